@@ -3,6 +3,8 @@ package admin
 import (
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
 	"github.com/gorilla/mux"
@@ -10,6 +12,10 @@ import (
 
 type AdminApi struct {
 	http.Server
+
+	// Handlers mounted after Init, keyed by path prefix
+	mountsLock sync.RWMutex
+	mounts     map[string]http.Handler
 }
 
 func (a *AdminApi) Init(name string) error {
@@ -25,9 +31,43 @@ func (a *AdminApi) Init(name string) error {
 	// Add admin handlers to the admin only http server and start it
 	router.Path("/metrics").Handler(metricsHandler)
 
+	// Sub-services mount their handlers once initialized, which may be after Serve
+	router.NotFoundHandler = http.HandlerFunc(a.serveMounted)
+
 	return err
 }
 
+// Mount serves handler for every request whose path starts with prefix.
+// Unlike routes added in Init, it is safe to call while the server is serving.
+func (a *AdminApi) Mount(prefix string, handler http.Handler) {
+	a.mountsLock.Lock()
+	defer a.mountsLock.Unlock()
+
+	if a.mounts == nil {
+		a.mounts = make(map[string]http.Handler)
+	}
+	a.mounts[prefix] = handler
+}
+
+func (a *AdminApi) serveMounted(w http.ResponseWriter, r *http.Request) {
+	a.mountsLock.RLock()
+	var handler http.Handler
+	longest := -1
+	for prefix, h := range a.mounts {
+		if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > longest {
+			handler = h
+			longest = len(prefix)
+		}
+	}
+	a.mountsLock.RUnlock()
+
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
 func (a *AdminApi) Serve(l net.Listener) error {
 	a.Addr = l.Addr().String()
 	return a.Server.Serve(l)
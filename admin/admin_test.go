@@ -63,3 +63,58 @@ func TestAdminStartStop(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestAdminMount(t *testing.T) {
+
+	ctx := setup(t)
+	a := AdminApi{}
+	err := a.Init("admin_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = a.Serve(listener)
+	}()
+	defer func() {
+		_ = a.Shutdown(ctx)
+	}()
+
+	get := func(path string) int {
+		resp, err := http.Get("http://" + listener.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get("/usage/report"); code != http.StatusNotFound {
+		t.Fatal("Expected 404 before mounting, got", code)
+	}
+
+	// Mount while serving
+	a.Mount("/usage", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	a.Mount("/usage/special", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	if code := get("/usage/report"); code != http.StatusTeapot {
+		t.Fatal("Expected the mounted handler to reply, got", code)
+	}
+	if code := get("/usage/special/report"); code != http.StatusAccepted {
+		t.Fatal("Expected the longest prefix to win, got", code)
+	}
+	if code := get("/metrics"); code != http.StatusOK {
+		t.Fatal("Expected /metrics to be unaffected, got", code)
+	}
+	if code := get("/other"); code != http.StatusNotFound {
+		t.Fatal("Expected 404 for unmounted paths, got", code)
+	}
+}
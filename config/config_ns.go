@@ -7,9 +7,13 @@ import (
 	"flag"
 	"fmt"
 	"github.com/ethereum/go-ethereum/common"
+	"math"
 	"net/url"
 	"os"
 	"strings"
+	"time"
+	// Report time zones are loaded on hosts without a zoneinfo database too
+	_ "time/tzdata"
 
 	"github.com/pkg/errors"
 )
@@ -42,23 +46,98 @@ func (c *CredentialSecrets) Set(arg string) error {
 }
 
 type Config struct {
-	BeaconURL            *url.URL
-	ExecutionURL         *url.URL
-	ListenAddr           string
-	APIListenAddr        string
-	AdminListenAddr      string
-	GRPCListenAddr       string
-	GRPCBeaconAddr       string
-	GRPCTLSCertFile      string
-	GRPCTLSKeyFile       string
-	RocketStorageAddr    string
-	SWVaultsRegistryAddr string
-	CredentialSecrets    CredentialSecrets
-	CachePath            string
-	EnableSoloValidators bool
-	Debug                bool
-	ForceBNJSON          bool
-	FeeRecipient         string
+	BeaconURL             *url.URL
+	ExecutionURL          *url.URL
+	ListenAddr            string
+	APIListenAddr         string
+	AdminListenAddr       string
+	GRPCListenAddr        string
+	GRPCBeaconAddr        string
+	GRPCTLSCertFile       string
+	GRPCTLSKeyFile        string
+	RocketStorageAddr     string
+	SWVaultsRegistryAddr  string
+	CredentialSecrets     CredentialSecrets
+	CachePath             string
+	EnableSoloValidators  bool
+	Debug                 bool
+	ForceBNJSON           bool
+	FeeRecipient          string
+	UsageDSN              string
+	UsageReadDSN          string
+	UsageModel            string
+	UsageSessionIdle      time.Duration
+	UsagePrecision        time.Duration
+	UsageBoundaryGrace    time.Duration
+	UsageCoalesce         bool
+	UsageOccupancy        bool
+	UsageMaxOpenConns     int
+	UsageMaxIdleConns     int
+	UsageConnMaxLifetime  time.Duration
+	UsageConnMaxIdleTime  time.Duration
+	UsageTxLock           string
+	UsageConflictPolicy   string
+	UsageWriteRetries     int
+	UsageClockSkew        string
+	UsageCommitPeriod     time.Duration
+	UsageCommitWebhook    string
+	ReportSigningKey      string
+	UsageRetention        time.Duration
+	UsageMinimize         bool
+	UsagePseudonymKey     []byte
+	UsageDutyCoverage     bool
+	UsageMissedWebhook    string
+	LoadElevatedVals      int
+	LoadOverloadVals      int
+	LoadElevatedLatency   time.Duration
+	LoadOverloadLatency   time.Duration
+	UsageEventLog         string
+	UsageEventLogSize     int64
+	UsageEventLogAge      time.Duration
+	UsageEventLogBackups  int
+	UsageEventInstance    string
+	UsageFaults           string
+	UsageRecordingRules   string
+	UsageRollout          string
+	UsageSLOWriteSuccess  float64
+	UsageSLOWriteLatency  time.Duration
+	UsageSLOLatencyTarget float64
+	UsageSLOSpoolFree     float64
+	UsageShadowDSN        string
+	UsageShadowModel      string
+	UsageShadowTolerance  time.Duration
+	UsageOwnershipPeriod  time.Duration
+	UsageOwnershipRefresh time.Duration
+	UsageOwnershipWebhook string
+	AdminUndoWindow       time.Duration
+	PublicListenAddr      string
+	UsageReportTimeZone   *time.Location
+	UsageMetadataPeriod   time.Duration
+	UsageWarmUpWindow     time.Duration
+	UsageStartupPolicy    string
+	UsageStartupRetry     time.Duration
+	UsageInfluxURL        string
+	UsageInfluxOrg        string
+	UsageInfluxBucket     string
+	UsageInfluxToken      string
+	UsageInfluxFlush      time.Duration
+	UsageOperatorDaily    time.Duration
+	AdminQueryCostLimit   int64
+	AdminIdempotency      time.Duration
+	TenantListenAddr      string
+	UsageMultiTenant      bool
+	UsageDeepTracking     float64
+	UsageWriteQueue       int
+	AdminBreakerFailures  int
+	AdminBreakerCooldown  time.Duration
+	AdminBreakerSlowRead  time.Duration
+	MemoryBudget          int
+	MemoryBudgetCaches    string
+	PolicyWebhook         string
+	PolicyWebhookFormat   string
+	PolicyWebhookTimeout  time.Duration
+	PolicyWebhookTTL      time.Duration
+	PolicyFailClosed      bool
 }
 
 func InitFlags() *Config {
@@ -88,6 +167,81 @@ Use 'dd if=/dev/urandom bs=4 count=8 | base64' if you need to generate a new sec
 	forceBNJSONFlag := flag.Bool("force-bn-json", false, "Disables SSZ in the BN.")
 	swiseVaultsRegistryAddrFlag := flag.String("swise-vaults-registry-addr", "0x3a0008a588772446f6e656133C2D5029CC4FC20E", "Address of the Stakewise Vaults Registry contract. Defaults to mainnet. Pass empty string to disable.")
 	feeRecipientFlag := flag.String("fee-recipient", "0x48319f97E5Da1233c21c48b80097c0FB7a20Ff86", "Required fee recipient for validators")
+	usageDSNFlag := flag.String("usage-db", "file:nodeset-usage.db?cache=shared", "DSN of the database validator usage is recorded to")
+	usageReadDSNFlag := flag.String("usage-db-read", "", "Optional DSN of a read replica used to view validator usage. Reads may lag behind recent writes.")
+	usageModelFlag := flag.String("usage-model", "buckets", "How validator usage is accounted for: buckets quantizes activity into -usage-precision wide buckets, sessions measures the time between first and last activity, hybrid records both and reconciles them on the admin API.")
+	usageSessionIdleFlag := flag.Duration("usage-session-idle-timeout", 15*time.Minute, "With -usage-model=sessions or hybrid, activity further apart than this starts a new session.")
+	usagePrecisionFlag := flag.Duration("usage-precision", 5*time.Minute, "Width of the buckets validator usage is quantized into. Must be between 1s and 24h.")
+	usageBoundaryGraceFlag := flag.Duration("usage-boundary-grace", 0, "Activity this close after a bucket boundary isn't recorded for validators active this close before it. Must be less than half of -usage-precision. 0 disables it.")
+	usageMultiTenantFlag := flag.Bool("usage-multi-tenant", false, "Record usage for the organization of the node it's made by, and skip usage of nodes outside every organization. The tenant API then only reads an organization's own records. Requires -usage-model=buckets.")
+	usageDeepTrackingFlag := flag.Float64("usage-deep-tracking-rate", 0, "Fraction of validators, between 0 and 1, whose every recorded request is kept with its endpoint and duration for debugging, selected by a stable hash. 0 disables deep tracking. Requires a SQL usage tracker and is unavailable with -usage-minimize.")
+	usageOccupancyFlag := flag.Bool("usage-occupancy", false, "Credit each bucket with the time between the validator's first and last activity in it, plus a slot, instead of the full -usage-precision, so validators active once per bucket aren't over-credited. Requires -usage-model=buckets or hybrid and is unavailable with -usage-coalesce.")
+	usageWriteQueueFlag := flag.Int("usage-write-queue", 0, "Size of a queue usage is written through in the background, so requests never wait on the usage database. Usage overflowing the queue is spooled in memory. 0 writes usage synchronously. Unavailable with -usage-multi-tenant.")
+	usageCoalesceFlag := flag.Bool("usage-coalesce", false, "Skip usage writes for validators this instance already recorded in the current bucket. Reduces database load at high request volumes without changing usage.")
+	usageMaxOpenConnsFlag := flag.Int("usage-db-max-open-conns", 0, "Maximum open connections per usage database. 0 uses the backend default.")
+	usageMaxIdleConnsFlag := flag.Int("usage-db-max-idle-conns", 0, "Maximum idle connections per usage database. 0 uses the backend default.")
+	usageConnMaxLifetimeFlag := flag.Duration("usage-db-conn-max-lifetime", 0, "Maximum lifetime of a usage database connection. 0 keeps connections forever.")
+	usageConnMaxIdleTimeFlag := flag.Duration("usage-db-conn-max-idle-time", 0, "Maximum idle time of a usage database connection. 0 keeps idle connections forever.")
+	usageTxLockFlag := flag.String("usage-db-tx-lock", "", "SQLite locking mode of usage write transactions: deferred, immediate or exclusive. Empty uses the driver default, and usage is written outside any transaction.")
+	usageConflictPolicyFlag := flag.String("usage-db-conflict-policy", "ignore", "What writes of a bucket another instance already recorded do: ignore keeps the recorded bucket, replace overwrites it. replace is unavailable with -usage-occupancy.")
+	usageClockSkewFlag := flag.String("usage-clock-skew-policy", "clamp", "What to do with usage recorded while the wall clock is behind previously recorded usage: clamp, warn or drop.")
+	usageWriteRetriesFlag := flag.Int("usage-db-write-retries", 3, "How many times a usage write is retried when the database is locked by another writer. Negative disables retries.")
+	usageCommitPeriodFlag := flag.Duration("usage-commitment-period", 0, "How often a Merkle root over the previous period's usage records is published. 0 disables it.")
+	usageCommitWebhookFlag := flag.String("usage-commitment-webhook", "", "Optional URL usage commitments are POSTed to as JSON.")
+	reportSigningKeyFlag := flag.String("report-signing-key", "", "Optional path to a hex-encoded secp256k1 private key used to sign exports and usage attestations. Both are disabled without it.")
+	usageRetentionFlag := flag.Duration("usage-retention", 0, "How long validator usage is kept. 0 keeps it forever, or 7 days with -usage-minimize. Organizations may override it with a longer retention.")
+	usageMinimizeFlag := flag.Bool("usage-minimize", false, "Data minimization mode: validator indices are stored as pseudonyms, node addresses aren't stored and usage is kept for -usage-retention only. Requires -usage-pseudonym-key.")
+	usageDutyCoverageFlag := flag.Bool("usage-duty-coverage", false, "Evaluate every epoch which attester and proposer duties of rescue-active validators were due while they used the rescue node. Requires -usage-model=buckets or hybrid.")
+	usageMissedWebhookFlag := flag.String("usage-missed-proposal-webhook", "", "Optional URL missed proposals of rescue-active validators are POSTed to as JSON. Requires -usage-duty-coverage.")
+	loadElevatedValsFlag := flag.Int("load-elevated-validators", 0, "Active validators at which load is elevated and bulk queries are shed. 0 disables the threshold.")
+	loadOverloadedValsFlag := flag.Int("load-overloaded-validators", 0, "Active validators at which the rescue node is overloaded and only duty-critical requests are served. 0 disables the threshold.")
+	loadElevatedLatencyFlag := flag.Duration("load-elevated-latency", 0, "Upstream beacon node latency at which load is elevated and bulk queries are shed. 0 disables the threshold.")
+	loadOverloadLatencyFlag := flag.Duration("load-overloaded-latency", 0, "Upstream beacon node latency at which the rescue node is overloaded and only duty-critical requests are served. 0 disables the threshold.")
+	memoryBudgetFlag := flag.Int("memory-budget", 0, "Megabytes the in-process caches (validator info, active validators, boundary grace, coalesced writes, usage spools) may use together, shared in fixed proportions. Full caches evict their least recently used entries or stop caching. 0 keeps the default limits.")
+	policyWebhookFlag := flag.String("policy-webhook", "", "Optional URL the node, credential tier, organization and daily usage of authenticated requests, except duty-critical ones, are POSTed to as JSON, answered with {\"allow\": bool, \"reason\": string}, so quotas can be decided by an external service. Requests it denies get a 429.")
+	policyWebhookFormatFlag := flag.String("policy-webhook-format", "json", "Wire format of -policy-webhook: json, or opa to query the data API of an Open Policy Agent server, e.g. -policy-webhook=http://localhost:8181/v1/data/rescue/decision, whose Rego rule gets the request as input and evaluates to a boolean or {\"allow\": bool, \"reason\": string}.")
+	policyWebhookTimeoutFlag := flag.Duration("policy-webhook-timeout", 2*time.Second, "How long -policy-webhook may take to answer before it counts as failed.")
+	policyWebhookTTLFlag := flag.Duration("policy-webhook-ttl", time.Minute, "How long the verdicts of -policy-webhook are cached per node and request priority. Failures are cached for at most 10s.")
+	policyFailClosedFlag := flag.Bool("policy-webhook-fail-closed", false, "Deny requests while -policy-webhook fails, instead of allowing them.")
+	memoryBudgetCachesFlag := flag.String("memory-budget-caches", "", "Optional limits in megabytes of individual caches, taken out of -memory-budget, e.g. validators=256,spool=64. Caches are validators, active, grace, coalesce, spool and untenanted.")
+	usageEventLogFlag := flag.String("usage-event-log", "", "Optional file every recorded usage event is appended to as a JSON line.")
+	usageEventLogSizeFlag := flag.Int64("usage-event-log-max-size", 100, "Size in megabytes at which -usage-event-log is rotated. 0 disables rotation by size.")
+	usageEventLogAgeFlag := flag.Duration("usage-event-log-max-age", 24*time.Hour, "How long -usage-event-log is written to before it's rotated. 0 disables rotation by age.")
+	usageEventLogBackupsFlag := flag.Int("usage-event-log-max-backups", 7, "How many rotated event logs are kept. 0 keeps them all.")
+	usageEventInstanceFlag := flag.String("usage-event-instance", "", "Identifies this proxy in usage events, so consumers can deduplicate them. Defaults to the hostname.")
+	usageInfluxURLFlag := flag.String("usage-influx-url", "", "Optional base URL of an InfluxDB v2 API, e.g. http://localhost:8086, every recorded usage event is written to as a point. Telegraf's influxdb_v2_listener works too. Requires -usage-influx-org and -usage-influx-bucket.")
+	usageInfluxOrgFlag := flag.String("usage-influx-org", "", "Organization of -usage-influx-url usage points are written to.")
+	usageInfluxBucketFlag := flag.String("usage-influx-bucket", "", "Bucket of -usage-influx-url usage points are written to.")
+	usageInfluxTokenFlag := flag.String("usage-influx-token", "", "Optional API token for -usage-influx-url.")
+	usageInfluxFlushFlag := flag.Duration("usage-influx-flush-interval", 10*time.Second, "How often usage points are written to -usage-influx-url.")
+	usageRecordingRulesFlag := flag.String("usage-recording-rules", "", "Optional YAML file of rules recording the usage of requests besides prepare_beacon_proposer, mapping methods and paths to where validator indices are read from.")
+	usageRolloutFlag := flag.String("usage-rollout", "", "Optional YAML file of stages enabling the usage write queue (write_queue) and the shadow backend (shadow) for a percentage of operators and listed node addresses only, so they can be rolled out gradually. Features without a stage are enabled for everyone.")
+	usageSLOWriteSuccessFlag := flag.Float64("usage-slo-write-success", 0.999, "Fraction of usage writes which must succeed, reported against by the /usage/slo admin endpoint.")
+	usageSLOWriteLatencyFlag := flag.Duration("usage-slo-write-latency", 500*time.Millisecond, "Usage writes slower than this, including the time spent in -usage-write-queue, count against -usage-slo-write-latency-target.")
+	usageSLOLatencyTargetFlag := flag.Float64("usage-slo-write-latency-target", 0.99, "Fraction of usage writes which must be faster than -usage-slo-write-latency.")
+	usageSLOSpoolFreeFlag := flag.Float64("usage-slo-spool-free", 0.99, "Fraction of hours in which usage mustn't be spooled because -usage-write-queue is full.")
+	usageOwnershipFlag := flag.Duration("usage-ownership-interval", 0, "How often the owners of recently active validators are snapshotted, so usage is attributed to the owner at the time. 0 disables it. Requires -usage-model=buckets or hybrid.")
+	usageOwnershipRefreshFlag := flag.Duration("usage-ownership-refresh-interval", 0, "How often the owners of every validator with an ownership history are re-resolved, active or not, so exited and relaunched minipools are detected. 0 disables it. Requires -usage-ownership-interval.")
+	usageOwnershipWebhookFlag := flag.String("usage-ownership-webhook", "", "Optional URL changes of validator owners are POSTed to as JSON, so usage aggregates can be corrected. Requires -usage-ownership-interval.")
+	tenantAddrFlag := flag.String("tenant-addr", "", "Optional address on which to reply to requests of organizations for their own usage, authenticated with the API keys issued on the admin API. For hosted deployments shared by several communities.")
+	publicAddrFlag := flag.String("public-addr", "", "Optional address on which to reply to unauthenticated requests for aggregate usage stats of the rescue node, and for the usage and credential expiry calendars of operators who opted in, e.g. for status pages and badges.")
+	usageOperatorDailyFlag := flag.Duration("usage-operator-daily-interval", 0, "How often the daily usage of each operator is aggregated into the usage database, for operator and organization dashboards. 0 disables it. Requires -usage-model=buckets or hybrid and is unavailable with -usage-minimize.")
+	usageMetadataFlag := flag.Duration("usage-validator-metadata-interval", 0, "How often the beacon chain metadata of recently active validators (status, activation and exit epochs, withdrawal credentials) is refreshed into the usage database, for reports. 0 disables it.")
+	usageStartupPolicyFlag := flag.String("usage-startup-policy", "fail-fast", "What to do when the usage database can't be initialized on startup: fail-fast exits, retry retries with backoff for -usage-startup-retry before exiting, degraded starts anyway and spools usage in memory until the database is reachable. degraded requires -usage-model=buckets or hybrid.")
+	usageStartupRetryFlag := flag.Duration("usage-startup-retry", 5*time.Minute, "How long -usage-startup-policy=retry retries for.")
+	usageWarmUpFlag := flag.Duration("usage-warmup-window", 0, "How much recent usage in-memory caches (validator info, active validators, coalesced writes) are loaded from on startup, before traffic is accepted. 0 disables it. Requires -usage-model=buckets or hybrid.")
+	usageReportTZFlag := flag.String("usage-report-timezone", "UTC", "IANA time zone days are bounded in by daily usage reports on the admin API, e.g. Europe/Berlin. Usage is stored in UTC regardless, requests may pick another zone.")
+	adminQueryCostFlag := flag.Int64("admin-query-cost-limit", 0, "Usage records an admin API query may be estimated to scan, from the length of its range and recent activity, before it's refused unless it passes force=true. 0 disables the limit. Requires -usage-model=buckets or hybrid.")
+	adminIdempotencyFlag := flag.Duration("admin-idempotency-window", 24*time.Hour, "How long the responses of mutating admin API requests made with an Idempotency-Key header are kept, so retries are replayed instead of applied twice. 0 disables idempotency keys. Requires a SQL usage tracker.")
+	adminBreakerFailuresFlag := flag.Int("admin-read-breaker-failures", 0, "Consecutive admin API reads failing or slower than -admin-read-breaker-slow after which reads are refused with a 503 for -admin-read-breaker-cooldown, so a sick usage database isn't hammered. Recording usage is unaffected. 0 disables the breaker.")
+	adminBreakerCooldownFlag := flag.Duration("admin-read-breaker-cooldown", 30*time.Second, "How long admin API reads are refused once the read breaker opens, before one is let through to probe the usage database.")
+	adminBreakerSlowFlag := flag.Duration("admin-read-breaker-slow", 10*time.Second, "Admin API reads taking longer than this count as failures of the read breaker. 0 only counts server errors.")
+	adminUndoWindowFlag := flag.Duration("admin-undo-window", 0, "How long deletions made on the admin API are staged before they're applied, so they can be cancelled. 0 applies them immediately.")
+	usageShadowDSNFlag := flag.String("usage-shadow-db", "", "Optional DSN of a database usage is also recorded to during a migration. Usage views are compared against it and discrepancies logged, the primary's answer is returned.")
+	usageShadowModelFlag := flag.String("usage-shadow-model", "", "Usage model of -usage-shadow-db. Defaults to -usage-model.")
+	usageShadowToleranceFlag := flag.Duration("usage-shadow-tolerance", 0, "Differences in a validator's usage up to this aren't reported as discrepancies with -usage-shadow-db.")
+	usageFaultsFlag := flag.String("usage-faults", "", "Faults injected into usage database operations, for resilience tests only, e.g. latency=50ms,jitter=20ms,busy=0.2,error=0.05,partial=0.05.")
+	usagePseudonymKeyFlag := flag.String("usage-pseudonym-key", "", "Base64-encoded secret of at least 32 bytes validator pseudonyms are derived from with -usage-minimize.")
 
 	flag.Parse()
 
@@ -169,6 +323,323 @@ Use 'dd if=/dev/urandom bs=4 count=8 | base64' if you need to generate a new sec
 		return nil
 	}
 
+	switch *usageModelFlag {
+	case "buckets", "sessions", "hybrid":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -usage-model: %s\n", *usageModelFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageSessionIdleFlag <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-session-idle-timeout: %v\n", *usageSessionIdleFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usagePrecisionFlag < time.Second || *usagePrecisionFlag > 24*time.Hour {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-precision: %v\nMust be between 1s and 24h.\n", *usagePrecisionFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageBoundaryGraceFlag < 0 || *usageBoundaryGraceFlag >= *usagePrecisionFlag/2 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-boundary-grace: %v\nMust be less than half of -usage-precision.\n", *usageBoundaryGraceFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageOccupancyFlag && (*usageModelFlag == "sessions" || *usageCoalesceFlag) {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-occupancy\nOccupancy requires -usage-model=buckets or hybrid and is unavailable with -usage-coalesce.\n")
+		os.Exit(1)
+		return nil
+	}
+
+	switch *usageTxLockFlag {
+	case "", "deferred", "immediate", "exclusive":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -usage-db-tx-lock: %s\n", *usageTxLockFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	switch *usageConflictPolicyFlag {
+	case "ignore":
+	case "replace":
+		if *usageOccupancyFlag {
+			fmt.Fprintf(os.Stderr, "Invalid -usage-db-conflict-policy: %s\nOccupancy merges the activity of conflicting writes.\n", *usageConflictPolicyFlag)
+			os.Exit(1)
+			return nil
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -usage-db-conflict-policy: %s\n", *usageConflictPolicyFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	switch *usageStartupPolicyFlag {
+	case "fail-fast", "retry":
+	case "degraded":
+		if *usageModelFlag == "sessions" {
+			fmt.Fprintf(os.Stderr, "Invalid -usage-startup-policy: %s\nSpooled usage can only be backfilled with -usage-model=buckets or hybrid.\n", *usageStartupPolicyFlag)
+			os.Exit(1)
+			return nil
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -usage-startup-policy: %s\n", *usageStartupPolicyFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageStartupRetryFlag <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-startup-retry: %v\n", *usageStartupRetryFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	switch *usageClockSkewFlag {
+	case "clamp", "warn", "drop":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -usage-clock-skew-policy: %s\n", *usageClockSkewFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageCommitPeriodFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-commitment-period: %v\n", *usageCommitPeriodFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageCommitWebhookFlag != "" {
+		u, err := url.Parse(*usageCommitWebhookFlag)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "Invalid -usage-commitment-webhook: %s\n", *usageCommitWebhookFlag)
+			os.Exit(1)
+			return nil
+		}
+	}
+
+	for name, target := range map[string]float64{
+		"usage-slo-write-success":        *usageSLOWriteSuccessFlag,
+		"usage-slo-write-latency-target": *usageSLOLatencyTargetFlag,
+		"usage-slo-spool-free":           *usageSLOSpoolFreeFlag,
+	} {
+		if math.IsNaN(target) || target <= 0 || target > 1 {
+			fmt.Fprintf(os.Stderr, "Invalid -%s: %v\nMust be above 0 and at most 1.\n", name, target)
+			os.Exit(1)
+			return nil
+		}
+	}
+
+	if *usageSLOWriteLatencyFlag <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-slo-write-latency: %v\n", *usageSLOWriteLatencyFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *reportSigningKeyFlag != "" {
+		if _, err := os.Stat(*reportSigningKeyFlag); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid -report-signing-key: %v\n", err)
+			os.Exit(1)
+			return nil
+		}
+	}
+
+	if *usageRetentionFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-retention: %v\n", *usageRetentionFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageOwnershipFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-ownership-interval: %v\n", *usageOwnershipFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageOwnershipRefreshFlag < 0 || (*usageOwnershipRefreshFlag > 0 && *usageOwnershipFlag == 0) {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-ownership-refresh-interval: %v\nIt requires -usage-ownership-interval.\n", *usageOwnershipRefreshFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageOwnershipWebhookFlag != "" {
+		u, err := url.Parse(*usageOwnershipWebhookFlag)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || *usageOwnershipFlag == 0 {
+			fmt.Fprintf(os.Stderr, "Invalid -usage-ownership-webhook: %s\nIt must be an http(s) URL and requires -usage-ownership-interval.\n", *usageOwnershipWebhookFlag)
+			os.Exit(1)
+			return nil
+		}
+	}
+
+	if *usageMetadataFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-validator-metadata-interval: %v\n", *usageMetadataFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageOperatorDailyFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-operator-daily-interval: %v\n", *usageOperatorDailyFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageWarmUpFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-warmup-window: %v\n", *usageWarmUpFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	usageReportTZ, err := time.LoadLocation(*usageReportTZFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-report-timezone: %v\n", err)
+		os.Exit(1)
+		return nil
+	}
+
+	if *adminQueryCostFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -admin-query-cost-limit: %d\n", *adminQueryCostFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *adminIdempotencyFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -admin-idempotency-window: %v\n", *adminIdempotencyFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *policyWebhookFlag != "" {
+		u, err := url.Parse(*policyWebhookFlag)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "Invalid -policy-webhook: %s\nIt must be an http(s) URL.\n", *policyWebhookFlag)
+			os.Exit(1)
+			return nil
+		}
+	}
+
+	switch *policyWebhookFormatFlag {
+	case "json", "opa":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid -policy-webhook-format: %s\n", *policyWebhookFormatFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *policyWebhookTimeoutFlag <= 0 || *policyWebhookTTLFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -policy-webhook-timeout or -policy-webhook-ttl: %v, %v\n", *policyWebhookTimeoutFlag, *policyWebhookTTLFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *memoryBudgetFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -memory-budget: %d\n", *memoryBudgetFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageWriteQueueFlag < 0 || (*usageWriteQueueFlag > 0 && *usageMultiTenantFlag) {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-write-queue: %d\nMust not be negative, and is unavailable with -usage-multi-tenant.\n", *usageWriteQueueFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if math.IsNaN(*usageDeepTrackingFlag) || *usageDeepTrackingFlag < 0 || *usageDeepTrackingFlag > 1 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-deep-tracking-rate: %v\nMust be between 0 and 1.\n", *usageDeepTrackingFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *adminBreakerFailuresFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -admin-read-breaker-failures: %d\n", *adminBreakerFailuresFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *adminBreakerCooldownFlag <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -admin-read-breaker-cooldown: %v\n", *adminBreakerCooldownFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *adminBreakerSlowFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -admin-read-breaker-slow: %v\n", *adminBreakerSlowFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *adminUndoWindowFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -admin-undo-window: %v\n", *adminUndoWindowFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageMinimizeFlag {
+		key, err := base64.StdEncoding.DecodeString(*usagePseudonymKeyFlag)
+		if err != nil || len(key) < 32 {
+			fmt.Fprintf(os.Stderr, "Invalid -usage-pseudonym-key\n-usage-minimize requires a base64-encoded secret of at least 32 bytes.\n")
+			os.Exit(1)
+			return nil
+		}
+		config.UsagePseudonymKey = key
+	}
+
+	if *usageDutyCoverageFlag && (*usageMinimizeFlag || *usageModelFlag == "sessions") {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-duty-coverage\nDuty coverage requires -usage-model=buckets or hybrid and is unavailable with -usage-minimize.\n")
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageMissedWebhookFlag != "" {
+		u, err := url.Parse(*usageMissedWebhookFlag)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || !*usageDutyCoverageFlag {
+			fmt.Fprintf(os.Stderr, "Invalid -usage-missed-proposal-webhook: %s\nIt must be an http(s) URL and requires -usage-duty-coverage.\n", *usageMissedWebhookFlag)
+			os.Exit(1)
+			return nil
+		}
+	}
+
+	if *loadElevatedValsFlag < 0 || *loadOverloadedValsFlag < 0 ||
+		(*loadElevatedValsFlag > 0 && *loadOverloadedValsFlag > 0 && *loadElevatedValsFlag > *loadOverloadedValsFlag) {
+		fmt.Fprintf(os.Stderr, "Invalid -load-elevated-validators or -load-overloaded-validators: %d, %d\n", *loadElevatedValsFlag, *loadOverloadedValsFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *loadElevatedLatencyFlag < 0 || *loadOverloadLatencyFlag < 0 ||
+		(*loadElevatedLatencyFlag > 0 && *loadOverloadLatencyFlag > 0 && *loadElevatedLatencyFlag > *loadOverloadLatencyFlag) {
+		fmt.Fprintf(os.Stderr, "Invalid -load-elevated-latency or -load-overloaded-latency: %v, %v\n", *loadElevatedLatencyFlag, *loadOverloadLatencyFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageEventLogSizeFlag < 0 || *usageEventLogAgeFlag < 0 || *usageEventLogBackupsFlag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -usage-event-log-max-size, -usage-event-log-max-age or -usage-event-log-max-backups: %d, %v, %d\n",
+			*usageEventLogSizeFlag, *usageEventLogAgeFlag, *usageEventLogBackupsFlag)
+		os.Exit(1)
+		return nil
+	}
+
+	if *usageInfluxURLFlag != "" {
+		u, err := url.Parse(*usageInfluxURLFlag)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "Invalid -usage-influx-url: %s\n", *usageInfluxURLFlag)
+			os.Exit(1)
+			return nil
+		}
+		if *usageInfluxOrgFlag == "" || *usageInfluxBucketFlag == "" {
+			fmt.Fprintf(os.Stderr, "Invalid -usage-influx-org or -usage-influx-bucket\n-usage-influx-url requires both.\n")
+			os.Exit(1)
+			return nil
+		}
+		if *usageInfluxFlushFlag <= 0 {
+			fmt.Fprintf(os.Stderr, "Invalid -usage-influx-flush-interval: %v\n", *usageInfluxFlushFlag)
+			os.Exit(1)
+			return nil
+		}
+	}
+
 	if *feeRecipientFlag == "" {
 		fmt.Fprintf(os.Stderr, "Invalid -fee-recipient: %s\n", *feeRecipientFlag)
 		flag.PrintDefaults()
@@ -192,5 +663,79 @@ Use 'dd if=/dev/urandom bs=4 count=8 | base64' if you need to generate a new sec
 	config.Debug = *debug
 	config.ForceBNJSON = *forceBNJSONFlag
 	config.SWVaultsRegistryAddr = *swiseVaultsRegistryAddrFlag
+	config.UsageDSN = *usageDSNFlag
+	config.UsageReadDSN = *usageReadDSNFlag
+	config.UsageModel = *usageModelFlag
+	config.UsageSessionIdle = *usageSessionIdleFlag
+	config.UsagePrecision = *usagePrecisionFlag
+	config.UsageBoundaryGrace = *usageBoundaryGraceFlag
+	config.UsageCoalesce = *usageCoalesceFlag
+	config.UsageOccupancy = *usageOccupancyFlag
+	config.UsageMaxOpenConns = *usageMaxOpenConnsFlag
+	config.UsageMaxIdleConns = *usageMaxIdleConnsFlag
+	config.UsageConnMaxLifetime = *usageConnMaxLifetimeFlag
+	config.UsageConnMaxIdleTime = *usageConnMaxIdleTimeFlag
+	config.UsageTxLock = *usageTxLockFlag
+	config.UsageConflictPolicy = *usageConflictPolicyFlag
+	config.UsageWriteRetries = *usageWriteRetriesFlag
+	config.UsageClockSkew = *usageClockSkewFlag
+	config.UsageCommitPeriod = *usageCommitPeriodFlag
+	config.UsageCommitWebhook = *usageCommitWebhookFlag
+	config.ReportSigningKey = *reportSigningKeyFlag
+	config.UsageRetention = *usageRetentionFlag
+	config.UsageMinimize = *usageMinimizeFlag
+	config.UsageDutyCoverage = *usageDutyCoverageFlag
+	config.UsageMissedWebhook = *usageMissedWebhookFlag
+	config.LoadElevatedVals = *loadElevatedValsFlag
+	config.LoadOverloadVals = *loadOverloadedValsFlag
+	config.LoadElevatedLatency = *loadElevatedLatencyFlag
+	config.LoadOverloadLatency = *loadOverloadLatencyFlag
+	config.UsageEventLog = *usageEventLogFlag
+	config.UsageEventLogSize = *usageEventLogSizeFlag * 1024 * 1024
+	config.UsageEventLogAge = *usageEventLogAgeFlag
+	config.UsageEventLogBackups = *usageEventLogBackupsFlag
+	config.UsageEventInstance = *usageEventInstanceFlag
+	config.UsageFaults = *usageFaultsFlag
+	config.UsageRecordingRules = *usageRecordingRulesFlag
+	config.UsageRollout = *usageRolloutFlag
+	config.UsageSLOWriteSuccess = *usageSLOWriteSuccessFlag
+	config.UsageSLOWriteLatency = *usageSLOWriteLatencyFlag
+	config.UsageSLOLatencyTarget = *usageSLOLatencyTargetFlag
+	config.UsageSLOSpoolFree = *usageSLOSpoolFreeFlag
+	config.UsageShadowDSN = *usageShadowDSNFlag
+	config.UsageShadowModel = *usageShadowModelFlag
+	config.UsageShadowTolerance = *usageShadowToleranceFlag
+	config.UsageOwnershipPeriod = *usageOwnershipFlag
+	config.UsageOwnershipRefresh = *usageOwnershipRefreshFlag
+	config.UsageOwnershipWebhook = *usageOwnershipWebhookFlag
+	config.AdminUndoWindow = *adminUndoWindowFlag
+	config.PublicListenAddr = *publicAddrFlag
+	config.UsageReportTimeZone = usageReportTZ
+	config.UsageMetadataPeriod = *usageMetadataFlag
+	config.UsageWarmUpWindow = *usageWarmUpFlag
+	config.UsageStartupPolicy = *usageStartupPolicyFlag
+	config.UsageStartupRetry = *usageStartupRetryFlag
+	config.UsageInfluxURL = *usageInfluxURLFlag
+	config.UsageInfluxOrg = *usageInfluxOrgFlag
+	config.UsageInfluxBucket = *usageInfluxBucketFlag
+	config.UsageInfluxToken = *usageInfluxTokenFlag
+	config.UsageInfluxFlush = *usageInfluxFlushFlag
+	config.UsageOperatorDaily = *usageOperatorDailyFlag
+	config.AdminQueryCostLimit = *adminQueryCostFlag
+	config.AdminIdempotency = *adminIdempotencyFlag
+	config.TenantListenAddr = *tenantAddrFlag
+	config.UsageMultiTenant = *usageMultiTenantFlag
+	config.UsageDeepTracking = *usageDeepTrackingFlag
+	config.UsageWriteQueue = *usageWriteQueueFlag
+	config.AdminBreakerFailures = *adminBreakerFailuresFlag
+	config.AdminBreakerCooldown = *adminBreakerCooldownFlag
+	config.AdminBreakerSlowRead = *adminBreakerSlowFlag
+	config.MemoryBudget = *memoryBudgetFlag
+	config.MemoryBudgetCaches = *memoryBudgetCachesFlag
+	config.PolicyWebhook = *policyWebhookFlag
+	config.PolicyWebhookFormat = *policyWebhookFormatFlag
+	config.PolicyWebhookTimeout = *policyWebhookTimeoutFlag
+	config.PolicyWebhookTTL = *policyWebhookTTLFlag
+	config.PolicyFailClosed = *policyFailClosedFlag
 	return config
 }
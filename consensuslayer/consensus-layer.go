@@ -44,6 +44,9 @@ type CachingConsensusLayer struct {
 	// Force attestantio client to use json
 	forceJSON bool
 
+	// Maximum size of the validator cache in MB, defaults to 512
+	ValidatorCacheSize int
+
 	m             *metrics.MetricsRegistry
 	slotsPerEpoch uint64
 }
@@ -128,6 +131,9 @@ func (c *CachingConsensusLayer) Init(ctx context.Context) error {
 	validatorCacheConfig.CleanWindow = 30 * time.Second
 	validatorCacheConfig.Shards = 32
 	validatorCacheConfig.HardMaxCacheSize = 512
+	if c.ValidatorCacheSize > 0 {
+		validatorCacheConfig.HardMaxCacheSize = c.ValidatorCacheSize
+	}
 
 	c.validatorCache, err = newValidatorCache(ctx, validatorCacheConfig)
 	if err != nil {
@@ -215,6 +221,71 @@ func (c *CachingConsensusLayer) GetValidatorInfo(validatorIndices []string) (map
 	return out, nil
 }
 
+// GetValidatorIndices maps validator pubkeys to indices. Unknown pubkeys are omitted.
+// Responses aren't cached, callers should only look up pubkeys they can't otherwise index.
+func (c *CachingConsensusLayer) GetValidatorIndices(pubkeys []rptypes.ValidatorPubkey) (map[rptypes.ValidatorPubkey]string, error) {
+	out := make(map[rptypes.ValidatorPubkey]string, len(pubkeys))
+	if len(pubkeys) == 0 {
+		return out, nil
+	}
+
+	query := make([]phase0.BLSPubKey, 0, len(pubkeys))
+	for _, pubkey := range pubkeys {
+		query = append(query, phase0.BLSPubKey(pubkey))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := c.client.Validators(ctx, &api.ValidatorsOpts{
+		State:   "head",
+		PubKeys: query,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for index, validator := range resp.Data {
+		out[rptypes.ValidatorPubkey(validator.Validator.PublicKey)] = strconv.FormatUint(uint64(index), 10)
+	}
+
+	return out, nil
+}
+
+// GetValidatorStates gets the head state of validators by index. Unknown indices are omitted.
+// Responses aren't cached, callers should keep what they need.
+func (c *CachingConsensusLayer) GetValidatorStates(validatorIndices []string) (map[string]*apiv1.Validator, error) {
+	out := make(map[string]*apiv1.Validator, len(validatorIndices))
+	if len(validatorIndices) == 0 {
+		return out, nil
+	}
+
+	query := make([]phase0.ValidatorIndex, 0, len(validatorIndices))
+	for _, validatorIndex := range validatorIndices {
+		index, err := strconv.ParseUint(validatorIndex, 10, 64)
+		if err != nil {
+			c.logger.Warn("Invalid validator index", zap.String("index", validatorIndex))
+			continue
+		}
+		query = append(query, phase0.ValidatorIndex(index))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	resp, err := c.client.Validators(ctx, &api.ValidatorsOpts{
+		State:   "head",
+		Indices: query,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for index, validator := range resp.Data {
+		out[strconv.FormatUint(uint64(index), 10)] = validator
+	}
+
+	return out, nil
+}
+
 // GetValidators gets the list of all validators for the finalized state
 // It does no caching- the response is large, so caching should be done downstream, for the data the caller cares about.
 func (c *CachingConsensusLayer) GetValidators() ([]*apiv1.Validator, error) {
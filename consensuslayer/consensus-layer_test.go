@@ -11,6 +11,8 @@ import (
 	"time"
 
 	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	rptypes "github.com/rocket-pool/rocketpool-go/types"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -156,6 +158,86 @@ func TestGetValidatorInfo(t *testing.T) {
 	t.Cleanup(cct.ccl.Deinit)
 }
 
+func TestGetValidatorIndices(t *testing.T) {
+	s := httptest.NewServer(&mockHandler{
+		t: t,
+		h: func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.String() {
+			case "/eth/v1/beacon/states/head/validators":
+				_, _ = fmt.Fprintf(w, `{"execution_optimistic":false,"data":[{"index":"100","balance":"32005252956","status":"active_ongoing","validator":{"pubkey":"0xb5bc96b70df0dfcc252c9ff0d1b42cb6dc0d55f8defa474dc0a5c7e0402c241e2850fea9c582e276b638b3c2c3a5ec55","withdrawal_credentials":"0x010000000000000000000000801e880e2e9aa87b20c9cc9ebf7375adb11eac21","effective_balance":"32000000000","slashed":false,"activation_eligibility_epoch":"0","activation_epoch":"0","exit_epoch":"18446744073709551615","withdrawable_epoch":"18446744073709551615"}}]}`)
+				return
+			}
+			panic("unhandled - " + r.URL.String())
+		},
+	})
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cct := setup(t, u)
+	err = cct.ccl.Init(cct.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cct.ccl.Deinit)
+
+	known, err := rptypes.HexToValidatorPubkey("b5bc96b70df0dfcc252c9ff0d1b42cb6dc0d55f8defa474dc0a5c7e0402c241e2850fea9c582e276b638b3c2c3a5ec55")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := rptypes.HexToValidatorPubkey("aa160542c2b1b9dbf5e11ca044067526c6dfff65efba88ea483d49bdbe478ab7489f8b1a903ea22b6d30cfa57626ca9e")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indices, err := cct.ccl.GetValidatorIndices([]rptypes.ValidatorPubkey{known, unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indices) != 1 || indices[known] != "100" {
+		t.Fatalf("Unexpected indices %v", indices)
+	}
+}
+
+func TestGetValidatorStates(t *testing.T) {
+	s := httptest.NewServer(&mockHandler{
+		t: t,
+		h: func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.String() {
+			case "/eth/v1/beacon/states/head/validators":
+				_, _ = fmt.Fprintf(w, `{"execution_optimistic":false,"data":[{"index":"100","balance":"32005252956","status":"active_ongoing","validator":{"pubkey":"0xb5bc96b70df0dfcc252c9ff0d1b42cb6dc0d55f8defa474dc0a5c7e0402c241e2850fea9c582e276b638b3c2c3a5ec55","withdrawal_credentials":"0x010000000000000000000000801e880e2e9aa87b20c9cc9ebf7375adb11eac21","effective_balance":"32000000000","slashed":false,"activation_eligibility_epoch":"0","activation_epoch":"12","exit_epoch":"18446744073709551615","withdrawable_epoch":"18446744073709551615"}}]}`)
+				return
+			}
+			panic("unhandled - " + r.URL.String())
+		},
+	})
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cct := setup(t, u)
+	err = cct.ccl.Init(cct.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cct.ccl.Deinit)
+
+	states, err := cct.ccl.GetValidatorStates([]string{"100", "invalid"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(states) != 1 || states["100"] == nil {
+		t.Fatalf("Unexpected states %v", states)
+	}
+	if states["100"].Validator.ActivationEpoch != 12 || states["100"].Status != apiv1.ValidatorStateActiveOngoing {
+		t.Fatalf("Unexpected state %+v", states["100"])
+	}
+}
+
 func TestGetValidatorCached(t *testing.T) {
 	once := false
 	s := httptest.NewServer(&mockHandler{
@@ -0,0 +1,151 @@
+package consensuslayer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/attestantio/go-eth2-client/api"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+)
+
+// DutyKind is the kind of a validator duty
+type DutyKind string
+
+const (
+	DutyAttester DutyKind = "attester"
+	DutyProposer DutyKind = "proposer"
+)
+
+// Duty is a slot in which a validator is expected to attest or propose
+type Duty struct {
+	ValidatorIndex string
+	Slot           uint64
+	Kind           DutyKind
+}
+
+// ChainTiming converts between slots and wall clock time
+type ChainTiming struct {
+	Genesis       time.Time
+	SlotDuration  time.Duration
+	SlotsPerEpoch uint64
+}
+
+// SlotTime returns the start of a slot
+func (t ChainTiming) SlotTime(slot uint64) time.Time {
+	return t.Genesis.Add(time.Duration(slot) * t.SlotDuration)
+}
+
+// EpochTime returns the start of an epoch
+func (t ChainTiming) EpochTime(epoch uint64) time.Time {
+	return t.SlotTime(epoch * t.SlotsPerEpoch)
+}
+
+// EpochAt returns the epoch in progress at a time, or 0 before genesis
+func (t ChainTiming) EpochAt(at time.Time) uint64 {
+	if at.Before(t.Genesis) {
+		return 0
+	}
+	return uint64(at.Sub(t.Genesis)/t.SlotDuration) / t.SlotsPerEpoch
+}
+
+// DutiesProvider looks up validator duties and whether they were fulfilled
+type DutiesProvider interface {
+	ChainTiming(ctx context.Context) (ChainTiming, error)
+	GetDuties(ctx context.Context, epoch uint64, validatorIndices []string) ([]Duty, error)
+	BlockProposed(ctx context.Context, slot uint64) (bool, error)
+}
+
+// ChainTiming returns the genesis time and slot configuration of the beacon chain
+func (c *CachingConsensusLayer) ChainTiming(ctx context.Context) (ChainTiming, error) {
+	genesis, err := c.client.GenesisTime(ctx)
+	if err != nil {
+		return ChainTiming{}, err
+	}
+
+	slotDuration, err := c.client.SlotDuration(ctx)
+	if err != nil {
+		return ChainTiming{}, err
+	}
+
+	return ChainTiming{
+		Genesis:       genesis,
+		SlotDuration:  slotDuration,
+		SlotsPerEpoch: c.slotsPerEpoch,
+	}, nil
+}
+
+// GetDuties returns the attester and proposer duties of the given validators in an epoch.
+// It isn't cached, since callers look up each epoch once.
+func (c *CachingConsensusLayer) GetDuties(ctx context.Context, epoch uint64, validatorIndices []string) ([]Duty, error) {
+	if len(validatorIndices) == 0 {
+		return nil, nil
+	}
+
+	indices := make([]phase0.ValidatorIndex, 0, len(validatorIndices))
+	for _, validatorIndex := range validatorIndices {
+		index, err := strconv.ParseUint(validatorIndex, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid validator index %s: %w", validatorIndex, err)
+		}
+		indices = append(indices, phase0.ValidatorIndex(index))
+	}
+
+	attesters, err := c.client.AttesterDuties(ctx, &api.AttesterDutiesOpts{
+		Epoch:   phase0.Epoch(epoch),
+		Indices: indices,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching attester duties: %w", err)
+	}
+
+	// The beacon API returns every proposer of the epoch, the client filters them
+	proposers, err := c.client.ProposerDuties(ctx, &api.ProposerDutiesOpts{
+		Epoch:   phase0.Epoch(epoch),
+		Indices: indices,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching proposer duties: %w", err)
+	}
+
+	out := make([]Duty, 0, len(attesters.Data)+len(proposers.Data))
+	for _, duty := range attesters.Data {
+		out = append(out, Duty{
+			ValidatorIndex: strconv.FormatUint(uint64(duty.ValidatorIndex), 10),
+			Slot:           uint64(duty.Slot),
+			Kind:           DutyAttester,
+		})
+	}
+	for _, duty := range proposers.Data {
+		out = append(out, Duty{
+			ValidatorIndex: strconv.FormatUint(uint64(duty.ValidatorIndex), 10),
+			Slot:           uint64(duty.Slot),
+			Kind:           DutyProposer,
+		})
+	}
+
+	c.m.Counter("duties_fetched").Add(float64(len(out)))
+
+	return out, nil
+}
+
+// BlockProposed returns whether the canonical chain has a block at slot
+func (c *CachingConsensusLayer) BlockProposed(ctx context.Context, slot uint64) (bool, error) {
+	_, err := c.client.BeaconBlockHeader(ctx, &api.BeaconBlockHeaderOpts{
+		Block: strconv.FormatUint(slot, 10),
+	})
+	if err == nil {
+		return true, nil
+	}
+
+	// Beacon nodes return 404 for empty slots
+	var apiErr *api.Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	return false, fmt.Errorf("error fetching block header: %w", err)
+}
@@ -0,0 +1,147 @@
+package consensuslayer
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChainTiming(t *testing.T) {
+	timing := ChainTiming{
+		Genesis:       time.Unix(1606824023, 0),
+		SlotDuration:  12 * time.Second,
+		SlotsPerEpoch: 32,
+	}
+
+	if got := timing.SlotTime(1); !got.Equal(time.Unix(1606824035, 0)) {
+		t.Fatalf("unexpected slot time %v", got)
+	}
+	if got := timing.EpochTime(2); !got.Equal(time.Unix(1606824023+2*32*12, 0)) {
+		t.Fatalf("unexpected epoch time %v", got)
+	}
+	if got := timing.EpochAt(timing.EpochTime(5).Add(-time.Second)); got != 4 {
+		t.Fatalf("expected epoch 4, got %d", got)
+	}
+	if got := timing.EpochAt(timing.EpochTime(5)); got != 5 {
+		t.Fatalf("expected epoch 5, got %d", got)
+	}
+	if got := timing.EpochAt(timing.Genesis.Add(-time.Hour)); got != 0 {
+		t.Fatalf("expected epoch 0 before genesis, got %d", got)
+	}
+}
+
+func TestGetDuties(t *testing.T) {
+	s := httptest.NewServer(&mockHandler{
+		t: t,
+		h: func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.String() {
+			case "/eth/v1/validator/duties/attester/100":
+				body, _ := io.ReadAll(r.Body)
+				if !strings.Contains(string(body), `"101"`) {
+					t.Errorf("unexpected attester duties request %s", body)
+				}
+				_, _ = fmt.Fprint(w, `{"dependent_root":"0x0000000000000000000000000000000000000000000000000000000000000000","execution_optimistic":false,"data":[{"pubkey":"0xaa160542c2b1b9dbf5e11ca044067526c6dfff65efba88ea483d49bdbe478ab7489f8b1a903ea22b6d30cfa57626ca9e","validator_index":"101","committee_index":"1","committee_length":"128","committees_at_slot":"64","validator_committee_index":"3","slot":"3205"}]}`)
+				return
+			case "/eth/v1/validator/duties/proposer/100":
+				_, _ = fmt.Fprint(w, `{"dependent_root":"0x0000000000000000000000000000000000000000000000000000000000000000","execution_optimistic":false,"data":[{"pubkey":"0xaa160542c2b1b9dbf5e11ca044067526c6dfff65efba88ea483d49bdbe478ab7489f8b1a903ea22b6d30cfa57626ca9e","validator_index":"101","slot":"3210"},{"pubkey":"0xb5bc96b70df0dfcc252c9ff0d1b42cb6dc0d55f8defa474dc0a5c7e0402c241e2850fea9c582e276b638b3c2c3a5ec55","validator_index":"100","slot":"3211"}]}`)
+				return
+			}
+			panic("unhandled - " + r.URL.String())
+		},
+	})
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cct := setup(t, u)
+	err = cct.ccl.Init(cct.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cct.ccl.Deinit)
+
+	duties, err := cct.ccl.GetDuties(cct.ctx, 100, []string{"101"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Duty{
+		{ValidatorIndex: "101", Slot: 3205, Kind: DutyAttester},
+		{ValidatorIndex: "101", Slot: 3210, Kind: DutyProposer},
+	}
+	if len(duties) != len(expected) {
+		t.Fatalf("expected %d duties, got %v", len(expected), duties)
+	}
+	for i, d := range expected {
+		if duties[i] != d {
+			t.Fatalf("expected duty %v, got %v", d, duties[i])
+		}
+	}
+
+	timing, err := cct.ccl.ChainTiming(cct.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !timing.Genesis.Equal(time.Unix(1606824023, 0)) || timing.SlotDuration != 12*time.Second || timing.SlotsPerEpoch != 32 {
+		t.Fatalf("unexpected chain timing %+v", timing)
+	}
+}
+
+func TestGetDutiesInvalidIndex(t *testing.T) {
+	ccl := &CachingConsensusLayer{}
+	if _, err := ccl.GetDuties(t.Context(), 1, []string{"0xabc"}); err == nil {
+		t.Fatal("expected an error for a non-numeric index")
+	}
+}
+
+func TestBlockProposed(t *testing.T) {
+	s := httptest.NewServer(&mockHandler{
+		t: t,
+		h: func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.String() {
+			case "/eth/v1/beacon/headers/3210":
+				_, _ = fmt.Fprint(w, `{"execution_optimistic":false,"finalized":true,"data":{"root":"0x0000000000000000000000000000000000000000000000000000000000000001","canonical":true,"header":{"message":{"slot":"3210","proposer_index":"101","parent_root":"0x0000000000000000000000000000000000000000000000000000000000000002","state_root":"0x0000000000000000000000000000000000000000000000000000000000000003","body_root":"0x0000000000000000000000000000000000000000000000000000000000000004"},"signature":"0x000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"}}}`)
+				return
+			case "/eth/v1/beacon/headers/3211":
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = fmt.Fprint(w, `{"code":404,"message":"Block header not found"}`)
+				return
+			case "/eth/v1/beacon/headers/3212":
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			panic("unhandled - " + r.URL.String())
+		},
+	})
+	t.Cleanup(s.Close)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cct := setup(t, u)
+	err = cct.ccl.Init(cct.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cct.ccl.Deinit)
+
+	proposed, err := cct.ccl.BlockProposed(cct.ctx, 3210)
+	if err != nil || !proposed {
+		t.Fatalf("Expected a block at slot 3210, got %v, %v", proposed, err)
+	}
+	proposed, err = cct.ccl.BlockProposed(cct.ctx, 3211)
+	if err != nil || proposed {
+		t.Fatalf("Expected no block at slot 3211, got %v, %v", proposed, err)
+	}
+	if _, err := cct.ccl.BlockProposed(cct.ctx, 3212); err == nil {
+		t.Fatal("Expected an error when the beacon node fails")
+	}
+}
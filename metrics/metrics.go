@@ -34,11 +34,16 @@ type MetricsMap[M registerable, O any] struct {
 // MetricsRegistry proves a per-module api for creating
 // and updating metrics
 type MetricsRegistry struct {
-	subsystem  string
-	counters   MetricsMap[prometheus.Counter, prometheus.CounterOpts]
-	gauges     MetricsMap[prometheus.Gauge, prometheus.GaugeOpts]
-	histograms MetricsMap[prometheus.Histogram, prometheus.HistogramOpts]
-	gaugeFuncs []prometheus.GaugeFunc
+	subsystem    string
+	labels       prometheus.Labels
+	counters     MetricsMap[prometheus.Counter, prometheus.CounterOpts]
+	gauges       MetricsMap[prometheus.Gauge, prometheus.GaugeOpts]
+	histograms   MetricsMap[prometheus.Histogram, prometheus.HistogramOpts]
+	gaugeFuncs   []prometheus.GaugeFunc
+	counterFuncs []prometheus.CounterFunc
+
+	gaugeVecsLock sync.Mutex
+	gaugeVecs     map[string]*prometheus.GaugeVec
 }
 
 // Init intializes the metrics package with the given namespace string.
@@ -87,6 +92,14 @@ func NewMetricsRegistry(subsystem string) *MetricsRegistry {
 	}
 }
 
+// NewLabeledMetricsRegistry creates a new MetricsRegistry whose metrics all carry the
+// given constant labels, so several instances of a module can share a process.
+func NewLabeledMetricsRegistry(subsystem string, labels prometheus.Labels) *MetricsRegistry {
+	out := NewMetricsRegistry(subsystem)
+	out.labels = labels
+	return out
+}
+
 func (r *MetricsRegistry) UnregisterAll() {
 	for _, m := range r.counters.m {
 		prometheus.DefaultRegisterer.Unregister(m)
@@ -100,6 +113,14 @@ func (r *MetricsRegistry) UnregisterAll() {
 	for _, m := range r.gaugeFuncs {
 		prometheus.DefaultRegisterer.Unregister(m)
 	}
+	for _, m := range r.counterFuncs {
+		prometheus.DefaultRegisterer.Unregister(m)
+	}
+	r.gaugeVecsLock.Lock()
+	defer r.gaugeVecsLock.Unlock()
+	for _, m := range r.gaugeVecs {
+		prometheus.DefaultRegisterer.Unregister(m)
+	}
 }
 
 func (m *MetricsMap[T, O]) value(name string, opts O) T {
@@ -137,9 +158,10 @@ func (m *MetricsMap[T, O]) value(name string, opts O) T {
 func (m *MetricsRegistry) Counter(name string) prometheus.Counter {
 
 	return m.counters.value(name, prometheus.CounterOpts{
-		Namespace: mtx.namespace,
-		Subsystem: m.subsystem,
-		Name:      name,
+		Namespace:   mtx.namespace,
+		Subsystem:   m.subsystem,
+		Name:        name,
+		ConstLabels: m.labels,
 	})
 }
 
@@ -148,29 +170,69 @@ func (m *MetricsRegistry) Counter(name string) prometheus.Counter {
 func (m *MetricsRegistry) Gauge(name string) prometheus.Gauge {
 
 	return m.gauges.value(name, prometheus.GaugeOpts{
-		Namespace: mtx.namespace,
-		Subsystem: m.subsystem,
-		Name:      name,
+		Namespace:   mtx.namespace,
+		Subsystem:   m.subsystem,
+		Name:        name,
+		ConstLabels: m.labels,
 	})
 }
 
 func (m *MetricsRegistry) GaugeFunc(name string, handler func() float64) {
 	gf := promauto.NewGaugeFunc(prometheus.GaugeOpts{
-		Namespace: mtx.namespace,
-		Subsystem: m.subsystem,
-		Name:      name,
+		Namespace:   mtx.namespace,
+		Subsystem:   m.subsystem,
+		Name:        name,
+		ConstLabels: m.labels,
 	}, handler)
 
 	m.gaugeFuncs = append(m.gaugeFuncs, gf)
 }
 
+// CounterFunc registers a prometheus CounterFunc, for counts kept by the caller, which
+// must never decrease.
+func (m *MetricsRegistry) CounterFunc(name string, handler func() float64) {
+	cf := promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace:   mtx.namespace,
+		Subsystem:   m.subsystem,
+		Name:        name,
+		ConstLabels: m.labels,
+	}, handler)
+
+	m.counterFuncs = append(m.counterFuncs, cf)
+}
+
+// GaugeVec creates or fetches a prometheus GaugeVec with the given labels from the
+// metrics registry and returns it.
+func (m *MetricsRegistry) GaugeVec(name string, labels ...string) *prometheus.GaugeVec {
+	m.gaugeVecsLock.Lock()
+	defer m.gaugeVecsLock.Unlock()
+
+	if val, ok := m.gaugeVecs[name]; ok {
+		return val
+	}
+
+	val := promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   mtx.namespace,
+		Subsystem:   m.subsystem,
+		Name:        name,
+		ConstLabels: m.labels,
+	}, labels)
+	if m.gaugeVecs == nil {
+		m.gaugeVecs = make(map[string]*prometheus.GaugeVec)
+	}
+	m.gaugeVecs[name] = val
+	globalCollectors = append(globalCollectors, val)
+	return val
+}
+
 // Histogram creates or fetches a prometheus Histogram from the metrics
 // registry and returns it.
 func (m *MetricsRegistry) Histogram(name string) prometheus.Histogram {
 
 	return m.histograms.value(name, prometheus.HistogramOpts{
-		Namespace: mtx.namespace,
-		Subsystem: m.subsystem,
-		Name:      name,
+		Namespace:   mtx.namespace,
+		Subsystem:   m.subsystem,
+		Name:        name,
+		ConstLabels: m.labels,
 	})
 }
@@ -0,0 +1,158 @@
+//go:build ns
+
+// Command backfill records the validator usage found in historical access logs.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/consensuslayer"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/router"
+	"go.uber.org/zap"
+)
+
+func main() {
+	usageDSN := flag.String("usage-db", "file:nodeset-usage.db?cache=shared", "DSN of the database validator usage is backfilled into")
+	usageModel := flag.String("usage-model", "buckets", "Usage model of the database, buckets or hybrid. Hybrid databases only have their buckets backfilled.")
+	usagePrecision := flag.Duration("usage-precision", 5*time.Minute, "Width of the buckets of the database")
+	pattern := flag.String("pattern", "", "Regular expression matching access log lines, with the named groups time and validators. validators is a list of indices or pubkeys.")
+	timeLayout := flag.String("time-layout", time.RFC3339, "Go layout of the time group, eg, 02/Jan/2006:15:04:05 -0700 for nginx")
+	from := flag.String("from", "", "Optional RFC3339 time before which lines are ignored")
+	to := flag.String("to", "", "Optional RFC3339 time from which lines are ignored")
+	bnURL := flag.String("bn-url", "", "Optional beacon node used to resolve pubkeys to indices, eg, http://localhost:5052")
+	keyFile := flag.String("key-file", "", "File holding a backfill key issued on the admin API (POST /backfill/keys). The caller, role and maximum age of the key apply to the backfill.")
+	flag.Parse()
+
+	if err := run(*usageDSN, *usageModel, *usagePrecision, *pattern, *timeLayout, *from, *to, *bnURL, *keyFile, flag.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(usageDSN, usageModel string, usagePrecision time.Duration, pattern, timeLayout, from, to, bnURL string, keyFile string, files []string) error {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = logger.Sync()
+	}()
+
+	if keyFile == "" {
+		return fmt.Errorf("invalid -key-file: %w", router.ErrBackfillCallerRequired)
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("invalid -key-file: %w", err)
+	}
+
+	format, err := router.NewAccessLogFormat(pattern, timeLayout)
+	if err != nil {
+		return fmt.Errorf("invalid -pattern or -time-layout: %w", err)
+	}
+
+	backfill := &router.AccessLogBackfill{
+		Format: format,
+		Logger: logger,
+	}
+	if from != "" {
+		if backfill.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return fmt.Errorf("invalid -from: %w", err)
+		}
+	}
+	if to != "" {
+		if backfill.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+	}
+
+	if _, err := metrics.Init("rescue_proxy_backfill"); err != nil {
+		return err
+	}
+
+	if bnURL != "" {
+		resolve, err := resolvePubkeys(logger, bnURL)
+		if err != nil {
+			return err
+		}
+		backfill.Resolve = resolve
+	}
+
+	model := router.UsageModel(usageModel)
+	if model == router.UsageModelSessions {
+		return fmt.Errorf("sessions can't be backfilled, -usage-model must be buckets or hybrid")
+	}
+	tracker, ok := router.NewUsageTracker(logger, router.UsageTrackerOptions{
+		DSN:       usageDSN,
+		Model:     model,
+		Precision: usagePrecision,
+	}).(router.UsageBackfiller)
+	if !ok {
+		return fmt.Errorf("usage model %s can't be backfilled", usageModel)
+	}
+	defer tracker.Close()
+	backfill.Tracker, err = router.NewGuardedBackfiller(logger, tracker, strings.TrimSpace(string(key)))
+	if err != nil {
+		return err
+	}
+
+	inputs := []io.Reader{os.Stdin}
+	if len(files) > 0 {
+		inputs = inputs[:0]
+		for _, name := range files {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			inputs = append(inputs, f)
+		}
+	}
+
+	stats, err := backfill.Run(io.MultiReader(inputs...))
+	logger.Info("Backfilled usage",
+		zap.Int("lines", stats.Lines),
+		zap.Int("skipped", stats.Skipped),
+		zap.Int("unresolved", stats.Unresolved),
+		zap.Int("records", stats.Records))
+	return err
+}
+
+// resolvePubkeys fetches every validator from the beacon node to map pubkeys to indices.
+func resolvePubkeys(logger *zap.Logger, bnURL string) (func(string) (string, bool), error) {
+	u, err := url.Parse(bnURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -bn-url: %w", err)
+	}
+
+	cl := consensuslayer.NewCachingConsensusLayer(u, logger, false)
+	if err := cl.Init(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed to connect to the beacon node: %w", err)
+	}
+	defer cl.Deinit()
+
+	validators, err := cl.GetValidators()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch validators: %w", err)
+	}
+
+	indices := make(map[string]string, len(validators))
+	for _, v := range validators {
+		indices[strings.ToLower(v.Validator.PublicKey.String())] = strconv.FormatUint(uint64(v.Index), 10)
+	}
+	logger.Info("Fetched validators", zap.Int("count", len(indices)))
+
+	return func(pubkey string) (string, bool) {
+		index, ok := indices[pubkey]
+		return index, ok
+	}, nil
+}
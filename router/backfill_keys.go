@@ -0,0 +1,289 @@
+//go:build ns
+
+package router
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrInvalidBackfillKey is returned for backfill keys which don't exist or were revoked.
+	ErrInvalidBackfillKey = errors.New("invalid backfill key")
+	// ErrNoBackfillKey is returned when revoking a backfill key which doesn't exist.
+	ErrNoBackfillKey = errors.New("no such backfill key")
+	// ErrInvalidBackfillMaxAge is returned when issuing a backfill key with a negative
+	// maximum age.
+	ErrInvalidBackfillMaxAge = errors.New("backfill key max age must not be negative")
+)
+
+// defaultBackfillKeyMaxAge is the maximum backdating age of keys issued without one.
+const defaultBackfillKeyMaxAge = 7 * 24 * time.Hour
+
+// BackfillKey is a credential of the backfill command, issued on the admin API to the
+// caller recorded in the backdating audit.
+type BackfillKey struct {
+	ID     string         `json:"id"`
+	Caller BackfillCaller `json:"caller"`
+	// Usage older than this can't be backfilled with the key, unless its caller is
+	// elevated. Set by the admin issuing the key, never by the backfill.
+	MaxAgeSeconds int64     `json:"max_age_seconds"`
+	CreatedAt     time.Time `json:"created_at"`
+	// Only returned when the key is created, only its hash is stored
+	Key string `json:"key,omitempty"`
+}
+
+// BackfillKeyStore keeps the keys backfills authenticate with, so the identity and role
+// of a caller are set by an admin rather than asserted by the caller.
+type BackfillKeyStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewBackfillKeyStore creates the backfill key table in db if needed.
+func NewBackfillKeyStore(logger *zap.Logger, db *sql.DB) (*BackfillKeyStore, error) {
+	store := &BackfillKeyStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *BackfillKeyStore) initSchema() error {
+	// key_hash is the hex SHA-256 of the key, max_age and created_at seconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS backfill_keys (
+		id TEXT PRIMARY KEY,
+		caller TEXT NOT NULL,
+		elevated INTEGER NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL
+	);
+	`
+
+	if _, err := store.Database.Exec(createTableSQL); err != nil {
+		return err
+	}
+	return store.migrateMaxAge()
+}
+
+// migrateMaxAge adds the max_age column to tables created before keys had one, which
+// get the default.
+func (store *BackfillKeyStore) migrateMaxAge() error {
+	rows, err := store.Database.Query("SELECT name FROM pragma_table_info('backfill_keys') WHERE name = 'max_age'")
+	if err != nil {
+		return err
+	}
+	migrated := rows.Next()
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	if migrated {
+		return nil
+	}
+	_, err = store.Database.Exec(fmt.Sprintf("ALTER TABLE backfill_keys ADD COLUMN max_age INTEGER NOT NULL DEFAULT %d",
+		int64(defaultBackfillKeyMaxAge.Seconds())))
+	if err != nil {
+		return fmt.Errorf("failed to add the max_age column: %w", err)
+	}
+	return nil
+}
+
+// Create issues a key for caller, which may backfill usage up to maxAge old, or
+// defaultBackfillKeyMaxAge if 0. The key is only returned here.
+func (store *BackfillKeyStore) Create(caller BackfillCaller, maxAge time.Duration) (*BackfillKey, error) {
+	if caller.Identity == "" {
+		return nil, ErrBackfillCallerRequired
+	}
+	if maxAge < 0 {
+		return nil, ErrInvalidBackfillMaxAge
+	}
+	if maxAge == 0 {
+		maxAge = defaultBackfillKeyMaxAge
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	out := &BackfillKey{
+		ID:            hex.EncodeToString(id),
+		Caller:        caller,
+		MaxAgeSeconds: int64(maxAge.Seconds()),
+		CreatedAt:     store.clock().Truncate(time.Second).UTC(),
+		Key:           hex.EncodeToString(secret),
+	}
+
+	_, err := store.Database.Exec(`
+	INSERT INTO backfill_keys (id, caller, elevated, key_hash, max_age, created_at) VALUES (?, ?, ?, ?, ?, ?)
+	`, out.ID, caller.Identity, caller.Elevated, hashTenantKey(out.Key), out.MaxAgeSeconds, out.CreatedAt.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to store backfill key: %w", err)
+	}
+
+	return out, nil
+}
+
+// List returns every backfill key, oldest first, without their secrets.
+func (store *BackfillKeyStore) List() ([]BackfillKey, error) {
+	rows, err := store.Database.Query(`
+	SELECT id, caller, elevated, max_age, created_at FROM backfill_keys ORDER BY created_at, id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query backfill keys: %w", err)
+	}
+	defer rows.Close()
+
+	out := []BackfillKey{}
+	for rows.Next() {
+		var key BackfillKey
+		var createdAt int64
+		if err := rows.Scan(&key.ID, &key.Caller.Identity, &key.Caller.Elevated, &key.MaxAgeSeconds, &createdAt); err != nil {
+			return nil, err
+		}
+		key.CreatedAt = time.Unix(createdAt, 0).UTC()
+		out = append(out, key)
+	}
+
+	return out, rows.Err()
+}
+
+// Revoke deletes the backfill key id.
+func (store *BackfillKeyStore) Revoke(id string) error {
+	res, err := store.Database.Exec("DELETE FROM backfill_keys WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke backfill key: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoBackfillKey
+	}
+	return nil
+}
+
+// Lookup returns the backfill key, without its secret, or ErrInvalidBackfillKey.
+func (store *BackfillKeyStore) Lookup(key string) (*BackfillKey, error) {
+	var out BackfillKey
+	var createdAt int64
+	err := store.Database.QueryRow(`
+	SELECT id, caller, elevated, max_age, created_at FROM backfill_keys WHERE key_hash = ?
+	`, hashTenantKey(key)).Scan(&out.ID, &out.Caller.Identity, &out.Caller.Elevated, &out.MaxAgeSeconds, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidBackfillKey
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query backfill key: %w", err)
+	}
+	out.CreatedAt = time.Unix(createdAt, 0).UTC()
+	return &out, nil
+}
+
+func (pr *ProxyRouter) backfillKeyStore(w http.ResponseWriter) (*BackfillKeyStore, bool) {
+	if pr.backfillKeys == nil {
+		http.Error(w, "backfill keys require a SQL usage tracker", http.StatusNotImplemented)
+		return nil, false
+	}
+	return pr.backfillKeys, true
+}
+
+// serveCreateBackfillKey issues a backfill key for the caller in the body, with an
+// optional max_age_seconds. The key can't be retrieved again.
+func (pr *ProxyRouter) serveCreateBackfillKey(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.backfillKeyStore(w)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		BackfillCaller
+		MaxAgeSeconds int64 `json:"max_age_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid backfill caller: %v", err), http.StatusBadRequest)
+		return
+	}
+	req.Identity = strings.TrimSpace(req.Identity)
+
+	key, err := store.Create(req.BackfillCaller, time.Duration(req.MaxAgeSeconds)*time.Second)
+	if errors.Is(err, ErrBackfillCallerRequired) || errors.Is(err, ErrInvalidBackfillMaxAge) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		pr.Logger.Error("Failed to create backfill key", zap.Error(err))
+		http.Error(w, "failed to create backfill key", http.StatusInternalServerError)
+		return
+	}
+	pr.Logger.Info("Created backfill key",
+		zap.String("caller", key.Caller.Identity),
+		zap.Bool("elevated", key.Caller.Elevated),
+		zap.Int64("max_age_seconds", key.MaxAgeSeconds),
+		zap.String("id", key.ID))
+
+	pr.writeUsageJSONStatus(w, r, http.StatusCreated, key)
+}
+
+func (pr *ProxyRouter) serveListBackfillKeys(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.backfillKeyStore(w)
+	if !ok {
+		return
+	}
+
+	keys, err := store.List()
+	if err != nil {
+		pr.Logger.Error("Failed to list backfill keys", zap.Error(err))
+		http.Error(w, "failed to list backfill keys", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, keys)
+}
+
+func (pr *ProxyRouter) serveRevokeBackfillKey(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.backfillKeyStore(w)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	err := store.Revoke(id)
+	if errors.Is(err, ErrNoBackfillKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		pr.Logger.Error("Failed to revoke backfill key", zap.Error(err))
+		http.Error(w, "failed to revoke backfill key", http.StatusInternalServerError)
+		return
+	}
+	pr.Logger.Info("Revoked backfill key", zap.String("id", id))
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,18 @@
+//go:build ns
+
+package router
+
+import "time"
+
+// wallClock is embedded by types which read the time, so tests can set it.
+type wallClock struct {
+	// Overrides time.Now in tests
+	now func() time.Time
+}
+
+func (c *wallClock) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
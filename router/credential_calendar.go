@@ -0,0 +1,231 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/credentials"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// How long before a credential expires calendars remind the operator
+const credentialExpiryReminder = 48 * time.Hour
+
+// CredentialExpiry is when the latest credential of a tier seen from an operator expires.
+type CredentialExpiry struct {
+	Tier      string    `json:"tier"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CredentialStore keeps the issuance time of the latest credential each operator
+// authenticated with, per operator type, so their expiry can be published.
+type CredentialStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	// Latest issuance observed per node and operator type, so repeated requests with
+	// the same credential don't write
+	seenLock sync.Mutex
+	seen     map[credentialKey]int64
+
+	wallClock
+}
+
+type credentialKey struct {
+	node         common.Address
+	operatorType credentials.OperatorType
+}
+
+// NewCredentialStore creates the credential table in db if needed.
+func NewCredentialStore(logger *zap.Logger, db *sql.DB) (*CredentialStore, error) {
+	store := &CredentialStore{
+		Database: db,
+		Logger:   logger,
+		seen:     make(map[credentialKey]int64),
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *CredentialStore) initSchema() error {
+	// issued_at is a unix timestamp
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS operator_credentials (
+		node_address TEXT NOT NULL,
+		operator_type INTEGER NOT NULL,
+		issued_at INTEGER NOT NULL,
+		PRIMARY KEY (node_address, operator_type)
+	);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Observe records that node authenticated with a credential of operatorType issued at
+// issuedAt. Older credentials than the latest observed are ignored.
+func (store *CredentialStore) Observe(node common.Address, operatorType credentials.OperatorType, issuedAt time.Time) error {
+	key := credentialKey{node, operatorType}
+	store.seenLock.Lock()
+	defer store.seenLock.Unlock()
+	if latest, ok := store.seen[key]; ok && latest >= issuedAt.Unix() {
+		return nil
+	}
+
+	_, err := store.Database.Exec(`
+	INSERT INTO operator_credentials (node_address, operator_type, issued_at) VALUES (?, ?, ?)
+	ON CONFLICT (node_address, operator_type) DO UPDATE SET issued_at = MAX(issued_at, excluded.issued_at)
+	`, node.Hex(), int32(operatorType), issuedAt.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record credential: %w", err)
+	}
+	store.seen[key] = issuedAt.Unix()
+	return nil
+}
+
+// forget drops what was observed of node, so its next credential is recorded again
+// after its rows were deleted.
+func (store *CredentialStore) forget(node common.Address) {
+	store.seenLock.Lock()
+	defer store.seenLock.Unlock()
+	for key := range store.seen {
+		if key.node == node {
+			delete(store.seen, key)
+		}
+	}
+}
+
+// Expiries returns when the latest credentials of node expire, by tier.
+func (store *CredentialStore) Expiries(node common.Address) ([]CredentialExpiry, error) {
+	rows, err := store.Database.Query(`
+	SELECT operator_type, issued_at FROM operator_credentials
+	WHERE node_address = ? ORDER BY operator_type
+	`, node.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query credentials: %w", err)
+	}
+	defer rows.Close()
+
+	out := []CredentialExpiry{}
+	for rows.Next() {
+		var operatorType int32
+		var issuedAt int64
+		if err := rows.Scan(&operatorType, &issuedAt); err != nil {
+			return nil, err
+		}
+		window, ok := validityWindow[credentials.OperatorType(operatorType)]
+		if !ok {
+			continue
+		}
+		issued := time.Unix(issuedAt, 0).UTC()
+		out = append(out, CredentialExpiry{
+			Tier:      credentialTier(credentials.OperatorType(operatorType)),
+			IssuedAt:  issued,
+			ExpiresAt: issued.Add(window),
+		})
+	}
+
+	return out, rows.Err()
+}
+
+// WriteCalendar writes an iCalendar feed of the credential expiries of node, with a
+// reminder ahead of each. Quota resets aren't known to the proxy, so they aren't part
+// of the feed.
+func (store *CredentialStore) WriteCalendar(w io.Writer, node common.Address) error {
+	expiries, err := store.Expiries(node)
+	if err != nil {
+		return err
+	}
+
+	const icsTime = "20060102T150405Z"
+	stamp := store.clock().UTC().Format(icsTime)
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//Rocket Rescue Node//rescue-proxy//EN",
+		"CALSCALE:GREGORIAN",
+		"X-WR-CALNAME:Rescue node " + node.Hex(),
+	}
+	for _, expiry := range expiries {
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			// Stable for a credential, and new when the operator gets a new one
+			fmt.Sprintf("UID:%s-%s-%d@rescue-proxy", strings.ToLower(node.Hex()), expiry.Tier, expiry.IssuedAt.Unix()),
+			"DTSTAMP:"+stamp,
+			"DTSTART:"+expiry.ExpiresAt.Format(icsTime),
+			"DTEND:"+expiry.ExpiresAt.Format(icsTime),
+			fmt.Sprintf("SUMMARY:Rescue node %s credential expires", expiry.Tier),
+			"DESCRIPTION:Request a new credential to keep using the rescue node.",
+			"TRANSP:TRANSPARENT",
+			"BEGIN:VALARM",
+			"ACTION:DISPLAY",
+			fmt.Sprintf("DESCRIPTION:Rescue node %s credential expires soon", expiry.Tier),
+			fmt.Sprintf("TRIGGER:-PT%dH", int(credentialExpiryReminder.Hours())),
+			"END:VALARM",
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+
+	_, err = io.WriteString(w, strings.Join(lines, "\r\n")+"\r\n")
+	return err
+}
+
+// observeCredential records the credential an operator authenticated with, if enabled.
+func (pr *ProxyRouter) observeCredential(node common.Address, operatorType credentials.OperatorType, timestamp int64) {
+	if pr.credentials == nil {
+		return
+	}
+	if err := pr.credentials.Observe(node, operatorType, time.Unix(timestamp, 0)); err != nil {
+		pr.Logger.Warn("Failed to record credential", zap.Error(err))
+	}
+}
+
+// serveCredentialCalendar serves the iCalendar feed of an operator who opted in to
+// publishing their usage, see PublicHandler.
+func (pr *ProxyRouter) serveCredentialCalendar(w http.ResponseWriter, r *http.Request) {
+	if pr.public == nil || pr.credentials == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	node := common.HexToAddress(mux.Vars(r)["node"])
+	public, err := pr.public.IsPublic(node)
+	if err != nil {
+		pr.Logger.Error("Failed to check public usage opt-in", zap.Error(err))
+		http.Error(w, "failed to get calendar", http.StatusInternalServerError)
+		return
+	}
+	if !public {
+		http.NotFound(w, r)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := pr.credentials.WriteCalendar(&buf, node); err != nil {
+		pr.Logger.Error("Failed to write credential calendar", zap.Error(err))
+		http.Error(w, "failed to get calendar", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(publicUsageMaxAge.Seconds())))
+	if _, err := buf.WriteTo(w); err != nil {
+		pr.Logger.Warn("Failed to write credential calendar", zap.Error(err))
+	}
+}
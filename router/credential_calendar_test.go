@@ -0,0 +1,125 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/credentials/pb"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestCredentialStore(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	store, err := NewCredentialStore(zaptest.NewLogger(t), tracker.(*SQLiteUsageTracker).primaryDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.now = func() time.Time { return time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC) }
+
+	issued := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	node := common.Address{1}
+	for _, observed := range []time.Time{issued, issued.Add(-time.Hour), issued} {
+		if err := store.Observe(node, pb.OperatorType_OT_ROCKETPOOL, observed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Observe(node, pb.OperatorType_OT_SOLO, issued.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh store has no cache, older credentials must not overwrite newer ones
+	fresh, err := NewCredentialStore(zaptest.NewLogger(t), store.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.Observe(node, pb.OperatorType_OT_ROCKETPOOL, issued.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	expiries, err := store.Expiries(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []CredentialExpiry{
+		{Tier: "rocketpool", IssuedAt: issued, ExpiresAt: issued.Add(15 * 24 * time.Hour)},
+		{Tier: "solo", IssuedAt: issued.Add(time.Hour), ExpiresAt: issued.Add(time.Hour + 10*24*time.Hour)},
+	}
+	if len(expiries) != len(expected) {
+		t.Fatalf("Expected %d expiries, got %+v", len(expected), expiries)
+	}
+	for i, expiry := range expected {
+		if expiries[i] != expiry {
+			t.Fatalf("Expected %+v, got %+v", expiry, expiries[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := store.WriteCalendar(&buf, node); err != nil {
+		t.Fatal(err)
+	}
+	calendar := buf.String()
+	for _, line := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"DTSTART:20250116T000000Z\r\n",
+		"DTSTART:20250111T010000Z\r\n",
+		"SUMMARY:Rescue node rocketpool credential expires\r\n",
+		"TRIGGER:-PT48H\r\n",
+		"DTSTAMP:20250110T000000Z\r\n",
+	} {
+		if !strings.Contains(calendar, line) {
+			t.Fatalf("Expected %q in calendar:\n%s", line, calendar)
+		}
+	}
+	if strings.Count(calendar, "BEGIN:VEVENT") != 2 {
+		t.Fatalf("Expected 2 events:\n%s", calendar)
+	}
+	if !strings.HasSuffix(calendar, "END:VCALENDAR\r\n") {
+		t.Fatalf("Expected the calendar to end with END:VCALENDAR:\n%s", calendar)
+	}
+}
+
+func TestCredentialCalendar(t *testing.T) {
+	pr, cleanup := setupPublicUsageTest(t)
+	defer cleanup()
+
+	creds, err := NewCredentialStore(zaptest.NewLogger(t), pr.public.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.credentials = creds
+	pr.observeCredential(common.Address{1}, pb.OperatorType_OT_SOLO, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+
+	path := "/operators/0x0100000000000000000000000000000000000000/calendar.ics"
+	rec := httptest.NewRecorder()
+	pr.PublicHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	if err := pr.public.OptIn(common.Address{1}); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	pr.PublicHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/calendar") {
+		t.Fatalf("Unexpected content type %s", rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), "DTSTART:20250111T000000Z\r\n") {
+		t.Fatalf("Expected the solo credential to expire on January 11th:\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,14 @@
+// Package router proxies requests to the beacon node, refusing those of unauthorized
+// users and validators with the wrong fee recipient.
+//
+// Its API has three levels of stability, selected with build tags:
+//
+//   - Without tags, the proxy itself, which is stable.
+//   - With the ns tag, usage tracking and the admin API. Exported identifiers are
+//     stable unless their doc starts with "Deprecated:".
+//   - With the ns and experimental tags, new subsystems whose API may change between
+//     releases. Their doc starts with "Experimental:".
+//
+// An experimental subsystem graduates once it's gone a release without breaking
+// changes: its experimental tag and marker are removed, and it's built with ns.
+package router
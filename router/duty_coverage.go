@@ -0,0 +1,310 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/consensuslayer"
+	"go.uber.org/zap"
+)
+
+// usageBuckets is implemented by trackers which record usage in fixed-size buckets.
+type usageBuckets interface {
+	usageCommitter
+	bucketPrecision() time.Duration
+}
+
+func (tracker *SQLiteUsageTracker) bucketPrecision() time.Duration {
+	return tracker.Precision
+}
+
+func (tracker *HybridUsageTracker) bucketPrecision() time.Duration {
+	return tracker.Buckets.Precision
+}
+
+// DutyCoverage is an expected duty of a validator which used the rescue node in its epoch.
+// The duty is covered if the validator was using the rescue node when it was due.
+type DutyCoverage struct {
+	Validator string
+	Epoch     uint64
+	Slot      uint64
+	Kind      consensuslayer.DutyKind
+	SlotTime  time.Time
+	Covered   bool
+}
+
+// DutyCoverageCount counts expected and covered duties.
+type DutyCoverageCount struct {
+	Expected int `json:"expected"`
+	Covered  int `json:"covered"`
+}
+
+func (c *DutyCoverageCount) add(expected int, covered int) {
+	c.Expected += expected
+	c.Covered += covered
+}
+
+// ValidatorDutyCoverage is the coverage of one validator's duties.
+type ValidatorDutyCoverage struct {
+	Validator string            `json:"validator"`
+	Attester  DutyCoverageCount `json:"attester"`
+	Proposer  DutyCoverageCount `json:"proposer"`
+}
+
+// DutyCoverageReport summarizes the coverage of the duties due in [From, To).
+type DutyCoverageReport struct {
+	From       time.Time               `json:"from"`
+	To         time.Time               `json:"to"`
+	Attester   DutyCoverageCount       `json:"attester"`
+	Proposer   DutyCoverageCount       `json:"proposer"`
+	Validators []ValidatorDutyCoverage `json:"validators"`
+}
+
+// DutyCoverageStore persists evaluated duties next to the usage data.
+type DutyCoverageStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+}
+
+// NewDutyCoverageStore creates the duty coverage table in db if needed.
+func NewDutyCoverageStore(logger *zap.Logger, db *sql.DB) (*DutyCoverageStore, error) {
+	store := &DutyCoverageStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *DutyCoverageStore) initSchema() error {
+	// slot_time is a unix timestamp
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS duty_coverage (
+		validator_index TEXT NOT NULL,
+		slot INTEGER NOT NULL,
+		kind TEXT NOT NULL,
+		epoch INTEGER NOT NULL,
+		slot_time INTEGER NOT NULL,
+		covered INTEGER NOT NULL,
+		PRIMARY KEY (validator_index, slot, kind)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_duty_coverage_slot_time ON duty_coverage(slot_time);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Record stores evaluated duties, replacing earlier evaluations of the same duties.
+func (store *DutyCoverageStore) Record(duties []DutyCoverage) error {
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT OR REPLACE INTO duty_coverage (validator_index, slot, kind, epoch, slot_time, covered)
+	VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare duty coverage statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, d := range duties {
+		if _, err := stmt.Exec(d.Validator, d.Slot, string(d.Kind), d.Epoch, d.SlotTime.Unix(), d.Covered); err != nil {
+			return fmt.Errorf("failed to record duty of validator %s at slot %d: %w", d.Validator, d.Slot, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Report summarizes the duties due in [from, to), per validator and overall.
+func (store *DutyCoverageStore) Report(from time.Time, to time.Time) (*DutyCoverageReport, error) {
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+
+	rows, err := store.Database.Query(`
+	SELECT validator_index, kind, COUNT(*), SUM(covered)
+	FROM duty_coverage
+	WHERE slot_time >= ? AND slot_time < ?
+	GROUP BY validator_index, kind
+	ORDER BY validator_index
+	`, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query duty coverage: %w", err)
+	}
+	defer rows.Close()
+
+	report := &DutyCoverageReport{
+		From:       from,
+		To:         to,
+		Validators: []ValidatorDutyCoverage{},
+	}
+	for rows.Next() {
+		var validator, kind string
+		var expected, covered int
+		if err := rows.Scan(&validator, &kind, &expected, &covered); err != nil {
+			return nil, err
+		}
+
+		last := len(report.Validators) - 1
+		if last < 0 || report.Validators[last].Validator != validator {
+			report.Validators = append(report.Validators, ValidatorDutyCoverage{Validator: validator})
+			last++
+		}
+
+		switch consensuslayer.DutyKind(kind) {
+		case consensuslayer.DutyAttester:
+			report.Validators[last].Attester.add(expected, covered)
+			report.Attester.add(expected, covered)
+		case consensuslayer.DutyProposer:
+			report.Validators[last].Proposer.add(expected, covered)
+			report.Proposer.add(expected, covered)
+		}
+	}
+
+	return report, rows.Err()
+}
+
+func (store *DutyCoverageStore) pruneUsage(cutoff time.Time, exempt map[string]time.Time) (int64, error) {
+	return pruneRows(store.Database, "duty_coverage", "slot_time < ?",
+		func(t time.Time) any { return t.Unix() }, cutoff, exempt)
+}
+
+// DutyCoverageJob evaluates, once per epoch, which duties of the validators using the
+// rescue node were due while they were using it. This quantifies how many attestations
+// and proposals the rescue node actually protected.
+//
+// A validator is rescue-active in an epoch if it has usage in a bucket overlapping the
+// epoch, and a duty is covered if usage was recorded in the bucket of its slot.
+type DutyCoverageJob struct {
+	Duties  consensuslayer.DutiesProvider
+	Tracker usageBuckets
+	Store   *DutyCoverageStore
+	Logger  *zap.Logger
+	// Alerts on missed proposals when set
+	Alerts *MissedProposalAlerter
+
+	wallClock
+}
+
+// Evaluate fetches and stores the coverage of the duties of an epoch.
+func (job *DutyCoverageJob) Evaluate(ctx context.Context, timing consensuslayer.ChainTiming, epoch uint64) ([]DutyCoverage, error) {
+	precision := job.Tracker.bucketPrecision()
+	start := timing.EpochTime(epoch)
+	end := timing.EpochTime(epoch + 1)
+
+	records, err := job.Tracker.usageRecords(start.Truncate(precision), end)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make(map[string]map[int64]struct{})
+	for _, r := range records {
+		validator := r.Validator.String()
+		if buckets[validator] == nil {
+			buckets[validator] = make(map[int64]struct{})
+		}
+		buckets[validator][r.Bucket.Unix()] = struct{}{}
+	}
+	if len(buckets) == 0 {
+		return nil, nil
+	}
+
+	active := make([]string, 0, len(buckets))
+	for validator := range buckets {
+		active = append(active, validator)
+	}
+	sort.Strings(active)
+
+	duties, err := job.Duties.GetDuties(ctx, epoch, active)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]DutyCoverage, 0, len(duties))
+	covered := 0
+	for _, d := range duties {
+		slotTime := timing.SlotTime(d.Slot)
+		_, ok := buckets[d.ValidatorIndex][slotTime.Truncate(precision).Unix()]
+		if ok {
+			covered++
+		}
+		out = append(out, DutyCoverage{
+			Validator: d.ValidatorIndex,
+			Epoch:     epoch,
+			Slot:      d.Slot,
+			Kind:      d.Kind,
+			SlotTime:  slotTime.UTC(),
+			Covered:   ok,
+		})
+	}
+
+	if err := job.Store.Record(out); err != nil {
+		return nil, err
+	}
+
+	job.Logger.Debug("Evaluated duty coverage",
+		zap.Uint64("epoch", epoch),
+		zap.Int("validators", len(active)),
+		zap.Int("duties", len(out)),
+		zap.Int("covered", covered))
+
+	if job.Alerts != nil {
+		job.Alerts.checkProposals(ctx, job.Duties, out, buckets, precision)
+	}
+
+	return out, nil
+}
+
+// Run evaluates the epoch before last at the start of every epoch until ctx is done.
+// The previous epoch is skipped, as its attestations may still be included.
+func (job *DutyCoverageJob) Run(ctx context.Context) {
+	var timing consensuslayer.ChainTiming
+	for {
+		var err error
+		timing, err = job.Duties.ChainTiming(ctx)
+		if err == nil {
+			break
+		}
+		job.Logger.Warn("Failed to get chain timing for duty coverage, retrying", zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+
+	for {
+		now := job.clock()
+		epoch := timing.EpochAt(now)
+		if epoch >= 2 {
+			if _, err := job.Evaluate(ctx, timing, epoch-2); err != nil {
+				job.Logger.Warn("Failed to evaluate duty coverage", zap.Uint64("epoch", epoch-2), zap.Error(err))
+			}
+		}
+
+		timer := time.NewTimer(timing.EpochTime(epoch + 1).Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,187 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/consensuslayer"
+	"go.uber.org/zap/zaptest"
+)
+
+type mockDutiesProvider struct {
+	timing    consensuslayer.ChainTiming
+	duties    []consensuslayer.Duty
+	requested []string
+	// Slots without a block
+	missed map[uint64]bool
+}
+
+func (m *mockDutiesProvider) ChainTiming(ctx context.Context) (consensuslayer.ChainTiming, error) {
+	return m.timing, nil
+}
+
+func (m *mockDutiesProvider) GetDuties(ctx context.Context, epoch uint64, validatorIndices []string) ([]consensuslayer.Duty, error) {
+	m.requested = validatorIndices
+	wanted := make(map[string]bool, len(validatorIndices))
+	for _, v := range validatorIndices {
+		wanted[v] = true
+	}
+
+	out := []consensuslayer.Duty{}
+	for _, d := range m.duties {
+		if wanted[d.ValidatorIndex] {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+func (m *mockDutiesProvider) BlockProposed(ctx context.Context, slot uint64) (bool, error) {
+	return !m.missed[slot], nil
+}
+
+func setupDutyCoverageTest(t *testing.T) (*DutyCoverageJob, *mockDutiesProvider, *SQLiteUsageTracker) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	sqlite := tracker.(*SQLiteUsageTracker)
+
+	store, err := NewDutyCoverageStore(zaptest.NewLogger(t), sqlite.primaryDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Epoch 10 spans 00:00:00 to 00:06:24, across two 5 minute buckets
+	provider := &mockDutiesProvider{
+		timing: consensuslayer.ChainTiming{
+			Genesis:       time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Add(-10 * 32 * 12 * time.Second),
+			SlotDuration:  12 * time.Second,
+			SlotsPerEpoch: 32,
+		},
+		duties: []consensuslayer.Duty{
+			// 00:00:12, in the first bucket
+			{ValidatorIndex: "1", Slot: 321, Kind: consensuslayer.DutyAttester},
+			// 00:06:12, in the second bucket
+			{ValidatorIndex: "1", Slot: 351, Kind: consensuslayer.DutyProposer},
+			{ValidatorIndex: "2", Slot: 351, Kind: consensuslayer.DutyAttester},
+			// Not rescue-active
+			{ValidatorIndex: "3", Slot: 330, Kind: consensuslayer.DutyAttester},
+		},
+	}
+
+	job := &DutyCoverageJob{
+		Duties:  provider,
+		Tracker: sqlite,
+		Store:   store,
+		Logger:  zaptest.NewLogger(t),
+	}
+	return job, provider, sqlite
+}
+
+func TestDutyCoverageEvaluate(t *testing.T) {
+	job, provider, tracker := setupDutyCoverageTest(t)
+	start := provider.timing.EpochTime(10)
+
+	// Validator 1 only used the rescue node during the first bucket, 2 during both
+	if err := tracker.recordUsage(start.Unix(), []string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.recordUsage(start.Add(5*time.Minute).Unix(), []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	coverage, err := job.Evaluate(t.Context(), provider.timing, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provider.requested) != 2 || provider.requested[0] != "1" || provider.requested[1] != "2" {
+		t.Fatalf("Expected duties of the rescue-active validators, got %v", provider.requested)
+	}
+	if len(coverage) != 3 {
+		t.Fatalf("Expected 3 duties, got %v", coverage)
+	}
+
+	expected := map[uint64]map[string]bool{
+		321: {"1": true},
+		351: {"1": false, "2": true},
+	}
+	for _, c := range coverage {
+		if c.Covered != expected[c.Slot][c.Validator] {
+			t.Fatalf("Unexpected coverage of validator %s at slot %d: %v", c.Validator, c.Slot, c.Covered)
+		}
+	}
+
+	report, err := job.Store.Report(start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Attester != (DutyCoverageCount{Expected: 2, Covered: 2}) {
+		t.Fatalf("Unexpected attester coverage %+v", report.Attester)
+	}
+	if report.Proposer != (DutyCoverageCount{Expected: 1, Covered: 0}) {
+		t.Fatalf("Unexpected proposer coverage %+v", report.Proposer)
+	}
+	if len(report.Validators) != 2 || report.Validators[0].Validator != "1" || report.Validators[1].Validator != "2" {
+		t.Fatalf("Unexpected validators in report %+v", report.Validators)
+	}
+
+	// Evaluating again replaces the earlier results
+	if _, err := job.Evaluate(t.Context(), provider.timing, 10); err != nil {
+		t.Fatal(err)
+	}
+	again, err := job.Store.Report(start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Attester != report.Attester || again.Proposer != report.Proposer {
+		t.Fatalf("Expected re-evaluation to be idempotent, got %+v", again)
+	}
+}
+
+func TestDutyCoverageNoUsage(t *testing.T) {
+	job, provider, _ := setupDutyCoverageTest(t)
+
+	coverage, err := job.Evaluate(t.Context(), provider.timing, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(coverage) != 0 || provider.requested != nil {
+		t.Fatalf("Expected no duties to be fetched without usage, got %v", coverage)
+	}
+}
+
+func TestDutyCoverageReportRange(t *testing.T) {
+	job, _, _ := setupDutyCoverageTest(t)
+	now := time.Now()
+
+	_, err := job.Store.Report(now, now.Add(-time.Hour))
+	var rangeErr *RangeError
+	if !errors.As(err, &rangeErr) {
+		t.Fatalf("Expected a range error, got %v", err)
+	}
+}
+
+func TestDutyCoveragePrune(t *testing.T) {
+	job, provider, tracker := setupDutyCoverageTest(t)
+	start := provider.timing.EpochTime(10)
+	if err := tracker.recordUsage(start.Unix(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := job.Evaluate(t.Context(), provider.timing, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := job.Store.pruneUsage(start.Add(time.Minute), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Fatalf("Expected the duty at slot 321 to be pruned, pruned %d", pruned)
+	}
+}
@@ -0,0 +1,432 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNoIncident is returned for incidents which don't exist.
+	ErrNoIncident = errors.New("no such incident")
+	// ErrInvalidIncident is returned for incidents with an invalid definition.
+	ErrInvalidIncident = errors.New("invalid incident")
+)
+
+var incidentIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Incident is a period declared on the admin API during which the rescue node was
+// used because of a wider outage, e.g. a client bug taking down many beacon nodes.
+//
+// Usage recorded in buckets overlapping an incident is tagged with it, so reports can
+// tell incident usage from regular usage. Incidents without an end are ongoing.
+//
+// Incidents which are exclusion windows, e.g. a client bug forcing everyone onto the
+// rescue node, have their usage recorded but not counted towards quotas. Tags are
+// resolved when usage is read, so declaring or changing an incident applies to usage
+// recorded before it as well.
+type Incident struct {
+	ID          string     `json:"id"`
+	Description string     `json:"description"`
+	Start       time.Time  `json:"start"`
+	End         *time.Time `json:"end,omitempty"`
+	Exclude     bool       `json:"exclude"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// Validate checks the definition of an incident.
+func (incident *Incident) Validate() error {
+	if !incidentIDPattern.MatchString(incident.ID) {
+		return fmt.Errorf("%w id %q, must be lowercase alphanumeric, dashes or underscores", ErrInvalidIncident, incident.ID)
+	}
+	if incident.Start.IsZero() {
+		return fmt.Errorf("%w, start is required", ErrInvalidIncident)
+	}
+	if incident.End != nil && !incident.End.After(incident.Start) {
+		return fmt.Errorf("%w, end %s isn't after start %s", ErrInvalidIncident, incident.End.Format(time.RFC3339), incident.Start.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// tags returns whether usage of the precision wide bucket starting at bucket is
+// tagged with the incident, i.e. whether the bucket overlaps it.
+func (incident *Incident) tags(bucket time.Time, precision time.Duration) bool {
+	if !bucket.Add(precision).After(incident.Start) {
+		return false
+	}
+	return incident.End == nil || bucket.Before(*incident.End)
+}
+
+// IncidentStore keeps the incidents declared on the admin API.
+type IncidentStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewIncidentStore creates the incident table in db if needed.
+func NewIncidentStore(logger *zap.Logger, db *sql.DB) (*IncidentStore, error) {
+	store := &IncidentStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *IncidentStore) initSchema() error {
+	// Times are unix milliseconds, end_time is NULL while the incident is ongoing
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS incidents (
+		id TEXT PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT '',
+		start_time INTEGER NOT NULL,
+		end_time INTEGER,
+		exclude INTEGER NOT NULL DEFAULT 0,
+		updated_at INTEGER NOT NULL
+	);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Put creates or replaces an incident.
+func (store *IncidentStore) Put(incident *Incident) error {
+	if err := incident.Validate(); err != nil {
+		return err
+	}
+
+	var end sql.NullInt64
+	if incident.End != nil {
+		end = sql.NullInt64{Int64: incident.End.UnixMilli(), Valid: true}
+	}
+	_, err := store.Database.Exec(`
+	INSERT INTO incidents (id, description, start_time, end_time, exclude, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET
+		description = excluded.description,
+		start_time = excluded.start_time,
+		end_time = excluded.end_time,
+		exclude = excluded.exclude,
+		updated_at = excluded.updated_at
+	`, incident.ID, incident.Description, incident.Start.UnixMilli(), end, incident.Exclude, store.clock().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to store incident: %w", err)
+	}
+	return nil
+}
+
+type incidentScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanIncident(row incidentScanner) (*Incident, error) {
+	incident := &Incident{}
+	var start, updatedAt int64
+	var end sql.NullInt64
+	if err := row.Scan(&incident.ID, &incident.Description, &start, &end, &incident.Exclude, &updatedAt); err != nil {
+		return nil, err
+	}
+	incident.Start = time.UnixMilli(start).UTC()
+	if end.Valid {
+		t := time.UnixMilli(end.Int64).UTC()
+		incident.End = &t
+	}
+	incident.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+	return incident, nil
+}
+
+const incidentColumns = "id, description, start_time, end_time, exclude, updated_at"
+
+// Get returns an incident.
+func (store *IncidentStore) Get(id string) (*Incident, error) {
+	incident, err := scanIncident(store.Database.QueryRow("SELECT "+incidentColumns+" FROM incidents WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoIncident
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query incident: %w", err)
+	}
+	return incident, nil
+}
+
+func (store *IncidentStore) query(query string, args ...any) ([]*Incident, error) {
+	rows, err := store.Database.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query incidents: %w", err)
+	}
+	defer rows.Close()
+
+	out := []*Incident{}
+	for rows.Next() {
+		incident, err := scanIncident(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan incident: %w", err)
+		}
+		out = append(out, incident)
+	}
+	return out, rows.Err()
+}
+
+// List returns every incident, most recent first.
+func (store *IncidentStore) List() ([]*Incident, error) {
+	return store.query("SELECT " + incidentColumns + " FROM incidents ORDER BY start_time DESC, id")
+}
+
+// Overlapping returns the incidents overlapping [from, to], oldest first.
+func (store *IncidentStore) Overlapping(from time.Time, to time.Time) ([]*Incident, error) {
+	return store.query("SELECT "+incidentColumns+" FROM incidents WHERE start_time <= ? AND (end_time IS NULL OR end_time > ?) ORDER BY start_time, id",
+		to.UnixMilli(), from.UnixMilli())
+}
+
+// Delete removes an incident. Usage it tagged is untagged.
+func (store *IncidentStore) Delete(id string) error {
+	res, err := store.Database.Exec("DELETE FROM incidents WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete incident: %w", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNoIncident
+	}
+	return nil
+}
+
+// IncidentUsageReport splits the usage of every validator in a range between the
+// incidents it was recorded during and regular usage.
+type IncidentUsageReport struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Usage of each validator outside of incidents
+	Regular map[ValidatorID]time.Duration `json:"regular"`
+	// Usage of each validator outside of exclusion windows, which counts towards quotas
+	Counted map[ValidatorID]time.Duration `json:"counted"`
+	// Usage of each validator during each incident, by incident ID. Usage recorded
+	// during overlapping incidents counts towards each of them.
+	Incidents map[string]map[ValidatorID]time.Duration `json:"incidents"`
+}
+
+// IncidentUsage returns the usage of the buckets overlapping [from, to], split
+// between incidents and regular usage.
+func IncidentUsage(tracker usageBuckets, store *IncidentStore, from time.Time, to time.Time) (*IncidentUsageReport, error) {
+	precision := tracker.bucketPrecision()
+	start := from.Truncate(precision)
+	// Buckets overlapping [from, to] start in [start, to]
+	records, err := tracker.usageRecords(start, to.Add(time.Nanosecond))
+	if err != nil {
+		return nil, err
+	}
+	incidents, err := store.Overlapping(start, to.Truncate(precision).Add(precision))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &IncidentUsageReport{
+		From:      from,
+		To:        to,
+		Regular:   make(map[ValidatorID]time.Duration),
+		Counted:   make(map[ValidatorID]time.Duration),
+		Incidents: make(map[string]map[ValidatorID]time.Duration, len(incidents)),
+	}
+	for _, incident := range incidents {
+		report.Incidents[incident.ID] = make(map[ValidatorID]time.Duration)
+	}
+	for _, record := range records {
+		tagged, excluded := false, false
+		for _, incident := range incidents {
+			if incident.tags(record.Bucket, precision) {
+				report.Incidents[incident.ID][record.Validator] += precision
+				tagged = true
+				excluded = excluded || incident.Exclude
+			}
+		}
+		if !tagged {
+			report.Regular[record.Validator] += precision
+		}
+		if !excluded {
+			report.Counted[record.Validator] += precision
+		}
+	}
+	return report, nil
+}
+
+func (pr *ProxyRouter) incidentStore(w http.ResponseWriter) (*IncidentStore, bool) {
+	if pr.incidents == nil {
+		http.Error(w, "incidents require a SQL usage tracker", http.StatusNotImplemented)
+		return nil, false
+	}
+	return pr.incidents, true
+}
+
+func (pr *ProxyRouter) writeIncidentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidIncident):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNoIncident):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		pr.Logger.Error("Failed to access incidents", zap.Error(err))
+		http.Error(w, "failed to access incidents", http.StatusInternalServerError)
+	}
+}
+
+func (pr *ProxyRouter) serveListIncidents(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.incidentStore(w)
+	if !ok {
+		return
+	}
+
+	incidents, err := store.List()
+	if err != nil {
+		pr.writeIncidentError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, incidents)
+}
+
+func (pr *ProxyRouter) serveGetIncident(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.incidentStore(w)
+	if !ok {
+		return
+	}
+
+	incident, err := store.Get(mux.Vars(r)["id"])
+	if err != nil {
+		pr.writeIncidentError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, incident)
+}
+
+// servePutIncident declares or updates the incident in the path. The start defaults to
+// now, and an incident is ended by setting its end.
+func (pr *ProxyRouter) servePutIncident(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.incidentStore(w)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Description string     `json:"description"`
+		Start       *time.Time `json:"start"`
+		End         *time.Time `json:"end"`
+		Exclude     bool       `json:"exclude"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid incident: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	incident := &Incident{
+		ID:          mux.Vars(r)["id"],
+		Description: body.Description,
+		Start:       store.clock(),
+		End:         body.End,
+		Exclude:     body.Exclude,
+	}
+	if body.Start != nil {
+		incident.Start = *body.Start
+	}
+	if err := store.Put(incident); err != nil {
+		pr.writeIncidentError(w, err)
+		return
+	}
+	incident, err := store.Get(incident.ID)
+	if err != nil {
+		pr.writeIncidentError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, incident)
+}
+
+func (pr *ProxyRouter) serveDeleteIncident(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.incidentStore(w)
+	if !ok {
+		return
+	}
+
+	if err := store.Delete(mux.Vars(r)["id"]); err != nil {
+		pr.writeIncidentError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveIncidentUsage returns the usage of every validator during an incident, up to
+// now if it's ongoing.
+func (pr *ProxyRouter) serveIncidentUsage(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.incidentStore(w)
+	if !ok {
+		return
+	}
+
+	incident, err := store.Get(mux.Vars(r)["id"])
+	if err != nil {
+		pr.writeIncidentError(w, err)
+		return
+	}
+	to := store.clock()
+	if incident.End != nil {
+		to = *incident.End
+	}
+
+	usage, err := pr.usage().ViewUsage(incident.Start, to)
+	if err != nil {
+		pr.Logger.Error("Failed to view incident usage", zap.String("incident", incident.ID), zap.Error(err))
+		http.Error(w, "failed to view usage", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, NewUsageSummary(incident.Start, to, usage))
+}
+
+// serveUsageIncidents splits the usage of the buckets overlapping [from, to] between
+// incidents and regular usage, and reports the usage counted towards quotas, see
+// IncidentUsage.
+func (pr *ProxyRouter) serveUsageIncidents(w http.ResponseWriter, r *http.Request) {
+	if !pr.requireUsageCapability(w, "incident usage", UsageCapabilityBuckets) {
+		return
+	}
+	store, ok := pr.incidentStore(w)
+	if !ok {
+		return
+	}
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := IncidentUsage(pr.ut.(usageBuckets), store, from, to)
+	if err != nil {
+		pr.Logger.Error("Failed to view incident usage", zap.Error(err))
+		http.Error(w, "failed to view usage", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
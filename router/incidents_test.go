@@ -0,0 +1,121 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestIncidents(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	var err error
+	if pr.incidents, err = NewIncidentStore(zaptest.NewLogger(t), pr.orgs.Database); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	pr.ut.(*SQLiteUsageTracker).now = func() time.Time { return now }
+	pr.incidents.now = func() time.Time { return now }
+	for _, indexes := range [][]string{{"1", "2"}, {"1", "3"}, {"1"}} {
+		if err := pr.ut.RecordUsage(indexes); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(5 * time.Minute)
+	}
+	handler := pr.AdminHandler()
+
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	for id, body := range map[string]string{
+		"Outage": `{"start": "2025-01-01T00:06:00Z"}`,
+		"outage": `{"start": "2025-01-01T00:06:00Z", "end": "2025-01-01T00:06:00Z"}`,
+	} {
+		if rec := serve(http.MethodPut, "/incidents/"+id, body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %d for %s, got %d", http.StatusBadRequest, body, rec.Code)
+		}
+	}
+	rec := serve(http.MethodPut, "/incidents/outage", `{"description": "Client bug", "start": "2025-01-01T00:06:00Z", "end": "2025-01-01T00:09:00Z", "exclude": true}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	// Only the bucket overlapping the incident is tagged
+	rec = serve(http.MethodGet, "/usage/incidents?from=2025-01-01T00:00:00Z&to=2025-01-01T00:14:00Z", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var report IncidentUsageReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Regular) != 2 || report.Regular["1"] != 10*time.Minute || report.Regular["2"] != 5*time.Minute {
+		t.Fatalf("Unexpected regular usage %v", report.Regular)
+	}
+	if outage := report.Incidents["outage"]; len(outage) != 2 || outage["1"] != 5*time.Minute || outage["3"] != 5*time.Minute {
+		t.Fatalf("Unexpected incident usage %v", report.Incidents)
+	}
+
+	rec = serve(http.MethodGet, "/usage?from=2025-01-01T00:00:00Z&to=2025-01-01T00:14:00Z&incidents=exclude", "")
+	var usage map[string]float64
+	if err := json.Unmarshal(rec.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || usage["1"] != 600 || usage["2"] != 300 {
+		t.Fatalf("Expected usage outside of the incident, got %v", usage)
+	}
+
+	// Ongoing incidents report their usage up to now
+	rec = serve(http.MethodPut, "/incidents/ongoing", `{"start": "2025-01-01T00:10:00Z"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	rec = serve(http.MethodGet, "/incidents/ongoing/usage", "")
+	var summary UsageSummary
+	if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if !summary.To.Equal(now) || len(summary.Validators) != 1 || summary.Usage("1") != 5*time.Minute {
+		t.Fatalf("Unexpected incident usage %+v", summary)
+	}
+
+	// Usage of incidents which aren't exclusion windows is still counted
+	report = IncidentUsageReport{}
+	rec = serve(http.MethodGet, "/usage/incidents?from=2025-01-01T00:00:00Z&to=2025-01-01T00:14:00Z", "")
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Counted) != 2 || report.Counted["1"] != 10*time.Minute || report.Counted["2"] != 5*time.Minute {
+		t.Fatalf("Unexpected counted usage %v", report.Counted)
+	}
+	if len(report.Regular) != 2 || report.Regular["1"] != 5*time.Minute || report.Regular["2"] != 5*time.Minute {
+		t.Fatalf("Unexpected regular usage %v", report.Regular)
+	}
+
+	var incidents []*Incident
+	if err := json.Unmarshal(serve(http.MethodGet, "/incidents", "").Body.Bytes(), &incidents); err != nil {
+		t.Fatal(err)
+	}
+	if len(incidents) != 2 || incidents[0].ID != "ongoing" || incidents[1].Description != "Client bug" || !incidents[1].Exclude {
+		t.Fatalf("Unexpected incidents %+v", incidents)
+	}
+
+	if rec := serve(http.MethodDelete, "/incidents/outage", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if rec := serve(http.MethodGet, "/incidents/outage", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
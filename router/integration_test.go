@@ -0,0 +1,207 @@
+//go:build ns && integration
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/config"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/test"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/usageclient"
+	"github.com/ethereum/go-ethereum/common"
+	rptypes "github.com/rocket-pool/rocketpool-go/types"
+	"go.uber.org/zap/zaptest"
+)
+
+// These tests run the proxy, a fake beacon node, the SQLite usage tracker and the
+// admin API together, and check usage flows from proxied requests to admin reports.
+// Run them with: go test -tags ns,integration -run Integration ./router/
+
+type integrationTest struct {
+	routerTest
+	errs chan error
+	// Requests which reached the fake beacon node
+	upstream *atomic.Int64
+	admin    *usageclient.Client
+}
+
+func setupIntegration(t *testing.T, configure func(pr *ProxyRouter)) integrationTest {
+	_, err := metrics.Init("integration_test_" + strings.ReplaceAll(t.Name(), "/", "_"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	t.Cleanup(cancel)
+
+	upstream := &atomic.Int64{}
+	beacon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.Add(1)
+		_, _ = fmt.Fprintln(w, responseString)
+	}))
+	t.Cleanup(beacon.Close)
+	beaconURL, err := url.Parse(beacon.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpListener, err := net.Listen("tcp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := test.NewMockConsensusLayer(100, t.Name())
+	el := test.NewMockExecutionLayer(50, 5, 100, 2, t.Name())
+	cl.AddExecutionValidators(el, t.Name())
+
+	pr := &ProxyRouter{
+		Addr:                 httpListener.Addr().String(),
+		BeaconURL:            beaconURL,
+		CL:                   cl,
+		EL:                   el,
+		Logger:               zaptest.NewLogger(t),
+		CredentialSecrets:    config.CredentialSecrets{[]byte("test"), []byte("test2")},
+		EnableSoloValidators: true,
+		UsageTrackerOptions: UsageTrackerOptions{
+			DSN: "file:" + filepath.Join(t.TempDir(), "usage.db"),
+		},
+	}
+	if configure != nil {
+		configure(pr)
+	}
+	pr.Init()
+
+	adminServer := httptest.NewServer(pr.AdminHandler())
+	t.Cleanup(adminServer.Close)
+	admin, err := usageclient.NewClient(adminServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 1)
+	it := integrationTest{
+		routerTest: routerTest{
+			ctx: ctx,
+			pr:  pr,
+			start: func() {
+				errs <- pr.Serve(httpListener, nil)
+			},
+		},
+		errs:     errs,
+		upstream: upstream,
+		admin:    admin,
+	}
+	go it.start()
+	return it
+}
+
+// stakewiseValidator returns the index of a validator in a StakeWise vault and the fee
+// recipient it must use.
+func (it integrationTest) stakewiseValidator(t *testing.T) (string, common.Address) {
+	var vault, fr common.Address
+	for v, f := range it.pr.EL.(*test.MockExecutionLayer).SWVaults {
+		vault, fr = v, f
+		break
+	}
+
+	validators, err := it.pr.CL.GetValidators()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range validators {
+		if bytes.Equal(v.Validator.WithdrawalCredentials[12:], vault[:]) {
+			pubkey := rptypes.BytesToValidatorPubkey(v.Validator.PublicKey[:])
+			return it.pr.CL.(*test.MockConsensusLayer).Indices[pubkey], fr
+		}
+	}
+	t.Fatalf("No validator withdraws to vault %s", vault)
+	return "", common.Address{}
+}
+
+func (it integrationTest) prepareBeaconProposer(t *testing.T, index string, fr string) int {
+	username, pw := it.validAuth(t, false)
+	resp, err := http.Post(
+		"http://"+username+":"+pw+"@"+it.pr.Addr+"/eth/v1/validator/prepare_beacon_proposer",
+		"application/json",
+		strings.NewReader(fmt.Sprintf(`[{"validator_index": "%s", "fee_recipient": "%s"}]`, index, fr)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (it integrationTest) stop(t *testing.T) {
+	it.pr.Stop(it.ctx)
+	if err := <-it.errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIntegrationUsage(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		configure func(pr *ProxyRouter)
+	}{
+		{"synchronous", nil},
+		{"write queue", func(pr *ProxyRouter) { pr.UsageWriteQueue = 16 }},
+		{"hybrid", func(pr *ProxyRouter) { pr.UsageTrackerOptions.Model = UsageModelHybrid }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			it := setupIntegration(t, tt.configure)
+			from := time.Now().Add(-time.Minute)
+
+			index, fr := it.stakewiseValidator(t)
+			if code := it.prepareBeaconProposer(t, index, fr.String()); code != http.StatusOK {
+				t.Fatalf("Expected 200, got %d", code)
+			}
+			// Refused requests are neither proxied nor recorded
+			if code := it.prepareBeaconProposer(t, index, "0xabcf8e0d4e9587369b2301d0790347320302cc09"); code != http.StatusConflict {
+				t.Fatalf("Expected 409, got %d", code)
+			}
+			if n := it.upstream.Load(); n != 1 {
+				t.Fatalf("Expected a single request to be proxied, got %d", n)
+			}
+
+			capabilities, err := it.admin.Capabilities(it.ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !capabilities.Has(string(UsageCapabilityBuckets)) {
+				t.Fatalf("Unexpected capabilities %+v", capabilities)
+			}
+
+			// Stopping writes what's queued, then closes the usage database
+			it.stop(t)
+			// A closed tracker won't reopen, so don't wait on retries
+			it.admin.Retries = -1
+			if _, err := it.admin.Usage(it.ctx, from, time.Now()); err == nil {
+				t.Fatal("Expected reads to fail once the router stopped")
+			}
+
+			tracker := NewUsageTracker(zaptest.NewLogger(t), it.pr.UsageTrackerOptions)
+			defer tracker.Close()
+			usage, err := tracker.ViewUsage(from, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(usage) != 1 || usage[index] != defaultUsagePrecision {
+				t.Fatalf("Expected a bucket of usage for validator %s, got %v", index, usage)
+			}
+		})
+	}
+}
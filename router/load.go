@@ -0,0 +1,319 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LoadLevel grades how loaded the rescue node is.
+type LoadLevel int
+
+const (
+	LoadNormal LoadLevel = iota
+	LoadElevated
+	LoadOverloaded
+)
+
+func (l LoadLevel) String() string {
+	switch l {
+	case LoadNormal:
+		return "normal"
+	case LoadElevated:
+		return "elevated"
+	case LoadOverloaded:
+		return "overloaded"
+	}
+	return "unknown"
+}
+
+// LoadThresholds are the active validator counts and upstream latencies at which
+// load becomes elevated or overloaded. Zero values disable a threshold.
+type LoadThresholds struct {
+	ElevatedValidators   int
+	OverloadedValidators int
+	ElevatedLatency      time.Duration
+	OverloadedLatency    time.Duration
+}
+
+// Enabled returns whether any threshold is set.
+func (t LoadThresholds) Enabled() bool {
+	return t != LoadThresholds{}
+}
+
+func levelOf[T int | time.Duration](value T, elevated T, overloaded T) LoadLevel {
+	switch {
+	case overloaded > 0 && value >= overloaded:
+		return LoadOverloaded
+	case elevated > 0 && value >= elevated:
+		return LoadElevated
+	}
+	return LoadNormal
+}
+
+// defaultLoadWindow is how long a validator counts as active after its last
+// prepare_beacon_proposer call, which validator clients make every epoch.
+const defaultLoadWindow = 2 * 32 * 12 * time.Second
+
+// loadPruneInterval is how often validators which left the window are forgotten, so
+// the active validator count lags by at most a slot.
+const loadPruneInterval = 12 * time.Second
+
+// LoadMonitor derives a LoadLevel from the number of active validators and the
+// latency of the upstream beacon node.
+type LoadMonitor struct {
+	Thresholds LoadThresholds
+	// How long a validator counts as active after it's seen, defaults to 2 epochs
+	Window time.Duration
+	Logger *zap.Logger
+
+	mu      sync.Mutex
+	seen    map[string]time.Time
+	latency time.Duration
+	// Size of seen, read without the lock on every request
+	active atomic.Int64
+	// Bounds seen, see MemoryBudget
+	limit cacheLimit
+
+	wallClock
+}
+
+func (m *LoadMonitor) window() time.Duration {
+	if m.Window == 0 {
+		return defaultLoadWindow
+	}
+	return m.Window
+}
+
+// ObserveValidators marks validators as active.
+func (m *LoadMonitor) ObserveValidators(indices []string) {
+	now := m.clock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seen == nil {
+		m.seen = make(map[string]time.Time, len(indices))
+	}
+	for _, index := range indices {
+		m.add(index, now)
+	}
+}
+
+// add marks index as seen at t, evicting the least recently seen validators if seen
+// is full. m.mu must be held.
+func (m *LoadMonitor) add(index string, t time.Time) {
+	if _, ok := m.seen[index]; !ok && m.limit.full(len(m.seen)) {
+		m.limit.evict(m.seen, m.clock().Add(-m.window()))
+	}
+	m.seen[index] = t
+	m.active.Store(int64(len(m.seen)))
+}
+
+func (m *LoadMonitor) cacheEntries() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.seen)
+}
+
+func (m *LoadMonitor) cacheEvictions() uint64 {
+	return m.limit.evictions.Load()
+}
+
+// ObserveLatency adds a sample of the upstream latency.
+// Samples are smoothed with an exponentially weighted moving average.
+func (m *LoadMonitor) ObserveLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latency == 0 {
+		m.latency = d
+		return
+	}
+	m.latency = (m.latency*3 + d) / 4
+}
+
+// ActiveValidators returns the number of validators seen within the window, as of the
+// last Prune.
+func (m *LoadMonitor) ActiveValidators() int {
+	return int(m.active.Load())
+}
+
+// Prune forgets the validators which left the window.
+func (m *LoadMonitor) Prune() {
+	cutoff := m.clock().Add(-m.window())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for index, seen := range m.seen {
+		if seen.Before(cutoff) {
+			delete(m.seen, index)
+		}
+	}
+	m.active.Store(int64(len(m.seen)))
+}
+
+// PruneEvery calls Prune every interval until ctx is done.
+func (m *LoadMonitor) PruneEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.Prune()
+		}
+	}
+}
+
+// Latency returns the smoothed upstream latency.
+func (m *LoadMonitor) Latency() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latency
+}
+
+// LoadLevel returns the higher of the levels of the active validators and latency.
+func (m *LoadMonitor) LoadLevel() LoadLevel {
+	t := m.Thresholds
+	return max(
+		levelOf(m.ActiveValidators(), t.ElevatedValidators, t.OverloadedValidators),
+		levelOf(m.Latency(), t.ElevatedLatency, t.OverloadedLatency),
+	)
+}
+
+// ProbeUpstream measures the latency of the beacon node's health endpoint every
+// interval until ctx is done. Failed probes count as taking the whole timeout.
+func (m *LoadMonitor) ProbeUpstream(ctx context.Context, beaconURL *url.URL, interval time.Duration) {
+	health := beaconURL.JoinPath("/eth/v1/node/health").String()
+	client := &http.Client{Timeout: interval}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, health, nil)
+		if err != nil {
+			m.Logger.Warn("Failed to create upstream probe", zap.Error(err))
+			return
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			m.Logger.Debug("Upstream probe failed", zap.Error(err))
+			m.ObserveLatency(interval)
+			continue
+		}
+		resp.Body.Close()
+		m.ObserveLatency(time.Since(start))
+	}
+}
+
+// RequestPriority ranks requests for load shedding. Lower priorities are shed first.
+type RequestPriority int
+
+const (
+	// Expensive queries validator clients don't need for their duties, such as
+	// historical state or debug endpoints. Shed once load is elevated.
+	PriorityBulk RequestPriority = iota
+	// Everything else. Shed once overloaded.
+	PriorityNormal
+	// Requests validator clients need to attest and propose. Never shed.
+	PriorityCritical
+)
+
+func (p RequestPriority) String() string {
+	switch p {
+	case PriorityBulk:
+		return "bulk"
+	case PriorityNormal:
+		return "normal"
+	case PriorityCritical:
+		return "critical"
+	}
+	return "unknown"
+}
+
+// shedAt returns the load level at which requests of priority p are shed.
+func (p RequestPriority) shedAt() (LoadLevel, bool) {
+	switch p {
+	case PriorityBulk:
+		return LoadElevated, true
+	case PriorityNormal:
+		return LoadOverloaded, true
+	}
+	return 0, false
+}
+
+// Paths validator clients use to fetch duties, attest and propose
+var criticalPrefixes = []string{
+	"/eth/v1/validator/",
+	"/eth/v2/validator/",
+	"/eth/v3/validator/",
+	"/eth/v1/beacon/pool/",
+	"/eth/v2/beacon/pool/",
+	"/eth/v1/beacon/blocks",
+	"/eth/v2/beacon/blocks",
+	"/eth/v1/beacon/blinded_blocks",
+	"/eth/v2/beacon/blinded_blocks",
+	"/eth/v1/beacon/headers",
+	"/eth/v1/beacon/genesis",
+	"/eth/v1/beacon/states/head/",
+	"/eth/v1/config/",
+	"/eth/v1/events",
+	"/eth/v1/node/",
+}
+
+// Paths of expensive queries
+var bulkPrefixes = []string{
+	"/eth/v1/debug/",
+	"/eth/v2/debug/",
+	"/eth/v1/beacon/rewards/",
+	"/eth/v1/beacon/light_client/",
+}
+
+// classifyRequest returns the priority of a request from its path.
+func classifyRequest(r *http.Request) RequestPriority {
+	path := r.URL.Path
+	for _, prefix := range criticalPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return PriorityCritical
+		}
+	}
+	for _, prefix := range bulkPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return PriorityBulk
+		}
+	}
+	if strings.HasPrefix(path, "/eth/v1/beacon/states/") {
+		// Recent states are cheap, anything else is archival
+		state, _, _ := strings.Cut(strings.TrimPrefix(path, "/eth/v1/beacon/states/"), "/")
+		if state != "finalized" && state != "justified" {
+			return PriorityBulk
+		}
+	}
+	return PriorityNormal
+}
+
+// shouldShed returns whether a request of priority p is shed at the current load.
+func (m *LoadMonitor) shouldShed(p RequestPriority) bool {
+	level, ok := p.shedAt()
+	return ok && m.LoadLevel() >= level
+}
@@ -0,0 +1,154 @@
+//go:build ns
+
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestLoadLevelValidators(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &LoadMonitor{
+		Thresholds: LoadThresholds{ElevatedValidators: 2, OverloadedValidators: 3},
+		Window:     time.Minute,
+		Logger:     zaptest.NewLogger(t),
+		wallClock:  wallClock{now: func() time.Time { return now }},
+	}
+
+	if m.LoadLevel() != LoadNormal {
+		t.Fatalf("Expected normal load, got %s", m.LoadLevel())
+	}
+
+	m.ObserveValidators([]string{"1", "2"})
+	if m.LoadLevel() != LoadElevated {
+		t.Fatalf("Expected elevated load, got %s", m.LoadLevel())
+	}
+
+	now = now.Add(30 * time.Second)
+	m.ObserveValidators([]string{"2", "3"})
+	if m.LoadLevel() != LoadOverloaded {
+		t.Fatalf("Expected overloaded, got %s", m.LoadLevel())
+	}
+
+	// Validator 1 leaves the window, and is forgotten once pruned
+	now = now.Add(45 * time.Second)
+	if m.ActiveValidators() != 3 {
+		t.Fatalf("Expected 3 active validators until pruned, got %d", m.ActiveValidators())
+	}
+	m.Prune()
+	if m.ActiveValidators() != 2 {
+		t.Fatalf("Expected 2 active validators, got %d", m.ActiveValidators())
+	}
+	if m.LoadLevel() != LoadElevated {
+		t.Fatalf("Expected elevated load, got %s", m.LoadLevel())
+	}
+}
+
+func TestLoadLevelLatency(t *testing.T) {
+	m := &LoadMonitor{
+		Thresholds: LoadThresholds{ElevatedLatency: time.Second},
+		Logger:     zaptest.NewLogger(t),
+	}
+
+	m.ObserveLatency(2 * time.Second)
+	if m.LoadLevel() != LoadElevated {
+		t.Fatalf("Expected elevated load, got %s", m.LoadLevel())
+	}
+
+	// Latency is smoothed, a single fast sample doesn't clear it
+	m.ObserveLatency(0)
+	if m.Latency() != 1500*time.Millisecond {
+		t.Fatalf("Unexpected smoothed latency %v", m.Latency())
+	}
+	if m.LoadLevel() != LoadElevated {
+		t.Fatalf("Expected elevated load, got %s", m.LoadLevel())
+	}
+
+	// No overloaded threshold is set
+	m.ObserveLatency(time.Hour)
+	if m.LoadLevel() != LoadElevated {
+		t.Fatalf("Expected elevated load, got %s", m.LoadLevel())
+	}
+}
+
+func TestClassifyRequest(t *testing.T) {
+	tests := []struct {
+		path     string
+		priority RequestPriority
+	}{
+		{"/eth/v1/validator/duties/attester/1", PriorityCritical},
+		{"/eth/v3/validator/blocks/1", PriorityCritical},
+		{"/eth/v1/beacon/pool/attestations", PriorityCritical},
+		{"/eth/v1/beacon/states/head/validators", PriorityCritical},
+		{"/eth/v1/node/syncing", PriorityCritical},
+		{"/eth/v1/beacon/states/finalized/finality_checkpoints", PriorityNormal},
+		{"/eth/v1/beacon/blob_sidecars/1", PriorityNormal},
+		{"/eth/v1/beacon/states/1234/validators", PriorityBulk},
+		{"/eth/v2/debug/beacon/states/head", PriorityBulk},
+		{"/eth/v1/beacon/rewards/blocks/1", PriorityBulk},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if p := classifyRequest(r); p != tt.priority {
+			t.Errorf("Expected %s to be %s, got %s", tt.path, tt.priority, p)
+		}
+	}
+}
+
+func TestRouterShedsByPriority(t *testing.T) {
+	errs := make(chan error)
+	rt := setup(t, errs)
+	rt.pr.load = &LoadMonitor{
+		Thresholds: LoadThresholds{ElevatedValidators: 1, OverloadedValidators: 2},
+		Logger:     zaptest.NewLogger(t),
+	}
+
+	go rt.start()
+
+	username, pw := rt.validAuth(t, false)
+	get := func(path string) int {
+		resp, err := http.Get("http://" + username + ":" + pw + "@" + rt.pr.Addr + path)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	const bulk = "/eth/v1/debug/beacon/heads"
+	const normal = "/eth/v1/beacon/blob_sidecars/head"
+	const critical = "/eth/v1/node/syncing"
+
+	expect := func(level LoadLevel, codes map[string]int) {
+		t.Helper()
+		if rt.pr.load.LoadLevel() != level {
+			t.Fatalf("Expected %s load, got %s", level, rt.pr.load.LoadLevel())
+		}
+		for path, code := range codes {
+			if got := get(path); got != code {
+				t.Fatalf("Expected %d for %s at %s load, got %d", code, path, level, got)
+			}
+		}
+	}
+
+	expect(LoadNormal, map[string]int{bulk: http.StatusOK, normal: http.StatusOK, critical: http.StatusOK})
+
+	rt.pr.load.ObserveValidators([]string{"1"})
+	expect(LoadElevated, map[string]int{bulk: http.StatusTooManyRequests, normal: http.StatusOK, critical: http.StatusOK})
+
+	rt.pr.load.ObserveValidators([]string{"2"})
+	expect(LoadOverloaded, map[string]int{bulk: http.StatusTooManyRequests, normal: http.StatusTooManyRequests, critical: http.StatusOK})
+
+	rt.pr.Stop(rt.ctx)
+
+	err := <-errs
+	if err != nil {
+		t.Fatal(err)
+	}
+}
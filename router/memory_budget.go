@@ -0,0 +1,299 @@
+//go:build ns
+
+package router
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MemoryCache names an in-process cache bounded by a MemoryBudget.
+type MemoryCache string
+
+const (
+	// Validator info cached by the consensus layer client, see
+	// consensuslayer.CachingConsensusLayer
+	MemoryCacheValidators MemoryCache = "validators"
+	// Active validators of the load monitor, see LoadMonitor
+	MemoryCacheActive MemoryCache = "active"
+	// Recently seen validators, used to apply the boundary grace
+	MemoryCacheGrace MemoryCache = "grace"
+	// Validators recorded in the current bucket, used to coalesce writes
+	MemoryCacheCoalesce MemoryCache = "coalesce"
+	// Usage spooled while the database is unavailable or the write queue is full
+	MemoryCacheSpool MemoryCache = "spool"
+	// Nodes outside every organization, logged once in multi-tenant mode
+	MemoryCacheUntenanted MemoryCache = "untenanted"
+)
+
+const mib = 1 << 20
+
+// memoryCacheSpec is how a cache is sized by a MemoryBudget.
+type memoryCacheSpec struct {
+	name MemoryCache
+	// Share of the budget when the cache has no limit of its own
+	share float64
+	// Estimated size of an entry, including map overhead. 0 for caches sized in bytes.
+	entryBytes int64
+	// Bytes used without a budget, 0 for unbounded
+	defaultBytes int64
+}
+
+var memoryCaches = []memoryCacheSpec{
+	{name: MemoryCacheValidators, share: 0.5, defaultBytes: 512 * mib},
+	{name: MemoryCacheActive, share: 0.15, entryBytes: 96},
+	{name: MemoryCacheGrace, share: 0.1, entryBytes: 96},
+	{name: MemoryCacheCoalesce, share: 0.09, entryBytes: 64},
+	{name: MemoryCacheSpool, share: 0.15, entryBytes: 64, defaultBytes: maxSpooledUsage * 64},
+	{name: MemoryCacheUntenanted, share: 0.01, entryBytes: 96, defaultBytes: maxUntenantedNodes * 96},
+}
+
+func memoryCacheSpecOf(cache MemoryCache) (memoryCacheSpec, bool) {
+	i := slices.IndexFunc(memoryCaches, func(spec memoryCacheSpec) bool {
+		return spec.name == cache
+	})
+	if i < 0 {
+		return memoryCacheSpec{}, false
+	}
+	return memoryCaches[i], true
+}
+
+// MemoryBudget bounds the memory used by in-process caches, which grow with the number
+// of validators using the rescue node.
+//
+// Caches without a limit of their own share what's left of Total after explicit
+// limits, in fixed proportions. Without a budget, the validator cache and the spools
+// keep their historical limits, the untenanted nodes have a default one, and the other
+// caches are unbounded.
+//
+// Caches enforce their limit when full: the active and recently seen validators and
+// the untenanted nodes evict the least recently seen first, the coalescer stops remembering validators and lets
+// their writes through to the database, spools drop new usage, and the validator cache
+// evicts its oldest entries.
+type MemoryBudget struct {
+	// Bytes shared by every cache, 0 for no overall budget
+	Total int64
+	// Bytes per cache, taken out of Total
+	Limits map[MemoryCache]int64
+}
+
+// ParseMemoryBudget parses a budget of total MiB, and per cache limits in MiB as a
+// comma separated list, e.g. validators=256,spool=64. It returns nil if both are unset.
+func ParseMemoryBudget(total int, caches string) (*MemoryBudget, error) {
+	if total < 0 {
+		return nil, fmt.Errorf("memory budget %d is negative", total)
+	}
+	if total == 0 && caches == "" {
+		return nil, nil
+	}
+
+	out := &MemoryBudget{
+		Total:  int64(total) * mib,
+		Limits: make(map[MemoryCache]int64),
+	}
+	if caches != "" {
+		for _, limit := range strings.Split(caches, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(limit), "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid cache limit %q, expected cache=MiB", limit)
+			}
+			if _, ok := memoryCacheSpecOf(MemoryCache(key)); !ok {
+				return nil, fmt.Errorf("unknown cache %q", key)
+			}
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("invalid limit %q of cache %q, expected a positive number of MiB", value, key)
+			}
+			out.Limits[MemoryCache(key)] = size * mib
+		}
+	}
+
+	if out.Total > 0 {
+		var limited int64
+		for _, size := range out.Limits {
+			limited += size
+		}
+		if limited > out.Total {
+			return nil, fmt.Errorf("cache limits add up to %d MiB, more than the budget of %d MiB", limited/mib, total)
+		}
+	}
+	return out, nil
+}
+
+// Bytes returns the memory cache may use, 0 if it's unbounded.
+func (b *MemoryBudget) Bytes(cache MemoryCache) int64 {
+	spec, _ := memoryCacheSpecOf(cache)
+	if b == nil {
+		return spec.defaultBytes
+	}
+	if size, ok := b.Limits[cache]; ok {
+		return size
+	}
+	if b.Total == 0 {
+		return spec.defaultBytes
+	}
+
+	remaining := b.Total
+	shares := 0.0
+	for _, other := range memoryCaches {
+		if size, ok := b.Limits[other.name]; ok {
+			remaining -= size
+		} else {
+			shares += other.share
+		}
+	}
+	return int64(float64(remaining) * spec.share / shares)
+}
+
+// MiB returns the memory cache may use in MiB, rounded up, 0 if it's unbounded.
+func (b *MemoryBudget) MiB(cache MemoryCache) int {
+	return int((b.Bytes(cache) + mib - 1) / mib)
+}
+
+// Entries returns the number of entries cache may hold, 0 if it's unbounded or sized
+// in bytes.
+func (b *MemoryBudget) Entries(cache MemoryCache) int {
+	spec, _ := memoryCacheSpecOf(cache)
+	if spec.entryBytes == 0 {
+		return 0
+	}
+	entries := int(b.Bytes(cache) / spec.entryBytes)
+	if entries == 0 && b.Bytes(cache) > 0 {
+		// Less than an entry still bounds the cache
+		return 1
+	}
+	return entries
+}
+
+// cacheLimit bounds the entries of an in-process cache. The zero value is unbounded.
+type cacheLimit struct {
+	// Maximum entries, 0 for no limit
+	max int
+	// Entries evicted, or refused by caches which don't evict
+	evictions atomic.Uint64
+}
+
+// full returns whether a cache of n entries can't take another one.
+func (l *cacheLimit) full(n int) bool {
+	return l.max > 0 && n >= l.max
+}
+
+// evict makes room in seen for new entries, deleting those last seen before cutoff,
+// which have expired, then the least recently seen. It frees a tenth of the limit, so
+// sorting is amortized over many inserts.
+func (l *cacheLimit) evict(seen map[string]time.Time, cutoff time.Time) {
+	for index, last := range seen {
+		if last.Before(cutoff) {
+			delete(seen, index)
+		}
+	}
+	target := l.max - max(l.max/10, 1)
+	if len(seen) <= target {
+		return
+	}
+
+	type entry struct {
+		index string
+		last  time.Time
+	}
+	entries := make([]entry, 0, len(seen))
+	for index, last := range seen {
+		entries = append(entries, entry{index, last})
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		return a.last.Compare(b.last)
+	})
+	evicted := entries[:len(entries)-target]
+	for _, e := range evicted {
+		delete(seen, e.index)
+	}
+	l.evictions.Add(uint64(len(evicted)))
+}
+
+// boundedCache is implemented by caches bounded by a MemoryBudget, so their size can
+// be reported.
+type boundedCache interface {
+	cacheEntries() int
+	cacheEvictions() uint64
+}
+
+// memoryBoundedTracker is implemented by usage trackers holding bounded caches.
+type memoryBoundedTracker interface {
+	boundedCaches(out map[MemoryCache][]boundedCache)
+}
+
+func (tracker *SQLiteUsageTracker) boundedCaches(out map[MemoryCache][]boundedCache) {
+	if tracker.BoundaryGrace > 0 {
+		out[MemoryCacheGrace] = append(out[MemoryCacheGrace], &tracker.grace)
+	}
+	if tracker.Coalesce {
+		out[MemoryCacheCoalesce] = append(out[MemoryCacheCoalesce], &tracker.coalescer)
+	}
+}
+
+func (tracker *HybridUsageTracker) boundedCaches(out map[MemoryCache][]boundedCache) {
+	tracker.Buckets.boundedCaches(out)
+}
+
+func (tracker *SpoolingUsageTracker) boundedCaches(out map[MemoryCache][]boundedCache) {
+	out[MemoryCacheSpool] = append(out[MemoryCacheSpool], tracker)
+	tracker.mu.Lock()
+	backend := tracker.backend
+	tracker.mu.Unlock()
+	if backend, ok := backend.(memoryBoundedTracker); ok {
+		backend.boundedCaches(out)
+	}
+}
+
+// boundedCaches returns the bounded caches of the router, some of which, like the
+// spools, may have several instances.
+func (pr *ProxyRouter) boundedCaches() map[MemoryCache][]boundedCache {
+	out := make(map[MemoryCache][]boundedCache)
+	if tracker, ok := pr.ut.(memoryBoundedTracker); ok {
+		tracker.boundedCaches(out)
+	}
+	if pr.load != nil {
+		out[MemoryCacheActive] = append(out[MemoryCacheActive], pr.load)
+	}
+	if pr.writes != nil {
+		out[MemoryCacheSpool] = append(out[MemoryCacheSpool], pr.writes)
+	}
+	if pr.UsageTrackerOptions.MultiTenant {
+		out[MemoryCacheUntenanted] = append(out[MemoryCacheUntenanted], &pr.untenanted)
+	}
+	return out
+}
+
+// registerMemoryMetrics exports the limit, entries and evictions of every cache in the
+// memory subsystem, labeled with the cache's name.
+func (pr *ProxyRouter) registerMemoryMetrics() {
+	for _, spec := range memoryCaches {
+		m := metrics.NewLabeledMetricsRegistry("memory", prometheus.Labels{"cache": string(spec.name)})
+		m.Gauge("limit_bytes").Set(float64(pr.MemoryBudget.Bytes(spec.name)))
+		if spec.entryBytes > 0 {
+			m.Gauge("limit_entries").Set(float64(pr.MemoryBudget.Entries(spec.name)))
+			m.GaugeFunc("entries", func() float64 {
+				n := 0
+				for _, cache := range pr.boundedCaches()[spec.name] {
+					n += cache.cacheEntries()
+				}
+				return float64(n)
+			})
+			m.CounterFunc("evictions", func() float64 {
+				var n uint64
+				for _, cache := range pr.boundedCaches()[spec.name] {
+					n += cache.cacheEvictions()
+				}
+				return float64(n)
+			})
+		}
+		pr.memory = append(pr.memory, m)
+	}
+}
@@ -0,0 +1,231 @@
+//go:build ns
+
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestParseMemoryBudget(t *testing.T) {
+	budget, err := ParseMemoryBudget(0, "")
+	if err != nil || budget != nil {
+		t.Fatalf("Expected no budget, got %+v, %v", budget, err)
+	}
+	// Without a budget, caches keep their historical limits
+	if budget.MiB(MemoryCacheValidators) != 512 || budget.Entries(MemoryCacheSpool) != maxSpooledUsage || budget.Entries(MemoryCacheActive) != 0 {
+		t.Fatalf("Unexpected default limits")
+	}
+
+	for _, tt := range []struct {
+		total  int
+		caches string
+	}{
+		{-1, ""},
+		{0, "validators"},
+		{0, "sessions=1"},
+		{0, "spool=0"},
+		{0, "spool=1.5"},
+		{100, "validators=64,spool=64"},
+	} {
+		if _, err := ParseMemoryBudget(tt.total, tt.caches); err == nil {
+			t.Fatalf("Expected an error for %d and %q", tt.total, tt.caches)
+		}
+	}
+
+	budget, err = ParseMemoryBudget(100, "validators=50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.MiB(MemoryCacheValidators) != 50 {
+		t.Fatalf("Expected the explicit limit, got %d", budget.MiB(MemoryCacheValidators))
+	}
+	// The other caches share what's left: active gets 0.15 / 0.5 of it
+	if active := budget.Bytes(MemoryCacheActive); active != 15*mib {
+		t.Fatalf("Expected 15 MiB for active validators, got %d", active)
+	}
+	if entries := budget.Entries(MemoryCacheActive); entries != 15*mib/96 {
+		t.Fatalf("Unexpected active validator entries %d", entries)
+	}
+
+	// Without a total, caches not limited keep their defaults
+	budget, err = ParseMemoryBudget(0, "active=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.MiB(MemoryCacheValidators) != 512 || budget.Entries(MemoryCacheGrace) != 0 || budget.Entries(MemoryCacheActive) != mib/96 {
+		t.Fatalf("Unexpected limits %+v", budget)
+	}
+}
+
+func TestLoadMonitorMemoryLimit(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &LoadMonitor{
+		Window:    time.Minute,
+		Logger:    zaptest.NewLogger(t),
+		wallClock: wallClock{now: func() time.Time { return now }},
+	}
+	m.limit.max = 10
+
+	for i := range 10 {
+		m.ObserveValidators([]string{fmt.Sprint(i)})
+		now = now.Add(time.Second)
+	}
+	if m.cacheEntries() != 10 || m.cacheEvictions() != 0 {
+		t.Fatalf("Expected a full cache, got %d entries", m.cacheEntries())
+	}
+
+	// Validators already seen don't evict anything
+	m.ObserveValidators([]string{"9"})
+	if m.cacheEvictions() != 0 {
+		t.Fatalf("Expected no evictions, got %d", m.cacheEvictions())
+	}
+
+	// A tenth of the limit is evicted, least recently seen first
+	m.ObserveValidators([]string{"10"})
+	if m.cacheEntries() != 10 || m.cacheEvictions() != 1 {
+		t.Fatalf("Expected an eviction, got %d entries and %d evictions", m.cacheEntries(), m.cacheEvictions())
+	}
+	if _, ok := m.seen["0"]; ok {
+		t.Fatal("Expected the least recently seen validator to be evicted")
+	}
+
+	// Validators which left the window are dropped before any active one
+	now = now.Add(time.Minute - 5*time.Second)
+	m.ObserveValidators([]string{"11"})
+	if m.cacheEvictions() != 1 || m.ActiveValidators() != 7 {
+		t.Fatalf("Expected expired validators to be dropped, got %d active and %d evictions", m.ActiveValidators(), m.cacheEvictions())
+	}
+}
+
+func TestBoundaryGraceMemoryLimit(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 4, 40, 0, time.UTC)
+	b := &boundaryGrace{limit: cacheLimit{max: 2}}
+
+	b.filter(now, 5*time.Minute, 30*time.Second, []string{"1"})
+	b.filter(now.Add(time.Second), 5*time.Minute, 30*time.Second, []string{"2"})
+	b.filter(now.Add(2*time.Second), 5*time.Minute, 30*time.Second, []string{"3"})
+	if b.cacheEntries() != 2 || b.cacheEvictions() != 1 {
+		t.Fatalf("Expected an eviction, got %d entries and %d evictions", b.cacheEntries(), b.cacheEvictions())
+	}
+
+	// Validators still cached are suppressed after the boundary, the evicted one isn't
+	if out := b.filter(now.Add(25*time.Second), 5*time.Minute, 30*time.Second, []string{"2", "3"}); len(out) != 0 {
+		t.Fatalf("Expected cached validators to be suppressed, got %v", out)
+	}
+	if out := b.filter(now.Add(25*time.Second), 5*time.Minute, 30*time.Second, []string{"1"}); len(out) != 1 {
+		t.Fatalf("Expected the evicted validator to be recorded, got %v", out)
+	}
+}
+
+func TestUsageCoalescerMemoryLimit(t *testing.T) {
+	c := usageCoalescer{limit: cacheLimit{max: 1}}
+
+	c.pending(10, "", []string{"1", "2"})
+	c.done(10, "", []string{"1", "2"})
+	if c.cacheEntries() != 1 || c.cacheEvictions() != 1 {
+		t.Fatalf("Expected a refused validator, got %d entries and %d evictions", c.cacheEntries(), c.cacheEvictions())
+	}
+	// Validators which weren't remembered are written again
+	if pending := c.pending(10, "", []string{"1", "2"}); len(pending) != 1 || pending[0] != "2" {
+		t.Fatalf("Expected 2 pending, got %v", pending)
+	}
+}
+
+func TestUsageWriteQueueMemoryLimit(t *testing.T) {
+	_, err := metrics.Init("memory_budget_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	q := newUsageWriteQueue(zaptest.NewLogger(t), nil, time.Minute, 0)
+	q.limit.max = 2
+	defer q.m.UnregisterAll()
+
+	if err := q.RecordUsage([]string{"1", "2", "3"}); err == nil {
+		t.Fatal("Expected usage over the limit to be dropped")
+	}
+	if q.cacheEntries() != 2 || q.cacheEvictions() != 1 {
+		t.Fatalf("Expected 2 spooled and 1 dropped, got %d and %d", q.cacheEntries(), q.cacheEvictions())
+	}
+}
+
+func TestUntenantedNodesMemoryLimit(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	u := &untenantedNodes{limit: cacheLimit{max: 2}}
+
+	u.see(common.Address{1}, now)
+	u.see(common.Address{2}, now.Add(time.Second))
+	if !u.see(common.Address{1}, now.Add(2*time.Second)) {
+		t.Fatal("Expected node 1 to be remembered")
+	}
+	u.see(common.Address{3}, now.Add(3*time.Second))
+	if u.cacheEntries() != 2 || u.cacheEvictions() != 1 {
+		t.Fatalf("Expected an eviction, got %d entries and %d evictions", u.cacheEntries(), u.cacheEvictions())
+	}
+
+	// The least recently seen node is forgotten, so it's logged again
+	if !u.see(common.Address{1}, now.Add(4*time.Second)) {
+		t.Fatal("Expected node 1 to be remembered")
+	}
+	if u.see(common.Address{2}, now.Add(5*time.Second)) {
+		t.Fatal("Expected node 2 to be forgotten")
+	}
+}
+
+func TestMemoryMetrics(t *testing.T) {
+	_, err := metrics.Init("memory_budget_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	budget, err := ParseMemoryBudget(0, "active=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := &ProxyRouter{
+		MemoryBudget: budget,
+		load:         &LoadMonitor{Logger: zaptest.NewLogger(t)},
+	}
+	pr.load.limit.max = budget.Entries(MemoryCacheActive)
+	pr.registerMemoryMetrics()
+	defer func() {
+		for _, m := range pr.memory {
+			m.UnregisterAll()
+		}
+	}()
+	pr.load.ObserveValidators([]string{"1", "2"})
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "cache" {
+					got[family.GetName()+"/"+label.GetValue()] = metric.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	for name, value := range map[string]float64{
+		"memory_budget_test_memory_entries/active":         2,
+		"memory_budget_test_memory_limit_bytes/active":     mib,
+		"memory_budget_test_memory_limit_bytes/grace":      0,
+		"memory_budget_test_memory_limit_bytes/validators": 512 * mib,
+	} {
+		if got[name] != value {
+			t.Fatalf("Expected %s to be %v, got %v", name, value, got[name])
+		}
+	}
+}
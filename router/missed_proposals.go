@@ -0,0 +1,128 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/consensuslayer"
+	"go.uber.org/zap"
+)
+
+// MissedProposal is an alert for a block proposal missed by a rescue-active validator.
+type MissedProposal struct {
+	Validator string    `json:"validator"`
+	Epoch     uint64    `json:"epoch"`
+	Slot      uint64    `json:"slot"`
+	SlotTime  time.Time `json:"slot_time"`
+	// Whether usage was recorded in the bucket of the slot
+	Covered bool `json:"covered"`
+	// Span of the validator's usage buckets in the epoch
+	UsageFrom time.Time `json:"usage_from"`
+	UsageTo   time.Time `json:"usage_to"`
+	// Beacon node the validator's requests were proxied to
+	Upstream string `json:"upstream"`
+}
+
+// MissedProposalAlerter logs missed proposals of rescue-active validators and
+// optionally posts them to a webhook, so proxy-side causes can be investigated.
+type MissedProposalAlerter struct {
+	Upstream   string
+	WebhookURL string
+	Logger     *zap.Logger
+	Client     *http.Client
+}
+
+// checkProposals alerts on the proposer duties in coverage which have no block.
+// usage maps each validator to the start of its usage buckets.
+func (a *MissedProposalAlerter) checkProposals(ctx context.Context,
+	duties consensuslayer.DutiesProvider,
+	coverage []DutyCoverage,
+	usage map[string]map[int64]struct{},
+	precision time.Duration,
+) {
+	for _, d := range coverage {
+		if d.Kind != consensuslayer.DutyProposer {
+			continue
+		}
+
+		proposed, err := duties.BlockProposed(ctx, d.Slot)
+		if err != nil {
+			a.Logger.Warn("Failed to check proposal", zap.Uint64("slot", d.Slot), zap.Error(err))
+			continue
+		}
+		if proposed {
+			continue
+		}
+
+		alert := MissedProposal{
+			Validator: d.Validator,
+			Epoch:     d.Epoch,
+			Slot:      d.Slot,
+			SlotTime:  d.SlotTime,
+			Covered:   d.Covered,
+			Upstream:  a.Upstream,
+		}
+		for bucket := range usage[d.Validator] {
+			from := time.Unix(bucket, 0).UTC()
+			if alert.UsageFrom.IsZero() || from.Before(alert.UsageFrom) {
+				alert.UsageFrom = from
+			}
+			if to := from.Add(precision); to.After(alert.UsageTo) {
+				alert.UsageTo = to
+			}
+		}
+
+		a.alert(ctx, &alert)
+	}
+}
+
+func (a *MissedProposalAlerter) alert(ctx context.Context, alert *MissedProposal) {
+	a.Logger.Warn("Rescue-active validator missed a proposal",
+		zap.String("validator", alert.Validator),
+		zap.Uint64("slot", alert.Slot),
+		zap.Time("slot_time", alert.SlotTime),
+		zap.Bool("covered", alert.Covered),
+		zap.Time("usage_from", alert.UsageFrom),
+		zap.Time("usage_to", alert.UsageTo),
+		zap.String("upstream", alert.Upstream))
+
+	if a.WebhookURL == "" {
+		return
+	}
+	if err := a.post(ctx, alert); err != nil {
+		a.Logger.Warn("Failed to post missed proposal alert", zap.Uint64("slot", alert.Slot), zap.Error(err))
+	}
+}
+
+func (a *MissedProposalAlerter) post(ctx context.Context, alert *MissedProposal) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("missed proposal webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestMissedProposalAlerts(t *testing.T) {
+	job, provider, tracker := setupDutyCoverageTest(t)
+	start := provider.timing.EpochTime(10)
+
+	alerts := make(chan MissedProposal, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert MissedProposal
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Error(err)
+		}
+		alerts <- alert
+	}))
+	t.Cleanup(webhook.Close)
+
+	job.Alerts = &MissedProposalAlerter{
+		Upstream:   "http://beacon:5052",
+		WebhookURL: webhook.URL,
+		Logger:     zaptest.NewLogger(t),
+	}
+
+	if err := tracker.recordUsage(start.Unix(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The proposal of validator 1 was made
+	if _, err := job.Evaluate(t.Context(), provider.timing, 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 0 {
+		t.Fatalf("Expected no alert, got %v", <-alerts)
+	}
+
+	provider.missed = map[uint64]bool{351: true}
+	if _, err := job.Evaluate(t.Context(), provider.timing, 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 {
+		t.Fatalf("Expected 1 alert, got %d", len(alerts))
+	}
+
+	alert := <-alerts
+	expected := MissedProposal{
+		Validator: "1",
+		Epoch:     10,
+		Slot:      351,
+		SlotTime:  start.Add(31 * 12 * time.Second),
+		Covered:   false,
+		UsageFrom: start,
+		UsageTo:   start.Add(5 * time.Minute),
+		Upstream:  "http://beacon:5052",
+	}
+	if alert != expected {
+		t.Fatalf("Expected alert %+v, got %+v", expected, alert)
+	}
+}
+
+func TestMissedProposalWebhookError(t *testing.T) {
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(webhook.Close)
+
+	alerter := &MissedProposalAlerter{
+		WebhookURL: webhook.URL,
+		Logger:     zaptest.NewLogger(t),
+	}
+	if err := alerter.post(t.Context(), &MissedProposal{Validator: "1"}); err == nil {
+		t.Fatal("Expected an error for a failing webhook")
+	}
+}
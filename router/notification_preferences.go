@@ -0,0 +1,210 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+// ErrNoPreferences is returned when a node address has no notification preferences.
+var ErrNoPreferences = errors.New("no notification preferences")
+
+// NotificationPreferences are the per-operator settings used by the notifier when
+// sending quota and expiry warnings.
+type NotificationPreferences struct {
+	NodeAddress common.Address `json:"node_address"`
+	WebhookURL  string         `json:"webhook_url,omitempty"`
+	Email       string         `json:"email,omitempty"`
+	// Fractions of the quota at which a warning is sent, in (0, 1], ascending
+	Thresholds []float64 `json:"thresholds,omitempty"`
+	// Operators who opted out receive no notifications at all
+	OptOut    bool      `json:"opt_out"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validate checks the preferences and normalizes the thresholds.
+func (p *NotificationPreferences) Validate() error {
+	if p.WebhookURL != "" {
+		u, err := url.Parse(p.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook url: %s", p.WebhookURL)
+		}
+	}
+	if p.Email != "" {
+		addr, err := mail.ParseAddress(p.Email)
+		if err != nil || addr.Address != p.Email {
+			return fmt.Errorf("invalid email: %s", p.Email)
+		}
+	}
+	for _, t := range p.Thresholds {
+		if t <= 0 || t > 1 {
+			return fmt.Errorf("invalid threshold %v, must be in (0, 1]", t)
+		}
+	}
+
+	sort.Float64s(p.Thresholds)
+	thresholds := p.Thresholds[:0]
+	for i, t := range p.Thresholds {
+		if i == 0 || t != p.Thresholds[i-1] {
+			thresholds = append(thresholds, t)
+		}
+	}
+	p.Thresholds = thresholds
+
+	return nil
+}
+
+// PreferencesStore persists NotificationPreferences next to the usage data.
+type PreferencesStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewPreferencesStore creates the preferences table in db if needed.
+func NewPreferencesStore(logger *zap.Logger, db *sql.DB) (*PreferencesStore, error) {
+	store := &PreferencesStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *PreferencesStore) initSchema() error {
+	// Thresholds are stored as a JSON array, updated_at in unix milliseconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS notification_preferences (
+		node_address TEXT PRIMARY KEY,
+		webhook_url TEXT NOT NULL DEFAULT '',
+		email TEXT NOT NULL DEFAULT '',
+		thresholds TEXT NOT NULL DEFAULT '[]',
+		opt_out INTEGER NOT NULL DEFAULT 0,
+		updated_at INTEGER NOT NULL
+	);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+type preferencesScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanPreferences(row preferencesScanner) (*NotificationPreferences, error) {
+	var node, thresholds string
+	var updatedAt int64
+	out := &NotificationPreferences{}
+
+	if err := row.Scan(&node, &out.WebhookURL, &out.Email, &thresholds, &out.OptOut, &updatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(thresholds), &out.Thresholds); err != nil {
+		return nil, fmt.Errorf("invalid thresholds for %s: %w", node, err)
+	}
+	out.NodeAddress = common.HexToAddress(node)
+	out.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+
+	return out, nil
+}
+
+// Get returns the preferences of a node address, or ErrNoPreferences.
+func (store *PreferencesStore) Get(node common.Address) (*NotificationPreferences, error) {
+	row := store.Database.QueryRow(`
+	SELECT node_address, webhook_url, email, thresholds, opt_out, updated_at
+	FROM notification_preferences WHERE node_address = ?`, node.Hex())
+
+	out, err := scanPreferences(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoPreferences
+	}
+	return out, err
+}
+
+// List returns the preferences of every node address, ordered by address.
+func (store *PreferencesStore) List() ([]*NotificationPreferences, error) {
+	rows, err := store.Database.Query(`
+	SELECT node_address, webhook_url, email, thresholds, opt_out, updated_at
+	FROM notification_preferences ORDER BY node_address`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query notification preferences: %w", err)
+	}
+	defer rows.Close()
+
+	out := []*NotificationPreferences{}
+	for rows.Next() {
+		prefs, err := scanPreferences(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, prefs)
+	}
+
+	return out, rows.Err()
+}
+
+// Put validates and stores prefs, replacing any previous preferences of the node.
+func (store *PreferencesStore) Put(prefs *NotificationPreferences) error {
+	if err := prefs.Validate(); err != nil {
+		return err
+	}
+
+	thresholds, err := json.Marshal(prefs.Thresholds)
+	if err != nil {
+		return err
+	}
+	if prefs.Thresholds == nil {
+		thresholds = []byte("[]")
+	}
+	prefs.UpdatedAt = store.clock().UTC().Truncate(time.Millisecond)
+
+	_, err = store.Database.Exec(`
+	INSERT INTO notification_preferences (node_address, webhook_url, email, thresholds, opt_out, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (node_address) DO UPDATE SET
+		webhook_url = excluded.webhook_url,
+		email = excluded.email,
+		thresholds = excluded.thresholds,
+		opt_out = excluded.opt_out,
+		updated_at = excluded.updated_at`,
+		prefs.NodeAddress.Hex(), prefs.WebhookURL, prefs.Email, string(thresholds), prefs.OptOut, prefs.UpdatedAt.UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to store notification preferences: %w", err)
+	}
+
+	return nil
+}
+
+// Delete removes the preferences of a node address, or returns ErrNoPreferences.
+func (store *PreferencesStore) Delete(node common.Address) error {
+	res, err := store.Database.Exec("DELETE FROM notification_preferences WHERE node_address = ?", node.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to delete notification preferences: %w", err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNoPreferences
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupPreferencesTestDatabase(t *testing.T) *PreferencesStore {
+	db, err := sql.Open("sqlite3", "file:preferences.db?mode=memory")
+	if err != nil {
+		t.Fatal("Failed to open SQLite database:", err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+
+	store, err := NewPreferencesStore(zaptest.NewLogger(t), db)
+	if err != nil {
+		t.Fatal("Failed to initialize schema:", err)
+	}
+	store.now = func() time.Time { return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	return store
+}
+
+func TestPreferencesStore(t *testing.T) {
+	store := setupPreferencesTestDatabase(t)
+	node := common.HexToAddress("0x1234567890123456789012345678901234567890")
+
+	if _, err := store.Get(node); !errors.Is(err, ErrNoPreferences) {
+		t.Fatal("Expected ErrNoPreferences, got", err)
+	}
+
+	prefs := &NotificationPreferences{
+		NodeAddress: node,
+		WebhookURL:  "https://example.com/hook",
+		Email:       "operator@example.com",
+		Thresholds:  []float64{0.95, 0.8, 0.95},
+	}
+	if err := store.Put(prefs); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.NodeAddress != node || got.WebhookURL != prefs.WebhookURL || got.Email != prefs.Email || got.OptOut {
+		t.Fatalf("Unexpected preferences %+v", got)
+	}
+	if len(got.Thresholds) != 2 || got.Thresholds[0] != 0.8 || got.Thresholds[1] != 0.95 {
+		t.Fatalf("Expected sorted, deduplicated thresholds, got %v", got.Thresholds)
+	}
+	if !got.UpdatedAt.Equal(store.now()) {
+		t.Fatalf("Unexpected update time %v", got.UpdatedAt)
+	}
+
+	// Opting out replaces the previous preferences
+	if err := store.Put(&NotificationPreferences{NodeAddress: node, OptOut: true}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.Get(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.OptOut || got.WebhookURL != "" || len(got.Thresholds) != 0 {
+		t.Fatalf("Expected the preferences to be replaced, got %+v", got)
+	}
+
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(list))
+	}
+
+	if err := store.Delete(node); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(node); !errors.Is(err, ErrNoPreferences) {
+		t.Fatal("Expected ErrNoPreferences, got", err)
+	}
+}
+
+func TestNotificationPreferencesValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		prefs NotificationPreferences
+		valid bool
+	}{
+		{"empty", NotificationPreferences{}, true},
+		{"http webhook", NotificationPreferences{WebhookURL: "http://localhost:8080/hook"}, true},
+		{"relative webhook", NotificationPreferences{WebhookURL: "/hook"}, false},
+		{"ftp webhook", NotificationPreferences{WebhookURL: "ftp://example.com"}, false},
+		{"named email", NotificationPreferences{Email: "Operator <operator@example.com>"}, false},
+		{"bad email", NotificationPreferences{Email: "operator"}, false},
+		{"zero threshold", NotificationPreferences{Thresholds: []float64{0}}, false},
+		{"threshold above quota", NotificationPreferences{Thresholds: []float64{1.5}}, false},
+		{"full quota", NotificationPreferences{Thresholds: []float64{1}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.prefs.Validate()
+			if tt.valid && err != nil {
+				t.Fatal("Expected valid preferences, got", err)
+			}
+			if !tt.valid && err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+// Length of the UTC days operator usage is aggregated over
+const operatorDay = 24 * time.Hour
+
+// OperatorDailyUsage is the usage of the validators attributed to a node address on a
+// UTC day.
+type OperatorDailyUsage struct {
+	// UTC date, e.g. 2025-03-30
+	Date        string         `json:"date"`
+	NodeAddress common.Address `json:"node_address"`
+	Validators  int            `json:"validators"`
+	Usage       time.Duration  `json:"usage"`
+}
+
+// OperatorDailyStore keeps the daily usage of every operator, precomputed by
+// OperatorDailyJob so operator and organization dashboards don't join usage with
+// attribution at query time.
+type OperatorDailyStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+}
+
+// NewOperatorDailyStore creates the operator aggregate tables in db if needed.
+func NewOperatorDailyStore(logger *zap.Logger, db *sql.DB) (*OperatorDailyStore, error) {
+	store := &OperatorDailyStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *OperatorDailyStore) initSchema() error {
+	// Days are the unix timestamp of their UTC midnight. aggregated_through is the
+	// unix timestamp before which every bucket has been aggregated.
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS operator_daily_usage (
+		day INTEGER NOT NULL,
+		node_address TEXT NOT NULL,
+		validators INTEGER NOT NULL,
+		usage_seconds INTEGER NOT NULL,
+		PRIMARY KEY (day, node_address)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_operator_daily_usage_node ON operator_daily_usage(node_address, day);
+
+	CREATE TABLE IF NOT EXISTS operator_daily_state (
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		aggregated_through INTEGER NOT NULL
+	);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// through returns the time before which usage has been aggregated, or the zero time
+// if nothing has been.
+func (store *OperatorDailyStore) through() (time.Time, error) {
+	var through int64
+	err := store.Database.QueryRow("SELECT aggregated_through FROM operator_daily_state WHERE id = 1").Scan(&through)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to query operator aggregate state: %w", err)
+	}
+	return time.Unix(through, 0).UTC(), nil
+}
+
+// replaceDay replaces the aggregates of the day starting at start and advances the
+// state to through.
+func (store *OperatorDailyStore) replaceDay(start time.Time, usage []OperatorDailyUsage, through time.Time) error {
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM operator_daily_usage WHERE day = ?", start.Unix()); err != nil {
+		return fmt.Errorf("failed to delete operator aggregates: %w", err)
+	}
+	for _, u := range usage {
+		_, err := tx.Exec(`
+		INSERT INTO operator_daily_usage (day, node_address, validators, usage_seconds)
+		VALUES (?, ?, ?, ?)
+		`, start.Unix(), u.NodeAddress.Hex(), u.Validators, int64(u.Usage.Seconds()))
+		if err != nil {
+			return fmt.Errorf("failed to insert operator aggregates: %w", err)
+		}
+	}
+	_, err = tx.Exec(`
+	INSERT INTO operator_daily_state (id, aggregated_through) VALUES (1, ?)
+	ON CONFLICT (id) DO UPDATE SET aggregated_through = excluded.aggregated_through
+	`, through.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to update operator aggregate state: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// Days returns the aggregates of the UTC days from the date of from to the date of to
+// inclusive, ordered by day and node address. nodes limits them to the given node
+// addresses, all are returned when it's empty.
+func (store *OperatorDailyStore) Days(nodes []common.Address, from time.Time, to time.Time) ([]OperatorDailyUsage, error) {
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+	first := from.UTC().Truncate(operatorDay)
+	last := to.UTC().Truncate(operatorDay)
+	if last.Sub(first) >= maxDailyUsageDays*operatorDay {
+		return nil, &RangeError{From: from, To: to, Err: ErrRangeTooLong}
+	}
+
+	query := "SELECT day, node_address, validators, usage_seconds FROM operator_daily_usage WHERE day >= ? AND day <= ?"
+	args := []any{first.Unix(), last.Unix()}
+	if len(nodes) > 0 {
+		params := make([]string, 0, len(nodes))
+		for _, node := range nodes {
+			params = append(params, "?")
+			args = append(args, node.Hex())
+		}
+		query += fmt.Sprintf(" AND node_address IN (%s)", strings.Join(params, ","))
+	}
+	rows, err := store.Database.Query(query+" ORDER BY day, node_address", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query operator aggregates: %w", err)
+	}
+	defer rows.Close()
+
+	out := []OperatorDailyUsage{}
+	for rows.Next() {
+		var start, seconds int64
+		var node string
+		var u OperatorDailyUsage
+		if err := rows.Scan(&start, &node, &u.Validators, &seconds); err != nil {
+			return nil, err
+		}
+		u.Date = time.Unix(start, 0).UTC().Format(time.DateOnly)
+		u.NodeAddress = common.HexToAddress(node)
+		u.Usage = time.Duration(seconds) * time.Second
+		out = append(out, u)
+	}
+
+	return out, rows.Err()
+}
+
+// pruneUsage deletes the aggregates of days which ended before cutoff. Aggregates don't
+// identify validators, so exempt doesn't apply.
+func (store *OperatorDailyStore) pruneUsage(cutoff time.Time, _ map[string]time.Time) (int64, error) {
+	res, err := store.Database.Exec("DELETE FROM operator_daily_usage WHERE day + ? <= ?", int64(operatorDay.Seconds()), cutoff.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// OperatorDailyJob periodically aggregates the usage of closed buckets into the daily
+// usage of the operators their validators were attributed to at the time. Each run
+// only recomputes the days with buckets closed since the previous one, so usage deleted
+// from a day after it was aggregated is still counted.
+//
+// A validator attributed to several node addresses during a bucket counts towards each.
+type OperatorDailyJob struct {
+	Tracker     usageBuckets
+	Attribution *AttributionStore
+	Store       *OperatorDailyStore
+	Interval    time.Duration
+	Logger      *zap.Logger
+
+	wallClock
+}
+
+// Refresh aggregates the buckets closed since the previous refresh and returns how
+// many days were recomputed.
+func (job *OperatorDailyJob) Refresh() (int, error) {
+	precision := job.Tracker.bucketPrecision()
+	// The current bucket is still being recorded in
+	end := job.clock().UTC().Truncate(precision)
+
+	start, err := job.Store.through()
+	if err != nil {
+		return 0, err
+	}
+	if start.IsZero() {
+		// Usage before the first attribution can't be attributed
+		start, err = job.Attribution.earliest()
+		if err != nil || start.IsZero() {
+			return 0, err
+		}
+		start = start.Truncate(precision)
+	}
+
+	days := 0
+	for d := start.Truncate(operatorDay); d.Before(end); d = d.Add(operatorDay) {
+		through := d.Add(operatorDay)
+		if through.After(end) {
+			through = end
+		}
+		usage, err := job.aggregate(d, through, precision)
+		if err != nil {
+			return days, err
+		}
+		if err := job.Store.replaceDay(d, usage, through); err != nil {
+			return days, err
+		}
+		days++
+	}
+
+	return days, nil
+}
+
+// aggregate totals the usage of each operator in the buckets of [start, end).
+func (job *OperatorDailyJob) aggregate(start time.Time, end time.Time, precision time.Duration) ([]OperatorDailyUsage, error) {
+	records, err := job.Tracker.usageRecords(start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	validators := make([]string, 0)
+	seen := make(map[string]struct{})
+	for _, record := range records {
+		validator := record.Validator.String()
+		if _, ok := seen[validator]; !ok {
+			seen[validator] = struct{}{}
+			validators = append(validators, validator)
+		}
+	}
+	attributions, err := job.Attribution.Attributions(validators)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[common.Address]*OperatorDailyUsage)
+	nodeValidators := make(map[common.Address]map[string]struct{})
+	for _, record := range records {
+		bucketEnd := record.Bucket.Add(precision)
+		validator := record.Validator.String()
+		for _, a := range attributions[validator] {
+			// Attributed while the bucket was recorded in
+			if !a.FirstSeen.Before(bucketEnd) || a.LastSeen.Before(record.Bucket) {
+				continue
+			}
+			u, ok := usage[a.NodeAddress]
+			if !ok {
+				u = &OperatorDailyUsage{
+					Date:        start.Format(time.DateOnly),
+					NodeAddress: a.NodeAddress,
+				}
+				usage[a.NodeAddress] = u
+				nodeValidators[a.NodeAddress] = make(map[string]struct{})
+			}
+			u.Usage += precision
+			nodeValidators[a.NodeAddress][validator] = struct{}{}
+		}
+	}
+	out := make([]OperatorDailyUsage, 0, len(usage))
+	for node, u := range usage {
+		u.Validators = len(nodeValidators[node])
+		out = append(out, *u)
+	}
+
+	return out, nil
+}
+
+// Run refreshes the aggregates every Interval until ctx is done.
+func (job *OperatorDailyJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := job.Refresh(); err != nil {
+			job.Logger.Warn("Failed to aggregate operator usage", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// serveOperatorDailyUsage returns the daily usage of every operator, or of the node
+// addresses given as node parameters, on the UTC days from the date of from to the
+// date of to.
+func (pr *ProxyRouter) serveOperatorDailyUsage(w http.ResponseWriter, r *http.Request) {
+	if pr.operatorDaily == nil {
+		http.Error(w, "operator aggregates require -usage-operator-daily-interval", http.StatusNotImplemented)
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodes := make([]common.Address, 0)
+	for _, node := range r.URL.Query()["node"] {
+		if !common.IsHexAddress(node) {
+			http.Error(w, fmt.Sprintf("invalid node address %q", node), http.StatusBadRequest)
+			return
+		}
+		nodes = append(nodes, common.HexToAddress(node))
+	}
+
+	report, err := pr.operatorDaily.Days(nodes, from, to)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to query operator aggregates", zap.Error(err))
+		http.Error(w, "failed to query operator aggregates", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
@@ -0,0 +1,170 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupOperatorDailyTest(t *testing.T) (*SQLiteUsageTracker, *AttributionStore, *OperatorDailyJob, *time.Time) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	sqlite := tracker.(*SQLiteUsageTracker)
+
+	attr, err := NewAttributionStore(zaptest.NewLogger(t), sqlite.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewOperatorDailyStore(zaptest.NewLogger(t), sqlite.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2025, 1, 1, 23, 50, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	sqlite.now = clock
+	attr.now = clock
+	job := &OperatorDailyJob{
+		Tracker:     sqlite,
+		Attribution: attr,
+		Store:       store,
+		Interval:    time.Hour,
+		Logger:      zaptest.NewLogger(t),
+		wallClock:   wallClock{now: clock},
+	}
+	return sqlite, attr, job, &now
+}
+
+func TestOperatorDailyRefresh(t *testing.T) {
+	tracker, attr, job, now := setupOperatorDailyTest(t)
+	nodeA := common.HexToAddress("0xa")
+	nodeB := common.HexToAddress("0xb")
+	record := func(node common.Address, validators ...string) {
+		t.Helper()
+		if err := tracker.RecordUsage(validators); err != nil {
+			t.Fatal(err)
+		}
+		if err := attr.Attribute(node, validators); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is attributed yet
+	if days, err := job.Refresh(); err != nil || days != 0 {
+		t.Fatalf("Expected nothing to aggregate, got %d days: %v", days, err)
+	}
+
+	record(nodeA, "1", "2")
+	*now = now.Add(5 * time.Minute)
+	record(nodeA, "1")
+	// Validator 2 moves to node B on the next day
+	*now = now.Add(10 * time.Minute)
+	record(nodeB, "2")
+	*now = now.Add(5 * time.Minute)
+
+	days, err := job.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days != 2 {
+		t.Fatalf("Expected 2 days aggregated, got %d", days)
+	}
+
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+	report, err := job.Store.Days(nil, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []OperatorDailyUsage{
+		{Date: "2025-01-01", NodeAddress: nodeA, Validators: 2, Usage: 15 * time.Minute},
+		{Date: "2025-01-02", NodeAddress: nodeB, Validators: 1, Usage: 5 * time.Minute},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, report)
+	}
+
+	// Only the open day is recomputed
+	record(nodeB, "2", "3")
+	*now = now.Add(5 * time.Minute)
+	if days, err := job.Refresh(); err != nil || days != 1 {
+		t.Fatalf("Expected 1 day aggregated, got %d: %v", days, err)
+	}
+	report, err = job.Store.Days([]common.Address{nodeB}, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []OperatorDailyUsage{
+		{Date: "2025-01-02", NodeAddress: nodeB, Validators: 2, Usage: 15 * time.Minute},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, report)
+	}
+
+	pruned, err := job.Store.pruneUsage(to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 1 {
+		t.Fatalf("Expected the first day to be pruned, got %d rows", pruned)
+	}
+}
+
+func TestAdminOperatorDailyUsage(t *testing.T) {
+	tracker, attr, job, now := setupOperatorDailyTest(t)
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	handler := pr.AdminHandler()
+	path := "/usage/operators/daily?from=2025-01-01T00:00:00Z&to=2025-01-01T00:00:00Z"
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected %d without aggregates, got %d", http.StatusNotImplemented, rec.Code)
+	}
+
+	pr.operatorDaily = job.Store
+	node := common.HexToAddress("0xa")
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := attr.Attribute(node, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	*now = now.Add(5 * time.Minute)
+	if _, err := job.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"&node=not-an-address", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %d for an invalid node, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"&node="+node.Hex(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var report []OperatorDailyUsage
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 1 || report[0].NodeAddress != node || report[0].Usage != 5*time.Minute {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+}
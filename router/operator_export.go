@@ -0,0 +1,362 @@
+//go:build ns
+
+package router
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"go.uber.org/zap"
+)
+
+// ErrNoOperatorData is returned when exporting a node address nothing is stored about.
+var ErrNoOperatorData = errors.New("no data stored for operator")
+
+// ErrInvalidExport is returned when an operator export archive is truncated, is missing
+// files, or doesn't match its manifest.
+var ErrInvalidExport = errors.New("invalid operator export")
+
+// Version of the layout of operator exports, bumped whenever a file is added, removed or
+// changes format
+const operatorExportSchemaVersion = 1
+
+// usageRecordLister is implemented by trackers which can list a validator's records.
+type usageRecordLister interface {
+	// validatorUsageRecords returns the records of buckets starting in [from, to], oldest first.
+	validatorUsageRecords(validator string, from time.Time, to time.Time) ([]UsageRecord, error)
+}
+
+const validatorUsageRecordsQuery = `
+	SELECT DISTINCT CAST(strftime('%s', timestamp) AS INTEGER)
+	FROM validator_usage
+	WHERE validator_index = ? AND timestamp >= datetime(?, 'unixepoch') AND timestamp <= datetime(?, 'unixepoch')
+	ORDER BY timestamp
+	`
+
+func (tracker *SQLiteUsageTracker) validatorUsageRecords(validator string, from time.Time, to time.Time) ([]UsageRecord, error) {
+	rows, err := tracker.readDB().Query(validatorUsageRecordsQuery, validator, from.Truncate(tracker.Precision).Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage records: %w", err)
+	}
+	defer rows.Close()
+
+	out := []UsageRecord{}
+	for rows.Next() {
+		var bucket int64
+		if err := rows.Scan(&bucket); err != nil {
+			return nil, err
+		}
+		out = append(out, UsageRecord{Bucket: time.Unix(bucket, 0).UTC(), Validator: ValidatorID(validator)})
+	}
+
+	return out, rows.Err()
+}
+
+func (tracker *HybridUsageTracker) validatorUsageRecords(validator string, from time.Time, to time.Time) ([]UsageRecord, error) {
+	return tracker.Buckets.validatorUsageRecords(validator, from, to)
+}
+
+// OperatorExportFile describes a file of an operator export.
+type OperatorExportFile struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+	// Number of elements of the file's JSON array, 1 for an object and 0 for null
+	Rows   int           `json:"rows"`
+	SHA256 hexutil.Bytes `json:"sha256"`
+}
+
+// OperatorExportManifest is the signed index of an operator export.
+type OperatorExportManifest struct {
+	SchemaVersion int            `json:"schema_version"`
+	NodeAddress   common.Address `json:"node_address"`
+	GeneratedAt   time.Time      `json:"generated_at"`
+	// Buckets of the first and last exported usage records, unset without usage
+	From  *time.Time           `json:"from,omitempty"`
+	To    *time.Time           `json:"to,omitempty"`
+	Files []OperatorExportFile `json:"files"`
+}
+
+// OperatorExportSignature is an EIP-191 signature over manifest.json.
+type OperatorExportSignature struct {
+	Signer    common.Address `json:"signer"`
+	Signature hexutil.Bytes  `json:"signature"`
+}
+
+type exportedUsageRecord struct {
+	Validator string    `json:"validator"`
+	Bucket    time.Time `json:"bucket"`
+}
+
+// OperatorExporter produces a complete export of one operator's data as a gzipped
+// tar archive, for data portability requests.
+//
+// The archive holds validators.json (attributed validators), usage.json (the usage
+// records of those validators while attributed to the operator) and
+// notification_preferences.json, indexed with their hashes in manifest.json.
+// signature.json holds an EIP-191 signature over manifest.json by SigningKey.
+//
+// Quota decisions and notifications aren't stored by this proxy, so they aren't part
+// of the export.
+type OperatorExporter struct {
+	Tracker     UsageTracker
+	Attribution *AttributionStore
+	Preferences *PreferencesStore
+	SigningKey  *ecdsa.PrivateKey
+	Logger      *zap.Logger
+
+	wallClock
+}
+
+func (e *OperatorExporter) collect(node common.Address) (map[string]any, error) {
+	validators, err := e.Attribution.Validators(node)
+	if err != nil {
+		return nil, err
+	}
+
+	prefs, err := e.Preferences.Get(node)
+	if err != nil && !errors.Is(err, ErrNoPreferences) {
+		return nil, err
+	}
+
+	if len(validators) == 0 && prefs == nil {
+		return nil, ErrNoOperatorData
+	}
+
+	usage := []exportedUsageRecord{}
+	if lister, ok := e.Tracker.(usageRecordLister); ok {
+		for _, v := range validators {
+			records, err := lister.validatorUsageRecords(v.Validator, v.FirstSeen, v.LastSeen)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range records {
+				usage = append(usage, exportedUsageRecord{Validator: r.Validator.String(), Bucket: r.Bucket})
+			}
+		}
+	}
+
+	return map[string]any{
+		"validators.json":               validators,
+		"usage.json":                    usage,
+		"notification_preferences.json": prefs,
+	}, nil
+}
+
+// Export writes the archive of node to w.
+func (e *OperatorExporter) Export(w io.Writer, node common.Address) error {
+	if e.SigningKey == nil {
+		return errors.New("no signing key configured")
+	}
+
+	data, err := e.collect(node)
+	if err != nil {
+		return err
+	}
+
+	now := e.clock().UTC()
+	manifest := OperatorExportManifest{
+		SchemaVersion: operatorExportSchemaVersion,
+		NodeAddress:   node,
+		GeneratedAt:   now,
+	}
+	if usage := data["usage.json"].([]exportedUsageRecord); len(usage) > 0 {
+		from, to := usage[0].Bucket, usage[0].Bucket
+		for _, r := range usage[1:] {
+			if r.Bucket.Before(from) {
+				from = r.Bucket
+			}
+			if r.Bucket.After(to) {
+				to = r.Bucket
+			}
+		}
+		manifest.From, manifest.To = &from, &to
+	}
+	files := make(map[string][]byte, len(data)+2)
+	// Fixed order, so archives of the same data are identical
+	for _, name := range []string{"validators.json", "usage.json", "notification_preferences.json"} {
+		content, err := json.MarshalIndent(data[name], "", "  ")
+		if err != nil {
+			return err
+		}
+		rows, err := exportRows(content)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		files[name] = content
+		manifest.Files = append(manifest.Files, OperatorExportFile{Name: name, Size: len(content), Rows: rows, SHA256: sum[:]})
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	manifestSum := sha256.Sum256(manifestJSON)
+	signature, err := crypto.Sign(accounts.TextHash(manifestJSON), e.SigningKey)
+	if err != nil {
+		return fmt.Errorf("failed to sign export: %w", err)
+	}
+	signatureJSON, err := json.MarshalIndent(OperatorExportSignature{
+		Signer:    crypto.PubkeyToAddress(e.SigningKey.PublicKey),
+		Signature: signature,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	write := func(name string, content []byte) error {
+		if err := archive.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		_, err := archive.Write(content)
+		return err
+	}
+
+	if err := write("manifest.json", manifestJSON); err != nil {
+		return err
+	}
+	if err := write("signature.json", signatureJSON); err != nil {
+		return err
+	}
+	for _, f := range manifest.Files {
+		if err := write(f.Name, files[f.Name]); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	e.Logger.Info("Exported operator data",
+		zap.String("node", node.Hex()),
+		zap.Int("files", len(manifest.Files)),
+		zap.String("manifest_sha256", hex.EncodeToString(manifestSum[:])))
+
+	return nil
+}
+
+// VerifyOperatorExport checks that signature is a valid signature of manifest by
+// the claimed signer.
+func VerifyOperatorExport(manifest []byte, signature OperatorExportSignature) bool {
+	if len(signature.Signature) != crypto.SignatureLength {
+		return false
+	}
+	pubkey, err := crypto.SigToPub(accounts.TextHash(manifest), signature.Signature)
+	if err != nil {
+		return false
+	}
+	return crypto.PubkeyToAddress(*pubkey) == signature.Signer
+}
+
+// exportRows counts the rows of an exported JSON file.
+func exportRows(content []byte) (int, error) {
+	var value any
+	if err := json.Unmarshal(content, &value); err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case nil:
+		return 0, nil
+	case []any:
+		return len(v), nil
+	default:
+		return 1, nil
+	}
+}
+
+// VerifyOperatorExportArchive reads the archive of an operator export from r and checks
+// that it's complete: the manifest's signature is valid, and the archive holds exactly
+// the files of the manifest with their sizes, hashes and row counts. It returns the
+// manifest and signature, so callers can check the signer is one they trust.
+//
+// Truncated or tampered archives return an error wrapping ErrInvalidExport.
+func VerifyOperatorExportArchive(r io.Reader) (*OperatorExportManifest, *OperatorExportSignature, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %w", ErrInvalidExport, err)
+	}
+	archive := tar.NewReader(gz)
+
+	files := make(map[string][]byte)
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrInvalidExport, err)
+		}
+		if _, ok := files[header.Name]; ok {
+			return nil, nil, fmt.Errorf("%w: duplicate file %s", ErrInvalidExport, header.Name)
+		}
+		content, err := io.ReadAll(archive)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %w", ErrInvalidExport, err)
+		}
+		files[header.Name] = content
+	}
+
+	manifestJSON, ok := files["manifest.json"]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: missing manifest.json", ErrInvalidExport)
+	}
+	var manifest OperatorExportManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid manifest.json: %w", ErrInvalidExport, err)
+	}
+	if manifest.SchemaVersion != operatorExportSchemaVersion {
+		return nil, nil, fmt.Errorf("%w: unsupported schema version %d", ErrInvalidExport, manifest.SchemaVersion)
+	}
+	var signature OperatorExportSignature
+	if err := json.Unmarshal(files["signature.json"], &signature); err != nil {
+		return nil, nil, fmt.Errorf("%w: missing or invalid signature.json", ErrInvalidExport)
+	}
+	if !VerifyOperatorExport(manifestJSON, signature) {
+		return nil, nil, fmt.Errorf("%w: invalid signature", ErrInvalidExport)
+	}
+
+	for _, f := range manifest.Files {
+		content, ok := files[f.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: missing %s", ErrInvalidExport, f.Name)
+		}
+		sum := sha256.Sum256(content)
+		if len(content) != f.Size || !bytes.Equal(sum[:], f.SHA256) {
+			return nil, nil, fmt.Errorf("%w: %s doesn't match the manifest", ErrInvalidExport, f.Name)
+		}
+		if rows, err := exportRows(content); err != nil || rows != f.Rows {
+			return nil, nil, fmt.Errorf("%w: %s doesn't have %d rows", ErrInvalidExport, f.Name, f.Rows)
+		}
+		delete(files, f.Name)
+	}
+	delete(files, "manifest.json")
+	delete(files, "signature.json")
+	for name := range files {
+		return nil, nil, fmt.Errorf("%w: unexpected file %s", ErrInvalidExport, name)
+	}
+
+	return &manifest, &signature, nil
+}
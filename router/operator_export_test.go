@@ -0,0 +1,218 @@
+//go:build ns
+
+package router
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupExportTest(t *testing.T) (*OperatorExporter, common.Address, time.Time) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	sqlite := tracker.(*SQLiteUsageTracker)
+
+	store, now := setupAttributionTestDatabase(t, sqlite.Database)
+	prefs, err := NewPreferencesStore(zaptest.NewLogger(t), sqlite.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	node := common.HexToAddress("0x1234567890123456789012345678901234567890")
+
+	// Validator 1 is used by node for two buckets
+	for _, offset := range []time.Duration{time.Minute, 6 * time.Minute} {
+		*now = start.Add(offset)
+		if err := sqlite.recordUsage(start.Add(offset).Truncate(5*time.Minute).Unix(), []string{"1"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Attribute(node, []string{"1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Later usage of validator 1 by someone else isn't part of node's export
+	if err := sqlite.recordUsage(start.Add(time.Hour).Unix(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &OperatorExporter{
+		Tracker:     sqlite,
+		Attribution: store,
+		Preferences: prefs,
+		SigningKey:  key,
+		Logger:      zaptest.NewLogger(t),
+		wallClock:   wallClock{now: func() time.Time { return start.Add(2 * time.Hour) }},
+	}, node, start
+}
+
+func readExport(t *testing.T, archive []byte) map[string][]byte {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := tar.NewReader(gz)
+
+	files := make(map[string][]byte)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[header.Name] = content
+	}
+
+	return files
+}
+
+func TestOperatorExport(t *testing.T) {
+	exporter, node, start := setupExportTest(t)
+
+	var archive bytes.Buffer
+	if err := exporter.Export(&archive, node); err != nil {
+		t.Fatal(err)
+	}
+	files := readExport(t, archive.Bytes())
+
+	var signature OperatorExportSignature
+	if err := json.Unmarshal(files["signature.json"], &signature); err != nil {
+		t.Fatal(err)
+	}
+	if signature.Signer != crypto.PubkeyToAddress(exporter.SigningKey.PublicKey) {
+		t.Fatal("Unexpected signer", signature.Signer)
+	}
+	if !VerifyOperatorExport(files["manifest.json"], signature) {
+		t.Fatal("Expected the signature to verify")
+	}
+	if VerifyOperatorExport(append(files["manifest.json"], ' '), signature) {
+		t.Fatal("Expected a modified manifest not to verify")
+	}
+
+	var manifest OperatorExportManifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.NodeAddress != node || len(manifest.Files) != 3 || manifest.SchemaVersion != operatorExportSchemaVersion {
+		t.Fatalf("Unexpected manifest %+v", manifest)
+	}
+	if manifest.From == nil || !manifest.From.Equal(start) || !manifest.To.Equal(start.Add(5*time.Minute)) {
+		t.Fatalf("Unexpected range %v to %v", manifest.From, manifest.To)
+	}
+	for i, rows := range []int{1, 2, 0} {
+		if manifest.Files[i].Rows != rows {
+			t.Fatalf("Expected %d rows in %s, got %d", rows, manifest.Files[i].Name, manifest.Files[i].Rows)
+		}
+	}
+	for _, f := range manifest.Files {
+		sum := sha256.Sum256(files[f.Name])
+		if !bytes.Equal(sum[:], f.SHA256) || len(files[f.Name]) != f.Size {
+			t.Fatalf("File %s doesn't match the manifest", f.Name)
+		}
+	}
+
+	var usage []exportedUsageRecord
+	if err := json.Unmarshal(files["usage.json"], &usage); err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || !usage[0].Bucket.Equal(start) || !usage[1].Bucket.Equal(start.Add(5*time.Minute)) {
+		t.Fatalf("Unexpected usage %+v", usage)
+	}
+	if string(files["notification_preferences.json"]) != "null" {
+		t.Fatalf("Expected no preferences, got %s", files["notification_preferences.json"])
+	}
+}
+
+func writeExport(t *testing.T, files map[string][]byte, names ...string) []byte {
+	var out bytes.Buffer
+	gz := gzip.NewWriter(&out)
+	archive := tar.NewWriter(gz)
+	for _, name := range names {
+		if err := archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name]))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestVerifyOperatorExportArchive(t *testing.T) {
+	exporter, node, _ := setupExportTest(t)
+
+	var archive bytes.Buffer
+	if err := exporter.Export(&archive, node); err != nil {
+		t.Fatal(err)
+	}
+	manifest, signature, err := VerifyOperatorExportArchive(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.NodeAddress != node || signature.Signer != crypto.PubkeyToAddress(exporter.SigningKey.PublicKey) {
+		t.Fatalf("Unexpected manifest %+v signed by %s", manifest, signature.Signer)
+	}
+
+	files := readExport(t, archive.Bytes())
+	all := []string{"manifest.json", "signature.json", "validators.json", "usage.json", "notification_preferences.json"}
+	with := func(name string, content []byte) map[string][]byte {
+		out := map[string][]byte{name: content}
+		for n, c := range files {
+			if n != name {
+				out[n] = c
+			}
+		}
+		return out
+	}
+
+	for name, archive := range map[string][]byte{
+		"truncated":        archive.Bytes()[:archive.Len()/2],
+		"missing file":     writeExport(t, files, all[:4]...),
+		"extra file":       writeExport(t, with("extra.json", []byte("{}")), append(all, "extra.json")...),
+		"tampered file":    writeExport(t, with("usage.json", []byte("[]")), all...),
+		"missing manifest": writeExport(t, files, all[1:]...),
+	} {
+		if _, _, err := VerifyOperatorExportArchive(bytes.NewReader(archive)); !errors.Is(err, ErrInvalidExport) {
+			t.Fatalf("Expected ErrInvalidExport for a %s, got %v", name, err)
+		}
+	}
+}
+
+func TestOperatorExportUnknown(t *testing.T) {
+	exporter, _, _ := setupExportTest(t)
+
+	err := exporter.Export(io.Discard, common.HexToAddress("0x0000000000000000000000000000000000000001"))
+	if !errors.Is(err, ErrNoOperatorData) {
+		t.Fatal("Expected ErrNoOperatorData, got", err)
+	}
+}
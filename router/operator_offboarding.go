@@ -0,0 +1,493 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Offboarding requests larger than this are rejected.
+const maxOffboardingRequestSize = 64 << 10
+
+// ErrInvalidOffboarding is returned for offboarding requests which can't be applied.
+var ErrInvalidOffboarding = errors.New("invalid offboarding")
+
+// OffboardingUsage is what offboarding does with the usage of an operator's validators.
+type OffboardingUsage string
+
+const (
+	// Usage is kept, still attributed to the operator
+	OffboardKeepUsage OffboardingUsage = "keep"
+	// Usage recorded while the validators were attributed to the operator is deleted
+	OffboardDeleteUsage OffboardingUsage = "delete"
+	// Usage is kept, but no longer attributed to the operator
+	OffboardAnonymizeUsage OffboardingUsage = "anonymize"
+)
+
+// OffboardingRequest is the body of an offboarding.
+type OffboardingRequest struct {
+	// OffboardKeepUsage when empty
+	Usage       OffboardingUsage `json:"usage"`
+	Reason      string           `json:"reason"`
+	RequestedBy string           `json:"requested_by"`
+}
+
+// Validate checks the usage mode, defaulting it to OffboardKeepUsage.
+func (o *OffboardingRequest) Validate() error {
+	switch o.Usage {
+	case "":
+		o.Usage = OffboardKeepUsage
+	case OffboardKeepUsage, OffboardDeleteUsage, OffboardAnonymizeUsage:
+	default:
+		return fmt.Errorf("%w usage %q, expected keep, delete or anonymize", ErrInvalidOffboarding, o.Usage)
+	}
+	return nil
+}
+
+// OffboardingResult is the outcome of an offboarding. Nothing is changed in a dry run,
+// but the counts are those the offboarding would have.
+type OffboardingResult struct {
+	DryRun bool             `json:"dry_run"`
+	Node   common.Address   `json:"node"`
+	Usage  OffboardingUsage `json:"usage"`
+	// Rows deleted per table
+	Deleted map[string]int64 `json:"deleted"`
+	// Validators also attributed to other operators, whose usage isn't deleted
+	Shared []string `json:"shared,omitempty"`
+	// The audit record of the offboarding, unset in a dry run
+	AuditID int64 `json:"audit_id,omitempty"`
+}
+
+// OffboardingAudit records an applied offboarding.
+type OffboardingAudit struct {
+	ID          int64            `json:"id"`
+	Node        common.Address   `json:"node"`
+	Usage       OffboardingUsage `json:"usage"`
+	Reason      string           `json:"reason"`
+	RequestedBy string           `json:"requested_by"`
+	Deleted     map[string]int64 `json:"deleted"`
+	RecordedAt  time.Time        `json:"recorded_at"`
+}
+
+// OffboardingAuditStore keeps the audit trail of offboardings, which outlives
+// everything they delete.
+type OffboardingAuditStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewOffboardingAuditStore creates the offboarding audit table in db if needed.
+func NewOffboardingAuditStore(logger *zap.Logger, db *sql.DB) (*OffboardingAuditStore, error) {
+	store := &OffboardingAuditStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *OffboardingAuditStore) initSchema() error {
+	// deleted is a JSON object, times are unix seconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS offboarding_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		node_address TEXT NOT NULL,
+		usage TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		requested_by TEXT NOT NULL,
+		deleted TEXT NOT NULL,
+		recorded_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_offboarding_audit_node ON offboarding_audit(node_address);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// record audits an offboarding within tx, so it's only kept if the offboarding is.
+func (store *OffboardingAuditStore) record(tx *sql.Tx, req *OffboardingRequest, result *OffboardingResult) (int64, error) {
+	deleted, err := json.Marshal(result.Deleted)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`
+	INSERT INTO offboarding_audit (node_address, usage, reason, requested_by, deleted, recorded_at) VALUES (?, ?, ?, ?, ?, ?)
+	`, result.Node.Hex(), string(result.Usage), req.Reason, req.RequestedBy, string(deleted), store.clock().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("failed to record offboarding audit: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// List returns the offboardings of node, oldest first.
+func (store *OffboardingAuditStore) List(node common.Address) ([]OffboardingAudit, error) {
+	rows, err := store.Database.Query(`
+	SELECT id, usage, reason, requested_by, deleted, recorded_at FROM offboarding_audit
+	WHERE node_address = ?
+	ORDER BY recorded_at, id
+	`, node.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query offboarding audit: %w", err)
+	}
+	defer rows.Close()
+
+	out := []OffboardingAudit{}
+	for rows.Next() {
+		a := OffboardingAudit{Node: node}
+		var deleted string
+		var recordedAt int64
+		if err := rows.Scan(&a.ID, &a.Usage, &a.Reason, &a.RequestedBy, &deleted, &recordedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(deleted), &a.Deleted); err != nil {
+			return nil, fmt.Errorf("invalid offboarding audit %d: %w", a.ID, err)
+		}
+		a.RecordedAt = time.Unix(recordedAt, 0).UTC()
+		out = append(out, a)
+	}
+
+	return out, rows.Err()
+}
+
+// usageEraser is implemented by trackers which can delete a validator's usage.
+type usageEraser interface {
+	// eraseUsage deletes the usage of validator recorded for tenant in [from, to]
+	// within tx. Trackers which don't keep tenants ignore it.
+	eraseUsage(tx *sql.Tx, validator string, tenant string, from time.Time, to time.Time) (int64, error)
+}
+
+func (tracker *SQLiteUsageTracker) eraseUsage(tx *sql.Tx, validator string, tenant string, from time.Time, to time.Time) (int64, error) {
+	res, err := tx.Exec(`
+	DELETE FROM validator_usage
+	WHERE validator_index = ? AND tenant = ? AND timestamp >= datetime(?, 'unixepoch') AND timestamp <= datetime(?, 'unixepoch')
+	`, validator, tenant, from.Truncate(tracker.Precision).Unix(), to.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (tracker *SQLiteSessionUsageTracker) eraseUsage(tx *sql.Tx, validator string, _ string, from time.Time, to time.Time) (int64, error) {
+	res, err := tx.Exec(`
+	DELETE FROM validator_sessions WHERE validator_index = ? AND last_seen >= ? AND started_at <= ?
+	`, validator, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (tracker *HybridUsageTracker) eraseUsage(tx *sql.Tx, validator string, tenant string, from time.Time, to time.Time) (int64, error) {
+	buckets, err := tracker.Buckets.eraseUsage(tx, validator, tenant, from, to)
+	if err != nil {
+		return 0, err
+	}
+	sessions, err := tracker.Sessions.eraseUsage(tx, validator, tenant, from, to)
+	return buckets + sessions, err
+}
+
+// eraseUsage deletes from the primary within tx, which is a transaction of its
+// database. The shadow is erased once tx is committed, see eraseShadowUsage.
+func (tracker *ShadowUsageTracker) eraseUsage(tx *sql.Tx, validator string, tenant string, from time.Time, to time.Time) (int64, error) {
+	eraser, ok := tracker.Primary.(usageEraser)
+	if !ok {
+		return 0, fmt.Errorf("%w: the usage tracker can't delete usage", ErrInvalidOffboarding)
+	}
+	return eraser.eraseUsage(tx, validator, tenant, from, to)
+}
+
+// eraseShadowUsage deletes the usage of validators recorded for tenant from the shadow,
+// in a transaction of its own. Like its other failures, they're logged and counted
+// without reaching the caller.
+func (tracker *ShadowUsageTracker) eraseShadowUsage(validators []ValidatorAttribution, tenant string) {
+	err := func() error {
+		eraser, ok := tracker.Shadow.(usageEraser)
+		if !ok {
+			return errors.New("the shadow backend can't delete usage")
+		}
+		sqlTracker, ok := tracker.Shadow.(sqlUsageTracker)
+		if !ok {
+			return errors.New("the shadow backend isn't a SQL usage tracker")
+		}
+
+		tx, err := sqlTracker.primaryDatabase().Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer tx.Rollback()
+		for _, v := range validators {
+			if _, err := eraser.eraseUsage(tx, v.Validator, tenant, v.FirstSeen, v.LastSeen); err != nil {
+				return fmt.Errorf("failed to delete usage of validator %s: %w", v.Validator, err)
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		tracker.incCounter("write_errors", 1)
+		tracker.Logger.Warn("Failed to delete usage from the shadow backend", zap.Error(err))
+	}
+}
+
+// offboard removes everything tying node to the rescue node in a single transaction,
+// which is rolled back in a dry run:
+//   - its organization memberships, which exempt its validators from the usage retention
+//   - its notification preferences, public usage opt-in and credential expiries
+//   - with OffboardDeleteUsage, the usage, tiers and request samples of its validators
+//     while attributed to it, unless they're also attributed to another operator
+//   - with OffboardDeleteUsage or OffboardAnonymizeUsage, its validator attributions,
+//     ownership periods and daily usage
+//
+// Applied offboardings are audited in the same transaction.
+func (pr *ProxyRouter) offboard(db *sql.DB, node common.Address, req *OffboardingRequest, dryRun bool) (*OffboardingResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	out := &OffboardingResult{
+		DryRun:  dryRun,
+		Node:    node,
+		Usage:   req.Usage,
+		Deleted: map[string]int64{},
+	}
+	exec := func(table string, query string, args ...any) error {
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return fmt.Errorf("failed to delete from %s: %w", table, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		out.Deleted[table] += n
+		return nil
+	}
+
+	// Read before the membership is deleted, the usage of other tenants is kept
+	tenant := ""
+	if pr.UsageTrackerOptions.MultiTenant {
+		err := tx.QueryRow("SELECT organization_id FROM organization_members WHERE node_address = ?", node.Hex()).Scan(&tenant)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("failed to query organization member: %w", err)
+		}
+	}
+
+	if err := exec("organization_members", "DELETE FROM organization_members WHERE node_address = ?", node.Hex()); err != nil {
+		return nil, err
+	}
+	if err := exec("notification_preferences", "DELETE FROM notification_preferences WHERE node_address = ?", node.Hex()); err != nil {
+		return nil, err
+	}
+	if pr.public != nil {
+		if err := exec("public_usage", "DELETE FROM public_usage WHERE node_address = ?", node.Hex()); err != nil {
+			return nil, err
+		}
+	}
+	if pr.credentials != nil {
+		if err := exec("operator_credentials", "DELETE FROM operator_credentials WHERE node_address = ?", node.Hex()); err != nil {
+			return nil, err
+		}
+	}
+
+	var erased []ValidatorAttribution
+	if req.Usage == OffboardDeleteUsage {
+		if erased, err = pr.eraseOperatorUsage(tx, node, tenant, out, exec); err != nil {
+			return nil, err
+		}
+	}
+	if req.Usage != OffboardKeepUsage {
+		if err := exec("validator_attribution", "DELETE FROM validator_attribution WHERE node_address = ?", node.Hex()); err != nil {
+			return nil, err
+		}
+		// Usage of its validators while it owned them is left without an owner
+		if pr.owners != nil {
+			if err := exec("validator_ownership", "DELETE FROM validator_ownership WHERE owner = ?", node.Hex()); err != nil {
+				return nil, err
+			}
+		}
+		if pr.operatorDaily != nil {
+			if err := exec("operator_daily_usage", "DELETE FROM operator_daily_usage WHERE node_address = ?", node.Hex()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if dryRun {
+		return out, nil
+	}
+	if out.AuditID, err = pr.offboardings.record(tx, req, out); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if pr.shadow != nil && len(erased) > 0 {
+		pr.shadow.eraseShadowUsage(erased, tenant)
+	}
+	// Credentials the node authenticates with again must be recorded again
+	if pr.credentials != nil {
+		pr.credentials.forget(node)
+	}
+	return out, nil
+}
+
+// eraseOperatorUsage deletes the usage recorded for tenant of the validators attributed
+// to node while they were, except for those shared with other operators, which are
+// listed in out.Shared. It returns the attributions whose usage was deleted.
+func (pr *ProxyRouter) eraseOperatorUsage(tx *sql.Tx, node common.Address, tenant string, out *OffboardingResult, exec func(table string, query string, args ...any) error) ([]ValidatorAttribution, error) {
+	eraser, ok := pr.usage().(usageEraser)
+	if !ok {
+		return nil, fmt.Errorf("%w: the usage tracker can't delete usage", ErrInvalidOffboarding)
+	}
+
+	rows, err := tx.Query(`
+	SELECT a.validator_index, a.first_seen, a.last_seen, EXISTS (
+		SELECT 1 FROM validator_attribution o WHERE o.validator_index = a.validator_index AND o.node_address != a.node_address
+	)
+	FROM validator_attribution a WHERE a.node_address = ?
+	ORDER BY a.validator_index
+	`, node.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query validator attribution: %w", err)
+	}
+	var validators []ValidatorAttribution
+	for rows.Next() {
+		var v ValidatorAttribution
+		var firstSeen, lastSeen int64
+		var shared bool
+		if err := rows.Scan(&v.Validator, &firstSeen, &lastSeen, &shared); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if shared {
+			out.Shared = append(out.Shared, v.Validator)
+			continue
+		}
+		v.FirstSeen, v.LastSeen = time.UnixMilli(firstSeen), time.UnixMilli(lastSeen)
+		validators = append(validators, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, v := range validators {
+		n, err := eraser.eraseUsage(tx, v.Validator, tenant, v.FirstSeen, v.LastSeen)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete usage of validator %s: %w", v.Validator, err)
+		}
+		out.Deleted["usage"] += n
+
+		if pr.tiers != nil {
+			precision := pr.tiers.Precision
+			if err := exec("usage_tier", "DELETE FROM usage_tier WHERE validator_index = ? AND bucket >= ? AND bucket <= ?",
+				v.Validator, v.FirstSeen.Truncate(precision).Unix(), v.LastSeen.Unix()); err != nil {
+				return nil, err
+			}
+		}
+		if pr.deep != nil {
+			if err := exec("validator_request_samples", "DELETE FROM validator_request_samples WHERE validator_index = ? AND timestamp >= ? AND timestamp <= ?",
+				v.Validator, v.FirstSeen.UnixMilli(), v.LastSeen.UnixMilli()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return validators, nil
+}
+
+// serveOffboard offboards a node, see offboard, with the OffboardingRequest read from
+// the JSON body. Like bulk deletions, it's a dry run unless dry_run=false. It isn't
+// staged by the undo window: the audit record is what's left of it.
+func (pr *ProxyRouter) serveOffboard(w http.ResponseWriter, r *http.Request) {
+	tracker, ok := pr.ut.(sqlUsageTracker)
+	if !ok || pr.offboardings == nil {
+		http.Error(w, "offboarding requires a SQL usage tracker", http.StatusNotImplemented)
+		return
+	}
+
+	dryRun := true
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid dry_run: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var req OffboardingRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxOffboardingRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid offboarding: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Usage != OffboardKeepUsage && pr.attr == nil {
+		// Without attribution, usage can't be tied to the node
+		http.Error(w, "deleting or anonymizing usage requires validator attribution", http.StatusNotImplemented)
+		return
+	}
+
+	node := common.HexToAddress(mux.Vars(r)["node"])
+	result, err := pr.offboard(tracker.primaryDatabase(), node, &req, dryRun)
+	if errors.Is(err, ErrInvalidOffboarding) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		pr.Logger.Error("Failed to offboard operator", zap.Error(err))
+		http.Error(w, "failed to offboard operator", http.StatusInternalServerError)
+		return
+	}
+	if !dryRun {
+		pr.Logger.Info("Offboarded operator",
+			zap.String("node", node.Hex()),
+			zap.String("usage", string(req.Usage)),
+			zap.String("requested_by", req.RequestedBy),
+			zap.Int64("audit_id", result.AuditID),
+			zap.Any("deleted", result.Deleted))
+	}
+
+	pr.writeUsageJSON(w, r, result)
+}
+
+// serveOffboardingAudit returns the audit records of a node's offboardings.
+func (pr *ProxyRouter) serveOffboardingAudit(w http.ResponseWriter, r *http.Request) {
+	if pr.offboardings == nil {
+		http.Error(w, "offboarding requires a SQL usage tracker", http.StatusNotImplemented)
+		return
+	}
+
+	audits, err := pr.offboardings.List(common.HexToAddress(mux.Vars(r)["node"]))
+	if err != nil {
+		pr.Logger.Error("Failed to list offboardings", zap.Error(err))
+		http.Error(w, "failed to list offboardings", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, audits)
+}
@@ -0,0 +1,287 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/credentials/pb"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupOffboardingTest(t *testing.T) (*ProxyRouter, func()) {
+	pr, cleanup := setupBulkTest(t)
+	db := pr.ut.(*SQLiteUsageTracker).primaryDatabase()
+	logger := zaptest.NewLogger(t)
+
+	var err error
+	if pr.attr, err = NewAttributionStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+	if pr.public, err = NewPublicUsageStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+	if pr.offboardings, err = NewOffboardingAuditStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.public.OptIn(common.Address{1}); err != nil {
+		t.Fatal(err)
+	}
+	if pr.owners, err = NewOwnershipStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+	if pr.credentials, err = NewCredentialStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.credentials.Observe(common.Address{1}, pb.OperatorType_OT_ROCKETPOOL, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Node 1 runs validators 1 and 2, which it shares with node 2, for two buckets.
+	// Validator 3 isn't attributed.
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	pr.ut.(*SQLiteUsageTracker).now = func() time.Time { return now }
+	pr.attr.now = func() time.Time { return now }
+	for i := range 2 {
+		now = start.Add(time.Duration(i) * 5 * time.Minute)
+		if err := pr.ut.RecordUsage([]string{"1", "2", "3"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := pr.attr.Attribute(common.Address{1}, []string{"1", "2"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := pr.attr.Attribute(common.Address{2}, []string{"2"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pr.owners.now = func() time.Time { return now }
+	if _, err := pr.owners.Snapshot(map[string]common.Address{"1": {1}, "2": {1}, "3": {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	return pr, cleanup
+}
+
+func serveOffboarding(t *testing.T, pr *ProxyRouter, node common.Address, query string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/operators/"+node.Hex()+"/offboarding"+query, strings.NewReader(body)))
+	return rec
+}
+
+func TestOffboard(t *testing.T) {
+	pr, cleanup := setupOffboardingTest(t)
+	defer cleanup()
+
+	body := `{"usage": "delete", "reason": "left the program", "requested_by": "ops"}`
+	expected := map[string]int64{
+		"organization_members":     1,
+		"notification_preferences": 1,
+		"public_usage":             1,
+		"operator_credentials":     1,
+		"usage":                    2,
+		"validator_attribution":    2,
+		"validator_ownership":      2,
+	}
+
+	// Dry runs are the default
+	for _, query := range []string{"", "?dry_run=true", "?dry_run=false"} {
+		rec := serveOffboarding(t, pr, common.Address{1}, query, body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		var result OffboardingResult
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.DryRun != (query != "?dry_run=false") || (result.AuditID == 0) != result.DryRun {
+			t.Fatalf("Unexpected dry run %+v for %q", result, query)
+		}
+		for table, n := range expected {
+			if result.Deleted[table] != n {
+				t.Fatalf("Expected %d rows of %s, got %d", n, table, result.Deleted[table])
+			}
+		}
+		// The shared validator's usage is kept
+		if !slices.Equal(result.Shared, []string{"2"}) {
+			t.Fatalf("Expected validator 2 to be shared, got %v", result.Shared)
+		}
+	}
+
+	usage, err := pr.ut.ViewUsage(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := usage["1"]; ok || usage["2"] != 10*time.Minute || usage["3"] != 10*time.Minute {
+		t.Fatalf("Expected only the usage of validator 1 to be deleted, got %v", usage)
+	}
+	if _, err := pr.prefs.Get(common.Address{1}); err == nil {
+		t.Fatal("Expected the notification preferences to be deleted")
+	}
+	if org, err := pr.orgs.OrganizationOf(common.Address{1}); err == nil {
+		t.Fatalf("Expected the node to have left %s", org)
+	}
+	if public, err := pr.public.IsPublic(common.Address{1}); err != nil || public {
+		t.Fatalf("Expected the node to have opted out, got %v, %v", public, err)
+	}
+	if validators, err := pr.attr.Validators(common.Address{1}); err != nil || len(validators) != 0 {
+		t.Fatalf("Expected no attributed validators, got %v, %v", validators, err)
+	}
+	// Other nodes are untouched
+	if validators, err := pr.attr.Validators(common.Address{2}); err != nil || len(validators) != 1 {
+		t.Fatalf("Expected node 2's validator to stay attributed, got %v, %v", validators, err)
+	}
+
+	// A credential seen before offboarding is recorded again when the node comes back
+	if expiries, err := pr.credentials.Expiries(common.Address{1}); err != nil || len(expiries) != 0 {
+		t.Fatalf("Expected the credentials to be deleted, got %v, %v", expiries, err)
+	}
+	if err := pr.credentials.Observe(common.Address{1}, pb.OperatorType_OT_ROCKETPOOL, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	if expiries, err := pr.credentials.Expiries(common.Address{1}); err != nil || len(expiries) != 1 {
+		t.Fatalf("Expected the credential to be recorded again, got %v, %v", expiries, err)
+	}
+
+	rec := httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/operators/"+common.Address{1}.Hex()+"/offboarding", nil))
+	var audits []OffboardingAudit
+	if err := json.NewDecoder(rec.Body).Decode(&audits); err != nil {
+		t.Fatal(err)
+	}
+	if len(audits) != 1 || audits[0].Usage != OffboardDeleteUsage || audits[0].Reason != "left the program" || audits[0].RequestedBy != "ops" || audits[0].Deleted["usage"] != 2 {
+		t.Fatalf("Unexpected audit %+v", audits)
+	}
+}
+
+func TestOffboardTenantAndShadow(t *testing.T) {
+	pr, cleanup := setupOffboardingTest(t)
+	defer cleanup()
+
+	shadowTracker, shadowCleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shadowCleanup()
+	primary := pr.ut.(*SQLiteUsageTracker)
+	shadow := shadowTracker.(*SQLiteUsageTracker)
+	shadow.now = primary.now
+	pr.shadow = &ShadowUsageTracker{Primary: primary, Shadow: shadow, Logger: zaptest.NewLogger(t)}
+	pr.UsageTrackerOptions.MultiTenant = true
+
+	// Node 1 belongs to acme, another tenant recorded validator 1 too
+	for _, tenant := range []string{"acme", "other"} {
+		if err := primary.RecordTenantUsage(tenant, []string{"1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := shadow.RecordTenantUsage("acme", []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serveOffboarding(t, pr, common.Address{1}, "?dry_run=false", `{"usage": "delete"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var result OffboardingResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Deleted["usage"] != 1 {
+		t.Fatalf("Expected only acme's record to be deleted, got %d", result.Deleted["usage"])
+	}
+
+	from, to := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		tracker  *SQLiteUsageTracker
+		tenant   string
+		expected bool
+	}{
+		{primary, "acme", false},
+		{primary, "other", true},
+		{shadow, "acme", false},
+	} {
+		usage, err := c.tracker.ViewTenantUsage(c.tenant, from, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := usage["1"]; ok != c.expected {
+			t.Fatalf("Expected usage of validator 1 for %s kept %v, got %v", c.tenant, c.expected, usage)
+		}
+	}
+}
+
+func TestOffboardAnonymize(t *testing.T) {
+	pr, cleanup := setupOffboardingTest(t)
+	defer cleanup()
+
+	rec := serveOffboarding(t, pr, common.Address{2}, "?dry_run=false", `{"usage": "anonymize"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	// The usage is kept, but no longer tied to the node
+	usage, err := pr.ut.ViewUsage(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["2"] != 10*time.Minute {
+		t.Fatalf("Expected the usage of validator 2 to be kept, got %v", usage)
+	}
+	if validators, err := pr.attr.Validators(common.Address{2}); err != nil || len(validators) != 0 {
+		t.Fatalf("Expected no attributed validators, got %v, %v", validators, err)
+	}
+	// Nor to it as their owner
+	report, err := pr.owners.Report(pr.ut.(usageBuckets), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, owner := range report.Owners {
+		if owner.Owner == (common.Address{2}) {
+			t.Fatalf("Expected node 2 not to own any usage, got %+v", report.Owners)
+		}
+	}
+	if len(report.Owners) != 1 || report.UnattributedSeconds == 0 {
+		t.Fatalf("Expected validator 3's usage to be unattributed, got %+v", report)
+	}
+	if history, err := pr.owners.History("3"); err != nil || len(history) != 0 {
+		t.Fatalf("Expected no ownership history, got %v, %v", history, err)
+	}
+	// Keeping usage leaves the attribution
+	rec = serveOffboarding(t, pr, common.Address{1}, "?dry_run=false", `{}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if validators, err := pr.attr.Validators(common.Address{1}); err != nil || len(validators) != 2 {
+		t.Fatalf("Expected node 1's validators to stay attributed, got %v, %v", validators, err)
+	}
+}
+
+func TestOffboardInvalid(t *testing.T) {
+	pr, cleanup := setupOffboardingTest(t)
+	defer cleanup()
+
+	for _, body := range []string{`{"usage": "forget"}`, `{"unknown": true}`, `[]`} {
+		if rec := serveOffboarding(t, pr, common.Address{1}, "?dry_run=false", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %d for %s, got %d", http.StatusBadRequest, body, rec.Code)
+		}
+	}
+	if rec := serveOffboarding(t, pr, common.Address{1}, "?dry_run=maybe", `{}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	// Usage can't be tied to nodes without attribution
+	pr.attr = nil
+	if rec := serveOffboarding(t, pr, common.Address{1}, "", `{"usage": "anonymize"}`); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected %d, got %d", http.StatusNotImplemented, rec.Code)
+	}
+}
@@ -0,0 +1,381 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNoOrganization is returned for organizations which don't exist.
+	ErrNoOrganization = errors.New("no such organization")
+	// ErrNotMember is returned when removing a node address from an organization it isn't in.
+	ErrNotMember = errors.New("node address isn't a member of the organization")
+	// ErrInvalidOrganization is returned for organizations with an invalid id or name.
+	ErrInvalidOrganization = errors.New("invalid organization")
+)
+
+var organizationIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// Organization groups the node addresses of an operator running many nodes.
+type Organization struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Overrides the usage retention of the members' validators when longer. 0 uses the default.
+	RetentionDays int              `json:"retention_days,omitempty"`
+	Members       []common.Address `json:"members"`
+	CreatedAt     time.Time        `json:"created_at"`
+}
+
+// Validate checks the id and name of an organization.
+func (o *Organization) Validate() error {
+	if !organizationIDPattern.MatchString(o.ID) {
+		return fmt.Errorf("%w id %q, must be lowercase alphanumeric or dashes", ErrInvalidOrganization, o.ID)
+	}
+	if o.Name == "" || len(o.Name) > 256 {
+		return fmt.Errorf("%w name %q", ErrInvalidOrganization, o.Name)
+	}
+	if o.RetentionDays < 0 {
+		return fmt.Errorf("%w retention of %d days", ErrInvalidOrganization, o.RetentionDays)
+	}
+	return nil
+}
+
+// OrganizationStore keeps organizations and their member node addresses.
+// A node address is a member of at most one organization.
+type OrganizationStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewOrganizationStore creates the organization tables in db if needed.
+func NewOrganizationStore(logger *zap.Logger, db *sql.DB) (*OrganizationStore, error) {
+	store := &OrganizationStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *OrganizationStore) initSchema() error {
+	// created_at is unix milliseconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS organizations (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS organization_members (
+		node_address TEXT PRIMARY KEY,
+		organization_id TEXT NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_members_organization ON organization_members(organization_id);
+
+	CREATE TABLE IF NOT EXISTS organization_retention (
+		organization_id TEXT PRIMARY KEY,
+		retention_days INTEGER NOT NULL
+	);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Put creates an organization or updates the name and retention of an existing one.
+// Members are left untouched.
+func (store *OrganizationStore) Put(org *Organization) error {
+	if err := org.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	INSERT INTO organizations (id, name, created_at) VALUES (?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET name = excluded.name
+	`, org.ID, org.Name, store.clock().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to store organization: %w", err)
+	}
+
+	if org.RetentionDays == 0 {
+		_, err = tx.Exec("DELETE FROM organization_retention WHERE organization_id = ?", org.ID)
+	} else {
+		_, err = tx.Exec(`
+		INSERT INTO organization_retention (organization_id, retention_days) VALUES (?, ?)
+		ON CONFLICT (organization_id) DO UPDATE SET retention_days = excluded.retention_days
+		`, org.ID, org.RetentionDays)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store organization retention: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// Get returns an organization with its members.
+func (store *OrganizationStore) Get(id string) (*Organization, error) {
+	org := &Organization{ID: id}
+	var createdAt int64
+	err := store.Database.QueryRow(`
+	SELECT o.name, COALESCE(r.retention_days, 0), o.created_at FROM organizations o
+	LEFT JOIN organization_retention r ON r.organization_id = o.id
+	WHERE o.id = ?
+	`, id).Scan(&org.Name, &org.RetentionDays, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoOrganization
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organization: %w", err)
+	}
+	org.CreatedAt = time.UnixMilli(createdAt).UTC()
+
+	org.Members, err = store.members(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return org, nil
+}
+
+func (store *OrganizationStore) members(id string) ([]common.Address, error) {
+	rows, err := store.Database.Query(`
+	SELECT node_address FROM organization_members WHERE organization_id = ? ORDER BY node_address
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organization members: %w", err)
+	}
+	defer rows.Close()
+
+	out := []common.Address{}
+	for rows.Next() {
+		var node string
+		if err := rows.Scan(&node); err != nil {
+			return nil, err
+		}
+		out = append(out, common.HexToAddress(node))
+	}
+
+	return out, rows.Err()
+}
+
+// OrganizationOf returns the id of the organization node is a member of, or
+// ErrNotMember.
+func (store *OrganizationStore) OrganizationOf(node common.Address) (string, error) {
+	var id string
+	err := store.Database.QueryRow("SELECT organization_id FROM organization_members WHERE node_address = ?", node.Hex()).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotMember
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query organization member: %w", err)
+	}
+	return id, nil
+}
+
+// List returns every organization without its members, ordered by id.
+func (store *OrganizationStore) List() ([]*Organization, error) {
+	rows, err := store.Database.Query(`
+	SELECT o.id, o.name, COALESCE(r.retention_days, 0), o.created_at FROM organizations o
+	LEFT JOIN organization_retention r ON r.organization_id = o.id
+	ORDER BY o.id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organizations: %w", err)
+	}
+	defer rows.Close()
+
+	out := []*Organization{}
+	for rows.Next() {
+		org := &Organization{}
+		var createdAt int64
+		if err := rows.Scan(&org.ID, &org.Name, &org.RetentionDays, &createdAt); err != nil {
+			return nil, err
+		}
+		org.CreatedAt = time.UnixMilli(createdAt).UTC()
+		out = append(out, org)
+	}
+
+	return out, rows.Err()
+}
+
+// Delete removes an organization and its memberships.
+func (store *OrganizationStore) Delete(id string) error {
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM organizations WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete organization: %w", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNoOrganization
+	}
+
+	if _, err := tx.Exec("DELETE FROM organization_members WHERE organization_id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete organization members: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM organization_retention WHERE organization_id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete organization retention: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// AddMember adds a node address to an organization, moving it out of its previous one.
+func (store *OrganizationStore) AddMember(id string, node common.Address) error {
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM organizations WHERE id = ?", id).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to query organization: %w", err)
+	}
+	if exists == 0 {
+		return ErrNoOrganization
+	}
+
+	_, err = tx.Exec(`
+	INSERT INTO organization_members (node_address, organization_id) VALUES (?, ?)
+	ON CONFLICT (node_address) DO UPDATE SET organization_id = excluded.organization_id
+	`, node.Hex(), id)
+	if err != nil {
+		return fmt.Errorf("failed to add organization member: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// RemoveMember removes a node address from an organization.
+func (store *OrganizationStore) RemoveMember(id string, node common.Address) error {
+	res, err := store.Database.Exec(`
+	DELETE FROM organization_members WHERE organization_id = ? AND node_address = ?
+	`, id, node.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to remove organization member: %w", err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotMember
+	}
+
+	return nil
+}
+
+// retentionOverrides returns the retention of every member of an organization with
+// a retention override.
+func (store *OrganizationStore) retentionOverrides() (map[common.Address]time.Duration, error) {
+	rows, err := store.Database.Query(`
+	SELECT m.node_address, r.retention_days FROM organization_members m
+	JOIN organization_retention r ON r.organization_id = m.organization_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organization retention: %w", err)
+	}
+	defer rows.Close()
+
+	out := make(map[common.Address]time.Duration)
+	for rows.Next() {
+		var node string
+		var days int
+		if err := rows.Scan(&node, &days); err != nil {
+			return nil, err
+		}
+		out[common.HexToAddress(node)] = time.Duration(days) * 24 * time.Hour
+	}
+
+	return out, rows.Err()
+}
+
+// NodeUsage is the usage of the validators attributed to a node address.
+type NodeUsage struct {
+	NodeAddress common.Address `json:"node_address"`
+	Validators  int            `json:"validators"`
+	Seconds     float64        `json:"seconds"`
+}
+
+// OrganizationUsage is the usage of an organization's members in a range.
+type OrganizationUsage struct {
+	Organization string      `json:"organization"`
+	From         time.Time   `json:"from"`
+	To           time.Time   `json:"to"`
+	Seconds      float64     `json:"seconds"`
+	Nodes        []NodeUsage `json:"nodes"`
+}
+
+// OrganizationUsageReport aggregates the usage of the validators attributed to the
+// members of an organization over the buckets overlapping [from, to].
+// A validator attributed to several members counts towards each of them, but only
+// once towards the organization.
+func OrganizationUsageReport(tracker UsageTracker, attr *AttributionStore, org *Organization, from time.Time, to time.Time) (*OrganizationUsage, error) {
+	usage, err := tracker.ViewUsage(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &OrganizationUsage{
+		Organization: org.ID,
+		From:         from,
+		To:           to,
+		Nodes:        make([]NodeUsage, 0, len(org.Members)),
+	}
+	counted := make(map[string]struct{})
+	for _, node := range org.Members {
+		validators, err := attr.Validators(node)
+		if err != nil {
+			return nil, err
+		}
+
+		nodeUsage := NodeUsage{NodeAddress: node, Validators: len(validators)}
+		for _, v := range validators {
+			seconds := usage[v.Validator].Seconds()
+			nodeUsage.Seconds += seconds
+			if _, ok := counted[v.Validator]; !ok {
+				counted[v.Validator] = struct{}{}
+				report.Seconds += seconds
+			}
+		}
+		report.Nodes = append(report.Nodes, nodeUsage)
+	}
+
+	sort.Slice(report.Nodes, func(i, j int) bool {
+		return report.Nodes[i].Seconds > report.Nodes[j].Seconds
+	})
+
+	return report, nil
+}
@@ -0,0 +1,175 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupOrganizationTest(t *testing.T) (*OrganizationStore, *AttributionStore, *SQLiteUsageTracker) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	sqlite := tracker.(*SQLiteUsageTracker)
+
+	store, err := NewOrganizationStore(zaptest.NewLogger(t), sqlite.primaryDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.now = func() time.Time { return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	attr, _ := setupAttributionTestDatabase(t, sqlite.primaryDatabase())
+
+	return store, attr, sqlite
+}
+
+func TestOrganizationValidate(t *testing.T) {
+	for _, org := range []Organization{
+		{ID: "", Name: "Empty"},
+		{ID: "Upper", Name: "Upper"},
+		{ID: "-dash", Name: "Dash"},
+		{ID: "ok", Name: ""},
+		{ID: "ok", Name: "Negative", RetentionDays: -1},
+	} {
+		if err := org.Validate(); !errors.Is(err, ErrInvalidOrganization) {
+			t.Fatalf("Expected %+v to be invalid, got %v", org, err)
+		}
+	}
+
+	if err := (&Organization{ID: "big-operator-1", Name: "Big Operator"}).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOrganizationMembers(t *testing.T) {
+	store, _, _ := setupOrganizationTest(t)
+	node1 := common.HexToAddress("0x01")
+	node2 := common.HexToAddress("0x02")
+
+	if err := store.AddMember("acme", node1); !errors.Is(err, ErrNoOrganization) {
+		t.Fatalf("Expected ErrNoOrganization, got %v", err)
+	}
+
+	for _, id := range []string{"acme", "globex"} {
+		if err := store.Put(&Organization{ID: id, Name: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.AddMember("acme", node1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddMember("acme", node2); err != nil {
+		t.Fatal(err)
+	}
+	// Moves node2 to globex
+	if err := store.AddMember("globex", node2); err != nil {
+		t.Fatal(err)
+	}
+
+	acme, err := store.Get("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acme.Members) != 1 || acme.Members[0] != node1 {
+		t.Fatalf("Unexpected members %v", acme.Members)
+	}
+
+	// Renaming keeps the members
+	if err := store.Put(&Organization{ID: "acme", Name: "ACME Corp"}); err != nil {
+		t.Fatal(err)
+	}
+	acme, err = store.Get("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acme.Name != "ACME Corp" || len(acme.Members) != 1 {
+		t.Fatalf("Unexpected organization %+v", acme)
+	}
+
+	if err := store.Put(&Organization{ID: "acme", Name: "ACME Corp", RetentionDays: 30}); err != nil {
+		t.Fatal(err)
+	}
+	overrides, err := store.retentionOverrides()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(overrides) != 1 || overrides[node1] != 30*24*time.Hour {
+		t.Fatalf("Unexpected retention overrides %v", overrides)
+	}
+
+	if err := store.RemoveMember("acme", node2); !errors.Is(err, ErrNotMember) {
+		t.Fatalf("Expected ErrNotMember, got %v", err)
+	}
+	if err := store.RemoveMember("globex", node2); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete("acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("acme"); !errors.Is(err, ErrNoOrganization) {
+		t.Fatalf("Expected ErrNoOrganization, got %v", err)
+	}
+	if err := store.Delete("acme"); !errors.Is(err, ErrNoOrganization) {
+		t.Fatalf("Expected ErrNoOrganization, got %v", err)
+	}
+
+	orgs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 1 || orgs[0].ID != "globex" {
+		t.Fatalf("Unexpected organizations %+v", orgs)
+	}
+}
+
+func TestOrganizationUsageReport(t *testing.T) {
+	store, attr, tracker := setupOrganizationTest(t)
+	node1 := common.HexToAddress("0x01")
+	node2 := common.HexToAddress("0x02")
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	if err := store.Put(&Organization{ID: "acme", Name: "ACME"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range []common.Address{node1, node2} {
+		if err := store.AddMember("acme", node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Validator 2 is shared by both nodes
+	if err := attr.Attribute(node1, []string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := attr.Attribute(node2, []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.recordUsage(start.Unix(), []string{"1", "2", "3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	org, err := store.Get("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := OrganizationUsageReport(tracker, attr, org, start, start.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Seconds != 7200 {
+		t.Fatalf("Expected 2 hours of usage, got %vs", report.Seconds)
+	}
+	if len(report.Nodes) != 2 || report.Nodes[0].NodeAddress != node1 || report.Nodes[0].Seconds != 7200 ||
+		report.Nodes[1].Seconds != 3600 {
+		t.Fatalf("Unexpected node usage %+v", report.Nodes)
+	}
+}
@@ -0,0 +1,302 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/credentials"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// Verdicts cached at most, beyond which expired ones are dropped and new ones aren't
+	// cached until there's room
+	maxPolicyCacheEntries = 100_000
+	// How long a failure's fallback verdict is cached at most, so an unavailable policy
+	// endpoint isn't called on every request but recovers quickly
+	policyFailureTTL = 10 * time.Second
+	// Days of daily usage passed to the policy endpoint
+	policyUsageDays = 30
+)
+
+// PolicyRequest is the context POSTed to the policy endpoint.
+type PolicyRequest struct {
+	Node common.Address `json:"node"`
+	// Tier of the credential, e.g. rocketpool or solo
+	Tier string `json:"tier"`
+	// Priority of the request, see RequestPriority. Duty-critical requests are never
+	// checked.
+	Priority string `json:"priority"`
+	// Organization the node is a member of, if any
+	Organization string `json:"organization,omitempty"`
+	// Daily usage of the node over the last policyUsageDays UTC days, oldest first.
+	// Omitted unless operator aggregates are enabled.
+	Usage []OperatorDailyUsage `json:"usage,omitempty"`
+}
+
+// PolicyVerdict is the policy endpoint's response.
+type PolicyVerdict struct {
+	Allow bool `json:"allow"`
+	// Returned to denied clients
+	Reason string `json:"reason,omitempty"`
+}
+
+// PolicyFormat selects the wire format of the policy endpoint.
+type PolicyFormat string
+
+const (
+	// PolicyFormatJSON POSTs the PolicyRequest and expects a PolicyVerdict.
+	PolicyFormatJSON PolicyFormat = "json"
+	// PolicyFormatOPA speaks the data API of an Open Policy Agent server: the
+	// PolicyRequest is POSTed as {"input": ...} to the URL of a rule, e.g.
+	// http://localhost:8181/v1/data/rescue/decision, whose result is either a
+	// PolicyVerdict or a boolean. An undefined rule counts as a failure, so the
+	// rules are reloaded by OPA, e.g. with opa run --server --watch <bundle>.
+	PolicyFormatOPA PolicyFormat = "opa"
+)
+
+// PolicyWebhookOptions configures the external policy requests are checked against.
+type PolicyWebhookOptions struct {
+	// URL the context of requests is POSTed to. Empty disables the policy.
+	URL string
+	// Wire format of the endpoint, PolicyFormatJSON if empty
+	Format PolicyFormat
+	// How long the endpoint may take to answer
+	Timeout time.Duration
+	// How long verdicts are cached
+	TTL time.Duration
+	// Deny requests while the endpoint fails, rather than allow them
+	FailClosed bool
+}
+
+type policyCacheKey struct {
+	node     common.Address
+	priority RequestPriority
+}
+
+type cachedVerdict struct {
+	verdict PolicyVerdict
+	expires time.Time
+}
+
+// PolicyWebhook delegates the decision to serve a node's requests to an external policy
+// endpoint, so quota logic can live outside the proxy. Verdicts are cached per node and
+// request priority for TTL.
+//
+// When the endpoint fails or times out, requests are allowed unless FailClosed is set,
+// and the fallback is cached for at most policyFailureTTL.
+type PolicyWebhook struct {
+	Options PolicyWebhookOptions
+	Client  *http.Client
+	Logger  *zap.Logger
+
+	// Called to build the context of a request, see PolicyRequest
+	context func(req *PolicyRequest) error
+
+	m        *metrics.MetricsRegistry
+	mu       sync.Mutex
+	verdicts map[policyCacheKey]cachedVerdict
+	calls    singleflight.Group
+
+	wallClock
+}
+
+// NewPolicyWebhook creates the policy webhook configured by opts.
+func NewPolicyWebhook(logger *zap.Logger, opts PolicyWebhookOptions) *PolicyWebhook {
+	return &PolicyWebhook{
+		Options:  opts,
+		Logger:   logger,
+		m:        metrics.NewMetricsRegistry("policy"),
+		verdicts: make(map[policyCacheKey]cachedVerdict),
+	}
+}
+
+// Decide returns the verdict on a request of node, from the cache or the endpoint.
+func (p *PolicyWebhook) Decide(node common.Address, operatorType credentials.OperatorType, priority RequestPriority) PolicyVerdict {
+	key := policyCacheKey{node: node, priority: priority}
+	now := p.clock()
+
+	p.mu.Lock()
+	cached, ok := p.verdicts[key]
+	p.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		p.m.Counter("cache_hit").Inc()
+		return cached.verdict
+	}
+
+	// Concurrent requests of a node share a call
+	v, _, _ := p.calls.Do(fmt.Sprintf("%s/%d", node.Hex(), priority), func() (any, error) {
+		verdict, ttl := p.call(node, operatorType, priority)
+		p.cache(key, verdict, p.clock().Add(ttl))
+		return verdict, nil
+	})
+	verdict := v.(PolicyVerdict)
+	if verdict.Allow {
+		p.m.Counter("allowed").Inc()
+	} else {
+		p.m.Counter("denied").Inc()
+	}
+	return verdict
+}
+
+// call asks the endpoint for a verdict, falling back on failures. It returns how long
+// the verdict may be cached.
+func (p *PolicyWebhook) call(node common.Address, operatorType credentials.OperatorType, priority RequestPriority) (PolicyVerdict, time.Duration) {
+	req := &PolicyRequest{
+		Node:     node,
+		Tier:     credentialTier(operatorType),
+		Priority: priority.String(),
+	}
+	verdict, err := p.post(req)
+	if err == nil {
+		return verdict, p.Options.TTL
+	}
+
+	p.m.Counter("errors").Inc()
+	p.Logger.Warn("Policy endpoint failed",
+		zap.String("node", node.Hex()),
+		zap.Bool("fail_closed", p.Options.FailClosed),
+		zap.Error(err))
+	if p.Options.FailClosed {
+		return PolicyVerdict{Reason: "the usage policy couldn't be checked, try again later"}, min(p.Options.TTL, policyFailureTTL)
+	}
+	return PolicyVerdict{Allow: true}, min(p.Options.TTL, policyFailureTTL)
+}
+
+func (p *PolicyWebhook) post(req *PolicyRequest) (PolicyVerdict, error) {
+	var verdict PolicyVerdict
+	if p.context != nil {
+		if err := p.context(req); err != nil {
+			return verdict, fmt.Errorf("failed to build the policy context: %w", err)
+		}
+	}
+	var body []byte
+	var err error
+	if p.Options.Format == PolicyFormatOPA {
+		body, err = json.Marshal(map[string]*PolicyRequest{"input": req})
+	} else {
+		body, err = json.Marshal(req)
+	}
+	if err != nil {
+		return verdict, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.Options.Timeout)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.Options.URL, bytes.NewReader(body))
+	if err != nil {
+		return verdict, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return verdict, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return verdict, fmt.Errorf("policy endpoint returned %s", resp.Status)
+	}
+	if p.Options.Format == PolicyFormatOPA {
+		return decodeOPAVerdict(resp.Body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil {
+		return verdict, fmt.Errorf("invalid policy verdict: %w", err)
+	}
+
+	return verdict, nil
+}
+
+// decodeOPAVerdict decodes the response of OPA's data API, whose result is the value
+// of the rule: a boolean or an object with allow and reason. A missing or null result
+// is an undefined rule, which fails like an unreachable endpoint.
+func decodeOPAVerdict(r io.Reader) (PolicyVerdict, error) {
+	var verdict PolicyVerdict
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(r).Decode(&resp); err != nil {
+		return verdict, fmt.Errorf("invalid OPA response: %w", err)
+	}
+	if len(resp.Result) == 0 || bytes.Equal(resp.Result, []byte("null")) {
+		return verdict, errors.New("the policy rule is undefined")
+	}
+	if err := json.Unmarshal(resp.Result, &verdict.Allow); err == nil {
+		return verdict, nil
+	}
+	if err := json.Unmarshal(resp.Result, &verdict); err != nil {
+		return verdict, fmt.Errorf("invalid policy verdict: %w", err)
+	}
+	return verdict, nil
+}
+
+func (p *PolicyWebhook) cache(key policyCacheKey, verdict PolicyVerdict, expires time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.verdicts[key]; !ok && len(p.verdicts) >= maxPolicyCacheEntries {
+		now := p.clock()
+		for k, v := range p.verdicts {
+			if !now.Before(v.expires) {
+				delete(p.verdicts, k)
+			}
+		}
+		if len(p.verdicts) >= maxPolicyCacheEntries {
+			return
+		}
+	}
+	p.verdicts[key] = cachedVerdict{verdict: verdict, expires: expires}
+}
+
+// policyContext adds the node's organization and daily usage to req, when known.
+func (pr *ProxyRouter) policyContext(req *PolicyRequest) error {
+	if pr.orgs != nil {
+		org, err := pr.orgs.OrganizationOf(req.Node)
+		if err != nil && !errors.Is(err, ErrNotMember) {
+			return err
+		}
+		req.Organization = org
+	}
+	if pr.operatorDaily != nil {
+		now := time.Now()
+		usage, err := pr.operatorDaily.Days([]common.Address{req.Node}, now.AddDate(0, 0, 1-policyUsageDays), now)
+		if err != nil {
+			return err
+		}
+		req.Usage = usage
+	}
+	return nil
+}
+
+// checkPolicy returns an error when the policy denies a request of node. Duty-critical
+// requests are never checked, so neither a verdict nor an unavailable endpoint can
+// throttle them.
+func (pr *ProxyRouter) checkPolicy(node common.Address, operatorType credentials.OperatorType, priority RequestPriority) error {
+	if pr.policy == nil || priority == PriorityCritical {
+		return nil
+	}
+	verdict := pr.policy.Decide(node, operatorType, priority)
+	if verdict.Allow {
+		return nil
+	}
+	if verdict.Reason == "" {
+		return errors.New("denied by the usage policy")
+	}
+	return fmt.Errorf("denied by the usage policy: %s", verdict.Reason)
+}
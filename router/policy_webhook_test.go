@@ -0,0 +1,193 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/credentials/pb"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupPolicyTest(t *testing.T, handler http.HandlerFunc, opts PolicyWebhookOptions) *PolicyWebhook {
+	_, err := metrics.Init("policy_webhook_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	opts.URL = server.URL
+	return NewPolicyWebhook(zaptest.NewLogger(t), opts)
+}
+
+func TestPolicyWebhook(t *testing.T) {
+	var calls atomic.Int32
+	p := setupPolicyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req PolicyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if req.Tier != "rocketpool" || req.Organization != "acme" {
+			t.Errorf("Unexpected context %+v", req)
+		}
+		// Node 2 is over its quota, except for regular requests
+		allow := req.Node != common.Address{2} || req.Priority == "normal"
+		_ = json.NewEncoder(w).Encode(PolicyVerdict{Allow: allow, Reason: "over quota"})
+	}, PolicyWebhookOptions{Timeout: time.Second, TTL: time.Minute})
+	p.context = func(req *PolicyRequest) error {
+		req.Organization = "acme"
+		return nil
+	}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	p.now = func() time.Time { return now }
+
+	if verdict := p.Decide(common.Address{1}, pb.OperatorType_OT_ROCKETPOOL, PriorityNormal); !verdict.Allow {
+		t.Fatalf("Expected node 1 to be allowed, got %+v", verdict)
+	}
+	if verdict := p.Decide(common.Address{2}, pb.OperatorType_OT_ROCKETPOOL, PriorityBulk); verdict.Allow || verdict.Reason != "over quota" {
+		t.Fatalf("Expected node 2's bulk requests to be denied, got %+v", verdict)
+	}
+	if verdict := p.Decide(common.Address{2}, pb.OperatorType_OT_ROCKETPOOL, PriorityNormal); !verdict.Allow {
+		t.Fatalf("Expected node 2's regular requests to be allowed, got %+v", verdict)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("Expected 3 calls, got %d", calls.Load())
+	}
+
+	// Verdicts are cached for the TTL
+	now = now.Add(59 * time.Second)
+	if verdict := p.Decide(common.Address{2}, pb.OperatorType_OT_ROCKETPOOL, PriorityBulk); verdict.Allow || calls.Load() != 3 {
+		t.Fatalf("Expected the cached verdict, got %+v after %d calls", verdict, calls.Load())
+	}
+	now = now.Add(time.Second)
+	p.Decide(common.Address{2}, pb.OperatorType_OT_ROCKETPOOL, PriorityBulk)
+	if calls.Load() != 4 {
+		t.Fatalf("Expected the verdict to expire, got %d calls", calls.Load())
+	}
+}
+
+func TestPolicyWebhookFailure(t *testing.T) {
+	var calls atomic.Int32
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}
+
+	for _, failClosed := range []bool{false, true} {
+		calls.Store(0)
+		p := setupPolicyTest(t, handler, PolicyWebhookOptions{Timeout: time.Second, TTL: time.Minute, FailClosed: failClosed})
+		now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		p.now = func() time.Time { return now }
+
+		if verdict := p.Decide(common.Address{1}, pb.OperatorType_OT_SOLO, PriorityNormal); verdict.Allow == failClosed {
+			t.Fatalf("Expected allow to be %v failing closed %v, got %+v", !failClosed, failClosed, verdict)
+		}
+		// Failures are cached briefly
+		now = now.Add(policyFailureTTL - time.Second)
+		p.Decide(common.Address{1}, pb.OperatorType_OT_SOLO, PriorityNormal)
+		if calls.Load() != 1 {
+			t.Fatalf("Expected the failure to be cached, got %d calls", calls.Load())
+		}
+		now = now.Add(time.Second)
+		p.Decide(common.Address{1}, pb.OperatorType_OT_SOLO, PriorityNormal)
+		if calls.Load() != 2 {
+			t.Fatalf("Expected the failure to expire, got %d calls", calls.Load())
+		}
+		metrics.Deinit()
+	}
+
+	// Slow endpoints count as failed
+	p := setupPolicyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		_ = json.NewEncoder(w).Encode(PolicyVerdict{Allow: true})
+	}, PolicyWebhookOptions{Timeout: 10 * time.Millisecond, TTL: time.Minute, FailClosed: true})
+	if verdict := p.Decide(common.Address{1}, pb.OperatorType_OT_SOLO, PriorityNormal); verdict.Allow {
+		t.Fatalf("Expected a timeout to be denied, got %+v", verdict)
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	pr := &ProxyRouter{}
+	if err := pr.checkPolicy(common.Address{1}, pb.OperatorType_OT_ROCKETPOOL, PriorityNormal); err != nil {
+		t.Fatalf("Expected requests to be allowed without a policy, got %v", err)
+	}
+
+	pr.policy = setupPolicyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(PolicyVerdict{Reason: "monthly quota exhausted"})
+	}, PolicyWebhookOptions{Timeout: time.Second, TTL: time.Minute})
+	err := pr.checkPolicy(common.Address{1}, pb.OperatorType_OT_ROCKETPOOL, PriorityNormal)
+	if err == nil || !strings.Contains(err.Error(), "monthly quota exhausted") {
+		t.Fatalf("Expected the reason of the denial, got %v", err)
+	}
+}
+
+func TestPolicyWebhookOPA(t *testing.T) {
+	// Stands in for OPA evaluating data.rescue.decision, or an undefined rule
+	results := map[common.Address]string{
+		{1}: `{"result": true}`,
+		{2}: `{"result": {"allow": false, "reason": "over quota"}}`,
+		{3}: `{}`,
+		{4}: `{"result": null}`,
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input PolicyRequest `json:"input"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		_, _ = w.Write([]byte(results[body.Input.Node]))
+	}
+	p := setupPolicyTest(t, handler, PolicyWebhookOptions{Format: PolicyFormatOPA, Timeout: time.Second, TTL: time.Minute, FailClosed: true})
+
+	if verdict := p.Decide(common.Address{1}, pb.OperatorType_OT_ROCKETPOOL, PriorityNormal); !verdict.Allow {
+		t.Fatalf("Expected node 1 to be allowed, got %+v", verdict)
+	}
+	if verdict := p.Decide(common.Address{2}, pb.OperatorType_OT_ROCKETPOOL, PriorityNormal); verdict.Allow || verdict.Reason != "over quota" {
+		t.Fatalf("Expected node 2 to be denied, got %+v", verdict)
+	}
+	// Missing and null results are undefined rules, which fail like an unreachable
+	// endpoint: closed here, open otherwise
+	for _, node := range []common.Address{{3}, {4}} {
+		if verdict := p.Decide(node, pb.OperatorType_OT_ROCKETPOOL, PriorityNormal); verdict.Allow || verdict.Reason == "" {
+			t.Fatalf("Expected node %s to be denied, got %+v", node.Hex(), verdict)
+		}
+	}
+	p.Options.FailClosed = false
+	for _, node := range []common.Address{{3}, {4}} {
+		if verdict, _ := p.call(node, pb.OperatorType_OT_ROCKETPOOL, PriorityNormal); !verdict.Allow {
+			t.Fatalf("Expected node %s to be allowed, got %+v", node.Hex(), verdict)
+		}
+	}
+}
+
+func TestCheckPolicyCritical(t *testing.T) {
+	var calls atomic.Int32
+	pr := &ProxyRouter{}
+	pr.policy = setupPolicyTest(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}, PolicyWebhookOptions{Timeout: time.Second, TTL: time.Minute, FailClosed: true})
+
+	// Duties pass while the endpoint is down, without waiting on it
+	if err := pr.checkPolicy(common.Address{1}, pb.OperatorType_OT_ROCKETPOOL, PriorityCritical); err != nil {
+		t.Fatalf("Expected duty-critical requests to be allowed, got %v", err)
+	}
+	if calls.Load() != 0 {
+		t.Fatalf("Expected the endpoint not to be called, got %d calls", calls.Load())
+	}
+	if err := pr.checkPolicy(common.Address{1}, pb.OperatorType_OT_ROCKETPOOL, PriorityNormal); err == nil {
+		t.Fatal("Expected regular requests to fail closed")
+	}
+}
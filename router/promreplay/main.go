@@ -0,0 +1,84 @@
+//go:build ns
+
+// Command promreplay writes historical validator usage as an OpenMetrics file, for
+// "promtool tsdb create-blocks-from openmetrics" to backfill Prometheus with.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/router"
+	"go.uber.org/zap"
+)
+
+func main() {
+	usageDSN := flag.String("usage-db", "file:nodeset-usage.db?cache=shared", "DSN of the database validator usage is read from")
+	usageModel := flag.String("usage-model", "buckets", "Usage model of the database, buckets or hybrid")
+	usagePrecision := flag.Duration("usage-precision", 5*time.Minute, "Width of the buckets of the database")
+	namespace := flag.String("namespace", "rescue_proxy", "Prefix of the metric names")
+	from := flag.String("from", "", "RFC3339 time of the first bucket replayed")
+	to := flag.String("to", "", "RFC3339 time before which buckets are replayed, eg, when the usage metrics were first scraped")
+	output := flag.String("output", "", "File the OpenMetrics are written to, stdout if empty")
+	flag.Parse()
+
+	if err := run(*usageDSN, *usageModel, *usagePrecision, *namespace, *from, *to, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(usageDSN, usageModel string, usagePrecision time.Duration, namespace, from, to, output string) error {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = logger.Sync()
+	}()
+
+	fromTime, err := time.Parse(time.RFC3339, from)
+	if err != nil {
+		return fmt.Errorf("invalid -from: %w", err)
+	}
+	toTime, err := time.Parse(time.RFC3339, to)
+	if err != nil {
+		return fmt.Errorf("invalid -to: %w", err)
+	}
+	if namespace == "" {
+		return fmt.Errorf("invalid -namespace: must not be empty")
+	}
+
+	if _, err := metrics.Init("rescue_proxy_promreplay"); err != nil {
+		return err
+	}
+
+	tracker := router.NewUsageTracker(logger, router.UsageTrackerOptions{
+		DSN:       usageDSN,
+		Model:     router.UsageModel(usageModel),
+		Precision: usagePrecision,
+	})
+	defer tracker.Close()
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := router.WriteUsageOpenMetrics(w, tracker, namespace, fromTime, toTime); err != nil {
+		return err
+	}
+	logger.Info("Replayed usage",
+		zap.Time("from", fromTime),
+		zap.Time("to", toTime))
+	return nil
+}
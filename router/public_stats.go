@@ -0,0 +1,102 @@
+//go:build ns
+
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// PublicStatsWindow is the usage of the rescue node by every validator over a window.
+type PublicStatsWindow struct {
+	Window     string  `json:"window"`
+	Validators int     `json:"validators"`
+	Hours      float64 `json:"hours"`
+}
+
+// PublicStats are coarse aggregates of the usage of the rescue node, for the project's
+// status page. They disclose no validator, operator or credential.
+type PublicStats struct {
+	Windows   []PublicStatsWindow `json:"windows"`
+	UpdatedAt time.Time           `json:"updated_at"`
+}
+
+// PublicStatsCache computes PublicStats at most once per publicUsageMaxAge, so an
+// unauthenticated endpoint can't be used to load the usage database.
+//
+// Validators are counted once per window, which daily aggregates can't tell, so the
+// stats are computed from the usage tracker rather than from OperatorDailyStore.
+type PublicStatsCache struct {
+	mu      sync.Mutex
+	stats   *PublicStats
+	expires time.Time
+
+	wallClock
+}
+
+// Get returns the stats of the windows ending now, or cached ones if they're recent.
+func (cache *PublicStatsCache) Get(tracker UsageTracker) (*PublicStats, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := cache.clock().UTC()
+	if cache.stats != nil && now.Before(cache.expires) {
+		return cache.stats, nil
+	}
+
+	stats, err := NewPublicStats(tracker, now)
+	if err != nil {
+		return nil, err
+	}
+	cache.stats = stats
+	cache.expires = now.Add(publicUsageMaxAge)
+	return stats, nil
+}
+
+// NewPublicStats computes the stats of the windows ending at now.
+func NewPublicStats(tracker UsageTracker, now time.Time) (*PublicStats, error) {
+	now = now.UTC()
+	stats := &PublicStats{
+		Windows:   make([]PublicStatsWindow, 0, len(publicUsageWindows)),
+		UpdatedAt: now,
+	}
+	for _, w := range publicUsageWindows {
+		usage, err := tracker.ViewUsage(now.Add(-w.window), now)
+		if err != nil {
+			return nil, err
+		}
+
+		window := PublicStatsWindow{Window: w.label}
+		for _, d := range usage {
+			if d > 0 {
+				window.Validators++
+				window.Hours += d.Hours()
+			}
+		}
+		stats.Windows = append(stats.Windows, window)
+	}
+	return stats, nil
+}
+
+// servePublicStats returns the PublicStats of the rescue node.
+func (pr *ProxyRouter) servePublicStats(w http.ResponseWriter, r *http.Request) {
+	if pr.ut == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	stats, err := pr.stats.Get(pr.usage())
+	if err != nil {
+		pr.Logger.Error("Failed to get public stats", zap.Error(err))
+		http.Error(w, "failed to get stats", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(publicUsageMaxAge.Seconds())))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	pr.writeUsageJSON(w, r, stats)
+}
@@ -0,0 +1,63 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPublicStats(t *testing.T) {
+	pr, cleanup := setupPublicUsageTest(t)
+	defer cleanup()
+
+	sqlite := pr.ut.(*SQLiteUsageTracker)
+	now := sqlite.now()
+	pr.stats.now = func() time.Time { return now }
+	public := pr.PublicHandler()
+
+	get := func() PublicStats {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		public.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		var stats PublicStats
+		if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+		return stats
+	}
+
+	// Every validator counts, whether it's attributed to an operator or not
+	stats := get()
+	expected := []PublicStatsWindow{
+		{Window: "24h", Validators: 2, Hours: 1.0 / 6},
+		{Window: "7d", Validators: 2, Hours: 1.0 / 6},
+		{Window: "30d", Validators: 4, Hours: 1.0 / 3},
+	}
+	if len(stats.Windows) != len(expected) {
+		t.Fatalf("Unexpected windows %+v", stats.Windows)
+	}
+	for i, w := range expected {
+		if stats.Windows[i] != w {
+			t.Fatalf("Expected %+v, got %+v", w, stats.Windows[i])
+		}
+	}
+
+	// Stats are cached
+	if err := pr.ut.RecordUsage([]string{"5"}); err != nil {
+		t.Fatal(err)
+	}
+	if stats := get(); stats.Windows[0].Validators != 2 {
+		t.Fatalf("Expected cached stats, got %+v", stats.Windows[0])
+	}
+	now = now.Add(publicUsageMaxAge)
+	if stats := get(); stats.Windows[0].Validators != 3 || !stats.UpdatedAt.Equal(now) {
+		t.Fatalf("Expected refreshed stats, got %+v", stats)
+	}
+}
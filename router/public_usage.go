@@ -0,0 +1,312 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ErrNotPublic is returned when opting out a node address which didn't opt in.
+var ErrNotPublic = errors.New("node address didn't opt in to public usage")
+
+// Windows of the public usage of an operator, and how they're labelled
+var publicUsageWindows = []struct {
+	label  string
+	window time.Duration
+}{
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+	{"30d", 30 * 24 * time.Hour},
+}
+
+// How long clients may cache public usage
+const publicUsageMaxAge = 5 * time.Minute
+
+// PublicUsageWindow is the aggregate usage of an operator's validators over a window.
+type PublicUsageWindow struct {
+	Window     string  `json:"window"`
+	Validators int     `json:"validators"`
+	Seconds    float64 `json:"seconds"`
+}
+
+// PublicUsage is what an operator who opted in publishes about its usage of the rescue
+// node. It's aggregated over every validator attributed to the operator, so no validator
+// index or pubkey is disclosed.
+type PublicUsage struct {
+	NodeAddress common.Address      `json:"node_address"`
+	Windows     []PublicUsageWindow `json:"windows"`
+	UpdatedAt   time.Time           `json:"updated_at"`
+}
+
+// PublicUsageBadge is a shields.io endpoint badge, see https://shields.io/badges/endpoint-badge
+type PublicUsageBadge struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+	CacheSeconds  int    `json:"cacheSeconds"`
+}
+
+// PublicUsageStore keeps which node addresses opted in to publishing their usage.
+type PublicUsageStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewPublicUsageStore creates the opt-in table in db if needed.
+func NewPublicUsageStore(logger *zap.Logger, db *sql.DB) (*PublicUsageStore, error) {
+	store := &PublicUsageStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *PublicUsageStore) initSchema() error {
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS public_usage (
+		node_address TEXT PRIMARY KEY,
+		opted_in_at INTEGER NOT NULL
+	);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// OptIn publishes the usage of a node address. Opting in again has no effect.
+func (store *PublicUsageStore) OptIn(node common.Address) error {
+	_, err := store.Database.Exec(`
+	INSERT OR IGNORE INTO public_usage (node_address, opted_in_at) VALUES (?, ?)
+	`, node.Hex(), store.clock().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to opt in: %w", err)
+	}
+	return nil
+}
+
+// OptOut stops publishing the usage of a node address, or returns ErrNotPublic.
+func (store *PublicUsageStore) OptOut(node common.Address) error {
+	res, err := store.Database.Exec("DELETE FROM public_usage WHERE node_address = ?", node.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to opt out: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotPublic
+	}
+	return nil
+}
+
+// IsPublic returns whether a node address opted in.
+func (store *PublicUsageStore) IsPublic(node common.Address) (bool, error) {
+	var n int
+	err := store.Database.QueryRow("SELECT COUNT(*) FROM public_usage WHERE node_address = ?", node.Hex()).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// PublicUsageCache keeps the usage of every validator over each public usage window for
+// publicUsageMaxAge, so reports of operators who opted in are aggregated from memory
+// and an unauthenticated endpoint can't be used to load the usage database.
+type PublicUsageCache struct {
+	mu      sync.Mutex
+	windows []map[string]time.Duration
+	updated time.Time
+	expires time.Time
+
+	wallClock
+}
+
+// Get returns the usage of every validator over each of publicUsageWindows and when
+// the windows end, or cached usage if it's recent.
+func (cache *PublicUsageCache) Get(tracker UsageTracker) ([]map[string]time.Duration, time.Time, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	now := cache.clock().UTC()
+	if cache.windows != nil && now.Before(cache.expires) {
+		return cache.windows, cache.updated, nil
+	}
+
+	windows := make([]map[string]time.Duration, 0, len(publicUsageWindows))
+	for _, w := range publicUsageWindows {
+		usage, err := tracker.ViewUsage(now.Add(-w.window), now)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		windows = append(windows, usage)
+	}
+	cache.windows = windows
+	cache.updated = now
+	cache.expires = now.Add(publicUsageMaxAge)
+	return windows, now, nil
+}
+
+// Report aggregates the usage of the validators attributed to node over each window,
+// from the usage of every validator in cache.
+func (store *PublicUsageStore) Report(cache *PublicUsageCache, tracker UsageTracker, attr *AttributionStore, node common.Address) (*PublicUsage, error) {
+	attributions, err := attr.Validators(node)
+	if err != nil {
+		return nil, err
+	}
+	windows, updated, err := cache.Get(tracker)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &PublicUsage{
+		NodeAddress: node,
+		Windows:     make([]PublicUsageWindow, 0, len(publicUsageWindows)),
+		UpdatedAt:   updated,
+	}
+	for i, w := range publicUsageWindows {
+		window := PublicUsageWindow{Window: w.label}
+		for _, attribution := range attributions {
+			if d, ok := windows[i][attribution.Validator]; ok && d > 0 {
+				window.Validators++
+				window.Seconds += d.Seconds()
+			}
+		}
+		out.Windows = append(out.Windows, window)
+	}
+
+	return out, nil
+}
+
+// Badge summarizes the usage of the last window.
+func (u *PublicUsage) Badge() *PublicUsageBadge {
+	out := &PublicUsageBadge{
+		SchemaVersion: 1,
+		Label:         "rescue node",
+		Color:         "blue",
+		CacheSeconds:  int(publicUsageMaxAge.Seconds()),
+	}
+	if len(u.Windows) == 0 {
+		out.Message = "unused"
+		return out
+	}
+
+	last := u.Windows[len(u.Windows)-1]
+	if last.Seconds == 0 {
+		out.Message = fmt.Sprintf("unused in %s", last.Window)
+		return out
+	}
+	out.Message = fmt.Sprintf("%.1fh in %s", last.Seconds/3600, last.Window)
+	return out
+}
+
+// PublicHandler serves the usage and credential expiry calendars of operators who
+// opted in, and aggregate stats of the rescue node. It's unauthenticated and may be
+// exposed publicly, e.g. for status pages.
+func (pr *ProxyRouter) PublicHandler() http.Handler {
+	router := mux.NewRouter()
+
+	router.Path("/stats").Methods(http.MethodGet).HandlerFunc(pr.servePublicStats)
+
+	router.Path("/operators/{node:0x[0-9a-fA-F]{40}}/usage").Methods(http.MethodGet).HandlerFunc(pr.servePublicUsage)
+	router.Path("/operators/{node:0x[0-9a-fA-F]{40}}/badge").Methods(http.MethodGet).Name("badge").HandlerFunc(pr.servePublicUsage)
+	router.Path("/operators/{node:0x[0-9a-fA-F]{40}}/calendar.ics").Methods(http.MethodGet).HandlerFunc(pr.serveCredentialCalendar)
+
+	return router
+}
+
+// servePublicUsage returns the PublicUsage of an operator, or its badge. Operators
+// who didn't opt in are indistinguishable from unknown ones.
+func (pr *ProxyRouter) servePublicUsage(w http.ResponseWriter, r *http.Request) {
+	if pr.public == nil || pr.attr == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	node := common.HexToAddress(mux.Vars(r)["node"])
+	public, err := pr.public.IsPublic(node)
+	if err != nil {
+		pr.Logger.Error("Failed to check public usage opt-in", zap.Error(err))
+		http.Error(w, "failed to get usage", http.StatusInternalServerError)
+		return
+	}
+	if !public {
+		http.NotFound(w, r)
+		return
+	}
+
+	usage, err := pr.public.Report(&pr.publicUsage, pr.usage(), pr.attr, node)
+	if err != nil {
+		pr.Logger.Error("Failed to get public usage", zap.Error(err))
+		http.Error(w, "failed to get usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(publicUsageMaxAge.Seconds())))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if mux.CurrentRoute(r).GetName() == "badge" {
+		pr.writeUsageJSON(w, r, usage.Badge())
+		return
+	}
+	pr.writeUsageJSON(w, r, usage)
+}
+
+func (pr *ProxyRouter) publicUsageStore(w http.ResponseWriter) (*PublicUsageStore, bool) {
+	if pr.public == nil {
+		http.Error(w, "public usage requires a SQL usage tracker and validator attribution", http.StatusNotImplemented)
+		return nil, false
+	}
+	return pr.public, true
+}
+
+func (pr *ProxyRouter) servePutPublicUsage(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.publicUsageStore(w)
+	if !ok {
+		return
+	}
+
+	if err := store.OptIn(common.HexToAddress(mux.Vars(r)["node"])); err != nil {
+		pr.Logger.Error("Failed to opt in to public usage", zap.Error(err))
+		http.Error(w, "failed to opt in to public usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (pr *ProxyRouter) serveDeletePublicUsage(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.publicUsageStore(w)
+	if !ok {
+		return
+	}
+
+	err := store.OptOut(common.HexToAddress(mux.Vars(r)["node"]))
+	if errors.Is(err, ErrNotPublic) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		pr.Logger.Error("Failed to opt out of public usage", zap.Error(err))
+		http.Error(w, "failed to opt out of public usage", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
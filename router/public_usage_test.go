@@ -0,0 +1,171 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupPublicUsageTest(t *testing.T) (*ProxyRouter, func()) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite := tracker.(*SQLiteUsageTracker)
+	logger := zaptest.NewLogger(t)
+
+	now := time.Date(2025, 1, 31, 12, 0, 0, 0, time.UTC)
+	sqlite.now = func() time.Time { return now }
+	attr, _ := setupAttributionTestDatabase(t, sqlite.primaryDatabase())
+	attr.now = sqlite.now
+	public, err := NewPublicUsageStore(logger, sqlite.primaryDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	public.now = sqlite.now
+
+	pr := &ProxyRouter{Logger: logger, ut: tracker, attr: attr, public: public}
+	pr.publicUsage.now = public.now
+
+	// Node 1 used validator 3 ten days ago, and validators 1 and 2 just now
+	sqlite.now = func() time.Time { return now.Add(-10 * 24 * time.Hour) }
+	if err := tracker.RecordUsage([]string{"3", "4"}); err != nil {
+		t.Fatal(err)
+	}
+	sqlite.now = func() time.Time { return now }
+	if err := tracker.RecordUsage([]string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := attr.Attribute(common.Address{1}, []string{"1", "2", "3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	return pr, cleanup
+}
+
+func TestPublicUsage(t *testing.T) {
+	pr, cleanup := setupPublicUsageTest(t)
+	defer cleanup()
+
+	public := pr.PublicHandler()
+	admin := pr.AdminHandler()
+	path := "/operators/0x0100000000000000000000000000000000000000"
+
+	// Hidden until the operator opts in
+	rec := httptest.NewRecorder()
+	public.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"/usage", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, path+"/public", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	public.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"/usage", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), `"1"`) || strings.Contains(rec.Body.String(), "validator_index") {
+		t.Fatalf("Expected no validators to be disclosed, got %s", rec.Body.String())
+	}
+	var usage PublicUsage
+	if err := json.NewDecoder(rec.Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []PublicUsageWindow{
+		{Window: "24h", Validators: 2, Seconds: 600},
+		{Window: "7d", Validators: 2, Seconds: 600},
+		{Window: "30d", Validators: 3, Seconds: 900},
+	}
+	if len(usage.Windows) != len(expected) {
+		t.Fatalf("Expected %d windows, got %+v", len(expected), usage.Windows)
+	}
+	for i, window := range expected {
+		if usage.Windows[i] != window {
+			t.Fatalf("Expected %+v, got %+v", window, usage.Windows[i])
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	public.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"/badge", nil))
+	var badge PublicUsageBadge
+	if err := json.NewDecoder(rec.Body).Decode(&badge); err != nil {
+		t.Fatal(err)
+	}
+	if badge.SchemaVersion != 1 || badge.Message != "0.2h in 30d" {
+		t.Fatalf("Unexpected badge %+v", badge)
+	}
+
+	// Opting out hides the usage again
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, path+"/public", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, path+"/public", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	public.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"/badge", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestPublicUsageBadge(t *testing.T) {
+	usage := &PublicUsage{Windows: []PublicUsageWindow{{Window: "30d"}}}
+	if badge := usage.Badge(); badge.Message != "unused in 30d" {
+		t.Fatalf("Unexpected badge %+v", badge)
+	}
+
+	usage.Windows[0].Seconds = 5400
+	if badge := usage.Badge(); badge.Message != "1.5h in 30d" {
+		t.Fatalf("Unexpected badge %+v", badge)
+	}
+}
+
+func TestPublicUsageCache(t *testing.T) {
+	pr, cleanup := setupPublicUsageTest(t)
+	defer cleanup()
+	node := common.Address{1}
+
+	now := pr.publicUsage.clock()
+	report, err := pr.public.Report(&pr.publicUsage, pr.ut, pr.attr, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Windows[0].Validators != 2 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	// Usage recorded since isn't read until the cache expires
+	if err := pr.attr.Attribute(node, []string{"4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.ut.RecordUsage([]string{"4"}); err != nil {
+		t.Fatal(err)
+	}
+	pr.publicUsage.now = func() time.Time { return now.Add(publicUsageMaxAge - time.Second) }
+	if report, err := pr.public.Report(&pr.publicUsage, pr.ut, pr.attr, node); err != nil || report.Windows[0].Validators != 2 || !report.UpdatedAt.Equal(now) {
+		t.Fatalf("Expected the cached usage, got %+v: %v", report, err)
+	}
+	pr.publicUsage.now = func() time.Time { return now.Add(publicUsageMaxAge) }
+	if report, err := pr.public.Report(&pr.publicUsage, pr.ut, pr.attr, node); err != nil || report.Windows[0].Validators != 3 {
+		t.Fatalf("Expected the usage to be read again, got %+v: %v", report, err)
+	}
+}
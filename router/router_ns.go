@@ -5,10 +5,12 @@ package router
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -38,12 +40,147 @@ type ProxyRouter struct {
 	CredentialSecrets    config.CredentialSecrets
 	EnableSoloValidators bool
 	ExpectedFeeRecipient string
+	UsageTrackerOptions  UsageTrackerOptions
+	// Period of the usage commitments to publish. 0 disables publishing.
+	UsageCommitmentPeriod time.Duration
+	// Optional webhook usage commitments are posted to
+	UsageCommitmentWebhook string
+	// Key signing exports produced by the admin API. Signed exports are disabled when nil.
+	ReportSigningKey *ecdsa.PrivateKey
+	// How long usage is kept. 0 keeps it forever.
+	UsageRetention time.Duration
+	// Restricts what is stored about validators and operators when set
+	DataMinimization *DataMinimization
+	// Evaluates which duties of rescue-active validators were covered by the rescue node.
+	// Requires a bucketed usage model and a CL which provides duties.
+	DutyCoverage bool
+	// Optional webhook missed proposals of rescue-active validators are posted to.
+	// They're logged regardless when DutyCoverage is set.
+	MissedProposalWebhook string
+	// Thresholds at which requests are shed by priority. Shedding is disabled when none are set.
+	LoadThresholds LoadThresholds
+	// Optional file every usage event is appended to. Disabled when Path is empty.
+	UsageEventLog UsageEventLogOptions
+	// Optional InfluxDB usage events are written to as points. Disabled when URL is empty.
+	UsageInflux InfluxOptions
+	// Optional rules recording the usage of requests besides prepare_beacon_proposer
+	RecordingRules *RecordingRules
+	// Optional backend usage is also recorded to and verified against, see ShadowUsageTracker
+	UsageShadow UsageShadowOptions
+	// Optional stages enabling the write queue and the shadow backend for some operators
+	// only. Features without a stage are enabled for everyone.
+	Rollout *Rollout
+	// Objectives the tracker's reliability is reported against, see SLOMonitor
+	UsageSLO SLOObjectives
+	// How often the owners of recently active validators are snapshotted. 0 disables it.
+	// Requires a bucketed usage model and is unavailable in data minimization mode.
+	OwnershipSnapshotInterval time.Duration
+	// How often the owners of every tracked validator are re-resolved. 0 disables it.
+	// Requires OwnershipSnapshotInterval.
+	OwnershipRefreshInterval time.Duration
+	// Optional URL ownership changes are POSTed to, see OwnershipChange
+	OwnershipWebhook string
+	// How long deletions of the admin API are staged before they're applied, so they
+	// can be cancelled. 0 applies them immediately.
+	AdminUndoWindow time.Duration
+	// Time zone days are bounded in by daily usage reports, unless a request picks
+	// another. Usage is stored in UTC regardless. Defaults to UTC.
+	ReportTimeZone *time.Location
+	// How often the beacon chain metadata of recently active validators is refreshed.
+	// 0 disables it. Unavailable in data minimization mode.
+	ValidatorMetadataInterval time.Duration
+	// How much recent usage caches are warmed up from before traffic is accepted, so
+	// they aren't cold after a restart. 0 disables it.
+	WarmUpWindow time.Duration
+	// How often the daily usage of operators is aggregated. 0 disables it. Requires a
+	// bucketed usage model and is unavailable in data minimization mode.
+	OperatorDailyInterval time.Duration
+	// Usage records admin queries may be estimated to scan before they're refused unless
+	// forced. 0 disables the limit. Requires a bucketed usage model.
+	AdminQueryCostLimit int64
+	// How long responses of mutating admin requests made with an Idempotency-Key are
+	// kept to be replayed on retries. 0 disables idempotency keys.
+	AdminIdempotencyWindow time.Duration
+	// Fraction of validators whose every request is recorded in detail, in [0, 1]. 0
+	// disables deep tracking. Requires a SQL usage tracker and is unavailable in data
+	// minimization mode.
+	DeepTrackingRate float64
+	// Circuit breaker in front of admin API reads, see ReadBreaker
+	AdminReadBreaker ReadBreakerOptions
+	// Optional external policy deciding whether requests are served, see PolicyWebhook
+	Policy PolicyWebhookOptions
+	// Size of the queue usage is written through, so requests never wait on the
+	// database, see UsageWriteQueue. 0 writes usage synchronously. Unavailable with
+	// multi-tenant usage.
+	UsageWriteQueue int
+	// Bounds the in-process caches, see MemoryBudget. Optional.
+	MemoryBudget *MemoryBudget
 
-	gbp  *gbp.GuardedBeaconProxy
-	m    *metrics.MetricsRegistry
-	gm   *metrics.MetricsRegistry
-	auth *auth
-	ut   UsageTracker
+	gbp    *gbp.GuardedBeaconProxy
+	m      *metrics.MetricsRegistry
+	gm     *metrics.MetricsRegistry
+	auth   *auth
+	ut     UsageTracker
+	prefs  *PreferencesStore
+	attr   *AttributionStore
+	alias  *AliasStore
+	orgs   *OrganizationStore
+	duty   *DutyCoverageStore
+	tiers  *TierStore
+	owners *OwnershipStore
+	load   *LoadMonitor
+	// Tracks whether usage tracking is degraded
+	health *TrackingModeMonitor
+	// Measures the tracker's reliability against UsageSLO
+	slo *SLOMonitor
+	// Receive every recorded usage event
+	events []UsageEventSink
+	// Pairs ut with the shadow backend, when one is configured
+	shadow *ShadowUsageTracker
+	// Writes usage in the background when UsageWriteQueue is set
+	writes *UsageWriteQueue
+	// Metrics of the caches bounded by MemoryBudget, one registry per cache
+	memory []*metrics.MetricsRegistry
+	// Stages admin deletions when AdminUndoWindow is set
+	pending *PendingDeletionStore
+	// Operators who opted in to publishing their usage, see PublicHandler
+	public *PublicUsageStore
+	// Audit trail of operator offboardings
+	offboardings *OffboardingAuditStore
+	// Checks requests against Policy, when configured
+	policy *PolicyWebhook
+	// Aggregates served on the public endpoint
+	stats PublicStatsCache
+	// Usage of every validator, which public operator usage is aggregated from
+	publicUsage PublicUsageCache
+	// Latest credential of each operator, for expiry calendars
+	credentials *CredentialStore
+	// Beacon chain metadata of validators, for reports
+	metadata *ValidatorMetadataStore
+	// Precomputed daily usage of operators
+	operatorDaily *OperatorDailyStore
+	// Refuses expensive admin queries
+	cost *QueryCostEstimator
+	// Responses of admin requests made with idempotency keys
+	idempotency *IdempotencyStore
+	// API keys of the tenant API, see TenantHandler
+	tenantKeys *TenantKeyStore
+	// Credentials of the backfill command, see GuardedBackfiller
+	backfillKeys *BackfillKeyStore
+	// Requests of the deep-tracking sample
+	deep *DeepTrackingStore
+	// Admin API queries run on a schedule
+	reports *SavedReportStore
+	// Declared incidents, whose usage is tagged in reports
+	incidents *IncidentStore
+	// Refuses admin reads while the database is failing
+	breaker *ReadBreaker
+	// Nodes outside every organization whose unrecorded usage was logged, in
+	// multi-tenant mode
+	untenanted untenantedNodes
+
+	// Cancels background jobs on Stop
+	cancel context.CancelFunc
 }
 
 type authInfo struct {
@@ -57,6 +194,7 @@ type prContextKey string
 
 const prContextOperatorTypeKey = prContextKey("operator_type")
 const prContextNodeAddrKey = prContextKey("node")
+const prContextPriorityKey = prContextKey("priority")
 
 func (pr *ProxyRouter) logCredentialSharing(authInfo authInfo,
 	rpInfo *executionlayer.RPInfo,
@@ -192,15 +330,76 @@ func (pr *ProxyRouter) prepareBeaconProposerGuard(proposers gbp.PrepareBeaconPro
 	}
 
 	// Every check passed, record usage
-	recordErr := pr.ut.RecordUsage(indices)
-	if recordErr != nil {
-		pr.Logger.Error("Error while recording validator usage", zap.Error(recordErr))
-	}
+	pr.recordUsage(authInfo, prepareBeaconProposerKind, indices)
+	pr.sampleRequest(ctx, prepareBeaconProposerKind, http.MethodPost, "/eth/v1/validator/prepare_beacon_proposer", indices)
 
 	// At this point all the fee recipients match our expectations. Proxy the request
 	return gbp.Allowed, nil
 }
 
+// Usage kind of prepare_beacon_proposer, which is always recorded
+const prepareBeaconProposerKind = "prepare_beacon_proposer"
+
+// recordUsage is the only path usage enters storage through, so data minimization
+// is enforced here.
+func (pr *ProxyRouter) recordUsage(authInfo authInfo, kind string, indices []string) {
+	if pr.load != nil {
+		pr.load.ObserveValidators(indices)
+	}
+
+	if pr.DataMinimization != nil {
+		indices = pr.DataMinimization.pseudonymize(indices)
+	}
+
+	// Staged features are only enabled for some operators, see Rollout
+	if pr.shadow != nil && pr.shadow.staged && pr.Rollout.Enabled(RolloutShadow, authInfo.nodeAddr) {
+		pr.shadow.enroll(indices)
+	}
+	queued := pr.writes != nil && pr.Rollout.Enabled(RolloutWriteQueue, authInfo.nodeAddr)
+
+	var err error
+	start := time.Now()
+	if pr.UsageTrackerOptions.MultiTenant {
+		var recorded bool
+		recorded, err = pr.recordTenantUsage(authInfo.nodeAddr, indices)
+		if err == nil && !recorded {
+			return
+		}
+	} else if queued {
+		// Only drops are reported here, the queue reports its writes itself
+		err = pr.writes.RecordUsage(indices)
+	} else {
+		err = pr.usage().RecordUsage(indices)
+	}
+	if pr.health != nil && (!queued || err != nil) {
+		pr.health.recordWrite(err)
+	}
+	// Queued writes are observed once written, drops right away
+	if pr.slo != nil && (!queued || err != nil) {
+		pr.slo.observeWrite(err, time.Since(start))
+	}
+	if err != nil {
+		pr.Logger.Error("Error while recording validator usage", zap.Error(err))
+		return
+	}
+	pr.emitUsageEvents(authInfo, kind, indices)
+
+	// Operators can change tiers, so the tier is kept as of now
+	if pr.tiers != nil {
+		if err := pr.tiers.Record(credentialTier(authInfo.operatorType), indices); err != nil {
+			pr.Logger.Error("Error while recording credential tier", zap.Error(err))
+		}
+	}
+
+	// Tie the usage back to the node whose credential was used.
+	// Never set in data minimization mode.
+	if pr.attr != nil {
+		if err := pr.attr.Attribute(authInfo.nodeAddr, indices); err != nil {
+			pr.Logger.Error("Error while attributing validator usage", zap.Error(err))
+		}
+	}
+}
+
 func (pr *ProxyRouter) registerValidatorGuard(validators gbp.RegisterValidatorRequest, ctx context.Context) (gbp.AuthenticationStatus, error) {
 	pr.m.Counter("register_validator").Inc()
 
@@ -230,6 +429,11 @@ func (pr *ProxyRouter) registerValidatorGuard(validators gbp.RegisterValidatorRe
 		)
 	}
 
+	// Every check passed, record the usage matched by a recording rule
+	if usage, ok := ctx.Value(prContextRequestUsageKey).(*requestUsage); ok {
+		pr.recordRequestUsage(ctx, usage)
+	}
+
 	// At this point all the fee recipients match our expectations. Proxy the request
 	return gbp.Allowed, nil
 }
@@ -297,11 +501,36 @@ func (pr *ProxyRouter) authenticate(r *http.Request) (gbp.AuthenticationStatus,
 		}
 		pr.m.Counter("auth_ok_solo").Inc()
 	}
+	// Under load, bulk queries are shed first and duty-critical requests never are
+	priority := classifyRequest(r)
+	pr.m.Counter("priority_" + priority.String()).Inc()
+	if pr.load != nil && pr.load.shouldShed(priority) {
+		pr.m.Counter("load_shed_" + priority.String()).Inc()
+		return gbp.TooManyRequests, nil, fmt.Errorf("the rescue node is under heavy load, try again later")
+	}
+	if err := pr.checkPolicy(common.BytesToAddress(ac.Credential.NodeId), ac.Credential.OperatorType, priority); err != nil {
+		pr.m.Counter("policy_denied").Inc()
+		return gbp.TooManyRequests, nil, err
+	}
 	pr.Logger.Debug("Proxying Guarded URI", zap.String("uri", r.RequestURI))
 	// Add the node address to the request context
 	ctx := context.WithValue(r.Context(), prContextNodeAddrKey, ac.Credential.NodeId)
 	// Add the operator type to the request context
 	ctx = context.WithValue(ctx, prContextOperatorTypeKey, ac.Credential.OperatorType)
+	// Add the priority to the request context
+	ctx = context.WithValue(ctx, prContextPriorityKey, priority)
+
+	pr.observeCredential(common.BytesToAddress(ac.Credential.NodeId), ac.Credential.OperatorType, ac.Credential.Timestamp)
+	// Usage is only recorded once the request is accepted, by the guard of guarded paths
+	usage := pr.matchRequestUsage(r, authInfo{
+		nodeAddr:     common.BytesToAddress(ac.Credential.NodeId),
+		operatorType: ac.Credential.OperatorType,
+	})
+	if usage != nil && r.URL.Path == registerValidatorPath {
+		ctx = context.WithValue(ctx, prContextRequestUsageKey, usage)
+	} else if usage != nil {
+		pr.recordRequestUsage(ctx, usage)
+	}
 	return gbp.Allowed, ctx, nil
 }
 
@@ -336,6 +565,9 @@ func (pr *ProxyRouter) grpcAuthenticate(md metadata.MD) (gbp.AuthenticationStatu
 		}
 		pr.gm.Counter("auth_ok_solo").Inc()
 	}
+	// gRPC is only used for validator duties, which the usage policy never throttles
+
+	pr.observeCredential(common.BytesToAddress(ac.Credential.NodeId), ac.Credential.OperatorType, ac.Credential.Timestamp)
 
 	ctx := context.WithValue(context.Background(), prContextNodeAddrKey, ac.Credential.NodeId)
 	ctx = context.WithValue(ctx, prContextOperatorTypeKey, ac.Credential.OperatorType)
@@ -371,7 +603,426 @@ func (pr *ProxyRouter) Init() {
 
 	pr.m = metrics.NewMetricsRegistry("http_proxy")
 	pr.gm = metrics.NewMetricsRegistry("grpc_proxy")
-	pr.ut = NewSQLiteUsageTracker(pr.Logger)
+	if pr.UsageTrackerOptions.Memory == nil {
+		pr.UsageTrackerOptions.Memory = pr.MemoryBudget
+	}
+	pr.ut = StartUsageTracker(pr.Logger, pr.UsageTrackerOptions)
+	pr.initShadow()
+	if tracker, ok := pr.ut.(sqlUsageTracker); ok {
+		slo, err := NewSLOMonitor(pr.Logger, tracker.primaryDatabase(), pr.UsageSLO)
+		if err != nil {
+			pr.Logger.Fatal("Failed to initialize the usage SLO", zap.Error(err))
+		}
+		pr.slo = slo
+	}
+	if pr.UsageWriteQueue > 0 {
+		if pr.UsageTrackerOptions.MultiTenant {
+			pr.Logger.Fatal("The usage write queue is unavailable with multi-tenant usage")
+		}
+		pr.writes = NewUsageWriteQueue(pr.Logger, pr.usage(), pr.UsageTrackerOptions.Precision, pr.UsageWriteQueue)
+		pr.writes.limit.max = pr.MemoryBudget.Entries(MemoryCacheSpool)
+		pr.writes.OnWrite = func(err error) {
+			if pr.health != nil {
+				pr.health.recordWrite(err)
+			}
+		}
+		if pr.slo != nil {
+			pr.writes.observe = pr.slo.observeWrite
+			pr.writes.onSpool = pr.slo.observeSpool
+		}
+	}
+	pr.logRollout()
+
+	// Operator settings live next to the usage data
+	if tracker, ok := pr.ut.(sqlUsageTracker); ok {
+		prefs, err := NewPreferencesStore(pr.Logger, tracker.primaryDatabase())
+		if err != nil {
+			pr.Logger.Fatal("Failed to initialize notification preferences", zap.Error(err))
+		}
+		pr.prefs = prefs
+
+		alias, err := NewAliasStore(pr.Logger, tracker.primaryDatabase())
+		if err != nil {
+			pr.Logger.Fatal("Failed to initialize validator aliases", zap.Error(err))
+		}
+		pr.alias = alias
+
+		orgs, err := NewOrganizationStore(pr.Logger, tracker.primaryDatabase())
+		if err != nil {
+			pr.Logger.Fatal("Failed to initialize organizations", zap.Error(err))
+		}
+		pr.orgs = orgs
+
+		tenantKeys, err := NewTenantKeyStore(pr.Logger, tracker.primaryDatabase())
+		if err != nil {
+			pr.Logger.Fatal("Failed to initialize tenant API keys", zap.Error(err))
+		}
+		pr.tenantKeys = tenantKeys
+
+		backfillKeys, err := NewBackfillKeyStore(pr.Logger, tracker.primaryDatabase())
+		if err != nil {
+			pr.Logger.Fatal("Failed to initialize backfill keys", zap.Error(err))
+		}
+		pr.backfillKeys = backfillKeys
+
+		reports, err := NewSavedReportStore(pr.Logger, tracker.primaryDatabase())
+		if err != nil {
+			pr.Logger.Fatal("Failed to initialize saved reports", zap.Error(err))
+		}
+		pr.reports = reports
+
+		incidents, err := NewIncidentStore(pr.Logger, tracker.primaryDatabase())
+		if err != nil {
+			pr.Logger.Fatal("Failed to initialize incidents", zap.Error(err))
+		}
+		pr.incidents = incidents
+
+		offboardings, err := NewOffboardingAuditStore(pr.Logger, tracker.primaryDatabase())
+		if err != nil {
+			pr.Logger.Fatal("Failed to initialize the offboarding audit", zap.Error(err))
+		}
+		pr.offboardings = offboardings
+
+		if buckets, ok := pr.ut.(usageBuckets); ok {
+			tiers, err := NewTierStore(pr.Logger, tracker.primaryDatabase(), buckets.bucketPrecision())
+			if err != nil {
+				pr.Logger.Fatal("Failed to initialize credential tiers", zap.Error(err))
+			}
+			pr.tiers = tiers
+		}
+
+		if pr.AdminUndoWindow > 0 {
+			pending, err := NewPendingDeletionStore(pr.Logger, tracker.primaryDatabase(), pr.AdminUndoWindow)
+			if err != nil {
+				pr.Logger.Fatal("Failed to initialize pending deletions", zap.Error(err))
+			}
+			pr.pending = pending
+		}
+
+		if pr.AdminIdempotencyWindow > 0 {
+			idempotency, err := NewIdempotencyStore(pr.Logger, tracker.primaryDatabase(), pr.AdminIdempotencyWindow)
+			if err != nil {
+				pr.Logger.Fatal("Failed to initialize idempotency keys", zap.Error(err))
+			}
+			pr.idempotency = idempotency
+		}
+
+		if pr.DataMinimization == nil {
+			attr, err := NewAttributionStore(pr.Logger, tracker.primaryDatabase())
+			if err != nil {
+				pr.Logger.Fatal("Failed to initialize validator attribution", zap.Error(err))
+			}
+			pr.attr = attr
+
+			public, err := NewPublicUsageStore(pr.Logger, tracker.primaryDatabase())
+			if err != nil {
+				pr.Logger.Fatal("Failed to initialize public usage", zap.Error(err))
+			}
+			pr.public = public
+
+			creds, err := NewCredentialStore(pr.Logger, tracker.primaryDatabase())
+			if err != nil {
+				pr.Logger.Fatal("Failed to initialize credentials", zap.Error(err))
+			}
+			pr.credentials = creds
+
+			if pr.DeepTrackingRate > 0 {
+				deep, err := NewDeepTrackingStore(pr.Logger, tracker.primaryDatabase(), pr.DeepTrackingRate)
+				if err != nil {
+					pr.Logger.Fatal("Failed to initialize deep tracking", zap.Error(err))
+				}
+				pr.deep = deep
+			}
+		}
+	}
+
+	if pr.UsageTrackerOptions.MultiTenant {
+		pr.initMultiTenant()
+	}
+
+	if (pr.UsageEventLog.Path != "" || pr.UsageInflux.URL != "") && pr.UsageEventLog.Instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			pr.Logger.Warn("Failed to get the hostname, usage events have no instance", zap.Error(err))
+		}
+		pr.UsageEventLog.Instance = hostname
+	}
+	if pr.UsageEventLog.Path != "" {
+		pr.events = append(pr.events, NewJSONUsageEventSink(&RotatingFile{
+			Path:       pr.UsageEventLog.Path,
+			MaxSize:    pr.UsageEventLog.MaxSize,
+			MaxAge:     pr.UsageEventLog.MaxAge,
+			MaxBackups: pr.UsageEventLog.MaxBackups,
+		}))
+	}
+	if pr.UsageInflux.URL != "" {
+		pr.events = append(pr.events, NewInfluxUsageEventSink(pr.Logger, pr.UsageInflux))
+	}
+
+	var ctx context.Context
+	ctx, pr.cancel = context.WithCancel(context.Background())
+	pr.health = NewTrackingModeMonitor(pr.Logger, pr.ut)
+	go pr.health.Run(ctx)
+	if pr.slo != nil {
+		go pr.slo.Run(ctx)
+	}
+
+	if pr.UsageCommitmentPeriod > 0 {
+		publisher := &UsageCommitmentPublisher{
+			Tracker:    pr.ut,
+			Period:     pr.UsageCommitmentPeriod,
+			WebhookURL: pr.UsageCommitmentWebhook,
+			Logger:     pr.Logger,
+		}
+		go publisher.Run(ctx)
+	}
+
+	if pr.DutyCoverage {
+		pr.initDutyCoverage(ctx)
+	}
+
+	if pr.OwnershipSnapshotInterval > 0 {
+		pr.initOwnership(ctx)
+	}
+
+	if pr.ValidatorMetadataInterval > 0 {
+		pr.initValidatorMetadata(ctx)
+	}
+
+	if pr.OperatorDailyInterval > 0 {
+		pr.initOperatorDaily(ctx)
+	}
+
+	if pr.AdminQueryCostLimit > 0 {
+		if err := requireCapability(pr.ut, "the admin query cost limit", UsageCapabilityRecordCounts); err != nil {
+			pr.Logger.Warn("Not limiting the cost of admin queries", zap.Error(err))
+		} else {
+			pr.cost = &QueryCostEstimator{
+				Tracker: pr.ut.(usageCounter),
+				Limit:   pr.AdminQueryCostLimit,
+				Logger:  pr.Logger,
+			}
+		}
+	}
+
+	if pr.Policy.URL != "" {
+		pr.policy = NewPolicyWebhook(pr.Logger, pr.Policy)
+		pr.policy.context = pr.policyContext
+	}
+
+	if pr.AdminReadBreaker.Failures > 0 {
+		pr.breaker = &ReadBreaker{
+			Options: pr.AdminReadBreaker,
+			Logger:  pr.Logger,
+		}
+		pr.m.GaugeFunc("admin_read_breaker_open", func() float64 {
+			if pr.breaker.Open() {
+				return 1
+			}
+			return 0
+		})
+	}
+
+	if pr.pending != nil {
+		go pr.pending.Run(ctx)
+	}
+
+	if pr.reports != nil {
+		job := &SavedReportJob{
+			Store:   pr.reports,
+			Handler: pr.AdminHandler(),
+			Logger:  pr.Logger,
+		}
+		go job.Run(ctx)
+	}
+
+	if pr.LoadThresholds.Enabled() {
+		pr.load = &LoadMonitor{
+			Thresholds: pr.LoadThresholds,
+			Logger:     pr.Logger,
+		}
+		pr.load.limit.max = pr.MemoryBudget.Entries(MemoryCacheActive)
+		go pr.load.PruneEvery(ctx, loadPruneInterval)
+		pr.m.GaugeFunc("load_level", func() float64 {
+			return float64(pr.load.LoadLevel())
+		})
+		if pr.LoadThresholds.ElevatedLatency > 0 || pr.LoadThresholds.OverloadedLatency > 0 {
+			go pr.load.ProbeUpstream(ctx, pr.BeaconURL, 12*time.Second)
+		}
+	}
+
+	if pr.MemoryBudget != nil {
+		pr.registerMemoryMetrics()
+	}
+
+	if pr.WarmUpWindow > 0 {
+		pr.warmUp(pr.WarmUpWindow)
+	}
+
+	retention := pr.UsageRetention
+	if pr.DataMinimization != nil && retention == 0 {
+		retention = DefaultMinimizedRetention
+	}
+	if retention > 0 {
+		job := &UsageRetentionJob{
+			Retention:     retention,
+			Organizations: pr.orgs,
+			Attribution:   pr.attr,
+			Logger:        pr.Logger,
+		}
+		if pruner, ok := pr.ut.(usagePruner); ok {
+			job.Stores = append(job.Stores, pruner)
+		}
+		if pr.attr != nil {
+			job.Stores = append(job.Stores, pr.attr)
+		}
+		if pr.duty != nil {
+			job.Stores = append(job.Stores, pr.duty)
+		}
+		if pr.tiers != nil {
+			job.Stores = append(job.Stores, pr.tiers)
+		}
+		if pr.owners != nil {
+			job.Stores = append(job.Stores, pr.owners)
+		}
+		if pr.operatorDaily != nil {
+			job.Stores = append(job.Stores, pr.operatorDaily)
+		}
+		if pr.deep != nil {
+			job.Stores = append(job.Stores, pr.deep)
+		}
+		go job.Run(ctx)
+	}
+}
+
+func (pr *ProxyRouter) initDutyCoverage(ctx context.Context) {
+	// Pseudonyms can't be looked up on the beacon chain
+	if pr.DataMinimization != nil {
+		pr.Logger.Warn("Duty coverage is unavailable in data minimization mode")
+		return
+	}
+	tracker, ok := pr.ut.(usageBuckets)
+	if !ok {
+		pr.Logger.Warn("Duty coverage requires -usage-model=buckets or hybrid")
+		return
+	}
+	duties, ok := pr.CL.(consensuslayer.DutiesProvider)
+	if !ok {
+		pr.Logger.Warn("Duty coverage requires a consensus layer which provides duties")
+		return
+	}
+
+	store, err := NewDutyCoverageStore(pr.Logger, pr.ut.(sqlUsageTracker).primaryDatabase())
+	if err != nil {
+		pr.Logger.Fatal("Failed to initialize duty coverage", zap.Error(err))
+	}
+	pr.duty = store
+
+	job := &DutyCoverageJob{
+		Duties:  duties,
+		Tracker: tracker,
+		Store:   store,
+		Logger:  pr.Logger,
+		Alerts: &MissedProposalAlerter{
+			// Leave out the credentials, if any
+			Upstream:   (&url.URL{Scheme: pr.BeaconURL.Scheme, Host: pr.BeaconURL.Host}).String(),
+			WebhookURL: pr.MissedProposalWebhook,
+			Logger:     pr.Logger,
+		},
+	}
+	go job.Run(ctx)
+}
+
+func (pr *ProxyRouter) initOwnership(ctx context.Context) {
+	// Pseudonyms can't be looked up on the beacon chain
+	if pr.DataMinimization != nil {
+		pr.Logger.Warn("Ownership snapshots are unavailable in data minimization mode")
+		return
+	}
+	if _, ok := pr.ut.(usageBuckets); !ok {
+		pr.Logger.Warn("Ownership snapshots require -usage-model=buckets or hybrid")
+		return
+	}
+
+	store, err := NewOwnershipStore(pr.Logger, pr.ut.(sqlUsageTracker).primaryDatabase())
+	if err != nil {
+		pr.Logger.Fatal("Failed to initialize validator ownership", zap.Error(err))
+	}
+	pr.owners = store
+
+	job := &OwnershipSnapshotJob{
+		CL:       pr.CL,
+		EL:       pr.EL,
+		Tracker:  pr.ut,
+		Store:    store,
+		Interval: pr.OwnershipSnapshotInterval,
+		Logger:   pr.Logger,
+
+		RefreshInterval: pr.OwnershipRefreshInterval,
+		WebhookURL:      pr.OwnershipWebhook,
+	}
+	go job.Run(ctx)
+}
+
+func (pr *ProxyRouter) initOperatorDaily(ctx context.Context) {
+	// Node addresses aren't stored in data minimization mode
+	if pr.attr == nil {
+		pr.Logger.Warn("Operator aggregates are unavailable in data minimization mode")
+		return
+	}
+	tracker, ok := pr.ut.(usageBuckets)
+	if !ok {
+		pr.Logger.Warn("Operator aggregates require -usage-model=buckets or hybrid")
+		return
+	}
+
+	store, err := NewOperatorDailyStore(pr.Logger, pr.ut.(sqlUsageTracker).primaryDatabase())
+	if err != nil {
+		pr.Logger.Fatal("Failed to initialize operator aggregates", zap.Error(err))
+	}
+	pr.operatorDaily = store
+
+	job := &OperatorDailyJob{
+		Tracker:     tracker,
+		Attribution: pr.attr,
+		Store:       store,
+		Interval:    pr.OperatorDailyInterval,
+		Logger:      pr.Logger,
+	}
+	go job.Run(ctx)
+}
+
+func (pr *ProxyRouter) initValidatorMetadata(ctx context.Context) {
+	// Pseudonyms can't be looked up on the beacon chain
+	if pr.DataMinimization != nil {
+		pr.Logger.Warn("Validator metadata is unavailable in data minimization mode")
+		return
+	}
+	tracker, ok := pr.ut.(sqlUsageTracker)
+	if !ok {
+		pr.Logger.Warn("Validator metadata requires a SQL usage backend")
+		return
+	}
+	stater, ok := pr.CL.(validatorStater)
+	if !ok {
+		pr.Logger.Warn("Validator metadata requires a consensus layer which can look up validator states")
+		return
+	}
+
+	store, err := NewValidatorMetadataStore(pr.Logger, tracker.primaryDatabase())
+	if err != nil {
+		pr.Logger.Fatal("Failed to initialize validator metadata", zap.Error(err))
+	}
+	pr.metadata = store
+
+	job := &ValidatorMetadataJob{
+		CL:       stater,
+		Tracker:  pr.ut,
+		Store:    store,
+		Interval: pr.ValidatorMetadataInterval,
+		Logger:   pr.Logger,
+	}
+	go job.Run(ctx)
 }
 
 func (pr *ProxyRouter) Start() error {
@@ -390,6 +1041,30 @@ func (pr *ProxyRouter) Serve(httpListener net.Listener, grpcListener net.Listene
 	return pr.gbp.Serve(httpListener, nil)
 }
 
+// Stop shuts the proxy down, writes what's queued and closes the usage trackers.
+// Servers of the admin, public and tenant handlers must be shut down first.
 func (pr *ProxyRouter) Stop(ctx context.Context) {
+	pr.cancel()
 	pr.gbp.Stop(ctx)
+	if pr.writes != nil {
+		pr.writes.Close()
+	}
+	// After the queue drained, so its last writes are included
+	if pr.slo != nil {
+		if err := pr.slo.Flush(); err != nil {
+			pr.Logger.Warn("Failed to flush SLO observations", zap.Error(err))
+		}
+	}
+	for _, m := range pr.memory {
+		m.UnregisterAll()
+	}
+	for _, sink := range pr.events {
+		if err := sink.Close(); err != nil {
+			pr.Logger.Warn("Failed to close usage event sink", zap.Error(err))
+		}
+	}
+	// Last, since every store shares its database. The shadow closes the primary too.
+	if tracker := pr.usage(); tracker != nil {
+		tracker.Close()
+	}
 }
@@ -0,0 +1,506 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNoSavedReport is returned for saved reports which don't exist.
+	ErrNoSavedReport = errors.New("no such saved report")
+	// ErrInvalidSavedReport is returned for saved reports with an invalid definition.
+	ErrInvalidSavedReport = errors.New("invalid saved report")
+)
+
+var savedReportNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Headers of delivered reports
+const (
+	savedReportNameHeader = "X-Report-Name"
+	savedReportFromHeader = "X-Report-From"
+	savedReportToHeader   = "X-Report-To"
+)
+
+// SavedReport is an admin API query run on a schedule, whose result is posted to a
+// webhook, in place of cron jobs calling the admin API.
+//
+// Runs are aligned on multiples of Interval since the unix epoch, and each covers the
+// Range before its run, e.g. an Interval and Range of 24h reports on the previous UTC
+// day every midnight.
+type SavedReport struct {
+	Name string `json:"name"`
+	// GET endpoint of the admin API with its filters and durations format, but without
+	// from and to, e.g. /usage/daily?node=0x...&durations=seconds
+	Query    string `json:"query"`
+	Range    string `json:"range"`
+	Interval string `json:"interval"`
+	// Results are posted here, with the X-Report-Name, X-Report-From and X-Report-To
+	// headers
+	WebhookURL string     `json:"webhook_url"`
+	LastRunAt  *time.Time `json:"last_run_at,omitempty"`
+	// Why the last run failed, empty if it succeeded
+	LastError string    `json:"last_error,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Validate checks the definition of a report, but not whether its query is served.
+func (report *SavedReport) Validate() error {
+	if !savedReportNamePattern.MatchString(report.Name) {
+		return fmt.Errorf("%w name %q, must be lowercase alphanumeric, dashes or underscores", ErrInvalidSavedReport, report.Name)
+	}
+
+	query, err := url.Parse(report.Query)
+	if err != nil || query.Scheme != "" || query.Host != "" || len(query.Path) == 0 || query.Path[0] != '/' {
+		return fmt.Errorf("%w query %q, must be an admin API path", ErrInvalidSavedReport, report.Query)
+	}
+	for _, param := range []string{"from", "to"} {
+		if query.Query().Has(param) {
+			return fmt.Errorf("%w query %q, %s is set on every run", ErrInvalidSavedReport, report.Query, param)
+		}
+	}
+
+	if d, err := time.ParseDuration(report.Range); err != nil || d <= 0 {
+		return fmt.Errorf("%w range %q, must be a positive duration", ErrInvalidSavedReport, report.Range)
+	}
+	if d, err := time.ParseDuration(report.Interval); err != nil || d < time.Minute {
+		return fmt.Errorf("%w interval %q, must be at least 1m", ErrInvalidSavedReport, report.Interval)
+	}
+
+	webhook, err := url.Parse(report.WebhookURL)
+	if err != nil || (webhook.Scheme != "http" && webhook.Scheme != "https") || webhook.Host == "" {
+		return fmt.Errorf("%w webhook url %q", ErrInvalidSavedReport, report.WebhookURL)
+	}
+	return nil
+}
+
+// window returns the range of the last run due at or before now.
+func (report *SavedReport) window(now time.Time) (time.Time, time.Time) {
+	// Validated when the report is stored
+	interval, _ := time.ParseDuration(report.Interval)
+	length, _ := time.ParseDuration(report.Range)
+
+	to := now.Truncate(interval)
+	return to.Add(-length), to
+}
+
+// SavedReportStore keeps the definitions of saved reports and the outcome of their
+// last run.
+type SavedReportStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewSavedReportStore creates the saved report table in db if needed.
+func NewSavedReportStore(logger *zap.Logger, db *sql.DB) (*SavedReportStore, error) {
+	store := &SavedReportStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *SavedReportStore) initSchema() error {
+	// last_run_at and updated_at are unix milliseconds. last_run_at is the end of the
+	// range of the last run.
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS saved_reports (
+		name TEXT PRIMARY KEY,
+		query TEXT NOT NULL,
+		range_length TEXT NOT NULL,
+		run_interval TEXT NOT NULL,
+		webhook_url TEXT NOT NULL,
+		last_run_at INTEGER,
+		last_error TEXT NOT NULL DEFAULT '',
+		updated_at INTEGER NOT NULL
+	);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Put creates or replaces the definition of a report. The outcome of its last run is
+// kept.
+func (store *SavedReportStore) Put(report *SavedReport) error {
+	if err := report.Validate(); err != nil {
+		return err
+	}
+
+	_, err := store.Database.Exec(`
+	INSERT INTO saved_reports (name, query, range_length, run_interval, webhook_url, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (name) DO UPDATE SET
+		query = excluded.query,
+		range_length = excluded.range_length,
+		run_interval = excluded.run_interval,
+		webhook_url = excluded.webhook_url,
+		updated_at = excluded.updated_at
+	`, report.Name, report.Query, report.Range, report.Interval, report.WebhookURL, store.clock().UnixMilli())
+	if err != nil {
+		return fmt.Errorf("failed to store saved report: %w", err)
+	}
+	return nil
+}
+
+type savedReportScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSavedReport(row savedReportScanner) (*SavedReport, error) {
+	report := &SavedReport{}
+	var lastRunAt sql.NullInt64
+	var updatedAt int64
+	err := row.Scan(&report.Name, &report.Query, &report.Range, &report.Interval, &report.WebhookURL, &lastRunAt, &report.LastError, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if lastRunAt.Valid {
+		t := time.UnixMilli(lastRunAt.Int64).UTC()
+		report.LastRunAt = &t
+	}
+	report.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+	return report, nil
+}
+
+const savedReportColumns = "name, query, range_length, run_interval, webhook_url, last_run_at, last_error, updated_at"
+
+// Get returns a saved report.
+func (store *SavedReportStore) Get(name string) (*SavedReport, error) {
+	report, err := scanSavedReport(store.Database.QueryRow("SELECT "+savedReportColumns+" FROM saved_reports WHERE name = ?", name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoSavedReport
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query saved report: %w", err)
+	}
+	return report, nil
+}
+
+// List returns every saved report, ordered by name.
+func (store *SavedReportStore) List() ([]*SavedReport, error) {
+	rows, err := store.Database.Query("SELECT " + savedReportColumns + " FROM saved_reports ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query saved reports: %w", err)
+	}
+	defer rows.Close()
+
+	out := []*SavedReport{}
+	for rows.Next() {
+		report, err := scanSavedReport(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan saved report: %w", err)
+		}
+		out = append(out, report)
+	}
+	return out, rows.Err()
+}
+
+// Delete removes a saved report.
+func (store *SavedReportStore) Delete(name string) error {
+	res, err := store.Database.Exec("DELETE FROM saved_reports WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete saved report: %w", err)
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNoSavedReport
+	}
+	return nil
+}
+
+// markRun records the outcome of the run of a report whose range ended at to.
+func (store *SavedReportStore) markRun(name string, to time.Time, runErr error) error {
+	lastError := ""
+	if runErr != nil {
+		lastError = runErr.Error()
+	}
+	_, err := store.Database.Exec("UPDATE saved_reports SET last_run_at = ?, last_error = ? WHERE name = ?", to.UnixMilli(), lastError, name)
+	if err != nil {
+		return fmt.Errorf("failed to update saved report: %w", err)
+	}
+	return nil
+}
+
+// savedReportRecorder keeps the response of a query run by SavedReportJob.
+type savedReportRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *savedReportRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *savedReportRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *savedReportRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+// SavedReportJob runs the saved reports which are due and posts their results.
+//
+// A run which fails isn't retried, the next one covers the following range. Runs
+// missed while the proxy was down are skipped, only the latest one due is made.
+type SavedReportJob struct {
+	Store *SavedReportStore
+	// Serves the queries, the admin API
+	Handler http.Handler
+	// How often reports are checked for being due, defaults to a minute
+	Interval time.Duration
+	Logger   *zap.Logger
+	Client   *http.Client
+
+	wallClock
+}
+
+// RunDue runs the reports whose next run is due and returns how many were run.
+func (job *SavedReportJob) RunDue(ctx context.Context) (int, error) {
+	reports, err := job.Store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	now := job.clock()
+	runs := 0
+	for _, report := range reports {
+		from, to := report.window(now)
+		if report.LastRunAt != nil && !report.LastRunAt.Before(to) {
+			continue
+		}
+
+		runErr := job.run(ctx, report, from, to)
+		if runErr != nil {
+			job.Logger.Warn("Saved report failed", zap.String("report", report.Name), zap.Error(runErr))
+		} else {
+			job.Logger.Info("Delivered saved report",
+				zap.String("report", report.Name),
+				zap.Time("from", from),
+				zap.Time("to", to))
+		}
+		if err := job.Store.markRun(report.Name, to, runErr); err != nil {
+			return runs, err
+		}
+		runs++
+	}
+	return runs, nil
+}
+
+// run queries a report over [from, to] and posts the result to its webhook.
+func (job *SavedReportJob) run(ctx context.Context, report *SavedReport, from time.Time, to time.Time) error {
+	// Validated when the report is stored
+	target, _ := url.Parse(report.Query)
+	query := target.Query()
+	query.Set("from", from.UTC().Format(time.RFC3339))
+	query.Set("to", to.UTC().Format(time.RFC3339))
+	target.RawQuery = query.Encode()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	r.RequestURI = target.RequestURI()
+	rec := &savedReportRecorder{header: make(http.Header)}
+	job.Handler.ServeHTTP(rec, r)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status != http.StatusOK {
+		return fmt.Errorf("query returned %d: %s", rec.status, bytes.TrimSpace(rec.body.Bytes()))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, report.WebhookURL, &rec.body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", rec.header.Get("Content-Type"))
+	req.Header.Set(savedReportNameHeader, report.Name)
+	req.Header.Set(savedReportFromHeader, from.UTC().Format(time.RFC3339))
+	req.Header.Set(savedReportToHeader, to.UTC().Format(time.RFC3339))
+
+	client := job.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("saved report webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Run runs due reports every Interval until ctx is done.
+func (job *SavedReportJob) Run(ctx context.Context) {
+	interval := job.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := job.RunDue(ctx); err != nil {
+			job.Logger.Warn("Failed to run saved reports", zap.Error(err))
+		}
+	}
+}
+
+func (pr *ProxyRouter) savedReportStore(w http.ResponseWriter) (*SavedReportStore, bool) {
+	if pr.reports == nil {
+		http.Error(w, "saved reports require a SQL usage tracker", http.StatusNotImplemented)
+		return nil, false
+	}
+	return pr.reports, true
+}
+
+func (pr *ProxyRouter) writeSavedReportError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidSavedReport):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNoSavedReport):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		pr.Logger.Error("Failed to access saved reports", zap.Error(err))
+		http.Error(w, "failed to access saved reports", http.StatusInternalServerError)
+	}
+}
+
+func (pr *ProxyRouter) serveListSavedReports(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.savedReportStore(w)
+	if !ok {
+		return
+	}
+
+	reports, err := store.List()
+	if err != nil {
+		pr.writeSavedReportError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, reports)
+}
+
+func (pr *ProxyRouter) serveGetSavedReport(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.savedReportStore(w)
+	if !ok {
+		return
+	}
+
+	report, err := store.Get(mux.Vars(r)["name"])
+	if err != nil {
+		pr.writeSavedReportError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
+
+// servePutSavedReport creates or replaces the saved report in the path. Its query
+// must be a GET endpoint of the admin API.
+func (pr *ProxyRouter) servePutSavedReport(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.savedReportStore(w)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Query      string `json:"query"`
+		Range      string `json:"range"`
+		Interval   string `json:"interval"`
+		WebhookURL string `json:"webhook_url"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid saved report: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	report := &SavedReport{
+		Name:       mux.Vars(r)["name"],
+		Query:      body.Query,
+		Range:      body.Range,
+		Interval:   body.Interval,
+		WebhookURL: body.WebhookURL,
+	}
+	if err := report.Validate(); err != nil {
+		pr.writeSavedReportError(w, err)
+		return
+	}
+	query, err := http.NewRequest(http.MethodGet, report.Query, nil)
+	if err != nil {
+		pr.writeSavedReportError(w, fmt.Errorf("%w query %q: %v", ErrInvalidSavedReport, report.Query, err))
+		return
+	}
+	var match mux.RouteMatch
+	if !pr.AdminHandler().(*mux.Router).Match(query, &match) || match.MatchErr != nil {
+		pr.writeSavedReportError(w, fmt.Errorf("%w query %q, not a GET endpoint of the admin API", ErrInvalidSavedReport, report.Query))
+		return
+	}
+
+	if err := store.Put(report); err != nil {
+		pr.writeSavedReportError(w, err)
+		return
+	}
+	report, err = store.Get(report.Name)
+	if err != nil {
+		pr.writeSavedReportError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
+
+func (pr *ProxyRouter) serveDeleteSavedReport(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.savedReportStore(w)
+	if !ok {
+		return
+	}
+
+	if err := store.Delete(mux.Vars(r)["name"]); err != nil {
+		pr.writeSavedReportError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,122 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSavedReports(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	var err error
+	if pr.reports, err = NewSavedReportStore(zaptest.NewLogger(t), pr.orgs.Database); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.ut.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := pr.AdminHandler()
+
+	type delivery struct {
+		header http.Header
+		body   string
+	}
+	deliveries := make(chan delivery, 1)
+	status := http.StatusOK
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{header: r.Header, body: string(body)}
+		w.WriteHeader(status)
+	}))
+	defer webhook.Close()
+
+	put := func(name string, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/reports/"+name, strings.NewReader(body)))
+		return rec
+	}
+	for _, body := range []string{
+		`{"query": "/nowhere", "range": "1h", "interval": "1h", "webhook_url": "` + webhook.URL + `"}`,
+		`{"query": "/usage?from=2025-01-01T00:00:00Z", "range": "1h", "interval": "1h", "webhook_url": "` + webhook.URL + `"}`,
+		`{"query": "/usage", "range": "0s", "interval": "1h", "webhook_url": "` + webhook.URL + `"}`,
+		`{"query": "/usage", "range": "1h", "interval": "1s", "webhook_url": "` + webhook.URL + `"}`,
+		`{"query": "/usage", "range": "1h", "interval": "1h", "webhook_url": "ftp://example.com"}`,
+	} {
+		if rec := put("hourly", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %d for %s, got %d", http.StatusBadRequest, body, rec.Code)
+		}
+	}
+	rec := put("hourly", `{"query": "/usage?durations=seconds", "range": "2h", "interval": "1h", "webhook_url": "`+webhook.URL+`"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	now := time.Now().Truncate(time.Hour).Add(90 * time.Minute)
+	job := &SavedReportJob{
+		Store:     pr.reports,
+		Handler:   handler,
+		Logger:    zaptest.NewLogger(t),
+		wallClock: wallClock{now: func() time.Time { return now }},
+	}
+	if runs, err := job.RunDue(context.Background()); err != nil || runs != 1 {
+		t.Fatalf("Expected 1 run, got %d: %v", runs, err)
+	}
+	d := <-deliveries
+	to := now.Truncate(time.Hour)
+	if d.header.Get(savedReportNameHeader) != "hourly" || d.header.Get(savedReportToHeader) != to.UTC().Format(time.RFC3339) ||
+		d.header.Get(savedReportFromHeader) != to.Add(-2*time.Hour).UTC().Format(time.RFC3339) {
+		t.Fatalf("Unexpected headers %v", d.header)
+	}
+	var usage map[string]float64
+	if err := json.Unmarshal([]byte(d.body), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] != 300 {
+		t.Fatalf("Expected the usage of validator 1 in seconds, got %s", d.body)
+	}
+
+	// Runs aren't repeated until the next interval
+	if runs, err := job.RunDue(context.Background()); err != nil || runs != 0 {
+		t.Fatalf("Expected no run, got %d: %v", runs, err)
+	}
+
+	// Failures are kept until the next run
+	now = now.Add(time.Hour)
+	status = http.StatusBadGateway
+	if runs, err := job.RunDue(context.Background()); err != nil || runs != 1 {
+		t.Fatalf("Expected 1 run, got %d: %v", runs, err)
+	}
+	<-deliveries
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/reports/hourly", nil))
+	var report SavedReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.LastRunAt == nil || !report.LastRunAt.Equal(now.Truncate(time.Hour)) || !strings.Contains(report.LastError, "502") {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/reports/hourly", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/reports/hourly", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+}
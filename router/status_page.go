@@ -0,0 +1,86 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+)
+
+// Files of a status page snapshot
+const (
+	statusPageJSON = "status.json"
+	statusPageHTML = "index.html"
+)
+
+var statusPageTemplate = template.Must(template.New(statusPageHTML).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Rescue Node usage</title>
+</head>
+<body>
+<h1>Rescue Node usage</h1>
+<table>
+<tr><th>Window</th><th>Validators</th><th>Hours</th></tr>
+{{- range .Windows}}
+<tr><td>{{.Window}}</td><td>{{.Validators}}</td><td>{{printf "%.1f" .Hours}}</td></tr>
+{{- end}}
+</table>
+<p>Updated {{.UpdatedAt.Format "2006-01-02 15:04 MST"}}</p>
+</body>
+</html>
+`))
+
+// WriteStatusPage writes stats to dir as status.json and a static index.html, so the
+// public stats can be served by any web server, independently of the proxy.
+//
+// Each file is replaced atomically: readers see either the previous snapshot or the
+// new one, and a failed write leaves the previous snapshot in place.
+func WriteStatusPage(dir string, stats *PublicStats) error {
+	data, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(dir, statusPageJSON, append(data, '\n')); err != nil {
+		return err
+	}
+
+	var page bytes.Buffer
+	if err := statusPageTemplate.Execute(&page, stats); err != nil {
+		return fmt.Errorf("failed to render the status page: %w", err)
+	}
+	return writeFileAtomic(dir, statusPageHTML, page.Bytes())
+}
+
+// writeFileAtomic writes data to a temporary file in dir and renames it to name.
+func writeFileAtomic(dir string, name string, data []byte) error {
+	f, err := os.CreateTemp(dir, "."+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	// Served as is, so readable by the web server
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", name, err)
+	}
+	return nil
+}
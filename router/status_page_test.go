@@ -0,0 +1,62 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteStatusPage(t *testing.T) {
+	dir := t.TempDir()
+	stats := &PublicStats{
+		Windows: []PublicStatsWindow{
+			{Window: "24h", Validators: 2, Hours: 1.0 / 6},
+			{Window: "7d", Validators: 3, Hours: 12.25},
+		},
+		UpdatedAt: time.Date(2025, 1, 31, 12, 0, 0, 0, time.UTC),
+	}
+	if err := WriteStatusPage(dir, stats); err != nil {
+		t.Fatal(err)
+	}
+	// Snapshots are replaced
+	stats.Windows[1].Validators = 4
+	if err := WriteStatusPage(dir, stats); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, statusPageJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written PublicStats
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatal(err)
+	}
+	if len(written.Windows) != 2 || written.Windows[1] != stats.Windows[1] || !written.UpdatedAt.Equal(stats.UpdatedAt) {
+		t.Fatalf("Unexpected stats %+v", written)
+	}
+
+	page, err := os.ReadFile(filepath.Join(dir, statusPageHTML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"<td>7d</td><td>4</td><td>12.2</td>", "Updated 2025-01-31 12:00 UTC"} {
+		if !strings.Contains(string(page), s) {
+			t.Fatalf("Expected %q in the page:\n%s", s, page)
+		}
+	}
+
+	// No temporary file is left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected the 2 snapshot files, got %v", entries)
+	}
+}
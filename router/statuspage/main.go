@@ -0,0 +1,94 @@
+//go:build ns
+
+// Command statuspage renders the public usage stats of the rescue node into a static
+// status page, on a schedule. It reads the usage database directly, so the page stays
+// up to date while the proxy is overloaded, and is served by any web server.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/router"
+	"go.uber.org/zap"
+)
+
+func main() {
+	usageDSN := flag.String("usage-db", "file:nodeset-usage.db?cache=shared", "DSN of the database validator usage is read from, preferably a replica")
+	usageModel := flag.String("usage-model", "buckets", "Usage model of the database, buckets, sessions or hybrid")
+	usagePrecision := flag.Duration("usage-precision", 5*time.Minute, "Width of the buckets of the database")
+	output := flag.String("output", ".", "Directory status.json and index.html are written to")
+	interval := flag.Duration("interval", 0, "How often the status page is rendered. 0 renders it once and exits.")
+	flag.Parse()
+
+	if err := run(*usageDSN, *usageModel, *usagePrecision, *output, *interval); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(usageDSN, usageModel string, usagePrecision time.Duration, output string, interval time.Duration) error {
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = logger.Sync()
+	}()
+
+	if interval < 0 {
+		return fmt.Errorf("invalid -interval: must not be negative")
+	}
+	if info, err := os.Stat(output); err != nil || !info.IsDir() {
+		return fmt.Errorf("invalid -output: %s isn't a directory", output)
+	}
+
+	if _, err := metrics.Init("rescue_proxy_statuspage"); err != nil {
+		return err
+	}
+
+	tracker := router.NewUsageTracker(logger, router.UsageTrackerOptions{
+		DSN:       usageDSN,
+		Model:     router.UsageModel(usageModel),
+		Precision: usagePrecision,
+	})
+	defer tracker.Close()
+
+	render := func() error {
+		stats, err := router.NewPublicStats(tracker, time.Now())
+		if err != nil {
+			return err
+		}
+		if err := router.WriteStatusPage(output, stats); err != nil {
+			return err
+		}
+		logger.Info("Rendered the status page", zap.String("output", output))
+		return nil
+	}
+
+	if interval == 0 {
+		return render()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		// The previous snapshot is kept until a render succeeds
+		if err := render(); err != nil {
+			logger.Warn("Failed to render the status page", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
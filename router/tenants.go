@@ -0,0 +1,616 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const prContextTenantKey = prContextKey("tenant")
+
+var (
+	// ErrInvalidTenantKey is returned for API keys which don't exist, were revoked, or
+	// belong to a deleted organization.
+	ErrInvalidTenantKey = errors.New("invalid tenant API key")
+	// ErrNoTenantKey is returned when revoking a key which doesn't exist.
+	ErrNoTenantKey = errors.New("no such tenant API key")
+
+	errTenantReadOnly = errors.New("tenant usage views are read-only")
+)
+
+// TenantKey is an API key of the tenant API, scoped to an organization.
+type TenantKey struct {
+	ID           string    `json:"id"`
+	Organization string    `json:"organization"`
+	CreatedAt    time.Time `json:"created_at"`
+	// Only returned when the key is created, only its hash is stored
+	Key string `json:"key,omitempty"`
+}
+
+// TenantKeyStore keeps the API keys organizations use to query their own usage on the
+// tenant API, see TenantHandler.
+type TenantKeyStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewTenantKeyStore creates the tenant key table in db if needed. db must hold the
+// organizations.
+func NewTenantKeyStore(logger *zap.Logger, db *sql.DB) (*TenantKeyStore, error) {
+	store := &TenantKeyStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *TenantKeyStore) initSchema() error {
+	// key_hash is the hex SHA-256 of the key, created_at unix seconds.
+	// organization_created_at ties keys to the organization they were issued for, so
+	// they don't apply to one later created with the same id.
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS tenant_api_keys (
+		id TEXT PRIMARY KEY,
+		organization_id TEXT NOT NULL,
+		organization_created_at INTEGER NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_tenant_api_keys_organization ON tenant_api_keys(organization_id);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+func hashTenantKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create issues a key for the organization org. The key is only returned here.
+func (store *TenantKeyStore) Create(org string) (*TenantKey, error) {
+	var orgCreatedAt int64
+	err := store.Database.QueryRow("SELECT created_at FROM organizations WHERE id = ?", org).Scan(&orgCreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoOrganization
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query organization: %w", err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	out := &TenantKey{
+		ID:           hex.EncodeToString(id),
+		Organization: org,
+		CreatedAt:    store.clock().Truncate(time.Second).UTC(),
+		Key:          hex.EncodeToString(secret),
+	}
+
+	_, err = store.Database.Exec(`
+	INSERT INTO tenant_api_keys (id, organization_id, organization_created_at, key_hash, created_at)
+	VALUES (?, ?, ?, ?, ?)
+	`, out.ID, org, orgCreatedAt, hashTenantKey(out.Key), out.CreatedAt.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to store tenant key: %w", err)
+	}
+
+	return out, nil
+}
+
+// List returns the keys of the organization org, oldest first, without their secrets.
+func (store *TenantKeyStore) List(org string) ([]TenantKey, error) {
+	rows, err := store.Database.Query(`
+	SELECT id, created_at FROM tenant_api_keys WHERE organization_id = ? ORDER BY created_at, id
+	`, org)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tenant keys: %w", err)
+	}
+	defer rows.Close()
+
+	out := []TenantKey{}
+	for rows.Next() {
+		key := TenantKey{Organization: org}
+		var createdAt int64
+		if err := rows.Scan(&key.ID, &createdAt); err != nil {
+			return nil, err
+		}
+		key.CreatedAt = time.Unix(createdAt, 0).UTC()
+		out = append(out, key)
+	}
+
+	return out, rows.Err()
+}
+
+// Revoke deletes the key id of the organization org.
+func (store *TenantKeyStore) Revoke(org string, id string) error {
+	res, err := store.Database.Exec("DELETE FROM tenant_api_keys WHERE organization_id = ? AND id = ?", org, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke tenant key: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoTenantKey
+	}
+	return nil
+}
+
+// Organization returns the id of the organization key belongs to, or
+// ErrInvalidTenantKey. Keys of deleted organizations are invalid.
+func (store *TenantKeyStore) Organization(key string) (string, error) {
+	var org string
+	err := store.Database.QueryRow(`
+	SELECT k.organization_id FROM tenant_api_keys k
+	JOIN organizations o ON o.id = k.organization_id AND o.created_at = k.organization_created_at
+	WHERE k.key_hash = ?
+	`, hashTenantKey(key)).Scan(&org)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrInvalidTenantKey
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query tenant key: %w", err)
+	}
+	return org, nil
+}
+
+// tenantScope is the data a tenant API request may see: its organization, the member
+// node addresses and the validators attributed to them, with when they were.
+type tenantScope struct {
+	Organization *Organization
+	nodes        map[common.Address]struct{}
+	// Periods each validator was attributed to a member, see ValidatorAttribution
+	validators map[string][]TimeRange
+	// Whether records carry their tenant, see UsageTrackerOptions.MultiTenant
+	multiTenant bool
+}
+
+// Usage returns a view of tracker restricted to the tenant. Every tenant usage query
+// goes through it. In multi-tenant mode, it only reads the records of the tenant.
+// Otherwise, it reads the records of the validators attributed to its members, while
+// they were, so usage under a previous or later operator isn't visible.
+func (scope *tenantScope) Usage(tracker UsageTracker) UsageTracker {
+	view := &tenantUsageTracker{tracker: tracker, validators: scope.validators}
+	if store, ok := tracker.(tenantUsageStore); ok && scope.multiTenant {
+		view.store = store
+		view.tenant = scope.Organization.ID
+	}
+	return view
+}
+
+// Nodes restricts nodes to the members of the tenant, and returns every member when
+// nodes is empty. ErrNotMember is returned for node addresses of other tenants.
+func (scope *tenantScope) Nodes(nodes []common.Address) ([]common.Address, error) {
+	if len(nodes) == 0 {
+		return scope.Organization.Members, nil
+	}
+	for _, node := range nodes {
+		if _, ok := scope.nodes[node]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNotMember, node.Hex())
+		}
+	}
+	return nodes, nil
+}
+
+// tenantUsageTracker is a read-only view of the usage of a tenant, from the records
+// of the tenant in store when set, or else of a set of validators over the periods
+// they were attributed to the tenant.
+type tenantUsageTracker struct {
+	tracker    UsageTracker
+	validators map[string][]TimeRange
+
+	store  tenantUsageStore
+	tenant string
+}
+
+func (t *tenantUsageTracker) RecordUsage([]string) error {
+	return errTenantReadOnly
+}
+
+func (t *tenantUsageTracker) ViewUsage(from time.Time, to time.Time) (map[string]time.Duration, error) {
+	if t.store != nil {
+		return t.store.ViewTenantUsage(t.tenant, from, to)
+	}
+
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+	var precision time.Duration
+	if buckets, ok := t.tracker.(usageBuckets); ok {
+		precision = buckets.bucketPrecision()
+	}
+
+	// Validators attributed over the same period share a range, so usage is read in
+	// one query per distinct period
+	var ranges []TimeRange
+	index := make(map[TimeRange]int)
+	periods := make(map[string][]int, len(t.validators))
+	for validator, windows := range t.validators {
+		for _, r := range clipAttribution(windows, from, to, precision) {
+			i, ok := index[r]
+			if !ok {
+				i = len(ranges)
+				index[r] = i
+				ranges = append(ranges, r)
+			}
+			periods[validator] = append(periods[validator], i)
+		}
+	}
+	out := make(map[string]time.Duration)
+	if len(ranges) == 0 {
+		return out, nil
+	}
+
+	usages, err := ViewUsageMulti(t.tracker, ranges)
+	if err != nil {
+		return nil, err
+	}
+	for validator, indexes := range periods {
+		for _, i := range indexes {
+			if d, ok := usages[i].Usage[validator]; ok {
+				out[validator] += d
+			}
+		}
+	}
+	return out, nil
+}
+
+// clipAttribution returns the parts of [from, to] within the attribution windows of a
+// validator, sorted by start. Windows sharing a bucket of precision are merged, so
+// their usage isn't counted twice.
+func clipAttribution(windows []TimeRange, from time.Time, to time.Time, precision time.Duration) []TimeRange {
+	var out []TimeRange
+	for _, w := range windows {
+		r := w
+		if r.From.Before(from) {
+			r.From = from
+		}
+		if r.To.After(to) {
+			r.To = to
+		}
+		if r.From.After(r.To) {
+			continue
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].From.Before(out[j].From)
+	})
+
+	merged := out[:0]
+	for _, r := range out {
+		if n := len(merged); n > 0 && !merged[n-1].To.Truncate(precision).Before(r.From.Truncate(precision)) {
+			if r.To.After(merged[n-1].To) {
+				merged[n-1].To = r.To
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// Close doesn't close the underlying tracker, which isn't owned by the view.
+func (t *tenantUsageTracker) Close() {}
+
+// resolveTenant returns the scope of the organization org.
+func (pr *ProxyRouter) resolveTenant(org string) (*tenantScope, error) {
+	o, err := pr.orgs.Get(org)
+	if err != nil {
+		return nil, err
+	}
+	scope := &tenantScope{
+		Organization: o,
+		nodes:        make(map[common.Address]struct{}, len(o.Members)),
+		validators:   make(map[string][]TimeRange),
+		multiTenant:  pr.UsageTrackerOptions.MultiTenant,
+	}
+	for _, node := range o.Members {
+		scope.nodes[node] = struct{}{}
+		validators, err := pr.attr.Validators(node)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range validators {
+			scope.validators[v.Validator] = append(scope.validators[v.Validator], TimeRange{From: v.FirstSeen, To: v.LastSeen})
+		}
+	}
+	return scope, nil
+}
+
+// authenticateTenant resolves the scope of the bearer API key of requests, and refuses
+// those without a valid one.
+func (pr *ProxyRouter) authenticateTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pr.tenantKeys == nil || pr.attr == nil {
+			http.Error(w, "the tenant API requires a SQL usage tracker with validator attribution", http.StatusNotImplemented)
+			return
+		}
+
+		key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || key == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing tenant API key", http.StatusUnauthorized)
+			return
+		}
+		org, err := pr.tenantKeys.Organization(key)
+		if errors.Is(err, ErrInvalidTenantKey) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			pr.Logger.Error("Failed to authenticate tenant", zap.Error(err))
+			http.Error(w, "failed to authenticate tenant", http.StatusInternalServerError)
+			return
+		}
+
+		scope, err := pr.resolveTenant(org)
+		if err != nil {
+			pr.Logger.Error("Failed to resolve tenant", zap.String("organization", org), zap.Error(err))
+			http.Error(w, "failed to resolve tenant", http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), prContextTenantKey, scope)))
+	})
+}
+
+func tenantFromContext(ctx context.Context) *tenantScope {
+	return ctx.Value(prContextTenantKey).(*tenantScope)
+}
+
+// checkTenantQueryCost refuses tenant requests estimated to scan more than the limit of
+// usage records, counting only the records of the tenant's validators. Unlike the admin
+// guard, there's no forcing a query through, and requests whose cost can't be estimated
+// are refused.
+func (pr *ProxyRouter) checkTenantQueryCost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pr.cost == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ranges := queryCostRanges(r)
+		if len(ranges) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		scope := tenantFromContext(r.Context())
+		var cost int64
+		for _, tr := range ranges {
+			estimate, err := pr.cost.EstimateFor(len(scope.validators), tr.From, tr.To)
+			if err != nil {
+				pr.Logger.Error("Failed to estimate tenant query cost", zap.String("organization", scope.Organization.ID), zap.Error(err))
+				http.Error(w, "failed to estimate query cost", http.StatusServiceUnavailable)
+				return
+			}
+			cost += estimate
+		}
+		if cost > pr.cost.Limit {
+			http.Error(w, fmt.Sprintf("query is estimated to scan %d usage records, more than the limit of %d; narrow the range", cost, pr.cost.Limit), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TenantHandler serves the usage of an organization to the holders of its API keys,
+// for hosted deployments shared by several communities. Every request requires a key,
+// sent as a bearer token, and only sees the organization's members and the validators
+// attributed to them. Keys are managed on the admin API.
+func (pr *ProxyRouter) TenantHandler() http.Handler {
+	router := mux.NewRouter()
+	router.Use(pr.authenticateTenant)
+	router.Use(checkDurationFormat)
+	router.Use(pr.checkTenantQueryCost)
+
+	router.Path("/usage").Methods(http.MethodGet).HandlerFunc(pr.serveTenantUsage)
+	router.Path("/organization").Methods(http.MethodGet).HandlerFunc(pr.serveTenantOrganization)
+	router.Path("/organization/usage").Methods(http.MethodGet).HandlerFunc(pr.serveTenantOrganizationUsage)
+	router.Path("/operators/daily").Methods(http.MethodGet).HandlerFunc(pr.serveTenantOperatorDailyUsage)
+
+	return router
+}
+
+// serveTenantUsage returns the usage of the tenant's validators in the buckets
+// overlapping [from, to].
+func (pr *ProxyRouter) serveTenantUsage(w http.ResponseWriter, r *http.Request) {
+	scope := tenantFromContext(r.Context())
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	usage, err := scope.Usage(pr.usage()).ViewUsage(from, to)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to view tenant usage", zap.Error(err))
+		http.Error(w, "failed to view usage", http.StatusInternalServerError)
+		return
+	}
+
+	seconds := make(map[string]float64, len(usage))
+	for validator, d := range usage {
+		seconds[validator] = d.Seconds()
+	}
+	pr.writeUsageJSON(w, r, seconds)
+}
+
+func (pr *ProxyRouter) serveTenantOrganization(w http.ResponseWriter, r *http.Request) {
+	pr.writeUsageJSON(w, r, tenantFromContext(r.Context()).Organization)
+}
+
+// serveTenantOrganizationUsage aggregates the usage of the tenant's members, see
+// OrganizationUsageReport.
+func (pr *ProxyRouter) serveTenantOrganizationUsage(w http.ResponseWriter, r *http.Request) {
+	scope := tenantFromContext(r.Context())
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := OrganizationUsageReport(scope.Usage(pr.usage()), pr.attr, scope.Organization, from, to)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to report tenant usage", zap.Error(err))
+		http.Error(w, "failed to report organization usage", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
+
+// serveTenantOperatorDailyUsage returns the daily usage of the tenant's members, or of
+// those given as node parameters.
+func (pr *ProxyRouter) serveTenantOperatorDailyUsage(w http.ResponseWriter, r *http.Request) {
+	scope := tenantFromContext(r.Context())
+	if pr.operatorDaily == nil {
+		http.Error(w, "operator aggregates are disabled", http.StatusNotImplemented)
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodes := make([]common.Address, 0)
+	for _, node := range r.URL.Query()["node"] {
+		if !common.IsHexAddress(node) {
+			http.Error(w, fmt.Sprintf("invalid node address %q", node), http.StatusBadRequest)
+			return
+		}
+		nodes = append(nodes, common.HexToAddress(node))
+	}
+	nodes, err = scope.Nodes(nodes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	report := []OperatorDailyUsage{}
+	// Without members, Days would return every operator
+	if len(nodes) > 0 {
+		report, err = pr.operatorDaily.Days(nodes, from, to)
+	}
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to query tenant operator aggregates", zap.Error(err))
+		http.Error(w, "failed to query operator aggregates", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
+
+func (pr *ProxyRouter) tenantKeyStore(w http.ResponseWriter) (*TenantKeyStore, bool) {
+	if pr.tenantKeys == nil {
+		http.Error(w, "tenant API keys require a SQL usage tracker", http.StatusNotImplemented)
+		return nil, false
+	}
+	return pr.tenantKeys, true
+}
+
+// serveCreateTenantKey issues an API key of the tenant API for the organization in
+// the path. The key can't be retrieved again.
+func (pr *ProxyRouter) serveCreateTenantKey(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.tenantKeyStore(w)
+	if !ok {
+		return
+	}
+
+	key, err := store.Create(mux.Vars(r)["org"])
+	if err != nil {
+		pr.writeOrganizationError(w, err)
+		return
+	}
+	pr.Logger.Info("Created tenant API key",
+		zap.String("organization", key.Organization),
+		zap.String("id", key.ID))
+
+	pr.writeUsageJSONStatus(w, r, http.StatusCreated, key)
+}
+
+func (pr *ProxyRouter) serveListTenantKeys(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.tenantKeyStore(w)
+	if !ok {
+		return
+	}
+
+	keys, err := store.List(mux.Vars(r)["org"])
+	if err != nil {
+		pr.writeOrganizationError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, keys)
+}
+
+func (pr *ProxyRouter) serveRevokeTenantKey(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.tenantKeyStore(w)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	err := store.Revoke(vars["org"], vars["id"])
+	if errors.Is(err, ErrNoTenantKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		pr.writeOrganizationError(w, err)
+		return
+	}
+	pr.Logger.Info("Revoked tenant API key",
+		zap.String("organization", vars["org"]),
+		zap.String("id", vars["id"]))
+
+	w.WriteHeader(http.StatusNoContent)
+}
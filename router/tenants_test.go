@@ -0,0 +1,222 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestTenantAPI(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	logger := zaptest.NewLogger(t)
+	var err error
+	if pr.attr, err = NewAttributionStore(logger, pr.orgs.Database); err != nil {
+		t.Fatal(err)
+	}
+	if pr.tenantKeys, err = NewTenantKeyStore(logger, pr.orgs.Database); err != nil {
+		t.Fatal(err)
+	}
+	// Node 1 is a member of acme, node 9 isn't
+	if err := pr.attr.Attribute(common.Address{1}, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.attr.Attribute(common.Address{9}, []string{"3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.ut.RecordUsage([]string{"1", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := pr.AdminHandler()
+	tenant := pr.TenantHandler()
+
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/organizations/unknown/keys", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d for an unknown organization, got %d", http.StatusNotFound, rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/organizations/acme/keys", nil))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusCreated, rec.Code, rec.Body.String())
+	}
+	var key TenantKey
+	if err := json.NewDecoder(rec.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+	if key.Key == "" || key.Organization != "acme" {
+		t.Fatalf("Unexpected key %+v", key)
+	}
+
+	serve := func(path string, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		tenant.ServeHTTP(rec, r)
+		return rec
+	}
+	const usageRange = "?from=2000-01-01T00:00:00Z&to=2100-01-01T00:00:00Z"
+
+	for _, token := range []string{"", "not-a-key"} {
+		if rec := serve("/usage"+usageRange, token); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected %d for %q, got %d", http.StatusUnauthorized, token, rec.Code)
+		}
+	}
+
+	// Only validators attributed to members are visible
+	rec = serve("/usage"+usageRange, key.Key)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var usage map[string]float64
+	if err := json.NewDecoder(rec.Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := usage["1"]; !ok || len(usage) != 1 {
+		t.Fatalf("Expected only validator 1, got %v", usage)
+	}
+
+	rec = serve("/organization/usage"+usageRange, key.Key)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var report OrganizationUsage
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Organization != "acme" || len(report.Nodes) != 2 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	// Operators of other tenants can't be queried
+	pr.operatorDaily, err = NewOperatorDailyStore(logger, pr.orgs.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve("/operators/daily"+usageRange+"&node="+common.Address{9}.Hex(), key.Key); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d for another tenant's operator, got %d", http.StatusNotFound, rec.Code)
+	}
+	if rec := serve("/operators/daily?from=2025-01-01T00:00:00Z&to=2025-01-01T00:00:00Z", key.Key); rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	// Admin routes aren't served
+	if rec := serve("/organizations", key.Key); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d for an admin route, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	// The cost guard only counts the tenant's validators and can't be forced
+	validators := make([]string, 1000)
+	for i := range validators {
+		validators[i] = strconv.Itoa(1000 + i)
+	}
+	if err := pr.ut.RecordUsage(validators); err != nil {
+		t.Fatal(err)
+	}
+	pr.cost = &QueryCostEstimator{
+		Tracker:   pr.ut.(*SQLiteUsageTracker),
+		Limit:     300,
+		Logger:    logger,
+		wallClock: wallClock{now: func() time.Time { return time.Now().Add(time.Hour) }},
+	}
+	const dayRange = "?from=2025-01-01T00:00:00Z&to=2025-01-02T00:00:00Z"
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage"+dayRange, nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected the admin guard to count every validator, got %d", rec.Code)
+	}
+	if rec := serve("/usage"+dayRange, key.Key); rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d for a day of the tenant's usage, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	for _, query := range []string{usageRange, usageRange + "&force=true"} {
+		if rec := serve("/usage"+query, key.Key); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %d for %s, got %d", http.StatusBadRequest, query, rec.Code)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/organizations/acme/keys", nil))
+	var keys []TenantKey
+	if err := json.NewDecoder(rec.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].ID != key.ID || keys[0].Key != "" {
+		t.Fatalf("Unexpected keys %+v", keys)
+	}
+
+	rec = httptest.NewRecorder()
+	admin.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/organizations/acme/keys/"+key.ID, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+	if rec := serve("/organization", key.Key); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a revoked key to be refused, got %d", rec.Code)
+	}
+}
+
+func TestTenantUsageAttributionWindow(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	var err error
+	if pr.attr, err = NewAttributionStore(zaptest.NewLogger(t), pr.orgs.Database); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	attribute := func(node common.Address, offset time.Duration) {
+		t.Helper()
+		pr.attr.now = func() time.Time { return start.Add(offset) }
+		if err := pr.attr.Attribute(node, []string{"7"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Validator 7 was operated by node 9, then transferred to acme's nodes 2 and 1
+	attribute(common.Address{9}, 0)
+	attribute(common.Address{9}, 20*time.Minute)
+	attribute(common.Address{2}, time.Hour)
+	attribute(common.Address{2}, time.Hour+20*time.Minute)
+	attribute(common.Address{1}, time.Hour+10*time.Minute)
+	attribute(common.Address{1}, 2*time.Hour)
+
+	for _, offset := range []time.Duration{5 * time.Minute, 15 * time.Minute, time.Hour + 5*time.Minute, time.Hour + 15*time.Minute, time.Hour + 50*time.Minute, 3 * time.Hour} {
+		if err := pr.ut.(UsageBackfiller).RecordUsageAt(start.Add(offset), []string{"7"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	scope, err := pr.resolveTenant("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := scope.Usage(pr.ut)
+	for _, tc := range []struct {
+		to       time.Duration
+		expected time.Duration
+	}{
+		// Only the buckets while a member operated it, once each
+		{4 * time.Hour, 15 * time.Minute},
+		// Clipped to the range
+		{time.Hour + 10*time.Minute, 5 * time.Minute},
+		{time.Hour / 2, 0},
+	} {
+		usage, err := view.ViewUsage(start, start.Add(tc.to))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage["7"] != tc.expected {
+			t.Fatalf("Expected %v of usage until %v, got %v", tc.expected, tc.to, usage)
+		}
+	}
+}
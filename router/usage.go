@@ -3,45 +3,558 @@
 package router
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// UsageTracker is the interface every usage tracker implements. It's kept stable so
+// trackers and their callers keep compiling: optional features are separate interfaces
+// reported by UsageCapabilitiesOf, and the experimental UsageAPI adapts trackers for
+// callers which need contexts, kinds or labels.
 type UsageTracker interface {
 	RecordUsage(indices []string) error
+	// ViewUsage reports usage in every bucket overlapping the closed range [from, to].
+	// Buckets straddling either edge are counted in full: the bucket containing from
+	// and the bucket containing to are both included, so from == to selects the single
+	// bucket containing that instant. Invalid ranges return a *RangeError.
 	ViewUsage(from time.Time, to time.Time) (map[string]time.Duration, error) // [ validator_pubkey ] -> [ duration ]
 	Close()
 }
 
-type SQLiteUsageTracker struct {
-	Database  *sql.DB
-	Logger    *zap.Logger
+var (
+	// ErrZeroTime is returned when either bound of a usage range is the zero time.
+	ErrZeroTime = errors.New("range bound is the zero time")
+	// ErrInvertedRange is returned when a usage range starts after it ends.
+	ErrInvertedRange = errors.New("range starts after it ends")
+	// ErrTrackerClosed is returned by usage trackers used after Close.
+	ErrTrackerClosed = errors.New("usage tracker is closed")
+)
+
+// RangeError describes an invalid range passed to ViewUsage.
+// Use errors.Is to match the reason against ErrZeroTime or ErrInvertedRange.
+type RangeError struct {
+	From time.Time
+	To   time.Time
+	Err  error
+}
+
+func (e *RangeError) Error() string {
+	return fmt.Sprintf("invalid usage range [%s, %s]: %v", e.From.Format(time.RFC3339), e.To.Format(time.RFC3339), e.Err)
+}
+
+func (e *RangeError) Unwrap() error {
+	return e.Err
+}
+
+// Supported bucket precision, enforced for every tracker.
+// Usage is stored per bucket, so the lower bound keeps the row count per validator
+// reasonable and the upper bound keeps daily reports meaningful.
+const (
+	MinUsagePrecision = time.Second
+	MaxUsagePrecision = 24 * time.Hour
+)
+
+// ErrInvalidPrecision is returned when a tracker is configured with an unsupported precision.
+var ErrInvalidPrecision = errors.New("invalid usage precision")
+
+// ValidatePrecision checks that a bucket precision is within the supported range.
+func ValidatePrecision(precision time.Duration) error {
+	if precision < MinUsagePrecision || precision > MaxUsagePrecision {
+		return fmt.Errorf("%w: %v is outside the supported range [%v, %v]",
+			ErrInvalidPrecision, precision, MinUsagePrecision, MaxUsagePrecision)
+	}
+	return nil
+}
+
+// warnPrecision logs precisions which are supported but likely a mistake.
+func warnPrecision(logger *zap.Logger, precision time.Duration) {
+	if precision < time.Minute {
+		logger.Warn("Usage precision is very small, the database will grow quickly",
+			zap.Duration("precision", precision))
+	}
+	if precision > time.Hour {
+		logger.Warn("Usage precision is very large, short usage will be over-counted",
+			zap.Duration("precision", precision))
+	}
+	if (24*time.Hour)%precision != 0 {
+		logger.Warn("Usage precision doesn't evenly divide a day, buckets won't align with daily boundaries",
+			zap.Duration("precision", precision))
+	}
+}
+
+func validateRange(from time.Time, to time.Time) error {
+	if from.IsZero() || to.IsZero() {
+		return &RangeError{From: from, To: to, Err: ErrZeroTime}
+	}
+	if from.After(to) {
+		return &RangeError{From: from, To: to, Err: ErrInvertedRange}
+	}
+	return nil
+}
+
+const defaultUsageDSN = "file:nodeset-usage.db?cache=shared"
+
+// UsageModel selects how a tracker accounts for usage.
+type UsageModel string
+
+const (
+	// UsageModelBuckets quantizes activity into fixed-width buckets and reports
+	// the number of buckets a validator was active in times the precision.
+	UsageModelBuckets UsageModel = "buckets"
+	// UsageModelSessions records when a validator's activity starts and ends and
+	// reports the time between the two, without quantization.
+	UsageModelSessions UsageModel = "sessions"
+	// UsageModelHybrid records with both models. Buckets stay authoritative for
+	// ViewUsage, sessions are kept to reconcile against them.
+	UsageModelHybrid UsageModel = "hybrid"
+)
+
+// UsageDBRole identifies which database connection of a tracker an operation uses.
+type UsageDBRole string
+
+const (
+	// UsageDBPrimary is the database all writes go to.
+	UsageDBPrimary UsageDBRole = "primary"
+	// UsageDBReplica is the optional database ViewUsage reads from.
+	UsageDBReplica UsageDBRole = "replica"
+)
+
+// UsageTrackerOptions configures the storage of a UsageTracker.
+type UsageTrackerOptions struct {
+	// DSN of the primary database. Defaults to nodeset-usage.db in the working directory.
+	DSN string
+	// Optional DSN of a read replica. When set, ViewUsage is served from the replica
+	// while RecordUsage keeps writing to the primary.
+	//
+	// Reads from a replica are staleness-tolerant: usage recorded on the primary
+	// becomes visible only once the replica has caught up, so a view may lag behind
+	// the most recent buckets by the replication delay. Callers needing
+	// read-your-writes semantics should leave ReadDSN empty.
+	ReadDSN string
+
+	// Usage model, buckets by default. See UsageModel.
+	Model UsageModel
+	// Activity further apart than SessionIdleTimeout starts a new session.
+	// Only used by the session model, defaults to 15 minutes.
+	SessionIdleTimeout time.Duration
+
+	// Width of the buckets usage is quantized into. Defaults to 5 minutes and
+	// must be within [MinUsagePrecision, MaxUsagePrecision].
 	Precision time.Duration
+
+	// Connection pool settings, applied to the primary and the replica alike.
+	// Zero values select the backend's defaults.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// Locking mode of write transactions: "deferred", "immediate" or "exclusive".
+	// SQLite transactions are always serializable; "immediate" takes the write lock
+	// up front, so concurrent writers from several instances queue instead of failing
+	// on lock upgrade. Empty leaves the driver default (deferred), and usage writes run
+	// as a single statement outside any transaction.
+	TxLock string
+	// What writes of a bucket which was already recorded do, e.g. by another instance.
+	// Defaults to UsageConflictIgnore. UsageConflictReplace isn't supported with
+	// Occupancy, whose writes merge the activity of a bucket.
+	ConflictPolicy UsageConflictPolicy
+	// Number of times a write transaction is retried when the database is busy
+	// or locked by another writer. Defaults to 3; negative disables retries.
+	WriteRetries int
+
+	// How to handle a wall clock that moved backwards. Defaults to ClockSkewClamp.
+	SkewPolicy ClockSkewPolicy
+
+	// Optional hysteresis around bucket boundaries. Activity less than BoundaryGrace
+	// after a boundary isn't recorded for validators that were active less than
+	// BoundaryGrace before it, so short usage straddling a boundary counts as one
+	// bucket rather than two. Must be less than half the precision; 0 disables it.
+	BoundaryGrace time.Duration
+
+	// Skip writes for validators this instance already recorded in the current bucket.
+	// Usage is unchanged, only redundant database work is avoided.
+	Coalesce bool
+
+	// Credit each bucket with how long the validator was active in it rather than in
+	// full, see occupancyMinimum. Only supported by the buckets and hybrid models, and
+	// not with Coalesce, since every activity extends the bucket it's in.
+	Occupancy bool
+
+	// Require every write to carry the tenant it's recorded for, see RecordTenantUsage.
+	// Only supported by the buckets model.
+	MultiTenant bool
+
+	// Optional faults injected into database operations, for resilience tests only.
+	Faults *FaultInjector
+
+	// What StartUsageTracker does when the database can't be initialized. Defaults to
+	// UsageStartupFailFast.
+	StartupPolicy UsageStartupPolicy
+	// How long UsageStartupRetry retries for
+	StartupRetryFor time.Duration
+
+	// Bounds the tracker's in-process caches, see MemoryBudget. Optional.
+	Memory *MemoryBudget
+
+	// Name of the tracker, added as the tracker label to its metrics and the tracker
+	// field to its logs so trackers sharing a process can be told apart. Defaults to
+	// primary.
+	Name string
+
+	// Subsystem of the tracker's metrics, defaults to usage_tracker. Trackers sharing
+	// a process, e.g. a shadow backend, need their own.
+	metricsSubsystem string
+}
+
+const (
+	defaultUsagePrecision    = 5 * time.Minute
+	defaultUsageWriteRetries = 3
+	defaultUsageTrackerName  = "primary"
+)
+
+func (opts *UsageTrackerOptions) name() string {
+	if opts.Name == "" {
+		return defaultUsageTrackerName
+	}
+	return opts.Name
+}
+
+// registry creates a metrics registry for subsystem labeled with the tracker's name.
+func (opts *UsageTrackerOptions) registry(subsystem string) *metrics.MetricsRegistry {
+	return metrics.NewLabeledMetricsRegistry(subsystem, prometheus.Labels{"tracker": opts.name()})
+}
+
+func (opts *UsageTrackerOptions) metrics() *metrics.MetricsRegistry {
+	if opts.metricsSubsystem == "" {
+		return opts.registry("usage_tracker")
+	}
+	return opts.registry(opts.metricsSubsystem)
+}
+
+// logger adds the tracker's name to logger's fields.
+func (opts *UsageTrackerOptions) logger(logger *zap.Logger) *zap.Logger {
+	return logger.With(zap.String("tracker", opts.name()))
+}
+
+func (opts *UsageTrackerOptions) writeRetries() int {
+	if opts.WriteRetries == 0 {
+		return defaultUsageWriteRetries
+	} else if opts.WriteRetries < 0 {
+		return 0
+	}
+	return opts.WriteRetries
+}
+
+// withDSNParam adds a query parameter to a sqlite DSN unless it's already present.
+func withDSNParam(dsn, key, value string) string {
+	if strings.Contains(dsn, key+"=") {
+		return dsn
+	}
+	if strings.Contains(dsn, "?") {
+		return dsn + "&" + key + "=" + value
+	}
+	return dsn + "?" + key + "=" + value
+}
+
+// SQLite serializes writers, so a single connection avoids "database is locked"
+// errors. Raising MaxOpenConns is only useful for read replicas.
+const (
+	sqliteDefaultMaxOpenConns = 1
+	sqliteDefaultMaxIdleConns = 1
+)
+
+func (opts *UsageTrackerOptions) applyPool(db *sql.DB) {
+	maxOpen := opts.MaxOpenConns
+	if maxOpen == 0 {
+		maxOpen = sqliteDefaultMaxOpenConns
+	}
+	maxIdle := opts.MaxIdleConns
+	if maxIdle == 0 {
+		maxIdle = sqliteDefaultMaxIdleConns
+	}
+
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+}
+
+type SQLiteUsageTracker struct {
+	Database *sql.DB
+	// Optional read replica. ViewUsage falls back to Database when nil.
+	ReadDatabase *sql.DB
+	Logger       *zap.Logger
+	Precision    time.Duration
+	// Number of retries for write transactions that fail because the database is busy
+	WriteRetries int
+	// Locking mode the database was opened with, see UsageTrackerOptions.TxLock. Usage
+	// writes run in a transaction when it's set, so they take the lock as configured.
+	TxLock string
+	// Handling of buckets which were already recorded, see UsageTrackerOptions.ConflictPolicy
+	ConflictPolicy UsageConflictPolicy
+	// How to handle a wall clock that moved backwards. Defaults to ClockSkewClamp.
+	SkewPolicy ClockSkewPolicy
+	// Optional hysteresis around bucket boundaries, see UsageTrackerOptions.BoundaryGrace
+	BoundaryGrace time.Duration
+	// Skip redundant writes within a bucket, see UsageTrackerOptions.Coalesce
+	Coalesce bool
+	// Weight buckets by occupancy, see UsageTrackerOptions.Occupancy
+	Occupancy bool
+	// Refuse writes without a tenant, see UsageTrackerOptions.MultiTenant
+	MultiTenant bool
+	// Optional faults injected into database operations, see FaultInjector
+	Faults *FaultInjector
+
+	wallClock
+	// Set by Close, after which statements are unusable
+	closed atomic.Bool
+	// Latest time usage was recorded at, in unix nanoseconds
+	latest atomic.Int64
+	// Whether the wall clock is currently behind latest
+	skewed atomic.Bool
+	// Recent activity used to apply BoundaryGrace
+	grace boundaryGrace
+	// Validators recorded in the current bucket, used when Coalesce is set
+	coalescer usageCoalescer
+
+	// Statements are prepared once per schema and re-prepared per connection by database/sql
+	insertUsageStmt *sql.Stmt
+	viewUsageStmt   *sql.Stmt
+	// Only prepared with Occupancy
+	occupyUsageStmt   *sql.Stmt
+	viewOccupancyStmt *sql.Stmt
+
+	m *metrics.MetricsRegistry
+}
+
+// sqlUsageTracker is implemented by trackers backed by a SQL database,
+// so other stores can share their primary database.
+type sqlUsageTracker interface {
+	primaryDatabase() *sql.DB
 }
 
-func NewSQLiteUsageTracker(logger *zap.Logger) UsageTracker {
-	db, err := sql.Open("sqlite3", "file:nodeset-usage.db?cache=shared")
+// NewUsageTracker creates the tracker for the usage model selected in opts.
+func NewUsageTracker(logger *zap.Logger, opts UsageTrackerOptions) UsageTracker {
+	tracker, err := newUsageTracker(logger, opts)
+	if err != nil {
+		logger.Fatal("Failed to initialize database schema", zap.Error(err))
+	}
+	return tracker
+}
+
+// newUsageTracker is NewUsageTracker, but returns an error if the database can't be
+// initialized. Invalid configuration is still fatal.
+func newUsageTracker(logger *zap.Logger, opts UsageTrackerOptions) (UsageTracker, error) {
+	switch opts.Model {
+	case UsageModelSessions:
+		return newSQLiteSessionUsageTracker(logger, opts)
+	case UsageModelHybrid:
+		return newHybridUsageTracker(logger, opts)
+	case UsageModelBuckets, "":
+		return newSQLiteUsageTracker(logger, opts)
+	default:
+		logger.Fatal("Unknown usage model", zap.String("model", string(opts.Model)))
+		return nil, nil
+	}
+}
+
+// openUsageDatabases opens the primary and, if configured, the replica database.
+// Connections are opened lazily, so read-only DSNs don't touch the replica until
+// the caller has created the schema on the primary.
+func openUsageDatabases(logger *zap.Logger, opts UsageTrackerOptions) (*sql.DB, *sql.DB) {
+	dsn := opts.DSN
+	if dsn == "" {
+		dsn = defaultUsageDSN
+	}
+	if opts.TxLock != "" {
+		dsn = withDSNParam(dsn, "_txlock", opts.TxLock)
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		logger.Fatal("Failed to open SQLite database", zap.Error(err))
 	}
+	opts.applyPool(db)
+
+	if opts.ReadDSN == "" {
+		return db, nil
+	}
+
+	readDB, err := sql.Open("sqlite3", opts.ReadDSN)
+	if err != nil {
+		logger.Fatal("Failed to open SQLite read replica", zap.Error(err))
+	}
+	opts.applyPool(readDB)
+
+	return db, readDB
+}
+
+// startUsageDatabases exports pool metrics and reports unhealthy databases once
+// the schema is initialized.
+func startUsageDatabases(logger *zap.Logger, m *metrics.MetricsRegistry, db *sql.DB, readDB *sql.DB) {
+	registerUsagePoolMetrics(m, UsageDBPrimary, db)
+	if readDB != nil {
+		registerUsagePoolMetrics(m, UsageDBReplica, readDB)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for role, err := range pingUsageDatabases(ctx, db, readDB) {
+		if err != nil {
+			logger.Warn("Usage database is unhealthy", zap.String("role", string(role)), zap.Error(err))
+		}
+	}
+}
+
+func NewSQLiteUsageTracker(logger *zap.Logger, opts UsageTrackerOptions) UsageTracker {
+	tracker, err := newSQLiteUsageTracker(logger, opts)
+	if err != nil {
+		logger.Fatal("Failed to initialize database schema", zap.Error(err))
+	}
+	return tracker
+}
+
+func newSQLiteUsageTracker(logger *zap.Logger, opts UsageTrackerOptions) (*SQLiteUsageTracker, error) {
+	logger = opts.logger(logger)
+	if opts.Precision == 0 {
+		opts.Precision = defaultUsagePrecision
+	}
+	if err := ValidatePrecision(opts.Precision); err != nil {
+		logger.Fatal("Invalid usage tracker configuration", zap.Error(err))
+	}
+	warnPrecision(logger, opts.Precision)
+	if opts.BoundaryGrace < 0 || opts.BoundaryGrace >= opts.Precision/2 {
+		logger.Fatal("Invalid usage tracker configuration, boundary grace must be less than half the precision",
+			zap.Duration("grace", opts.BoundaryGrace),
+			zap.Duration("precision", opts.Precision))
+	}
+	if opts.Occupancy && opts.Coalesce {
+		logger.Fatal("Invalid usage tracker configuration, occupancy can't be combined with coalescing")
+	}
+	switch opts.ConflictPolicy {
+	case "":
+		opts.ConflictPolicy = UsageConflictIgnore
+	case UsageConflictIgnore:
+	case UsageConflictReplace:
+		if opts.Occupancy {
+			logger.Fatal("Invalid usage tracker configuration, occupancy can't be combined with replacing conflicting buckets")
+		}
+	default:
+		logger.Fatal("Invalid usage tracker configuration, unknown conflict policy",
+			zap.String("policy", string(opts.ConflictPolicy)))
+	}
+	if opts.SkewPolicy == "" {
+		opts.SkewPolicy = ClockSkewClamp
+	}
 
-	db.SetMaxOpenConns(1)
+	db, readDB := openUsageDatabases(logger, opts)
 
 	tracker := &SQLiteUsageTracker{
-		Database:  db,
-		Logger:    logger,
-		Precision: 5 * time.Minute,
+		Database:       db,
+		ReadDatabase:   readDB,
+		Logger:         logger,
+		Precision:      opts.Precision,
+		WriteRetries:   opts.writeRetries(),
+		TxLock:         opts.TxLock,
+		ConflictPolicy: opts.ConflictPolicy,
+		SkewPolicy:     opts.SkewPolicy,
+		BoundaryGrace:  opts.BoundaryGrace,
+		Coalesce:       opts.Coalesce,
+		Occupancy:      opts.Occupancy,
+		MultiTenant:    opts.MultiTenant,
+		Faults:         opts.Faults,
+		m:              opts.metrics(),
 	}
+	tracker.grace.limit.max = opts.Memory.Entries(MemoryCacheGrace)
+	tracker.coalescer.limit.max = opts.Memory.Entries(MemoryCacheCoalesce)
 
 	if err := tracker.initSchema(); err != nil {
-		logger.Fatal("Failed to initialize database schema", zap.Error(err))
+		tracker.Close()
+		return nil, err
 	}
 
-	return tracker
+	startUsageDatabases(logger, tracker.m, db, readDB)
+
+	return tracker, nil
+}
+
+// HealthCheck pings each database the tracker uses and returns the result per role.
+// The replica role is only present when a read replica is configured.
+func (tracker *SQLiteUsageTracker) HealthCheck(ctx context.Context) map[UsageDBRole]error {
+	return pingUsageDatabases(ctx, tracker.Database, tracker.ReadDatabase)
+}
+
+func pingUsageDatabases(ctx context.Context, db *sql.DB, readDB *sql.DB) map[UsageDBRole]error {
+	out := map[UsageDBRole]error{
+		UsageDBPrimary: db.PingContext(ctx),
+	}
+
+	if readDB != nil {
+		out[UsageDBReplica] = readDB.PingContext(ctx)
+	}
+
+	return out
+}
+
+// registerUsagePoolMetrics exports the connection pool statistics of db, so the footprint
+// on shared databases can be observed.
+func registerUsagePoolMetrics(m *metrics.MetricsRegistry, role UsageDBRole, db *sql.DB) {
+	prefix := string(role) + "_pool_"
+	m.GaugeFunc(prefix+"open_connections", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+	m.GaugeFunc(prefix+"in_use", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	m.GaugeFunc(prefix+"idle", func() float64 {
+		return float64(db.Stats().Idle)
+	})
+	m.GaugeFunc(prefix+"wait_count", func() float64 {
+		return float64(db.Stats().WaitCount)
+	})
+	m.GaugeFunc(prefix+"wait_seconds", func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	})
+	m.GaugeFunc(prefix+"max_idle_closed", func() float64 {
+		return float64(db.Stats().MaxIdleClosed + db.Stats().MaxIdleTimeClosed)
+	})
+	m.GaugeFunc(prefix+"max_lifetime_closed", func() float64 {
+		return float64(db.Stats().MaxLifetimeClosed)
+	})
+}
+
+func (tracker *SQLiteUsageTracker) incCounter(name string) {
+	if tracker.m != nil {
+		tracker.m.Counter(name).Inc()
+	}
+}
+
+func (tracker *SQLiteUsageTracker) addCounter(name string, n int) {
+	if tracker.m != nil {
+		tracker.m.Counter(name).Add(float64(n))
+	}
+}
+
+func (tracker *SQLiteUsageTracker) primaryDatabase() *sql.DB {
+	return tracker.Database
+}
+
+func (tracker *SQLiteUsageTracker) readDB() *sql.DB {
+	if tracker.ReadDatabase != nil {
+		return tracker.ReadDatabase
+	}
+	return tracker.Database
 }
 
 func (tracker *SQLiteUsageTracker) initSchema() error {
@@ -49,19 +562,227 @@ func (tracker *SQLiteUsageTracker) initSchema() error {
 	CREATE TABLE IF NOT EXISTS validator_usage (
 		timestamp DATETIME NOT NULL,
 		validator_index TEXT NOT NULL,
-		PRIMARY KEY (timestamp, validator_index)
+		tenant TEXT NOT NULL DEFAULT '',
+		first_offset_ms INTEGER,
+		last_offset_ms INTEGER,
+		PRIMARY KEY (timestamp, validator_index, tenant)
 	);
-	
+	`
+
+	if _, err := tracker.Database.Exec(createTableSQL); err != nil {
+		return err
+	}
+	if err := migrateUsageTenant(tracker.Database); err != nil {
+		return err
+	}
+	if err := migrateUsageOccupancy(tracker.Database); err != nil {
+		return err
+	}
+	if err := migrateUsageTenantKey(tracker.Database); err != nil {
+		return err
+	}
+	if _, err := tracker.Database.Exec(usageIndexesSQL); err != nil {
+		return err
+	}
+
+	// Statements prepared against the previous schema may be stale, so always re-prepare
+	return tracker.prepareStatements()
+}
+
+// usageIndexesSQL creates the indexes of validator_usage, which are dropped when the
+// table is rebuilt by a migration.
+const usageIndexesSQL = `
 	CREATE INDEX IF NOT EXISTS idx_timestamp ON validator_usage(timestamp);
 	CREATE INDEX IF NOT EXISTS idx_validator ON validator_usage(validator_index);
+	CREATE INDEX IF NOT EXISTS idx_tenant_timestamp ON validator_usage(tenant, timestamp);
 	`
 
-	_, err := tracker.Database.Exec(createTableSQL)
-	return err
+// viewUsageQuery counts the buckets of each validator between two bucket timestamps.
+// Several tenants may record the same bucket, which only counts once.
+const viewUsageQuery = `
+	SELECT validator_index, COUNT(DISTINCT timestamp) as usage_count
+	FROM validator_usage
+	WHERE timestamp >= datetime(?, 'unixepoch') AND timestamp <= datetime(?, 'unixepoch')
+	GROUP BY validator_index
+	`
+
+// UsageConflictPolicy selects what a write of a bucket which was already recorded for
+// the same validator and tenant does.
+type UsageConflictPolicy string
+
+const (
+	// UsageConflictIgnore leaves the recorded bucket as it is. With occupancy, writes
+	// still extend its activity, see prepareOccupancyStatements.
+	UsageConflictIgnore UsageConflictPolicy = "ignore"
+	// UsageConflictReplace overwrites the recorded bucket, including the activity
+	// another instance recorded with occupancy, so the bucket is credited in full.
+	UsageConflictReplace UsageConflictPolicy = "replace"
+)
+
+// insertUsageQuery records a bucket of a tenant for a JSON array of validators. The
+// WHERE clause is required by SQLite for an upsert from a SELECT. Buckets which were
+// already recorded are left as they are, see UsageConflictIgnore.
+const insertUsageQuery = `
+	INSERT INTO validator_usage (timestamp, validator_index, tenant)
+	SELECT datetime(?, 'unixepoch'), value, ? FROM json_each(?) WHERE true
+	ON CONFLICT (timestamp, validator_index, tenant) DO NOTHING
+	`
+
+// replaceUsageQuery is insertUsageQuery for UsageConflictReplace. The row is updated
+// rather than deleted and inserted again, so it keeps its rowid, see ExportSince.
+const replaceUsageQuery = `
+	INSERT INTO validator_usage (timestamp, validator_index, tenant)
+	SELECT datetime(?, 'unixepoch'), value, ? FROM json_each(?) WHERE true
+	ON CONFLICT (timestamp, validator_index, tenant) DO UPDATE SET
+		first_offset_ms = excluded.first_offset_ms,
+		last_offset_ms = excluded.last_offset_ms
+	`
+
+func (tracker *SQLiteUsageTracker) prepareStatements() error {
+	tracker.closeStatements()
+
+	// Several instances may record the same validator in the same bucket. A bucket
+	// only needs to exist once per tenant, so conflicting inserts are ignored or
+	// replaced rather than failing the whole batch.
+	query := insertUsageQuery
+	if tracker.ConflictPolicy == UsageConflictReplace {
+		query = replaceUsageQuery
+	}
+	var err error
+	tracker.insertUsageStmt, err = tracker.Database.Prepare(query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert statement: %w", err)
+	}
+
+	tracker.viewUsageStmt, err = tracker.readDB().Prepare(viewUsageQuery)
+	if err != nil {
+		return fmt.Errorf("failed to prepare view statement: %w", err)
+	}
+
+	if tracker.Occupancy {
+		return tracker.prepareOccupancyStatements()
+	}
+	return nil
+}
+
+func (tracker *SQLiteUsageTracker) closeStatements() {
+	for _, stmt := range []*sql.Stmt{tracker.insertUsageStmt, tracker.viewUsageStmt, tracker.occupyUsageStmt, tracker.viewOccupancyStmt} {
+		if stmt != nil {
+			_ = stmt.Close()
+		}
+	}
+	tracker.insertUsageStmt = nil
+	tracker.viewUsageStmt = nil
+	tracker.occupyUsageStmt = nil
+	tracker.viewOccupancyStmt = nil
+}
+
+// isRetryableWriteError reports whether a write failed because another writer held the lock.
+func isRetryableWriteError(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
 }
 
 func (tracker *SQLiteUsageTracker) RecordUsage(indexes []string) error {
-	timestampUnix := time.Now().Truncate(tracker.Precision).Unix()
+	if tracker.MultiTenant {
+		return ErrTenantRequired
+	}
+	return tracker.recordLiveUsage("", indexes)
+}
+
+// recordLiveUsage records usage of tenant in the current bucket.
+func (tracker *SQLiteUsageTracker) recordLiveUsage(tenant string, indexes []string) error {
+	if err := ValidatePrecision(tracker.Precision); err != nil {
+		return err
+	}
+
+	now, err := tracker.timestamp()
+	if err != nil {
+		return err
+	}
+	return tracker.recordActivity(now, tenant, indexes)
+}
+
+// recordActivity records usage of tenant active at now, applying the boundary grace,
+// coalescing and occupancy of live usage.
+func (tracker *SQLiteUsageTracker) recordActivity(now time.Time, tenant string, indexes []string) error {
+	timestampUnix := now.Truncate(tracker.Precision).Unix()
+
+	if tracker.BoundaryGrace > 0 {
+		filtered := tracker.grace.filter(now, tracker.Precision, tracker.BoundaryGrace, indexes)
+		if skipped := len(indexes) - len(filtered); skipped > 0 {
+			tracker.addCounter("boundary_grace_skipped", skipped)
+		}
+		if len(filtered) == 0 {
+			return nil
+		}
+		indexes = filtered
+	}
+
+	if tracker.Coalesce {
+		pending := tracker.coalescer.pending(timestampUnix, tenant, indexes)
+		if skipped := len(indexes) - len(pending); skipped > 0 {
+			tracker.addCounter("coalesced", skipped)
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		indexes = pending
+	}
+
+	err := retryUsageWrite(tracker.Logger, tracker.WriteRetries, func() {
+		tracker.incCounter("write_retries")
+	}, func() error {
+		return tracker.Faults.write(indexes, func(indexes []string) error {
+			if tracker.Occupancy {
+				return tracker.recordOccupancy(timestampUnix, now.Sub(now.Truncate(tracker.Precision)), tenant, indexes)
+			}
+			return tracker.recordTenantUsage(timestampUnix, tenant, indexes)
+		})
+	})
+	if err == nil && tracker.Coalesce {
+		tracker.coalescer.done(timestampUnix, tenant, indexes)
+	}
+	return err
+}
+
+// retryUsageWrite calls write until it succeeds, fails with an error other than a busy
+// database, or has been retried retries times. Retries back off exponentially.
+func retryUsageWrite(logger *zap.Logger, retries int, onRetry func(), write func() error) error {
+	backoff := 10 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil || attempt >= retries || !isRetryableWriteError(err) {
+			return err
+		}
+
+		onRetry()
+		logger.Debug("Usage database busy, retrying write",
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (tracker *SQLiteUsageTracker) recordUsage(timestampUnix int64, indexes []string) error {
+	return tracker.recordTenantUsage(timestampUnix, "", indexes)
+}
+
+// recordTenantUsage records every validator in a single statement, which is atomic
+// without a transaction. With TxLock, the statement runs in a transaction of that mode,
+// which costs a few allocations per write.
+func (tracker *SQLiteUsageTracker) recordTenantUsage(timestampUnix int64, tenant string, indexes []string) error {
+	if tracker.closed.Load() {
+		return ErrTrackerClosed
+	}
+	if tracker.TxLock == "" {
+		return tracker.insertUsage(tracker.insertUsageStmt, timestampUnix, tenant, indexes)
+	}
 
 	tx, err := tracker.Database.Begin()
 	if err != nil {
@@ -69,45 +790,60 @@ func (tracker *SQLiteUsageTracker) RecordUsage(indexes []string) error {
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.Prepare("INSERT OR IGNORE INTO validator_usage (timestamp, validator_index) VALUES (datetime(?, 'unixepoch'), ?)")
-	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %w", err)
-	}
+	stmt := tx.Stmt(tracker.insertUsageStmt)
 	defer stmt.Close()
+	if err := tracker.insertUsage(stmt, timestampUnix, tenant, indexes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	for _, index := range indexes {
-		_, err := stmt.Exec(timestampUnix, index)
-		if err != nil {
-			tracker.Logger.Error("Failed to store index usage",
-				zap.String("index", index),
-				zap.Int64("timestamp_unix", timestampUnix),
-				zap.Error(err))
-			return fmt.Errorf("failed to insert usage for validator %s at %d: %w", index, timestampUnix, err)
-		}
+func (tracker *SQLiteUsageTracker) insertUsage(stmt *sql.Stmt, timestampUnix int64, tenant string, indexes []string) error {
+	buf := validatorListPool.Get().(*[]byte)
+	*buf = appendValidatorList((*buf)[:0], indexes)
+	_, err := stmt.Exec(timestampUnix, tenant, string(*buf))
+	validatorListPool.Put(buf)
+	if err != nil {
+		tracker.Logger.Error("Failed to store index usage",
+			zap.Strings("indexes", indexes),
+			zap.Int64("timestamp_unix", timestampUnix),
+			zap.Error(err))
+		return fmt.Errorf("failed to insert usage for %d validators at %d: %w", len(indexes), timestampUnix, err)
+	}
 
-		tracker.Logger.Debug("Recorded index usage",
-			zap.String("index", index),
+	// Fields are only built when debug logs are enabled
+	if ce := tracker.Logger.Check(zap.DebugLevel, "Recorded index usage"); ce != nil {
+		ce.Write(zap.Strings("indexes", indexes),
 			zap.Int64("quantized_timestamp_unix", timestampUnix),
 			zap.Duration("precision", tracker.Precision))
 	}
 
-	return tx.Commit()
+	return nil
 }
 
 func (tracker *SQLiteUsageTracker) ViewUsage(from time.Time, to time.Time) (map[string]time.Duration, error) {
-	result := make(map[string]time.Duration)
+	if err := ValidatePrecision(tracker.Precision); err != nil {
+		return nil, err
+	}
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+	if err := tracker.Faults.read(); err != nil {
+		return nil, err
+	}
+	if tracker.closed.Load() {
+		return nil, ErrTrackerClosed
+	}
 
 	fromUnix := from.Truncate(tracker.Precision).Unix()
 	toUnix := to.Truncate(tracker.Precision).Unix()
+	if tracker.Occupancy {
+		return tracker.viewOccupancy(fromUnix, toUnix)
+	}
 
-	query := `
-	SELECT validator_index, COUNT(*) as usage_count
-	FROM validator_usage 
-	WHERE timestamp >= datetime(?, 'unixepoch') AND timestamp <= datetime(?, 'unixepoch')
-	GROUP BY validator_index
-	`
+	result := make(map[string]time.Duration)
 
-	rows, err := tracker.Database.Query(query, fromUnix, toUnix)
+	rows, err := tracker.viewUsageStmt.Query(fromUnix, toUnix)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query usage data: %w", err)
 	}
@@ -137,7 +873,20 @@ func (tracker *SQLiteUsageTracker) ViewUsage(from time.Time, to time.Time) (map[
 	return result, rows.Err()
 }
 
+// Close closes the databases. Later calls fail with ErrTrackerClosed.
 func (tracker *SQLiteUsageTracker) Close() {
+	if tracker.closed.Swap(true) {
+		return
+	}
+	if tracker.m != nil {
+		tracker.m.UnregisterAll()
+	}
+	tracker.closeStatements()
+	if tracker.ReadDatabase != nil {
+		if err := tracker.ReadDatabase.Close(); err != nil {
+			tracker.Logger.Error("Failed to close SQLite read replica", zap.Error(err))
+		}
+	}
 	if err := tracker.Database.Close(); err != nil {
 		tracker.Logger.Error("Failed to close SQLite database", zap.Error(err))
 	}
@@ -0,0 +1,869 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// AdminHandler serves the router's endpoints of the admin API.
+// It must only be mounted on the admin listener, as it is unauthenticated.
+func (pr *ProxyRouter) AdminHandler() http.Handler {
+	router := mux.NewRouter()
+	router.Use(checkDurationFormat)
+	router.Use(pr.checkReadBreaker)
+	router.Use(pr.checkQueryCost)
+	router.Use(pr.checkIdempotencyKey)
+
+	router.Path("/usage").Methods(http.MethodGet).HandlerFunc(pr.serveUsage)
+	router.Path("/usage/ranges").Methods(http.MethodGet).HandlerFunc(pr.serveUsageRanges)
+	router.Path("/usage/reconcile").Methods(http.MethodGet).HandlerFunc(pr.serveUsageReconcile)
+	router.Path("/usage/commitment").Methods(http.MethodGet).HandlerFunc(pr.serveUsageCommitment)
+	router.Path("/usage/proof").Methods(http.MethodGet).HandlerFunc(pr.serveUsageProof)
+	router.Path("/usage/duties").Methods(http.MethodGet).HandlerFunc(pr.serveDutyCoverage)
+	router.Path("/usage/health").Methods(http.MethodGet).HandlerFunc(pr.serveUsageHealth)
+	router.Path("/usage/slo").Methods(http.MethodGet).HandlerFunc(pr.serveUsageSLO)
+	router.Path("/usage/capabilities").Methods(http.MethodGet).HandlerFunc(pr.serveUsageCapabilities)
+	router.Path("/usage/tiers").Methods(http.MethodGet).HandlerFunc(pr.serveUsageTiers)
+	router.Path("/usage/owners").Methods(http.MethodGet).HandlerFunc(pr.serveUsageOwners)
+	router.Path("/usage/daily").Methods(http.MethodGet).HandlerFunc(pr.serveDailyUsage)
+	router.Path("/usage/validators").Methods(http.MethodGet).HandlerFunc(pr.serveValidatorUsage)
+	router.Path("/usage/export").Methods(http.MethodGet).HandlerFunc(pr.serveUsageExport)
+	router.Path("/usage/incidents").Methods(http.MethodGet).HandlerFunc(pr.serveUsageIncidents)
+	router.Path("/usage/operators/daily").Methods(http.MethodGet).HandlerFunc(pr.serveOperatorDailyUsage)
+
+	router.Path("/validators/aliases").Methods(http.MethodGet).HandlerFunc(pr.serveListAliases)
+	router.Path("/validators/shared").Methods(http.MethodGet).HandlerFunc(pr.serveSharedValidators)
+	aliases := router.Path("/validators/{alias}/alias").Subrouter()
+	aliases.Methods(http.MethodPut).HandlerFunc(pr.servePutAlias)
+	aliases.Methods(http.MethodDelete).HandlerFunc(pr.serveDeleteAlias)
+	router.Path("/validators/{validator}/owners").Methods(http.MethodGet).HandlerFunc(pr.serveValidatorOwners)
+	router.Path("/validators/{validator}/requests").Methods(http.MethodGet).HandlerFunc(pr.serveRequestSamples)
+
+	router.Path("/organizations").Methods(http.MethodGet).HandlerFunc(pr.serveListOrganizations)
+	organization := router.Path("/organizations/{org}").Subrouter()
+	organization.Methods(http.MethodGet).HandlerFunc(pr.serveGetOrganization)
+	organization.Methods(http.MethodPut).HandlerFunc(pr.servePutOrganization)
+	organization.Methods(http.MethodDelete).HandlerFunc(pr.serveDeleteOrganization)
+	members := router.Path("/organizations/{org}/members/{node:0x[0-9a-fA-F]{40}}").Subrouter()
+	members.Methods(http.MethodPut).HandlerFunc(pr.servePutOrganizationMember)
+	members.Methods(http.MethodDelete).HandlerFunc(pr.serveDeleteOrganizationMember)
+	router.Path("/organizations/{org}/usage").Methods(http.MethodGet).HandlerFunc(pr.serveOrganizationUsage)
+	keys := router.Path("/organizations/{org}/keys").Subrouter()
+	keys.Methods(http.MethodGet).HandlerFunc(pr.serveListTenantKeys)
+	keys.Methods(http.MethodPost).HandlerFunc(pr.serveCreateTenantKey)
+	router.Path("/organizations/{org}/keys/{id}").Methods(http.MethodDelete).HandlerFunc(pr.serveRevokeTenantKey)
+
+	backfillKeys := router.Path("/backfill/keys").Subrouter()
+	backfillKeys.Methods(http.MethodGet).HandlerFunc(pr.serveListBackfillKeys)
+	backfillKeys.Methods(http.MethodPost).HandlerFunc(pr.serveCreateBackfillKey)
+	router.Path("/backfill/keys/{id}").Methods(http.MethodDelete).HandlerFunc(pr.serveRevokeBackfillKey)
+
+	router.Path("/operators/notifications").Methods(http.MethodGet).HandlerFunc(pr.serveListPreferences)
+	notifications := router.Path("/operators/{node:0x[0-9a-fA-F]{40}}/notifications").Subrouter()
+	notifications.Methods(http.MethodGet).HandlerFunc(pr.serveGetPreferences)
+	notifications.Methods(http.MethodPut).HandlerFunc(pr.servePutPreferences)
+	notifications.Methods(http.MethodDelete).HandlerFunc(pr.serveDeletePreferences)
+	router.Path("/operators/{node:0x[0-9a-fA-F]{40}}/export").Methods(http.MethodGet).HandlerFunc(pr.serveOperatorExport)
+	router.Path("/operators/{node:0x[0-9a-fA-F]{40}}/attestation").Methods(http.MethodGet).HandlerFunc(pr.serveOperatorAttestation)
+	public := router.Path("/operators/{node:0x[0-9a-fA-F]{40}}/public").Subrouter()
+	public.Methods(http.MethodPut).HandlerFunc(pr.servePutPublicUsage)
+	public.Methods(http.MethodDelete).HandlerFunc(pr.serveDeletePublicUsage)
+	offboarding := router.Path("/operators/{node:0x[0-9a-fA-F]{40}}/offboarding").Subrouter()
+	offboarding.Methods(http.MethodGet).HandlerFunc(pr.serveOffboardingAudit)
+	offboarding.Methods(http.MethodPost).HandlerFunc(pr.serveOffboard)
+
+	router.Path("/reports").Methods(http.MethodGet).HandlerFunc(pr.serveListSavedReports)
+	reports := router.Path("/reports/{name}").Subrouter()
+	reports.Methods(http.MethodGet).HandlerFunc(pr.serveGetSavedReport)
+	reports.Methods(http.MethodPut).HandlerFunc(pr.servePutSavedReport)
+	reports.Methods(http.MethodDelete).HandlerFunc(pr.serveDeleteSavedReport)
+
+	router.Path("/incidents").Methods(http.MethodGet).HandlerFunc(pr.serveListIncidents)
+	incidents := router.Path("/incidents/{id}").Subrouter()
+	incidents.Methods(http.MethodGet).HandlerFunc(pr.serveGetIncident)
+	incidents.Methods(http.MethodPut).HandlerFunc(pr.servePutIncident)
+	incidents.Methods(http.MethodDelete).HandlerFunc(pr.serveDeleteIncident)
+	router.Path("/incidents/{id}/usage").Methods(http.MethodGet).HandlerFunc(pr.serveIncidentUsage)
+
+	router.Path("/bulk/delete").Methods(http.MethodPost).HandlerFunc(pr.serveBulkDelete)
+	router.Path("/pending").Methods(http.MethodGet).HandlerFunc(pr.serveListPendingDeletions)
+	router.Path("/pending/{id}").Methods(http.MethodDelete).HandlerFunc(pr.serveCancelPendingDeletion)
+
+	return router
+}
+
+// parseUsageRange reads the RFC3339 from and to query parameters.
+func parseUsageRange(r *http.Request) (time.Time, time.Time, error) {
+	query := r.URL.Query()
+
+	from, err := time.Parse(time.RFC3339, query.Get("from"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid from: %w", err)
+	}
+	to, err := time.Parse(time.RFC3339, query.Get("to"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %w", err)
+	}
+
+	return from, to, nil
+}
+
+// writeUsageJSON writes v with the durations format requested by r, and timestamps
+// in UTC, see parseDurationFormat.
+func (pr *ProxyRouter) writeUsageJSON(w http.ResponseWriter, r *http.Request, v any) {
+	pr.writeUsageJSONStatus(w, r, http.StatusOK, v)
+}
+
+func (pr *ProxyRouter) writeUsageJSONStatus(w http.ResponseWriter, r *http.Request, status int, v any) {
+	// Validated by checkDurationFormat
+	format, err := parseDurationFormat(r)
+	if err != nil {
+		format = DurationNanoseconds
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(formatResponse(v, format)); err != nil {
+		pr.Logger.Warn("Failed to write usage admin response", zap.Error(err))
+	}
+}
+
+// serveUsage returns the usage of every validator in the buckets overlapping [from, to],
+// with the usage of aliases merged into their validators unless aliases=false. With
+// incidents=exclude, usage recorded during incidents which are exclusion windows is
+// left out, so it isn't counted towards quotas.
+func (pr *ProxyRouter) serveUsage(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var usage map[string]time.Duration
+	switch r.URL.Query().Get("incidents") {
+	case "", "include":
+		usage, err = pr.usage().ViewUsage(from, to)
+	case "exclude":
+		if !pr.requireUsageCapability(w, "excluding incident usage", UsageCapabilityBuckets) {
+			return
+		}
+		store, ok := pr.incidentStore(w)
+		if !ok {
+			return
+		}
+		var report *IncidentUsageReport
+		report, err = IncidentUsage(pr.ut.(usageBuckets), store, from, to)
+		if err == nil {
+			usage = make(map[string]time.Duration, len(report.Counted))
+			for validator, d := range report.Counted {
+				usage[validator.String()] = d
+			}
+		}
+	default:
+		http.Error(w, "invalid incidents, must be include or exclude", http.StatusBadRequest)
+		return
+	}
+	if err == nil && pr.alias != nil && r.URL.Query().Get("aliases") != "false" {
+		usage, err = pr.alias.LinkUsage(usage)
+	}
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to view usage", zap.Error(err))
+		http.Error(w, "failed to view usage", http.StatusInternalServerError)
+		return
+	}
+
+	seconds := make(map[string]float64, len(usage))
+	for validator, d := range usage {
+		seconds[validator] = d.Seconds()
+	}
+	pr.writeUsageJSON(w, r, seconds)
+}
+
+// serveUsageReconcile compares bucket and session usage, see HybridUsageTracker.Reconcile.
+// The optional tolerance parameter defaults to the bucket precision.
+func (pr *ProxyRouter) serveUsageReconcile(w http.ResponseWriter, r *http.Request) {
+	if !pr.requireUsageCapability(w, "reconciliation", UsageCapabilityReconciliation) {
+		return
+	}
+	hybrid := pr.ut.(*HybridUsageTracker)
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tolerance := hybrid.Buckets.Precision
+	if t := r.URL.Query().Get("tolerance"); t != "" {
+		tolerance, err = time.ParseDuration(t)
+		if err != nil || tolerance < 0 {
+			http.Error(w, fmt.Sprintf("invalid tolerance: %s", t), http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := hybrid.Reconcile(from, to, tolerance)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to reconcile usage", zap.Error(err))
+		http.Error(w, "failed to reconcile usage", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
+
+// serveUsageCommitment returns the Merkle root over the records of buckets starting
+// in [from, to).
+func (pr *ProxyRouter) serveUsageCommitment(w http.ResponseWriter, r *http.Request) {
+	if !pr.requireUsageCapability(w, "usage commitments", UsageCapabilityCommitments) {
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	commitment, err := CommitUsage(pr.ut, from, to)
+	if err != nil {
+		pr.writeCommitmentError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, commitment)
+}
+
+// serveUsageProof returns inclusion proofs for the records of a validator, along
+// with the commitment they verify against.
+func (pr *ProxyRouter) serveUsageProof(w http.ResponseWriter, r *http.Request) {
+	if !pr.requireUsageCapability(w, "usage commitments", UsageCapabilityCommitments) {
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	param := r.URL.Query().Get("validator")
+	if param == "" {
+		http.Error(w, "missing validator", http.StatusBadRequest)
+		return
+	}
+	validator, ok := pr.validatorParam(w, param)
+	if !ok {
+		return
+	}
+
+	commitment, proofs, err := ProveUsage(pr.ut, from, to, validator.String())
+	if err != nil {
+		pr.writeCommitmentError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, struct {
+		Commitment *UsageCommitment      `json:"commitment"`
+		Proofs     []UsageInclusionProof `json:"proofs"`
+	}{commitment, proofs})
+}
+
+func (pr *ProxyRouter) writeCommitmentError(w http.ResponseWriter, err error) {
+	var rangeErr *RangeError
+	switch {
+	case errors.As(err, &rangeErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNoUsageRecord):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		pr.Logger.Error("Failed to compute usage commitment", zap.Error(err))
+		http.Error(w, "failed to compute usage commitment", http.StatusInternalServerError)
+	}
+}
+
+// serveDutyCoverage summarizes the coverage of the duties due in [from, to),
+// see DutyCoverageJob.
+func (pr *ProxyRouter) serveDutyCoverage(w http.ResponseWriter, r *http.Request) {
+	if pr.duty == nil {
+		http.Error(w, "duty coverage requires -duty-coverage", http.StatusNotImplemented)
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := pr.duty.Report(from, to)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to report duty coverage", zap.Error(err))
+		http.Error(w, "failed to report duty coverage", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
+
+// serveUsageTiers breaks usage in the buckets overlapping [from, to] down by the tier of
+// the credentials it was recorded with.
+func (pr *ProxyRouter) serveUsageTiers(w http.ResponseWriter, r *http.Request) {
+	if pr.tiers == nil {
+		http.Error(w, "credential tiers require -usage-model=buckets or hybrid", http.StatusNotImplemented)
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := pr.tiers.Breakdown(from, to)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to break usage down by tier", zap.Error(err))
+		http.Error(w, "failed to break usage down by tier", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
+
+// serveUsageOwners attributes usage in the buckets overlapping [from, to] to the owners
+// of the validators at the time of usage.
+func (pr *ProxyRouter) serveUsageOwners(w http.ResponseWriter, r *http.Request) {
+	if pr.owners == nil {
+		http.Error(w, "ownership requires -usage-ownership-interval", http.StatusNotImplemented)
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Snapshots are only taken with a bucketed usage model
+	report, err := pr.owners.Report(pr.ut.(usageBuckets), from, to)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to attribute usage to owners", zap.Error(err))
+		http.Error(w, "failed to attribute usage to owners", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
+
+// serveSharedValidators returns the validators attributed to more than one operator in
+// [from, to], see SharedValidators.
+func (pr *ProxyRouter) serveSharedValidators(w http.ResponseWriter, r *http.Request) {
+	if pr.attr == nil && pr.owners == nil {
+		http.Error(w, "shared validators require attribution or -usage-ownership-interval", http.StatusNotImplemented)
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := SharedValidators(pr.attr, pr.owners, from, to)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to report shared validators", zap.Error(err))
+		http.Error(w, "failed to report shared validators", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
+
+// serveValidatorOwners returns the ownership history of a validator.
+func (pr *ProxyRouter) serveValidatorOwners(w http.ResponseWriter, r *http.Request) {
+	if pr.owners == nil {
+		http.Error(w, "ownership requires -usage-ownership-interval", http.StatusNotImplemented)
+		return
+	}
+
+	validator, ok := pr.validatorParam(w, mux.Vars(r)["validator"])
+	if !ok {
+		return
+	}
+
+	history, err := pr.owners.History(validator.String())
+	if err != nil {
+		pr.Logger.Error("Failed to get ownership history", zap.Error(err))
+		http.Error(w, "failed to get ownership history", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, history)
+}
+
+// serveUsageHealth returns the tracking mode, with a 503 while usage isn't recorded.
+func (pr *ProxyRouter) serveUsageHealth(w http.ResponseWriter, r *http.Request) {
+	if pr.health == nil {
+		http.Error(w, "usage tracking isn't initialized", http.StatusServiceUnavailable)
+		return
+	}
+
+	status := pr.health.Status()
+	if status.Mode == TrackingBackendDown || status.Mode == TrackingWritesFailing {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			pr.Logger.Warn("Failed to write usage admin response", zap.Error(err))
+		}
+		return
+	}
+	pr.writeUsageJSON(w, r, status)
+}
+
+func (pr *ProxyRouter) aliasStore(w http.ResponseWriter) (*AliasStore, bool) {
+	if pr.alias == nil {
+		http.Error(w, "validator aliases require a SQL usage tracker", http.StatusNotImplemented)
+		return nil, false
+	}
+	return pr.alias, true
+}
+
+func (pr *ProxyRouter) serveListAliases(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.aliasStore(w)
+	if !ok {
+		return
+	}
+
+	aliases, err := store.List()
+	if err != nil {
+		pr.Logger.Error("Failed to list validator aliases", zap.Error(err))
+		http.Error(w, "failed to list validator aliases", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, aliases)
+}
+
+// servePutAlias links the usage of the alias in the path to the validator in the body.
+func (pr *ProxyRouter) servePutAlias(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.aliasStore(w)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Validator string `json:"validator"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid alias: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	alias, err := store.Put(mux.Vars(r)["alias"], body.Validator)
+	switch {
+	case errors.Is(err, ErrInvalidAlias):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrAliasChain):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		pr.Logger.Error("Failed to store validator alias", zap.Error(err))
+		http.Error(w, "failed to store validator alias", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, alias)
+}
+
+func (pr *ProxyRouter) serveDeleteAlias(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.aliasStore(w)
+	if !ok {
+		return
+	}
+
+	alias := mux.Vars(r)["alias"]
+	if pr.stageDeletion(w, r, &BulkDeletion{Aliases: []string{alias}}, ErrNoAlias) {
+		return
+	}
+
+	err := store.Delete(alias)
+	if errors.Is(err, ErrNoAlias) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		pr.Logger.Error("Failed to delete validator alias", zap.Error(err))
+		http.Error(w, "failed to delete validator alias", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (pr *ProxyRouter) organizationStore(w http.ResponseWriter) (*OrganizationStore, bool) {
+	if pr.orgs == nil {
+		http.Error(w, "organizations require a SQL usage tracker", http.StatusNotImplemented)
+		return nil, false
+	}
+	return pr.orgs, true
+}
+
+// writeOrganizationError maps organization store errors to status codes.
+func (pr *ProxyRouter) writeOrganizationError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidOrganization):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrNoOrganization), errors.Is(err, ErrNotMember):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		pr.Logger.Error("Failed to access organizations", zap.Error(err))
+		http.Error(w, "failed to access organizations", http.StatusInternalServerError)
+	}
+}
+
+func (pr *ProxyRouter) serveListOrganizations(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.organizationStore(w)
+	if !ok {
+		return
+	}
+
+	orgs, err := store.List()
+	if err != nil {
+		pr.writeOrganizationError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, orgs)
+}
+
+func (pr *ProxyRouter) serveGetOrganization(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.organizationStore(w)
+	if !ok {
+		return
+	}
+
+	org, err := store.Get(mux.Vars(r)["org"])
+	if err != nil {
+		pr.writeOrganizationError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, org)
+}
+
+// servePutOrganization creates or updates the organization in the path.
+func (pr *ProxyRouter) servePutOrganization(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.organizationStore(w)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name          string `json:"name"`
+		RetentionDays int    `json:"retention_days"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid organization: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	id := mux.Vars(r)["org"]
+	if err := store.Put(&Organization{ID: id, Name: body.Name, RetentionDays: body.RetentionDays}); err != nil {
+		pr.writeOrganizationError(w, err)
+		return
+	}
+
+	org, err := store.Get(id)
+	if err != nil {
+		pr.writeOrganizationError(w, err)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, org)
+}
+
+func (pr *ProxyRouter) serveDeleteOrganization(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.organizationStore(w)
+	if !ok {
+		return
+	}
+
+	id := mux.Vars(r)["org"]
+	if pr.stageDeletion(w, r, &BulkDeletion{Organizations: []string{id}}, ErrNoOrganization) {
+		return
+	}
+
+	if err := store.Delete(id); err != nil {
+		pr.writeOrganizationError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (pr *ProxyRouter) servePutOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.organizationStore(w)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	if err := store.AddMember(vars["org"], common.HexToAddress(vars["node"])); err != nil {
+		pr.writeOrganizationError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (pr *ProxyRouter) serveDeleteOrganizationMember(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.organizationStore(w)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+	member := BulkMember{Organization: vars["org"], Node: common.HexToAddress(vars["node"])}
+	if pr.stageDeletion(w, r, &BulkDeletion{Members: []BulkMember{member}}, ErrNotMember) {
+		return
+	}
+
+	if err := store.RemoveMember(member.Organization, member.Node); err != nil {
+		pr.writeOrganizationError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveOrganizationUsage aggregates the usage of an organization's members,
+// see OrganizationUsageReport.
+func (pr *ProxyRouter) serveOrganizationUsage(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.organizationStore(w)
+	if !ok {
+		return
+	}
+	if pr.attr == nil {
+		http.Error(w, "organization usage is unavailable without validator attribution", http.StatusNotImplemented)
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	org, err := store.Get(mux.Vars(r)["org"])
+	if err != nil {
+		pr.writeOrganizationError(w, err)
+		return
+	}
+
+	report, err := OrganizationUsageReport(pr.usage(), pr.attr, org, from, to)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to report organization usage", zap.Error(err))
+		http.Error(w, "failed to report organization usage", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
+
+func (pr *ProxyRouter) preferencesStore(w http.ResponseWriter) (*PreferencesStore, bool) {
+	if pr.prefs == nil {
+		http.Error(w, "notification preferences require a SQL usage tracker", http.StatusNotImplemented)
+		return nil, false
+	}
+	return pr.prefs, true
+}
+
+func (pr *ProxyRouter) serveListPreferences(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.preferencesStore(w)
+	if !ok {
+		return
+	}
+
+	prefs, err := store.List()
+	if err != nil {
+		pr.Logger.Error("Failed to list notification preferences", zap.Error(err))
+		http.Error(w, "failed to list notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, prefs)
+}
+
+func (pr *ProxyRouter) serveGetPreferences(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.preferencesStore(w)
+	if !ok {
+		return
+	}
+
+	prefs, err := store.Get(common.HexToAddress(mux.Vars(r)["node"]))
+	if errors.Is(err, ErrNoPreferences) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		pr.Logger.Error("Failed to get notification preferences", zap.Error(err))
+		http.Error(w, "failed to get notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, prefs)
+}
+
+// servePutPreferences replaces the preferences of a node. The node address in the
+// body, if any, must match the path.
+func (pr *ProxyRouter) servePutPreferences(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.preferencesStore(w)
+	if !ok {
+		return
+	}
+
+	node := common.HexToAddress(mux.Vars(r)["node"])
+	prefs := &NotificationPreferences{}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(prefs); err != nil {
+		http.Error(w, fmt.Sprintf("invalid preferences: %v", err), http.StatusBadRequest)
+		return
+	}
+	if prefs.NodeAddress != (common.Address{}) && prefs.NodeAddress != node {
+		http.Error(w, "node address doesn't match the path", http.StatusBadRequest)
+		return
+	}
+	prefs.NodeAddress = node
+
+	if err := prefs.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := store.Put(prefs); err != nil {
+		pr.Logger.Error("Failed to store notification preferences", zap.Error(err))
+		http.Error(w, "failed to store notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, prefs)
+}
+
+func (pr *ProxyRouter) serveDeletePreferences(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.preferencesStore(w)
+	if !ok {
+		return
+	}
+
+	node := common.HexToAddress(mux.Vars(r)["node"])
+	if pr.stageDeletion(w, r, &BulkDeletion{Notifications: []common.Address{node}}, ErrNoPreferences) {
+		return
+	}
+
+	err := store.Delete(node)
+	if errors.Is(err, ErrNoPreferences) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		pr.Logger.Error("Failed to delete notification preferences", zap.Error(err))
+		http.Error(w, "failed to delete notification preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveOperatorExport returns the signed archive of everything stored about a node,
+// see OperatorExporter.
+func (pr *ProxyRouter) serveOperatorExport(w http.ResponseWriter, r *http.Request) {
+	if pr.ReportSigningKey == nil {
+		http.Error(w, "exports require -report-signing-key", http.StatusNotImplemented)
+		return
+	}
+	store, ok := pr.preferencesStore(w)
+	if !ok {
+		return
+	}
+	if pr.attr == nil {
+		http.Error(w, "exports require a SQL usage tracker", http.StatusNotImplemented)
+		return
+	}
+
+	node := common.HexToAddress(mux.Vars(r)["node"])
+	exporter := &OperatorExporter{
+		Tracker:     pr.ut,
+		Attribution: pr.attr,
+		Preferences: store,
+		SigningKey:  pr.ReportSigningKey,
+		Logger:      pr.Logger,
+	}
+
+	// Buffer the archive so failures can still be reported with a status code
+	var archive bytes.Buffer
+	err := exporter.Export(&archive, node)
+	if errors.Is(err, ErrNoOperatorData) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		pr.Logger.Error("Failed to export operator data", zap.Error(err))
+		http.Error(w, "failed to export operator data", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.tar.gz"`, node.Hex()))
+	if _, err := archive.WriteTo(w); err != nil {
+		pr.Logger.Warn("Failed to write operator export", zap.Error(err))
+	}
+}
@@ -0,0 +1,156 @@
+//go:build ns
+
+package router
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ReadBreakerOptions configures the circuit breaker in front of admin API reads.
+type ReadBreakerOptions struct {
+	// Consecutive failed or slow reads which open the breaker. 0 disables it.
+	Failures int
+	// How long the breaker stays open before a read is let through to probe the
+	// database again
+	Cooldown time.Duration
+	// Reads taking longer than this count as failed. 0 only counts server errors.
+	SlowRead time.Duration
+}
+
+// ReadBreaker stops admin API reads from reaching the database while it's failing or
+// slow, so a sick backend or a pathological query isn't made worse by retries and
+// dashboards get a clear error right away.
+//
+// Only reads go through the breaker. Usage is recorded without the admin API, so the
+// write path, with its buffering and spooling, keeps working while it's open.
+type ReadBreaker struct {
+	Options ReadBreakerOptions
+	Logger  *zap.Logger
+
+	mu       sync.Mutex
+	failures int
+	// When the breaker opened, zero while it's closed
+	openedAt time.Time
+	// Whether a read is probing the database after the cooldown
+	probing bool
+
+	wallClock
+}
+
+// allow returns whether a read may go through, and otherwise how long until it may
+// be retried.
+func (b *ReadBreaker) allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.openedAt.IsZero() {
+		return true, 0
+	}
+	if wait := b.openedAt.Add(b.Options.Cooldown).Sub(b.clock()); wait > 0 {
+		return false, wait
+	}
+	if b.probing {
+		return false, 0
+	}
+	b.probing = true
+	return true, 0
+}
+
+// record counts the outcome of a read which went through.
+func (b *ReadBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if !b.openedAt.IsZero() {
+			b.Logger.Info("Admin read breaker closed, the usage database recovered")
+		}
+		b.failures = 0
+		b.openedAt = time.Time{}
+		b.probing = false
+		return
+	}
+
+	b.failures++
+	if b.probing || b.failures >= b.Options.Failures {
+		if b.openedAt.IsZero() {
+			b.Logger.Warn("Admin read breaker opened, reads fail fast until the usage database recovers",
+				zap.Int("failures", b.failures),
+				zap.Duration("cooldown", b.Options.Cooldown))
+		}
+		b.openedAt = b.clock()
+		b.probing = false
+	}
+}
+
+// Open returns whether reads are currently refused.
+func (b *ReadBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !b.openedAt.IsZero()
+}
+
+// statusRecorder keeps the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// checkReadBreaker refuses admin reads with a 503 while the breaker is open, and counts
+// server errors and slow responses of the reads it lets through.
+func (pr *ProxyRouter) checkReadBreaker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The health endpoint reports on the write path, and must answer regardless
+		if pr.breaker == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.URL.Path == "/usage/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ok, wait := pr.breaker.allow()
+		if !ok {
+			if pr.m != nil {
+				pr.m.Counter("admin_read_breaker_refused").Inc()
+			}
+			retry := int(math.Max(1, math.Ceil(wait.Seconds())))
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			http.Error(w, fmt.Sprintf("usage database reads are failing, retry in %ds", retry), http.StatusServiceUnavailable)
+			return
+		}
+
+		start := pr.breaker.clock()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		duration := pr.breaker.clock().Sub(start)
+		slow := pr.breaker.Options.SlowRead > 0 && duration > pr.breaker.Options.SlowRead
+		if slow {
+			pr.Logger.Warn("Slow admin read",
+				zap.String("uri", r.URL.RequestURI()),
+				zap.Duration("duration", duration))
+		}
+		// 501s are features which aren't configured, not failures of the database
+		failed := rec.status >= http.StatusInternalServerError && rec.status != http.StatusNotImplemented
+		pr.breaker.record(slow || failed)
+	})
+}
@@ -0,0 +1,131 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+// failingReads fails ViewUsage while err is set.
+type failingReads struct {
+	UsageTracker
+	err error
+}
+
+func (tracker *failingReads) ViewUsage(from time.Time, to time.Time) (map[string]time.Duration, error) {
+	if tracker.err != nil {
+		return nil, tracker.err
+	}
+	return tracker.UsageTracker.ViewUsage(from, to)
+}
+
+func TestReadBreaker(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	tracker := &failingReads{UsageTracker: pr.ut, err: errors.New("disk I/O error")}
+	pr.ut = tracker
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	pr.breaker = &ReadBreaker{
+		Options:   ReadBreakerOptions{Failures: 2, Cooldown: time.Minute},
+		Logger:    zaptest.NewLogger(t),
+		wallClock: wallClock{now: func() time.Time { return now }},
+	}
+	handler := pr.AdminHandler()
+
+	serve := func(method string, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(`{"validator": "3"}`)))
+		return rec
+	}
+	const usage = "/usage?from=2025-01-01T00:00:00Z&to=2025-01-01T00:00:00Z"
+
+	for i := 0; i < 2; i++ {
+		if rec := serve(http.MethodGet, usage); rec.Code != http.StatusInternalServerError {
+			t.Fatalf("Expected %d, got %d", http.StatusInternalServerError, rec.Code)
+		}
+	}
+	rec := serve(http.MethodGet, usage)
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "60" {
+		t.Fatalf("Expected the breaker to be open, got %d with Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if !pr.breaker.Open() {
+		t.Fatal("Expected the breaker to be open")
+	}
+
+	// Writes and the health endpoint aren't refused
+	if rec := serve(http.MethodPut, "/validators/gamma/alias"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected writes to go through, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(http.MethodGet, "/usage/health"); rec.Code == http.StatusServiceUnavailable && strings.Contains(rec.Body.String(), "retry in") {
+		t.Fatal("Expected the health endpoint to bypass the breaker")
+	}
+
+	// A failed probe opens the breaker again
+	now = now.Add(time.Minute)
+	if rec := serve(http.MethodGet, usage); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected the probe to go through, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodGet, usage); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the breaker to open again, got %d", rec.Code)
+	}
+
+	// A successful probe closes it
+	now = now.Add(time.Minute)
+	tracker.err = nil
+	if rec := serve(http.MethodGet, usage); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the probe to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if pr.breaker.Open() {
+		t.Fatal("Expected the breaker to be closed")
+	}
+
+	// Slow reads count as failures
+	pr.breaker.Options.SlowRead = time.Second
+	pr.breaker.now = func() time.Time {
+		now = now.Add(2 * time.Second)
+		return now
+	}
+	for i := 0; i < 2; i++ {
+		if rec := serve(http.MethodGet, usage); rec.Code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, rec.Code)
+		}
+	}
+	if !pr.breaker.Open() {
+		t.Fatal("Expected slow reads to open the breaker")
+	}
+}
+
+func TestReadBreakerProbe(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &ReadBreaker{
+		Options:   ReadBreakerOptions{Failures: 1, Cooldown: time.Minute},
+		Logger:    zaptest.NewLogger(t),
+		wallClock: wallClock{now: func() time.Time { return now }},
+	}
+	b.record(true)
+	if ok, wait := b.allow(); ok || wait != time.Minute {
+		t.Fatalf("Expected reads to be refused for a minute, got %t %v", ok, wait)
+	}
+
+	// Only one read probes the database at a time
+	now = now.Add(time.Minute)
+	if ok, _ := b.allow(); !ok {
+		t.Fatal("Expected a probe to be let through")
+	}
+	if ok, _ := b.allow(); ok {
+		t.Fatal("Expected a single probe")
+	}
+	b.record(false)
+	if ok, _ := b.allow(); !ok || b.Open() {
+		t.Fatal("Expected the breaker to close")
+	}
+}
@@ -0,0 +1,181 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+// Bulk requests larger than this are rejected.
+const maxBulkRequestSize = 4 << 20
+
+// BulkMember is an organization member to remove.
+type BulkMember struct {
+	Organization string         `json:"organization"`
+	Node         common.Address `json:"node"`
+}
+
+// BulkDeletion lists what a bulk admin deletion removes. Every list is optional.
+type BulkDeletion struct {
+	Aliases       []string         `json:"aliases"`
+	Organizations []string         `json:"organizations"`
+	Members       []BulkMember     `json:"members"`
+	Notifications []common.Address `json:"notifications"`
+}
+
+// BulkDeletionResult is the outcome of a bulk deletion. Nothing is deleted in a dry run,
+// but the counts are those the deletion would have.
+type BulkDeletionResult struct {
+	DryRun bool `json:"dry_run"`
+	// Rows deleted per table
+	Deleted map[string]int64 `json:"deleted"`
+	// Entries of the request which matched nothing, per list
+	Missing map[string][]string `json:"missing"`
+}
+
+// bulkDelete applies a bulk deletion in a single transaction, which is rolled back in
+// a dry run.
+func bulkDelete(db *sql.DB, deletion *BulkDeletion, dryRun bool) (*BulkDeletionResult, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	out, err := bulkDeleteTx(tx, deletion)
+	if err != nil {
+		return nil, err
+	}
+	out.DryRun = dryRun
+	if dryRun {
+		return out, nil
+	}
+	return out, tx.Commit()
+}
+
+// bulkDeleteTx applies a bulk deletion in tx.
+func bulkDeleteTx(tx *sql.Tx, deletion *BulkDeletion) (*BulkDeletionResult, error) {
+	out := &BulkDeletionResult{
+		Deleted: map[string]int64{},
+		Missing: map[string][]string{},
+	}
+	exec := func(table string, query string, args ...any) (int64, error) {
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete from %s: %w", table, err)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		out.Deleted[table] += n
+		return n, nil
+	}
+	missing := func(list string, entry string) {
+		out.Missing[list] = append(out.Missing[list], entry)
+	}
+
+	for _, alias := range deletion.Aliases {
+		n, err := exec("validator_aliases", "DELETE FROM validator_aliases WHERE alias = ?", alias)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			missing("aliases", alias)
+		}
+	}
+
+	// Members are removed before organizations, so removing both isn't reported missing
+	for _, member := range deletion.Members {
+		n, err := exec("organization_members",
+			"DELETE FROM organization_members WHERE organization_id = ? AND node_address = ?",
+			member.Organization, member.Node.Hex())
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			missing("members", member.Organization+"/"+member.Node.Hex())
+		}
+	}
+
+	for _, id := range deletion.Organizations {
+		n, err := exec("organizations", "DELETE FROM organizations WHERE id = ?", id)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			missing("organizations", id)
+			continue
+		}
+		if _, err := exec("organization_members", "DELETE FROM organization_members WHERE organization_id = ?", id); err != nil {
+			return nil, err
+		}
+		if _, err := exec("organization_retention", "DELETE FROM organization_retention WHERE organization_id = ?", id); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, node := range deletion.Notifications {
+		n, err := exec("notification_preferences", "DELETE FROM notification_preferences WHERE node_address = ?", node.Hex())
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			missing("notifications", node.Hex())
+		}
+	}
+
+	return out, nil
+}
+
+// serveBulkDelete applies a BulkDeletion read from the JSON body, which may be uploaded
+// from a file. It's a dry run unless dry_run=false, so the affected row counts can be
+// checked before anything is deleted. With an undo window, the deletion is staged instead.
+func (pr *ProxyRouter) serveBulkDelete(w http.ResponseWriter, r *http.Request) {
+	tracker, ok := pr.ut.(sqlUsageTracker)
+	if !ok || pr.alias == nil || pr.orgs == nil || pr.prefs == nil {
+		http.Error(w, "bulk deletions require a SQL usage tracker", http.StatusNotImplemented)
+		return
+	}
+
+	dryRun := true
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid dry_run: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var deletion BulkDeletion
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBulkRequestSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&deletion); err != nil {
+		http.Error(w, fmt.Sprintf("invalid bulk deletion: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if !dryRun && pr.stageDeletion(w, r, &deletion, nil) {
+		return
+	}
+
+	result, err := bulkDelete(tracker.primaryDatabase(), &deletion, dryRun)
+	if err != nil {
+		pr.Logger.Error("Failed to apply bulk deletion", zap.Error(err))
+		http.Error(w, "failed to apply bulk deletion", http.StatusInternalServerError)
+		return
+	}
+	if !dryRun {
+		pr.Logger.Info("Applied bulk deletion", zap.Any("deleted", result.Deleted))
+	}
+
+	pr.writeUsageJSON(w, r, result)
+}
@@ -0,0 +1,187 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupBulkTest(t *testing.T) (*ProxyRouter, func()) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := tracker.(*SQLiteUsageTracker).primaryDatabase()
+	logger := zaptest.NewLogger(t)
+
+	pr := &ProxyRouter{Logger: logger, ut: tracker}
+	if pr.alias, err = NewAliasStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+	if pr.orgs, err = NewOrganizationStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+	if pr.prefs, err = NewPreferencesStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pr.alias.Put("alpha", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.alias.Put("beta", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.orgs.Put(&Organization{ID: "acme", Name: "Acme", RetentionDays: 30}); err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range []common.Address{{1}, {2}} {
+		if err := pr.orgs.AddMember("acme", node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pr.prefs.Put(&NotificationPreferences{NodeAddress: common.Address{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	return pr, cleanup
+}
+
+func serveBulkDeletion(t *testing.T, pr *ProxyRouter, query string, body string) *BulkDeletionResult {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/bulk/delete"+query, strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var out BulkDeletionResult
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return &out
+}
+
+func TestBulkDelete(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	body := `{
+		"aliases": ["alpha", "gamma"],
+		"members": [{"organization": "acme", "node": "0x0100000000000000000000000000000000000000"}],
+		"organizations": ["acme", "nope"],
+		"notifications": ["0x0100000000000000000000000000000000000000"]
+	}`
+	expected := map[string]int64{
+		"validator_aliases":        1,
+		"organizations":            1,
+		"organization_members":     2,
+		"organization_retention":   1,
+		"notification_preferences": 1,
+	}
+
+	// Dry runs are the default
+	for _, query := range []string{"", "?dry_run=true"} {
+		result := serveBulkDeletion(t, pr, query, body)
+		if !result.DryRun {
+			t.Fatal("Expected a dry run")
+		}
+		for table, n := range expected {
+			if result.Deleted[table] != n {
+				t.Fatalf("Expected %d rows of %s, got %d", n, table, result.Deleted[table])
+			}
+		}
+		if len(result.Missing["aliases"]) != 1 || result.Missing["aliases"][0] != "gamma" {
+			t.Fatalf("Expected alias gamma to be missing, got %v", result.Missing)
+		}
+		if len(result.Missing["organizations"]) != 1 || result.Missing["organizations"][0] != "nope" {
+			t.Fatalf("Expected organization nope to be missing, got %v", result.Missing)
+		}
+		if len(result.Missing["members"]) != 0 {
+			t.Fatalf("Expected no missing members, got %v", result.Missing)
+		}
+
+		aliases, err := pr.alias.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(aliases) != 2 {
+			t.Fatalf("Expected the dry run to keep both aliases, got %v", aliases)
+		}
+		if _, err := pr.orgs.Get("acme"); err != nil {
+			t.Fatalf("Expected the dry run to keep the organization: %v", err)
+		}
+	}
+
+	result := serveBulkDeletion(t, pr, "?dry_run=false", body)
+	if result.DryRun {
+		t.Fatal("Expected the deletion to be executed")
+	}
+	for table, n := range expected {
+		if result.Deleted[table] != n {
+			t.Fatalf("Expected %d rows of %s, got %d", n, table, result.Deleted[table])
+		}
+	}
+
+	aliases, err := pr.alias.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 1 || aliases[0].Alias != "beta" {
+		t.Fatalf("Expected only alias beta to remain, got %v", aliases)
+	}
+	if _, err := pr.orgs.Get("acme"); err != ErrNoOrganization {
+		t.Fatalf("Expected ErrNoOrganization, got %v", err)
+	}
+	if _, err := pr.prefs.Get(common.Address{1}); err != ErrNoPreferences {
+		t.Fatalf("Expected ErrNoPreferences, got %v", err)
+	}
+
+	// Executing again deletes nothing
+	result = serveBulkDeletion(t, pr, "?dry_run=false", body)
+	if len(result.Missing["aliases"]) != 2 || len(result.Missing["organizations"]) != 2 {
+		t.Fatalf("Expected everything to be missing, got %v", result.Missing)
+	}
+}
+
+func TestBulkDeleteInvalid(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	tests := []struct {
+		name  string
+		query string
+		body  string
+		code  int
+	}{
+		{"unknown field", "", `{"bans": ["1"]}`, http.StatusBadRequest},
+		{"not json", "", `alpha`, http.StatusBadRequest},
+		{"bad dry run", "?dry_run=maybe", `{}`, http.StatusBadRequest},
+		{"empty", "", `{}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/bulk/delete"+tt.query, strings.NewReader(tt.body)))
+			if rec.Code != tt.code {
+				t.Fatalf("Expected %d, got %d: %s", tt.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	aliases, err := pr.alias.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 2 {
+		t.Fatalf("Expected both aliases to remain, got %v", aliases)
+	}
+}
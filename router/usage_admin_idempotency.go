@@ -0,0 +1,247 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// Set on responses replayed for a key which was already used
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// idempotentResponse is the response of a request made with an idempotency key.
+type idempotentResponse struct {
+	// Hash of the method, URI and body of the request, so a key reused for another
+	// request is detected
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyStore keeps the responses of mutating admin requests made with an
+// Idempotency-Key header for Window, so retried requests get the original response
+// instead of being applied twice.
+type IdempotencyStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+	Window   time.Duration
+
+	// Keys of requests being served
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+
+	wallClock
+}
+
+// NewIdempotencyStore creates the idempotency key table in db if needed.
+func NewIdempotencyStore(logger *zap.Logger, db *sql.DB, window time.Duration) (*IdempotencyStore, error) {
+	store := &IdempotencyStore{
+		Database: db,
+		Logger:   logger,
+		Window:   window,
+		inFlight: make(map[string]struct{}),
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *IdempotencyStore) initSchema() error {
+	// created_at is unix seconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS admin_idempotency_keys (
+		key TEXT PRIMARY KEY,
+		request_hash TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		body BLOB,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_admin_idempotency_keys_created_at ON admin_idempotency_keys(created_at);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Get returns the response stored for key, or nil if there is none within the window.
+func (store *IdempotencyStore) Get(key string) (*idempotentResponse, error) {
+	var out idempotentResponse
+	err := store.Database.QueryRow(`
+	SELECT request_hash, status, content_type, body FROM admin_idempotency_keys
+	WHERE key = ? AND created_at > ?
+	`, key, store.clock().Add(-store.Window).Unix()).Scan(&out.RequestHash, &out.Status, &out.ContentType, &out.Body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query idempotency key: %w", err)
+	}
+	return &out, nil
+}
+
+// Put stores the response of key, and deletes the keys whose window has passed.
+func (store *IdempotencyStore) Put(key string, response *idempotentResponse) error {
+	now := store.clock()
+	if _, err := store.Database.Exec("DELETE FROM admin_idempotency_keys WHERE created_at <= ?", now.Add(-store.Window).Unix()); err != nil {
+		return fmt.Errorf("failed to delete expired idempotency keys: %w", err)
+	}
+
+	_, err := store.Database.Exec(`
+	INSERT INTO admin_idempotency_keys (key, request_hash, status, content_type, body, created_at)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT (key) DO UPDATE SET
+		request_hash = excluded.request_hash,
+		status = excluded.status,
+		content_type = excluded.content_type,
+		body = excluded.body,
+		created_at = excluded.created_at
+	`, key, response.RequestHash, response.Status, response.ContentType, response.Body, now.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to store idempotency key: %w", err)
+	}
+	return nil
+}
+
+// acquire marks key as being served, and returns false if it already is.
+func (store *IdempotencyStore) acquire(key string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.inFlight[key]; ok {
+		return false
+	}
+	store.inFlight[key] = struct{}{}
+	return true
+}
+
+func (store *IdempotencyStore) release(key string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.inFlight, key)
+}
+
+// idempotencyRecorder passes a response through while keeping a copy of it.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// checkIdempotencyKey replays the stored response of mutating requests whose
+// Idempotency-Key was already used for the same request within the window, and stores
+// the response of those which weren't. Reusing a key for another request is refused,
+// as is retrying one before the original completed. Server errors aren't stored, so
+// the request can be retried.
+//
+// Requests without the header, and every request when no store is configured, are
+// served as usual.
+func (pr *ProxyRouter) checkIdempotencyKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if pr.idempotency == nil || key == "" || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, fmt.Sprintf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength), http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBulkRequestSize))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s\n%s\n", r.Method, r.URL.RequestURI())
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		if !pr.idempotency.acquire(key) {
+			http.Error(w, fmt.Sprintf("a request with this %s is in progress", idempotencyKeyHeader), http.StatusConflict)
+			return
+		}
+		defer pr.idempotency.release(key)
+
+		stored, err := pr.idempotency.Get(key)
+		if err != nil {
+			pr.Logger.Error("Failed to look up idempotency key", zap.Error(err))
+			http.Error(w, "failed to look up idempotency key", http.StatusInternalServerError)
+			return
+		}
+		if stored != nil {
+			if stored.RequestHash != requestHash {
+				http.Error(w, fmt.Sprintf("%s was already used for a different request", idempotencyKeyHeader), http.StatusUnprocessableEntity)
+				return
+			}
+			pr.Logger.Info("Replayed admin request",
+				zap.String("key", key),
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path))
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.WriteHeader(stored.Status)
+			_, _ = w.Write(stored.Body)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= http.StatusInternalServerError {
+			return
+		}
+		err = pr.idempotency.Put(key, &idempotentResponse{
+			RequestHash: requestHash,
+			Status:      rec.status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		})
+		if err != nil {
+			// The request was applied, so its response stands
+			pr.Logger.Warn("Failed to store idempotency key", zap.String("key", key), zap.Error(err))
+		}
+	})
+}
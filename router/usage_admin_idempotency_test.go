@@ -0,0 +1,79 @@
+//go:build ns
+
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestIdempotencyKeys(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	store, err := NewIdempotencyStore(zaptest.NewLogger(t), pr.alias.Database, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.now = func() time.Time { return now }
+	pr.idempotency = store
+	handler := pr.AdminHandler()
+
+	serve := func(method string, path string, key string, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if key != "" {
+			r.Header.Set(idempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	if rec := serve(http.MethodDelete, "/validators/alpha/alias", "delete-alpha", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+	// The retry gets the original response rather than a 404
+	rec := serve(http.MethodDelete, "/validators/alpha/alias", "delete-alpha", "")
+	if rec.Code != http.StatusNoContent || rec.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Fatalf("Expected the response to be replayed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(http.MethodDelete, "/validators/alpha/alias", "", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d without a key, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	// Reusing a key for another request is refused
+	if rec := serve(http.MethodDelete, "/validators/beta/alias", "delete-alpha", ""); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusUnprocessableEntity, rec.Code, rec.Body.String())
+	}
+	if rec := serve(http.MethodPut, "/validators/gamma/alias", "put-gamma", `{"validator": "3"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	if rec := serve(http.MethodPut, "/validators/gamma/alias", "put-gamma", `{"validator": "4"}`); rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected %d for another body, got %d", http.StatusUnprocessableEntity, rec.Code)
+	}
+	rec = serve(http.MethodPut, "/validators/gamma/alias", "put-gamma", `{"validator": "3"}`)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" || !strings.Contains(rec.Body.String(), `"3"`) {
+		t.Fatalf("Expected the response to be replayed, got %d %s: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body.String())
+	}
+
+	// Keys can be used again once the window has passed
+	now = now.Add(time.Hour)
+	if rec := serve(http.MethodDelete, "/validators/alpha/alias", "delete-alpha", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected the key to have expired, got %d", rec.Code)
+	}
+
+	// Concurrent retries wait for the original to complete
+	if !store.acquire("busy") {
+		t.Fatal("Expected to acquire the key")
+	}
+	if rec := serve(http.MethodDelete, "/validators/beta/alias", "busy", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("Expected %d, got %d", http.StatusConflict, rec.Code)
+	}
+}
@@ -0,0 +1,418 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestUsageAdminReconcile(t *testing.T) {
+	tracker, now := setupHybridTestDatabase(t, 5*time.Minute, 10*time.Minute)
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	handler := pr.AdminHandler()
+
+	*now = time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC)
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		code  int
+	}{
+		{"valid", "from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z", http.StatusOK},
+		{"zero tolerance", "from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z&tolerance=0s", http.StatusOK},
+		{"missing from", "to=2025-01-01T01:00:00Z", http.StatusBadRequest},
+		{"inverted", "from=2025-01-01T01:00:00Z&to=2025-01-01T00:00:00Z", http.StatusBadRequest},
+		{"bad tolerance", "from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z&tolerance=-1m", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/reconcile?"+tt.query, nil))
+			if rec.Code != tt.code {
+				t.Fatalf("Expected %d, got %d: %s", tt.code, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+		"/usage/reconcile?from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z&tolerance=0s", nil))
+	var report UsageReconciliation
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Discrepancies) != 1 || report.Discrepancies[0].Validator != "1" {
+		t.Fatalf("Expected a discrepancy for validator 1, got %+v", report.Discrepancies)
+	}
+}
+
+func TestUsageAdminReconcileRequiresHybrid(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+
+	rec := httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+		"/usage/reconcile?from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected %d, got %d", http.StatusNotImplemented, rec.Code)
+	}
+}
+
+func TestAdminNotificationPreferences(t *testing.T) {
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		prefs:  setupPreferencesTestDatabase(t),
+	}
+	handler := pr.AdminHandler()
+
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	path := "/operators/0x1234567890123456789012345678901234567890/notifications"
+
+	if rec := serve(http.MethodGet, path, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodPut, path, `{"webhook_url": "not a url"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodPut, path, `{"node_address": "0x0000000000000000000000000000000000000001"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a mismatched node address, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodPut, path, `{"webhook_url": "https://example.com", "thresholds": [0.9]}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := serve(http.MethodGet, path, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	var prefs NotificationPreferences
+	if err := json.NewDecoder(rec.Body).Decode(&prefs); err != nil {
+		t.Fatal(err)
+	}
+	if prefs.WebhookURL != "https://example.com" || len(prefs.Thresholds) != 1 {
+		t.Fatalf("Unexpected preferences %+v", prefs)
+	}
+
+	rec = serve(http.MethodGet, "/operators/notifications", "")
+	var list []NotificationPreferences
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(list))
+	}
+
+	if rec := serve(http.MethodDelete, path, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodDelete, path, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodGet, "/operators/0x1234/notifications", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a malformed address, got %d", rec.Code)
+	}
+}
+
+func TestAdminUsageProof(t *testing.T) {
+	tracker, _ := setupMerkleTestDatabase(t)
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	handler := pr.AdminHandler()
+	query := "from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z"
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/commitment?"+query, nil))
+	var commitment UsageCommitment
+	if err := json.NewDecoder(rec.Body).Decode(&commitment); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/proof?validator=1&"+query, nil))
+	var response struct {
+		Commitment UsageCommitment       `json:"commitment"`
+		Proofs     []UsageInclusionProof `json:"proofs"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Proofs) != 3 {
+		t.Fatalf("Expected 3 proofs, got %d", len(response.Proofs))
+	}
+	for _, proof := range response.Proofs {
+		if !proof.Verify(commitment.Root) {
+			t.Fatal("Expected the proof to verify against the published root")
+		}
+	}
+
+	for path, code := range map[string]int{
+		"/usage/proof?validator=4&" + query:                                   http.StatusNotFound,
+		"/usage/proof?" + query:                                               http.StatusBadRequest,
+		"/usage/proof?validator=0x12&" + query:                                http.StatusBadRequest,
+		"/usage/commitment?from=2025-01-01T01:00:00Z&to=2025-01-01T00:00:00Z": http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != code {
+			t.Errorf("%s: expected %d, got %d", path, code, rec.Code)
+		}
+	}
+}
+
+func TestAdminOperatorExport(t *testing.T) {
+	exporter, node, _ := setupExportTest(t)
+	pr := &ProxyRouter{
+		Logger:           zaptest.NewLogger(t),
+		ut:               exporter.Tracker,
+		prefs:            exporter.Preferences,
+		attr:             exporter.Attribution,
+		ReportSigningKey: exporter.SigningKey,
+	}
+	handler := pr.AdminHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/operators/"+node.Hex()+"/export", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if files := readExport(t, rec.Body.Bytes()); len(files) != 5 {
+		t.Fatalf("Expected 5 files, got %d", len(files))
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/operators/0x0000000000000000000000000000000000000001/export", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %d", rec.Code)
+	}
+
+	pr.ReportSigningKey = nil
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/operators/"+node.Hex()+"/export", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected 501 without a signing key, got %d", rec.Code)
+	}
+}
+
+func TestAdminDutyCoverage(t *testing.T) {
+	job, provider, tracker := setupDutyCoverageTest(t)
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	handler := pr.AdminHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+		"/usage/duties?from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected 501 without duty coverage, got %d", rec.Code)
+	}
+
+	pr.duty = job.Store
+	start := provider.timing.EpochTime(10)
+	if err := tracker.recordUsage(start.Unix(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := job.Evaluate(t.Context(), provider.timing, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+		"/usage/duties?from=2025-01-01T01:00:00Z&to=2025-01-01T00:00:00Z", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an inverted range, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet,
+		"/usage/duties?from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var report DutyCoverageReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Attester != (DutyCoverageCount{Expected: 1, Covered: 1}) ||
+		report.Proposer != (DutyCoverageCount{Expected: 1, Covered: 0}) {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+}
+
+func TestAdminValidatorAliases(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	sqlite := tracker.(*SQLiteUsageTracker)
+	alias, err := NewAliasStore(zaptest.NewLogger(t), sqlite.primaryDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+		alias:  alias,
+	}
+	handler := pr.AdminHandler()
+
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := sqlite.recordUsage(start.Unix(), []string{"1", "100"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := serve(http.MethodPut, "/validators/100/alias", `{"validator": "100"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a self alias, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodPut, "/validators/100/alias", `{"validator": "1"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(http.MethodPut, "/validators/1/alias", `{"validator": "2"}`); rec.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for a chained alias, got %d", rec.Code)
+	}
+
+	rec := serve(http.MethodGet, "/validators/aliases", "")
+	var aliases []ValidatorAlias
+	if err := json.NewDecoder(rec.Body).Decode(&aliases); err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 1 || aliases[0].Alias != "100" || aliases[0].Validator != "1" {
+		t.Fatalf("Unexpected aliases %+v", aliases)
+	}
+
+	usage := func(query string) map[string]float64 {
+		rec := serve(http.MethodGet, "/usage?from=2025-01-01T00:00:00Z&to=2025-01-01T00:30:00Z"+query, "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		out := map[string]float64{}
+		if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	if linked := usage(""); len(linked) != 1 || linked["1"] != 7200 {
+		t.Fatalf("Expected the alias's usage to be linked, got %v", linked)
+	}
+	if raw := usage("&aliases=false"); len(raw) != 2 {
+		t.Fatalf("Expected raw usage, got %v", raw)
+	}
+
+	if rec := serve(http.MethodDelete, "/validators/100/alias", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodDelete, "/validators/100/alias", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %d", rec.Code)
+	}
+}
+
+func TestAdminOrganizations(t *testing.T) {
+	store, attr, tracker := setupOrganizationTest(t)
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+		orgs:   store,
+	}
+	handler := pr.AdminHandler()
+
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	node := "0x1234567890123456789012345678901234567890"
+
+	if rec := serve(http.MethodPut, "/organizations/Bad", `{"name": "Bad"}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodPut, "/organizations/acme/members/"+node, ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for a missing organization, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodPut, "/organizations/acme", `{"name": "ACME", "retention_days": -1}`); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a negative retention, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodPut, "/organizations/acme", `{"name": "ACME", "retention_days": 365}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(http.MethodPut, "/organizations/acme/members/"+node, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rec.Code)
+	}
+
+	rec := serve(http.MethodGet, "/organizations/acme", "")
+	var org Organization
+	if err := json.NewDecoder(rec.Body).Decode(&org); err != nil {
+		t.Fatal(err)
+	}
+	if org.Name != "ACME" || org.RetentionDays != 365 || len(org.Members) != 1 || org.Members[0] != common.HexToAddress(node) {
+		t.Fatalf("Unexpected organization %+v", org)
+	}
+
+	usagePath := "/organizations/acme/usage?from=2025-01-01T00:00:00Z&to=2025-01-01T00:30:00Z"
+	if rec := serve(http.MethodGet, usagePath, ""); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected 501 without attribution, got %d", rec.Code)
+	}
+	pr.attr = attr
+	if err := attr.Attribute(common.HexToAddress(node), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.recordUsage(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Unix(), []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	rec = serve(http.MethodGet, usagePath, "")
+	var report OrganizationUsage
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Seconds != 3600 || len(report.Nodes) != 1 {
+		t.Fatalf("Unexpected organization usage %+v", report)
+	}
+
+	if rec := serve(http.MethodDelete, "/organizations/acme/members/"+node, ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodDelete, "/organizations/acme", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d", rec.Code)
+	}
+	if rec := serve(http.MethodGet, "/organizations/acme", ""); rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,306 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// How often due deletions are applied
+const pendingDeletionInterval = 15 * time.Second
+
+// ErrNoPendingDeletion is returned when cancelling a deletion which isn't pending.
+var ErrNoPendingDeletion = errors.New("no such pending deletion")
+
+// PendingDeletion is a deletion staged by the admin API, which is applied at ApplyAt
+// unless cancelled before.
+type PendingDeletion struct {
+	ID       string       `json:"id"`
+	Deletion BulkDeletion `json:"deletion"`
+	StagedAt time.Time    `json:"staged_at"`
+	ApplyAt  time.Time    `json:"apply_at"`
+}
+
+// PendingDeletionStore stages the deletions of the admin API for Window, so mistakes
+// can be undone by cancelling them.
+type PendingDeletionStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+	Window   time.Duration
+
+	wallClock
+}
+
+// NewPendingDeletionStore creates the pending deletion table in db if needed. Deletions
+// are applied to db as well.
+func NewPendingDeletionStore(logger *zap.Logger, db *sql.DB, window time.Duration) (*PendingDeletionStore, error) {
+	store := &PendingDeletionStore{
+		Database: db,
+		Logger:   logger,
+		Window:   window,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *PendingDeletionStore) initSchema() error {
+	// deletion is a JSON BulkDeletion, times are unix seconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS pending_deletions (
+		id TEXT PRIMARY KEY,
+		deletion TEXT NOT NULL,
+		staged_at INTEGER NOT NULL,
+		apply_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_pending_deletions_apply_at ON pending_deletions(apply_at);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Stage schedules deletion to be applied after the undo window.
+func (store *PendingDeletionStore) Stage(deletion *BulkDeletion) (*PendingDeletion, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(deletion)
+	if err != nil {
+		return nil, err
+	}
+
+	now := store.clock().Truncate(time.Second).UTC()
+	out := &PendingDeletion{
+		ID:       hex.EncodeToString(id),
+		Deletion: *deletion,
+		StagedAt: now,
+		ApplyAt:  now.Add(store.Window).Truncate(time.Second),
+	}
+	_, err = store.Database.Exec(`
+	INSERT INTO pending_deletions (id, deletion, staged_at, apply_at) VALUES (?, ?, ?, ?)
+	`, out.ID, string(data), out.StagedAt.Unix(), out.ApplyAt.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to stage deletion: %w", err)
+	}
+
+	return out, nil
+}
+
+// List returns the pending deletions, the next to be applied first.
+func (store *PendingDeletionStore) List() ([]PendingDeletion, error) {
+	rows, err := store.Database.Query(`
+	SELECT id, deletion, staged_at, apply_at FROM pending_deletions ORDER BY apply_at, id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending deletions: %w", err)
+	}
+	defer rows.Close()
+
+	out := []PendingDeletion{}
+	for rows.Next() {
+		var p PendingDeletion
+		var data string
+		var stagedAt, applyAt int64
+		if err := rows.Scan(&p.ID, &data, &stagedAt, &applyAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &p.Deletion); err != nil {
+			return nil, fmt.Errorf("invalid pending deletion %s: %w", p.ID, err)
+		}
+		p.StagedAt = time.Unix(stagedAt, 0).UTC()
+		p.ApplyAt = time.Unix(applyAt, 0).UTC()
+		out = append(out, p)
+	}
+
+	return out, rows.Err()
+}
+
+// Cancel discards a pending deletion, or returns ErrNoPendingDeletion if it was already
+// applied or cancelled.
+func (store *PendingDeletionStore) Cancel(id string) error {
+	res, err := store.Database.Exec("DELETE FROM pending_deletions WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to cancel pending deletion: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNoPendingDeletion
+	}
+	return nil
+}
+
+// ApplyDue applies every deletion whose undo window has passed, and returns how many
+// were applied.
+func (store *PendingDeletionStore) ApplyDue() (int, error) {
+	pending, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+
+	now := store.clock()
+	applied := 0
+	for _, p := range pending {
+		if p.ApplyAt.After(now) {
+			break
+		}
+
+		ok, err := store.apply(&p)
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			applied++
+		}
+	}
+
+	return applied, nil
+}
+
+// apply applies a pending deletion, unless it was cancelled concurrently.
+func (store *PendingDeletionStore) apply(p *PendingDeletion) (bool, error) {
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM pending_deletions WHERE id = ?", p.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to apply pending deletion %s: %w", p.ID, err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	result, err := bulkDeleteTx(tx, &p.Deletion)
+	if err != nil {
+		return false, fmt.Errorf("failed to apply pending deletion %s: %w", p.ID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	store.Logger.Info("Applied pending deletion",
+		zap.String("id", p.ID),
+		zap.Time("staged_at", p.StagedAt),
+		zap.Any("deleted", result.Deleted))
+	return true, nil
+}
+
+// Run applies due deletions until ctx is done.
+func (store *PendingDeletionStore) Run(ctx context.Context) {
+	ticker := time.NewTicker(pendingDeletionInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := store.ApplyDue(); err != nil {
+			store.Logger.Warn("Failed to apply pending deletions", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stageDeletion stages deletion and writes the pending deletion, if an undo window is
+// configured. notFound is written instead if the deletion would currently match nothing,
+// unless it's nil. Returns false if deletions are applied immediately.
+func (pr *ProxyRouter) stageDeletion(w http.ResponseWriter, r *http.Request, deletion *BulkDeletion, notFound error) bool {
+	if pr.pending == nil {
+		return false
+	}
+
+	if notFound != nil {
+		result, err := bulkDelete(pr.pending.Database, deletion, true)
+		if err != nil {
+			pr.Logger.Error("Failed to check deletion", zap.Error(err))
+			http.Error(w, "failed to stage deletion", http.StatusInternalServerError)
+			return true
+		}
+		if len(result.Missing) > 0 {
+			http.Error(w, notFound.Error(), http.StatusNotFound)
+			return true
+		}
+	}
+
+	pending, err := pr.pending.Stage(deletion)
+	if err != nil {
+		pr.Logger.Error("Failed to stage deletion", zap.Error(err))
+		http.Error(w, "failed to stage deletion", http.StatusInternalServerError)
+		return true
+	}
+	pr.Logger.Info("Staged deletion",
+		zap.String("id", pending.ID),
+		zap.Time("apply_at", pending.ApplyAt))
+
+	pr.writeUsageJSONStatus(w, r, http.StatusAccepted, pending)
+	return true
+}
+
+func (pr *ProxyRouter) pendingDeletionStore(w http.ResponseWriter) (*PendingDeletionStore, bool) {
+	if pr.pending == nil {
+		http.Error(w, "deletions are applied immediately without -admin-undo-window", http.StatusNotImplemented)
+		return nil, false
+	}
+	return pr.pending, true
+}
+
+func (pr *ProxyRouter) serveListPendingDeletions(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.pendingDeletionStore(w)
+	if !ok {
+		return
+	}
+
+	pending, err := store.List()
+	if err != nil {
+		pr.Logger.Error("Failed to list pending deletions", zap.Error(err))
+		http.Error(w, "failed to list pending deletions", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, pending)
+}
+
+// serveCancelPendingDeletion undoes a deletion staged within the undo window.
+func (pr *ProxyRouter) serveCancelPendingDeletion(w http.ResponseWriter, r *http.Request) {
+	store, ok := pr.pendingDeletionStore(w)
+	if !ok {
+		return
+	}
+
+	err := store.Cancel(mux.Vars(r)["id"])
+	if errors.Is(err, ErrNoPendingDeletion) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		pr.Logger.Error("Failed to cancel pending deletion", zap.Error(err))
+		http.Error(w, "failed to cancel pending deletion", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
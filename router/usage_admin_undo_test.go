@@ -0,0 +1,203 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupUndoTest(t *testing.T) (*ProxyRouter, *time.Time, func()) {
+	pr, cleanup := setupBulkTest(t)
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	pending, err := NewPendingDeletionStore(zaptest.NewLogger(t), pr.alias.Database, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending.now = func() time.Time { return now }
+	pr.pending = pending
+
+	return pr, &now, cleanup
+}
+
+func serveStagedDeletion(t *testing.T, pr *ProxyRouter, r *http.Request) *PendingDeletion {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, r)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusAccepted, rec.Code, rec.Body.String())
+	}
+	var out PendingDeletion
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	return &out
+}
+
+func TestPendingDeletions(t *testing.T) {
+	pr, now, cleanup := setupUndoTest(t)
+	defer cleanup()
+
+	alias := serveStagedDeletion(t, pr, httptest.NewRequest(http.MethodDelete, "/validators/alpha/alias", nil))
+	if !alias.ApplyAt.Equal(now.Add(10 * time.Minute)) {
+		t.Fatalf("Expected the deletion to apply at %v, got %v", now.Add(10*time.Minute), alias.ApplyAt)
+	}
+	org := serveStagedDeletion(t, pr, httptest.NewRequest(http.MethodDelete, "/organizations/acme", nil))
+	prefs := serveStagedDeletion(t, pr, httptest.NewRequest(http.MethodDelete,
+		"/operators/0x0100000000000000000000000000000000000000/notifications", nil))
+
+	// Nothing is deleted yet
+	if _, err := pr.orgs.Get("acme"); err != nil {
+		t.Fatalf("Expected the organization to be kept while pending: %v", err)
+	}
+	applied, err := pr.pending.ApplyDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 0 {
+		t.Fatalf("Expected no deletion to be due, got %d", applied)
+	}
+
+	rec := httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/pending", nil))
+	var pending []PendingDeletion
+	if err := json.NewDecoder(rec.Body).Decode(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 3 {
+		t.Fatalf("Expected 3 pending deletions, got %+v", pending)
+	}
+
+	// Undo the organization deletion
+	rec = httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/pending/"+org.ID, nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/pending/"+org.ID, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	*now = now.Add(10 * time.Minute)
+	applied, err = pr.pending.ApplyDue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied != 2 {
+		t.Fatalf("Expected 2 deletions to be applied, got %d", applied)
+	}
+
+	aliases, err := pr.alias.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 1 || aliases[0].Alias != "beta" {
+		t.Fatalf("Expected only alias beta to remain, got %v", aliases)
+	}
+	if _, err := pr.prefs.Get(common.Address{1}); err != ErrNoPreferences {
+		t.Fatalf("Expected ErrNoPreferences, got %v", err)
+	}
+	if _, err := pr.orgs.Get("acme"); err != nil {
+		t.Fatalf("Expected the cancelled deletion to keep the organization: %v", err)
+	}
+
+	// Applied deletions can't be cancelled
+	if err := pr.pending.Cancel(alias.ID); err != ErrNoPendingDeletion {
+		t.Fatalf("Expected ErrNoPendingDeletion, got %v", err)
+	}
+	if err := pr.pending.Cancel(prefs.ID); err != ErrNoPendingDeletion {
+		t.Fatalf("Expected ErrNoPendingDeletion, got %v", err)
+	}
+}
+
+func TestPendingDeletionNotFound(t *testing.T) {
+	pr, _, cleanup := setupUndoTest(t)
+	defer cleanup()
+
+	for _, path := range []string{
+		"/validators/gamma/alias",
+		"/organizations/nope",
+		"/organizations/acme/members/0x0300000000000000000000000000000000000000",
+		"/operators/0x0200000000000000000000000000000000000000/notifications",
+	} {
+		rec := httptest.NewRecorder()
+		pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Fatalf("Expected %d for %s, got %d: %s", http.StatusNotFound, path, rec.Code, rec.Body.String())
+		}
+	}
+
+	pending, err := pr.pending.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("Expected nothing to be staged, got %+v", pending)
+	}
+}
+
+func TestPendingBulkDeletion(t *testing.T) {
+	pr, now, cleanup := setupUndoTest(t)
+	defer cleanup()
+
+	body := `{"aliases": ["alpha", "beta"], "members": [{"organization": "acme", "node": "0x0200000000000000000000000000000000000000"}]}`
+
+	// Dry runs aren't staged
+	result := serveBulkDeletion(t, pr, "", body)
+	if result.Deleted["validator_aliases"] != 2 {
+		t.Fatalf("Expected 2 aliases to be deleted, got %v", result.Deleted)
+	}
+
+	staged := serveStagedDeletion(t, pr, httptest.NewRequest(http.MethodPost, "/bulk/delete?dry_run=false", strings.NewReader(body)))
+	if len(staged.Deletion.Aliases) != 2 || len(staged.Deletion.Members) != 1 {
+		t.Fatalf("Unexpected staged deletion %+v", staged.Deletion)
+	}
+
+	*now = now.Add(time.Hour)
+	if _, err := pr.pending.ApplyDue(); err != nil {
+		t.Fatal(err)
+	}
+	aliases, err := pr.alias.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 0 {
+		t.Fatalf("Expected every alias to be deleted, got %v", aliases)
+	}
+	org, err := pr.orgs.Get("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(org.Members) != 1 {
+		t.Fatalf("Expected one member to remain, got %v", org.Members)
+	}
+}
+
+func TestPendingDeletionsDisabled(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	rec := httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/pending", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected %d, got %d", http.StatusNotImplemented, rec.Code)
+	}
+
+	// Deletions are applied immediately
+	rec = httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/validators/alpha/alias", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusNoContent, rec.Code, rec.Body.String())
+	}
+}
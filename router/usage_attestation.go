@@ -0,0 +1,195 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidAttestation is returned when a signed usage attestation can't be decoded or
+// its signature doesn't match its signer.
+var ErrInvalidAttestation = errors.New("invalid usage attestation")
+
+// Version of the attestation format, bumped whenever a field is added, removed or
+// changes meaning
+const usageAttestationVersion = 1
+
+// AttestedValidatorUsage is the usage of one validator in an attestation, with the
+// period it was attributed to the node.
+type AttestedValidatorUsage struct {
+	Validator string    `json:"validator"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Seconds   float64   `json:"seconds"`
+}
+
+// UsageAttestation summarizes the rescue usage of an operator over a period, e.g. for
+// DAO reimbursements or partner billing. Only validators attributed to the node during
+// the period are included.
+type UsageAttestation struct {
+	Version     int                      `json:"version"`
+	NodeAddress common.Address           `json:"node_address"`
+	From        time.Time                `json:"from"`
+	To          time.Time                `json:"to"`
+	GeneratedAt time.Time                `json:"generated_at"`
+	Seconds     float64                  `json:"seconds"`
+	Validators  []AttestedValidatorUsage `json:"validators"`
+}
+
+// SignedUsageAttestation is an attestation with an EIP-191 signature over its compact
+// JSON encoding, so it can be verified offline with VerifyUsageAttestation.
+type SignedUsageAttestation struct {
+	Attestation json.RawMessage `json:"attestation"`
+	Signer      common.Address  `json:"signer"`
+	Signature   hexutil.Bytes   `json:"signature"`
+}
+
+// NewUsageAttestation aggregates the usage of the validators attributed to node over
+// the buckets overlapping [from, to].
+func NewUsageAttestation(tracker UsageTracker, attr *AttributionStore, node common.Address, from time.Time, to time.Time) (*UsageAttestation, error) {
+	usage, err := tracker.ViewUsage(from, to)
+	if err != nil {
+		return nil, err
+	}
+	validators, err := attr.Validators(node)
+	if err != nil {
+		return nil, err
+	}
+
+	attestation := &UsageAttestation{
+		Version:     usageAttestationVersion,
+		NodeAddress: node,
+		From:        from.UTC(),
+		To:          to.UTC(),
+		Validators:  make([]AttestedValidatorUsage, 0, len(validators)),
+	}
+	for _, v := range validators {
+		// Validators attributed to the node only before or after the period
+		if v.LastSeen.Before(from) || v.FirstSeen.After(to) {
+			continue
+		}
+		seconds := usage[v.Validator].Seconds()
+		if seconds == 0 {
+			continue
+		}
+		attestation.Seconds += seconds
+		attestation.Validators = append(attestation.Validators, AttestedValidatorUsage{
+			Validator: v.Validator,
+			FirstSeen: v.FirstSeen.UTC(),
+			LastSeen:  v.LastSeen.UTC(),
+			Seconds:   seconds,
+		})
+	}
+	sort.Slice(attestation.Validators, func(i, j int) bool {
+		return attestation.Validators[i].Validator < attestation.Validators[j].Validator
+	})
+
+	return attestation, nil
+}
+
+// Sign signs the attestation with key.
+func (a *UsageAttestation) Sign(key *ecdsa.PrivateKey) (*SignedUsageAttestation, error) {
+	content, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := crypto.Sign(accounts.TextHash(content), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign attestation: %w", err)
+	}
+	return &SignedUsageAttestation{
+		Attestation: content,
+		Signer:      crypto.PubkeyToAddress(key.PublicKey),
+		Signature:   signature,
+	}, nil
+}
+
+// VerifyUsageAttestation checks that the attestation was signed by its claimed signer
+// and returns it. Callers should then check the signer is one they trust.
+func VerifyUsageAttestation(signed *SignedUsageAttestation) (*UsageAttestation, error) {
+	if len(signed.Signature) != crypto.SignatureLength {
+		return nil, fmt.Errorf("%w: signature is %d bytes", ErrInvalidAttestation, len(signed.Signature))
+	}
+	// Whitespace may have been added when the attestation was re-encoded
+	var content bytes.Buffer
+	if err := json.Compact(&content, signed.Attestation); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	pubkey, err := crypto.SigToPub(accounts.TextHash(content.Bytes()), signed.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	if crypto.PubkeyToAddress(*pubkey) != signed.Signer {
+		return nil, fmt.Errorf("%w: not signed by %s", ErrInvalidAttestation, signed.Signer.Hex())
+	}
+
+	var attestation UsageAttestation
+	if err := json.Unmarshal(content.Bytes(), &attestation); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	if attestation.Version != usageAttestationVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidAttestation, attestation.Version)
+	}
+	return &attestation, nil
+}
+
+// serveOperatorAttestation returns a signed attestation of the usage of a node in the
+// buckets overlapping [from, to].
+func (pr *ProxyRouter) serveOperatorAttestation(w http.ResponseWriter, r *http.Request) {
+	if pr.ReportSigningKey == nil {
+		http.Error(w, "attestations require -report-signing-key", http.StatusNotImplemented)
+		return
+	}
+	if pr.attr == nil {
+		http.Error(w, "attestations require a SQL usage tracker", http.StatusNotImplemented)
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	node := common.HexToAddress(mux.Vars(r)["node"])
+	attestation, err := NewUsageAttestation(pr.usage(), pr.attr, node, from, to)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to aggregate attested usage", zap.Error(err))
+		http.Error(w, "failed to aggregate attested usage", http.StatusInternalServerError)
+		return
+	}
+	attestation.GeneratedAt = time.Now().UTC()
+
+	signed, err := attestation.Sign(pr.ReportSigningKey)
+	if err != nil {
+		pr.Logger.Error("Failed to sign usage attestation", zap.Error(err))
+		http.Error(w, "failed to sign usage attestation", http.StatusInternalServerError)
+		return
+	}
+
+	pr.Logger.Info("Attested operator usage",
+		zap.String("node", node.Hex()),
+		zap.Time("from", from),
+		zap.Time("to", to),
+		zap.Float64("seconds", attestation.Seconds))
+	pr.writeUsageJSON(w, r, signed)
+}
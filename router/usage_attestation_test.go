@@ -0,0 +1,99 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestUsageAttestation(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	var err error
+	if pr.attr, err = NewAttributionStore(zaptest.NewLogger(t), pr.orgs.Database); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.attr.Attribute(common.Address{1}, []string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.attr.Attribute(common.Address{9}, []string{"3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pr.ut.RecordUsage([]string{"1", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	handler := pr.AdminHandler()
+	const path = "/operators/0x0100000000000000000000000000000000000000/attestation?from=2000-01-01T00:00:00Z&to=2100-01-01T00:00:00Z"
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected %d without a signing key, got %d", http.StatusNotImplemented, rec.Code)
+	}
+
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.ReportSigningKey = key
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var signed SignedUsageAttestation
+	if err := json.NewDecoder(rec.Body).Decode(&signed); err != nil {
+		t.Fatal(err)
+	}
+	if signed.Signer != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Fatalf("Unexpected signer %s", signed.Signer.Hex())
+	}
+
+	// Validator 2 has no usage and validator 3 belongs to another node
+	attestation, err := VerifyUsageAttestation(&signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attestation.NodeAddress != (common.Address{1}) || len(attestation.Validators) != 1 ||
+		attestation.Validators[0].Validator != "1" || attestation.Seconds != attestation.Validators[0].Seconds || attestation.Seconds == 0 {
+		t.Fatalf("Unexpected attestation %+v", attestation)
+	}
+
+	// Indentation doesn't invalidate the signature
+	indented, err := json.MarshalIndent(signed, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reread SignedUsageAttestation
+	if err := json.Unmarshal(indented, &reread); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyUsageAttestation(&reread); err != nil {
+		t.Fatal(err)
+	}
+
+	attestation.Seconds *= 2
+	tampered, err := attestation.Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.Signature = signed.Signature
+	if _, err := VerifyUsageAttestation(tampered); !errors.Is(err, ErrInvalidAttestation) {
+		t.Fatal("Expected a tampered attestation to be invalid, got", err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/operators/0x0100000000000000000000000000000000000000/attestation?from=2100-01-01T00:00:00Z&to=2000-01-01T00:00:00Z", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %d for an inverted range, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
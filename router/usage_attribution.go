@@ -0,0 +1,171 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+// ValidatorAttribution records that a node address used the rescue node for a validator.
+type ValidatorAttribution struct {
+	NodeAddress common.Address `json:"node_address"`
+	Validator   string         `json:"validator"`
+	FirstSeen   time.Time      `json:"first_seen"`
+	LastSeen    time.Time      `json:"last_seen"`
+}
+
+// AttributionStore keeps track of which node address, as authenticated by its
+// credential, recorded usage for which validator. Usage itself is keyed by validator,
+// so this is what ties it back to an operator.
+type AttributionStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewAttributionStore creates the attribution table in db if needed.
+func NewAttributionStore(logger *zap.Logger, db *sql.DB) (*AttributionStore, error) {
+	store := &AttributionStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *AttributionStore) initSchema() error {
+	// Times are unix milliseconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS validator_attribution (
+		node_address TEXT NOT NULL,
+		validator_index TEXT NOT NULL,
+		first_seen INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		PRIMARY KEY (node_address, validator_index)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_attribution_validator ON validator_attribution(validator_index);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Attribute records that node used the rescue node for the given validators just now.
+func (store *AttributionStore) Attribute(node common.Address, indexes []string) error {
+	now := store.clock().UnixMilli()
+
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT INTO validator_attribution (node_address, validator_index, first_seen, last_seen)
+	VALUES (?1, ?2, ?3, ?3)
+	ON CONFLICT (node_address, validator_index) DO UPDATE SET
+		first_seen = MIN(first_seen, excluded.first_seen),
+		last_seen = MAX(last_seen, excluded.last_seen)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare attribution statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, index := range indexes {
+		if _, err := stmt.Exec(node.Hex(), index, now); err != nil {
+			return fmt.Errorf("failed to attribute validator %s to %s: %w", index, node.Hex(), err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Attributions returns the node addresses each of the given validators is attributed to.
+// Validators without attribution are omitted.
+func (store *AttributionStore) Attributions(validators []string) (map[string][]ValidatorAttribution, error) {
+	out := make(map[string][]ValidatorAttribution)
+	if len(validators) == 0 {
+		return out, nil
+	}
+
+	params := make([]string, 0, len(validators))
+	args := make([]any, 0, len(validators))
+	for _, validator := range validators {
+		params = append(params, "?")
+		args = append(args, validator)
+	}
+	rows, err := store.Database.Query(fmt.Sprintf(`
+	SELECT node_address, validator_index, first_seen, last_seen FROM validator_attribution
+	WHERE validator_index IN (%s) ORDER BY validator_index, node_address
+	`, strings.Join(params, ",")), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attribution: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a ValidatorAttribution
+		var node string
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&node, &a.Validator, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		a.NodeAddress = common.HexToAddress(node)
+		a.FirstSeen = time.UnixMilli(firstSeen).UTC()
+		a.LastSeen = time.UnixMilli(lastSeen).UTC()
+		out[a.Validator] = append(out[a.Validator], a)
+	}
+
+	return out, rows.Err()
+}
+
+// earliest returns when the first validator was attributed, or the zero time if none was.
+func (store *AttributionStore) earliest() (time.Time, error) {
+	var firstSeen sql.NullInt64
+	if err := store.Database.QueryRow("SELECT MIN(first_seen) FROM validator_attribution").Scan(&firstSeen); err != nil {
+		return time.Time{}, fmt.Errorf("failed to query attribution: %w", err)
+	}
+	if !firstSeen.Valid {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(firstSeen.Int64).UTC(), nil
+}
+
+// Validators returns the validators attributed to a node address, ordered by validator.
+func (store *AttributionStore) Validators(node common.Address) ([]ValidatorAttribution, error) {
+	rows, err := store.Database.Query(`
+	SELECT validator_index, first_seen, last_seen FROM validator_attribution
+	WHERE node_address = ? ORDER BY validator_index
+	`, node.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query attribution: %w", err)
+	}
+	defer rows.Close()
+
+	out := []ValidatorAttribution{}
+	for rows.Next() {
+		a := ValidatorAttribution{NodeAddress: node}
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&a.Validator, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		a.FirstSeen = time.UnixMilli(firstSeen).UTC()
+		a.LastSeen = time.UnixMilli(lastSeen).UTC()
+		out = append(out, a)
+	}
+
+	return out, rows.Err()
+}
@@ -0,0 +1,72 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupAttributionTestDatabase(t *testing.T, db *sql.DB) (*AttributionStore, *time.Time) {
+	store, err := NewAttributionStore(zaptest.NewLogger(t), db)
+	if err != nil {
+		t.Fatal("Failed to initialize schema:", err)
+	}
+
+	now := new(time.Time)
+	store.now = func() time.Time { return *now }
+
+	return store, now
+}
+
+func TestAttributionStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:attribution.db?mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	store, now := setupAttributionTestDatabase(t, db)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	node := common.HexToAddress("0x1234567890123456789012345678901234567890")
+	other := common.HexToAddress("0x0000000000000000000000000000000000000001")
+
+	*now = start
+	if err := store.Attribute(node, []string{"2", "1"}); err != nil {
+		t.Fatal(err)
+	}
+	*now = start.Add(time.Hour)
+	if err := store.Attribute(node, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Attribute(other, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	validators, err := store.Validators(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(validators) != 2 {
+		t.Fatalf("Expected 2 validators, got %+v", validators)
+	}
+	if validators[0].Validator != "1" || !validators[0].FirstSeen.Equal(start) || !validators[0].LastSeen.Equal(start.Add(time.Hour)) {
+		t.Fatalf("Unexpected attribution %+v", validators[0])
+	}
+	if validators[1].Validator != "2" || !validators[1].LastSeen.Equal(start) {
+		t.Fatalf("Unexpected attribution %+v", validators[1])
+	}
+
+	validators, err = store.Validators(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(validators) != 1 || !validators[0].FirstSeen.Equal(start.Add(time.Hour)) {
+		t.Fatalf("Unexpected attribution %+v", validators)
+	}
+}
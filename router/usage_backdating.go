@@ -0,0 +1,242 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrBackfillCallerRequired is returned when backfilling without a caller identity or
+	// backfill key.
+	ErrBackfillCallerRequired = errors.New("backfills require a caller identity")
+	// ErrBackdatingTooOld is returned when a caller without the elevated role backfills
+	// usage older than the maximum backdating age.
+	ErrBackdatingTooOld = errors.New("usage is older than the maximum backdating age")
+	// ErrBackdatingFuture is returned when backfilling usage after the current bucket.
+	ErrBackdatingFuture = errors.New("usage is after the current bucket")
+)
+
+// BackfillCaller is who is backfilling usage, as recorded in the backdating audit.
+type BackfillCaller struct {
+	Identity string `json:"identity"`
+	// Elevated callers may backfill usage of any age
+	Elevated bool `json:"elevated"`
+}
+
+// BackdatingAudit records a backdated insert, usage recorded in a bucket before the
+// current one.
+type BackdatingAudit struct {
+	ID         int64          `json:"id"`
+	Caller     BackfillCaller `json:"caller"`
+	Bucket     time.Time      `json:"bucket"`
+	Validators []string       `json:"validators"`
+	RecordedAt time.Time      `json:"recorded_at"`
+}
+
+// BackdatingAuditStore keeps the audit trail of backdated inserts, so fabricated usage
+// can be traced back to whoever backfilled it.
+type BackdatingAuditStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewBackdatingAuditStore creates the backdating audit table in db if needed.
+func NewBackdatingAuditStore(logger *zap.Logger, db *sql.DB) (*BackdatingAuditStore, error) {
+	store := &BackdatingAuditStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *BackdatingAuditStore) initSchema() error {
+	// validators is a JSON list, times are unix seconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS backdating_audit (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		caller TEXT NOT NULL,
+		elevated INTEGER NOT NULL,
+		bucket INTEGER NOT NULL,
+		validators TEXT NOT NULL,
+		recorded_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_backdating_audit_recorded_at ON backdating_audit(recorded_at);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Record audits caller backdating usage of validators into bucket.
+func (store *BackdatingAuditStore) Record(caller BackfillCaller, bucket time.Time, validators []string) error {
+	data, err := json.Marshal(validators)
+	if err != nil {
+		return err
+	}
+
+	_, err = store.Database.Exec(`
+	INSERT INTO backdating_audit (caller, elevated, bucket, validators, recorded_at) VALUES (?, ?, ?, ?, ?)
+	`, caller.Identity, caller.Elevated, bucket.Unix(), string(data), store.clock().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to record backdating audit: %w", err)
+	}
+	return nil
+}
+
+// List returns the backdated inserts recorded in [from, to), oldest first.
+func (store *BackdatingAuditStore) List(from time.Time, to time.Time) ([]BackdatingAudit, error) {
+	rows, err := store.Database.Query(`
+	SELECT id, caller, elevated, bucket, validators, recorded_at FROM backdating_audit
+	WHERE recorded_at >= ? AND recorded_at < ?
+	ORDER BY recorded_at, id
+	`, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query backdating audit: %w", err)
+	}
+	defer rows.Close()
+
+	out := []BackdatingAudit{}
+	for rows.Next() {
+		var a BackdatingAudit
+		var data string
+		var bucket, recordedAt int64
+		if err := rows.Scan(&a.ID, &a.Caller.Identity, &a.Caller.Elevated, &bucket, &data, &recordedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &a.Validators); err != nil {
+			return nil, fmt.Errorf("invalid backdating audit %d: %w", a.ID, err)
+		}
+		a.Bucket = time.Unix(bucket, 0).UTC()
+		a.RecordedAt = time.Unix(recordedAt, 0).UTC()
+		out = append(out, a)
+	}
+
+	return out, rows.Err()
+}
+
+// GuardedBackfiller is a UsageBackfiller which limits how far back Caller may record
+// usage, and audits every backdated insert, so backfills can't quietly fabricate
+// history.
+type GuardedBackfiller struct {
+	UsageBackfiller
+	Caller BackfillCaller
+	// Usage older than MaxAge can only be backfilled by elevated callers.
+	// 0 leaves the age unlimited.
+	MaxAge time.Duration
+	Audit  *BackdatingAuditStore
+}
+
+// NewGuardedBackfiller guards tracker for the caller key was issued to on the admin
+// API, see BackfillKeyStore, auditing in the usage database. The maximum age is the
+// key's.
+func NewGuardedBackfiller(logger *zap.Logger, tracker UsageBackfiller, key string) (*GuardedBackfiller, error) {
+	if key == "" {
+		return nil, ErrBackfillCallerRequired
+	}
+	db, ok := tracker.(sqlUsageTracker)
+	if !ok {
+		return nil, fmt.Errorf("backdating audits require a SQL usage tracker")
+	}
+	keys, err := NewBackfillKeyStore(logger, db.primaryDatabase())
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize backfill keys: %w", err)
+	}
+	issued, err := keys.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return newGuardedBackfiller(logger, tracker, issued.Caller, time.Duration(issued.MaxAgeSeconds)*time.Second)
+}
+
+// newGuardedBackfiller guards tracker for caller, who must already be trusted.
+func newGuardedBackfiller(logger *zap.Logger, tracker UsageBackfiller, caller BackfillCaller, maxAge time.Duration) (*GuardedBackfiller, error) {
+	if caller.Identity == "" {
+		return nil, ErrBackfillCallerRequired
+	}
+	db, ok := tracker.(sqlUsageTracker)
+	if !ok {
+		return nil, fmt.Errorf("backdating audits require a SQL usage tracker")
+	}
+	audit, err := NewBackdatingAuditStore(logger, db.primaryDatabase())
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize the backdating audit: %w", err)
+	}
+
+	return &GuardedBackfiller{
+		UsageBackfiller: tracker,
+		Caller:          caller,
+		MaxAge:          maxAge,
+		Audit:           audit,
+	}, nil
+}
+
+// RecordUsageAt checks the age of at against MaxAge, and audits the insert before
+// recording it if at is before the current bucket. Usage after the current bucket
+// is refused. An insert which fails after its audit is left audited.
+func (b *GuardedBackfiller) RecordUsageAt(at time.Time, indexes []string) error {
+	return b.record(at, indexes, b.UsageBackfiller.RecordUsageAt)
+}
+
+// recordLate is RecordUsageAt for live usage written late, which keeps the accounting
+// of live usage if the tracker supports it, see lateUsageRecorder.
+func (b *GuardedBackfiller) recordLate(at time.Time, indexes []string) error {
+	late, ok := b.UsageBackfiller.(lateUsageRecorder)
+	if !ok {
+		return b.RecordUsageAt(at, indexes)
+	}
+	return b.record(at, indexes, late.recordUsageLate)
+}
+
+func (b *GuardedBackfiller) record(at time.Time, indexes []string, write func(time.Time, []string) error) error {
+	if b.Caller.Identity == "" {
+		return ErrBackfillCallerRequired
+	}
+	if at.IsZero() {
+		return ErrZeroTime
+	}
+
+	now := b.Audit.clock()
+	precision := b.bucketPrecision()
+	bucket := at.Truncate(precision)
+	current := now.Truncate(precision)
+	if bucket.After(current) {
+		b.Audit.Logger.Warn("Refused future usage",
+			zap.String("caller", b.Caller.Identity),
+			zap.Time("bucket", bucket))
+		return fmt.Errorf("%w: %s is after %s",
+			ErrBackdatingFuture, bucket.UTC().Format(time.RFC3339), current.UTC().Format(time.RFC3339))
+	}
+	if bucket.Equal(current) {
+		return write(at, indexes)
+	}
+
+	if age := now.Sub(at); b.MaxAge > 0 && age > b.MaxAge && !b.Caller.Elevated {
+		b.Audit.Logger.Warn("Refused backdated usage",
+			zap.String("caller", b.Caller.Identity),
+			zap.Time("bucket", bucket),
+			zap.Duration("age", age))
+		return fmt.Errorf("%w: %s is %s old, the maximum is %s without the elevated role",
+			ErrBackdatingTooOld, bucket.UTC().Format(time.RFC3339), age.Truncate(time.Second), b.MaxAge)
+	}
+
+	if err := b.Audit.Record(b.Caller, bucket, indexes); err != nil {
+		return err
+	}
+	return write(at, indexes)
+}
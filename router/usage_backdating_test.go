@@ -0,0 +1,139 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestGuardedBackfiller(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	keys, err := NewBackfillKeyStore(zaptest.NewLogger(t), tracker.(sqlUsageTracker).primaryDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2025, 1, 10, 12, 2, 0, 0, time.UTC)
+	guard := func(caller BackfillCaller) *GuardedBackfiller {
+		key, err := keys.Create(caller, 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := NewGuardedBackfiller(zaptest.NewLogger(t), tracker.(UsageBackfiller), key.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.Audit.now = func() time.Time { return now }
+		return b
+	}
+	operator := guard(BackfillCaller{Identity: "operator"})
+	admin := guard(BackfillCaller{Identity: "admin", Elevated: true})
+
+	if _, err := NewGuardedBackfiller(zaptest.NewLogger(t), tracker.(UsageBackfiller), ""); !errors.Is(err, ErrBackfillCallerRequired) {
+		t.Fatalf("Expected a missing caller error, got %v", err)
+	}
+	// The role and maximum age come from the key, callers can't assert them
+	if _, err := NewGuardedBackfiller(zaptest.NewLogger(t), tracker.(UsageBackfiller), "not-a-key"); !errors.Is(err, ErrInvalidBackfillKey) {
+		t.Fatalf("Expected an invalid key error, got %v", err)
+	}
+	if operator.MaxAge != 24*time.Hour {
+		t.Fatalf("Expected the maximum age of the key, got %v", operator.MaxAge)
+	}
+	if _, err := keys.Create(BackfillCaller{Elevated: true}, 0); !errors.Is(err, ErrBackfillCallerRequired) {
+		t.Fatalf("Expected a missing caller error, got %v", err)
+	}
+	if _, err := keys.Create(BackfillCaller{Identity: "operator"}, -time.Hour); !errors.Is(err, ErrInvalidBackfillMaxAge) {
+		t.Fatalf("Expected an invalid max age error, got %v", err)
+	}
+
+	// Within the maximum age
+	recent := now.Add(-time.Hour)
+	if err := operator.RecordUsageAt(recent, []string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	// The current bucket isn't backdated
+	if err := operator.RecordUsageAt(now, []string{"3"}); err != nil {
+		t.Fatal(err)
+	}
+	// Nor can anyone write usage ahead of it
+	for _, b := range []*GuardedBackfiller{operator, admin} {
+		if err := b.RecordUsageAt(now.Add(5*time.Minute), []string{"5"}); !errors.Is(err, ErrBackdatingFuture) {
+			t.Fatalf("Expected a future usage error, got %v", err)
+		}
+	}
+
+	// Older usage requires the elevated role
+	old := now.Add(-48 * time.Hour)
+	if err := operator.RecordUsageAt(old, []string{"4"}); !errors.Is(err, ErrBackdatingTooOld) {
+		t.Fatalf("Expected a backdating error, got %v", err)
+	}
+	if err := admin.RecordUsageAt(old, []string{"4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := tracker.ViewUsage(old, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, validator := range []string{"1", "2", "3", "4"} {
+		if usage[validator] != 5*time.Minute {
+			t.Fatalf("Expected usage of validator %s, got %v", validator, usage)
+		}
+	}
+	future, err := tracker.ViewUsage(now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := future["5"]; ok {
+		t.Fatalf("Expected no future usage, got %v", future)
+	}
+
+	audits, err := operator.Audit.List(old, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audits) != 2 {
+		t.Fatalf("Expected 2 audited inserts, got %+v", audits)
+	}
+	if a := audits[0]; a.Caller.Identity != "operator" || a.Caller.Elevated || !a.Bucket.Equal(recent.Truncate(5*time.Minute)) || !slices.Equal(a.Validators, []string{"1", "2"}) {
+		t.Fatalf("Unexpected audit %+v", a)
+	}
+	if a := audits[1]; a.Caller.Identity != "admin" || !a.Caller.Elevated || !a.Bucket.Equal(old.Truncate(5*time.Minute)) {
+		t.Fatalf("Unexpected audit %+v", a)
+	}
+
+	// Revoked keys can't backfill
+	issued, err := keys.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issued) != 2 || issued[0].Key != "" || issued[0].MaxAgeSeconds != int64((24*time.Hour).Seconds()) {
+		t.Fatalf("Expected 2 keys without secrets, got %+v", issued)
+	}
+	key, err := keys.Create(BackfillCaller{Identity: "revoked"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Revoke(key.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Revoke(key.ID); !errors.Is(err, ErrNoBackfillKey) {
+		t.Fatalf("Expected a missing key error, got %v", err)
+	}
+	if key.MaxAgeSeconds != int64(defaultBackfillKeyMaxAge.Seconds()) {
+		t.Fatalf("Expected the default max age, got %+v", key)
+	}
+	if _, err := NewGuardedBackfiller(zaptest.NewLogger(t), tracker.(UsageBackfiller), key.Key); !errors.Is(err, ErrInvalidBackfillKey) {
+		t.Fatalf("Expected an invalid key error, got %v", err)
+	}
+}
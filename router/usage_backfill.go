@@ -0,0 +1,217 @@
+//go:build ns
+
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// UsageBackfiller is implemented by trackers which can record usage in the past.
+type UsageBackfiller interface {
+	UsageTracker
+	// RecordUsageAt records usage in the bucket containing at.
+	// Usage already recorded in that bucket is left as is.
+	RecordUsageAt(at time.Time, indexes []string) error
+	bucketPrecision() time.Duration
+}
+
+// RecordUsageAt records usage in the bucket containing at, ignoring the boundary grace
+// and the clock skew policy, which only apply to live usage.
+func (tracker *SQLiteUsageTracker) RecordUsageAt(at time.Time, indexes []string) error {
+	if err := ValidatePrecision(tracker.Precision); err != nil {
+		return err
+	}
+	if at.IsZero() {
+		return ErrZeroTime
+	}
+	if tracker.MultiTenant {
+		return ErrTenantRequired
+	}
+
+	timestampUnix := at.Truncate(tracker.Precision).Unix()
+	return retryUsageWrite(tracker.Logger, tracker.WriteRetries, func() {
+		tracker.incCounter("write_retries")
+	}, func() error {
+		return tracker.recordUsage(timestampUnix, indexes)
+	})
+}
+
+// lateUsageRecorder is implemented by trackers which can record live usage written
+// after the fact, see UsageWriteQueue. Unlike backfills, late usage keeps the boundary
+// grace and occupancy it would have had if it had been written when it was recorded.
+type lateUsageRecorder interface {
+	recordUsageLate(at time.Time, indexes []string) error
+}
+
+func (tracker *SQLiteUsageTracker) recordUsageLate(at time.Time, indexes []string) error {
+	if err := ValidatePrecision(tracker.Precision); err != nil {
+		return err
+	}
+	if at.IsZero() {
+		return ErrZeroTime
+	}
+	if tracker.MultiTenant {
+		return ErrTenantRequired
+	}
+	return tracker.recordActivity(at, "", indexes)
+}
+
+func (tracker *HybridUsageTracker) recordUsageLate(at time.Time, indexes []string) error {
+	return tracker.Buckets.recordUsageLate(at, indexes)
+}
+
+// RecordUsageAt backfills the buckets only. Sessions can only be extended forward
+// in time, so the session model can't be backfilled.
+func (tracker *HybridUsageTracker) RecordUsageAt(at time.Time, indexes []string) error {
+	return tracker.Buckets.RecordUsageAt(at, indexes)
+}
+
+// AccessLogFormat describes where access log lines keep the time of a request and
+// the validators it was made for.
+type AccessLogFormat struct {
+	// Must have the named groups "time" and "validators". validators is a list of
+	// validator indices or pubkeys separated by commas or whitespace.
+	Pattern *regexp.Regexp
+	// Layout of the time group, see time.Parse
+	TimeLayout string
+}
+
+// NewAccessLogFormat compiles pattern and checks it has the groups AccessLogFormat needs.
+func NewAccessLogFormat(pattern string, timeLayout string) (*AccessLogFormat, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	for _, group := range []string{"time", "validators"} {
+		if re.SubexpIndex(group) < 0 {
+			return nil, fmt.Errorf("access log pattern has no %q group", group)
+		}
+	}
+	if timeLayout == "" {
+		return nil, fmt.Errorf("empty access log time layout")
+	}
+
+	return &AccessLogFormat{Pattern: re, TimeLayout: timeLayout}, nil
+}
+
+// BackfillStats counts what an access log backfill did.
+type BackfillStats struct {
+	Lines int
+	// Lines which didn't match the pattern or had an invalid time
+	Skipped int
+	// Validators which couldn't be resolved to an index
+	Unresolved int
+	// Distinct bucket and validator pairs recorded, including ones which already existed
+	Records int
+}
+
+// AccessLogBackfill records the usage found in historical access logs, for deployments
+// which ran before usage was tracked.
+//
+// Requests for the same validator in the same bucket are recorded once, and buckets
+// which already have usage aren't changed, so overlapping logs can be backfilled
+// more than once.
+type AccessLogBackfill struct {
+	Tracker UsageBackfiller
+	Format  *AccessLogFormat
+	// Optional. Maps validator pubkeys found in the logs to indices.
+	// Identifiers which aren't pubkeys are recorded as is.
+	Resolve func(pubkey string) (string, bool)
+	// Only lines in [From, To) are backfilled. Zero values leave the range open.
+	From   time.Time
+	To     time.Time
+	Logger *zap.Logger
+}
+
+func isPubkey(validator string) bool {
+	return len(validator) == 98 && strings.HasPrefix(validator, "0x")
+}
+
+// Run reads access log lines from r until EOF.
+// Buckets are flushed as soon as a line of another bucket is read, so logs are best
+// read in chronological order, though it isn't required.
+func (b *AccessLogBackfill) Run(r io.Reader) (BackfillStats, error) {
+	var stats BackfillStats
+	timeGroup := b.Format.Pattern.SubexpIndex("time")
+	validatorsGroup := b.Format.Pattern.SubexpIndex("validators")
+
+	precision := b.Tracker.bucketPrecision()
+	var bucket time.Time
+	pending := make(map[string]struct{})
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		indexes := make([]string, 0, len(pending))
+		for index := range pending {
+			indexes = append(indexes, index)
+		}
+		if err := b.Tracker.RecordUsageAt(bucket, indexes); err != nil {
+			return fmt.Errorf("failed to backfill bucket %s: %w", bucket.Format(time.RFC3339), err)
+		}
+		stats.Records += len(indexes)
+		clear(pending)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		stats.Lines++
+		match := b.Format.Pattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			stats.Skipped++
+			continue
+		}
+		at, err := time.Parse(b.Format.TimeLayout, match[timeGroup])
+		if err != nil {
+			b.Logger.Debug("Invalid access log time", zap.Int("line", stats.Lines), zap.Error(err))
+			stats.Skipped++
+			continue
+		}
+		if (!b.From.IsZero() && at.Before(b.From)) || (!b.To.IsZero() && !at.Before(b.To)) {
+			continue
+		}
+
+		if lineBucket := at.Truncate(precision); !lineBucket.Equal(bucket) {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+			bucket = lineBucket
+		}
+
+		for _, validator := range strings.FieldsFunc(match[validatorsGroup], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		}) {
+			validator = strings.Trim(validator, `"[]`)
+			if validator == "" {
+				continue
+			}
+			if isPubkey(validator) {
+				if b.Resolve == nil {
+					stats.Unresolved++
+					continue
+				}
+				index, ok := b.Resolve(strings.ToLower(validator))
+				if !ok {
+					stats.Unresolved++
+					continue
+				}
+				validator = index
+			}
+			pending[validator] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+
+	return stats, flush()
+}
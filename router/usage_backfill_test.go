@@ -0,0 +1,94 @@
+//go:build ns
+
+package router
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+const nginxLayout = "02/Jan/2006:15:04:05 -0700"
+
+func TestNewAccessLogFormat(t *testing.T) {
+	if _, err := NewAccessLogFormat(`\[(?P<time>[^\]]+)\]`, nginxLayout); err == nil {
+		t.Fatal("Expected an error without a validators group")
+	}
+	if _, err := NewAccessLogFormat(`(?P<time>`, nginxLayout); err == nil {
+		t.Fatal("Expected an error for an invalid pattern")
+	}
+	if _, err := NewAccessLogFormat(`\[(?P<time>[^\]]+)\] (?P<validators>\S+)`, ""); err == nil {
+		t.Fatal("Expected an error without a time layout")
+	}
+}
+
+func TestAccessLogBackfill(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+
+	format, err := NewAccessLogFormat(`\[(?P<time>[^\]]+)\] "POST \S+" validators=(?P<validators>\S*)`, nginxLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey := "0x" + strings.Repeat("ab", 48)
+	unknown := "0x" + strings.Repeat("cd", 48)
+
+	logs := strings.Join([]string{
+		`[01/Jan/2025:00:01:00 +0000] "POST /eth/v1/validator/prepare_beacon_proposer" validators=1,2`,
+		`[01/Jan/2025:00:02:00 +0000] "POST /eth/v1/validator/prepare_beacon_proposer" validators=1`,
+		`garbage`,
+		`[01/Jan/2025:00:06:00 +0000] "POST /eth/v1/validator/register_validator" validators=` + pubkey + `,` + unknown,
+		`[not a time] "POST /eth/v1/validator/prepare_beacon_proposer" validators=1`,
+		// Outside of the range
+		`[01/Jan/2025:01:00:00 +0000] "POST /eth/v1/validator/prepare_beacon_proposer" validators=1`,
+	}, "\n")
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	backfill := &AccessLogBackfill{
+		Tracker: sqlite,
+		Format:  format,
+		Resolve: func(p string) (string, bool) {
+			if p == pubkey {
+				return "1", true
+			}
+			return "", false
+		},
+		To:     start.Add(time.Hour),
+		Logger: zaptest.NewLogger(t),
+	}
+
+	stats, err := backfill.Run(strings.NewReader(logs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := BackfillStats{Lines: 6, Skipped: 2, Unresolved: 1, Records: 3}
+	if stats != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, stats)
+	}
+
+	usage, err := sqlite.ViewUsage(start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] != 10*time.Minute || usage["2"] != 5*time.Minute || len(usage) != 2 {
+		t.Fatalf("Unexpected usage %v", usage)
+	}
+
+	// Backfilling the same logs again changes nothing
+	if _, err := backfill.Run(strings.NewReader(logs)); err != nil {
+		t.Fatal(err)
+	}
+	usage, err = sqlite.ViewUsage(start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] != 10*time.Minute || usage["2"] != 5*time.Minute {
+		t.Fatalf("Expected the backfill to be idempotent, got %v", usage)
+	}
+}
@@ -0,0 +1,161 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// UsageCapability is an optional feature of a usage tracker. Features of the admin
+// API and background jobs which need one are unavailable on trackers without it.
+type UsageCapability string
+
+const (
+	// Usage is recorded in fixed-size buckets, which daily reports, duty coverage,
+	// ownership snapshots, validator metadata and operator aggregates are built on
+	UsageCapabilityBuckets UsageCapability = "buckets"
+	// Records can be committed to and proven, see CommitUsage
+	UsageCapabilityCommitments UsageCapability = "commitments"
+	// Records can be counted cheaply, which the admin query cost limit needs
+	UsageCapabilityRecordCounts UsageCapability = "record_counts"
+	// A validator's records can be listed, e.g. in operator exports
+	UsageCapabilityRecordListing UsageCapability = "record_listing"
+	// Records can be exported incrementally
+	UsageCapabilityExport UsageCapability = "export"
+	// Usage can be recorded in the past, see UsageBackfiller
+	UsageCapabilityBackfill UsageCapability = "backfill"
+	// Records keep their tenant, which multi-tenant mode needs
+	UsageCapabilityTenants UsageCapability = "tenants"
+	// Old records can be deleted by the retention job
+	UsageCapabilityRetention UsageCapability = "retention"
+	// The usage databases can be pinged
+	UsageCapabilityHealthCheck UsageCapability = "health_check"
+	// In-memory state can be restored from records after a restart
+	UsageCapabilityWarmUp UsageCapability = "warm_up"
+	// Other stores can share the tracker's SQL database, which operator settings,
+	// aliases, organizations and saved reports live in
+	UsageCapabilitySQL UsageCapability = "sql"
+	// Bucket and session usage can be reconciled
+	UsageCapabilityReconciliation UsageCapability = "reconciliation"
+)
+
+// How to get a tracker with each capability, for error messages
+var usageCapabilityHints = map[UsageCapability]string{
+	UsageCapabilityBuckets:        "-usage-model=buckets or hybrid",
+	UsageCapabilityCommitments:    "-usage-model=buckets or hybrid",
+	UsageCapabilityRecordCounts:   "-usage-model=buckets or hybrid",
+	UsageCapabilityRecordListing:  "-usage-model=buckets or hybrid",
+	UsageCapabilityExport:         "-usage-model=buckets or hybrid",
+	UsageCapabilityBackfill:       "-usage-model=buckets",
+	UsageCapabilityTenants:        "-usage-model=buckets without a shadow backend",
+	UsageCapabilityRetention:      "a SQL usage tracker",
+	UsageCapabilityHealthCheck:    "a SQL usage tracker",
+	UsageCapabilityWarmUp:         "-usage-model=buckets or hybrid",
+	UsageCapabilitySQL:            "a SQL usage tracker",
+	UsageCapabilityReconciliation: "-usage-model=hybrid",
+}
+
+// UsageCapabilities is a sorted set of capabilities.
+type UsageCapabilities []UsageCapability
+
+// Has returns whether c is in the set.
+func (cs UsageCapabilities) Has(c UsageCapability) bool {
+	_, found := slices.BinarySearch(cs, c)
+	return found
+}
+
+// UsageCapabilitiesOf returns the capabilities of tracker, from the optional interfaces
+// it implements, so what it reports always matches what the type assertions of the
+// features find. Wrappers such as ShadowUsageTracker only have their own capabilities,
+// not the wrapped tracker's: features which bypass them would go unverified.
+func UsageCapabilitiesOf(tracker UsageTracker) UsageCapabilities {
+	out := UsageCapabilities{}
+	add := func(c UsageCapability, ok bool) {
+		if ok {
+			out = append(out, c)
+		}
+	}
+
+	_, ok := tracker.(usageBuckets)
+	add(UsageCapabilityBuckets, ok)
+	_, ok = tracker.(usageCommitter)
+	add(UsageCapabilityCommitments, ok)
+	_, ok = tracker.(usageCounter)
+	add(UsageCapabilityRecordCounts, ok)
+	_, ok = tracker.(usageRecordLister)
+	add(UsageCapabilityRecordListing, ok)
+	_, ok = tracker.(usageExporter)
+	add(UsageCapabilityExport, ok)
+	_, ok = tracker.(UsageBackfiller)
+	add(UsageCapabilityBackfill, ok)
+	_, ok = tracker.(tenantUsageStore)
+	add(UsageCapabilityTenants, ok)
+	_, ok = tracker.(usagePruner)
+	add(UsageCapabilityRetention, ok)
+	_, ok = tracker.(usageHealthChecker)
+	add(UsageCapabilityHealthCheck, ok)
+	_, ok = tracker.(usageWarmer)
+	add(UsageCapabilityWarmUp, ok)
+	_, ok = tracker.(sqlUsageTracker)
+	add(UsageCapabilitySQL, ok)
+	_, ok = tracker.(*HybridUsageTracker)
+	add(UsageCapabilityReconciliation, ok)
+
+	slices.Sort(out)
+	return out
+}
+
+// UnsupportedError is returned for features the usage tracker lacks a capability for.
+// It matches errors.ErrUnsupported.
+type UnsupportedError struct {
+	// Feature which was requested, e.g. "daily usage"
+	Feature    string
+	Capability UsageCapability
+}
+
+func (e *UnsupportedError) Error() string {
+	msg := fmt.Sprintf("%s is unsupported by the usage tracker, it lacks the %s capability", e.Feature, e.Capability)
+	if hint, ok := usageCapabilityHints[e.Capability]; ok {
+		msg += fmt.Sprintf(" (requires %s)", hint)
+	}
+	return msg
+}
+
+func (e *UnsupportedError) Unwrap() error {
+	return errors.ErrUnsupported
+}
+
+// requireCapability returns an *UnsupportedError if tracker lacks c.
+func requireCapability(tracker UsageTracker, feature string, c UsageCapability) error {
+	if UsageCapabilitiesOf(tracker).Has(c) {
+		return nil
+	}
+	return &UnsupportedError{Feature: feature, Capability: c}
+}
+
+// requireUsageCapability rejects the request with a 501 if the usage tracker lacks c,
+// and otherwise returns true.
+func (pr *ProxyRouter) requireUsageCapability(w http.ResponseWriter, feature string, c UsageCapability) bool {
+	if err := requireCapability(pr.ut, feature, c); err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return false
+	}
+	return true
+}
+
+// serveUsageCapabilities returns the usage model and the capabilities of the usage
+// tracker, so clients can tell which features are available before using them.
+func (pr *ProxyRouter) serveUsageCapabilities(w http.ResponseWriter, r *http.Request) {
+	model := pr.UsageTrackerOptions.Model
+	if model == "" {
+		model = UsageModelBuckets
+	}
+
+	pr.writeUsageJSON(w, r, struct {
+		Model        UsageModel        `json:"model"`
+		Capabilities UsageCapabilities `json:"capabilities"`
+	}{model, UsageCapabilitiesOf(pr.ut)})
+}
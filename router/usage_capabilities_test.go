@@ -0,0 +1,113 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestUsageCapabilities(t *testing.T) {
+	buckets, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sessions, _ := setupSessionTestDatabase(t, 10*time.Minute)
+	hybrid, _ := setupHybridTestDatabase(t, 5*time.Minute, 10*time.Minute)
+
+	tests := []struct {
+		name    string
+		tracker UsageTracker
+		has     []UsageCapability
+		lacks   []UsageCapability
+	}{
+		{
+			"buckets", buckets,
+			[]UsageCapability{UsageCapabilityBuckets, UsageCapabilityCommitments, UsageCapabilityRecordCounts, UsageCapabilityExport, UsageCapabilityBackfill, UsageCapabilityTenants, UsageCapabilitySQL},
+			[]UsageCapability{UsageCapabilityReconciliation},
+		},
+		{
+			"sessions", sessions,
+			[]UsageCapability{UsageCapabilitySQL},
+			[]UsageCapability{UsageCapabilityBuckets, UsageCapabilityCommitments, UsageCapabilityExport, UsageCapabilityReconciliation},
+		},
+		{
+			"hybrid", hybrid,
+			[]UsageCapability{UsageCapabilityBuckets, UsageCapabilityCommitments, UsageCapabilityReconciliation, UsageCapabilitySQL},
+			[]UsageCapability{UsageCapabilityTenants},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caps := UsageCapabilitiesOf(tt.tracker)
+			for _, c := range tt.has {
+				if !caps.Has(c) {
+					t.Errorf("Expected %s, got %v", c, caps)
+				}
+			}
+			for _, c := range tt.lacks {
+				if caps.Has(c) {
+					t.Errorf("Expected no %s, got %v", c, caps)
+				}
+			}
+		})
+	}
+
+	err = requireCapability(sessions, "daily usage", UsageCapabilityBuckets)
+	if !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("Expected an unsupported error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "-usage-model=buckets or hybrid") {
+		t.Fatalf("Expected the error to say how to get the capability, got %q", err)
+	}
+	if err := requireCapability(buckets, "daily usage", UsageCapabilityBuckets); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeUsageCapabilities(t *testing.T) {
+	tracker, _ := setupSessionTestDatabase(t, 10*time.Minute)
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	pr.UsageTrackerOptions.Model = UsageModelSessions
+	handler := pr.AdminHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/capabilities", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var out struct {
+		Model        UsageModel        `json:"model"`
+		Capabilities UsageCapabilities `json:"capabilities"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Model != UsageModelSessions || out.Capabilities.Has(UsageCapabilityBuckets) {
+		t.Fatalf("Unexpected capabilities %+v", out)
+	}
+
+	// Features the tracker lacks a capability for are rejected with the reason
+	for _, path := range []string{"/usage/daily", "/usage/commitment", "/usage/export"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"?from=2025-01-01T00:00:00Z&to=2025-01-02T00:00:00Z", nil))
+		if rec.Code != http.StatusNotImplemented {
+			t.Fatalf("Expected %d for %s, got %d", http.StatusNotImplemented, path, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), "capability") {
+			t.Fatalf("Expected the missing capability for %s, got %q", path, rec.Body.String())
+		}
+	}
+}
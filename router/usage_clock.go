@@ -0,0 +1,75 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ClockSkewPolicy selects how RecordUsage handles a wall clock that moved backwards,
+// e.g. after an NTP correction.
+type ClockSkewPolicy string
+
+const (
+	// ClockSkewClamp records into the bucket of the latest time seen so far,
+	// so usage is never written into a bucket older than one already written.
+	ClockSkewClamp ClockSkewPolicy = "clamp"
+	// ClockSkewWarn records at the current wall clock time and logs a warning.
+	ClockSkewWarn ClockSkewPolicy = "warn"
+	// ClockSkewDrop discards the usage and returns ErrClockSkew.
+	ClockSkewDrop ClockSkewPolicy = "drop"
+)
+
+// ErrClockSkew is returned by RecordUsage when the wall clock is behind the latest
+// recorded time and the ClockSkewDrop policy is used.
+var ErrClockSkew = errors.New("wall clock moved backwards")
+
+// Concurrent callers may observe slightly out-of-order times, which isn't skew.
+const usageClockSkewTolerance = time.Second
+
+// timestamp returns the time usage should be recorded at. It compares the wall clock
+// against the latest time a previous call recorded at and applies the skew policy
+// when the clock is behind by more than usageClockSkewTolerance.
+func (tracker *SQLiteUsageTracker) timestamp() (time.Time, error) {
+	now := tracker.clock()
+	latest := time.Unix(0, tracker.latest.Load())
+
+	skew := latest.Sub(now)
+	if skew <= usageClockSkewTolerance {
+		if tracker.skewed.CompareAndSwap(true, false) {
+			tracker.Logger.Info("Wall clock caught up with recorded usage")
+		}
+
+		// Advance the latest time, unless a concurrent call already moved it further
+		for {
+			cur := tracker.latest.Load()
+			if now.UnixNano() <= cur || tracker.latest.CompareAndSwap(cur, now.UnixNano()) {
+				break
+			}
+		}
+		return now, nil
+	}
+
+	tracker.incCounter("clock_skew")
+	// Only log when entering the skewed state, every call is skewed until the clock catches up
+	if tracker.skewed.CompareAndSwap(false, true) {
+		tracker.Logger.Warn("Wall clock moved backwards, applying skew policy",
+			zap.Time("latest", latest),
+			zap.Time("now", now),
+			zap.Duration("skew", skew),
+			zap.String("policy", string(tracker.SkewPolicy)))
+	}
+
+	switch tracker.SkewPolicy {
+	case ClockSkewWarn:
+		return now, nil
+	case ClockSkewDrop:
+		return time.Time{}, fmt.Errorf("%w by %v", ErrClockSkew, skew)
+	default:
+		return latest, nil
+	}
+}
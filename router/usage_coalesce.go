@@ -0,0 +1,77 @@
+//go:build ns
+
+package router
+
+import "sync"
+
+// usageCoalescer remembers which validators were recorded in the current bucket, so
+// repeated activity within a bucket skips the database. Buckets are deduplicated on
+// write, so skipped writes can't change usage. Only successful writes are remembered,
+// which guarantees at least one record per validator and bucket. In multi-tenant mode,
+// each tenant's records are remembered separately.
+type usageCoalescer struct {
+	sync.Mutex
+
+	bucket   int64
+	recorded map[coalescedRecord]struct{}
+	// Bounds recorded, see MemoryBudget
+	limit cacheLimit
+}
+
+type coalescedRecord struct {
+	tenant string
+	index  string
+}
+
+// pending returns the indexes not yet recorded in bucket for tenant.
+func (c *usageCoalescer) pending(bucket int64, tenant string, indexes []string) []string {
+	c.Lock()
+	defer c.Unlock()
+
+	if bucket > c.bucket {
+		c.bucket = bucket
+		c.recorded = make(map[coalescedRecord]struct{})
+	}
+	if bucket < c.bucket {
+		// Only the latest bucket is remembered, e.g. with a ClockSkewWarn policy
+		return indexes
+	}
+
+	return filterIndexes(indexes, func(index string) bool {
+		_, ok := c.recorded[coalescedRecord{tenant, index}]
+		return !ok
+	})
+}
+
+// done remembers that indexes were recorded in bucket for tenant.
+func (c *usageCoalescer) done(bucket int64, tenant string, indexes []string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if bucket != c.bucket {
+		return
+	}
+	for _, index := range indexes {
+		key := coalescedRecord{tenant, index}
+		if _, ok := c.recorded[key]; ok {
+			continue
+		}
+		if c.limit.full(len(c.recorded)) {
+			// Further writes of the validator in the bucket go to the database,
+			// which deduplicates them
+			c.limit.evictions.Add(1)
+			continue
+		}
+		c.recorded[key] = struct{}{}
+	}
+}
+
+func (c *usageCoalescer) cacheEntries() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.recorded)
+}
+
+func (c *usageCoalescer) cacheEvictions() uint64 {
+	return c.limit.evictions.Load()
+}
@@ -0,0 +1,102 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUsageCoalescer(t *testing.T) {
+	var c usageCoalescer
+
+	if pending := c.pending(10, "", []string{"1", "2"}); len(pending) != 2 {
+		t.Fatalf("Expected both pending, got %v", pending)
+	}
+	c.done(10, "", []string{"1"})
+	if pending := c.pending(10, "", []string{"1", "2"}); len(pending) != 1 || pending[0] != "2" {
+		t.Fatalf("Expected 2 pending, got %v", pending)
+	}
+
+	// A new bucket forgets the previous one
+	if pending := c.pending(20, "", []string{"1"}); len(pending) != 1 {
+		t.Fatalf("Expected 1 pending in a new bucket, got %v", pending)
+	}
+	// Writes completing after the bucket moved on aren't remembered
+	c.done(10, "", []string{"3"})
+	if pending := c.pending(20, "", []string{"3"}); len(pending) != 1 {
+		t.Fatalf("Expected 3 pending, got %v", pending)
+	}
+	// Older buckets are never coalesced
+	if pending := c.pending(10, "", []string{"1"}); len(pending) != 1 {
+		t.Fatalf("Expected 1 pending in an older bucket, got %v", pending)
+	}
+}
+
+func TestCoalescedUsage(t *testing.T) {
+	newTracker := func(coalesce bool) *SQLiteUsageTracker {
+		tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cleanup)
+		sqlite := tracker.(*SQLiteUsageTracker)
+		sqlite.Coalesce = coalesce
+		return sqlite
+	}
+	plain := newTracker(false)
+	coalesced := newTracker(true)
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	plain.now = func() time.Time { return now }
+	coalesced.now = func() time.Time { return now }
+
+	// Bursts of requests for overlapping validators across many buckets
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		now = now.Add(time.Duration(random.Intn(10)) * time.Second)
+		indexes := make([]string, 1+random.Intn(5))
+		for j := range indexes {
+			indexes[j] = strconv.Itoa(random.Intn(20))
+		}
+
+		// A failed write must not be remembered, the next request writes again
+		if i%100 == 0 {
+			failed := strconv.Itoa(1000 + i)
+			coalesced.Faults = &FaultInjector{ErrorRate: 1}
+			if err := coalesced.RecordUsage([]string{failed}); !errors.Is(err, ErrInjectedFault) {
+				t.Fatalf("Expected an injected error, got %v", err)
+			}
+			coalesced.Faults = nil
+			indexes = append(indexes, failed)
+		}
+
+		if err := plain.RecordUsage(indexes); err != nil {
+			t.Fatal(err)
+		}
+		if err := coalesced.RecordUsage(indexes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := plain.ViewUsage(start, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage, err := coalesced.ViewUsage(start, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, usage)
+	}
+	for validator, d := range expected {
+		if usage[validator] != d {
+			t.Fatalf("Expected %v for %s, got %v", d, validator, usage[validator])
+		}
+	}
+}
@@ -0,0 +1,126 @@
+//go:build ns && experimental
+
+package router
+
+import (
+	"context"
+	"time"
+)
+
+// UsageWrite is the usage of a request, as recorded through UsageAPI.
+type UsageWrite struct {
+	Validators []ValidatorID
+	// Kind of the request, eg, prepare_beacon_proposer. Optional.
+	Kind string
+	// Optional labels of the request
+	Labels map[string]string
+}
+
+// UsageAPI is the context-aware, typed interface to usage tracking. It grows with
+// request kinds, labels and typed results, while UsageTracker stays as is so existing
+// trackers and callers keep compiling.
+//
+// Experimental: UsageAPI is only built with the experimental tag and may change
+// between releases until it graduates.
+//
+// Trackers only implementing UsageTracker are adapted with NewUsageAPI. They ignore
+// the kind and labels of writes, and only see the context's cancellation before the
+// call is made.
+type UsageAPI interface {
+	Record(ctx context.Context, write UsageWrite) error
+	// Summarize returns the usage of the buckets overlapping [from, to], like
+	// UsageTracker.ViewUsage.
+	Summarize(ctx context.Context, from time.Time, to time.Time) (*UsageSummary, error)
+	Capabilities() UsageCapabilities
+	Close()
+}
+
+// Every tracker is usable through both interfaces
+var (
+	_ UsageTracker = (*SQLiteUsageTracker)(nil)
+	_ UsageTracker = (*SQLiteSessionUsageTracker)(nil)
+	_ UsageTracker = (*HybridUsageTracker)(nil)
+	_ UsageTracker = (*ShadowUsageTracker)(nil)
+	_ UsageTracker = (*SpoolingUsageTracker)(nil)
+	_ UsageAPI     = (*usageAPIAdapter)(nil)
+	_ UsageTracker = (*legacyUsageTracker)(nil)
+)
+
+// NewUsageAPI returns tracker as a UsageAPI, adapting it if it doesn't implement the
+// interface itself.
+func NewUsageAPI(tracker UsageTracker) UsageAPI {
+	if api, ok := tracker.(UsageAPI); ok {
+		return api
+	}
+	if legacy, ok := tracker.(*legacyUsageTracker); ok {
+		return legacy.api
+	}
+	return &usageAPIAdapter{tracker: tracker}
+}
+
+// LegacyUsageTracker returns api as a UsageTracker, for callers of RecordUsage and
+// ViewUsage which haven't moved to UsageAPI yet. Writes have no kind or labels and
+// calls aren't cancellable.
+func LegacyUsageTracker(api UsageAPI) UsageTracker {
+	if adapter, ok := api.(*usageAPIAdapter); ok {
+		return adapter.tracker
+	}
+	if tracker, ok := api.(UsageTracker); ok {
+		return tracker
+	}
+	return &legacyUsageTracker{api: api}
+}
+
+type usageAPIAdapter struct {
+	tracker UsageTracker
+}
+
+func (a *usageAPIAdapter) Record(ctx context.Context, write UsageWrite) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	indexes := make([]string, len(write.Validators))
+	for i, validator := range write.Validators {
+		indexes[i] = validator.String()
+	}
+	return a.tracker.RecordUsage(indexes)
+}
+
+func (a *usageAPIAdapter) Summarize(ctx context.Context, from time.Time, to time.Time) (*UsageSummary, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return SummarizeUsage(a.tracker, from, to)
+}
+
+func (a *usageAPIAdapter) Capabilities() UsageCapabilities {
+	return UsageCapabilitiesOf(a.tracker)
+}
+
+func (a *usageAPIAdapter) Close() {
+	a.tracker.Close()
+}
+
+type legacyUsageTracker struct {
+	api UsageAPI
+}
+
+func (l *legacyUsageTracker) RecordUsage(indexes []string) error {
+	validators := make([]ValidatorID, len(indexes))
+	for i, index := range indexes {
+		validators[i] = ValidatorID(index)
+	}
+	return l.api.Record(context.Background(), UsageWrite{Validators: validators})
+}
+
+func (l *legacyUsageTracker) ViewUsage(from time.Time, to time.Time) (map[string]time.Duration, error) {
+	summary, err := l.api.Summarize(context.Background(), from, to)
+	if err != nil {
+		return nil, err
+	}
+	return summary.Map(), nil
+}
+
+func (l *legacyUsageTracker) Close() {
+	l.api.Close()
+}
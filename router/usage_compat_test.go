@@ -0,0 +1,92 @@
+//go:build ns && experimental
+
+package router
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUsageAPI(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	api := NewUsageAPI(tracker)
+	if err := api.Record(context.Background(), UsageWrite{Validators: []ValidatorID{"1", "2"}, Kind: prepareBeaconProposerKind}); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	summary, err := api.Summarize(context.Background(), now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Usage("1") != 5*time.Minute || summary.Usage("2") != 5*time.Minute {
+		t.Fatalf("Expected a bucket of usage, got %v", summary.Validators)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := api.Record(ctx, UsageWrite{Validators: []ValidatorID{"3"}}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the write to be cancelled, got %v", err)
+	}
+
+	// Adapting back returns the tracker itself, so its optional features stay reachable
+	if LegacyUsageTracker(api) != tracker {
+		t.Fatal("Expected the tracker to be unwrapped")
+	}
+	if !api.Capabilities().Has(UsageCapabilityCommitments) {
+		t.Fatalf("Expected the tracker's capabilities, got %v", api.Capabilities())
+	}
+}
+
+// nativeUsageAPI implements UsageAPI only, like trackers written against it will.
+type nativeUsageAPI struct {
+	writes []UsageWrite
+}
+
+func (n *nativeUsageAPI) Record(ctx context.Context, write UsageWrite) error {
+	n.writes = append(n.writes, write)
+	return nil
+}
+
+func (n *nativeUsageAPI) Summarize(ctx context.Context, from time.Time, to time.Time) (*UsageSummary, error) {
+	return NewUsageSummary(from, to, map[string]time.Duration{"1": time.Minute}), nil
+}
+
+func (n *nativeUsageAPI) Capabilities() UsageCapabilities {
+	return UsageCapabilities{}
+}
+
+func (n *nativeUsageAPI) Close() {}
+
+func TestLegacyUsageTracker(t *testing.T) {
+	native := &nativeUsageAPI{}
+
+	// Existing callers keep using RecordUsage and ViewUsage
+	tracker := LegacyUsageTracker(native)
+	if err := tracker.RecordUsage([]string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(native.writes) != 1 || len(native.writes[0].Validators) != 2 || native.writes[0].Validators[1] != "2" {
+		t.Fatalf("Unexpected writes %+v", native.writes)
+	}
+	usage, err := tracker.ViewUsage(time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] != time.Minute {
+		t.Fatalf("Unexpected usage %v", usage)
+	}
+
+	if NewUsageAPI(tracker) != native {
+		t.Fatal("Expected the API to be unwrapped")
+	}
+	if caps := UsageCapabilitiesOf(tracker); len(caps) != 0 {
+		t.Fatalf("Expected no capabilities, got %v", caps)
+	}
+}
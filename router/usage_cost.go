@@ -0,0 +1,177 @@
+//go:build ns
+
+package router
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Recent usage the number of records per bucket is sampled from
+	queryCostSampleWindow = 24 * time.Hour
+	// How long a sample is used before it's taken again
+	queryCostSampleTTL = 5 * time.Minute
+)
+
+// usageCounter is implemented by trackers which can count their records cheaply.
+type usageCounter interface {
+	usageBuckets
+	// countUsageRecords returns the number of records in the buckets of [from, to).
+	countUsageRecords(from time.Time, to time.Time) (int64, error)
+}
+
+func (tracker *SQLiteUsageTracker) countUsageRecords(from time.Time, to time.Time) (int64, error) {
+	var count int64
+	err := tracker.readDB().QueryRow(`
+	SELECT COUNT(*) FROM validator_usage
+	WHERE timestamp >= datetime(?, 'unixepoch') AND timestamp < datetime(?, 'unixepoch')
+	`, from.Unix(), to.Unix()).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count usage records: %w", err)
+	}
+	return count, nil
+}
+
+func (tracker *HybridUsageTracker) countUsageRecords(from time.Time, to time.Time) (int64, error) {
+	return tracker.Buckets.countUsageRecords(from, to)
+}
+
+// QueryCostEstimator estimates how many usage records an admin query scans, as the
+// number of buckets in its range times the number of validators active per bucket
+// recently, so queries which would scan far more than intended can be refused.
+type QueryCostEstimator struct {
+	Tracker usageCounter
+	// Estimated records above which queries are refused unless forced
+	Limit  int64
+	Logger *zap.Logger
+
+	mu        sync.Mutex
+	perBucket float64
+	sampledAt time.Time
+
+	wallClock
+}
+
+// recordsPerBucket returns the average number of records per bucket in the sample
+// window, sampling it again once it's older than queryCostSampleTTL.
+func (e *QueryCostEstimator) recordsPerBucket() (float64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.clock()
+	if !e.sampledAt.IsZero() && now.Sub(e.sampledAt) < queryCostSampleTTL {
+		return e.perBucket, nil
+	}
+
+	precision := e.Tracker.bucketPrecision()
+	end := now.Truncate(precision)
+	count, err := e.Tracker.countUsageRecords(end.Add(-queryCostSampleWindow), end)
+	if err != nil {
+		return 0, err
+	}
+	e.perBucket = float64(count) / float64(queryCostSampleWindow/precision)
+	e.sampledAt = now
+	return e.perBucket, nil
+}
+
+// Estimate returns the estimated number of records a query of the buckets overlapping
+// [from, to] scans.
+func (e *QueryCostEstimator) Estimate(from time.Time, to time.Time) (int64, error) {
+	perBucket, err := e.recordsPerBucket()
+	if err != nil {
+		return 0, err
+	}
+	return e.estimate(perBucket, from, to), nil
+}
+
+// EstimateFor is Estimate for a query restricted to a set of validators, which reads at
+// most one record per validator and bucket.
+func (e *QueryCostEstimator) EstimateFor(validators int, from time.Time, to time.Time) (int64, error) {
+	perBucket, err := e.recordsPerBucket()
+	if err != nil {
+		return 0, err
+	}
+	return e.estimate(min(perBucket, float64(validators)), from, to), nil
+}
+
+func (e *QueryCostEstimator) estimate(perBucket float64, from time.Time, to time.Time) int64 {
+	precision := e.Tracker.bucketPrecision()
+	buckets := to.Truncate(precision).Sub(from.Truncate(precision))/precision + 1
+	return int64(float64(buckets) * perBucket)
+}
+
+// checkQueryCost refuses requests with a from and to range, or range parameters,
+// estimated to scan more than the limit of usage records, unless they pass force=true.
+// Requests without a valid range are left to their handler.
+func (pr *ProxyRouter) checkQueryCost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pr.cost == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ranges := queryCostRanges(r)
+		if len(ranges) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var cost int64
+		for _, tr := range ranges {
+			estimate, err := pr.cost.Estimate(tr.From, tr.To)
+			if err != nil {
+				// The guardrail mustn't take the admin API down with it
+				pr.Logger.Warn("Failed to estimate query cost", zap.Error(err))
+				next.ServeHTTP(w, r)
+				return
+			}
+			cost += estimate
+		}
+		if cost <= pr.cost.Limit {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.URL.Query().Get("force") != "true" {
+			http.Error(w, fmt.Sprintf("query is estimated to scan %d usage records, more than the limit of %d; narrow the range or pass force=true", cost, pr.cost.Limit), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Warn("Running a forced query above the cost limit",
+			zap.String("path", r.URL.Path),
+			zap.Time("from", ranges[0].From),
+			zap.Time("to", ranges[len(ranges)-1].To),
+			zap.Int("ranges", len(ranges)),
+			zap.Int64("estimated_records", cost),
+			zap.Int64("limit", pr.cost.Limit))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// queryCostRanges returns the valid ranges r queries, nil if it has none.
+func queryCostRanges(r *http.Request) []TimeRange {
+	query := r.URL.Query()
+	var ranges []TimeRange
+	switch {
+	case query.Has("from") && query.Has("to"):
+		from, to, err := parseUsageRange(r)
+		if err != nil {
+			return nil
+		}
+		ranges = []TimeRange{{From: from, To: to}}
+	case query.Has("range"):
+		var err error
+		if ranges, err = parseUsageRanges(r); err != nil {
+			return nil
+		}
+	}
+	for _, tr := range ranges {
+		if tr.From.After(tr.To) {
+			return nil
+		}
+	}
+	return ranges
+}
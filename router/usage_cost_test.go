@@ -0,0 +1,117 @@
+//go:build ns
+
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestQueryCostEstimate(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	sqlite.now = func() time.Time { return now }
+
+	// 288 records in the last day, one per bucket on average
+	for i := 0; i < 144; i++ {
+		now = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(i) * 5 * time.Minute)
+		if err := tracker.RecordUsage([]string{"1", "2"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	estimator := &QueryCostEstimator{
+		Tracker:   sqlite,
+		Limit:     1000,
+		Logger:    zaptest.NewLogger(t),
+		wallClock: wallClock{now: sqlite.now},
+	}
+
+	cost, err := estimator.Estimate(now.Add(-24*time.Hour), now.Add(-5*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost != 288 {
+		t.Fatalf("Expected 288 records in a day, got %d", cost)
+	}
+
+	// The sample is reused until it's stale
+	if err := tracker.RecordUsage([]string{"3", "4", "5"}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(queryCostSampleTTL - time.Second)
+	if cost, err := estimator.Estimate(now, now); err != nil || cost != 1 {
+		t.Fatalf("Expected the cached sample to be used, got %d: %v", cost, err)
+	}
+	now = now.Add(time.Second)
+	if perBucket, err := estimator.recordsPerBucket(); err != nil || perBucket != 291.0/288 {
+		t.Fatalf("Expected the sample to be taken again, got %v: %v", perBucket, err)
+	}
+}
+
+func TestAdminQueryCostLimit(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	sqlite.now = func() time.Time { return now.Add(-time.Hour) }
+	if err := tracker.RecordUsage([]string{"1", "2", "3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+		cost: &QueryCostEstimator{
+			Tracker:   sqlite,
+			Limit:     100,
+			Logger:    zaptest.NewLogger(t),
+			wallClock: wallClock{now: func() time.Time { return now }},
+		},
+	}
+	handler := pr.AdminHandler()
+
+	for _, test := range []struct {
+		query  string
+		status int
+	}{
+		// 289 buckets with 3/288 records each
+		{"?from=2025-01-01T00:00:00Z&to=2025-01-02T00:00:00Z", http.StatusOK},
+		// About 3000 records in a year
+		{"?from=2024-01-01T00:00:00Z&to=2025-01-01T00:00:00Z", http.StatusBadRequest},
+		{"?from=2024-01-01T00:00:00Z&to=2025-01-01T00:00:00Z&force=true", http.StatusOK},
+		// Left to the handler
+		{"?from=yesterday&to=2025-01-01T00:00:00Z", http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage"+test.query, nil))
+		if rec.Code != test.status {
+			t.Fatalf("Expected %d for %s, got %d: %s", test.status, test.query, rec.Code, rec.Body.String())
+		}
+	}
+
+	// Ranges add up
+	months := url.Values{}
+	for month := time.January; month <= time.December; month++ {
+		start := time.Date(2024, month, 1, 0, 0, 0, 0, time.UTC)
+		months.Add("range", start.Format(time.RFC3339)+"/"+start.AddDate(0, 1, 0).Add(-time.Second).Format(time.RFC3339))
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/ranges?"+months.Encode(), nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %d for a year of months, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
@@ -0,0 +1,145 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Longest range of days DailyUsage reports on
+const maxDailyUsageDays = 366
+
+// ErrRangeTooLong is returned when a daily usage range spans more than maxDailyUsageDays.
+var ErrRangeTooLong = fmt.Errorf("range spans more than %d days", maxDailyUsageDays)
+
+// DailyUsageTotal is the usage of a calendar day in the reporting time zone.
+type DailyUsageTotal struct {
+	// Local date, e.g. 2025-03-30
+	Date string `json:"date"`
+	// Local midnights bounding the day. Days are 23 or 25 hours long across DST changes.
+	Start      time.Time     `json:"start"`
+	End        time.Time     `json:"end"`
+	Validators int           `json:"validators"`
+	Usage      time.Duration `json:"usage"`
+}
+
+// DailyUsageReport is the usage of each day in a range of calendar days.
+type DailyUsageReport struct {
+	TimeZone string            `json:"time_zone"`
+	Days     []DailyUsageTotal `json:"days"`
+}
+
+// DailyUsage totals the usage of each calendar day from the date of from to the date of
+// to inclusive, with days bounded by midnight in loc. Usage is stored in UTC buckets;
+// a bucket is counted on the local day it starts, so buckets straddling midnight in
+// zones which aren't offset from UTC by a multiple of the precision count on one day only.
+func DailyUsage(tracker usageBuckets, from time.Time, to time.Time, loc *time.Location) (*DailyUsageReport, error) {
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+
+	first := localMidnight(from, loc)
+	last := localMidnight(to, loc)
+	days := []DailyUsageTotal{}
+	for day := first; !day.After(last); {
+		next := localMidnight(day.AddDate(0, 0, 1), loc)
+		days = append(days, DailyUsageTotal{
+			Date:  day.Format(time.DateOnly),
+			Start: day,
+			End:   next,
+		})
+		if len(days) > maxDailyUsageDays {
+			return nil, &RangeError{From: from, To: to, Err: ErrRangeTooLong}
+		}
+		day = next
+	}
+
+	records, err := tracker.usageRecords(first, days[len(days)-1].End)
+	if err != nil {
+		return nil, err
+	}
+
+	precision := tracker.bucketPrecision()
+	validators := make([]map[string]struct{}, len(days))
+	i := 0
+	for _, record := range records {
+		// Records are ordered by bucket
+		for !record.Bucket.Before(days[i].End) {
+			i++
+		}
+		if validators[i] == nil {
+			validators[i] = make(map[string]struct{})
+		}
+		validators[i][record.Validator.String()] = struct{}{}
+		days[i].Usage += precision
+	}
+	for i := range days {
+		days[i].Validators = len(validators[i])
+	}
+
+	return &DailyUsageReport{
+		TimeZone: loc.String(),
+		Days:     days,
+	}, nil
+}
+
+// localMidnight returns the start of the day t falls on in loc.
+func localMidnight(t time.Time, loc *time.Location) time.Time {
+	y, m, d := t.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// reportLocation returns the time zone requested by the tz query parameter, or else
+// ReportTimeZone.
+func (pr *ProxyRouter) reportLocation(r *http.Request) (*time.Location, error) {
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tz: %w", err)
+		}
+		return loc, nil
+	}
+	if pr.ReportTimeZone != nil {
+		return pr.ReportTimeZone, nil
+	}
+	return time.UTC, nil
+}
+
+// serveDailyUsage totals usage by calendar day in the reporting time zone, from the day
+// of from to the day of to.
+func (pr *ProxyRouter) serveDailyUsage(w http.ResponseWriter, r *http.Request) {
+	if !pr.requireUsageCapability(w, "daily usage", UsageCapabilityBuckets) {
+		return
+	}
+	tracker := pr.ut.(usageBuckets)
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	loc, err := pr.reportLocation(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := DailyUsage(tracker, from, to, loc)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to total daily usage", zap.Error(err))
+		http.Error(w, "failed to total daily usage", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
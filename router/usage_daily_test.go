@@ -0,0 +1,147 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestDailyUsageAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// Local date of the DST change
+		date  time.Time
+		hours time.Duration
+	}{
+		{"spring forward", time.Date(2025, 3, 30, 0, 0, 0, 0, berlin), 23 * time.Hour},
+		{"fall back", time.Date(2025, 10, 26, 0, 0, 0, 0, berlin), 25 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker, now := setupHybridTestDatabase(t, time.Hour, 10*time.Minute)
+
+			// Every hour of the day before, the day of the change and the day after
+			start := tt.date.AddDate(0, 0, -1)
+			end := tt.date.AddDate(0, 0, 2)
+			for ts := start; ts.Before(end); ts = ts.Add(time.Hour) {
+				*now = ts.Add(time.Minute)
+				if err := tracker.RecordUsage([]string{"1"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			report, err := DailyUsage(tracker, start, end.Add(-time.Second), berlin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.TimeZone != "Europe/Berlin" || len(report.Days) != 3 {
+				t.Fatalf("Unexpected report %+v", report)
+			}
+
+			expected := []time.Duration{24 * time.Hour, tt.hours, 24 * time.Hour}
+			for i, day := range report.Days {
+				date := start.AddDate(0, 0, i).Format(time.DateOnly)
+				if day.Date != date {
+					t.Fatalf("Expected day %d to be %s, got %s", i, date, day.Date)
+				}
+				if day.End.Sub(day.Start) != expected[i] || day.Usage != expected[i] {
+					t.Fatalf("Expected %s to last and be used %v, got %+v", date, expected[i], day)
+				}
+				if day.Validators != 1 {
+					t.Fatalf("Expected 1 validator on %s, got %d", date, day.Validators)
+				}
+			}
+
+			// The same usage falls on different days in UTC
+			utc, err := DailyUsage(tracker, start, end.Add(-time.Second), time.UTC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if utc.Days[0].Date != start.AddDate(0, 0, -1).Format(time.DateOnly) || utc.Days[0].Usage > 2*time.Hour {
+				t.Fatalf("Expected the first UTC day to start before Berlin's, got %+v", utc.Days[0])
+			}
+		})
+	}
+}
+
+func TestDailyUsageRange(t *testing.T) {
+	tracker, _ := setupHybridTestDatabase(t, time.Hour, 10*time.Minute)
+
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err := DailyUsage(tracker, from, from.AddDate(2, 0, 0), time.UTC)
+	if !errors.Is(err, ErrRangeTooLong) {
+		t.Fatalf("Expected ErrRangeTooLong, got %v", err)
+	}
+	_, err = DailyUsage(tracker, from, from.Add(-time.Hour), time.UTC)
+	if !errors.Is(err, ErrInvertedRange) {
+		t.Fatalf("Expected ErrInvertedRange, got %v", err)
+	}
+}
+
+func TestUsageAdminDailyUsage(t *testing.T) {
+	tracker, now := setupHybridTestDatabase(t, time.Hour, 10*time.Minute)
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := &ProxyRouter{
+		Logger:         zaptest.NewLogger(t),
+		ut:             tracker,
+		ReportTimeZone: tokyo,
+	}
+	handler := pr.AdminHandler()
+
+	// 2025-01-02 in Tokyo, 2025-01-01 in UTC
+	*now = time.Date(2025, 1, 1, 20, 30, 0, 0, time.UTC)
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		date  string
+		zone  string
+	}{
+		{"", "2025-01-02", "Asia/Tokyo"},
+		{"&tz=UTC", "2025-01-01", "UTC"},
+	}
+	for _, tt := range tests {
+		path := "/usage/daily?from=2025-01-01T00:00:00Z&to=2025-01-02T23:59:59Z" + tt.query
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+		var report DailyUsageReport
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		if report.TimeZone != tt.zone {
+			t.Fatalf("Expected time zone %s, got %s", tt.zone, report.TimeZone)
+		}
+		for _, day := range report.Days {
+			if (day.Date == tt.date) != (day.Usage == time.Hour) {
+				t.Fatalf("Expected usage on %s only, got %+v", tt.date, report.Days)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/daily?from=2025-01-01T00:00:00Z&to=2025-01-02T00:00:00Z&tz=Mars/Olympus", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
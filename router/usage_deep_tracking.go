@@ -0,0 +1,212 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// Salt of the deep-tracking sample, so it's independent of other samples
+const deepTrackingSalt = "deep-tracking"
+
+// RequestSample is a request made for a validator of the deep-tracking sample.
+type RequestSample struct {
+	Time      time.Time `json:"time"`
+	Validator string    `json:"validator"`
+	// See RecordingRule.Kind
+	Kind string `json:"kind"`
+	// Method and path pattern of the request
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// How long the request took to proxy. For streams, how long they stayed open.
+	Duration time.Duration `json:"duration"`
+}
+
+// DeepTrackingStore keeps every request made for a small, stable sample of validators,
+// so their usage can be debugged in more detail than buckets allow without keeping
+// that detail for every validator.
+type DeepTrackingStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+	// Fraction of validators in the sample, in [0, 1]
+	Rate float64
+
+	sampler ValidatorSampler
+}
+
+// NewDeepTrackingStore creates the request sample table in db if needed.
+func NewDeepTrackingStore(logger *zap.Logger, db *sql.DB, rate float64) (*DeepTrackingStore, error) {
+	store := &DeepTrackingStore{
+		Database: db,
+		Logger:   logger,
+		Rate:     rate,
+		sampler:  ValidatorSampler{Salt: deepTrackingSalt},
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *DeepTrackingStore) initSchema() error {
+	// timestamp is unix milliseconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS validator_request_samples (
+		timestamp INTEGER NOT NULL,
+		validator_index TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		method TEXT NOT NULL,
+		path TEXT NOT NULL,
+		duration_ns INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_validator_request_samples_validator ON validator_request_samples(validator_index, timestamp);
+	CREATE INDEX IF NOT EXISTS idx_validator_request_samples_timestamp ON validator_request_samples(timestamp);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Sampled returns the validators of indices which are part of the sample.
+func (store *DeepTrackingStore) Sampled(indices []string) []string {
+	var out []string
+	for _, index := range indices {
+		if store.sampler.Sampled(index, store.Rate) {
+			out = append(out, index)
+		}
+	}
+	return out
+}
+
+// Record stores samples.
+func (store *DeepTrackingStore) Record(samples []RequestSample) error {
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, s := range samples {
+		_, err := tx.Exec(`
+		INSERT INTO validator_request_samples (timestamp, validator_index, kind, method, path, duration_ns)
+		VALUES (?, ?, ?, ?, ?, ?)
+		`, s.Time.UnixMilli(), s.Validator, s.Kind, s.Method, s.Path, int64(s.Duration))
+		if err != nil {
+			return fmt.Errorf("failed to insert request sample: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Samples returns the requests made for validator in [from, to], oldest first.
+func (store *DeepTrackingStore) Samples(validator string, from time.Time, to time.Time) ([]RequestSample, error) {
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+
+	rows, err := store.Database.Query(`
+	SELECT timestamp, kind, method, path, duration_ns FROM validator_request_samples
+	WHERE validator_index = ? AND timestamp >= ? AND timestamp <= ?
+	ORDER BY timestamp
+	`, validator, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query request samples: %w", err)
+	}
+	defer rows.Close()
+
+	out := make([]RequestSample, 0)
+	for rows.Next() {
+		var timestamp, duration int64
+		s := RequestSample{Validator: validator}
+		if err := rows.Scan(&timestamp, &s.Kind, &s.Method, &s.Path, &duration); err != nil {
+			return nil, fmt.Errorf("failed to scan request sample: %w", err)
+		}
+		s.Time = time.UnixMilli(timestamp).UTC()
+		s.Duration = time.Duration(duration)
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func (store *DeepTrackingStore) pruneUsage(cutoff time.Time, exempt map[string]time.Time) (int64, error) {
+	return pruneRows(store.Database, "validator_request_samples", "timestamp < ?", unixMilli, cutoff, exempt)
+}
+
+// sampleRequest records a request made for indices, of which only the sampled
+// validators are kept, once ctx, the context of the request, is done.
+func (pr *ProxyRouter) sampleRequest(ctx context.Context, kind string, method string, path string, indices []string) {
+	if pr.deep == nil {
+		return
+	}
+	sampled := pr.deep.Sampled(indices)
+	if len(sampled) == 0 {
+		return
+	}
+
+	start := time.Now()
+	go func() {
+		<-ctx.Done()
+		duration := time.Since(start)
+
+		samples := make([]RequestSample, 0, len(sampled))
+		for _, validator := range sampled {
+			samples = append(samples, RequestSample{
+				Time:      start,
+				Validator: validator,
+				Kind:      kind,
+				Method:    method,
+				Path:      path,
+				Duration:  duration,
+			})
+		}
+		if err := pr.deep.Record(samples); err != nil {
+			pr.Logger.Warn("Failed to record request samples", zap.Error(err))
+		}
+	}()
+}
+
+// serveRequestSamples returns the requests made for a validator of the deep-tracking
+// sample in [from, to].
+func (pr *ProxyRouter) serveRequestSamples(w http.ResponseWriter, r *http.Request) {
+	if pr.deep == nil {
+		http.Error(w, "request samples require -usage-deep-tracking-rate", http.StatusNotImplemented)
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	validator, ok := pr.validatorParam(w, mux.Vars(r)["validator"])
+	if !ok {
+		return
+	}
+
+	samples, err := pr.deep.Samples(validator.String(), from, to)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to query request samples", zap.Error(err))
+		http.Error(w, "failed to query request samples", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, samples)
+}
@@ -0,0 +1,74 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestDeepTracking(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	deep, err := NewDeepTrackingStore(zaptest.NewLogger(t), pr.orgs.Database, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.deep = deep
+
+	var sampled, unsampled string
+	for i := 0; sampled == "" || unsampled == ""; i++ {
+		if len(deep.Sampled([]string{strconv.Itoa(i)})) == 1 {
+			sampled = strconv.Itoa(i)
+		} else {
+			unsampled = strconv.Itoa(i)
+		}
+	}
+
+	synctest.Run(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		pr.sampleRequest(ctx, "attester_duties", http.MethodPost, "/eth/v1/validator/duties/attester/{epoch}", []string{sampled, unsampled})
+		time.Sleep(250 * time.Millisecond)
+		cancel()
+		synctest.Wait()
+	})
+
+	rec := httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/validators/"+sampled+"/requests?from=2000-01-01T00:00:00Z&to=2100-01-01T00:00:00Z", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var samples []RequestSample
+	if err := json.NewDecoder(rec.Body).Decode(&samples); err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || samples[0].Kind != "attester_duties" || samples[0].Path != "/eth/v1/validator/duties/attester/{epoch}" ||
+		samples[0].Duration != 250*time.Millisecond {
+		t.Fatalf("Unexpected samples %+v", samples)
+	}
+
+	// Validators outside the sample get standard buckets only
+	if samples, err := deep.Samples(unsampled, time.Unix(0, 0), time.Now().Add(time.Hour)); err != nil || len(samples) != 0 {
+		t.Fatalf("Expected no samples of validator %s, got %v: %v", unsampled, samples, err)
+	}
+
+	if deleted, err := deep.pruneUsage(time.Now().Add(time.Hour), nil); err != nil || deleted != 1 {
+		t.Fatalf("Expected 1 sample to be pruned, got %d: %v", deleted, err)
+	}
+
+	pr.deep = nil
+	rec = httptest.NewRecorder()
+	pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/validators/"+sampled+"/requests?from=2000-01-01T00:00:00Z&to=2100-01-01T00:00:00Z", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected %d without deep tracking, got %d", http.StatusNotImplemented, rec.Code)
+	}
+}
@@ -0,0 +1,119 @@
+//go:build ns
+
+package router
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Width of the ranges of records compared at once by DiffUsage
+const usageDiffChunk = 24 * time.Hour
+
+// ValidatorUsageDiff is how the buckets of a validator differ between two trackers.
+type ValidatorUsageDiff struct {
+	Validator ValidatorID `json:"validator"`
+	// Buckets only the first tracker has
+	Missing []time.Time `json:"missing"`
+	// Buckets only the second tracker has
+	Extra []time.Time `json:"extra"`
+}
+
+// UsageDiff compares the records of two trackers, eg, a primary and a restored backup.
+type UsageDiff struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Records compared in either tracker
+	Records  int `json:"records"`
+	Matching int `json:"matching"`
+	// Validators whose buckets differ, sorted
+	Validators []*ValidatorUsageDiff `json:"validators"`
+}
+
+// Equal returns whether both trackers have the same records.
+func (d *UsageDiff) Equal() bool {
+	return len(d.Validators) == 0
+}
+
+// DiffUsage compares the records of buckets starting in [from, to) in a and b, which
+// must have the same precision. Trackers without the buckets capability return an
+// *UnsupportedError.
+func DiffUsage(a UsageTracker, b UsageTracker, from time.Time, to time.Time) (*UsageDiff, error) {
+	for _, tracker := range []UsageTracker{a, b} {
+		if err := requireCapability(tracker, "usage diffs", UsageCapabilityBuckets); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+	bucketsA, bucketsB := a.(usageBuckets), b.(usageBuckets)
+	if pa, pb := bucketsA.bucketPrecision(), bucketsB.bucketPrecision(); pa != pb {
+		return nil, fmt.Errorf("can't compare usage of precision %s and %s", pa, pb)
+	}
+
+	out := &UsageDiff{From: from, To: to}
+	validators := make(map[ValidatorID]*ValidatorUsageDiff)
+	diff := func(validator ValidatorID) *ValidatorUsageDiff {
+		d, ok := validators[validator]
+		if !ok {
+			d = &ValidatorUsageDiff{Validator: validator, Missing: []time.Time{}, Extra: []time.Time{}}
+			validators[validator] = d
+		}
+		return d
+	}
+
+	// Records are compared a chunk at a time, so large ranges don't have to fit in memory
+	for start := from; start.Before(to); start = start.Add(usageDiffChunk) {
+		end := start.Add(usageDiffChunk)
+		if end.After(to) {
+			end = to
+		}
+		recordsA, err := bucketsA.usageRecords(start, end)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the first tracker: %w", err)
+		}
+		recordsB, err := bucketsB.usageRecords(start, end)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the second tracker: %w", err)
+		}
+
+		// Both are ordered by bucket then validator
+		i, j := 0, 0
+		for i < len(recordsA) || j < len(recordsB) {
+			out.Records++
+			switch {
+			case j == len(recordsB) || (i < len(recordsA) && recordsA[i].less(recordsB[j])):
+				d := diff(recordsA[i].Validator)
+				d.Missing = append(d.Missing, recordsA[i].Bucket)
+				i++
+			case i == len(recordsA) || recordsB[j].less(recordsA[i]):
+				d := diff(recordsB[j].Validator)
+				d.Extra = append(d.Extra, recordsB[j].Bucket)
+				j++
+			default:
+				out.Matching++
+				i++
+				j++
+			}
+		}
+	}
+
+	out.Validators = make([]*ValidatorUsageDiff, 0, len(validators))
+	for _, d := range validators {
+		out.Validators = append(out.Validators, d)
+	}
+	sort.Slice(out.Validators, func(i, j int) bool {
+		return out.Validators[i].Validator < out.Validators[j].Validator
+	})
+	return out, nil
+}
+
+// less orders records by bucket, then validator, like usageRecords does.
+func (r UsageRecord) less(other UsageRecord) bool {
+	if !r.Bucket.Equal(other.Bucket) {
+		return r.Bucket.Before(other.Bucket)
+	}
+	return r.Validator < other.Validator
+}
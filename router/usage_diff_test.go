@@ -0,0 +1,60 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDiffUsage(t *testing.T) {
+	a, start := setupMerkleTestDatabase(t)
+	b, _ := setupHybridTestDatabase(t, 5*time.Minute, 10*time.Minute)
+
+	// b lacks validator 2 in the first bucket and 3 in the third, and has 4 as well
+	records := map[time.Duration][]string{
+		0:                {"1"},
+		5 * time.Minute:  {"1", "4"},
+		10 * time.Minute: {"1"},
+		time.Hour:        {"1"},
+	}
+	for _, offset := range []time.Duration{0, 5 * time.Minute, 10 * time.Minute, time.Hour} {
+		if err := b.Buckets.recordUsage(start.Add(offset).Unix(), records[offset]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diff, err := DiffUsage(a, b, start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff.Equal() || diff.Records != 7 || diff.Matching != 4 {
+		t.Fatalf("Unexpected diff %+v", diff)
+	}
+	if len(diff.Validators) != 3 {
+		t.Fatalf("Expected 3 validators to differ, got %+v", diff.Validators)
+	}
+	expected := []ValidatorUsageDiff{
+		{Validator: "2", Missing: []time.Time{start}},
+		{Validator: "3", Missing: []time.Time{start.Add(10 * time.Minute)}},
+		{Validator: "4", Extra: []time.Time{start.Add(5 * time.Minute)}},
+	}
+	for i, e := range expected {
+		got := diff.Validators[i]
+		if got.Validator != e.Validator || !slices.EqualFunc(got.Missing, e.Missing, time.Time.Equal) || !slices.EqualFunc(got.Extra, e.Extra, time.Time.Equal) {
+			t.Fatalf("Expected %+v, got %+v", e, got)
+		}
+	}
+
+	// A tracker has the same records as itself
+	if diff, err := DiffUsage(a, a, start, start.Add(2*time.Hour)); err != nil || !diff.Equal() || diff.Matching != 6 {
+		t.Fatalf("Expected no differences, got %+v, %v", diff, err)
+	}
+
+	sessions, _ := setupSessionTestDatabase(t, 10*time.Minute)
+	if _, err := DiffUsage(a, sessions, start, start.Add(time.Hour)); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("Expected an unsupported error, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+//go:build ns
+
+package router
+
+import (
+	"fmt"
+	"time"
+)
+
+// Approximate size of a row with its index entries, measured on SQLite with 7 digit
+// validator indices after a VACUUM. Live databases carry some free space on top.
+const (
+	estimatedBucketRowBytes = 150
+	// Extra bytes of a bucket row recorded for a tenant, in the row and its index
+	estimatedTenantRowBytes = 20
+	// Extra bytes of a bucket row with activity offsets
+	estimatedOccupancyRowBytes = 5
+	estimatedSessionRowBytes   = 60
+)
+
+// UsageEstimateInput describes a deployment whose usage storage is estimated.
+type UsageEstimateInput struct {
+	Validators int
+	// Fraction of the validators active in a bucket, in (0, 1]
+	ActiveFraction float64
+	// Average time between the requests of an active validator
+	RequestInterval time.Duration
+
+	Model              UsageModel
+	Precision          time.Duration
+	SessionIdleTimeout time.Duration
+	// How long records are kept, 0 if they're never pruned
+	Retention   time.Duration
+	Coalesce    bool
+	Occupancy   bool
+	MultiTenant bool
+}
+
+// UsageStorageEstimate is the projected storage of a usage table.
+type UsageStorageEstimate struct {
+	// Table the estimate is for, validator_usage or validator_sessions
+	Table      string  `json:"table"`
+	RowsPerDay float64 `json:"rows_per_day"`
+	// Growth of the table
+	BytesPerDay float64 `json:"bytes_per_day"`
+	// Size once retention prunes as much as is recorded, or after a year without it
+	SteadyStateBytes float64 `json:"steady_state_bytes"`
+	// Statements executed by the writes of the table
+	WritesPerSecond float64 `json:"writes_per_second"`
+}
+
+// EstimateUsageStorage projects the growth and write rate of the tables of the usage
+// model of in, to choose a precision and retention before deploying.
+//
+// Estimates assume validators are active throughout the day, and that sessions of
+// validators requesting more often than the idle timeout last a day. Real databases
+// are somewhat larger, see estimatedBucketRowBytes.
+func EstimateUsageStorage(in UsageEstimateInput) ([]UsageStorageEstimate, error) {
+	if in.Validators <= 0 {
+		return nil, fmt.Errorf("the number of validators must be positive")
+	}
+	if in.ActiveFraction == 0 {
+		in.ActiveFraction = 1
+	}
+	if in.ActiveFraction < 0 || in.ActiveFraction > 1 {
+		return nil, fmt.Errorf("the active fraction must be in (0, 1]")
+	}
+	if in.RequestInterval <= 0 {
+		return nil, fmt.Errorf("the request interval must be positive")
+	}
+	if in.Retention < 0 {
+		return nil, fmt.Errorf("the retention must not be negative")
+	}
+	if in.Coalesce && in.Occupancy {
+		return nil, fmt.Errorf("usage occupancy can't be coalesced")
+	}
+	if in.Model == "" {
+		in.Model = UsageModelBuckets
+	}
+	if in.Precision == 0 {
+		in.Precision = defaultUsagePrecision
+	}
+	if in.SessionIdleTimeout == 0 {
+		in.SessionIdleTimeout = defaultSessionIdleTimeout
+	}
+
+	day := 24 * time.Hour
+	kept := in.Retention
+	if kept == 0 {
+		kept = 365 * day
+	}
+	active := float64(in.Validators) * in.ActiveFraction
+	requestsPerSecond := active / in.RequestInterval.Seconds()
+	estimate := func(table string, rowsPerDay float64, rowBytes float64, writesPerSecond float64) UsageStorageEstimate {
+		return UsageStorageEstimate{
+			Table:            table,
+			RowsPerDay:       rowsPerDay,
+			BytesPerDay:      rowsPerDay * rowBytes,
+			SteadyStateBytes: rowsPerDay * rowBytes * kept.Hours() / 24,
+			WritesPerSecond:  writesPerSecond,
+		}
+	}
+
+	var out []UsageStorageEstimate
+	switch in.Model {
+	case UsageModelBuckets, UsageModelHybrid:
+		if err := ValidatePrecision(in.Precision); err != nil {
+			return nil, err
+		}
+		rowBytes := float64(estimatedBucketRowBytes)
+		if in.MultiTenant {
+			rowBytes += estimatedTenantRowBytes
+		}
+		if in.Occupancy {
+			rowBytes += estimatedOccupancyRowBytes
+		}
+		// Each request of an active validator writes its row of the bucket, only the
+		// first one of the bucket when coalesced. Validators requesting less often
+		// than the precision skip buckets.
+		buckets := float64(day / in.Precision)
+		if in.RequestInterval > in.Precision {
+			buckets = day.Seconds() / in.RequestInterval.Seconds()
+		}
+		writes := requestsPerSecond
+		if in.Coalesce {
+			writes = min(writes, active/in.Precision.Seconds())
+		}
+		out = append(out, estimate("validator_usage", active*buckets, rowBytes, writes))
+		if in.Model == UsageModelBuckets {
+			break
+		}
+		fallthrough
+	case UsageModelSessions:
+		sessions := 1.0
+		if in.RequestInterval > in.SessionIdleTimeout {
+			sessions = day.Seconds() / in.RequestInterval.Seconds()
+		}
+		// Every request extends the session of its validator
+		out = append(out, estimate("validator_sessions", active*sessions, estimatedSessionRowBytes, requestsPerSecond))
+	default:
+		return nil, fmt.Errorf("unknown usage model %q", in.Model)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,78 @@
+//go:build ns
+
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateUsageStorage(t *testing.T) {
+	in := UsageEstimateInput{
+		Validators:      1000,
+		RequestInterval: 12 * time.Second,
+		Precision:       5 * time.Minute,
+		Retention:       30 * 24 * time.Hour,
+	}
+
+	estimates, err := EstimateUsageStorage(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(estimates) != 1 || estimates[0].Table != "validator_usage" {
+		t.Fatalf("Expected a single bucket estimate, got %+v", estimates)
+	}
+	buckets := estimates[0]
+	// 288 buckets a day
+	if buckets.RowsPerDay != 288_000 || buckets.BytesPerDay != 288_000*estimatedBucketRowBytes {
+		t.Fatalf("Unexpected growth %+v", buckets)
+	}
+	if buckets.SteadyStateBytes != 30*buckets.BytesPerDay {
+		t.Fatalf("Expected 30 days of records, got %+v", buckets)
+	}
+	if buckets.WritesPerSecond < 83 || buckets.WritesPerSecond > 84 {
+		t.Fatalf("Expected a write per request, got %v", buckets.WritesPerSecond)
+	}
+
+	// Coalescing writes once per bucket
+	in.Coalesce = true
+	estimates, _ = EstimateUsageStorage(in)
+	if w := estimates[0].WritesPerSecond; w < 3.3 || w > 3.4 {
+		t.Fatalf("Expected a write per bucket, got %v", w)
+	}
+	in.Coalesce = false
+
+	// Validators requesting less often than the precision skip buckets
+	in.RequestInterval = 10 * time.Minute
+	estimates, _ = EstimateUsageStorage(in)
+	if estimates[0].RowsPerDay != 144_000 {
+		t.Fatalf("Expected a row every other bucket, got %+v", estimates[0])
+	}
+
+	in.Model = UsageModelHybrid
+	in.SessionIdleTimeout = 5 * time.Minute
+	estimates, err = EstimateUsageStorage(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(estimates) != 2 || estimates[1].Table != "validator_sessions" {
+		t.Fatalf("Expected bucket and session estimates, got %+v", estimates)
+	}
+	// Requests further apart than the idle timeout start a session each
+	if estimates[1].RowsPerDay != 144_000 {
+		t.Fatalf("Expected a session per request, got %+v", estimates[1])
+	}
+
+	for _, invalid := range []UsageEstimateInput{
+		{RequestInterval: time.Second},
+		{Validators: 1},
+		{Validators: 1, RequestInterval: time.Second, ActiveFraction: 2},
+		{Validators: 1, RequestInterval: time.Second, Precision: time.Millisecond},
+		{Validators: 1, RequestInterval: time.Second, Coalesce: true, Occupancy: true},
+		{Validators: 1, RequestInterval: time.Second, Model: "minutes"},
+	} {
+		if _, err := EstimateUsageStorage(invalid); err == nil {
+			t.Errorf("Expected %+v to be invalid", invalid)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+// UsageEvent is a validator's use of the rescue node, as recorded by the tracker.
+type UsageEvent struct {
+	Time time.Time `json:"time"`
+	// Start of the bucket the usage was recorded in, for bucketed usage models
+	Bucket    *time.Time `json:"bucket,omitempty"`
+	Validator string     `json:"validator"`
+	// Node whose credential was used. Omitted in data minimization mode.
+	Node *common.Address `json:"node,omitempty"`
+	// Proxy instance which recorded the usage
+	Instance string `json:"instance,omitempty"`
+	// What the validator used the rescue node for, see RecordingRule.Kind
+	Kind string `json:"kind,omitempty"`
+	// Tier of the credential used, e.g. rocketpool or solo
+	Tier string `json:"tier,omitempty"`
+}
+
+// UsageEventSink receives every usage event after it's recorded.
+type UsageEventSink interface {
+	WriteUsageEvents(events []UsageEvent) error
+	Close() error
+}
+
+// usageEvents creates the events of a RecordUsage call.
+func usageEvents(at time.Time, precision time.Duration, kind string, tier string, validators []string, node *common.Address, instance string) []UsageEvent {
+	var bucket *time.Time
+	if precision > 0 {
+		b := at.Truncate(precision).UTC()
+		bucket = &b
+	}
+
+	out := make([]UsageEvent, 0, len(validators))
+	for _, v := range validators {
+		out = append(out, UsageEvent{
+			Time:      at.UTC(),
+			Bucket:    bucket,
+			Validator: v,
+			Node:      node,
+			Instance:  instance,
+			Kind:      kind,
+			Tier:      tier,
+		})
+	}
+	return out
+}
+
+// emitUsageEvents passes the usage just recorded to every sink.
+// Sinks are best effort, failures don't affect the tracker.
+func (pr *ProxyRouter) emitUsageEvents(authInfo authInfo, kind string, validators []string) {
+	if len(pr.events) == 0 {
+		return
+	}
+
+	var precision time.Duration
+	if buckets, ok := pr.ut.(usageBuckets); ok {
+		precision = buckets.bucketPrecision()
+	}
+	var nodeAddr *common.Address
+	if pr.DataMinimization == nil {
+		nodeAddr = &authInfo.nodeAddr
+	}
+
+	tier := credentialTier(authInfo.operatorType)
+	events := usageEvents(time.Now(), precision, kind, tier, validators, nodeAddr, pr.UsageEventLog.Instance)
+	for _, sink := range pr.events {
+		if err := sink.WriteUsageEvents(events); err != nil {
+			pr.m.Counter("usage_event_errors").Inc()
+			pr.Logger.Warn("Failed to write usage events", zap.Error(err))
+		}
+	}
+}
+
+// UsageEventLogOptions configures the file usage events are appended to as JSON lines.
+// See RotatingFile.
+type UsageEventLogOptions struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+	// Identifies this proxy in events, so consumers can deduplicate them.
+	// Defaults to the hostname.
+	Instance string
+}
+
+// JSONUsageEventSink writes usage events as JSON lines.
+type JSONUsageEventSink struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// NewJSONUsageEventSink writes events to w, which is closed with the sink.
+func NewJSONUsageEventSink(w io.WriteCloser) *JSONUsageEventSink {
+	return &JSONUsageEventSink{w: w}
+}
+
+func (s *JSONUsageEventSink) WriteUsageEvents(events []UsageEvent) error {
+	var buf []byte
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(buf)
+	return err
+}
+
+func (s *JSONUsageEventSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
+
+// RotatingFile is a file which is rotated once it reaches MaxSize bytes or has been
+// written to for MaxAge since it was opened. Rotated files are renamed with the time
+// of the rotation appended, and only the MaxBackups most recent are kept.
+type RotatingFile struct {
+	Path string
+	// 0 disables rotation by size
+	MaxSize int64
+	// 0 disables rotation by age
+	MaxAge time.Duration
+	// 0 keeps every rotated file
+	MaxBackups int
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+
+	wallClock
+}
+
+const rotatedFileLayout = "20060102T150405.000000000Z"
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	r.f = f
+	r.size = info.Size()
+	r.opened = r.clock()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+
+	rotated := r.Path + "." + r.clock().UTC().Format(rotatedFileLayout)
+	if err := os.Rename(r.Path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate %s: %w", r.Path, err)
+	}
+	if err := r.removeBackups(); err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+// removeBackups deletes all but the MaxBackups most recent rotated files.
+func (r *RotatingFile) removeBackups() error {
+	if r.MaxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(r.Path + ".*")
+	if err != nil {
+		return err
+	}
+	// The layout sorts chronologically
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	keep := r.MaxBackups
+	for _, backup := range backups {
+		if _, err := time.Parse(rotatedFileLayout, strings.TrimPrefix(backup, r.Path+".")); err != nil {
+			continue
+		}
+		if keep > 0 {
+			keep--
+			continue
+		}
+		if err := os.Remove(backup); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write appends p to the file, rotating it first if needed.
+// A single write is never split across files.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	full := r.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.MaxSize
+	old := r.MaxAge > 0 && r.clock().Sub(r.opened) >= r.MaxAge
+	if full || old {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
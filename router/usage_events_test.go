@@ -0,0 +1,133 @@
+//go:build ns
+
+package router
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/credentials/pb"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func readUsageEvents(t *testing.T, path string) []UsageEvent {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var out []UsageEvent
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e UsageEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+func TestEmitUsageEvents(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+		events: []UsageEventSink{NewJSONUsageEventSink(&RotatingFile{Path: path})},
+	}
+	pr.UsageEventLog.Instance = "proxy-a"
+	node := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	pr.recordUsage(authInfo{nodeAddr: node, operatorType: pb.OperatorType_OT_SOLO}, prepareBeaconProposerKind, []string{"1", "2"})
+
+	pr.DataMinimization = &DataMinimization{PseudonymKey: []byte("0123456789abcdef0123456789abcdef")}
+	pr.recordUsage(authInfo{nodeAddr: node}, prepareBeaconProposerKind, []string{"3"})
+
+	for _, sink := range pr.events {
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := readUsageEvents(t, path)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %+v", events)
+	}
+	if events[0].Validator != "1" || events[1].Validator != "2" || events[0].Instance != "proxy-a" ||
+		events[0].Node == nil || *events[0].Node != node || events[0].Tier != "solo" {
+		t.Fatalf("Unexpected events %+v", events[:2])
+	}
+	if events[0].Bucket == nil || !events[0].Bucket.Equal(events[0].Time.Truncate(5*time.Minute)) {
+		t.Fatalf("Unexpected bucket %v of %v", events[0].Bucket, events[0].Time)
+	}
+	// Minimized events carry the pseudonym and no node
+	if events[2].Validator != pr.DataMinimization.Pseudonym("3") || events[2].Node != nil {
+		t.Fatalf("Unexpected minimized event %+v", events[2])
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := &RotatingFile{
+		Path:       filepath.Join(dir, "usage.jsonl"),
+		MaxSize:    10,
+		MaxAge:     time.Hour,
+		MaxBackups: 2,
+		wallClock:  wallClock{now: func() time.Time { return now }},
+	}
+	defer f.Close()
+
+	write := func(s string) {
+		t.Helper()
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+
+	write("123456")
+	// Doesn't fit, rotates
+	write("123456")
+	// Writes larger than MaxSize go to an empty file as a whole
+	write("1234567890123")
+	// Rotates by age, and drops the oldest backup
+	now = now.Add(time.Hour)
+	write("1")
+
+	backups, err := filepath.Glob(f.Path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups, got %v", backups)
+	}
+	for i, expected := range []string{"123456", "1234567890123"} {
+		data, err := os.ReadFile(backups[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("Expected %q in %s, got %q", expected, backups[i], data)
+		}
+	}
+
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "1" {
+		t.Fatalf("Unexpected current file %q", data)
+	}
+}
@@ -0,0 +1,160 @@
+//go:build ns
+
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultUsageExportLimit = 10_000
+	maxUsageExportLimit     = 100_000
+	// Version of the format of export records, bumped whenever it changes
+	usageExportSchemaVersion = 1
+)
+
+// UsageExportRecord is a bucket a validator was recorded in, with the cursor of its
+// ingestion.
+type UsageExportRecord struct {
+	Cursor    int64     `json:"cursor"`
+	Bucket    time.Time `json:"bucket"`
+	Validator string    `json:"validator"`
+}
+
+// UsageExport is a page of the records ingested after a cursor, in ingestion order.
+type UsageExport struct {
+	Records []UsageExportRecord `json:"records"`
+	// Cursor to export the next page from. Unchanged when no records were ingested since.
+	Cursor int64 `json:"cursor"`
+	// Whether more records were ingested after the page
+	More     bool                `json:"more"`
+	Manifest UsageExportManifest `json:"manifest"`
+}
+
+// UsageExportManifest describes a page of an export, so pipelines can check the page
+// they stored is complete.
+type UsageExportManifest struct {
+	SchemaVersion int `json:"schema_version"`
+	// Cursor the page was exported after. The page covers (Since, UsageExport.Cursor].
+	Since int64 `json:"since"`
+	Rows  int   `json:"rows"`
+	// Hash of the compact JSON encoding of the records
+	SHA256 hexutil.Bytes `json:"sha256"`
+}
+
+// newUsageExportManifest returns the manifest of the records exported after since.
+func newUsageExportManifest(since int64, records []UsageExportRecord) (UsageExportManifest, error) {
+	content, err := json.Marshal(records)
+	if err != nil {
+		return UsageExportManifest{}, err
+	}
+	sum := sha256.Sum256(content)
+	return UsageExportManifest{
+		SchemaVersion: usageExportSchemaVersion,
+		Since:         since,
+		Rows:          len(records),
+		SHA256:        sum[:],
+	}, nil
+}
+
+// usageExporter is implemented by trackers which can export records incrementally.
+type usageExporter interface {
+	// ExportSince returns up to limit records ingested after cursor. 0 exports from
+	// the first record.
+	ExportSince(cursor int64, limit int) (*UsageExport, error)
+}
+
+// ExportSince uses the rowid as cursor. Rows are inserted by a single writer at a time,
+// so rowids grow in commit order and a record is never ingested behind a cursor which
+// was already returned. Backfilled usage is exported when it's ingested, whatever its
+// bucket; deleted records aren't reported. A bucket recorded by several tenants is only
+// exported once, with the first record.
+func (tracker *SQLiteUsageTracker) ExportSince(cursor int64, limit int) (*UsageExport, error) {
+	// One extra record tells whether there are more
+	rows, err := tracker.readDB().Query(`
+	SELECT rowid, CAST(strftime('%s', timestamp) AS INTEGER), validator_index
+	FROM validator_usage AS u WHERE rowid > ? AND NOT EXISTS (
+		SELECT 1 FROM validator_usage
+		WHERE timestamp = u.timestamp AND validator_index = u.validator_index AND rowid < u.rowid
+	)
+	ORDER BY rowid LIMIT ?
+	`, cursor, limit+1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage records: %w", err)
+	}
+	defer rows.Close()
+
+	out := &UsageExport{
+		Records: make([]UsageExportRecord, 0),
+		Cursor:  cursor,
+	}
+	for rows.Next() {
+		if len(out.Records) == limit {
+			out.More = true
+			break
+		}
+		var record UsageExportRecord
+		var bucket int64
+		if err := rows.Scan(&record.Cursor, &bucket, &record.Validator); err != nil {
+			return nil, err
+		}
+		record.Bucket = time.Unix(bucket, 0).UTC()
+		out.Records = append(out.Records, record)
+		out.Cursor = record.Cursor
+	}
+
+	return out, rows.Err()
+}
+
+func (tracker *HybridUsageTracker) ExportSince(cursor int64, limit int) (*UsageExport, error) {
+	return tracker.Buckets.ExportSince(cursor, limit)
+}
+
+// serveUsageExport returns the records ingested after the since cursor, so downstream
+// pipelines can sync incrementally. Pages hold up to limit records.
+func (pr *ProxyRouter) serveUsageExport(w http.ResponseWriter, r *http.Request) {
+	if !pr.requireUsageCapability(w, "incremental exports", UsageCapabilityExport) {
+		return
+	}
+	exporter := pr.ut.(usageExporter)
+
+	query := r.URL.Query()
+	var cursor int64
+	if since := query.Get("since"); since != "" {
+		var err error
+		cursor, err = strconv.ParseInt(since, 10, 64)
+		if err != nil || cursor < 0 {
+			http.Error(w, fmt.Sprintf("invalid since %q", since), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultUsageExportLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxUsageExportLimit {
+			http.Error(w, fmt.Sprintf("invalid limit %q, must be between 1 and %d", l, maxUsageExportLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	export, err := exporter.ExportSince(cursor, limit)
+	if err == nil {
+		export.Manifest, err = newUsageExportManifest(cursor, export.Records)
+	}
+	if err != nil {
+		pr.Logger.Error("Failed to export usage", zap.Error(err))
+		http.Error(w, "failed to export usage", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, export)
+}
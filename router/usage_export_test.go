@@ -0,0 +1,116 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestExportSince(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+	now := time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC)
+	sqlite.now = func() time.Time { return now }
+
+	if err := tracker.RecordUsage([]string{"1", "2", "3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := sqlite.ExportSince(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 2 || !page.More || page.Cursor != page.Records[1].Cursor {
+		t.Fatalf("Unexpected first page %+v", page)
+	}
+	page, err = sqlite.ExportSince(page.Cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 1 || page.More || page.Records[0].Validator != "3" {
+		t.Fatalf("Unexpected last page %+v", page)
+	}
+
+	// Nothing new keeps the cursor
+	cursor := page.Cursor
+	page, err = sqlite.ExportSince(cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 0 || page.Cursor != cursor {
+		t.Fatalf("Expected an empty page at %d, got %+v", cursor, page)
+	}
+
+	// Backfilled usage is exported once ingested, whatever its bucket
+	earlier := time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC)
+	if err := sqlite.RecordUsageAt(earlier, []string{"4"}); err != nil {
+		t.Fatal(err)
+	}
+	page, err = sqlite.ExportSince(cursor, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 1 || page.Records[0].Validator != "4" || !page.Records[0].Bucket.Equal(earlier) {
+		t.Fatalf("Expected the backfilled record, got %+v", page)
+	}
+}
+
+func TestAdminUsageExport(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if err := tracker.RecordUsage([]string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	handler := pr.AdminHandler()
+
+	for _, query := range []string{"?since=-1", "?since=abc", "?limit=0", "?limit=100001"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/export"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %d for %s, got %d", http.StatusBadRequest, query, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/export?limit=1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var page UsageExport
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Records) != 1 || !page.More {
+		t.Fatalf("Unexpected page %+v", page)
+	}
+
+	records, err := json.Marshal(page.Records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(records)
+	manifest := page.Manifest
+	if manifest.SchemaVersion != usageExportSchemaVersion || manifest.Since != 0 || manifest.Rows != 1 || !bytes.Equal(manifest.SHA256, sum[:]) {
+		t.Fatalf("Unexpected manifest %+v", manifest)
+	}
+}
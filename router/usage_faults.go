@@ -0,0 +1,153 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrInjectedFault is returned by operations a FaultInjector made fail.
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultInjector injects latency and failures into the usage tracker's database
+// operations, so retries and degraded tracking can be exercised end to end.
+// It's meant for resilience tests and must not be enabled in production.
+type FaultInjector struct {
+	// Added to every operation
+	Latency time.Duration
+	// Up to Jitter is added to Latency at random
+	Jitter time.Duration
+	// Fraction of writes failing with a retryable busy database error
+	BusyRate float64
+	// Fraction of reads and writes failing with ErrInjectedFault
+	ErrorRate float64
+	// Fraction of writes committing only the first half of their validators, then
+	// failing with a busy database error. Retries must complete the write without
+	// double counting.
+	PartialRate float64
+
+	// Overrides rand.Float64 in tests
+	rand func() float64
+}
+
+// ParseFaultInjector parses a comma separated list of faults, e.g.
+// "latency=50ms,jitter=20ms,busy=0.2,error=0.05,partial=0.05".
+// An empty spec disables fault injection and returns nil.
+func ParseFaultInjector(spec string) (*FaultInjector, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	out := &FaultInjector{}
+	for _, fault := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(fault), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault %q, expected key=value", fault)
+		}
+
+		var err error
+		switch key {
+		case "latency":
+			out.Latency, err = time.ParseDuration(value)
+		case "jitter":
+			out.Jitter, err = time.ParseDuration(value)
+		case "busy":
+			out.BusyRate, err = parseFaultRate(value)
+		case "error":
+			out.ErrorRate, err = parseFaultRate(value)
+		case "partial":
+			out.PartialRate, err = parseFaultRate(value)
+		default:
+			return nil, fmt.Errorf("unknown fault %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault %q: %w", key, err)
+		}
+	}
+
+	if out.Latency < 0 || out.Jitter < 0 {
+		return nil, errors.New("latency and jitter must not be negative")
+	}
+
+	return out, nil
+}
+
+func parseFaultRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("rate %v is outside of [0, 1]", rate)
+	}
+	return rate, nil
+}
+
+func (f *FaultInjector) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	if f.rand != nil {
+		return f.rand() < rate
+	}
+	return rand.Float64() < rate
+}
+
+func (f *FaultInjector) delay() {
+	latency := f.Latency
+	if f.Jitter > 0 {
+		latency += rand.N(f.Jitter)
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+}
+
+// busyError mimics SQLite failing to take the write lock.
+func busyError() error {
+	return fmt.Errorf("%w: %w", ErrInjectedFault, sqlite3.Error{Code: sqlite3.ErrBusy})
+}
+
+// write calls write with indexes, unless a fault is injected. A nil FaultInjector
+// injects nothing.
+func (f *FaultInjector) write(indexes []string, write func([]string) error) error {
+	if f == nil {
+		return write(indexes)
+	}
+
+	f.delay()
+	switch {
+	case f.roll(f.ErrorRate):
+		return ErrInjectedFault
+	case f.roll(f.BusyRate):
+		return busyError()
+	case len(indexes) > 1 && f.roll(f.PartialRate):
+		if err := write(indexes[:len(indexes)/2]); err != nil {
+			return err
+		}
+		return busyError()
+	}
+
+	return write(indexes)
+}
+
+// read returns an error if a fault is injected into a read. A nil FaultInjector
+// injects nothing.
+func (f *FaultInjector) read() error {
+	if f == nil {
+		return nil
+	}
+
+	f.delay()
+	if f.roll(f.ErrorRate) {
+		return ErrInjectedFault
+	}
+	return nil
+}
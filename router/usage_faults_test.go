@@ -0,0 +1,115 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseFaultInjector(t *testing.T) {
+	faults, err := ParseFaultInjector("")
+	if err != nil || faults != nil {
+		t.Fatalf("Expected no faults, got %+v, %v", faults, err)
+	}
+
+	faults, err = ParseFaultInjector("latency=50ms, jitter=20ms,busy=0.2,error=0.05,partial=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if faults.Latency != 50*time.Millisecond || faults.Jitter != 20*time.Millisecond ||
+		faults.BusyRate != 0.2 || faults.ErrorRate != 0.05 || faults.PartialRate != 1 {
+		t.Fatalf("Unexpected faults %+v", faults)
+	}
+
+	for _, spec := range []string{"busy", "busy=2", "error=-0.1", "latency=fast", "latency=-1s", "crash=0.5"} {
+		if _, err := ParseFaultInjector(spec); err == nil {
+			t.Fatalf("Expected an error for %q", spec)
+		}
+	}
+}
+
+// faultRolls returns a rand func replaying rolls, then never injecting faults.
+func faultRolls(rolls ...float64) func() float64 {
+	return func() float64 {
+		if len(rolls) == 0 {
+			return 1
+		}
+		roll := rolls[0]
+		rolls = rolls[1:]
+		return roll
+	}
+}
+
+func TestFaultInjectorTracker(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+	sqlite.WriteRetries = 3
+
+	now := time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC)
+	sqlite.now = func() time.Time { return now }
+	start := now.Add(-time.Hour)
+	end := now.Add(time.Hour)
+	expectUsage := func(expected map[string]time.Duration) {
+		t.Helper()
+		usage, err := sqlite.ViewUsage(start, end)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(usage) != len(expected) {
+			t.Fatalf("Expected %v, got %v", expected, usage)
+		}
+		for v, d := range expected {
+			if usage[v] != d {
+				t.Fatalf("Expected %v, got %v", expected, usage)
+			}
+		}
+	}
+
+	// Busy writes are retried
+	sqlite.Faults = &FaultInjector{BusyRate: 0.5, rand: faultRolls(0, 0)}
+	if err := sqlite.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	expectUsage(map[string]time.Duration{"1": 5 * time.Minute})
+
+	// Retries of partial writes don't double count
+	sqlite.Faults = &FaultInjector{PartialRate: 0.5, rand: faultRolls(0)}
+	if err := sqlite.RecordUsage([]string{"1", "2", "3", "4"}); err != nil {
+		t.Fatal(err)
+	}
+	expectUsage(map[string]time.Duration{"1": 5 * time.Minute, "2": 5 * time.Minute, "3": 5 * time.Minute, "4": 5 * time.Minute})
+
+	// Without retries, the partial write is visible
+	sqlite.WriteRetries = 0
+	sqlite.Faults = &FaultInjector{PartialRate: 0.5, rand: faultRolls(0)}
+	if err := sqlite.RecordUsage([]string{"5", "6"}); !isRetryableWriteError(err) || !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("Expected an injected busy error, got %v", err)
+	}
+	sqlite.Faults = nil
+	usage, err := sqlite.ViewUsage(start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := usage["5"]; !ok {
+		t.Fatalf("Expected the first half of the write, got %v", usage)
+	}
+	if _, ok := usage["6"]; ok {
+		t.Fatalf("Expected only the first half of the write, got %v", usage)
+	}
+
+	// Errors aren't retried and fail reads too
+	sqlite.WriteRetries = 3
+	sqlite.Faults = &FaultInjector{ErrorRate: 1}
+	if err := sqlite.RecordUsage([]string{"7"}); !errors.Is(err, ErrInjectedFault) || isRetryableWriteError(err) {
+		t.Fatalf("Expected an injected error, got %v", err)
+	}
+	if _, err := sqlite.ViewUsage(start, end); !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("Expected an injected error, got %v", err)
+	}
+}
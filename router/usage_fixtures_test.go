@@ -0,0 +1,285 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Bump when the generator or the usage schema changes, so cached fixtures are regenerated
+const usageFixtureVersion = 2
+
+// usageFixture describes a usage database shaped like a rescue node's on mainnet:
+// validator indices spread over the whole validator set, each day's usage made of
+// episodes of nodes falling back to the rescue node for a while, and incidents during
+// which a large share of the network does at once.
+//
+// Fixtures are generated deterministically from their description, which is their
+// compressed form: databases of hundreds of megabytes aren't checked in.
+type usageFixture struct {
+	Name string
+	// Size of the validator set indices are drawn from
+	Validators int
+	Days       int
+	// Nodes falling back to the rescue node per day
+	EpisodesPerDay int
+	Incidents      []usageFixtureIncident
+	Seed           uint64
+}
+
+type usageFixtureIncident struct {
+	Day        int
+	Validators int
+	Duration   time.Duration
+}
+
+var (
+	// Small enough to be generated by every test run
+	smallUsageFixture = usageFixture{
+		Name:           "small",
+		Validators:     1_000_000,
+		Days:           7,
+		EpisodesPerDay: 10,
+		Incidents:      []usageFixtureIncident{{Day: 5, Validators: 2_000, Duration: 2 * time.Hour}},
+		Seed:           1,
+	}
+	// A quarter of a year of mainnet usage, with a client bug taking down a tenth of
+	// the network for an hour, for benchmarks
+	mainnetUsageFixture = usageFixture{
+		Name:           "mainnet",
+		Validators:     1_000_000,
+		Days:           90,
+		EpisodesPerDay: 20,
+		Incidents: []usageFixtureIncident{
+			{Day: 30, Validators: 20_000, Duration: 3 * time.Hour},
+			{Day: 75, Validators: 100_000, Duration: time.Hour},
+		},
+		Seed: 2,
+	}
+)
+
+// Start of the first day of every fixture
+var usageFixtureStart = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const usageFixturePrecision = 5 * time.Minute
+
+func (f usageFixture) end() time.Time {
+	return usageFixtureStart.AddDate(0, 0, f.Days)
+}
+
+// generate writes the fixture's usage to db, which has the validator_usage schema.
+func (f usageFixture) generate(db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	stmt, err := tx.Prepare("INSERT INTO validator_usage (timestamp, validator_index, tenant) VALUES (datetime(?, 'unixepoch'), ?, '') ON CONFLICT (timestamp, validator_index, tenant) DO NOTHING")
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	rows := 0
+	end := f.end()
+	record := func(first int, n int, start time.Time, d time.Duration) error {
+		stop := start.Add(d)
+		if stop.After(end) {
+			stop = end
+		}
+		for bucket := start.Truncate(usageFixturePrecision); bucket.Before(stop); bucket = bucket.Add(usageFixturePrecision) {
+			for i := first; i < first+n; i++ {
+				if _, err := stmt.Exec(bucket.Unix(), fmt.Sprint(i)); err != nil {
+					return err
+				}
+				rows++
+			}
+		}
+		return nil
+	}
+
+	rng := rand.New(rand.NewPCG(f.Seed, usageFixtureVersion))
+	for day := range f.Days {
+		midnight := usageFixtureStart.AddDate(0, 0, day)
+		for range f.EpisodesPerDay {
+			// Most nodes run a handful of validators, few run hundreds. Their
+			// validators' indices are mostly contiguous.
+			var n int
+			switch p := rng.Float64(); {
+			case p < 0.7:
+				n = 1 + rng.IntN(4)
+			case p < 0.95:
+				n = 5 + rng.IntN(46)
+			default:
+				n = 51 + rng.IntN(450)
+			}
+			first := rng.IntN(f.Validators - n)
+			start := midnight.Add(time.Duration(rng.Int64N(int64(24 * time.Hour))))
+			// From a bucket to a day, log-uniformly
+			d := time.Duration(float64(usageFixturePrecision) * math.Pow(288, rng.Float64()))
+			if err := record(first, n, start, d); err != nil {
+				return rows, err
+			}
+		}
+		for _, incident := range f.Incidents {
+			if incident.Day != day {
+				continue
+			}
+			start := midnight.Add(12 * time.Hour)
+			if err := record(rng.IntN(f.Validators-incident.Validators), incident.Validators, start, incident.Duration); err != nil {
+				return rows, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return rows, err
+	}
+	// Query plans are chosen from the table's statistics
+	_, err = db.Exec("ANALYZE")
+	return rows, err
+}
+
+// open opens a tracker on the fixture, generated into the user's cache directory the
+// first time it's used.
+func (f usageFixture) open(tb testing.TB) *SQLiteUsageTracker {
+	tb.Helper()
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = tb.TempDir()
+	}
+	dir = filepath.Join(dir, "rescue-proxy", "usage-fixtures")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		tb.Fatal(err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-v%d.db", f.Name, usageFixtureVersion))
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		start := time.Now()
+		// Concurrent test binaries may generate it as well
+		tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+		db, err := sql.Open("sqlite3", "file:"+tmp)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tracker := &SQLiteUsageTracker{Database: db, Logger: zap.NewNop(), Precision: usageFixturePrecision}
+		if err := tracker.initSchema(); err != nil {
+			tb.Fatal(err)
+		}
+		rows, err := f.generate(db)
+		tracker.Close()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			tb.Fatal(err)
+		}
+		tb.Logf("Generated the %s usage fixture, %d records in %s", f.Name, rows, time.Since(start))
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tracker := &SQLiteUsageTracker{Database: db, Logger: zap.NewNop(), Precision: usageFixturePrecision}
+	if err := tracker.prepareStatements(); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(tracker.Close)
+	return tracker
+}
+
+// TestUsageQueryPlans checks the usage queries search an index, rather than scan the
+// table, with the statistics of a realistic database.
+func TestUsageQueryPlans(t *testing.T) {
+	tracker := smallUsageFixture.open(t)
+	from := usageFixtureStart.Unix()
+	to := usageFixtureStart.Add(24 * time.Hour).Unix()
+
+	for _, tt := range []struct {
+		name  string
+		query string
+		args  []any
+		// Expected in the search of validator_usage
+		search string
+	}{
+		{"view usage", viewUsageQuery, []any{from, to}, "(timestamp>? AND timestamp<?)"},
+		{"usage records", usageRecordsQuery, []any{from, to}, "(timestamp>? AND timestamp<?)"},
+		{"validator usage records", validatorUsageRecordsQuery, []any{"1", from, to}, "(validator_index=?"},
+		{"view usage multi", viewUsageMultiQuery, []any{fmt.Sprintf("[[%d,%d],[%d,%d]]", from, to, to, to+86400)}, "(timestamp>? AND timestamp<?)"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := tracker.Database.Query("EXPLAIN QUERY PLAN "+tt.query, tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+
+			plan := ""
+			for rows.Next() {
+				var id, parent, unused int
+				var detail string
+				if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+					t.Fatal(err)
+				}
+				plan += detail + "\n"
+			}
+			if err := rows.Err(); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(plan, "SEARCH validator_usage USING") || !strings.Contains(plan, tt.search) {
+				t.Fatalf("Expected an index search on %s, got:\n%s", tt.search, plan)
+			}
+		})
+	}
+}
+
+func BenchmarkUsageFixture(b *testing.B) {
+	tracker := mainnetUsageFixture.open(b)
+	// The busiest day, of the largest incident
+	day := usageFixtureStart.AddDate(0, 0, 75)
+
+	for _, r := range []struct {
+		name   string
+		length time.Duration
+	}{
+		{"day", 24 * time.Hour},
+		{"week", 7 * 24 * time.Hour},
+		{"month", 30 * 24 * time.Hour},
+	} {
+		b.Run("view usage/"+r.name, func(b *testing.B) {
+			for b.Loop() {
+				if _, err := tracker.ViewUsage(day.Add(24*time.Hour-r.length), day.Add(24*time.Hour)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	b.Run("usage records/day", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := tracker.usageRecords(day, day.Add(24*time.Hour)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("daily usage/month", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := DailyUsage(tracker, day.AddDate(0, 0, -29), day, time.UTC); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
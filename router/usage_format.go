@@ -0,0 +1,288 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// DurationFormat is how durations are written in admin API responses.
+type DurationFormat string
+
+const (
+	// Integer nanoseconds, as encoding/json writes time.Duration. The default.
+	DurationNanoseconds DurationFormat = "nanoseconds"
+	DurationSeconds     DurationFormat = "seconds"
+	DurationMinutes     DurationFormat = "minutes"
+	// e.g. 2d 3h 5m
+	DurationHuman DurationFormat = "human"
+)
+
+func (f DurationFormat) valid() bool {
+	switch f {
+	case DurationNanoseconds, DurationSeconds, DurationMinutes, DurationHuman:
+		return true
+	}
+	return false
+}
+
+// parseDurationFormat reads the durations query parameter, or else the durations
+// parameter of an application/json Accept header, e.g.
+//
+//	Accept: application/json; durations=seconds
+func parseDurationFormat(r *http.Request) (DurationFormat, error) {
+	value := r.URL.Query().Get("durations")
+	if value == "" {
+		for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+			mediaType, params, err := mime.ParseMediaType(accept)
+			if err != nil || mediaType != "application/json" {
+				continue
+			}
+			value = params["durations"]
+			break
+		}
+	}
+	if value == "" {
+		return DurationNanoseconds, nil
+	}
+
+	f := DurationFormat(value)
+	if !f.valid() {
+		return "", fmt.Errorf("invalid durations %q, must be nanoseconds, seconds, minutes or human", value)
+	}
+	return f, nil
+}
+
+// checkDurationFormat rejects requests for an unknown durations format before
+// they're handled.
+func checkDurationFormat(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := parseDurationFormat(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// humanizeDuration writes d in days, hours, minutes and seconds, largest first and
+// leaving out zero units, e.g. 2d 3h 5m. Durations under a second keep their precision.
+func humanizeDuration(d time.Duration) string {
+	if d == 0 {
+		return "0s"
+	}
+	sign := ""
+	if d < 0 {
+		sign = "-"
+		d = -d
+	}
+	if d < time.Second {
+		return sign + d.String()
+	}
+
+	var parts []string
+	for _, unit := range []struct {
+		suffix string
+		d      time.Duration
+	}{
+		{"d", 24 * time.Hour},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	} {
+		if n := d / unit.d; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d%s", n, unit.suffix))
+			d -= n * unit.d
+		}
+	}
+	return sign + strings.Join(parts, " ")
+}
+
+func (f DurationFormat) format(d time.Duration) any {
+	switch f {
+	case DurationSeconds:
+		return d.Seconds()
+	case DurationMinutes:
+		return d.Minutes()
+	case DurationHuman:
+		return humanizeDuration(d)
+	}
+	return int64(d)
+}
+
+// jsonField is a member of a jsonObject.
+type jsonField struct {
+	name  string
+	value any
+}
+
+// jsonObject is a JSON object which keeps the order of its fields, like a struct.
+type jsonObject []jsonField
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := json.Marshal(field.name)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+var (
+	durationType      = reflect.TypeOf(time.Duration(0))
+	timeType          = reflect.TypeOf(time.Time{})
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// formatResponse returns v with its durations written in f and its timestamps in UTC,
+// to be encoded as JSON instead of v. Struct fields are written like encoding/json
+// would, and values marshaling themselves are left as they are.
+func formatResponse(v any, f DurationFormat) any {
+	return formatValue(reflect.ValueOf(v), f)
+}
+
+func formatValue(v reflect.Value, f DurationFormat) any {
+	if !v.IsValid() {
+		return nil
+	}
+
+	if v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		return formatValue(v.Elem(), f)
+	}
+
+	switch v.Type() {
+	case durationType:
+		return f.format(time.Duration(v.Int()))
+	case timeType:
+		return v.Interface().(time.Time).UTC()
+	}
+	if marshals(v.Type()) {
+		return v.Interface()
+	}
+	if v.CanAddr() && marshals(reflect.PointerTo(v.Type())) {
+		return v.Addr().Interface()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return formatStruct(v, f)
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		out := reflect.MakeMapWithSize(reflect.MapOf(v.Type().Key(), reflect.TypeOf((*any)(nil)).Elem()), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			value := formatValue(iter.Value(), f)
+			if value == nil {
+				out.SetMapIndex(iter.Key(), reflect.Zero(out.Type().Elem()))
+				continue
+			}
+			out.SetMapIndex(iter.Key(), reflect.ValueOf(value))
+		}
+		return out.Interface()
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		// Written as base64
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		fallthrough
+	case reflect.Array:
+		out := make([]any, v.Len())
+		for i := range out {
+			out[i] = formatValue(v.Index(i), f)
+		}
+		return out
+	}
+
+	return v.Interface()
+}
+
+func marshals(t reflect.Type) bool {
+	return t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType)
+}
+
+func formatStruct(v reflect.Value, f DurationFormat) jsonObject {
+	out := jsonObject{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		// Fields of untagged embedded structs are promoted
+		if field.Anonymous && name == "" {
+			embedded := v.Field(i)
+			if embedded.Kind() == reflect.Pointer {
+				if embedded.IsNil() {
+					continue
+				}
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				out = append(out, formatStruct(embedded, f)...)
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		value := v.Field(i)
+		if strings.Contains(options, "omitempty") && isEmptyJSONValue(value) {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		out = append(out, jsonField{name: name, value: formatValue(value, f)})
+	}
+	return out
+}
+
+// isEmptyJSONValue reports whether omitempty leaves v out.
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestHumanizeDuration(t *testing.T) {
+	tests := []struct {
+		d        time.Duration
+		expected string
+	}{
+		{0, "0s"},
+		{250 * time.Millisecond, "250ms"},
+		{5 * time.Minute, "5m"},
+		{90 * time.Second, "1m 30s"},
+		{51*time.Hour + 5*time.Minute, "2d 3h 5m"},
+		{-2 * time.Hour, "-2h"},
+	}
+
+	for _, tt := range tests {
+		if got := humanizeDuration(tt.d); got != tt.expected {
+			t.Fatalf("Expected %v to be %q, got %q", tt.d, tt.expected, got)
+		}
+	}
+}
+
+func TestParseDurationFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		accept   string
+		expected DurationFormat
+		err      bool
+	}{
+		{"default", "", "", DurationNanoseconds, false},
+		{"query", "durations=seconds", "", DurationSeconds, false},
+		{"accept", "", "text/html, application/json; durations=human", DurationHuman, false},
+		{"query over accept", "durations=minutes", "application/json; durations=human", DurationMinutes, false},
+		{"other media type", "", "text/plain; durations=human", DurationNanoseconds, false},
+		{"invalid", "durations=hours", "", "", true},
+		{"invalid accept", "", "application/json; durations=fortnights", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/usage?"+tt.query, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			f, err := parseDurationFormat(r)
+			if (err != nil) != tt.err {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if f != tt.expected {
+				t.Fatalf("Expected %q, got %q", tt.expected, f)
+			}
+		})
+	}
+}
+
+type formatEmbedded struct {
+	Embedded string `json:"embedded"`
+}
+
+type formatTestResponse struct {
+	formatEmbedded
+	Duration time.Duration            `json:"duration"`
+	Time     time.Time                `json:"time"`
+	Address  common.Address           `json:"address"`
+	Omitted  string                   `json:"omitted,omitempty"`
+	Kept     string                   `json:"kept"`
+	Ignored  string                   `json:"-"`
+	Untagged int                      `json:""`
+	Pointer  *time.Duration           `json:"pointer"`
+	Nil      *time.Duration           `json:"nil"`
+	Slice    []time.Duration          `json:"slice"`
+	NilSlice []string                 `json:"nil_slice"`
+	Map      map[string]time.Duration `json:"map"`
+	Bytes    []byte                   `json:"bytes"`
+	Any      any                      `json:"any"`
+	private  int
+}
+
+func TestFormatResponse(t *testing.T) {
+	pointer := 2 * time.Second
+	zone := time.FixedZone("test", 2*60*60)
+	response := &formatTestResponse{
+		formatEmbedded: formatEmbedded{Embedded: "embedded"},
+		Duration:       90 * time.Minute,
+		Time:           time.Date(2025, 1, 1, 2, 0, 0, 0, zone),
+		Address:        common.Address{1},
+		Kept:           "kept",
+		Ignored:        "ignored",
+		Untagged:       7,
+		Pointer:        &pointer,
+		Slice:          []time.Duration{time.Minute},
+		Map:            map[string]time.Duration{"1": time.Hour},
+		Bytes:          []byte("bytes"),
+		Any:            []UsageDiscrepancy{{Validator: "1", Difference: -time.Minute}},
+		private:        1,
+	}
+
+	// Nanoseconds match encoding/json, apart from timestamps being in UTC
+	formatted, err := json.Marshal(formatResponse(response, DurationNanoseconds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	utc := *response
+	utc.Time = utc.Time.UTC()
+	expected, err := json.Marshal(&utc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(formatted) != string(expected) {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, formatted)
+	}
+
+	formatted, err = json.Marshal(formatResponse(response, DurationSeconds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seconds map[string]any
+	if err := json.Unmarshal(formatted, &seconds); err != nil {
+		t.Fatal(err)
+	}
+	if seconds["duration"] != 5400.0 || seconds["pointer"] != 2.0 || seconds["slice"].([]any)[0] != 60.0 {
+		t.Fatalf("Expected durations in seconds, got %s", formatted)
+	}
+	if seconds["map"].(map[string]any)["1"] != 3600.0 {
+		t.Fatalf("Expected map durations in seconds, got %s", formatted)
+	}
+	if seconds["any"].([]any)[0].(map[string]any)["difference"] != -60.0 {
+		t.Fatalf("Expected nested durations in seconds, got %s", formatted)
+	}
+	if seconds["time"] != "2025-01-01T00:00:00Z" {
+		t.Fatalf("Expected the time in UTC, got %s", formatted)
+	}
+
+	formatted, err = json.Marshal(formatResponse(response, DurationHuman))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var human map[string]any
+	if err := json.Unmarshal(formatted, &human); err != nil {
+		t.Fatal(err)
+	}
+	if human["duration"] != "1h 30m" {
+		t.Fatalf("Expected a humanized duration, got %s", formatted)
+	}
+}
+
+func TestUsageAdminDurationFormat(t *testing.T) {
+	tracker, now := setupHybridTestDatabase(t, 5*time.Minute, 10*time.Minute)
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	handler := pr.AdminHandler()
+
+	*now = time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC)
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := "/usage/reconcile?from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z&tolerance=0s"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"&durations=minutes", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var report map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report["precision"] != 5.0 || report["tolerance"] != 0.0 {
+		t.Fatalf("Expected durations in minutes, got %v", report)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path+"&durations=weeks", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
@@ -0,0 +1,71 @@
+//go:build ns
+
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// boundaryGrace suppresses records right after a bucket boundary for validators
+// that were active right before it, so a short burst of activity straddling the
+// boundary is counted as a single bucket instead of two.
+type boundaryGrace struct {
+	sync.Mutex
+
+	// Last activity per validator index
+	lastSeen  map[string]time.Time
+	lastPrune time.Time
+	// Bounds lastSeen, see MemoryBudget
+	limit cacheLimit
+}
+
+// filter returns the indices which should be recorded at now.
+// A validator is skipped when now is less than grace after the start of its bucket
+// and the validator was already active within grace before that boundary.
+func (b *boundaryGrace) filter(now time.Time, precision time.Duration, grace time.Duration, indexes []string) []string {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.lastSeen == nil {
+		b.lastSeen = make(map[string]time.Time)
+	}
+
+	bucketStart := now.Truncate(precision)
+	inGrace := now.Sub(bucketStart) < grace
+
+	out := filterIndexes(indexes, func(index string) bool {
+		last, seen := b.lastSeen[index]
+		if !seen && b.limit.full(len(b.lastSeen)) {
+			// Evicted validators may be recorded twice around the boundary
+			b.limit.evict(b.lastSeen, now.Add(-precision-grace))
+		}
+		if !last.After(now) {
+			b.lastSeen[index] = now
+		}
+
+		return !inGrace || !seen || last.Before(bucketStart.Add(-grace))
+	})
+
+	// Activity older than a bucket plus the grace can no longer suppress anything
+	if now.Sub(b.lastPrune) > precision {
+		for index, last := range b.lastSeen {
+			if now.Sub(last) > precision+grace {
+				delete(b.lastSeen, index)
+			}
+		}
+		b.lastPrune = now
+	}
+
+	return out
+}
+
+func (b *boundaryGrace) cacheEntries() int {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.lastSeen)
+}
+
+func (b *boundaryGrace) cacheEvictions() uint64 {
+	return b.limit.evictions.Load()
+}
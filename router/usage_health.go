@@ -0,0 +1,228 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"go.uber.org/zap"
+)
+
+// TrackingMode is how well usage is currently being tracked.
+type TrackingMode string
+
+const (
+	// Usage is recorded and can be viewed.
+	TrackingNormal TrackingMode = "normal"
+	// The wall clock is behind recorded usage, usage is recorded per the ClockSkewPolicy.
+	TrackingClockSkew TrackingMode = "clock_skew"
+	// Usage is recorded, but views fail as the read replica is unreachable.
+	TrackingReplicaDown TrackingMode = "replica_down"
+	// The database is reachable, but usage writes fail.
+	TrackingWritesFailing TrackingMode = "writes_failing"
+	// The database is unreachable, usage isn't recorded.
+	TrackingBackendDown TrackingMode = "backend_down"
+)
+
+// trackingModes are ordered by severity
+var trackingModes = []TrackingMode{
+	TrackingNormal,
+	TrackingClockSkew,
+	TrackingReplicaDown,
+	TrackingWritesFailing,
+	TrackingBackendDown,
+}
+
+// usageHealthChecker is implemented by trackers whose databases can be pinged.
+type usageHealthChecker interface {
+	HealthCheck(ctx context.Context) map[UsageDBRole]error
+}
+
+func (tracker *HybridUsageTracker) HealthCheck(ctx context.Context) map[UsageDBRole]error {
+	// Both models share the bucket tracker's databases
+	return tracker.Buckets.HealthCheck(ctx)
+}
+
+// clockSkewer is implemented by trackers which apply a ClockSkewPolicy.
+type clockSkewer interface {
+	clockSkewed() bool
+}
+
+func (tracker *SQLiteUsageTracker) clockSkewed() bool {
+	return tracker.skewed.Load()
+}
+
+func (tracker *HybridUsageTracker) clockSkewed() bool {
+	return tracker.Buckets.clockSkewed()
+}
+
+// TrackingStatus is the tracking mode and the health of each usage database.
+type TrackingStatus struct {
+	Mode  TrackingMode `json:"mode"`
+	Since time.Time    `json:"since"`
+	// "ok" or the error of the last check, per role
+	Databases map[UsageDBRole]string `json:"databases"`
+	// Error of the last usage write, if it failed
+	WriteError string `json:"write_error,omitempty"`
+}
+
+// TrackingModeMonitor derives the TrackingMode from periodic database health checks,
+// the tracker's clock and the outcome of usage writes. It exports the mode as the
+// one-hot tracking_mode{mode} gauge and logs every transition.
+type TrackingModeMonitor struct {
+	Tracker UsageTracker
+	Logger  *zap.Logger
+	// How often databases are checked, defaults to 30 seconds
+	Interval time.Duration
+
+	mu        sync.Mutex
+	mode      TrackingMode
+	since     time.Time
+	databases map[UsageDBRole]error
+	writeErr  error
+
+	m *metrics.MetricsRegistry
+}
+
+// NewTrackingModeMonitor creates a monitor in the normal mode and exports its gauge.
+func NewTrackingModeMonitor(logger *zap.Logger, tracker UsageTracker) *TrackingModeMonitor {
+	monitor := &TrackingModeMonitor{
+		Tracker: tracker,
+		Logger:  logger,
+		m:       metrics.NewMetricsRegistry("usage_tracking"),
+	}
+	monitor.setMode(TrackingNormal)
+	return monitor
+}
+
+// setMode must be called with mu held.
+func (monitor *TrackingModeMonitor) setMode(mode TrackingMode) {
+	monitor.mode = mode
+	monitor.since = time.Now()
+	if monitor.m == nil {
+		return
+	}
+	gauge := monitor.m.GaugeVec("tracking_mode", "mode")
+	for _, m := range trackingModes {
+		value := 0.0
+		if m == mode {
+			value = 1
+		}
+		gauge.WithLabelValues(string(m)).Set(value)
+	}
+}
+
+// update recomputes the mode and must be called with mu held.
+func (monitor *TrackingModeMonitor) update() {
+	mode := TrackingNormal
+	switch {
+	case monitor.databases[UsageDBPrimary] != nil:
+		mode = TrackingBackendDown
+	case monitor.writeErr != nil:
+		mode = TrackingWritesFailing
+	case monitor.databases[UsageDBReplica] != nil:
+		mode = TrackingReplicaDown
+	default:
+		if skewer, ok := monitor.Tracker.(clockSkewer); ok && skewer.clockSkewed() {
+			mode = TrackingClockSkew
+		}
+	}
+
+	if mode == monitor.mode {
+		return
+	}
+
+	fields := []zap.Field{
+		zap.String("from", string(monitor.mode)),
+		zap.String("to", string(mode)),
+		zap.Duration("after", time.Since(monitor.since)),
+	}
+	if mode == TrackingNormal {
+		monitor.Logger.Info("Usage tracking recovered", fields...)
+	} else {
+		monitor.Logger.Warn("Usage tracking degraded", fields...)
+	}
+	monitor.setMode(mode)
+}
+
+// recordWrite reports the outcome of a usage write.
+func (monitor *TrackingModeMonitor) recordWrite(err error) {
+	if errors.Is(err, ErrClockSkew) {
+		// Dropped usage is reported as clock skew
+		err = nil
+	}
+
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+	monitor.writeErr = err
+	monitor.update()
+}
+
+// Check pings the tracker's databases and updates the mode.
+func (monitor *TrackingModeMonitor) Check(ctx context.Context) {
+	var databases map[UsageDBRole]error
+	if checker, ok := monitor.Tracker.(usageHealthChecker); ok {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		databases = checker.HealthCheck(ctx)
+		cancel()
+	}
+
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+	monitor.databases = databases
+	monitor.update()
+}
+
+// Mode returns the current mode.
+func (monitor *TrackingModeMonitor) Mode() TrackingMode {
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+	return monitor.mode
+}
+
+// Status returns the current mode and the results of the last check.
+func (monitor *TrackingModeMonitor) Status() TrackingStatus {
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+
+	out := TrackingStatus{
+		Mode:      monitor.mode,
+		Since:     monitor.since.UTC(),
+		Databases: make(map[UsageDBRole]string, len(monitor.databases)),
+	}
+	for role, err := range monitor.databases {
+		out.Databases[role] = "ok"
+		if err != nil {
+			out.Databases[role] = err.Error()
+		}
+	}
+	if monitor.writeErr != nil {
+		out.WriteError = monitor.writeErr.Error()
+	}
+	return out
+}
+
+// Run checks the databases every Interval until ctx is done.
+func (monitor *TrackingModeMonitor) Run(ctx context.Context) {
+	interval := monitor.Interval
+	if interval == 0 {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		monitor.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,121 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestTrackingModeMonitor(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+
+	monitor := &TrackingModeMonitor{
+		Tracker: sqlite,
+		Logger:  zaptest.NewLogger(t),
+		mode:    TrackingNormal,
+	}
+	ctx := context.Background()
+
+	expect := func(mode TrackingMode) {
+		t.Helper()
+		if m := monitor.Mode(); m != mode {
+			t.Fatalf("Expected mode %s, got %s", mode, m)
+		}
+	}
+
+	monitor.Check(ctx)
+	expect(TrackingNormal)
+	if status := monitor.Status(); status.Databases[UsageDBPrimary] != "ok" {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+
+	// Dropped usage isn't a write failure
+	sqlite.skewed.Store(true)
+	monitor.recordWrite(ErrClockSkew)
+	expect(TrackingClockSkew)
+	sqlite.skewed.Store(false)
+
+	monitor.recordWrite(errors.New("disk I/O error"))
+	expect(TrackingWritesFailing)
+	if status := monitor.Status(); status.WriteError != "disk I/O error" {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+	monitor.recordWrite(nil)
+	expect(TrackingNormal)
+
+	replica, err := sql.Open("sqlite3", "file:replica.db?mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = replica.Close()
+	sqlite.ReadDatabase = replica
+	monitor.Check(ctx)
+	expect(TrackingReplicaDown)
+	sqlite.ReadDatabase = nil
+
+	// A failing primary takes precedence over everything else
+	monitor.recordWrite(errors.New("disk I/O error"))
+	_ = sqlite.Database.Close()
+	monitor.Check(ctx)
+	expect(TrackingBackendDown)
+	if status := monitor.Status(); status.Databases[UsageDBPrimary] == "ok" {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+}
+
+func TestAdminUsageHealth(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	handler := pr.AdminHandler()
+
+	serve := func(code int) TrackingStatus {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/health", nil))
+		if rec.Code != code {
+			t.Fatalf("Expected %d, got %d: %s", code, rec.Code, rec.Body.String())
+		}
+		var status TrackingStatus
+		if code != http.StatusServiceUnavailable || pr.health != nil {
+			if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return status
+	}
+
+	serve(http.StatusServiceUnavailable)
+
+	pr.health = &TrackingModeMonitor{Tracker: tracker, Logger: pr.Logger, mode: TrackingNormal}
+	pr.health.Check(context.Background())
+	if status := serve(http.StatusOK); status.Mode != TrackingNormal {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+
+	pr.health.recordWrite(errors.New("disk I/O error"))
+	if status := serve(http.StatusServiceUnavailable); status.Mode != TrackingWritesFailing {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+}
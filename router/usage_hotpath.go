@@ -0,0 +1,79 @@
+//go:build ns
+
+package router
+
+import "sync"
+
+// RecordUsage runs on every prepare_beacon_proposer call, so its allocations are kept
+// in check by TestRecordUsageAllocations:
+//   - calls whose validators are all skipped, by the coalescer or the boundary grace,
+//     don't allocate
+//   - writes allocate a fixed amount regardless of the number of validators, which are
+//     inserted by a single statement taking them as a JSON array. It only runs in a
+//     transaction with UsageTrackerOptions.TxLock, which allocates a few more.
+
+// filterIndexes returns the indexes keep returns true for. keep is called once per
+// index, in order.
+//
+// It returns a prefix of indexes, rather than a copy, unless a kept index follows a
+// dropped one, so the common cases of keeping all, none or the first few indexes don't
+// allocate. Prefixes are returned with their capacity limited to their length, so
+// appending to them copies.
+func filterIndexes(indexes []string, keep func(string) bool) []string {
+	kept := 0
+	var out []string
+	for i, index := range indexes {
+		if !keep(index) {
+			continue
+		}
+		if out == nil && kept < i {
+			out = make([]string, kept, len(indexes)-i+kept)
+			copy(out, indexes[:kept])
+		}
+		if out != nil {
+			out = append(out, index)
+		}
+		kept++
+	}
+	if out == nil {
+		return indexes[:kept:kept]
+	}
+	return out
+}
+
+// Buffers validator lists are encoded in, reused across writes
+var validatorListPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+// appendValidatorList appends indexes to buf as a JSON array of strings.
+func appendValidatorList(buf []byte, indexes []string) []byte {
+	buf = append(buf, '[')
+	for i, index := range indexes {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendJSONString(buf, index)
+	}
+	return append(buf, ']')
+}
+
+func appendJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c < 0x20:
+			buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, '"')
+}
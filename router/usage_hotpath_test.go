@@ -0,0 +1,128 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFilterIndexes(t *testing.T) {
+	indexes := []string{"1", "2", "3", "4"}
+	for _, tt := range []struct {
+		drop     []string
+		expected []string
+		copied   bool
+	}{
+		{nil, indexes, false},
+		{indexes, []string{}, false},
+		{[]string{"3", "4"}, []string{"1", "2"}, false},
+		{[]string{"1", "3"}, []string{"2", "4"}, true},
+	} {
+		out := filterIndexes(indexes, func(index string) bool {
+			return !slices.Contains(tt.drop, index)
+		})
+		if !slices.Equal(out, tt.expected) {
+			t.Fatalf("Expected %v after dropping %v, got %v", tt.expected, tt.drop, out)
+		}
+		if copied := len(out) > 0 && &out[0] != &indexes[0]; copied != tt.copied {
+			t.Fatalf("Expected copied to be %v after dropping %v", tt.copied, tt.drop)
+		}
+		if !tt.copied && cap(out) != len(out) {
+			t.Fatalf("Expected the capacity of %v to be its length, got %d", out, cap(out))
+		}
+	}
+}
+
+func TestAppendValidatorList(t *testing.T) {
+	indexes := []string{"1", "", `quo"te`, `back\slash`, "new\nline", "ünïcode"}
+	var out []string
+	if err := json.Unmarshal(appendValidatorList(nil, indexes), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(out, indexes) {
+		t.Fatalf("Expected %q, got %q", indexes, out)
+	}
+	if list := string(appendValidatorList(nil, nil)); list != "[]" {
+		t.Fatalf("Expected an empty array, got %s", list)
+	}
+}
+
+// TestRecordUsageAllocations enforces the allocation budget of RecordUsage, which runs
+// on every prepare_beacon_proposer call.
+func TestRecordUsageAllocations(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Allocations are measured over many calls")
+	}
+
+	validators := func(n int) []string {
+		out := make([]string, n)
+		for i := range out {
+			out[i] = fmt.Sprint(i)
+		}
+		return out
+	}
+	now := time.Date(2025, 1, 1, 0, 4, 50, 0, time.UTC)
+
+	t.Run("coalesced", func(t *testing.T) {
+		tracker := setupSQLiteBenchmarkDatabase(t)
+		tracker.Coalesce = true
+		tracker.now = func() time.Time { return now }
+		indexes := validators(4)
+		if err := tracker.RecordUsage(indexes); err != nil {
+			t.Fatal(err)
+		}
+
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := tracker.RecordUsage(indexes); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Fatalf("Expected coalesced writes not to allocate, got %v allocations", allocs)
+		}
+	})
+
+	t.Run("boundary grace", func(t *testing.T) {
+		tracker := setupSQLiteBenchmarkDatabase(t)
+		tracker.BoundaryGrace = 30 * time.Second
+		tracker.now = func() time.Time { return now }
+		indexes := validators(4)
+		if err := tracker.RecordUsage(indexes); err != nil {
+			t.Fatal(err)
+		}
+
+		// Right after the boundary, the validators active right before it are skipped
+		after := now.Add(20 * time.Second)
+		tracker.now = func() time.Time { return after }
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := tracker.RecordUsage(indexes); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Fatalf("Expected skipped writes not to allocate, got %v allocations", allocs)
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		tracker := setupSQLiteBenchmarkDatabase(t)
+		tracker.now = func() time.Time { return now }
+
+		// Writes cost the same whatever the number of validators
+		for _, n := range []int{1, 4, 100} {
+			indexes := validators(n)
+			allocs := testing.AllocsPerRun(100, func() {
+				if err := tracker.RecordUsage(indexes); err != nil {
+					t.Fatal(err)
+				}
+			})
+			if allocs > 12 {
+				t.Fatalf("Expected at most 12 allocations writing %d validators, got %v", n, allocs)
+			}
+		}
+	})
+}
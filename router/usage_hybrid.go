@@ -0,0 +1,189 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HybridUsageTracker records usage with both the bucket and the session model.
+// ViewUsage is served from the buckets, which quotas are based on; the sessions are
+// only used by Reconcile to validate the quantized numbers.
+//
+// Both models share the same databases.
+type HybridUsageTracker struct {
+	Buckets  *SQLiteUsageTracker
+	Sessions *SQLiteSessionUsageTracker
+	Logger   *zap.Logger
+}
+
+func NewHybridUsageTracker(logger *zap.Logger, opts UsageTrackerOptions) UsageTracker {
+	tracker, err := newHybridUsageTracker(logger, opts)
+	if err != nil {
+		logger.Fatal("Failed to initialize database schema", zap.Error(err))
+	}
+	return tracker
+}
+
+func newHybridUsageTracker(logger *zap.Logger, opts UsageTrackerOptions) (*HybridUsageTracker, error) {
+	idleTimeout := opts.sessionIdleTimeout(logger)
+
+	buckets, err := newSQLiteUsageTracker(logger, opts)
+	if err != nil {
+		return nil, err
+	}
+	// The bucket tracker's logger already carries the tracker's name
+	logger = buckets.Logger
+	sessions := &SQLiteSessionUsageTracker{
+		Database:     buckets.Database,
+		ReadDatabase: buckets.ReadDatabase,
+		Logger:       logger,
+		IdleTimeout:  idleTimeout,
+		WriteRetries: buckets.WriteRetries,
+		Faults:       buckets.Faults,
+		// Metrics are shared with the bucket tracker, which owns the registry
+		m: buckets.m,
+	}
+
+	if err := sessions.initSchema(); err != nil {
+		sessions.closeStatements()
+		buckets.Close()
+		return nil, err
+	}
+
+	return &HybridUsageTracker{
+		Buckets:  buckets,
+		Sessions: sessions,
+		Logger:   logger,
+	}, nil
+}
+
+func (tracker *HybridUsageTracker) RecordUsage(indexes []string) error {
+	var out error
+	if err := tracker.Buckets.RecordUsage(indexes); err != nil {
+		out = errors.Join(out, fmt.Errorf("buckets: %w", err))
+	}
+	if err := tracker.Sessions.RecordUsage(indexes); err != nil {
+		out = errors.Join(out, fmt.Errorf("sessions: %w", err))
+	}
+	return out
+}
+
+func (tracker *HybridUsageTracker) ViewUsage(from time.Time, to time.Time) (map[string]time.Duration, error) {
+	return tracker.Buckets.ViewUsage(from, to)
+}
+
+func (tracker *HybridUsageTracker) primaryDatabase() *sql.DB {
+	return tracker.Buckets.Database
+}
+
+func (tracker *HybridUsageTracker) Close() {
+	// The bucket tracker owns the databases and metrics
+	tracker.Sessions.closed.Store(true)
+	tracker.Sessions.closeStatements()
+	tracker.Buckets.Close()
+}
+
+// UsageDiscrepancy compares the usage of a validator under both models.
+type UsageDiscrepancy struct {
+	Validator string        `json:"validator"`
+	Buckets   time.Duration `json:"buckets"`
+	Sessions  time.Duration `json:"sessions"`
+	// Buckets minus Sessions. Positive when quantization over-counts.
+	Difference time.Duration `json:"difference"`
+}
+
+// UsageReconciliation is the result of HybridUsageTracker.Reconcile.
+type UsageReconciliation struct {
+	// The range both models were compared over, aligned to bucket boundaries
+	From      time.Time     `json:"from"`
+	To        time.Time     `json:"to"`
+	Precision time.Duration `json:"precision"`
+	Tolerance time.Duration `json:"tolerance"`
+
+	Validators    int           `json:"validators"`
+	BucketsTotal  time.Duration `json:"buckets_total"`
+	SessionsTotal time.Duration `json:"sessions_total"`
+
+	// Validators whose difference exceeds Tolerance, largest first
+	Discrepancies []UsageDiscrepancy `json:"discrepancies"`
+}
+
+// Reconcile compares bucket- and session-derived usage per validator over [from, to].
+//
+// Buckets straddling either edge count in full, so the range is widened to the
+// enclosing bucket boundaries before sessions are clipped to it. Each session is
+// expected to be over-counted by up to one precision by the buckets; validators
+// whose difference exceeds tolerance in either direction are reported.
+func (tracker *HybridUsageTracker) Reconcile(from time.Time, to time.Time, tolerance time.Duration) (*UsageReconciliation, error) {
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+
+	precision := tracker.Buckets.Precision
+	alignedFrom := from.Truncate(precision)
+	alignedTo := to.Truncate(precision).Add(precision)
+
+	buckets, err := tracker.Buckets.ViewUsage(from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to view bucket usage: %w", err)
+	}
+	sessions, err := tracker.Sessions.ViewUsage(alignedFrom, alignedTo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to view session usage: %w", err)
+	}
+
+	out := &UsageReconciliation{
+		From:          alignedFrom,
+		To:            alignedTo,
+		Precision:     precision,
+		Tolerance:     tolerance,
+		Discrepancies: []UsageDiscrepancy{},
+	}
+
+	validators := make(map[string]struct{}, len(buckets))
+	for validator := range buckets {
+		validators[validator] = struct{}{}
+	}
+	for validator := range sessions {
+		validators[validator] = struct{}{}
+	}
+	out.Validators = len(validators)
+
+	for validator := range validators {
+		d := UsageDiscrepancy{
+			Validator: validator,
+			Buckets:   buckets[validator],
+			Sessions:  sessions[validator],
+		}
+		d.Difference = d.Buckets - d.Sessions
+		out.BucketsTotal += d.Buckets
+		out.SessionsTotal += d.Sessions
+
+		if d.Difference > tolerance || -d.Difference > tolerance {
+			out.Discrepancies = append(out.Discrepancies, d)
+		}
+	}
+
+	sort.Slice(out.Discrepancies, func(i, j int) bool {
+		a, b := out.Discrepancies[i].Difference, out.Discrepancies[j].Difference
+		if a < 0 {
+			a = -a
+		}
+		if b < 0 {
+			b = -b
+		}
+		if a != b {
+			return a > b
+		}
+		return out.Discrepancies[i].Validator < out.Discrepancies[j].Validator
+	})
+
+	return out, nil
+}
@@ -0,0 +1,171 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func setupHybridTestDatabase(t *testing.T, precision time.Duration, idleTimeout time.Duration) (*HybridUsageTracker, *time.Time) {
+	db, err := sql.Open("sqlite3", "file:hybrid.db?mode=memory")
+	if err != nil {
+		t.Fatal("Failed to open SQLite database:", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	now := new(time.Time)
+	clock := func() time.Time { return *now }
+	logger := zaptest.NewLogger(t)
+
+	buckets := &SQLiteUsageTracker{
+		Database:   db,
+		Logger:     logger,
+		Precision:  precision,
+		SkewPolicy: ClockSkewClamp,
+		wallClock:  wallClock{now: clock},
+	}
+	if err := buckets.initSchema(); err != nil {
+		t.Fatal("Failed to initialize schema:", err)
+	}
+	sessions := &SQLiteSessionUsageTracker{
+		Database:    db,
+		Logger:      logger,
+		IdleTimeout: idleTimeout,
+		wallClock:   wallClock{now: clock},
+	}
+	if err := sessions.initSchema(); err != nil {
+		t.Fatal("Failed to initialize schema:", err)
+	}
+
+	tracker := &HybridUsageTracker{
+		Buckets:  buckets,
+		Sessions: sessions,
+		Logger:   logger,
+	}
+	t.Cleanup(tracker.Close)
+
+	return tracker, now
+}
+
+func TestHybridUsageTrackerReconcile(t *testing.T) {
+	tracker, now := setupHybridTestDatabase(t, 5*time.Minute, 10*time.Minute)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type event struct {
+		offset    time.Duration
+		validator string
+	}
+	var events []event
+
+	// Validator 1 is active continuously, both models roughly agree
+	for offset := time.Duration(0); offset <= 30*time.Minute; offset += time.Minute {
+		events = append(events, event{offset, "1"})
+	}
+	// Validator 2 pings every 10 minutes, just often enough to stay in session,
+	// but skips every other bucket
+	for offset := 4 * time.Minute; offset <= 40*time.Minute; offset += 10 * time.Minute {
+		events = append(events, event{offset, "2"})
+	}
+	// Validator 3 is seen once, the buckets count a full bucket for it
+	events = append(events, event{12 * time.Minute, "3"})
+	// Validator 4 pings every 11 minutes, starting a new session each time
+	events = append(events,
+		event{4*time.Minute + 59*time.Second, "4"},
+		event{16 * time.Minute, "4"},
+		event{27 * time.Minute, "4"})
+
+	// Record in order, the clock must not move backwards
+	sort.SliceStable(events, func(i, j int) bool { return events[i].offset < events[j].offset })
+	for _, e := range events {
+		*now = start.Add(e.offset)
+		if err := tracker.RecordUsage([]string{e.validator}); err != nil {
+			t.Fatal("Failed to record usage:", err)
+		}
+	}
+
+	// ViewUsage is served from the buckets
+	usage, err := tracker.ViewUsage(start, start.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] != 35*time.Minute {
+		t.Fatalf("Expected bucket usage for validator 1, got %v", usage["1"])
+	}
+
+	report, err := tracker.Reconcile(start.Add(time.Minute), start.Add(30*time.Minute), 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.From.Equal(start) || !report.To.Equal(start.Add(35*time.Minute)) {
+		t.Fatalf("Expected the range to be aligned to buckets, got [%v, %v]", report.From, report.To)
+	}
+	if report.Validators != 4 {
+		t.Fatalf("Expected 4 validators, got %d", report.Validators)
+	}
+	if report.BucketsTotal != (7+4+1+3)*5*time.Minute {
+		t.Fatalf("Unexpected bucket total %v", report.BucketsTotal)
+	}
+	if report.SessionsTotal != 60*time.Minute {
+		t.Fatalf("Unexpected session total %v", report.SessionsTotal)
+	}
+
+	// Validator 1: 35m vs 30m, within tolerance
+	// Validator 2: 20m vs 30m, under-counted by the buckets
+	// Validator 3: 5m vs 0, within tolerance
+	// Validator 4: 15m vs 0, three zero-length sessions
+	expected := []UsageDiscrepancy{
+		{Validator: "4", Buckets: 15 * time.Minute, Sessions: 0, Difference: 15 * time.Minute},
+		{Validator: "2", Buckets: 20 * time.Minute, Sessions: 30 * time.Minute, Difference: -10 * time.Minute},
+	}
+	if len(report.Discrepancies) != len(expected) {
+		t.Fatalf("Expected %d discrepancies, got %+v", len(expected), report.Discrepancies)
+	}
+	for i, d := range expected {
+		if report.Discrepancies[i] != d {
+			t.Errorf("Discrepancy %d: expected %+v, got %+v", i, d, report.Discrepancies[i])
+		}
+	}
+}
+
+func TestHybridUsageTrackerReconcileInvalidRange(t *testing.T) {
+	tracker, _ := setupHybridTestDatabase(t, 5*time.Minute, 10*time.Minute)
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := tracker.Reconcile(start, start.Add(-time.Minute), 0); err == nil {
+		t.Fatal("Expected an error for an inverted range")
+	}
+}
+
+func TestUsageTrackerClosed(t *testing.T) {
+	tracker, now := setupHybridTestDatabase(t, 5*time.Minute, 10*time.Minute)
+	*now = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing twice is harmless, and later calls fail rather than panic
+	tracker.Close()
+	tracker.Close()
+	if err := tracker.Buckets.RecordUsage([]string{"1"}); !errors.Is(err, ErrTrackerClosed) {
+		t.Fatalf("Expected a closed tracker, got %v", err)
+	}
+	if err := tracker.Buckets.RecordUsageAt(now.Add(-time.Hour), []string{"1"}); !errors.Is(err, ErrTrackerClosed) {
+		t.Fatalf("Expected a closed tracker, got %v", err)
+	}
+	if err := tracker.Sessions.RecordUsage([]string{"1"}); !errors.Is(err, ErrTrackerClosed) {
+		t.Fatalf("Expected a closed tracker, got %v", err)
+	}
+	if _, err := tracker.ViewUsage(*now, now.Add(time.Hour)); !errors.Is(err, ErrTrackerClosed) {
+		t.Fatalf("Expected a closed tracker, got %v", err)
+	}
+	if _, err := tracker.Sessions.ViewUsage(*now, now.Add(time.Hour)); !errors.Is(err, ErrTrackerClosed) {
+		t.Fatalf("Expected a closed tracker, got %v", err)
+	}
+}
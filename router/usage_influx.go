@@ -0,0 +1,239 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	influxMeasurement          = "validator_usage"
+	defaultInfluxFlushInterval = 10 * time.Second
+	influxWriteTimeout         = 10 * time.Second
+	// Points kept between flushes, further points are dropped
+	maxInfluxBuffered = 100_000
+)
+
+// ErrInfluxBufferFull is returned when usage events are dropped because points
+// couldn't be written to InfluxDB fast enough.
+var ErrInfluxBufferFull = errors.New("influx buffer is full")
+
+// InfluxOptions configures the InfluxDB v2 API usage events are written to as
+// points. Disabled when URL is empty.
+type InfluxOptions struct {
+	// Base URL of the API, e.g. http://localhost:8086. Telegraf's
+	// influxdb_v2_listener input serves the same API.
+	URL    string
+	Org    string
+	Bucket string
+	// Optional API token
+	Token string
+	// How often buffered points are written, defaults to 10 seconds
+	FlushInterval time.Duration
+}
+
+// InfluxUsageEventSink writes usage events as points in InfluxDB line protocol, so
+// usage can be charted next to other time series. Points are buffered and written
+// in the background; the tracker stays authoritative, points that can't be written
+// are eventually dropped.
+//
+// Each event is a validator_usage point tagged with the validator and, when known,
+// its node, kind, tier and instance, with a count field of 1 and the bucket field
+// holding the start of its bucket in unix seconds.
+type InfluxUsageEventSink struct {
+	Options InfluxOptions
+	Logger  *zap.Logger
+	Client  *http.Client
+
+	mu     sync.Mutex
+	points [][]byte
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	m *metrics.MetricsRegistry
+}
+
+// NewInfluxUsageEventSink starts flushing points to the API configured in opts.
+func NewInfluxUsageEventSink(logger *zap.Logger, opts InfluxOptions) *InfluxUsageEventSink {
+	sink := newInfluxUsageEventSink(logger, opts)
+	var ctx context.Context
+	ctx, sink.cancel = context.WithCancel(context.Background())
+	go sink.run(ctx)
+	return sink
+}
+
+func newInfluxUsageEventSink(logger *zap.Logger, opts InfluxOptions) *InfluxUsageEventSink {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultInfluxFlushInterval
+	}
+	return &InfluxUsageEventSink{
+		Options: opts,
+		Logger:  logger,
+		Client:  &http.Client{Timeout: influxWriteTimeout},
+		done:    make(chan struct{}),
+		m:       metrics.NewMetricsRegistry("usage_influx"),
+	}
+}
+
+// escapeInfluxTag escapes a tag key or value for line protocol.
+var escapeInfluxTag = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `).Replace
+
+// influxPoint formats an event as a line of line protocol, including the newline.
+func influxPoint(e UsageEvent) []byte {
+	var node string
+	if e.Node != nil {
+		node = e.Node.Hex()
+	}
+
+	var b bytes.Buffer
+	b.WriteString(influxMeasurement)
+	// Tags sorted by key, as InfluxDB recommends
+	for _, tag := range [][2]string{
+		{"instance", e.Instance},
+		{"kind", e.Kind},
+		{"node", node},
+		{"tier", e.Tier},
+		{"validator", e.Validator},
+	} {
+		if tag[1] == "" {
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(tag[0])
+		b.WriteByte('=')
+		b.WriteString(escapeInfluxTag(tag[1]))
+	}
+	b.WriteString(" count=1i")
+	if e.Bucket != nil {
+		b.WriteString(",bucket=")
+		b.WriteString(strconv.FormatInt(e.Bucket.Unix(), 10))
+		b.WriteByte('i')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(e.Time.UnixNano(), 10))
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func (s *InfluxUsageEventSink) WriteUsageEvents(events []UsageEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped := 0
+	for _, e := range events {
+		if len(s.points) >= maxInfluxBuffered {
+			dropped++
+			continue
+		}
+		s.points = append(s.points, influxPoint(e))
+	}
+	if dropped > 0 {
+		s.m.Counter("dropped").Add(float64(dropped))
+		return fmt.Errorf("%w, %d events dropped", ErrInfluxBufferFull, dropped)
+	}
+	return nil
+}
+
+// Flush writes the buffered points. Points that couldn't be written are kept for the
+// next flush, as long as there's room.
+func (s *InfluxUsageEventSink) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	points := s.points
+	s.points = nil
+	s.mu.Unlock()
+	if len(points) == 0 {
+		return nil
+	}
+
+	err := s.write(ctx, points)
+	if err == nil {
+		s.m.Counter("points_written").Add(float64(len(points)))
+		return nil
+	}
+	s.m.Counter("write_errors").Inc()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Points buffered since go after the ones being retried
+	kept := min(len(points), maxInfluxBuffered-len(s.points))
+	if dropped := len(points) - kept; dropped > 0 {
+		s.m.Counter("dropped").Add(float64(dropped))
+	}
+	s.points = append(points[:kept:kept], s.points...)
+	return err
+}
+
+func (s *InfluxUsageEventSink) write(ctx context.Context, points [][]byte) error {
+	endpoint, err := url.JoinPath(s.Options.URL, "/api/v2/write")
+	if err != nil {
+		return err
+	}
+	query := url.Values{
+		"org":       {s.Options.Org},
+		"bucket":    {s.Options.Bucket},
+		"precision": {"ns"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"?"+query.Encode(), bytes.NewReader(bytes.Join(points, nil)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.Options.Token != "" {
+		req.Header.Set("Authorization", "Token "+s.Options.Token)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to write %d points: %w", len(points), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("failed to write %d points: %s: %s", len(points), resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func (s *InfluxUsageEventSink) run(ctx context.Context) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.Options.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Flush(ctx); err != nil {
+				s.Logger.Warn("Failed to write usage points to InfluxDB", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Close stops flushing in the background and writes the remaining points.
+func (s *InfluxUsageEventSink) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	defer s.m.UnregisterAll()
+
+	ctx, cancel := context.WithTimeout(context.Background(), influxWriteTimeout)
+	defer cancel()
+	return s.Flush(ctx)
+}
@@ -0,0 +1,117 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestInfluxPoint(t *testing.T) {
+	at := time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC)
+	node := common.HexToAddress("0x1234")
+	events := usageEvents(at, 5*time.Minute, "proposer", "solo", []string{"100"}, &node, "proxy 1")
+
+	expected := "validator_usage,instance=proxy\\ 1,kind=proposer,node=0x0000000000000000000000000000000000001234,tier=solo,validator=100 count=1i,bucket=1735689600i 1735689660000000000\n"
+	if line := string(influxPoint(events[0])); line != expected {
+		t.Fatalf("Expected %q, got %q", expected, line)
+	}
+
+	// Minimized, unbucketed usage only has the validator
+	events = usageEvents(at, 0, "", "", []string{"a=b,c"}, nil, "")
+	expected = "validator_usage,validator=a\\=b\\,c count=1i 1735689660000000000\n"
+	if line := string(influxPoint(events[0])); line != expected {
+		t.Fatalf("Expected %q, got %q", expected, line)
+	}
+}
+
+func TestInfluxUsageEventSink(t *testing.T) {
+	_, err := metrics.Init("usage_influx_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	var mu sync.Mutex
+	var bodies []string
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/api/v2/write" || query.Get("org") != "org" || query.Get("bucket") != "usage" || query.Get("precision") != "ns" {
+			t.Errorf("Unexpected request %s", r.URL)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Token secret" {
+			t.Errorf("Unexpected authorization %q", auth)
+		}
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if status == http.StatusNoContent {
+			bodies = append(bodies, string(body))
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := newInfluxUsageEventSink(zaptest.NewLogger(t), InfluxOptions{
+		URL:    server.URL,
+		Org:    "org",
+		Bucket: "usage",
+		Token:  "secret",
+	})
+	at := time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC)
+	if err := sink.WriteUsageEvents(usageEvents(at, 0, "", "", []string{"1", "2"}, nil, "")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failed writes are retried on the next flush, after points buffered since
+	if err := sink.Flush(context.Background()); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	if err := sink.WriteUsageEvents(usageEvents(at, 0, "", "", []string{"3"}, nil, "")); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	status = http.StatusNoContent
+	mu.Unlock()
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "validator_usage,validator=1 count=1i 1735689660000000000\n" +
+		"validator_usage,validator=2 count=1i 1735689660000000000\n" +
+		"validator_usage,validator=3 count=1i 1735689660000000000\n"
+	if len(bodies) != 1 || bodies[0] != expected {
+		t.Fatalf("Expected a single write of %q, got %q", expected, bodies)
+	}
+}
+
+func TestInfluxUsageEventSinkFull(t *testing.T) {
+	_, err := metrics.Init("usage_influx_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	sink := newInfluxUsageEventSink(zaptest.NewLogger(t), InfluxOptions{URL: "http://localhost"})
+	sink.points = make([][]byte, maxInfluxBuffered-1)
+
+	err = sink.WriteUsageEvents(usageEvents(time.Now(), 0, "", "", []string{"1", "2"}, nil, ""))
+	if !errors.Is(err, ErrInfluxBufferFull) {
+		t.Fatalf("Expected an event to be dropped, got %v", err)
+	}
+	if len(sink.points) != maxInfluxBuffered {
+		t.Fatalf("Expected the buffer to be full, got %d points", len(sink.points))
+	}
+}
@@ -0,0 +1,306 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"go.uber.org/zap"
+)
+
+// Usage commitments are Merkle roots over the bucket records of a period, so third
+// parties given the root can verify the records they are shown.
+//
+// Leaves are the records of the period ordered by bucket then validator, hashed as
+// sha256(0x00 || bucket start as big endian unix seconds || validator). Inner nodes
+// are sha256(0x01 || left || right); an odd node at the end of a level is promoted
+// to the next level unchanged. A period without records commits to sha256("").
+
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// ErrNoUsageRecord is returned when an inclusion proof is requested for a validator
+// without records in the period.
+var ErrNoUsageRecord = errors.New("no usage record")
+
+// usageCommitter is implemented by trackers whose records can be committed to.
+type usageCommitter interface {
+	// usageRecords returns the records of buckets starting in [from, to), in leaf order.
+	usageRecords(from time.Time, to time.Time) ([]UsageRecord, error)
+}
+
+const usageRecordsQuery = `
+	SELECT DISTINCT CAST(strftime('%s', timestamp) AS INTEGER), validator_index
+	FROM validator_usage
+	WHERE timestamp >= datetime(?, 'unixepoch') AND timestamp < datetime(?, 'unixepoch')
+	ORDER BY timestamp, validator_index
+	`
+
+func (tracker *SQLiteUsageTracker) usageRecords(from time.Time, to time.Time) ([]UsageRecord, error) {
+	rows, err := tracker.readDB().Query(usageRecordsQuery, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage records: %w", err)
+	}
+	defer rows.Close()
+
+	out := []UsageRecord{}
+	for rows.Next() {
+		var bucket int64
+		var validator string
+		if err := rows.Scan(&bucket, &validator); err != nil {
+			return nil, err
+		}
+		out = append(out, UsageRecord{Bucket: time.Unix(bucket, 0).UTC(), Validator: ValidatorID(validator)})
+	}
+
+	return out, rows.Err()
+}
+
+func (tracker *HybridUsageTracker) usageRecords(from time.Time, to time.Time) ([]UsageRecord, error) {
+	return tracker.Buckets.usageRecords(from, to)
+}
+
+func (r UsageRecord) leaf() []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	_ = binary.Write(h, binary.BigEndian, r.Bucket.Unix())
+	h.Write([]byte(r.Validator))
+	return h.Sum(nil)
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleLevels returns every level of the tree, from the leaves to the root.
+func merkleLevels(records []UsageRecord) [][][]byte {
+	if len(records) == 0 {
+		empty := sha256.Sum256(nil)
+		return [][][]byte{{empty[:]}}
+	}
+
+	level := make([][]byte, len(records))
+	for i, r := range records {
+		level[i] = r.leaf()
+	}
+	levels := [][][]byte{level}
+
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		levels = append(levels, next)
+		level = next
+	}
+
+	return levels
+}
+
+// UsageCommitment is the Merkle root over the usage records of [From, To).
+type UsageCommitment struct {
+	From    time.Time     `json:"from"`
+	To      time.Time     `json:"to"`
+	Records int           `json:"records"`
+	Root    hexutil.Bytes `json:"root"`
+}
+
+// UsageProofStep is a sibling on the path from a leaf to the root.
+type UsageProofStep struct {
+	Hash hexutil.Bytes `json:"hash"`
+	// Whether the sibling is the left operand
+	Left bool `json:"left"`
+}
+
+// UsageInclusionProof proves that a record is part of a UsageCommitment.
+type UsageInclusionProof struct {
+	Validator string           `json:"validator"`
+	Bucket    time.Time        `json:"bucket"`
+	Leaf      int              `json:"leaf"`
+	Steps     []UsageProofStep `json:"steps"`
+}
+
+// Verify checks the proof against a commitment root.
+func (p *UsageInclusionProof) Verify(root []byte) bool {
+	hash := UsageRecord{Bucket: p.Bucket, Validator: ValidatorID(p.Validator)}.leaf()
+	for _, step := range p.Steps {
+		if step.Left {
+			hash = merkleNode(step.Hash, hash)
+		} else {
+			hash = merkleNode(hash, step.Hash)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
+
+// CommitUsage computes the commitment over the records of buckets starting in [from, to).
+func CommitUsage(tracker UsageTracker, from time.Time, to time.Time) (*UsageCommitment, error) {
+	if err := requireCapability(tracker, "usage commitments", UsageCapabilityCommitments); err != nil {
+		return nil, err
+	}
+	committer := tracker.(usageCommitter)
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+
+	records, err := committer.usageRecords(from, to)
+	if err != nil {
+		return nil, err
+	}
+	levels := merkleLevels(records)
+
+	return &UsageCommitment{
+		From:    from,
+		To:      to,
+		Records: len(records),
+		Root:    levels[len(levels)-1][0],
+	}, nil
+}
+
+// ProveUsage returns inclusion proofs for every record of a validator in [from, to),
+// along with the commitment they verify against.
+func ProveUsage(tracker UsageTracker, from time.Time, to time.Time, validator string) (*UsageCommitment, []UsageInclusionProof, error) {
+	if err := requireCapability(tracker, "usage commitments", UsageCapabilityCommitments); err != nil {
+		return nil, nil, err
+	}
+	committer := tracker.(usageCommitter)
+	if err := validateRange(from, to); err != nil {
+		return nil, nil, err
+	}
+
+	records, err := committer.usageRecords(from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	levels := merkleLevels(records)
+
+	proofs := []UsageInclusionProof{}
+	for leaf, r := range records {
+		if r.Validator.String() != validator {
+			continue
+		}
+
+		proof := UsageInclusionProof{
+			Validator: validator,
+			Bucket:    r.Bucket,
+			Leaf:      leaf,
+			Steps:     []UsageProofStep{},
+		}
+		index := leaf
+		for _, level := range levels[:len(levels)-1] {
+			sibling := index ^ 1
+			if sibling < len(level) {
+				proof.Steps = append(proof.Steps, UsageProofStep{
+					Hash: level[sibling],
+					Left: sibling < index,
+				})
+			}
+			index /= 2
+		}
+		proofs = append(proofs, proof)
+	}
+
+	if len(proofs) == 0 {
+		return nil, nil, ErrNoUsageRecord
+	}
+
+	return &UsageCommitment{
+		From:    from,
+		To:      to,
+		Records: len(records),
+		Root:    levels[len(levels)-1][0],
+	}, proofs, nil
+}
+
+// UsageCommitmentPublisher commits to the usage of each period once it's over,
+// logs the root and optionally posts the commitment to a webhook.
+type UsageCommitmentPublisher struct {
+	Tracker    UsageTracker
+	Period     time.Duration
+	WebhookURL string
+	Logger     *zap.Logger
+	Client     *http.Client
+
+	wallClock
+}
+
+// Run publishes a commitment at the end of every period until ctx is done.
+func (p *UsageCommitmentPublisher) Run(ctx context.Context) {
+	for {
+		now := p.clock()
+		end := now.Truncate(p.Period).Add(p.Period)
+
+		timer := time.NewTimer(end.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := p.publish(ctx, end.Add(-p.Period), end); err != nil {
+			p.Logger.Warn("Failed to publish usage commitment", zap.Error(err))
+		}
+	}
+}
+
+func (p *UsageCommitmentPublisher) publish(ctx context.Context, from time.Time, to time.Time) error {
+	commitment, err := CommitUsage(p.Tracker, from, to)
+	if err != nil {
+		return err
+	}
+
+	p.Logger.Info("Usage commitment",
+		zap.Time("from", commitment.From),
+		zap.Time("to", commitment.To),
+		zap.Int("records", commitment.Records),
+		zap.Stringer("root", commitment.Root))
+
+	if p.WebhookURL == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(commitment)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post usage commitment: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("usage commitment webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func setupMerkleTestDatabase(t *testing.T) (*SQLiteUsageTracker, time.Time) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	sqlite := tracker.(*SQLiteUsageTracker)
+	records := map[time.Duration][]string{
+		0:                {"1", "2"},
+		5 * time.Minute:  {"1"},
+		10 * time.Minute: {"1", "3"},
+		// Outside of the committed hour
+		time.Hour: {"1"},
+	}
+	for offset, validators := range records {
+		if err := sqlite.recordUsage(start.Add(offset).Unix(), validators); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return sqlite, start
+}
+
+func TestUsageCommitment(t *testing.T) {
+	tracker, start := setupMerkleTestDatabase(t)
+	end := start.Add(time.Hour)
+
+	commitment, err := CommitUsage(tracker, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commitment.Records != 5 {
+		t.Fatalf("Expected 5 records in [start, end), got %d", commitment.Records)
+	}
+
+	// Recomputing yields the same root
+	again, err := CommitUsage(tracker, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(commitment.Root, again.Root) {
+		t.Fatal("Expected commitments to be deterministic")
+	}
+
+	// Every record of every validator verifies against the root
+	for validator, count := range map[string]int{"1": 3, "2": 1, "3": 1} {
+		proven, proofs, err := ProveUsage(tracker, start, end, validator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(proven.Root, commitment.Root) {
+			t.Fatal("Expected proofs to come with the same commitment")
+		}
+		if len(proofs) != count {
+			t.Fatalf("Expected %d proofs for validator %s, got %d", count, validator, len(proofs))
+		}
+		for _, proof := range proofs {
+			if !proof.Verify(commitment.Root) {
+				t.Fatalf("Proof for validator %s at %v doesn't verify", validator, proof.Bucket)
+			}
+
+			tampered := proof
+			tampered.Bucket = proof.Bucket.Add(5 * time.Minute)
+			if tampered.Verify(commitment.Root) {
+				t.Fatal("Expected a tampered proof not to verify")
+			}
+		}
+	}
+
+	if _, _, err := ProveUsage(tracker, start, end, "4"); !errors.Is(err, ErrNoUsageRecord) {
+		t.Fatal("Expected ErrNoUsageRecord, got", err)
+	}
+
+	// New usage changes the root
+	if err := tracker.recordUsage(start.Add(15*time.Minute).Unix(), []string{"4"}); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := CommitUsage(tracker, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(changed.Root, commitment.Root) {
+		t.Fatal("Expected the root to change")
+	}
+}
+
+func TestUsageCommitmentEmpty(t *testing.T) {
+	tracker, start := setupMerkleTestDatabase(t)
+
+	commitment, err := CommitUsage(tracker, start.Add(-time.Hour), start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := sha256.Sum256(nil)
+	if commitment.Records != 0 || !bytes.Equal(commitment.Root, empty[:]) {
+		t.Fatalf("Unexpected empty commitment %+v", commitment)
+	}
+}
+
+func TestUsageCommitmentPublisher(t *testing.T) {
+	tracker, start := setupMerkleTestDatabase(t)
+
+	received := make(chan UsageCommitment, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var commitment UsageCommitment
+		if err := json.NewDecoder(r.Body).Decode(&commitment); err != nil {
+			t.Error(err)
+		}
+		received <- commitment
+	}))
+	defer server.Close()
+
+	publisher := &UsageCommitmentPublisher{
+		Tracker:    tracker,
+		Period:     time.Hour,
+		WebhookURL: server.URL,
+		Logger:     zaptest.NewLogger(t),
+	}
+	if err := publisher.publish(context.Background(), start, start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	commitment := <-received
+	expected, err := CommitUsage(tracker, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commitment.Records != expected.Records || !bytes.Equal(commitment.Root, expected.Root) {
+		t.Fatalf("Expected %+v, got %+v", expected, commitment)
+	}
+}
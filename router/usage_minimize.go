@@ -0,0 +1,230 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultMinimizedRetention is the usage retention of data minimization mode when
+// none is configured.
+const DefaultMinimizedRetention = 7 * 24 * time.Hour
+
+// DataMinimization restricts what the router persists for privacy-sensitive deployments.
+// It's enforced in ProxyRouter.recordUsage, the only place usage enters storage:
+//   - validator indices are replaced by keyed pseudonyms before they're recorded
+//   - node addresses are never attributed to validators, which also disables exports
+//   - usage is pruned after ProxyRouter.UsageRetention, DefaultMinimizedRetention by default
+type DataMinimization struct {
+	// Secret the pseudonyms are derived from. Keep it stable, as changing it
+	// splits the history of every validator.
+	PseudonymKey []byte
+}
+
+// Pseudonym returns the identifier stored in place of a validator index.
+// Admins holding the key can compute it to look a validator up.
+func (m *DataMinimization) Pseudonym(index string) string {
+	mac := hmac.New(sha256.New, m.PseudonymKey)
+	mac.Write([]byte(index))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (m *DataMinimization) pseudonymize(indexes []string) []string {
+	out := make([]string, len(indexes))
+	for i, index := range indexes {
+		out[i] = m.Pseudonym(index)
+	}
+	return out
+}
+
+// usagePruner is implemented by stores which can delete data older than a cutoff.
+type usagePruner interface {
+	// pruneUsage deletes data last seen before cutoff and returns the number of rows deleted.
+	// The data of the validators in exempt is deleted before their own, earlier, cutoff instead.
+	pruneUsage(cutoff time.Time, exempt map[string]time.Time) (int64, error)
+}
+
+// pruneRows deletes the rows of table matching olderThan, a condition on the row's
+// time with a single parameter. arg converts a cutoff into that parameter.
+// Every table pruned this way has a validator_index column.
+func pruneRows(db *sql.DB, table string, olderThan string, arg func(time.Time) any, cutoff time.Time, exempt map[string]time.Time) (int64, error) {
+	if len(exempt) == 0 {
+		res, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", table, olderThan), arg(cutoff))
+		if err != nil {
+			return 0, err
+		}
+		return res.RowsAffected()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	params := make([]string, 0, len(exempt))
+	args := make([]any, 0, len(exempt)+1)
+	args = append(args, arg(cutoff))
+	for validator := range exempt {
+		params = append(params, "?")
+		args = append(args, validator)
+	}
+	res, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s AND validator_index NOT IN (%s)",
+		table, olderThan, strings.Join(params, ",")), args...)
+	if err != nil {
+		return 0, err
+	}
+	pruned, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	for validator, validatorCutoff := range exempt {
+		res, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s AND validator_index = ?", table, olderThan),
+			arg(validatorCutoff), validator)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		pruned += n
+	}
+
+	return pruned, tx.Commit()
+}
+
+func unixMilli(t time.Time) any {
+	return t.UnixMilli()
+}
+
+func (tracker *SQLiteUsageTracker) pruneUsage(cutoff time.Time, exempt map[string]time.Time) (int64, error) {
+	// Buckets are only pruned once they've ended
+	return pruneRows(tracker.Database, "validator_usage", "timestamp < datetime(?, 'unixepoch')",
+		func(t time.Time) any { return t.Add(-tracker.Precision).Unix() }, cutoff, exempt)
+}
+
+func (tracker *SQLiteSessionUsageTracker) pruneUsage(cutoff time.Time, exempt map[string]time.Time) (int64, error) {
+	return pruneRows(tracker.Database, "validator_sessions", "last_seen < ?", unixMilli, cutoff, exempt)
+}
+
+func (tracker *HybridUsageTracker) pruneUsage(cutoff time.Time, exempt map[string]time.Time) (int64, error) {
+	buckets, err := tracker.Buckets.pruneUsage(cutoff, exempt)
+	if err != nil {
+		return buckets, err
+	}
+	sessions, err := tracker.Sessions.pruneUsage(cutoff, exempt)
+	return buckets + sessions, err
+}
+
+func (store *AttributionStore) pruneUsage(cutoff time.Time, exempt map[string]time.Time) (int64, error) {
+	return pruneRows(store.Database, "validator_attribution", "last_seen < ?", unixMilli, cutoff, exempt)
+}
+
+// UsageRetentionJob periodically deletes usage older than Retention.
+//
+// The validators attributed to members of organizations with a longer retention
+// override are kept for that long instead. Overrides need Organizations and
+// Attribution, so they're unavailable in data minimization mode.
+type UsageRetentionJob struct {
+	Stores        []usagePruner
+	Retention     time.Duration
+	Organizations *OrganizationStore
+	Attribution   *AttributionStore
+	// How often to prune, defaults to hourly
+	Interval time.Duration
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// exemptions returns the cutoffs of validators whose organization overrides the retention.
+func (job *UsageRetentionJob) exemptions(now time.Time) (map[string]time.Time, error) {
+	if job.Organizations == nil || job.Attribution == nil {
+		return nil, nil
+	}
+
+	overrides, err := job.Organizations.retentionOverrides()
+	if err != nil {
+		return nil, err
+	}
+
+	exempt := make(map[string]time.Time)
+	for node, retention := range overrides {
+		if retention <= job.Retention {
+			continue
+		}
+		validators, err := job.Attribution.Validators(node)
+		if err != nil {
+			return nil, err
+		}
+		cutoff := now.Add(-retention)
+		for _, v := range validators {
+			if existing, ok := exempt[v.Validator]; !ok || cutoff.Before(existing) {
+				exempt[v.Validator] = cutoff
+			}
+		}
+	}
+
+	return exempt, nil
+}
+
+// Prune deletes everything older than the retention once.
+func (job *UsageRetentionJob) Prune() {
+	now := job.clock()
+	cutoff := now.Add(-job.Retention)
+
+	exempt, err := job.exemptions(now)
+	if err != nil {
+		// Pruning without the overrides could delete data that must be kept
+		job.Logger.Warn("Failed to load retention overrides, skipping pruning", zap.Error(err))
+		return
+	}
+
+	var pruned int64
+	for _, store := range job.Stores {
+		n, err := store.pruneUsage(cutoff, exempt)
+		if err != nil {
+			job.Logger.Warn("Failed to prune usage", zap.Time("cutoff", cutoff), zap.Error(err))
+			continue
+		}
+		pruned += n
+	}
+
+	if pruned > 0 {
+		job.Logger.Info("Pruned usage past retention",
+			zap.Time("cutoff", cutoff),
+			zap.Int64("rows", pruned))
+	}
+}
+
+// Run prunes immediately and then every Interval until ctx is done.
+func (job *UsageRetentionJob) Run(ctx context.Context) {
+	interval := job.Interval
+	if interval == 0 {
+		interval = time.Hour
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		job.Prune()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,154 @@
+//go:build ns
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestDataMinimizationPseudonym(t *testing.T) {
+	m := &DataMinimization{PseudonymKey: []byte("0123456789abcdef0123456789abcdef")}
+	other := &DataMinimization{PseudonymKey: []byte("fedcba9876543210fedcba9876543210")}
+
+	if m.Pseudonym("1") != m.Pseudonym("1") {
+		t.Fatal("Expected pseudonyms to be stable")
+	}
+	if m.Pseudonym("1") == m.Pseudonym("2") {
+		t.Fatal("Expected validators to have distinct pseudonyms")
+	}
+	if m.Pseudonym("1") == other.Pseudonym("1") {
+		t.Fatal("Expected pseudonyms to depend on the key")
+	}
+	if len(m.Pseudonym("1")) != 32 {
+		t.Fatalf("Unexpected pseudonym %s", m.Pseudonym("1"))
+	}
+}
+
+func TestRecordUsageMinimized(t *testing.T) {
+	exporter, _, start := setupExportTest(t)
+	tracker := exporter.Tracker.(*SQLiteUsageTracker)
+	tracker.now = func() time.Time { return start.Add(3 * time.Hour) }
+
+	m := &DataMinimization{PseudonymKey: []byte("0123456789abcdef0123456789abcdef")}
+	pr := &ProxyRouter{
+		Logger:           zaptest.NewLogger(t),
+		ut:               tracker,
+		DataMinimization: m,
+	}
+	node := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	pr.recordUsage(authInfo{nodeAddr: node}, prepareBeaconProposerKind, []string{"7"})
+
+	usage, err := tracker.ViewUsage(start.Add(3*time.Hour), start.Add(3*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || usage[m.Pseudonym("7")] != 5*time.Minute {
+		t.Fatalf("Expected only the pseudonym to be stored, got %v", usage)
+	}
+
+	// Nothing ties the pseudonym to the node
+	validators, err := exporter.Attribution.Validators(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(validators) != 0 {
+		t.Fatalf("Expected no attribution, got %+v", validators)
+	}
+}
+
+func TestUsageRetentionJob(t *testing.T) {
+	exporter, node, start := setupExportTest(t)
+	tracker := exporter.Tracker.(*SQLiteUsageTracker)
+
+	job := &UsageRetentionJob{
+		Stores:    []usagePruner{tracker, exporter.Attribution},
+		Retention: time.Hour,
+		Logger:    zaptest.NewLogger(t),
+		// Buckets at 00:00 and 00:05 have ended an hour ago, the one at 01:00 hasn't
+		wallClock: wallClock{now: func() time.Time { return start.Add(time.Hour + 30*time.Minute) }},
+	}
+	job.Prune()
+
+	usage, err := tracker.ViewUsage(start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] != 5*time.Minute {
+		t.Fatalf("Expected a single bucket to remain, got %v", usage["1"])
+	}
+
+	validators, err := exporter.Attribution.Validators(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(validators) != 0 {
+		t.Fatalf("Expected the attribution to be pruned, got %+v", validators)
+	}
+}
+
+func TestUsageRetentionOverride(t *testing.T) {
+	exporter, node, start := setupExportTest(t)
+	tracker := exporter.Tracker.(*SQLiteUsageTracker)
+	if err := tracker.recordUsage(start.Unix(), []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	orgs, err := NewOrganizationStore(zaptest.NewLogger(t), tracker.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := orgs.Put(&Organization{ID: "acme", Name: "Acme", RetentionDays: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := orgs.AddMember("acme", node); err != nil {
+		t.Fatal(err)
+	}
+
+	job := &UsageRetentionJob{
+		Stores:        []usagePruner{tracker, exporter.Attribution},
+		Retention:     time.Hour,
+		Organizations: orgs,
+		Attribution:   exporter.Attribution,
+		Logger:        zaptest.NewLogger(t),
+		wallClock:     wallClock{now: func() time.Time { return start.Add(time.Hour + 30*time.Minute) }},
+	}
+	job.Prune()
+
+	usage, err := tracker.ViewUsage(start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Validator 1 belongs to acme and is kept for a day, validator 2 isn't
+	if usage["1"] != 15*time.Minute {
+		t.Fatalf("Expected every bucket of validator 1 to remain, got %v", usage["1"])
+	}
+	if _, ok := usage["2"]; ok {
+		t.Fatalf("Expected validator 2 to be pruned, got %v", usage["2"])
+	}
+
+	validators, err := exporter.Attribution.Validators(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(validators) != 1 {
+		t.Fatalf("Expected the attribution to be kept, got %+v", validators)
+	}
+
+	// Without the override, everything older than the retention goes
+	if err := orgs.Put(&Organization{ID: "acme", Name: "Acme"}); err != nil {
+		t.Fatal(err)
+	}
+	job.Prune()
+
+	usage, err = tracker.ViewUsage(start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] != 5*time.Minute {
+		t.Fatalf("Expected a single bucket to remain, got %v", usage["1"])
+	}
+}
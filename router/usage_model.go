@@ -0,0 +1,217 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	rptypes "github.com/rocket-pool/rocketpool-go/types"
+	"go.uber.org/zap"
+)
+
+// ErrInvalidValidatorID is returned for identifiers which are neither a validator
+// index nor a pubkey.
+var ErrInvalidValidatorID = errors.New("invalid validator identifier")
+
+// ValidatorID identifies a validator in usage data. Usage is recorded under validator
+// indices, or under an alias or pubkey where it couldn't be linked to an index yet.
+type ValidatorID string
+
+func (id ValidatorID) String() string {
+	return string(id)
+}
+
+// IndexValidatorID returns the identifier of the validator with index.
+func IndexValidatorID(index uint64) ValidatorID {
+	return ValidatorID(strconv.FormatUint(index, 10))
+}
+
+// PubkeyValidatorID returns the identifier of the validator with pubkey, in 0x-prefixed
+// lower case hex. Usage is recorded under indices, see ProxyRouter.ValidatorIDOf to
+// look the index of a pubkey up.
+func PubkeyValidatorID(pubkey rptypes.ValidatorPubkey) ValidatorID {
+	return ValidatorID("0x" + pubkey.Hex())
+}
+
+// ParseValidatorPubkey parses a hex pubkey, with or without its 0x prefix.
+func ParseValidatorPubkey(s string) (rptypes.ValidatorPubkey, error) {
+	pubkey, err := rptypes.HexToValidatorPubkey(strings.TrimPrefix(strings.ToLower(s), "0x"))
+	if err != nil {
+		return rptypes.ValidatorPubkey{}, fmt.Errorf("%w %q", ErrInvalidValidatorID, s)
+	}
+	return pubkey, nil
+}
+
+// ParseValidatorID parses a decimal validator index or a pubkey, and returns it in
+// canonical form.
+func ParseValidatorID(s string) (ValidatorID, error) {
+	if index, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return IndexValidatorID(index), nil
+	}
+	pubkey, err := ParseValidatorPubkey(s)
+	if err != nil {
+		return "", err
+	}
+	return PubkeyValidatorID(pubkey), nil
+}
+
+// Pubkey returns the pubkey id is, if it's one.
+func (id ValidatorID) Pubkey() (rptypes.ValidatorPubkey, bool) {
+	if !strings.HasPrefix(string(id), "0x") {
+		return rptypes.ValidatorPubkey{}, false
+	}
+	pubkey, err := ParseValidatorPubkey(string(id))
+	return pubkey, err == nil
+}
+
+// UsageRecord is a single bucket a validator was active in.
+type UsageRecord struct {
+	Bucket    time.Time   `json:"bucket"`
+	Validator ValidatorID `json:"validator"`
+}
+
+// UsageSummary is the usage of every validator active in a range, as reported by
+// ViewUsage.
+type UsageSummary struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Usage of each validator, validators without usage are left out
+	Validators map[ValidatorID]time.Duration `json:"validators"`
+}
+
+// NewUsageSummary wraps usage, as returned by ViewUsage for [from, to].
+func NewUsageSummary(from time.Time, to time.Time, usage map[string]time.Duration) *UsageSummary {
+	summary := &UsageSummary{
+		From:       from,
+		To:         to,
+		Validators: make(map[ValidatorID]time.Duration, len(usage)),
+	}
+	for validator, d := range usage {
+		if d > 0 {
+			summary.Validators[ValidatorID(validator)] = d
+		}
+	}
+	return summary
+}
+
+// SummarizeUsage returns the usage of every validator in the buckets overlapping
+// [from, to]. Invalid ranges return a *RangeError.
+func SummarizeUsage(tracker UsageTracker, from time.Time, to time.Time) (*UsageSummary, error) {
+	usage, err := tracker.ViewUsage(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return NewUsageSummary(from, to, usage), nil
+}
+
+// Usage returns the usage of validator, 0 if it wasn't active.
+func (s *UsageSummary) Usage(validator ValidatorID) time.Duration {
+	return s.Validators[validator]
+}
+
+// Total returns the usage of every validator combined.
+func (s *UsageSummary) Total() time.Duration {
+	var total time.Duration
+	for _, d := range s.Validators {
+		total += d
+	}
+	return total
+}
+
+// ValidatorIDs returns the validators with usage, sorted.
+func (s *UsageSummary) ValidatorIDs() []ValidatorID {
+	out := make([]ValidatorID, 0, len(s.Validators))
+	for validator := range s.Validators {
+		out = append(out, validator)
+	}
+	slices.Sort(out)
+	return out
+}
+
+// Map returns the usage in the format of ViewUsage.
+func (s *UsageSummary) Map() map[string]time.Duration {
+	out := make(map[string]time.Duration, len(s.Validators))
+	for validator, d := range s.Validators {
+		out[string(validator)] = d
+	}
+	return out
+}
+
+// ListUsageRecords returns the records of buckets starting in [from, to), ordered by
+// bucket then validator. Trackers without the commitments capability return an
+// *UnsupportedError.
+func ListUsageRecords(tracker UsageTracker, from time.Time, to time.Time) ([]UsageRecord, error) {
+	if err := requireCapability(tracker, "listing usage records", UsageCapabilityCommitments); err != nil {
+		return nil, err
+	}
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+	return tracker.(usageCommitter).usageRecords(from, to)
+}
+
+// ListValidatorUsageRecords returns the records of validator in buckets starting in
+// [from, to], oldest first. Trackers without the record_listing capability return an
+// *UnsupportedError.
+func ListValidatorUsageRecords(tracker UsageTracker, validator ValidatorID, from time.Time, to time.Time) ([]UsageRecord, error) {
+	if err := requireCapability(tracker, "listing a validator's usage records", UsageCapabilityRecordListing); err != nil {
+		return nil, err
+	}
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+	return tracker.(usageRecordLister).validatorUsageRecords(string(validator), from, to)
+}
+
+// ValidatorIDOf returns the identifier usage of the validator with pubkey is recorded
+// under, its index. Without a consensus layer which can look indices up, or if the
+// pubkey isn't known on the beacon chain yet, it's the pubkey itself.
+func (pr *ProxyRouter) ValidatorIDOf(pubkey rptypes.ValidatorPubkey) (ValidatorID, error) {
+	indexer, ok := pr.CL.(validatorIndexer)
+	if !ok {
+		return PubkeyValidatorID(pubkey), nil
+	}
+	indices, err := indexer.GetValidatorIndices([]rptypes.ValidatorPubkey{pubkey})
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the index of validator %s: %w", pubkey.Hex(), err)
+	}
+	if index, ok := indices[pubkey]; ok {
+		return ValidatorID(index), nil
+	}
+	return PubkeyValidatorID(pubkey), nil
+}
+
+// LookupValidatorID is ValidatorIDOf for a validator index or pubkey, which is
+// validated with ParseValidatorID.
+func (pr *ProxyRouter) LookupValidatorID(validator string) (ValidatorID, error) {
+	id, err := ParseValidatorID(validator)
+	if err != nil {
+		return "", err
+	}
+	if pubkey, ok := id.Pubkey(); ok {
+		return pr.ValidatorIDOf(pubkey)
+	}
+	return id, nil
+}
+
+// validatorParam looks up validator, a request parameter, with LookupValidatorID.
+// It writes the error and returns false if it fails.
+func (pr *ProxyRouter) validatorParam(w http.ResponseWriter, validator string) (ValidatorID, bool) {
+	id, err := pr.LookupValidatorID(validator)
+	if errors.Is(err, ErrInvalidValidatorID) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	if err != nil {
+		pr.Logger.Error("Failed to look up validator", zap.Error(err))
+		http.Error(w, "failed to look up validator", http.StatusInternalServerError)
+		return "", false
+	}
+	return id, true
+}
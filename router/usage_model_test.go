@@ -0,0 +1,137 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/test"
+)
+
+func TestUsageSummary(t *testing.T) {
+	tracker, start := setupMerkleTestDatabase(t)
+
+	summary, err := SummarizeUsage(tracker, start, start.Add(10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := summary.Usage("1"); got != 15*time.Minute {
+		t.Fatalf("Expected 15m for validator 1, got %v", got)
+	}
+	if got := summary.Usage("4"); got != 0 {
+		t.Fatalf("Expected no usage for validator 4, got %v", got)
+	}
+	if got := summary.Total(); got != 25*time.Minute {
+		t.Fatalf("Expected 25m in total, got %v", got)
+	}
+	if got := summary.ValidatorIDs(); !slices.Equal(got, []ValidatorID{"1", "2", "3"}) {
+		t.Fatalf("Unexpected validators %v", got)
+	}
+
+	// The adapter round-trips through the ViewUsage format
+	usage, err := tracker.ViewUsage(start, start.Add(10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	back := summary.Map()
+	if len(back) != len(usage) {
+		t.Fatalf("Expected %v, got %v", usage, back)
+	}
+	for validator, d := range usage {
+		if back[validator] != d {
+			t.Fatalf("Expected %v, got %v", usage, back)
+		}
+	}
+
+	var rangeErr *RangeError
+	if _, err := SummarizeUsage(tracker, start, start.Add(-time.Minute)); !errors.As(err, &rangeErr) {
+		t.Fatalf("Expected a range error, got %v", err)
+	}
+}
+
+func TestListUsageRecords(t *testing.T) {
+	tracker, start := setupMerkleTestDatabase(t)
+
+	records, err := ListUsageRecords(tracker, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 || records[0] != (UsageRecord{Bucket: start, Validator: "1"}) {
+		t.Fatalf("Unexpected records %+v", records)
+	}
+
+	records, err = ListValidatorUsageRecords(tracker, "3", start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0] != (UsageRecord{Bucket: start.Add(10 * time.Minute), Validator: "3"}) {
+		t.Fatalf("Unexpected records %+v", records)
+	}
+
+	sessions, _ := setupSessionTestDatabase(t, 10*time.Minute)
+	if _, err := ListUsageRecords(sessions, start, start.Add(time.Hour)); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("Expected an unsupported error, got %v", err)
+	}
+}
+
+func TestParseValidatorID(t *testing.T) {
+	pubkey := strings.Repeat("ab", 48)
+	tests := []struct {
+		in  string
+		out ValidatorID
+	}{
+		{"1", "1"},
+		{"007", "7"},
+		{pubkey, ValidatorID("0x" + pubkey)},
+		{"0x" + strings.ToUpper(pubkey), ValidatorID("0x" + pubkey)},
+		{"", ""},
+		{"-1", ""},
+		{"alpha", ""},
+		{"0x" + pubkey[2:], ""},
+	}
+
+	for _, tt := range tests {
+		id, err := ParseValidatorID(tt.in)
+		if tt.out == "" {
+			if !errors.Is(err, ErrInvalidValidatorID) {
+				t.Errorf("Expected %q to be invalid, got %q, %v", tt.in, id, err)
+			}
+			continue
+		}
+		if err != nil || id != tt.out {
+			t.Errorf("Expected %q to parse as %q, got %q, %v", tt.in, tt.out, id, err)
+		}
+	}
+
+	if _, ok := ValidatorID("1").Pubkey(); ok {
+		t.Fatal("Expected an index not to be a pubkey")
+	}
+	parsed, _ := ParseValidatorPubkey(pubkey)
+	if got, ok := PubkeyValidatorID(parsed).Pubkey(); !ok || got != parsed {
+		t.Fatalf("Expected the pubkey to round-trip, got %v", got)
+	}
+}
+
+func TestLookupValidatorID(t *testing.T) {
+	cl := test.NewMockConsensusLayer(1, t.Name())
+	pr := &ProxyRouter{CL: cl}
+	for pubkey, index := range cl.Indices {
+		id, err := pr.LookupValidatorID("0x" + pubkey.Hex())
+		if err != nil || id != ValidatorID(index) {
+			t.Fatalf("Expected the pubkey to be looked up as %s, got %q, %v", index, id, err)
+		}
+	}
+
+	// Unknown pubkeys are left as is
+	unknown := "0x" + strings.Repeat("cd", 48)
+	if id, err := pr.LookupValidatorID(unknown); err != nil || id != ValidatorID(unknown) {
+		t.Fatalf("Expected %s, got %q, %v", unknown, id, err)
+	}
+	if _, err := pr.LookupValidatorID("alpha"); !errors.Is(err, ErrInvalidValidatorID) {
+		t.Fatalf("Expected an invalid identifier, got %v", err)
+	}
+}
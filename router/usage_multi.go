@@ -0,0 +1,202 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Ranges a single request to /usage/ranges may ask for
+const maxUsageRanges = 100
+
+// TimeRange is a range usage is viewed over, with the bounds of ViewUsage: the buckets
+// overlapping [From, To].
+type TimeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// RangeUsage is the usage of every validator over a range.
+type RangeUsage struct {
+	TimeRange
+	Usage map[string]time.Duration `json:"usage"`
+}
+
+// usageMultiViewer is implemented by trackers viewing usage over several ranges in a
+// single query.
+type usageMultiViewer interface {
+	ViewUsageMulti(ranges []TimeRange) ([]RangeUsage, error)
+}
+
+// ViewUsageMulti returns the usage over each of ranges, in order, e.g. for every month
+// billed. Ranges may overlap. Trackers which can't view them in a single query are
+// asked for each range in turn.
+func ViewUsageMulti(tracker UsageTracker, ranges []TimeRange) ([]RangeUsage, error) {
+	if viewer, ok := tracker.(usageMultiViewer); ok {
+		return viewer.ViewUsageMulti(ranges)
+	}
+	return viewUsageEach(tracker, ranges)
+}
+
+func viewUsageEach(tracker UsageTracker, ranges []TimeRange) ([]RangeUsage, error) {
+	out := make([]RangeUsage, 0, len(ranges))
+	for _, r := range ranges {
+		usage, err := tracker.ViewUsage(r.From, r.To)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, RangeUsage{TimeRange: r, Usage: usage})
+	}
+	return out, nil
+}
+
+// viewUsageMultiQuery counts the buckets of each validator in each of a JSON array of
+// [from, to] bucket timestamps. The ranges are joined first, so each one is an index
+// search of validator_usage. Buckets recorded by several tenants count once.
+const viewUsageMultiQuery = `
+	WITH ranges (i, from_ts, to_ts) AS (
+		SELECT key, datetime(json_extract(value, '$[0]'), 'unixepoch'), datetime(json_extract(value, '$[1]'), 'unixepoch')
+		FROM json_each(?)
+	)
+	SELECT ranges.i, validator_usage.validator_index, COUNT(DISTINCT validator_usage.timestamp)
+	FROM ranges CROSS JOIN validator_usage
+	WHERE validator_usage.timestamp >= ranges.from_ts AND validator_usage.timestamp <= ranges.to_ts
+	GROUP BY ranges.i, validator_usage.validator_index
+	`
+
+func (tracker *SQLiteUsageTracker) ViewUsageMulti(ranges []TimeRange) ([]RangeUsage, error) {
+	if err := ValidatePrecision(tracker.Precision); err != nil {
+		return nil, err
+	}
+	bounds := make([][2]int64, 0, len(ranges))
+	for _, r := range ranges {
+		if err := validateRange(r.From, r.To); err != nil {
+			return nil, err
+		}
+		bounds = append(bounds, [2]int64{r.From.Truncate(tracker.Precision).Unix(), r.To.Truncate(tracker.Precision).Unix()})
+	}
+	if tracker.Occupancy {
+		// Occupancy weighs buckets, which a count can't
+		return viewUsageEach(tracker, ranges)
+	}
+	if err := tracker.Faults.read(); err != nil {
+		return nil, err
+	}
+
+	out := make([]RangeUsage, len(ranges))
+	for i, r := range ranges {
+		out[i] = RangeUsage{TimeRange: r, Usage: make(map[string]time.Duration)}
+	}
+	if len(ranges) == 0 {
+		return out, nil
+	}
+
+	list, err := json.Marshal(bounds)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tracker.readDB().Query(viewUsageMultiQuery, string(list))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage data: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var i int
+		var validator string
+		var count int
+		if err := rows.Scan(&i, &validator, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan usage data: %w", err)
+		}
+		out[i].Usage[validator] = time.Duration(count) * tracker.Precision
+	}
+	return out, rows.Err()
+}
+
+func (tracker *HybridUsageTracker) ViewUsageMulti(ranges []TimeRange) ([]RangeUsage, error) {
+	return tracker.Buckets.ViewUsageMulti(ranges)
+}
+
+// parseUsageRanges reads the range query parameters, RFC3339 from and to separated by
+// a slash, e.g. 2025-01-01T00:00:00Z/2025-01-31T23:59:59Z.
+func parseUsageRanges(r *http.Request) ([]TimeRange, error) {
+	values := r.URL.Query()["range"]
+	if len(values) == 0 {
+		return nil, errors.New("missing range")
+	}
+	if len(values) > maxUsageRanges {
+		return nil, fmt.Errorf("too many ranges, at most %d are allowed", maxUsageRanges)
+	}
+
+	out := make([]TimeRange, 0, len(values))
+	for _, value := range values {
+		fromValue, toValue, ok := strings.Cut(value, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid range %q, expected from/to", value)
+		}
+		from, err := time.Parse(time.RFC3339, fromValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from of range %q: %w", value, err)
+		}
+		to, err := time.Parse(time.RFC3339, toValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to of range %q: %w", value, err)
+		}
+		out = append(out, TimeRange{From: from, To: to})
+	}
+	return out, nil
+}
+
+// usageRangeResponse is a RangeUsage with usage in seconds, like serveUsage's.
+type usageRangeResponse struct {
+	TimeRange
+	Usage map[string]float64 `json:"usage"`
+}
+
+// serveUsageRanges returns the usage of every validator over each of the range
+// parameters, in order, with the usage of aliases merged into their validators unless
+// aliases=false. It's served in a single query where serveUsage would need one per
+// range.
+func (pr *ProxyRouter) serveUsageRanges(w http.ResponseWriter, r *http.Request) {
+	ranges, err := parseUsageRanges(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	usages, err := ViewUsageMulti(pr.usage(), ranges)
+	if err == nil && pr.alias != nil && r.URL.Query().Get("aliases") != "false" {
+		for i := range usages {
+			if usages[i].Usage, err = pr.alias.LinkUsage(usages[i].Usage); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to view usage", zap.Error(err))
+		http.Error(w, "failed to view usage", http.StatusInternalServerError)
+		return
+	}
+
+	out := make([]usageRangeResponse, 0, len(usages))
+	for _, usage := range usages {
+		seconds := make(map[string]float64, len(usage.Usage))
+		for validator, d := range usage.Usage {
+			seconds[validator] = d.Seconds()
+		}
+		out = append(out, usageRangeResponse{TimeRange: usage.TimeRange, Usage: seconds})
+	}
+	pr.writeUsageJSON(w, r, out)
+}
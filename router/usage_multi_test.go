@@ -0,0 +1,149 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestViewUsageMulti(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	tracker.(*SQLiteUsageTracker).now = func() time.Time { return now }
+	for i, indexes := range [][]string{{"1", "2"}, {"1"}, {"2", "3"}, {"1", "3"}} {
+		now = start.Add(time.Duration(i) * time.Hour)
+		if err := tracker.RecordUsage(indexes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ranges := []TimeRange{
+		{From: start, To: start.Add(time.Hour)},
+		// Overlapping the first
+		{From: start.Add(time.Hour), To: start.Add(3 * time.Hour)},
+		// Empty
+		{From: start.Add(10 * time.Hour), To: start.Add(11 * time.Hour)},
+		{From: start, To: start.Add(24 * time.Hour)},
+	}
+	usages, err := ViewUsageMulti(tracker, ranges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != len(ranges) {
+		t.Fatalf("Expected %d ranges, got %d", len(ranges), len(usages))
+	}
+	for i, r := range ranges {
+		expected, err := tracker.ViewUsage(r.From, r.To)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usages[i].TimeRange != r || !maps.Equal(usages[i].Usage, expected) {
+			t.Fatalf("Expected %v over range %d, got %v", expected, i, usages[i])
+		}
+	}
+	if usages[3].Usage["1"] != 15*time.Minute || len(usages[2].Usage) != 0 {
+		t.Fatalf("Unexpected usage %v", usages)
+	}
+
+	// Ranges are validated like ViewUsage's
+	if _, err := ViewUsageMulti(tracker, []TimeRange{ranges[0], {From: start.Add(time.Hour), To: start}}); err == nil {
+		t.Fatal("Expected an error for an inverted range")
+	}
+}
+
+func TestServeUsageRanges(t *testing.T) {
+	pr, cleanup := setupBulkTest(t)
+	defer cleanup()
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	pr.ut.(*SQLiteUsageTracker).now = func() time.Time { return now }
+	for _, month := range []int{0, 1, 1} {
+		now = start.AddDate(0, month, 0).Add(time.Duration(month) * time.Hour)
+		if err := pr.ut.RecordUsage([]string{"1", "alpha"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := pr.AdminHandler()
+
+	serve := func(query url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/ranges?"+query.Encode(), nil))
+		return rec
+	}
+	for _, query := range []url.Values{
+		{},
+		{"range": {"2025-01-01T00:00:00Z"}},
+		{"range": {"2025-01-01T00:00:00Z/yesterday"}},
+		{"range": {"2025-02-01T00:00:00Z/2025-01-01T00:00:00Z"}},
+	} {
+		if rec := serve(query); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %d for %v, got %d", http.StatusBadRequest, query, rec.Code)
+		}
+	}
+
+	query := url.Values{"range": {
+		"2025-01-01T00:00:00Z/2025-01-31T23:59:59Z",
+		"2025-02-01T00:00:00Z/2025-02-28T23:59:59Z",
+	}}
+	rec := serve(query)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var usages []struct {
+		From  time.Time          `json:"from"`
+		To    time.Time          `json:"to"`
+		Usage map[string]float64 `json:"usage"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &usages); err != nil {
+		t.Fatal(err)
+	}
+	// The usage of the alias is merged into validator 1's
+	if len(usages) != 2 || !usages[1].From.Equal(start.AddDate(0, 1, 0)) || len(usages[0].Usage) != 1 || usages[0].Usage["1"] != 600 || usages[1].Usage["1"] != 600 {
+		t.Fatalf("Unexpected usage %+v", usages)
+	}
+
+	query.Set("aliases", "false")
+	usages = nil
+	if err := json.Unmarshal(serve(query).Body.Bytes(), &usages); err != nil {
+		t.Fatal(err)
+	}
+	if len(usages[0].Usage) != 2 || usages[0].Usage["alpha"] != 300 {
+		t.Fatalf("Expected unlinked usage, got %+v", usages)
+	}
+}
+
+func TestViewUsageMultiFallback(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Trackers without a single query are asked for each range
+	now := time.Now()
+	ranges := []TimeRange{{From: now.Add(-time.Hour), To: now}, {From: now.Add(-2 * time.Hour), To: now.Add(-time.Hour)}}
+	usages, err := ViewUsageMulti(struct{ UsageTracker }{tracker}, ranges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 2 || usages[0].Usage["1"] != 5*time.Minute || len(usages[1].Usage) != 0 {
+		t.Fatalf("Unexpected usage %v", usages)
+	}
+}
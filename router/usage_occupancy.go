@@ -0,0 +1,174 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// occupancyMinimum is the credit of a bucket with a single activity, one slot.
+//
+// With UsageTrackerOptions.Occupancy, a bucket is credited with the time between the
+// first and last activity of the validator in it, plus occupancyMinimum, instead of the
+// full precision. A validator making a single request per bucket is credited a slot
+// rather than the whole bucket, while one active throughout the bucket is still
+// credited all of it.
+//
+// Buckets recorded without offsets, before occupancy was enabled or by backfills, are
+// credited in full. Only ViewUsage and the reports built on it are weighted: reports
+// built on individual records, such as daily usage, commitments and tenant usage, keep
+// counting buckets.
+const occupancyMinimum = 12 * time.Second
+
+// migrateUsageOccupancy adds the activity offset columns to usage tables created before
+// they existed. Existing records have no offsets and are credited in full.
+func migrateUsageOccupancy(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('validator_usage')")
+	if err != nil {
+		return fmt.Errorf("failed to read the usage schema: %w", err)
+	}
+	defer rows.Close()
+
+	migrated := false
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return err
+		}
+		if column == "first_offset_ms" {
+			migrated = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if migrated {
+		return nil
+	}
+	// Offsets are milliseconds since the start of the bucket
+	for _, column := range []string{"first_offset_ms", "last_offset_ms"} {
+		if _, err := db.Exec("ALTER TABLE validator_usage ADD COLUMN " + column + " INTEGER"); err != nil {
+			return fmt.Errorf("failed to add the %s column: %w", column, err)
+		}
+	}
+	return nil
+}
+
+func (tracker *SQLiteUsageTracker) prepareOccupancyStatements() error {
+	// A bucket recorded without offsets keeps none, since min and max of NULL are NULL
+	var err error
+	tracker.occupyUsageStmt, err = tracker.Database.Prepare(`
+	INSERT INTO validator_usage (timestamp, validator_index, tenant, first_offset_ms, last_offset_ms)
+	VALUES (datetime(?1, 'unixepoch'), ?2, ?3, ?4, ?4)
+	ON CONFLICT (timestamp, validator_index, tenant) DO UPDATE SET
+		first_offset_ms = min(first_offset_ms, excluded.first_offset_ms),
+		last_offset_ms = max(last_offset_ms, excluded.last_offset_ms)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare occupancy statement: %w", err)
+	}
+
+	tracker.viewOccupancyStmt, err = tracker.readDB().Prepare(fmt.Sprintf(viewOccupancyQuery, ""))
+	if err != nil {
+		return fmt.Errorf("failed to prepare occupancy view statement: %w", err)
+	}
+
+	return nil
+}
+
+// viewOccupancyQuery weighs the buckets of each validator by occupancy, with an
+// optional condition on the records. Records of several tenants in a bucket are merged
+// first, and a bucket is credited in full if any of them has no offsets.
+const viewOccupancyQuery = `
+	SELECT validator_index, COUNT(*), SUM(
+		CASE WHEN first_offset_ms IS NULL OR last_offset_ms IS NULL THEN ?1
+		ELSE min(?1, last_offset_ms - first_offset_ms + ?2) END
+	)
+	FROM (
+		SELECT validator_index,
+			CASE WHEN COUNT(first_offset_ms) < COUNT(*) THEN NULL ELSE min(first_offset_ms) END AS first_offset_ms,
+			CASE WHEN COUNT(last_offset_ms) < COUNT(*) THEN NULL ELSE max(last_offset_ms) END AS last_offset_ms
+		FROM validator_usage
+		WHERE timestamp >= datetime(?3, 'unixepoch') AND timestamp <= datetime(?4, 'unixepoch') %s
+		GROUP BY timestamp, validator_index
+	)
+	GROUP BY validator_index
+	`
+
+// recordOccupancy records usage of tenant at offset into the bucket starting at
+// timestampUnix, extending the activity already recorded in the bucket.
+func (tracker *SQLiteUsageTracker) recordOccupancy(timestampUnix int64, offset time.Duration, tenant string, indexes []string) error {
+	if tracker.closed.Load() {
+		return ErrTrackerClosed
+	}
+	tx, err := tracker.Database.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt := tx.Stmt(tracker.occupyUsageStmt)
+	defer stmt.Close()
+
+	for _, index := range indexes {
+		if _, err := stmt.Exec(timestampUnix, index, tenant, offset.Milliseconds()); err != nil {
+			tracker.Logger.Error("Failed to store index usage",
+				zap.String("index", index),
+				zap.Int64("timestamp_unix", timestampUnix),
+				zap.Error(err))
+			return fmt.Errorf("failed to insert usage for validator %s at %d: %w", index, timestampUnix, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// viewOccupancy is ViewUsage with buckets weighted by occupancy.
+func (tracker *SQLiteUsageTracker) viewOccupancy(fromUnix int64, toUnix int64) (map[string]time.Duration, error) {
+	credit := tracker.Precision.Milliseconds()
+	rows, err := tracker.viewOccupancyStmt.Query(credit, occupancyMinimum.Milliseconds(), fromUnix, toUnix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage data: %w", err)
+	}
+	return tracker.scanOccupancy(rows)
+}
+
+// viewTenantOccupancy is ViewTenantUsage with buckets weighted by occupancy. Only the
+// records of tenant are merged.
+func (tracker *SQLiteUsageTracker) viewTenantOccupancy(tenant string, fromUnix int64, toUnix int64) (map[string]time.Duration, error) {
+	credit := tracker.Precision.Milliseconds()
+	rows, err := tracker.readDB().Query(fmt.Sprintf(viewOccupancyQuery, "AND tenant = ?5"),
+		credit, occupancyMinimum.Milliseconds(), fromUnix, toUnix, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tenant usage: %w", err)
+	}
+	return tracker.scanOccupancy(rows)
+}
+
+func (tracker *SQLiteUsageTracker) scanOccupancy(rows *sql.Rows) (map[string]time.Duration, error) {
+	defer rows.Close()
+
+	result := make(map[string]time.Duration)
+	for rows.Next() {
+		var validator string
+		var count int
+		var ms int64
+		if err := rows.Scan(&validator, &count, &ms); err != nil {
+			return nil, fmt.Errorf("failed to scan usage data: %w", err)
+		}
+		result[validator] = time.Duration(ms) * time.Millisecond
+
+		tracker.Logger.Debug("Found usage record",
+			zap.String("validator", validator),
+			zap.Int("count", count),
+			zap.Duration("total_duration", result[validator]))
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,98 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestUsageOccupancy(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:occupancy.db?mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	newTracker := func(occupancy bool) *SQLiteUsageTracker {
+		tracker := &SQLiteUsageTracker{
+			Database:  db,
+			Logger:    zaptest.NewLogger(t),
+			Precision: 5 * time.Minute,
+			Occupancy: occupancy,
+			wallClock: wallClock{now: func() time.Time { return now }},
+		}
+		if err := tracker.initSchema(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(tracker.closeStatements)
+		return tracker
+	}
+	record := func(tracker *SQLiteUsageTracker, offset time.Duration, indexes ...string) {
+		now = start.Add(offset)
+		if err := tracker.RecordUsage(indexes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Recorded before occupancy was enabled
+	buckets := newTracker(false)
+	record(buckets, 30*time.Second, "4")
+
+	tracker := newTracker(true)
+	record(tracker, 0, "3")
+	record(tracker, time.Minute, "1")
+	record(tracker, 2*time.Minute, "2")
+	record(tracker, 3*time.Minute, "1")
+	record(tracker, 4*time.Minute, "4")
+	record(tracker, 4*time.Minute+48*time.Second, "3")
+	// Next bucket
+	record(tracker, 6*time.Minute, "2")
+	if err := tracker.RecordUsageAt(start.Add(10*time.Minute), []string{"5"}); err != nil {
+		t.Fatal(err)
+	}
+	// Live usage written late keeps its offset, unlike backfills
+	if err := tracker.recordUsageLate(start.Add(10*time.Minute), []string{"6"}); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := tracker.ViewUsage(start, start.Add(10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]time.Duration{
+		// From the first to the last activity, plus a slot
+		"1": 2*time.Minute + occupancyMinimum,
+		// A slot in each bucket
+		"2": 2 * occupancyMinimum,
+		// Active throughout the bucket
+		"3": 5 * time.Minute,
+		// Buckets without offsets count in full
+		"4": 5 * time.Minute,
+		"5": 5 * time.Minute,
+		"6": occupancyMinimum,
+	}
+	if len(usage) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, usage)
+	}
+	for validator, d := range expected {
+		if usage[validator] != d {
+			t.Fatalf("Expected %v for validator %s, got %v", d, validator, usage[validator])
+		}
+	}
+
+	// Without occupancy the same records count buckets
+	usage, err = buckets.ViewUsage(start, start.Add(10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] != 5*time.Minute || usage["2"] != 10*time.Minute {
+		t.Fatalf("Expected bucket counts, got %v", usage)
+	}
+}
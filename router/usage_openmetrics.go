@@ -0,0 +1,80 @@
+//go:build ns
+
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Width of the ranges of records read at once by WriteUsageOpenMetrics
+const openMetricsChunk = 24 * time.Hour
+
+// WriteUsageOpenMetrics writes the usage in the buckets starting in [from, to) as an
+// OpenMetrics file with timestamped samples, which promtool turns into TSDB blocks
+// with "promtool tsdb create-blocks-from openmetrics". Dashboards can then show usage
+// from before it was scraped.
+//
+// Two families are written, prefixed with namespace:
+//   - usage_active_validators, a gauge of the validators active in each bucket
+//   - usage_validator_seconds, a counter of the usage credited since from
+//
+// Every bucket of the range has a sample, buckets without usage count 0. Trackers
+// without the buckets capability return an *UnsupportedError.
+func WriteUsageOpenMetrics(w io.Writer, tracker UsageTracker, namespace string, from time.Time, to time.Time) error {
+	if err := requireCapability(tracker, "OpenMetrics replays", UsageCapabilityBuckets); err != nil {
+		return err
+	}
+	if err := validateRange(from, to); err != nil {
+		return err
+	}
+	buckets := tracker.(usageBuckets)
+	precision := buckets.bucketPrecision()
+
+	// A family's samples must be contiguous, so the counts are gathered before either
+	// family is written
+	first := from.Truncate(precision)
+	if first.Before(from) {
+		first = first.Add(precision)
+	}
+	counts := make([]int64, 0, int(to.Sub(first)/precision)+1)
+	for bucket := first; bucket.Before(to); bucket = bucket.Add(precision) {
+		counts = append(counts, 0)
+	}
+	for start := first; start.Before(to); start = start.Add(openMetricsChunk) {
+		end := start.Add(openMetricsChunk)
+		if end.After(to) {
+			end = to
+		}
+		records, err := buckets.usageRecords(start, end)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			counts[record.Bucket.Sub(first)/precision]++
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	gauge := namespace + "_usage_active_validators"
+	fmt.Fprintf(out, "# HELP %s Validators active in the usage bucket.\n", gauge)
+	fmt.Fprintf(out, "# TYPE %s gauge\n", gauge)
+	for i, count := range counts {
+		fmt.Fprintf(out, "%s %d %d\n", gauge, count, first.Add(time.Duration(i)*precision).Unix())
+	}
+
+	counter := namespace + "_usage_validator_seconds"
+	fmt.Fprintf(out, "# HELP %s Usage credited to validators.\n", counter)
+	fmt.Fprintf(out, "# TYPE %s counter\n", counter)
+	fmt.Fprintf(out, "# UNIT %s seconds\n", counter)
+	var total int64
+	for i, count := range counts {
+		total += count * int64(precision/time.Second)
+		fmt.Fprintf(out, "%s_total %d %d\n", counter, total, first.Add(time.Duration(i)*precision).Unix())
+	}
+	fmt.Fprintln(out, "# EOF")
+
+	return out.Flush()
+}
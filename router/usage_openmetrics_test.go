@@ -0,0 +1,56 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteUsageOpenMetrics(t *testing.T) {
+	tracker, start := setupMerkleTestDatabase(t)
+
+	var out strings.Builder
+	if err := WriteUsageOpenMetrics(&out, tracker, "rescue_proxy", start, start.Add(15*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	ts := start.Unix()
+	expected := strings.Join([]string{
+		"# HELP rescue_proxy_usage_active_validators Validators active in the usage bucket.",
+		"# TYPE rescue_proxy_usage_active_validators gauge",
+		"rescue_proxy_usage_active_validators 2 " + fmt.Sprint(ts),
+		"rescue_proxy_usage_active_validators 1 " + fmt.Sprint(ts+300),
+		"rescue_proxy_usage_active_validators 2 " + fmt.Sprint(ts+600),
+		"# HELP rescue_proxy_usage_validator_seconds Usage credited to validators.",
+		"# TYPE rescue_proxy_usage_validator_seconds counter",
+		"# UNIT rescue_proxy_usage_validator_seconds seconds",
+		"rescue_proxy_usage_validator_seconds_total 600 " + fmt.Sprint(ts),
+		"rescue_proxy_usage_validator_seconds_total 900 " + fmt.Sprint(ts+300),
+		"rescue_proxy_usage_validator_seconds_total 1500 " + fmt.Sprint(ts+600),
+		"# EOF",
+		"",
+	}, "\n")
+	if out.String() != expected {
+		t.Fatalf("Expected\n%s\ngot\n%s", expected, out.String())
+	}
+
+	// Buckets without usage are written as 0, ranges start at the next bucket boundary
+	out.Reset()
+	if err := WriteUsageOpenMetrics(&out, tracker, "rescue_proxy", start.Add(time.Minute), start.Add(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(strings.SplitN(out.String(), "\n", 4)[2], "rescue_proxy_usage_active_validators 1 "+fmt.Sprint(ts+300)) {
+		t.Fatalf("Expected the range to start at the second bucket, got\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "rescue_proxy_usage_active_validators 0 "+fmt.Sprint(ts+1500)) {
+		t.Fatalf("Expected empty buckets to count 0, got\n%s", out.String())
+	}
+
+	sessions, _ := setupSessionTestDatabase(t, 10*time.Minute)
+	if err := WriteUsageOpenMetrics(&out, sessions, "rescue_proxy", start, start.Add(time.Hour)); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("Expected an unsupported error, got %v", err)
+	}
+}
@@ -0,0 +1,409 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/consensuslayer"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/executionlayer"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+// OwnershipPeriod is a period a validator was observed to be owned by an operator.
+type OwnershipPeriod struct {
+	Validator string         `json:"validator"`
+	Owner     common.Address `json:"owner"`
+	FirstSeen time.Time      `json:"first_seen"`
+	LastSeen  time.Time      `json:"last_seen"`
+}
+
+// OwnerUsage is the usage of the validators an operator owned at the time of usage.
+type OwnerUsage struct {
+	Owner      common.Address `json:"owner"`
+	Validators int            `json:"validators"`
+	Seconds    float64        `json:"seconds"`
+}
+
+// OwnershipUsage is the usage of a range, attributed to owners.
+type OwnershipUsage struct {
+	From   time.Time    `json:"from"`
+	To     time.Time    `json:"to"`
+	Owners []OwnerUsage `json:"owners"`
+	// Usage of validators whose owner is unknown
+	UnattributedSeconds float64 `json:"unattributed_seconds"`
+}
+
+// OwnershipStore keeps snapshots of which operator owns each validator, so usage can be
+// attributed to the owner at the time rather than the current one. Consecutive snapshots
+// with the same owner are merged into a period.
+type OwnershipStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewOwnershipStore creates the ownership table in db if needed.
+func NewOwnershipStore(logger *zap.Logger, db *sql.DB) (*OwnershipStore, error) {
+	store := &OwnershipStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *OwnershipStore) initSchema() error {
+	// Times are unix seconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS validator_ownership (
+		validator_index TEXT NOT NULL,
+		owner TEXT NOT NULL,
+		first_seen INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		PRIMARY KEY (validator_index, first_seen)
+	);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Snapshot records the current owner of each validator. A validator whose owner
+// changed since the last snapshot starts a new period, and is returned as a change.
+func (store *OwnershipStore) Snapshot(owners map[string]common.Address) ([]OwnershipChange, error) {
+	now := store.clock().Unix()
+
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	latestStmt, err := tx.Prepare(`
+	SELECT owner, first_seen, last_seen FROM validator_ownership
+	WHERE validator_index = ? ORDER BY first_seen DESC LIMIT 1
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare ownership statement: %w", err)
+	}
+	defer latestStmt.Close()
+
+	extendStmt, err := tx.Prepare(`
+	UPDATE validator_ownership SET last_seen = MAX(last_seen, ?)
+	WHERE validator_index = ? AND first_seen = ?
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare ownership statement: %w", err)
+	}
+	defer extendStmt.Close()
+
+	insertStmt, err := tx.Prepare(`
+	INSERT OR REPLACE INTO validator_ownership (validator_index, owner, first_seen, last_seen)
+	VALUES (?1, ?2, ?3, ?3)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prepare ownership statement: %w", err)
+	}
+	defer insertStmt.Close()
+
+	var changes []OwnershipChange
+	for validator, owner := range owners {
+		var latest string
+		var firstSeen, lastSeen int64
+		err := latestStmt.QueryRow(validator).Scan(&latest, &firstSeen, &lastSeen)
+		switch {
+		case err == nil && latest == owner.Hex():
+			_, err = extendStmt.Exec(now, validator, firstSeen)
+		case err == nil:
+			changes = append(changes, OwnershipChange{
+				Validator:        validator,
+				PreviousOwner:    common.HexToAddress(latest),
+				Owner:            owner,
+				PreviousLastSeen: time.Unix(lastSeen, 0).UTC(),
+				DetectedAt:       time.Unix(now, 0).UTC(),
+			})
+			_, err = insertStmt.Exec(validator, owner.Hex(), now)
+		case err == sql.ErrNoRows:
+			_, err = insertStmt.Exec(validator, owner.Hex(), now)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to snapshot the owner of validator %s: %w", validator, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Validator < changes[j].Validator
+	})
+	return changes, nil
+}
+
+// History returns the ownership periods of a validator, oldest first.
+func (store *OwnershipStore) History(validator string) ([]OwnershipPeriod, error) {
+	periods, err := store.periods([]string{validator})
+	if err != nil {
+		return nil, err
+	}
+	if periods[validator] == nil {
+		return []OwnershipPeriod{}, nil
+	}
+	return periods[validator], nil
+}
+
+// periods returns the ownership periods of the given validators, oldest first.
+func (store *OwnershipStore) periods(validators []string) (map[string][]OwnershipPeriod, error) {
+	out := make(map[string][]OwnershipPeriod, len(validators))
+	if len(validators) == 0 {
+		return out, nil
+	}
+
+	params := make([]string, 0, len(validators))
+	args := make([]any, 0, len(validators))
+	for _, validator := range validators {
+		params = append(params, "?")
+		args = append(args, validator)
+	}
+	rows, err := store.Database.Query(fmt.Sprintf(`
+	SELECT validator_index, owner, first_seen, last_seen FROM validator_ownership
+	WHERE validator_index IN (%s) ORDER BY validator_index, first_seen
+	`, strings.Join(params, ",")), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ownership: %w", err)
+	}
+	defer rows.Close()
+
+	periods, err := scanOwnershipPeriods(rows)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range periods {
+		out[p.Validator] = append(out[p.Validator], p)
+	}
+	return out, nil
+}
+
+// scanOwnershipPeriods reads rows of validator_index, owner, first_seen and last_seen.
+func scanOwnershipPeriods(rows *sql.Rows) ([]OwnershipPeriod, error) {
+	var out []OwnershipPeriod
+	for rows.Next() {
+		var p OwnershipPeriod
+		var owner string
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&p.Validator, &owner, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		p.Owner = common.HexToAddress(owner)
+		p.FirstSeen = time.Unix(firstSeen, 0).UTC()
+		p.LastSeen = time.Unix(lastSeen, 0).UTC()
+		out = append(out, p)
+	}
+
+	return out, rows.Err()
+}
+
+// ownerAt returns the owner observed by the first snapshot at or after t, or by the
+// latest one if t is more recent.
+func ownerAt(periods []OwnershipPeriod, t time.Time) (common.Address, bool) {
+	if len(periods) == 0 {
+		return common.Address{}, false
+	}
+	i := sort.Search(len(periods), func(i int) bool {
+		return !periods[i].LastSeen.Before(t)
+	})
+	if i == len(periods) {
+		i--
+	}
+	return periods[i].Owner, true
+}
+
+// Report attributes the usage in every bucket overlapping [from, to] to the owner of each
+// validator at the time of the bucket, see ownerAt. Usage of validators which were never
+// snapshotted is unattributed.
+func (store *OwnershipStore) Report(tracker usageBuckets, from time.Time, to time.Time) (*OwnershipUsage, error) {
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+
+	precision := tracker.bucketPrecision()
+	records, err := tracker.usageRecords(from.Truncate(precision), to.Truncate(precision).Add(precision))
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	validators := make([]string, 0)
+	for _, record := range records {
+		validator := record.Validator.String()
+		if _, ok := seen[validator]; !ok {
+			seen[validator] = struct{}{}
+			validators = append(validators, validator)
+		}
+	}
+	periods, err := store.periods(validators)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &OwnershipUsage{From: from, To: to, Owners: []OwnerUsage{}}
+	owners := make(map[common.Address]*OwnerUsage)
+	ownedValidators := make(map[common.Address]map[string]struct{})
+	for _, record := range records {
+		validator := record.Validator.String()
+		owner, ok := ownerAt(periods[validator], record.Bucket)
+		if !ok {
+			out.UnattributedSeconds += precision.Seconds()
+			continue
+		}
+
+		usage, ok := owners[owner]
+		if !ok {
+			usage = &OwnerUsage{Owner: owner}
+			owners[owner] = usage
+			ownedValidators[owner] = make(map[string]struct{})
+		}
+		usage.Seconds += precision.Seconds()
+		ownedValidators[owner][validator] = struct{}{}
+	}
+
+	for owner, usage := range owners {
+		usage.Validators = len(ownedValidators[owner])
+		out.Owners = append(out.Owners, *usage)
+	}
+	sort.Slice(out.Owners, func(i, j int) bool {
+		return out.Owners[i].Owner.Cmp(out.Owners[j].Owner) < 0
+	})
+
+	return out, nil
+}
+
+func (store *OwnershipStore) pruneUsage(cutoff time.Time, exempt map[string]time.Time) (int64, error) {
+	return pruneRows(store.Database, "validator_ownership", "last_seen < ?",
+		func(t time.Time) any { return t.Unix() }, cutoff, exempt)
+}
+
+// OwnershipSnapshotJob periodically snapshots the owners of the validators which used
+// the rescue node since the previous snapshot. Minipools are owned by their node, other
+// validators by their withdrawal address.
+//
+// With a RefreshInterval, the owners of every tracked validator are also re-resolved,
+// used recently or not, so periods don't go stale as minipools exit and launch.
+// Ownership changes are logged and posted to WebhookURL, if any, see OwnershipChange.
+type OwnershipSnapshotJob struct {
+	CL       consensuslayer.ConsensusLayer
+	EL       executionlayer.ExecutionLayer
+	Tracker  UsageTracker
+	Store    *OwnershipStore
+	Interval time.Duration
+	Logger   *zap.Logger
+
+	// How often every tracked validator is re-resolved. 0 disables it.
+	RefreshInterval time.Duration
+	WebhookURL      string
+	Client          *http.Client
+}
+
+// resolve returns the current owners of validators. Validators which are unknown or
+// have BLS withdrawal credentials are omitted.
+func (job *OwnershipSnapshotJob) resolve(validators []string) (map[string]common.Address, error) {
+	owners := make(map[string]common.Address, len(validators))
+	for batch := validators; len(batch) > 0; {
+		n := min(len(batch), ownershipResolveBatch)
+		infos, err := job.CL.GetValidatorInfo(batch[:n])
+		if err != nil {
+			return nil, fmt.Errorf("failed to get validator info: %w", err)
+		}
+		batch = batch[n:]
+
+		for validator, info := range infos {
+			rpInfo, err := job.EL.GetRPInfo(info.Pubkey)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the node of validator %s: %w", validator, err)
+			}
+			switch {
+			case rpInfo != nil:
+				owners[validator] = rpInfo.NodeAddress
+			case info.IsELWithdrawal:
+				owners[validator] = info.WithdrawalAddress
+			}
+		}
+	}
+	return owners, nil
+}
+
+// Snapshot resolves and stores the owners of the validators used in the last interval.
+func (job *OwnershipSnapshotJob) Snapshot() error {
+	now := job.Store.clock()
+	usage, err := job.Tracker.ViewUsage(now.Add(-job.Interval), now)
+	if err != nil {
+		return fmt.Errorf("failed to view usage: %w", err)
+	}
+	if len(usage) == 0 {
+		return nil
+	}
+
+	validators := make([]string, 0, len(usage))
+	for validator := range usage {
+		validators = append(validators, validator)
+	}
+	return job.snapshot(context.Background(), validators)
+}
+
+// snapshot resolves and stores the owners of validators, reporting the changes.
+func (job *OwnershipSnapshotJob) snapshot(ctx context.Context, validators []string) error {
+	owners, err := job.resolve(validators)
+	if err != nil {
+		return err
+	}
+	changes, err := job.Store.Snapshot(owners)
+	if err != nil {
+		return err
+	}
+	job.notify(ctx, changes)
+	return nil
+}
+
+// Run takes a snapshot every Interval, and refreshes every RefreshInterval, until ctx
+// is done.
+func (job *OwnershipSnapshotJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	var refresh <-chan time.Time
+	if job.RefreshInterval > 0 {
+		refreshTicker := time.NewTicker(job.RefreshInterval)
+		defer refreshTicker.Stop()
+		refresh = refreshTicker.C
+	}
+
+	if err := job.Snapshot(); err != nil {
+		job.Logger.Warn("Failed to snapshot validator ownership", zap.Error(err))
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := job.Snapshot(); err != nil {
+				job.Logger.Warn("Failed to snapshot validator ownership", zap.Error(err))
+			}
+		case <-refresh:
+			if err := job.Refresh(ctx); err != nil {
+				job.Logger.Warn("Failed to refresh validator ownership", zap.Error(err))
+			}
+		}
+	}
+}
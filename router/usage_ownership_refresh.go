@@ -0,0 +1,117 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+// Validators resolved per beacon node request
+const ownershipResolveBatch = 1000
+
+// OwnershipChange reports that a tracked validator's owner changed, e.g. because its
+// minipool exited and a new one launched with its index.
+//
+// Usage in buckets after PreviousLastSeen and before DetectedAt was attributed to the
+// new owner by OwnershipStore.Report, while aggregates computed before the change
+// attribute it to the previous one: consumers correct the aggregates of that range.
+type OwnershipChange struct {
+	Validator        string         `json:"validator"`
+	PreviousOwner    common.Address `json:"previous_owner"`
+	Owner            common.Address `json:"owner"`
+	PreviousLastSeen time.Time      `json:"previous_last_seen"`
+	DetectedAt       time.Time      `json:"detected_at"`
+}
+
+// tracked returns every validator with an ownership period.
+func (store *OwnershipStore) tracked() ([]string, error) {
+	rows, err := store.Database.Query("SELECT DISTINCT validator_index FROM validator_ownership ORDER BY validator_index")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tracked validators: %w", err)
+	}
+	defer rows.Close()
+
+	out := []string{}
+	for rows.Next() {
+		var validator string
+		if err := rows.Scan(&validator); err != nil {
+			return nil, err
+		}
+		out = append(out, validator)
+	}
+	return out, rows.Err()
+}
+
+// Refresh re-resolves and stores the owners of every tracked validator, whether it used
+// the rescue node recently or not.
+func (job *OwnershipSnapshotJob) Refresh(ctx context.Context) error {
+	validators, err := job.Store.tracked()
+	if err != nil {
+		return err
+	}
+	if len(validators) == 0 {
+		return nil
+	}
+
+	if err := job.snapshot(ctx, validators); err != nil {
+		return err
+	}
+	job.Logger.Debug("Refreshed validator ownership", zap.Int("validators", len(validators)))
+	return nil
+}
+
+// notify logs changes and posts them to the webhook as a JSON array, if any.
+func (job *OwnershipSnapshotJob) notify(ctx context.Context, changes []OwnershipChange) {
+	if len(changes) == 0 {
+		return
+	}
+	for _, change := range changes {
+		job.Logger.Info("Validator owner changed",
+			zap.String("validator", change.Validator),
+			zap.String("previous_owner", change.PreviousOwner.Hex()),
+			zap.String("owner", change.Owner.Hex()),
+			zap.Time("previous_last_seen", change.PreviousLastSeen))
+	}
+
+	if job.WebhookURL == "" {
+		return
+	}
+	if err := job.post(ctx, changes); err != nil {
+		job.Logger.Warn("Failed to post ownership changes", zap.Int("changes", len(changes)), zap.Error(err))
+	}
+}
+
+func (job *OwnershipSnapshotJob) post(ctx context.Context, changes []OwnershipChange) error {
+	body, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := job.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("ownership webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
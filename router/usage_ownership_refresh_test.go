@@ -0,0 +1,125 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/executionlayer"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/test"
+	"github.com/ethereum/go-ethereum/common"
+	rptypes "github.com/rocket-pool/rocketpool-go/types"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestOwnershipRefresh(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+
+	store, err := NewOwnershipStore(zaptest.NewLogger(t), sqlite.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	sqlite.now = func() time.Time { return now }
+	store.now = sqlite.now
+
+	el := test.NewMockExecutionLayer(1, 0, 2, 0, "refresh")
+	cl := test.NewMockConsensusLayer(0, "refresh")
+	cl.AddExecutionValidators(el, "refresh")
+	var pubkeys []rptypes.ValidatorPubkey
+	var validators []string
+	for pubkey := range el.VMap {
+		pubkeys = append(pubkeys, pubkey)
+		validators = append(validators, cl.Indices[pubkey])
+	}
+
+	var posted []OwnershipChange
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var changes []OwnershipChange
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			t.Error(err)
+		}
+		posted = append(posted, changes...)
+	}))
+	defer webhook.Close()
+
+	job := &OwnershipSnapshotJob{
+		CL:              cl,
+		EL:              el,
+		Tracker:         tracker,
+		Store:           store,
+		Interval:        time.Hour,
+		Logger:          zaptest.NewLogger(t),
+		RefreshInterval: 24 * time.Hour,
+		WebhookURL:      webhook.URL,
+	}
+
+	// Nothing is tracked before the first snapshot
+	if err := job.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.RecordUsage(validators); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	if err := job.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 0 {
+		t.Fatalf("Expected no changes, got %+v", posted)
+	}
+
+	// The first minipool exits and its validator moves to another node, while neither
+	// validator uses the rescue node anymore
+	previous := el.VMap[pubkeys[0]].NodeAddress
+	moved := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	el.VMap[pubkeys[0]] = &executionlayer.RPInfo{NodeAddress: moved}
+	now = now.Add(24 * time.Hour)
+	if err := job.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 0 {
+		t.Fatalf("Expected inactive validators not to be snapshotted, got %+v", posted)
+	}
+
+	if err := job.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 1 {
+		t.Fatalf("Expected a change, got %+v", posted)
+	}
+	change := posted[0]
+	if change.Validator != validators[0] || change.PreviousOwner != previous || change.Owner != moved ||
+		!change.PreviousLastSeen.Equal(start.Add(time.Hour)) || !change.DetectedAt.Equal(now) {
+		t.Fatalf("Unexpected change %+v", change)
+	}
+
+	// The unchanged validator's period is extended
+	history, err := store.History(validators[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || !history[0].LastSeen.Equal(now) {
+		t.Fatalf("Unexpected history %+v", history)
+	}
+
+	// Changes are only reported once
+	now = now.Add(24 * time.Hour)
+	if err := job.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 1 {
+		t.Fatalf("Expected no new changes, got %+v", posted)
+	}
+}
@@ -0,0 +1,159 @@
+//go:build ns
+
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/executionlayer"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/test"
+	"github.com/ethereum/go-ethereum/common"
+	rptypes "github.com/rocket-pool/rocketpool-go/types"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestOwnershipSnapshots(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+
+	store, err := NewOwnershipStore(zaptest.NewLogger(t), sqlite.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	sqlite.now = func() time.Time { return now }
+	store.now = sqlite.now
+
+	el := test.NewMockExecutionLayer(1, 0, 1, 0, "ownership")
+	cl := test.NewMockConsensusLayer(0, "ownership")
+	cl.AddExecutionValidators(el, "ownership")
+	var pubkey rptypes.ValidatorPubkey
+	var original common.Address
+	for k, info := range el.VMap {
+		pubkey, original = k, info.NodeAddress
+	}
+	validator := cl.Indices[pubkey]
+
+	job := &OwnershipSnapshotJob{
+		CL:       cl,
+		EL:       el,
+		Tracker:  tracker,
+		Store:    store,
+		Interval: time.Hour,
+		Logger:   zaptest.NewLogger(t),
+	}
+	snapshot := func() {
+		t.Helper()
+		if err := job.Snapshot(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tracker.RecordUsage([]string{validator}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	snapshot()
+
+	// The minipool is transferred to another node
+	transferred := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	el.VMap[pubkey] = &executionlayer.RPInfo{NodeAddress: transferred}
+	now = now.Add(30 * time.Minute)
+	if err := tracker.RecordUsage([]string{validator}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(30 * time.Minute)
+	snapshot()
+	snapshot()
+
+	history, err := store.History(validator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || history[0].Owner != original || history[1].Owner != transferred ||
+		!history[1].FirstSeen.Equal(now) || !history[1].LastSeen.Equal(now) {
+		t.Fatalf("Unexpected history %+v", history)
+	}
+
+	// Usage after the last snapshot is attributed to the latest owner
+	if err := tracker.RecordUsage([]string{validator}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := store.Report(sqlite, start, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Owners) != 2 || report.UnattributedSeconds != 0 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	for _, owner := range report.Owners {
+		expected := 300.0
+		if owner.Owner == transferred {
+			expected = 600
+		}
+		if owner.Validators != 1 || owner.Seconds != expected {
+			t.Fatalf("Unexpected usage %+v", owner)
+		}
+	}
+
+	// Validators never snapshotted are unattributed
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	report, err = store.Report(sqlite, now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.UnattributedSeconds != 300 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+}
+
+func TestAdminValidatorOwners(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	handler := pr.AdminHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/validators/1/owners", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected 501 without snapshots, got %d", rec.Code)
+	}
+
+	pr.owners, err = NewOwnershipStore(pr.Logger, tracker.(*SQLiteUsageTracker).Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pr.owners.Snapshot(map[string]common.Address{"1": common.HexToAddress("0x0000000000000000000000000000000000000002")}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/validators/1/owners", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/owners?from=2025-01-01T01:00:00Z&to=2025-01-01T00:00:00Z", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an inverted range, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,167 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	rptypes "github.com/rocket-pool/rocketpool-go/types"
+)
+
+// Beacon API payloads a RecordingRule can extract validators from.
+const (
+	// [{"validator_index", "fee_recipient"}], JSON only
+	PayloadPrepareBeaconProposer = "prepare_beacon_proposer"
+	// A list of SignedValidatorRegistration, JSON or SSZ
+	PayloadRegisterValidator = "register_validator"
+	// A list of validator indices, as posted to the duties endpoints, JSON or SSZ
+	PayloadDuties = "duties"
+)
+
+// Size of an SSZ encoded SignedValidatorRegistration
+const signedValidatorRegistrationSize = 180
+
+// payloadValidators are the validators a request is for, by index or by pubkey.
+type payloadValidators struct {
+	Indices []string
+	Pubkeys []rptypes.ValidatorPubkey
+}
+
+func isPayload(payload string) bool {
+	switch payload {
+	case PayloadPrepareBeaconProposer, PayloadRegisterValidator, PayloadDuties:
+		return true
+	}
+	return false
+}
+
+// isSSZ returns whether a body with the given Content-Type is SSZ encoded.
+func isSSZ(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/octet-stream"
+}
+
+// parsePayload extracts the validators of a body of the given payload and Content-Type.
+func parsePayload(payload string, contentType string, body []byte) (payloadValidators, error) {
+	ssz := isSSZ(contentType)
+	switch payload {
+	case PayloadPrepareBeaconProposer:
+		if ssz {
+			return payloadValidators{}, fmt.Errorf("%s has no SSZ encoding", payload)
+		}
+		return parsePrepareBeaconProposer(body)
+	case PayloadRegisterValidator:
+		if ssz {
+			return parseRegisterValidatorSSZ(body)
+		}
+		return parseRegisterValidatorJSON(body)
+	case PayloadDuties:
+		if ssz {
+			return parseDutiesSSZ(body)
+		}
+		return parseDutiesJSON(body)
+	default:
+		return payloadValidators{}, fmt.Errorf("unknown payload %q", payload)
+	}
+}
+
+func parseIndex(index string) (string, error) {
+	if _, err := strconv.ParseUint(index, 10, 64); err != nil {
+		return "", fmt.Errorf("invalid validator index %q", index)
+	}
+	return index, nil
+}
+
+func parsePrepareBeaconProposer(body []byte) (payloadValidators, error) {
+	var proposers []struct {
+		ValidatorIndex string `json:"validator_index"`
+	}
+	if err := json.Unmarshal(body, &proposers); err != nil {
+		return payloadValidators{}, err
+	}
+
+	out := payloadValidators{Indices: make([]string, 0, len(proposers))}
+	for _, proposer := range proposers {
+		index, err := parseIndex(proposer.ValidatorIndex)
+		if err != nil {
+			return payloadValidators{}, err
+		}
+		out.Indices = append(out.Indices, index)
+	}
+	return out, nil
+}
+
+func parseRegisterValidatorJSON(body []byte) (payloadValidators, error) {
+	var registrations []struct {
+		Message struct {
+			Pubkey string `json:"pubkey"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(body, &registrations); err != nil {
+		return payloadValidators{}, err
+	}
+
+	out := payloadValidators{Pubkeys: make([]rptypes.ValidatorPubkey, 0, len(registrations))}
+	for _, registration := range registrations {
+		pubkey, err := rptypes.HexToValidatorPubkey(strings.TrimPrefix(registration.Message.Pubkey, "0x"))
+		if err != nil {
+			return payloadValidators{}, fmt.Errorf("invalid pubkey %q: %w", registration.Message.Pubkey, err)
+		}
+		out.Pubkeys = append(out.Pubkeys, pubkey)
+	}
+	return out, nil
+}
+
+func parseRegisterValidatorSSZ(body []byte) (payloadValidators, error) {
+	// A list of fixed size containers is their concatenation
+	if len(body)%signedValidatorRegistrationSize != 0 {
+		return payloadValidators{}, fmt.Errorf("SSZ body of %d bytes isn't a list of registrations", len(body))
+	}
+
+	out := payloadValidators{Pubkeys: make([]rptypes.ValidatorPubkey, 0, len(body)/signedValidatorRegistrationSize)}
+	for offset := 0; offset < len(body); offset += signedValidatorRegistrationSize {
+		var registration apiv1.SignedValidatorRegistration
+		if err := registration.UnmarshalSSZ(body[offset : offset+signedValidatorRegistrationSize]); err != nil {
+			return payloadValidators{}, err
+		}
+		out.Pubkeys = append(out.Pubkeys, rptypes.ValidatorPubkey(registration.Message.Pubkey))
+	}
+	return out, nil
+}
+
+func parseDutiesJSON(body []byte) (payloadValidators, error) {
+	// Indices are strings per the spec, some clients send numbers
+	var indices []json.Number
+	if err := json.Unmarshal(body, &indices); err != nil {
+		return payloadValidators{}, err
+	}
+
+	out := payloadValidators{Indices: make([]string, 0, len(indices))}
+	for _, i := range indices {
+		index, err := parseIndex(i.String())
+		if err != nil {
+			return payloadValidators{}, err
+		}
+		out.Indices = append(out.Indices, index)
+	}
+	return out, nil
+}
+
+func parseDutiesSSZ(body []byte) (payloadValidators, error) {
+	// A list of uint64 is their little endian concatenation
+	if len(body)%8 != 0 {
+		return payloadValidators{}, fmt.Errorf("SSZ body of %d bytes isn't a list of indices", len(body))
+	}
+
+	out := payloadValidators{Indices: make([]string, 0, len(body)/8)}
+	for offset := 0; offset < len(body); offset += 8 {
+		out.Indices = append(out.Indices, strconv.FormatUint(binary.LittleEndian.Uint64(body[offset:]), 10))
+	}
+	return out, nil
+}
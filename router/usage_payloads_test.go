@@ -0,0 +1,131 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	rptypes "github.com/rocket-pool/rocketpool-go/types"
+)
+
+func testRegistrations(t testing.TB, pubkeys ...rptypes.ValidatorPubkey) ([]byte, []byte) {
+	registrations := make([]*apiv1.SignedValidatorRegistration, 0, len(pubkeys))
+	var ssz []byte
+	for i, pubkey := range pubkeys {
+		registration := &apiv1.SignedValidatorRegistration{
+			Message: &apiv1.ValidatorRegistration{
+				GasLimit:  30000000,
+				Timestamp: time.Unix(1700000000+int64(i), 0),
+				Pubkey:    phase0.BLSPubKey(pubkey),
+			},
+		}
+		encoded, err := registration.MarshalSSZ()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ssz = append(ssz, encoded...)
+		registrations = append(registrations, registration)
+	}
+
+	encoded, err := json.Marshal(registrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded, ssz
+}
+
+func testPubkey(b byte) rptypes.ValidatorPubkey {
+	var pubkey rptypes.ValidatorPubkey
+	for i := range pubkey {
+		pubkey[i] = b
+	}
+	return pubkey
+}
+
+func TestParsePayload(t *testing.T) {
+	registrationsJSON, registrationsSSZ := testRegistrations(t, testPubkey(1), testPubkey(2))
+	dutiesSSZ := binary.LittleEndian.AppendUint64(binary.LittleEndian.AppendUint64(nil, 1), 18446744073709551615)
+
+	tests := []struct {
+		name        string
+		payload     string
+		contentType string
+		body        []byte
+		indices     []string
+		pubkeys     []rptypes.ValidatorPubkey
+		fails       bool
+	}{
+		{"proposers", PayloadPrepareBeaconProposer, "application/json",
+			[]byte(`[{"validator_index": "1", "fee_recipient": "0x00"}, {"validator_index": "2"}]`), []string{"1", "2"}, nil, false},
+		{"proposers bad index", PayloadPrepareBeaconProposer, "", []byte(`[{"validator_index": "-1"}]`), nil, nil, true},
+		{"proposers SSZ", PayloadPrepareBeaconProposer, "application/octet-stream", dutiesSSZ, nil, nil, true},
+		{"registrations", PayloadRegisterValidator, "application/json", registrationsJSON, nil, []rptypes.ValidatorPubkey{testPubkey(1), testPubkey(2)}, false},
+		{"registrations SSZ", PayloadRegisterValidator, "application/octet-stream; charset=binary", registrationsSSZ, nil, []rptypes.ValidatorPubkey{testPubkey(1), testPubkey(2)}, false},
+		{"registrations truncated SSZ", PayloadRegisterValidator, "application/octet-stream", registrationsSSZ[:179], nil, nil, true},
+		{"registrations bad pubkey", PayloadRegisterValidator, "", []byte(`[{"message": {"pubkey": "0x01"}}]`), nil, nil, true},
+		{"duties", PayloadDuties, "application/json", []byte(`["1", 2]`), []string{"1", "2"}, nil, false},
+		{"duties SSZ", PayloadDuties, "application/octet-stream", dutiesSSZ, []string{"1", "18446744073709551615"}, nil, false},
+		{"duties truncated SSZ", PayloadDuties, "application/octet-stream", dutiesSSZ[:9], nil, nil, true},
+		{"duties bad index", PayloadDuties, "", []byte(`["1.5"]`), nil, nil, true},
+		{"duties not a list", PayloadDuties, "", []byte(`{"1": 2}`), nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validators, err := parsePayload(tt.payload, tt.contentType, tt.body)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("Expected an error, got %+v", validators)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(validators.Indices, ",") != strings.Join(tt.indices, ",") {
+				t.Fatalf("Expected indices %v, got %v", tt.indices, validators.Indices)
+			}
+			if len(validators.Pubkeys) != len(tt.pubkeys) {
+				t.Fatalf("Expected pubkeys %v, got %v", tt.pubkeys, validators.Pubkeys)
+			}
+			for i := range tt.pubkeys {
+				if validators.Pubkeys[i] != tt.pubkeys[i] {
+					t.Fatalf("Expected pubkeys %v, got %v", tt.pubkeys, validators.Pubkeys)
+				}
+			}
+		})
+	}
+}
+
+func FuzzParsePayload(f *testing.F) {
+	registrationsJSON, registrationsSSZ := testRegistrations(f, testPubkey(1))
+	f.Add(PayloadPrepareBeaconProposer, "application/json", []byte(`[{"validator_index": "1"}]`))
+	f.Add(PayloadRegisterValidator, "application/json", registrationsJSON)
+	f.Add(PayloadRegisterValidator, "application/octet-stream", registrationsSSZ)
+	f.Add(PayloadDuties, "application/json", []byte(`["1", 2]`))
+	f.Add(PayloadDuties, "application/octet-stream", binary.LittleEndian.AppendUint64(nil, 1))
+
+	f.Fuzz(func(t *testing.T, payload string, contentType string, body []byte) {
+		validators, err := parsePayload(payload, contentType, body)
+		if err != nil {
+			return
+		}
+		// Anything accepted is a list of valid indices or pubkeys
+		for _, index := range validators.Indices {
+			if _, err := strconv.ParseUint(index, 10, 64); err != nil {
+				t.Fatalf("Invalid index %q from %q", index, body)
+			}
+		}
+		if isSSZ(contentType) && payload == PayloadRegisterValidator &&
+			len(validators.Pubkeys)*signedValidatorRegistrationSize != len(body) {
+			t.Fatalf("Expected a pubkey per registration, got %d from %d bytes", len(validators.Pubkeys), len(body))
+		}
+	})
+}
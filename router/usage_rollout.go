@@ -0,0 +1,162 @@
+//go:build ns
+
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// RolloutFeature is a tracker subsystem which can be enabled for some operators only.
+type RolloutFeature string
+
+const (
+	// RolloutWriteQueue writes usage through the UsageWriteQueue rather than
+	// synchronously. Requires a write queue.
+	RolloutWriteQueue RolloutFeature = "write_queue"
+	// RolloutShadow records usage to the shadow backend, e.g. a new database or the
+	// sessions model. Requires a shadow backend.
+	RolloutShadow RolloutFeature = "shadow"
+)
+
+// Precision of RolloutStage.Percent
+const rolloutBuckets = 10_000
+
+// RolloutStage selects the operators a feature is enabled for: those listed, and
+// Percent of the others.
+type RolloutStage struct {
+	// Between 0 and 100
+	Percent float64 `yaml:"percent"`
+	// Node addresses the feature is always enabled for
+	Operators []string `yaml:"operators"`
+
+	operators map[common.Address]struct{}
+}
+
+// Rollout enables tracker features gradually, per operator. Operators are assigned to
+// percentages by a hash of the feature and their node address, so the same operators
+// keep the feature across restarts and proxy instances, and raising a percentage only
+// adds operators. Features without a stage are enabled for everyone.
+//
+//	features:
+//	  write_queue:
+//	    percent: 10
+//	  shadow:
+//	    percent: 0
+//	    operators:
+//	      - "0x0000000000000000000000000000000000000001"
+type Rollout struct {
+	Features map[RolloutFeature]*RolloutStage `yaml:"features"`
+}
+
+// LoadRollout reads and validates a rollout from a YAML file.
+func LoadRollout(path string) (*Rollout, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRollout(data)
+}
+
+// ParseRollout parses and validates a rollout from YAML. Unknown keys are errors.
+func ParseRollout(data []byte) (*Rollout, error) {
+	out := &Rollout{}
+	if err := yaml.UnmarshalStrict(data, out); err != nil {
+		return nil, err
+	}
+
+	for feature, stage := range out.Features {
+		switch feature {
+		case RolloutWriteQueue, RolloutShadow:
+		default:
+			return nil, fmt.Errorf("unknown feature %q", feature)
+		}
+		if stage == nil {
+			return nil, fmt.Errorf("feature %s: empty stage", feature)
+		}
+		if stage.Percent < 0 || stage.Percent > 100 {
+			return nil, fmt.Errorf("feature %s: percent %v must be between 0 and 100", feature, stage.Percent)
+		}
+		stage.operators = make(map[common.Address]struct{}, len(stage.Operators))
+		for _, operator := range stage.Operators {
+			if !common.IsHexAddress(operator) {
+				return nil, fmt.Errorf("feature %s: invalid operator %q", feature, operator)
+			}
+			stage.operators[common.HexToAddress(operator)] = struct{}{}
+		}
+	}
+
+	return out, nil
+}
+
+// Enabled returns whether feature is enabled for node.
+func (r *Rollout) Enabled(feature RolloutFeature, node common.Address) bool {
+	if r == nil {
+		return true
+	}
+	stage, ok := r.Features[feature]
+	if !ok {
+		return true
+	}
+	if _, ok := stage.operators[node]; ok {
+		return true
+	}
+	return float64(rolloutBucket(feature, node)) < stage.Percent*rolloutBuckets/100
+}
+
+// Staged returns whether feature is only enabled for some operators.
+func (r *Rollout) Staged(feature RolloutFeature) bool {
+	if r == nil {
+		return false
+	}
+	_, ok := r.Features[feature]
+	return ok
+}
+
+// rolloutBucket returns the bucket of node for feature, in [0, rolloutBuckets).
+// Hashing the feature as well means features are rolled out to different operators.
+func rolloutBucket(feature RolloutFeature, node common.Address) uint64 {
+	h := sha256.New()
+	h.Write([]byte(feature))
+	h.Write(node.Bytes())
+	return binary.BigEndian.Uint64(h.Sum(nil)) % rolloutBuckets
+}
+
+// logRollout logs the stage of each feature, and warns about stages of features which
+// aren't configured.
+func (pr *ProxyRouter) logRollout() {
+	if pr.Rollout == nil {
+		return
+	}
+
+	features := make([]string, 0, len(pr.Rollout.Features))
+	for feature := range pr.Rollout.Features {
+		features = append(features, string(feature))
+	}
+	sort.Strings(features)
+	for _, feature := range features {
+		stage := pr.Rollout.Features[RolloutFeature(feature)]
+		configured := true
+		switch RolloutFeature(feature) {
+		case RolloutWriteQueue:
+			configured = pr.writes != nil
+		case RolloutShadow:
+			configured = pr.shadow != nil
+		}
+		if !configured {
+			pr.Logger.Warn("Staged rollout of a feature that isn't configured", zap.String("feature", feature))
+			continue
+		}
+		pr.Logger.Info("Staged rollout",
+			zap.String("feature", feature),
+			zap.Float64("percent", stage.Percent),
+			zap.Int("operators", len(stage.operators)))
+	}
+}
@@ -0,0 +1,154 @@
+//go:build ns
+
+package router
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestParseRollout(t *testing.T) {
+	rollout, err := ParseRollout([]byte(`
+features:
+  write_queue:
+    percent: 12.5
+  shadow:
+    operators:
+      - "0x0100000000000000000000000000000000000000"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stage := rollout.Features[RolloutWriteQueue]; stage.Percent != 12.5 {
+		t.Fatalf("Unexpected stage %+v", stage)
+	}
+	if _, ok := rollout.Features[RolloutShadow].operators[common.Address{1}]; !ok {
+		t.Fatal("Expected node 1 to be listed")
+	}
+
+	for _, invalid := range []string{
+		"features:\n  sessions:\n    percent: 10\n",
+		"features:\n  shadow:\n    percent: 101\n",
+		"features:\n  shadow:\n    percent: -1\n",
+		"features:\n  shadow:\n    operators: [node1]\n",
+		"features:\n  shadow:\n",
+		"features:\n  shadow:\n    percentage: 10\n",
+	} {
+		if _, err := ParseRollout([]byte(invalid)); err == nil {
+			t.Fatalf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestRolloutEnabled(t *testing.T) {
+	var rollout *Rollout
+	if !rollout.Enabled(RolloutShadow, common.Address{1}) || rollout.Staged(RolloutShadow) {
+		t.Fatal("Expected features to be enabled without a rollout")
+	}
+
+	rollout, err := ParseRollout([]byte(`
+features:
+  shadow:
+    percent: 0
+    operators:
+      - "0x0100000000000000000000000000000000000000"
+  write_queue:
+    percent: 30
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rollout.Enabled(RolloutShadow, common.Address{1}) || rollout.Enabled(RolloutShadow, common.Address{2}) {
+		t.Fatal("Expected the shadow to be enabled for listed operators only")
+	}
+
+	// Roughly the percentage of operators is enabled, and raising it only adds operators
+	enabled := map[common.Address]bool{}
+	for i := range 1000 {
+		node := common.BigToAddress(big.NewInt(int64(i)))
+		if rollout.Enabled(RolloutWriteQueue, node) {
+			enabled[node] = true
+		}
+	}
+	if len(enabled) < 250 || len(enabled) > 350 {
+		t.Fatalf("Expected about 300 operators to be enabled, got %d", len(enabled))
+	}
+	rollout.Features[RolloutWriteQueue].Percent = 60
+	for node := range enabled {
+		if !rollout.Enabled(RolloutWriteQueue, node) {
+			t.Fatalf("Expected %s to stay enabled", node.Hex())
+		}
+	}
+	rollout.Features[RolloutWriteQueue].Percent = 100
+	if !rollout.Enabled(RolloutWriteQueue, common.Address{3}) {
+		t.Fatal("Expected every operator to be enabled")
+	}
+}
+
+func TestRolloutShadow(t *testing.T) {
+	newTracker := func() *SQLiteUsageTracker {
+		tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cleanup)
+		return tracker.(*SQLiteUsageTracker)
+	}
+	primary := newTracker()
+	shadow := newTracker()
+	now := time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC)
+	primary.now = func() time.Time { return now }
+	shadow.now = func() time.Time { return now }
+
+	rollout, err := ParseRollout([]byte(`
+features:
+  shadow:
+    operators:
+      - "0x0100000000000000000000000000000000000000"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := &ProxyRouter{
+		Logger:  zaptest.NewLogger(t),
+		Rollout: rollout,
+		ut:      primary,
+		shadow: &ShadowUsageTracker{
+			Primary: primary,
+			Shadow:  shadow,
+			Logger:  zaptest.NewLogger(t),
+			staged:  rollout.Staged(RolloutShadow),
+		},
+	}
+	pr.recordUsage(authInfo{nodeAddr: common.Address{1}}, prepareBeaconProposerKind, []string{"1"})
+	pr.recordUsage(authInfo{nodeAddr: common.Address{2}}, prepareBeaconProposerKind, []string{"2"})
+
+	// Only the enrolled operator's validators reach the shadow
+	usage, err := shadow.ViewUsage(now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]time.Duration{"1": 5 * time.Minute}; !reflect.DeepEqual(usage, expected) {
+		t.Fatalf("Expected %v in the shadow, got %v", expected, usage)
+	}
+	usage, err = pr.usage().ViewUsage(now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]time.Duration{"1": 5 * time.Minute, "2": 5 * time.Minute}; !reflect.DeepEqual(usage, expected) {
+		t.Fatalf("Expected the primary's usage %v, got %v", expected, usage)
+	}
+	// and other validators aren't discrepancies
+	shadowUsage, err := shadow.ViewUsage(now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if discrepancies := compareShadowUsage(pr.shadow.enrolledUsage(usage), pr.shadow.enrolledUsage(shadowUsage), 0); len(discrepancies) != 0 {
+		t.Fatalf("Expected no discrepancies, got %+v", discrepancies)
+	}
+}
@@ -0,0 +1,383 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	rptypes "github.com/rocket-pool/rocketpool-go/types"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+)
+
+// Where a RecordingRule extracts validator indices from.
+const (
+	RecordFromBody  = "body"
+	RecordFromQuery = "query"
+	RecordFromPath  = "path"
+	// A Beacon API payload, JSON or SSZ, see PayloadDuties and friends
+	RecordFromPayload = "payload"
+	// The validators recently attributed to the authenticated node
+	RecordFromNode = "node"
+)
+
+// Bodies larger than this aren't inspected, and their usage isn't recorded.
+const maxRecordedBodySize = 1 << 20
+
+var usageKindPattern = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// RecordingRule records the usage of the validators a matching request is for.
+type RecordingRule struct {
+	// Request method, any when empty
+	Method string `yaml:"method"`
+	// Path pattern in gorilla/mux syntax, e.g. /eth/v1/validator/duties/attester/{epoch}
+	Path string `yaml:"path"`
+	// Where validator indices are read from: body, query, path, payload or node
+	From string `yaml:"from"`
+	// For body, a dot separated path into the JSON document, where * selects every
+	// element of an array, e.g. *.validator_index. For query and path, the name of the
+	// parameter or variable. Comma separated values are split. For payload, the name of
+	// the payload, e.g. register_validator. For node, how recently validators must have
+	// been attributed to the node, e.g. 24h.
+	Field string `yaml:"field"`
+	// Reported on usage events, e.g. attester_duties
+	Kind string `yaml:"kind"`
+	// Whether the request is a long-lived stream, e.g. /eth/v1/events. Its usage is
+	// recorded again every bucket for as long as it stays open.
+	Stream bool `yaml:"stream"`
+}
+
+// RecordingRules configures which requests besides prepare_beacon_proposer, which is
+// always recorded, record usage. The first matching rule applies.
+//
+//	rules:
+//	  - method: POST
+//	    path: /eth/v1/validator/duties/attester/{epoch}
+//	    from: body
+//	    field: "*"
+//	    kind: attester_duties
+//	  - method: GET
+//	    path: /eth/v1/beacon/states/{state}/validators
+//	    from: query
+//	    field: id
+//	    kind: validator_status
+type RecordingRules struct {
+	Rules []RecordingRule `yaml:"rules"`
+
+	router *mux.Router
+}
+
+// LoadRecordingRules reads and validates rules from a YAML file.
+func LoadRecordingRules(path string) (*RecordingRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRecordingRules(data)
+}
+
+// ParseRecordingRules parses and validates rules from YAML. Unknown keys are errors.
+func ParseRecordingRules(data []byte) (*RecordingRules, error) {
+	out := &RecordingRules{}
+	if err := yaml.UnmarshalStrict(data, out); err != nil {
+		return nil, err
+	}
+
+	out.router = mux.NewRouter()
+	for i := range out.Rules {
+		rule := &out.Rules[i]
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+
+		route := out.router.Path(rule.Path).Name(strconv.Itoa(i))
+		if rule.Method != "" {
+			route.Methods(rule.Method)
+		}
+		if err := route.GetError(); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+
+	return out, nil
+}
+
+func (rule *RecordingRule) validate() error {
+	rule.Method = strings.ToUpper(rule.Method)
+
+	if !strings.HasPrefix(rule.Path, "/") {
+		return fmt.Errorf("path %q must start with /", rule.Path)
+	}
+	if rule.Path == "/eth/v1/validator/prepare_beacon_proposer" {
+		return errors.New("prepare_beacon_proposer is already recorded")
+	}
+	switch rule.From {
+	case RecordFromBody, RecordFromPayload:
+		if rule.Method == http.MethodGet {
+			return errors.New("GET requests have no body")
+		}
+	case RecordFromQuery, RecordFromPath:
+	case RecordFromNode:
+		if age, err := time.ParseDuration(rule.Field); err != nil || age <= 0 {
+			return fmt.Errorf("field of a node rule must be a positive duration, got %q", rule.Field)
+		}
+	default:
+		return fmt.Errorf("from must be body, query, path, payload or node, got %q", rule.From)
+	}
+	if rule.Field == "" {
+		return errors.New("field is required")
+	}
+	if rule.From == RecordFromPath && !strings.Contains(rule.Path, "{"+rule.Field) {
+		return fmt.Errorf("path %q has no variable %q", rule.Path, rule.Field)
+	}
+	if rule.From == RecordFromPayload && !isPayload(rule.Field) {
+		return fmt.Errorf("unknown payload %q", rule.Field)
+	}
+	if !usageKindPattern.MatchString(rule.Kind) {
+		return fmt.Errorf("kind %q must be lower case letters, digits and underscores", rule.Kind)
+	}
+
+	return nil
+}
+
+// match returns the first rule matching r and the path variables, or nil.
+func (rules *RecordingRules) match(r *http.Request) (*RecordingRule, map[string]string) {
+	if rules == nil || rules.router == nil {
+		return nil, nil
+	}
+
+	var match mux.RouteMatch
+	if !rules.router.Match(r, &match) || match.MatchErr != nil {
+		return nil, nil
+	}
+	i, err := strconv.Atoi(match.Route.GetName())
+	if err != nil {
+		return nil, nil
+	}
+	return &rules.Rules[i], match.Vars
+}
+
+// extract returns the validators r is for. The body is read and replaced,
+// so it can still be proxied. Node rules are resolved by ProxyRouter.nodeValidators.
+func (rule *RecordingRule) extract(r *http.Request, vars map[string]string) (payloadValidators, error) {
+	switch rule.From {
+	case RecordFromNode:
+		return payloadValidators{}, nil
+	case RecordFromQuery:
+		var out payloadValidators
+		for _, value := range r.URL.Query()[rule.Field] {
+			out.Indices = append(out.Indices, splitIndices(value)...)
+		}
+		return out, nil
+	case RecordFromPath:
+		return payloadValidators{Indices: splitIndices(vars[rule.Field])}, nil
+	}
+
+	buf, err := readBody(r)
+	if err != nil || buf == nil {
+		return payloadValidators{}, err
+	}
+
+	if rule.From == RecordFromPayload {
+		return parsePayload(rule.Field, r.Header.Get("Content-Type"), buf)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	var document any
+	if err := decoder.Decode(&document); err != nil {
+		return payloadValidators{}, fmt.Errorf("invalid JSON body: %w", err)
+	}
+
+	var out payloadValidators
+	if err := selectIndices(document, strings.Split(rule.Field, "."), &out.Indices); err != nil {
+		return payloadValidators{}, err
+	}
+	return out, nil
+}
+
+// readBody reads up to maxRecordedBodySize bytes of the body of r, and replaces it so
+// it can still be read in full.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+
+	buf, err := io.ReadAll(io.LimitReader(r.Body, maxRecordedBodySize+1))
+	body := r.Body
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), body), body}
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > maxRecordedBodySize {
+		return nil, fmt.Errorf("body exceeds %d bytes", maxRecordedBodySize)
+	}
+	return buf, nil
+}
+
+// validatorIndexer is implemented by consensus layers which can map pubkeys to indices.
+type validatorIndexer interface {
+	GetValidatorIndices(pubkeys []rptypes.ValidatorPubkey) (map[rptypes.ValidatorPubkey]string, error)
+}
+
+// resolve returns the indices of validators, looking pubkeys up on the consensus
+// layer. Unknown pubkeys are dropped.
+func (pr *ProxyRouter) resolve(validators payloadValidators) ([]string, error) {
+	if len(validators.Pubkeys) == 0 {
+		return validators.Indices, nil
+	}
+
+	indexer, ok := pr.CL.(validatorIndexer)
+	if !ok {
+		return nil, errors.New("the consensus layer can't map pubkeys to indices")
+	}
+	indices, err := indexer.GetValidatorIndices(validators.Pubkeys)
+	if err != nil {
+		return nil, err
+	}
+
+	out := validators.Indices
+	for _, pubkey := range validators.Pubkeys {
+		if index, ok := indices[pubkey]; ok {
+			out = append(out, index)
+		}
+	}
+	return out, nil
+}
+
+// Holds the requestUsage of requests on guarded paths, recorded by their guard
+const prContextRequestUsageKey = prContextKey("request_usage")
+
+// Requests to this path are only accepted once registerValidatorGuard allows them
+const registerValidatorPath = "/eth/v1/validator/register_validator"
+
+// requestUsage is the usage a RecordingRule matched, recorded once its request is
+// accepted.
+type requestUsage struct {
+	authInfo authInfo
+	rule     *RecordingRule
+	method   string
+	indices  []string
+}
+
+// matchRequestUsage returns the usage of the validators r is for, if a RecordingRule
+// matches it.
+func (pr *ProxyRouter) matchRequestUsage(r *http.Request, authInfo authInfo) *requestUsage {
+	rule, vars := pr.RecordingRules.match(r)
+	if rule == nil {
+		return nil
+	}
+
+	validators, err := rule.extract(r, vars)
+	var indices []string
+	if err == nil {
+		indices, err = pr.resolve(validators)
+	}
+	if err == nil && rule.From == RecordFromNode {
+		// Validated when the rules are parsed
+		age, _ := time.ParseDuration(rule.Field)
+		indices, err = pr.nodeValidators(authInfo.nodeAddr, age)
+	}
+	if err != nil {
+		pr.m.Counter("recording_rule_errors").Inc()
+		pr.Logger.Debug("Failed to extract validators from request",
+			zap.String("kind", rule.Kind),
+			zap.String("uri", r.RequestURI),
+			zap.Error(err))
+		return nil
+	}
+	if len(indices) == 0 {
+		return nil
+	}
+
+	return &requestUsage{
+		authInfo: authInfo,
+		rule:     rule,
+		method:   r.Method,
+		indices:  indices,
+	}
+}
+
+// recordRequestUsage records usage once its request was accepted. ctx ends with the
+// request.
+func (pr *ProxyRouter) recordRequestUsage(ctx context.Context, usage *requestUsage) {
+	pr.recordUsage(usage.authInfo, usage.rule.Kind, usage.indices)
+	pr.sampleRequest(ctx, usage.rule.Kind, usage.method, usage.rule.Path, usage.indices)
+	if usage.rule.Stream {
+		go pr.recordStreamUsage(ctx, usage.authInfo, usage.rule.Kind, usage.indices)
+	}
+}
+
+// selectIndices appends the values of the JSON document at path to out.
+func selectIndices(document any, path []string, out *[]string) error {
+	if len(path) == 0 {
+		switch v := document.(type) {
+		case string:
+			*out = append(*out, splitIndices(v)...)
+		case json.Number:
+			*out = append(*out, splitIndices(v.String())...)
+		case []any:
+			for _, element := range v {
+				if err := selectIndices(element, nil, out); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unexpected %T where a validator index was expected", document)
+		}
+		return nil
+	}
+
+	switch v := document.(type) {
+	case []any:
+		if path[0] != "*" {
+			return fmt.Errorf("unexpected array where %q was expected", path[0])
+		}
+		for _, element := range v {
+			if err := selectIndices(element, path[1:], out); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		if path[0] == "*" {
+			return errors.New("unexpected object where an array was expected")
+		}
+		field, ok := v[path[0]]
+		if !ok {
+			return nil
+		}
+		return selectIndices(field, path[1:], out)
+	default:
+		return fmt.Errorf("unexpected %T where %q was expected", document, path[0])
+	}
+}
+
+// splitIndices splits comma separated validator indices. Pubkeys and anything
+// else that isn't an index are dropped, the tracker records indices only.
+func splitIndices(value string) []string {
+	var out []string
+	for _, index := range strings.Split(value, ",") {
+		index = strings.TrimSpace(index)
+		if _, err := strconv.ParseUint(index, 10, 64); err != nil {
+			continue
+		}
+		out = append(out, index)
+	}
+	return out
+}
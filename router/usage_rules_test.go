@@ -0,0 +1,243 @@
+//go:build ns
+
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gbp "github.com/Rocket-Rescue-Node/guarded-beacon-proxy"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/test"
+	"github.com/ethereum/go-ethereum/common"
+	rptypes "github.com/rocket-pool/rocketpool-go/types"
+	"go.uber.org/zap/zaptest"
+)
+
+const testRecordingRules = `
+rules:
+  - method: post
+    path: /eth/v1/validator/duties/attester/{epoch}
+    from: body
+    field: "*"
+    kind: attester_duties
+  - method: POST
+    path: /eth/v1/validator/liveness/{epoch}
+    from: body
+    field: "*.index"
+    kind: liveness
+  - method: GET
+    path: /eth/v1/beacon/states/{state}/validators
+    from: query
+    field: id
+    kind: validator_status
+  - path: /eth/v1/beacon/states/{state}/validators/{validator}
+    from: path
+    field: validator
+    kind: validator_status
+  - method: POST
+    path: /eth/v1/validator/register_validator
+    from: payload
+    field: register_validator
+    kind: registration
+  - method: GET
+    path: /eth/v1/events
+    from: node
+    field: 24h
+    kind: events
+    stream: true
+`
+
+func TestParseRecordingRules(t *testing.T) {
+	rules, err := ParseRecordingRules([]byte(testRecordingRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules.Rules) != 6 || !rules.Rules[5].Stream || rules.Rules[0].Method != http.MethodPost {
+		t.Fatalf("Unexpected rules %+v", rules.Rules)
+	}
+
+	tests := []struct {
+		name string
+		rule string
+	}{
+		{"unknown key", "{path: /a, from: query, field: id, kind: a, extra: 1}"},
+		{"relative path", "{path: a, from: query, field: id, kind: a}"},
+		{"guarded path", "{path: /eth/v1/validator/prepare_beacon_proposer, from: body, field: '*', kind: a}"},
+		{"unknown source", "{path: /a, from: header, field: id, kind: a}"},
+		{"get body", "{method: GET, path: /a, from: body, field: '*', kind: a}"},
+		{"missing field", "{path: /a, from: query, kind: a}"},
+		{"missing variable", "{path: /a/{b}, from: path, field: c, kind: a}"},
+		{"invalid kind", "{path: /a, from: query, field: id, kind: Attester-Duties}"},
+		{"invalid pattern", "{path: '/a/{b', from: query, field: id, kind: a}"},
+		{"unknown payload", "{path: /a, from: payload, field: attestations, kind: a}"},
+		{"node without age", "{path: /a, from: node, field: recent, kind: a}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseRecordingRules([]byte("rules: [" + tt.rule + "]")); err == nil {
+				t.Fatal("Expected an error")
+			}
+		})
+	}
+}
+
+func TestRecordingRulesExtract(t *testing.T) {
+	rules, err := ParseRecordingRules([]byte(testRecordingRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		kind     string
+		expected []string
+	}{
+		{"body", http.MethodPost, "/eth/v1/validator/duties/attester/1", `["1", 2, "0xab"]`, "attester_duties", []string{"1", "2"}},
+		{"body field", http.MethodPost, "/eth/v1/validator/liveness/1", `[{"index": "3"}, {"index": 4}, {}]`, "liveness", []string{"3", "4"}},
+		{"query", http.MethodGet, "/eth/v1/beacon/states/head/validators?id=5,6&id=7", "", "validator_status", []string{"5", "6", "7"}},
+		{"path", http.MethodGet, "/eth/v1/beacon/states/head/validators/8", "", "validator_status", []string{"8"}},
+		{"pubkey", http.MethodGet, "/eth/v1/beacon/states/head/validators/0xab", "", "validator_status", nil},
+		{"wrong method", http.MethodGet, "/eth/v1/validator/duties/attester/1", "", "", nil},
+		{"no rule", http.MethodGet, "/eth/v1/node/syncing", "", "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			rule, vars := rules.match(r)
+			if rule == nil {
+				if tt.kind != "" {
+					t.Fatal("Expected a matching rule")
+				}
+				return
+			}
+			if rule.Kind != tt.kind {
+				t.Fatalf("Expected kind %s, got %s", tt.kind, rule.Kind)
+			}
+
+			indices, err := rule.extract(r, vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(indices.Indices, ",") != strings.Join(tt.expected, ",") {
+				t.Fatalf("Expected %v, got %v", tt.expected, indices)
+			}
+
+			// The body can still be proxied
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.body {
+				t.Fatalf("Expected body %q, got %q", tt.body, body)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/eth/v1/validator/duties/attester/1", strings.NewReader(`{"1": 2}`))
+	rule, vars := rules.match(r)
+	if _, err := rule.extract(r, vars); err == nil {
+		t.Fatal("Expected an error for an unexpected document")
+	}
+}
+
+func TestRecordRequestUsage(t *testing.T) {
+	if _, err := metrics.Init("usage_rules_test_" + t.Name()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	rules, err := ParseRecordingRules([]byte(testRecordingRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	pr := &ProxyRouter{
+		Logger:         zaptest.NewLogger(t),
+		RecordingRules: rules,
+		ut:             tracker,
+		events:         []UsageEventSink{NewJSONUsageEventSink(&RotatingFile{Path: path})},
+	}
+
+	node := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	record := func(r *http.Request) {
+		if usage := pr.matchRequestUsage(r, authInfo{nodeAddr: node}); usage != nil {
+			pr.recordRequestUsage(r.Context(), usage)
+		}
+	}
+	record(httptest.NewRequest(http.MethodPost, "/eth/v1/validator/duties/attester/1",
+		strings.NewReader(`["1", "2"]`)))
+	if usage := pr.matchRequestUsage(httptest.NewRequest(http.MethodGet, "/eth/v1/node/syncing", nil), authInfo{nodeAddr: node}); usage != nil {
+		t.Fatalf("Expected no rule to match, got %+v", usage)
+	}
+
+	// Registered pubkeys are recorded by index
+	cl := test.NewMockConsensusLayer(2, t.Name())
+	pr.CL = cl
+	var pubkeys []rptypes.ValidatorPubkey
+	for pubkey := range cl.Indices {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	_, ssz := testRegistrations(t, append(pubkeys, testPubkey(1))...)
+	r := httptest.NewRequest(http.MethodPost, "/eth/v1/validator/register_validator", bytes.NewReader(ssz))
+	r.Header.Set("Content-Type", "application/octet-stream")
+	matched := pr.matchRequestUsage(r, authInfo{nodeAddr: node})
+	if matched == nil {
+		t.Fatal("Expected the registrations to match a rule")
+	}
+
+	// Registrations are only recorded once the guard accepts them
+	pr.m = metrics.NewMetricsRegistry("http_proxy")
+	pr.ExpectedFeeRecipient = "0x0000000000000000000000000000000000000001"
+	ctx := context.WithValue(r.Context(), prContextRequestUsageKey, matched)
+	registration := func(feeRecipient string) gbp.RegisterValidatorRequest {
+		var validator gbp.RegisterValidatorRequest
+		if err := json.Unmarshal([]byte(`[{"message": {"pubkey": "0x`+testPubkey(1).String()+`", "fee_recipient": "`+feeRecipient+`"}}]`), &validator); err != nil {
+			t.Fatal(err)
+		}
+		return validator
+	}
+	if status, _ := pr.registerValidatorGuard(registration("0x0000000000000000000000000000000000000009"), ctx); status != gbp.Conflict {
+		t.Fatalf("Expected the guard to refuse the registration, got %v", status)
+	}
+	if usage, _ := tracker.ViewUsage(time.Now().Add(-time.Hour), time.Now().Add(time.Hour)); usage["100"] != 0 {
+		t.Fatalf("Expected refused registrations not to be recorded, got %v", usage)
+	}
+	if status, err := pr.registerValidatorGuard(registration(pr.ExpectedFeeRecipient), ctx); status != gbp.Allowed {
+		t.Fatalf("Expected the guard to allow the registration, got %v: %v", status, err)
+	}
+	if err := pr.events[0].Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := tracker.ViewUsage(time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 4 || usage["1"] == 0 || usage["2"] == 0 || usage["100"] == 0 || usage["101"] == 0 {
+		t.Fatalf("Unexpected usage %v", usage)
+	}
+
+	events := readUsageEvents(t, path)
+	if len(events) != 4 || events[0].Kind != "attester_duties" || events[2].Kind != "registration" {
+		t.Fatalf("Unexpected events %+v", events)
+	}
+}
@@ -0,0 +1,63 @@
+//go:build ns
+
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"strings"
+)
+
+// ValidatorSampler maps validators to stable shards and sample groups, e.g. to roll a
+// policy out to a fraction of validators or track a few of them in more detail.
+//
+// Validators are identified by their pubkey or index, and the same validator must
+// always be identified the same way. Pubkeys are compared case-insensitively, with or
+// without their 0x prefix.
+type ValidatorSampler struct {
+	// Mixed into every hash, so samplers with different salts select independent groups
+	Salt string
+}
+
+// hash returns a uniformly distributed hash of validator.
+func (s ValidatorSampler) hash(validator string) uint64 {
+	validator = strings.TrimPrefix(strings.ToLower(validator), "0x")
+	h := sha256.New()
+	h.Write([]byte(s.Salt))
+	h.Write([]byte{0})
+	h.Write([]byte(validator))
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// Shard returns which of shards the validator belongs to, in [0, shards). When shards
+// grows from n to n+1 only 1/(n+1) of validators move, all of them to the new shard.
+// It returns 0 if shards isn't positive.
+func (s ValidatorSampler) Shard(validator string, shards int) int {
+	if shards <= 0 {
+		return 0
+	}
+
+	// Jump consistent hash, see https://arxiv.org/abs/1406.2294
+	key := s.hash(validator)
+	var b, j int64 = -1, 0
+	for j < int64(shards) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// Sampled returns whether the validator is part of a sample of rate of validators, in
+// [0, 1]. Samples are nested: a validator sampled at a rate is sampled at every higher
+// rate.
+func (s ValidatorSampler) Sampled(validator string, rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	if rate >= 1 {
+		return true
+	}
+	// Top 53 bits, so every value is exactly representable
+	return float64(s.hash(validator)>>11)/(1<<53) < rate
+}
@@ -0,0 +1,99 @@
+//go:build ns
+
+package router
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+const samplingTestValidators = 100000
+
+func TestValidatorSamplerShardDistribution(t *testing.T) {
+	s := ValidatorSampler{}
+	const shards = 16
+	counts := make([]int, shards)
+	for i := 0; i < samplingTestValidators; i++ {
+		shard := s.Shard(strconv.Itoa(i), shards)
+		if shard < 0 || shard >= shards {
+			t.Fatalf("Shard %d out of range", shard)
+		}
+		counts[shard]++
+	}
+
+	// Chi-squared with 15 degrees of freedom, p < 0.001 above 37.7
+	expected := float64(samplingTestValidators) / shards
+	var chi2 float64
+	for _, c := range counts {
+		chi2 += math.Pow(float64(c)-expected, 2) / expected
+	}
+	if chi2 > 37.7 {
+		t.Fatalf("Shards aren't uniform, chi2 = %f: %v", chi2, counts)
+	}
+}
+
+func TestValidatorSamplerShardStability(t *testing.T) {
+	s := ValidatorSampler{Salt: "canary"}
+	moved := 0
+	for i := 0; i < samplingTestValidators; i++ {
+		validator := strconv.Itoa(i)
+		before, after := s.Shard(validator, 10), s.Shard(validator, 11)
+		if before == after {
+			continue
+		}
+		if after != 10 {
+			t.Fatalf("Validator %s moved from shard %d to %d instead of the new shard", validator, before, after)
+		}
+		moved++
+	}
+
+	// 1/11 of validators are expected to move
+	if fraction := float64(moved) / samplingTestValidators; math.Abs(fraction-1.0/11) > 0.005 {
+		t.Fatalf("Expected about 1/11 of validators to move, got %f", fraction)
+	}
+	if s.Shard("1", 0) != 0 {
+		t.Fatal("Expected shard 0 without shards")
+	}
+}
+
+func TestValidatorSamplerSampled(t *testing.T) {
+	s := ValidatorSampler{}
+	sampled := 0
+	for i := 0; i < samplingTestValidators; i++ {
+		validator := strconv.Itoa(i)
+		if !s.Sampled(validator, 0.01) {
+			continue
+		}
+		sampled++
+		if !s.Sampled(validator, 0.1) {
+			t.Fatalf("Validator %s sampled at 1%% but not 10%%", validator)
+		}
+	}
+	if fraction := float64(sampled) / samplingTestValidators; math.Abs(fraction-0.01) > 0.002 {
+		t.Fatalf("Expected about 1%% of validators to be sampled, got %f", fraction)
+	}
+
+	if s.Sampled("1", 0) || !s.Sampled("1", 1) {
+		t.Fatal("Expected rates 0 and 1 to sample none and every validator")
+	}
+
+	// Pubkeys are normalized
+	const pubkey = "0xAB0000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000"
+	if s.Shard(pubkey, 1000) != s.Shard("ab0000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000", 1000) {
+		t.Fatal("Expected a pubkey to map to the same shard regardless of case and prefix")
+	}
+
+	// Salts select independent samples
+	other := ValidatorSampler{Salt: "other"}
+	both := 0
+	for i := 0; i < samplingTestValidators; i++ {
+		validator := strconv.Itoa(i)
+		if s.Sampled(validator, 0.1) && other.Sampled(validator, 0.1) {
+			both++
+		}
+	}
+	if fraction := float64(both) / samplingTestValidators; math.Abs(fraction-0.01) > 0.002 {
+		t.Fatalf("Expected about 1%% of validators in both samples, got %f", fraction)
+	}
+}
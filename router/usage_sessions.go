@@ -0,0 +1,277 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"go.uber.org/zap"
+)
+
+const defaultSessionIdleTimeout = 15 * time.Minute
+
+// SQLiteSessionUsageTracker is a UsageTracker which accounts for usage with sessions
+// instead of buckets. Every call to RecordUsage either extends the validator's current
+// session or, if its last activity is older than IdleTimeout, starts a new one.
+//
+// A session lasts from its first to its last activity, so a validator seen only once
+// has a session of zero length. ViewUsage clips sessions to the requested range.
+type SQLiteSessionUsageTracker struct {
+	Database *sql.DB
+	// Optional read replica. ViewUsage falls back to Database when nil.
+	ReadDatabase *sql.DB
+	Logger       *zap.Logger
+	IdleTimeout  time.Duration
+	// Number of retries for write transactions that fail because the database is busy
+	WriteRetries int
+	// Optional faults injected into database operations, see FaultInjector
+	Faults *FaultInjector
+
+	wallClock
+	// Set by Close, after which statements are unusable
+	closed atomic.Bool
+
+	extendSessionStmt *sql.Stmt
+	startSessionStmt  *sql.Stmt
+	viewSessionsStmt  *sql.Stmt
+
+	m *metrics.MetricsRegistry
+}
+
+func (opts *UsageTrackerOptions) sessionIdleTimeout(logger *zap.Logger) time.Duration {
+	if opts.SessionIdleTimeout == 0 {
+		return defaultSessionIdleTimeout
+	}
+	if opts.SessionIdleTimeout < 0 {
+		logger.Fatal("Invalid usage tracker configuration, session idle timeout must be positive",
+			zap.Duration("idle_timeout", opts.SessionIdleTimeout))
+	}
+	return opts.SessionIdleTimeout
+}
+
+func NewSQLiteSessionUsageTracker(logger *zap.Logger, opts UsageTrackerOptions) UsageTracker {
+	tracker, err := newSQLiteSessionUsageTracker(logger, opts)
+	if err != nil {
+		logger.Fatal("Failed to initialize database schema", zap.Error(err))
+	}
+	return tracker
+}
+
+func newSQLiteSessionUsageTracker(logger *zap.Logger, opts UsageTrackerOptions) (*SQLiteSessionUsageTracker, error) {
+	logger = opts.logger(logger)
+	idleTimeout := opts.sessionIdleTimeout(logger)
+
+	db, readDB := openUsageDatabases(logger, opts)
+
+	tracker := &SQLiteSessionUsageTracker{
+		Database:     db,
+		ReadDatabase: readDB,
+		Logger:       logger,
+		IdleTimeout:  idleTimeout,
+		WriteRetries: opts.writeRetries(),
+		Faults:       opts.Faults,
+		m:            opts.metrics(),
+	}
+
+	if err := tracker.initSchema(); err != nil {
+		tracker.Close()
+		return nil, err
+	}
+
+	startUsageDatabases(logger, tracker.m, db, readDB)
+
+	return tracker, nil
+}
+
+func (tracker *SQLiteSessionUsageTracker) initSchema() error {
+	// Times are unix milliseconds, sessions are not quantized
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS validator_sessions (
+		validator_index TEXT NOT NULL,
+		started_at INTEGER NOT NULL,
+		last_seen INTEGER NOT NULL,
+		PRIMARY KEY (validator_index, started_at)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_sessions_last_seen ON validator_sessions(last_seen);
+	`
+
+	if _, err := tracker.Database.Exec(createTableSQL); err != nil {
+		return err
+	}
+
+	return tracker.prepareStatements()
+}
+
+func (tracker *SQLiteSessionUsageTracker) prepareStatements() error {
+	tracker.closeStatements()
+
+	var err error
+	tracker.extendSessionStmt, err = tracker.Database.Prepare(`
+	UPDATE validator_sessions SET last_seen = MAX(last_seen, ?1)
+	WHERE validator_index = ?2 AND last_seen >= ?3
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare extend statement: %w", err)
+	}
+
+	tracker.startSessionStmt, err = tracker.Database.Prepare(`
+	INSERT INTO validator_sessions (validator_index, started_at, last_seen) VALUES (?1, ?2, ?2)
+	ON CONFLICT (validator_index, started_at) DO NOTHING
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare start statement: %w", err)
+	}
+
+	tracker.viewSessionsStmt, err = tracker.readDB().Prepare(`
+	SELECT validator_index, SUM(MIN(last_seen, ?2) - MAX(started_at, ?1)) AS usage_ms
+	FROM validator_sessions
+	WHERE started_at <= ?2 AND last_seen >= ?1
+	GROUP BY validator_index
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare view statement: %w", err)
+	}
+
+	return nil
+}
+
+func (tracker *SQLiteSessionUsageTracker) closeStatements() {
+	for _, stmt := range []*sql.Stmt{tracker.extendSessionStmt, tracker.startSessionStmt, tracker.viewSessionsStmt} {
+		if stmt != nil {
+			_ = stmt.Close()
+		}
+	}
+	tracker.extendSessionStmt = nil
+	tracker.startSessionStmt = nil
+	tracker.viewSessionsStmt = nil
+}
+
+// HealthCheck pings each database the tracker uses and returns the result per role.
+func (tracker *SQLiteSessionUsageTracker) HealthCheck(ctx context.Context) map[UsageDBRole]error {
+	return pingUsageDatabases(ctx, tracker.Database, tracker.ReadDatabase)
+}
+
+func (tracker *SQLiteSessionUsageTracker) primaryDatabase() *sql.DB {
+	return tracker.Database
+}
+
+func (tracker *SQLiteSessionUsageTracker) readDB() *sql.DB {
+	if tracker.ReadDatabase != nil {
+		return tracker.ReadDatabase
+	}
+	return tracker.Database
+}
+
+func (tracker *SQLiteSessionUsageTracker) RecordUsage(indexes []string) error {
+	now := tracker.clock().UnixMilli()
+	idleSince := now - tracker.IdleTimeout.Milliseconds()
+
+	return retryUsageWrite(tracker.Logger, tracker.WriteRetries, func() {
+		if tracker.m != nil {
+			tracker.m.Counter("write_retries").Inc()
+		}
+	}, func() error {
+		return tracker.Faults.write(indexes, func(indexes []string) error {
+			return tracker.recordUsage(now, idleSince, indexes)
+		})
+	})
+}
+
+func (tracker *SQLiteSessionUsageTracker) recordUsage(now int64, idleSince int64, indexes []string) error {
+	if tracker.closed.Load() {
+		return ErrTrackerClosed
+	}
+	tx, err := tracker.Database.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	extend := tx.Stmt(tracker.extendSessionStmt)
+	defer extend.Close()
+	start := tx.Stmt(tracker.startSessionStmt)
+	defer start.Close()
+
+	for _, index := range indexes {
+		res, err := extend.Exec(now, index, idleSince)
+		if err != nil {
+			return fmt.Errorf("failed to extend session for validator %s: %w", index, err)
+		}
+
+		extended, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to extend session for validator %s: %w", index, err)
+		}
+		if extended > 0 {
+			continue
+		}
+
+		if _, err := start.Exec(index, now); err != nil {
+			return fmt.Errorf("failed to start session for validator %s: %w", index, err)
+		}
+
+		tracker.Logger.Debug("Started usage session",
+			zap.String("index", index),
+			zap.Int64("started_at_ms", now))
+	}
+
+	return tx.Commit()
+}
+
+func (tracker *SQLiteSessionUsageTracker) ViewUsage(from time.Time, to time.Time) (map[string]time.Duration, error) {
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+	if err := tracker.Faults.read(); err != nil {
+		return nil, err
+	}
+	if tracker.closed.Load() {
+		return nil, ErrTrackerClosed
+	}
+
+	rows, err := tracker.viewSessionsStmt.Query(from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query session data: %w", err)
+	}
+	defer rows.Close()
+
+	result := make(map[string]time.Duration)
+	for rows.Next() {
+		var validator string
+		var usageMs int64
+
+		if err := rows.Scan(&validator, &usageMs); err != nil {
+			tracker.Logger.Error("Failed to scan row", zap.Error(err))
+			continue
+		}
+
+		result[validator] = time.Duration(usageMs) * time.Millisecond
+	}
+
+	return result, rows.Err()
+}
+
+// Close closes the databases. Later calls fail with ErrTrackerClosed.
+func (tracker *SQLiteSessionUsageTracker) Close() {
+	if tracker.closed.Swap(true) {
+		return
+	}
+	if tracker.m != nil {
+		tracker.m.UnregisterAll()
+	}
+	tracker.closeStatements()
+	if tracker.ReadDatabase != nil {
+		if err := tracker.ReadDatabase.Close(); err != nil {
+			tracker.Logger.Error("Failed to close SQLite read replica", zap.Error(err))
+		}
+	}
+	if err := tracker.Database.Close(); err != nil {
+		tracker.Logger.Error("Failed to close SQLite database", zap.Error(err))
+	}
+}
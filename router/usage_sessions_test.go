@@ -0,0 +1,122 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func setupSessionTestDatabase(t *testing.T, idleTimeout time.Duration) (*SQLiteSessionUsageTracker, *time.Time) {
+	db, err := sql.Open("sqlite3", "file:sessions.db?mode=memory")
+	if err != nil {
+		t.Fatal("Failed to open SQLite database:", err)
+	}
+	db.SetMaxOpenConns(1)
+
+	now := new(time.Time)
+	tracker := &SQLiteSessionUsageTracker{
+		Database:    db,
+		Logger:      zaptest.NewLogger(t),
+		IdleTimeout: idleTimeout,
+		wallClock:   wallClock{now: func() time.Time { return *now }},
+	}
+	if err := tracker.initSchema(); err != nil {
+		t.Fatal("Failed to initialize schema:", err)
+	}
+	t.Cleanup(tracker.Close)
+
+	return tracker, now
+}
+
+func TestSQLiteSessionUsageTracker(t *testing.T) {
+	tracker, now := setupSessionTestDatabase(t, 10*time.Minute)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	record := func(offset time.Duration, validators ...string) {
+		t.Helper()
+		*now = start.Add(offset)
+		if err := tracker.RecordUsage(validators); err != nil {
+			t.Fatal("Failed to record usage:", err)
+		}
+	}
+
+	// Validator 1 is active for 90 seconds, crossing what would be a bucket boundary
+	record(4*time.Minute, "1", "2")
+	record(5*time.Minute, "1")
+	record(5*time.Minute+30*time.Second, "1")
+	// Validator 2 comes back after the idle timeout, starting a second session
+	record(20*time.Minute, "2")
+	record(23*time.Minute, "2")
+
+	tests := []struct {
+		name     string
+		from     time.Duration
+		to       time.Duration
+		expected map[string]time.Duration
+	}{
+		{"everything", 0, time.Hour, map[string]time.Duration{
+			"1": 90 * time.Second,
+			"2": 3 * time.Minute,
+		}},
+		{"clipped", 5 * time.Minute, 21 * time.Minute, map[string]time.Duration{
+			"1": 30 * time.Second,
+			"2": time.Minute,
+		}},
+		// A single activity is a zero length session, but still reported
+		{"single activity", 0, 4 * time.Minute, map[string]time.Duration{
+			"1": 0,
+			"2": 0,
+		}},
+		{"between sessions", 10 * time.Minute, 15 * time.Minute, map[string]time.Duration{}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := tracker.ViewUsage(start.Add(tc.from), start.Add(tc.to))
+			if err != nil {
+				t.Fatal("Failed to view usage:", err)
+			}
+			if len(result) != len(tc.expected) {
+				t.Fatalf("Expected %d validators, got %v", len(tc.expected), result)
+			}
+			for validator, duration := range tc.expected {
+				usage, ok := result[validator]
+				if !ok || usage != duration {
+					t.Errorf("Expected validator %s to have %v of usage, got %v", validator, duration, usage)
+				}
+			}
+		})
+	}
+}
+
+func TestSQLiteSessionUsageTrackerOutOfOrder(t *testing.T) {
+	tracker, now := setupSessionTestDatabase(t, 10*time.Minute)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	*now = start.Add(time.Minute)
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A concurrent request observed an earlier time, it must not shorten the session
+	*now = start.Add(2 * time.Minute)
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	*now = start.Add(90 * time.Second)
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := tracker.ViewUsage(start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result["1"] != time.Minute {
+		t.Fatalf("Expected a 1 minute session, got %v", result["1"])
+	}
+}
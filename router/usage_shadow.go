@@ -0,0 +1,259 @@
+//go:build ns
+
+package router
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"go.uber.org/zap"
+)
+
+// Number of discrepancies logged per view, largest first
+const maxLoggedShadowDiscrepancies = 10
+
+// UsageShadowOptions configures a shadow backend, which usage is also recorded to
+// and read from, so a migration can be verified before cutting over. Disabled when
+// DSN is empty.
+type UsageShadowOptions struct {
+	DSN string
+	// Usage model of the shadow, defaults to the primary's
+	Model UsageModel
+	// Differences up to Tolerance per validator aren't discrepancies, e.g. when
+	// comparing buckets to sessions
+	Tolerance time.Duration
+}
+
+// ShadowDiscrepancy is the usage of a validator the primary and the shadow disagree on.
+type ShadowDiscrepancy struct {
+	Validator string        `json:"validator"`
+	Primary   time.Duration `json:"primary"`
+	Shadow    time.Duration `json:"shadow"`
+}
+
+func (d ShadowDiscrepancy) difference() time.Duration {
+	if d.Primary > d.Shadow {
+		return d.Primary - d.Shadow
+	}
+	return d.Shadow - d.Primary
+}
+
+// ShadowUsageTracker records usage to both the primary and the shadow tracker.
+// ViewUsage queries both, logs and counts the validators they disagree on, and
+// returns the primary's answer. Failures of the shadow never reach the caller.
+type ShadowUsageTracker struct {
+	Primary UsageTracker
+	Shadow  UsageTracker
+	Logger  *zap.Logger
+	// See UsageShadowOptions.Tolerance
+	Tolerance time.Duration
+
+	// Set when the shadow is rolled out to some operators only, see RolloutShadow. Only
+	// validators enrolled by their operator are recorded to and compared against the
+	// shadow, so the others aren't discrepancies.
+	staged   bool
+	mu       sync.Mutex
+	enrolled map[string]struct{}
+
+	m *metrics.MetricsRegistry
+}
+
+// NewShadowUsageTracker opens the shadow backend configured in shadow, with the
+// remaining settings of opts, and pairs it with primary.
+func NewShadowUsageTracker(logger *zap.Logger, primary UsageTracker, opts UsageTrackerOptions, shadow UsageShadowOptions) *ShadowUsageTracker {
+	opts.DSN = shadow.DSN
+	// The shadow is read from its primary, so views aren't subject to replication delay
+	opts.ReadDSN = ""
+	if shadow.Model != "" {
+		opts.Model = shadow.Model
+	}
+	opts.metricsSubsystem = "usage_shadow_tracker"
+	// Named after the primary's tracker, the options are shared
+	if opts.Name == "" {
+		opts.Name = "shadow"
+	} else {
+		opts.Name += "_shadow"
+	}
+
+	return &ShadowUsageTracker{
+		Primary:   primary,
+		Shadow:    NewUsageTracker(logger, opts),
+		Logger:    opts.logger(logger),
+		Tolerance: shadow.Tolerance,
+		m:         opts.registry("usage_shadow"),
+	}
+}
+
+func (tracker *ShadowUsageTracker) incCounter(name string, n int) {
+	if tracker.m != nil {
+		tracker.m.Counter(name).Add(float64(n))
+	}
+}
+
+// enroll adds validators to the staged rollout of the shadow. The set is bounded by
+// the number of validators using the rescue node, and starts empty on every start.
+func (tracker *ShadowUsageTracker) enroll(indexes []string) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	if tracker.enrolled == nil {
+		tracker.enrolled = make(map[string]struct{})
+	}
+	for _, index := range indexes {
+		tracker.enrolled[index] = struct{}{}
+	}
+}
+
+// shadowed returns the validators of indexes recorded to the shadow.
+func (tracker *ShadowUsageTracker) shadowed(indexes []string) []string {
+	if !tracker.staged {
+		return indexes
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	out := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		if _, ok := tracker.enrolled[index]; ok {
+			out = append(out, index)
+		}
+	}
+	return out
+}
+
+// enrolledUsage returns the usage of enrolled validators, or usage when the shadow
+// isn't staged.
+func (tracker *ShadowUsageTracker) enrolledUsage(usage map[string]time.Duration) map[string]time.Duration {
+	if !tracker.staged {
+		return usage
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	out := make(map[string]time.Duration, len(tracker.enrolled))
+	for validator, d := range usage {
+		if _, ok := tracker.enrolled[validator]; ok {
+			out[validator] = d
+		}
+	}
+	return out
+}
+
+func (tracker *ShadowUsageTracker) RecordUsage(indexes []string) error {
+	err := tracker.Primary.RecordUsage(indexes)
+
+	shadowed := tracker.shadowed(indexes)
+	if len(shadowed) == 0 {
+		return err
+	}
+	if shadowErr := tracker.Shadow.RecordUsage(shadowed); shadowErr != nil {
+		tracker.incCounter("write_errors", 1)
+		tracker.Logger.Warn("Failed to record usage to the shadow backend", zap.Error(shadowErr))
+	}
+
+	return err
+}
+
+func (tracker *ShadowUsageTracker) ViewUsage(from time.Time, to time.Time) (map[string]time.Duration, error) {
+	var wg sync.WaitGroup
+	var shadow map[string]time.Duration
+	var shadowErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		shadow, shadowErr = tracker.Shadow.ViewUsage(from, to)
+	}()
+
+	usage, err := tracker.Primary.ViewUsage(from, to)
+	wg.Wait()
+	if err != nil {
+		// Nothing to compare to
+		return nil, err
+	}
+
+	tracker.incCounter("reads", 1)
+	if shadowErr != nil {
+		tracker.incCounter("read_errors", 1)
+		tracker.Logger.Warn("Failed to view usage from the shadow backend", zap.Error(shadowErr))
+		return usage, nil
+	}
+
+	discrepancies := compareShadowUsage(tracker.enrolledUsage(usage), tracker.enrolledUsage(shadow), tracker.Tolerance)
+	if len(discrepancies) == 0 {
+		return usage, nil
+	}
+
+	tracker.incCounter("mismatched_reads", 1)
+	tracker.incCounter("discrepancies", len(discrepancies))
+	logged := discrepancies[:min(len(discrepancies), maxLoggedShadowDiscrepancies)]
+	tracker.Logger.Warn("Shadow usage differs from the primary",
+		zap.Time("from", from),
+		zap.Time("to", to),
+		zap.Int("validators", len(usage)),
+		zap.Int("discrepancies", len(discrepancies)),
+		zap.Any("largest", logged))
+
+	return usage, nil
+}
+
+// compareShadowUsage returns the validators whose usage differs by more than tolerance,
+// largest difference first.
+func compareShadowUsage(primary map[string]time.Duration, shadow map[string]time.Duration, tolerance time.Duration) []ShadowDiscrepancy {
+	var out []ShadowDiscrepancy
+	for validator, d := range primary {
+		discrepancy := ShadowDiscrepancy{Validator: validator, Primary: d, Shadow: shadow[validator]}
+		if discrepancy.difference() > tolerance {
+			out = append(out, discrepancy)
+		}
+	}
+	for validator, d := range shadow {
+		if _, ok := primary[validator]; ok {
+			continue
+		}
+		discrepancy := ShadowDiscrepancy{Validator: validator, Shadow: d}
+		if discrepancy.difference() > tolerance {
+			out = append(out, discrepancy)
+		}
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].difference(), out[j].difference()
+		if a != b {
+			return a > b
+		}
+		return out[i].Validator < out[j].Validator
+	})
+	return out
+}
+
+func (tracker *ShadowUsageTracker) Close() {
+	tracker.Shadow.Close()
+	tracker.Primary.Close()
+}
+
+// usage returns the tracker usage is recorded to and viewed from, which is the
+// shadow pair during a migration.
+func (pr *ProxyRouter) usage() UsageTracker {
+	if pr.shadow != nil {
+		return pr.shadow
+	}
+	return pr.ut
+}
+
+// initShadow opens the shadow backend, if configured.
+func (pr *ProxyRouter) initShadow() {
+	if pr.UsageShadow.DSN == "" {
+		return
+	}
+	if pr.UsageShadow.DSN == pr.UsageTrackerOptions.DSN {
+		pr.Logger.Fatal("The shadow usage backend must differ from the primary",
+			zap.String("dsn", pr.UsageShadow.DSN))
+	}
+
+	pr.shadow = NewShadowUsageTracker(pr.Logger, pr.ut, pr.UsageTrackerOptions, pr.UsageShadow)
+	pr.shadow.staged = pr.Rollout.Staged(RolloutShadow)
+	pr.Logger.Info("Verifying usage against a shadow backend",
+		zap.Duration("tolerance", pr.UsageShadow.Tolerance))
+}
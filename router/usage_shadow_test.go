@@ -0,0 +1,144 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestCompareShadowUsage(t *testing.T) {
+	primary := map[string]time.Duration{
+		"1": 10 * time.Minute,
+		"2": 10 * time.Minute,
+		"3": 5 * time.Minute,
+	}
+	shadow := map[string]time.Duration{
+		"1": 10 * time.Minute,
+		"2": 12 * time.Minute,
+		"4": 20 * time.Minute,
+	}
+
+	expected := []ShadowDiscrepancy{
+		{Validator: "4", Shadow: 20 * time.Minute},
+		{Validator: "3", Primary: 5 * time.Minute},
+		{Validator: "2", Primary: 10 * time.Minute, Shadow: 12 * time.Minute},
+	}
+	if discrepancies := compareShadowUsage(primary, shadow, 0); !reflect.DeepEqual(discrepancies, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, discrepancies)
+	}
+
+	// Differences within the tolerance are ignored
+	if discrepancies := compareShadowUsage(primary, shadow, 5*time.Minute); !reflect.DeepEqual(discrepancies, expected[:1]) {
+		t.Fatalf("Expected %+v, got %+v", expected[:1], discrepancies)
+	}
+}
+
+func TestShadowUsageTracker(t *testing.T) {
+	newTracker := func() *SQLiteUsageTracker {
+		tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(cleanup)
+		return tracker.(*SQLiteUsageTracker)
+	}
+	primary := newTracker()
+	shadow := newTracker()
+	tracker := &ShadowUsageTracker{
+		Primary: primary,
+		Shadow:  shadow,
+		Logger:  zaptest.NewLogger(t),
+	}
+
+	now := time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC)
+	primary.now = func() time.Time { return now }
+	shadow.now = func() time.Time { return now }
+	if err := tracker.RecordUsage([]string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	// The shadow diverges
+	if err := shadow.RecordUsage([]string{"3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]time.Duration{"1": 5 * time.Minute, "2": 5 * time.Minute}
+	usage, err := tracker.ViewUsage(now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Fatalf("Expected the primary's usage %v, got %v", expected, usage)
+	}
+
+	// Shadow failures don't reach the caller
+	shadow.Faults = &FaultInjector{ErrorRate: 1}
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	usage, err = tracker.ViewUsage(now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(usage, expected) {
+		t.Fatalf("Expected the primary's usage %v, got %v", expected, usage)
+	}
+
+	// Primary failures do
+	shadow.Faults = nil
+	primary.Faults = &FaultInjector{ErrorRate: 1}
+	if err := tracker.RecordUsage([]string{"1"}); !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("Expected an injected fault, got %v", err)
+	}
+	if _, err := tracker.ViewUsage(now, now); !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("Expected an injected fault, got %v", err)
+	}
+}
+
+func TestShadowUsageTrackerLabels(t *testing.T) {
+	namespace := "usage_shadow_test_" + t.Name()
+	_, err := metrics.Init(namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	dir := t.TempDir()
+	opts := UsageTrackerOptions{DSN: "file:" + filepath.Join(dir, "primary.db")}
+	primary := NewUsageTracker(zaptest.NewLogger(t), opts)
+	defer primary.Close()
+	tracker := NewShadowUsageTracker(zaptest.NewLogger(t), primary, opts, UsageShadowOptions{
+		DSN: "file:" + filepath.Join(dir, "shadow.db"),
+	})
+	defer tracker.Shadow.Close()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		namespace + "_usage_tracker_primary_pool_open_connections":        "primary",
+		namespace + "_usage_shadow_tracker_primary_pool_open_connections": "shadow",
+	}
+	for _, family := range families {
+		name, ok := expected[family.GetName()]
+		if !ok {
+			continue
+		}
+		for _, label := range family.GetMetric()[0].GetLabel() {
+			if label.GetName() == "tracker" && label.GetValue() == name {
+				delete(expected, family.GetName())
+			}
+		}
+	}
+	if len(expected) != 0 {
+		t.Fatalf("Expected tracker labels on %v", expected)
+	}
+}
@@ -0,0 +1,374 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"go.uber.org/zap"
+)
+
+// How often SLO observations are flushed to the database
+const sloFlushInterval = time.Minute
+
+// Names of the objectives of an SLOReport
+const (
+	SLOWriteSuccess = "write_success"
+	SLOWriteLatency = "write_latency"
+	SLOSpoolFree    = "spool_free"
+)
+
+// SLOObjectives are the targets the tracker's own reliability is measured against, so
+// the trustworthiness of the usage of a period can be quantified.
+type SLOObjectives struct {
+	// Fraction of usage writes which must succeed, e.g. 0.999
+	WriteSuccess float64
+	// Writes slower than this are slow. Queued writes are measured from when they were
+	// queued to when they were written.
+	WriteLatency time.Duration
+	// Fraction of usage writes which mustn't be slow, e.g. 0.99
+	WriteLatencyTarget float64
+	// Fraction of hours with writes in which usage mustn't be spooled, e.g. 0.99
+	SpoolFree float64
+}
+
+// DefaultSLOObjectives are used for objectives which aren't set.
+var DefaultSLOObjectives = SLOObjectives{
+	WriteSuccess:       0.999,
+	WriteLatency:       500 * time.Millisecond,
+	WriteLatencyTarget: 0.99,
+	SpoolFree:          0.99,
+}
+
+func (objectives SLOObjectives) withDefaults() SLOObjectives {
+	if objectives.WriteSuccess == 0 {
+		objectives.WriteSuccess = DefaultSLOObjectives.WriteSuccess
+	}
+	if objectives.WriteLatency == 0 {
+		objectives.WriteLatency = DefaultSLOObjectives.WriteLatency
+	}
+	if objectives.WriteLatencyTarget == 0 {
+		objectives.WriteLatencyTarget = DefaultSLOObjectives.WriteLatencyTarget
+	}
+	if objectives.SpoolFree == 0 {
+		objectives.SpoolFree = DefaultSLOObjectives.SpoolFree
+	}
+	return objectives
+}
+
+// SLOStatus is how an objective fared over the period of an SLOReport.
+type SLOStatus struct {
+	Name   string  `json:"name"`
+	Target float64 `json:"target"`
+	Good   int64   `json:"good"`
+	Total  int64   `json:"total"`
+	// Good over Total, 1 without events
+	Ratio float64 `json:"ratio"`
+	Met   bool    `json:"met"`
+	// Bad events the target allows over the period
+	ErrorBudget float64 `json:"error_budget"`
+	// Fraction of the error budget left, negative when it's exceeded
+	BudgetRemaining float64 `json:"budget_remaining"`
+}
+
+func newSLOStatus(name string, target float64, good int64, total int64) SLOStatus {
+	status := SLOStatus{
+		Name:            name,
+		Target:          target,
+		Good:            good,
+		Total:           total,
+		Ratio:           1,
+		ErrorBudget:     (1 - target) * float64(total),
+		BudgetRemaining: 1,
+	}
+	if total > 0 {
+		status.Ratio = float64(good) / float64(total)
+	}
+	status.Met = status.Ratio >= target
+	bad := float64(total - good)
+	if status.ErrorBudget > 0 {
+		status.BudgetRemaining = 1 - bad/status.ErrorBudget
+	} else if bad > 0 {
+		status.BudgetRemaining = -1
+	}
+	return status
+}
+
+// SLOReport is the reliability of the tracker over a period, summed over every proxy
+// sharing the usage database. Hours are UTC and included when they overlap the period.
+type SLOReport struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Usage writes, and those which failed or were slow
+	Writes       int64 `json:"writes"`
+	FailedWrites int64 `json:"failed_writes"`
+	SlowWrites   int64 `json:"slow_writes"`
+	// Slowest write
+	MaxLatency time.Duration `json:"max_latency"`
+	// Times usage started being spooled because the write queue was full
+	SpoolActivations int64 `json:"spool_activations"`
+	// Hours with observations, and those in which usage was spooled
+	Hours        int64 `json:"hours"`
+	SpooledHours int64 `json:"spooled_hours"`
+
+	Objectives []SLOStatus `json:"objectives"`
+	// Whether every objective was met
+	Met bool `json:"met"`
+}
+
+type sloHour struct {
+	writes           int64
+	failed           int64
+	slow             int64
+	maxLatency       time.Duration
+	spoolActivations int64
+}
+
+// SLOMonitor measures the tracker's own reliability: the outcome and latency of usage
+// writes, and activations of the write queue's spool. Observations are kept per hour
+// in memory and added to the usage database every minute, so any period can be
+// reported on later. Observations which can't be flushed are kept until they are.
+type SLOMonitor struct {
+	Database   *sql.DB
+	Logger     *zap.Logger
+	Objectives SLOObjectives
+
+	mu sync.Mutex
+	// Observations not flushed yet, per hour in unix seconds
+	pending map[int64]*sloHour
+
+	wallClock
+
+	m *metrics.MetricsRegistry
+}
+
+// NewSLOMonitor creates the SLO table in db if needed. Unset objectives default to
+// DefaultSLOObjectives.
+func NewSLOMonitor(logger *zap.Logger, db *sql.DB, objectives SLOObjectives) (*SLOMonitor, error) {
+	monitor := &SLOMonitor{
+		Database:   db,
+		Logger:     logger,
+		Objectives: objectives.withDefaults(),
+		pending:    make(map[int64]*sloHour),
+		m:          metrics.NewMetricsRegistry("usage_slo"),
+	}
+
+	if err := monitor.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return monitor, nil
+}
+
+func (monitor *SLOMonitor) initSchema() error {
+	// hour is the start of the UTC hour in unix seconds, max_latency is in nanoseconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS usage_slo_hours (
+		hour INTEGER PRIMARY KEY,
+		writes INTEGER NOT NULL DEFAULT 0,
+		failed INTEGER NOT NULL DEFAULT 0,
+		slow INTEGER NOT NULL DEFAULT 0,
+		max_latency INTEGER NOT NULL DEFAULT 0,
+		spool_activations INTEGER NOT NULL DEFAULT 0
+	);
+	`
+
+	_, err := monitor.Database.Exec(createTableSQL)
+	return err
+}
+
+// hour must be called with mu held.
+func (monitor *SLOMonitor) hour() *sloHour {
+	key := monitor.clock().Truncate(time.Hour).Unix()
+	hour, ok := monitor.pending[key]
+	if !ok {
+		hour = &sloHour{}
+		monitor.pending[key] = hour
+	}
+	return hour
+}
+
+// observeWrite records the outcome of a usage write which took latency.
+func (monitor *SLOMonitor) observeWrite(err error, latency time.Duration) {
+	slow := latency > monitor.Objectives.WriteLatency
+
+	monitor.mu.Lock()
+	hour := monitor.hour()
+	hour.writes++
+	if err != nil {
+		hour.failed++
+	}
+	if slow {
+		hour.slow++
+	}
+	hour.maxLatency = max(hour.maxLatency, latency)
+	monitor.mu.Unlock()
+
+	monitor.m.Counter("writes").Inc()
+	if err != nil {
+		monitor.m.Counter("failed_writes").Inc()
+	}
+	if slow {
+		monitor.m.Counter("slow_writes").Inc()
+	}
+}
+
+// observeSpool records that usage started being spooled.
+func (monitor *SLOMonitor) observeSpool() {
+	monitor.mu.Lock()
+	monitor.hour().spoolActivations++
+	monitor.mu.Unlock()
+
+	monitor.m.Counter("spool_activations").Inc()
+}
+
+// Flush adds the pending observations to the database.
+func (monitor *SLOMonitor) Flush() error {
+	monitor.mu.Lock()
+	pending := monitor.pending
+	monitor.pending = make(map[int64]*sloHour)
+	monitor.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := monitor.flush(pending)
+	if err == nil {
+		return nil
+	}
+
+	// Keep them for the next flush
+	monitor.mu.Lock()
+	defer monitor.mu.Unlock()
+	for key, hour := range pending {
+		current, ok := monitor.pending[key]
+		if !ok {
+			monitor.pending[key] = hour
+			continue
+		}
+		current.writes += hour.writes
+		current.failed += hour.failed
+		current.slow += hour.slow
+		current.maxLatency = max(current.maxLatency, hour.maxLatency)
+		current.spoolActivations += hour.spoolActivations
+	}
+	return err
+}
+
+func (monitor *SLOMonitor) flush(pending map[int64]*sloHour) error {
+	tx, err := monitor.Database.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	for key, hour := range pending {
+		_, err := tx.Exec(`
+			INSERT INTO usage_slo_hours (hour, writes, failed, slow, max_latency, spool_activations)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (hour) DO UPDATE SET
+				writes = writes + excluded.writes,
+				failed = failed + excluded.failed,
+				slow = slow + excluded.slow,
+				max_latency = MAX(max_latency, excluded.max_latency),
+				spool_activations = spool_activations + excluded.spool_activations`,
+			key, hour.writes, hour.failed, hour.slow, int64(hour.maxLatency), hour.spoolActivations)
+		if err != nil {
+			return fmt.Errorf("failed to flush SLO observations: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Report flushes pending observations and reports on the hours overlapping from and to.
+func (monitor *SLOMonitor) Report(from time.Time, to time.Time) (*SLOReport, error) {
+	if err := monitor.Flush(); err != nil {
+		return nil, err
+	}
+
+	out := &SLOReport{From: from.UTC(), To: to.UTC()}
+	var maxLatency int64
+	err := monitor.Database.QueryRow(`
+		SELECT
+			COUNT(*),
+			COALESCE(SUM(writes), 0),
+			COALESCE(SUM(failed), 0),
+			COALESCE(SUM(slow), 0),
+			COALESCE(MAX(max_latency), 0),
+			COALESCE(SUM(spool_activations), 0),
+			COALESCE(SUM(spool_activations > 0), 0)
+		FROM usage_slo_hours
+		WHERE hour >= ? AND hour <= ?`,
+		from.Truncate(time.Hour).Unix(), to.Unix()).Scan(
+		&out.Hours, &out.Writes, &out.FailedWrites, &out.SlowWrites, &maxLatency,
+		&out.SpoolActivations, &out.SpooledHours)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SLO observations: %w", err)
+	}
+	out.MaxLatency = time.Duration(maxLatency)
+
+	objectives := monitor.Objectives
+	out.Objectives = []SLOStatus{
+		newSLOStatus(SLOWriteSuccess, objectives.WriteSuccess, out.Writes-out.FailedWrites, out.Writes),
+		newSLOStatus(SLOWriteLatency, objectives.WriteLatencyTarget, out.Writes-out.SlowWrites, out.Writes),
+		newSLOStatus(SLOSpoolFree, objectives.SpoolFree, out.Hours-out.SpooledHours, out.Hours),
+	}
+	out.Met = true
+	for _, status := range out.Objectives {
+		out.Met = out.Met && status.Met
+	}
+	return out, nil
+}
+
+// Run flushes observations every minute until ctx is done.
+func (monitor *SLOMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(sloFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := monitor.Flush(); err != nil {
+			monitor.Logger.Warn("Failed to flush SLO observations", zap.Error(err))
+		}
+	}
+}
+
+// serveUsageSLO reports on the tracker's reliability between from and to.
+func (pr *ProxyRouter) serveUsageSLO(w http.ResponseWriter, r *http.Request) {
+	if pr.slo == nil {
+		http.Error(w, "the usage SLO requires a SQL usage tracker", http.StatusNotImplemented)
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from.After(to) {
+		http.Error(w, "from must not be after to", http.StatusBadRequest)
+		return
+	}
+
+	report, err := pr.slo.Report(from, to)
+	if err != nil {
+		pr.Logger.Error("Failed to report on the usage SLO", zap.Error(err))
+		http.Error(w, "failed to report on the usage SLO", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
@@ -0,0 +1,217 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"go.uber.org/zap/zaptest"
+)
+
+func setupSLOTest(t *testing.T) (*SLOMonitor, *SQLiteUsageTracker) {
+	_, err := metrics.Init("usage_slo_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+	sqlite := tracker.(*SQLiteUsageTracker)
+
+	monitor, err := NewSLOMonitor(zaptest.NewLogger(t), sqlite.Database, SLOObjectives{
+		WriteSuccess: 0.9,
+		WriteLatency: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return monitor, sqlite
+}
+
+func TestSLOReport(t *testing.T) {
+	monitor, sqlite := setupSLOTest(t)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	monitor.now = func() time.Time { return now }
+
+	// 20 writes in the first hour, 1 failed and 1 slow. The queue spooled once.
+	for i := range 20 {
+		var err error
+		if i == 0 {
+			err = errors.New("database is locked")
+		}
+		latency := 10 * time.Millisecond
+		if i == 1 {
+			latency = time.Second
+		}
+		monitor.observeWrite(err, latency)
+	}
+	monitor.observeSpool()
+	if err := monitor.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another proxy adds to the same hour, and the second hour fails entirely
+	other := &SLOMonitor{
+		Database:   sqlite.Database,
+		Logger:     zaptest.NewLogger(t),
+		Objectives: monitor.Objectives,
+		pending:    make(map[int64]*sloHour),
+		wallClock:  wallClock{now: monitor.now},
+		m:          monitor.m,
+	}
+	other.observeWrite(nil, time.Millisecond)
+	if err := other.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	now = start.Add(time.Hour)
+	for range 3 {
+		monitor.observeWrite(errors.New("disk I/O error"), time.Millisecond)
+	}
+
+	report, err := monitor.Report(start, start.Add(30*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Writes != 21 || report.FailedWrites != 1 || report.SlowWrites != 1 || report.MaxLatency != time.Second ||
+		report.SpoolActivations != 1 || report.Hours != 1 || report.SpooledHours != 1 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	success := report.Objectives[0]
+	if success.Name != SLOWriteSuccess || success.Good != 20 || success.Total != 21 || !success.Met ||
+		math.Abs(success.ErrorBudget-2.1) > 1e-9 || math.Abs(success.BudgetRemaining-(1-1/2.1)) > 1e-9 {
+		t.Fatalf("Unexpected write success %+v", success)
+	}
+	// The latency target defaults to 99%, which one slow write of 21 misses
+	if latency := report.Objectives[1]; latency.Name != SLOWriteLatency || latency.Target != 0.99 || latency.Met || latency.BudgetRemaining >= 0 {
+		t.Fatalf("Unexpected write latency %+v", latency)
+	}
+	if spool := report.Objectives[2]; spool.Name != SLOSpoolFree || spool.Good != 0 || spool.Total != 1 || spool.Met {
+		t.Fatalf("Unexpected spool free %+v", spool)
+	}
+	if report.Met {
+		t.Fatal("Expected the report to miss its objectives")
+	}
+
+	// Pending observations are included
+	report, err = monitor.Report(start, start.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Writes != 24 || report.FailedWrites != 4 || report.Hours != 2 || report.Objectives[0].Met {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	// Periods without writes meet every objective
+	report, err = monitor.Report(start.Add(24*time.Hour), start.Add(48*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Writes != 0 || !report.Met {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+}
+
+func TestSLOFlushFailure(t *testing.T) {
+	monitor, sqlite := setupSLOTest(t)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	monitor.now = func() time.Time { return start }
+
+	monitor.observeWrite(nil, time.Millisecond)
+	if _, err := sqlite.Database.Exec("DROP TABLE usage_slo_hours"); err != nil {
+		t.Fatal(err)
+	}
+	if err := monitor.Flush(); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+
+	// Observations are kept until they're flushed
+	monitor.observeWrite(nil, time.Millisecond)
+	if err := monitor.initSchema(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := monitor.Report(start, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Writes != 2 {
+		t.Fatalf("Expected 2 writes, got %d", report.Writes)
+	}
+}
+
+func TestSLOWriteQueue(t *testing.T) {
+	monitor, sqlite := setupSLOTest(t)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	monitor.now = func() time.Time { return now }
+	sqlite.now = monitor.now
+
+	// Not started, so the queue fills up
+	q := newUsageWriteQueue(zaptest.NewLogger(t), sqlite, 5*time.Minute, 1)
+	q.now = monitor.now
+	q.observe = monitor.observeWrite
+	q.onSpool = monitor.observeSpool
+	for _, indexes := range [][]string{{"1"}, {"2"}, {"3"}} {
+		if err := q.RecordUsage(indexes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Queued usage is measured from when it was queued
+	now = now.Add(time.Second)
+	q.drain()
+	report, err := monitor.Report(start, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Writes != 2 || report.SlowWrites != 2 || report.SpoolActivations != 1 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+}
+
+func TestServeUsageSLO(t *testing.T) {
+	monitor, _ := setupSLOTest(t)
+	pr := &ProxyRouter{Logger: zaptest.NewLogger(t)}
+
+	serve := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		pr.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/slo"+query, nil))
+		return rec
+	}
+	query := "?from=2025-01-01T00:00:00Z&to=2025-01-02T00:00:00Z"
+	if rec := serve(query); rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected %d, got %d", http.StatusNotImplemented, rec.Code)
+	}
+
+	pr.slo = monitor
+	monitor.now = func() time.Time { return time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC) }
+	monitor.observeWrite(nil, time.Millisecond)
+	rec := serve(query)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var report SLOReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Writes != 1 || len(report.Objectives) != 3 || !report.Met {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	for _, invalid := range []string{"", "?from=2025-01-02T00:00:00Z&to=2025-01-01T00:00:00Z"} {
+		if rec := serve(invalid); rec.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %d for %q, got %d", http.StatusBadRequest, invalid, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"go.uber.org/zap"
+)
+
+// UsageStartupPolicy selects what happens when the usage database can't be initialized
+// on startup.
+type UsageStartupPolicy string
+
+const (
+	// UsageStartupFailFast exits, so no usage goes untracked. The default.
+	UsageStartupFailFast UsageStartupPolicy = "fail-fast"
+	// UsageStartupRetry retries with backoff for UsageTrackerOptions.StartupRetryFor
+	// before exiting.
+	UsageStartupRetry UsageStartupPolicy = "retry"
+	// UsageStartupDegraded starts without the database and spools usage in memory until
+	// it can be initialized, see SpoolingUsageTracker.
+	UsageStartupDegraded UsageStartupPolicy = "degraded"
+)
+
+const (
+	usageStartupMinBackoff = time.Second
+	usageStartupMaxBackoff = time.Minute
+	// Validator and bucket pairs SpoolingUsageTracker keeps without a MemoryBudget,
+	// further usage is dropped
+	maxSpooledUsage = 1_000_000
+)
+
+// ErrUsageBackendUnavailable is returned when viewing usage before the usage database
+// could be initialized.
+var ErrUsageBackendUnavailable = errors.New("usage database is unavailable")
+
+// StartUsageTracker creates the tracker for opts like NewUsageTracker, handling an
+// unavailable database per opts.StartupPolicy.
+func StartUsageTracker(logger *zap.Logger, opts UsageTrackerOptions) UsageTracker {
+	switch opts.StartupPolicy {
+	case UsageStartupFailFast, "":
+		return NewUsageTracker(logger, opts)
+	case UsageStartupRetry:
+		tracker, err := retryUsageTracker(logger, opts, opts.StartupRetryFor, time.Sleep)
+		if err != nil {
+			logger.Fatal("Failed to initialize database schema",
+				zap.Duration("retried_for", opts.StartupRetryFor),
+				zap.Error(err))
+		}
+		return tracker
+	case UsageStartupDegraded:
+		tracker, err := newUsageTracker(logger, opts)
+		if err == nil {
+			return tracker
+		}
+		logger.Warn("Usage database is unavailable, starting degraded. Usage is spooled in memory until it's reachable, features stored in it stay disabled until restarted",
+			zap.Error(err))
+		return NewSpoolingUsageTracker(logger, opts, err)
+	default:
+		logger.Fatal("Unknown usage startup policy", zap.String("policy", string(opts.StartupPolicy)))
+		return nil
+	}
+}
+
+// retryUsageTracker creates the tracker for opts, retrying with exponential backoff
+// until it succeeds or retryFor has passed.
+func retryUsageTracker(logger *zap.Logger, opts UsageTrackerOptions, retryFor time.Duration, sleep func(time.Duration)) (UsageTracker, error) {
+	deadline := time.Now().Add(retryFor)
+	backoff := usageStartupMinBackoff
+	for attempt := 1; ; attempt++ {
+		tracker, err := newUsageTracker(logger, opts)
+		if err == nil {
+			return tracker, nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, fmt.Errorf("usage database unavailable after %d attempts: %w", attempt, err)
+		}
+
+		logger.Warn("Usage database is unavailable, retrying",
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+		sleep(backoff)
+		backoff = min(backoff*2, usageStartupMaxBackoff)
+	}
+}
+
+// SpoolingUsageTracker stands in for a tracker whose database couldn't be initialized
+// on startup. Usage is spooled in memory per bucket while initialization is retried in
+// the background, then backfilled into the new tracker, which all calls go to from then
+// on. Views fail with ErrUsageBackendUnavailable until then.
+//
+// Only buckets can be backfilled, so sessions miss the spooled usage.
+type SpoolingUsageTracker struct {
+	Logger *zap.Logger
+
+	opts      UsageTrackerOptions
+	precision time.Duration
+
+	mu      sync.Mutex
+	backend UsageTracker
+	lastErr error
+	// Validators per bucket, in unix seconds
+	spool   map[int64]map[string]struct{}
+	spooled int
+	// Bounds spooled, see MemoryBudget
+	limit cacheLimit
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	wallClock
+	// Overrides time.Sleep between attempts in tests
+	sleep func(context.Context, time.Duration)
+	// Overrides newUsageTracker in tests
+	connect func() (UsageTracker, error)
+
+	m *metrics.MetricsRegistry
+}
+
+// NewSpoolingUsageTracker starts initializing the tracker for opts in the background.
+// err is why it failed so far.
+func NewSpoolingUsageTracker(logger *zap.Logger, opts UsageTrackerOptions, err error) *SpoolingUsageTracker {
+	tracker := newSpoolingUsageTracker(logger, opts, err)
+	tracker.start()
+	return tracker
+}
+
+func newSpoolingUsageTracker(logger *zap.Logger, opts UsageTrackerOptions, err error) *SpoolingUsageTracker {
+	precision := opts.Precision
+	if precision == 0 {
+		precision = defaultUsagePrecision
+	}
+	tracker := &SpoolingUsageTracker{
+		Logger:    opts.logger(logger),
+		opts:      opts,
+		precision: precision,
+		lastErr:   err,
+		spool:     make(map[int64]map[string]struct{}),
+		limit:     cacheLimit{max: opts.Memory.Entries(MemoryCacheSpool)},
+		done:      make(chan struct{}),
+		m:         opts.registry("usage_spool"),
+	}
+	tracker.connect = func() (UsageTracker, error) {
+		return newUsageTracker(logger, tracker.opts)
+	}
+	tracker.m.GaugeFunc("spooled", func() float64 {
+		tracker.mu.Lock()
+		defer tracker.mu.Unlock()
+		return float64(tracker.spooled)
+	})
+	return tracker
+}
+
+func (tracker *SpoolingUsageTracker) start() {
+	var ctx context.Context
+	ctx, tracker.cancel = context.WithCancel(context.Background())
+	go tracker.run(ctx)
+}
+
+func (tracker *SpoolingUsageTracker) wait(ctx context.Context, d time.Duration) {
+	if tracker.sleep != nil {
+		tracker.sleep(ctx, d)
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+func (tracker *SpoolingUsageTracker) RecordUsage(indexes []string) error {
+	tracker.mu.Lock()
+	backend := tracker.backend
+	if backend != nil {
+		tracker.mu.Unlock()
+		return backend.RecordUsage(indexes)
+	}
+	defer tracker.mu.Unlock()
+
+	bucket := tracker.clock().Truncate(tracker.precision).Unix()
+	validators, ok := tracker.spool[bucket]
+	if !ok {
+		validators = make(map[string]struct{})
+		tracker.spool[bucket] = validators
+	}
+	dropped := 0
+	for _, index := range indexes {
+		if _, ok := validators[index]; ok {
+			continue
+		}
+		if tracker.limit.full(tracker.spooled) {
+			dropped++
+			continue
+		}
+		validators[index] = struct{}{}
+		tracker.spooled++
+	}
+	tracker.limit.evictions.Add(uint64(dropped))
+	if dropped > 0 {
+		tracker.m.Counter("dropped").Add(float64(dropped))
+		return fmt.Errorf("%w and the spool is full, %d validators dropped", ErrUsageBackendUnavailable, dropped)
+	}
+	return nil
+}
+
+func (tracker *SpoolingUsageTracker) ViewUsage(from time.Time, to time.Time) (map[string]time.Duration, error) {
+	tracker.mu.Lock()
+	backend := tracker.backend
+	tracker.mu.Unlock()
+	if backend == nil {
+		return nil, ErrUsageBackendUnavailable
+	}
+	return backend.ViewUsage(from, to)
+}
+
+// HealthCheck reports the primary database down with the last initialization error
+// until the tracker is initialized.
+func (tracker *SpoolingUsageTracker) HealthCheck(ctx context.Context) map[UsageDBRole]error {
+	tracker.mu.Lock()
+	backend, lastErr := tracker.backend, tracker.lastErr
+	tracker.mu.Unlock()
+	if backend == nil {
+		return map[UsageDBRole]error{UsageDBPrimary: lastErr}
+	}
+	if checker, ok := backend.(usageHealthChecker); ok {
+		return checker.HealthCheck(ctx)
+	}
+	return map[UsageDBRole]error{}
+}
+
+func (tracker *SpoolingUsageTracker) Close() {
+	if tracker.cancel != nil {
+		tracker.cancel()
+		<-tracker.done
+	}
+	tracker.m.UnregisterAll()
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.backend != nil {
+		tracker.backend.Close()
+	}
+	if tracker.spooled > 0 {
+		tracker.Logger.Warn("Closed with spooled usage, it won't be recorded", zap.Int("spooled", tracker.spooled))
+	}
+}
+
+// run initializes the tracker with backoff until it succeeds or ctx is done.
+func (tracker *SpoolingUsageTracker) run(ctx context.Context) {
+	defer close(tracker.done)
+
+	backoff := usageStartupMinBackoff
+	for {
+		tracker.wait(ctx, backoff)
+		if ctx.Err() != nil {
+			return
+		}
+		if tracker.attach() {
+			return
+		}
+		backoff = min(backoff*2, usageStartupMaxBackoff)
+	}
+}
+
+// attach initializes the tracker and backfills the spool into it. Returns false if
+// either fails, keeping what wasn't backfilled.
+func (tracker *SpoolingUsageTracker) attach() bool {
+	backend, err := tracker.connect()
+	if err != nil {
+		tracker.mu.Lock()
+		tracker.lastErr = err
+		tracker.mu.Unlock()
+		tracker.Logger.Warn("Usage database is still unavailable", zap.Error(err))
+		return false
+	}
+
+	// Holding the lock keeps new usage in the spool until it's backfilled
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if err := tracker.backfill(backend); err != nil {
+		backend.Close()
+		tracker.lastErr = err
+		tracker.Logger.Warn("Failed to backfill spooled usage", zap.Error(err))
+		return false
+	}
+
+	tracker.backend = backend
+	tracker.lastErr = nil
+	tracker.Logger.Info("Usage database is available, left degraded startup")
+	return true
+}
+
+// backfill must be called with mu held.
+func (tracker *SpoolingUsageTracker) backfill(backend UsageTracker) error {
+	if tracker.spooled == 0 {
+		return nil
+	}
+	backfiller, ok := backend.(UsageBackfiller)
+	if !ok {
+		return fmt.Errorf("the %s usage model can't be backfilled", tracker.opts.Model)
+	}
+
+	buckets := make([]int64, 0, len(tracker.spool))
+	for bucket := range tracker.spool {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+
+	backfilled := 0
+	for _, bucket := range buckets {
+		validators := make([]string, 0, len(tracker.spool[bucket]))
+		for validator := range tracker.spool[bucket] {
+			validators = append(validators, validator)
+		}
+		if err := backfiller.RecordUsageAt(time.Unix(bucket, 0), validators); err != nil {
+			return err
+		}
+		delete(tracker.spool, bucket)
+		tracker.spooled -= len(validators)
+		backfilled += len(validators)
+	}
+
+	tracker.Logger.Info("Backfilled spooled usage",
+		zap.Int("buckets", len(buckets)),
+		zap.Int("validators", backfilled))
+	return nil
+}
+
+func (tracker *SpoolingUsageTracker) cacheEntries() int {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return tracker.spooled
+}
+
+func (tracker *SpoolingUsageTracker) cacheEvictions() uint64 {
+	return tracker.limit.evictions.Load()
+}
@@ -0,0 +1,164 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"go.uber.org/zap/zaptest"
+)
+
+// unreachableUsageOptions point at a database in a directory that doesn't exist yet.
+func unreachableUsageOptions(t *testing.T) (UsageTrackerOptions, string) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	return UsageTrackerOptions{
+		DSN:       "file:" + filepath.Join(dir, "usage.db"),
+		Precision: 5 * time.Minute,
+	}, dir
+}
+
+func TestRetryUsageTrackerGivesUp(t *testing.T) {
+	opts, _ := unreachableUsageOptions(t)
+
+	synctest.Run(func() {
+		start := time.Now()
+		_, err := retryUsageTracker(zaptest.NewLogger(t), opts, 10*time.Second, time.Sleep)
+		if err == nil {
+			t.Fatal("Expected the tracker to fail")
+		}
+		// Attempts at 0s, 1s, 3s and 7s, the next one would be past the deadline
+		if elapsed := time.Since(start); elapsed != 7*time.Second {
+			t.Fatalf("Expected to give up after 7s, got %v: %v", elapsed, err)
+		}
+	})
+}
+
+func TestRetryUsageTrackerRecovers(t *testing.T) {
+	_, err := metrics.Init("usage_startup_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	opts, dir := unreachableUsageOptions(t)
+	var sleeps []time.Duration
+	sleep := func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		if len(sleeps) == 2 {
+			if err := os.Mkdir(dir, 0o700); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tracker, err := retryUsageTracker(zaptest.NewLogger(t), opts, time.Hour, sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+	if len(sleeps) != 2 || sleeps[0] != time.Second || sleeps[1] != 2*time.Second {
+		t.Fatalf("Expected to back off for 1s and 2s, got %v", sleeps)
+	}
+}
+
+func TestSpoolingUsageTracker(t *testing.T) {
+	_, err := metrics.Init("usage_startup_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	opts, dir := unreachableUsageOptions(t)
+	_, initErr := newUsageTracker(zaptest.NewLogger(t), opts)
+	if initErr == nil {
+		t.Fatal("Expected the database to be unreachable")
+	}
+
+	tracker := newSpoolingUsageTracker(zaptest.NewLogger(t), opts, initErr)
+	defer tracker.Close()
+	now := time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	for _, validators := range [][]string{{"1", "2"}, {"1"}} {
+		if err := tracker.RecordUsage(validators); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(5 * time.Minute)
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if tracker.spooled != 3 {
+		t.Fatalf("Expected 3 validators spooled, got %d", tracker.spooled)
+	}
+
+	from, to := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 1, 0, 0, 0, time.UTC)
+	if _, err := tracker.ViewUsage(from, to); !errors.Is(err, ErrUsageBackendUnavailable) {
+		t.Fatalf("Expected ErrUsageBackendUnavailable, got %v", err)
+	}
+	if health := tracker.HealthCheck(context.Background()); health[UsageDBPrimary] == nil {
+		t.Fatalf("Expected the primary database to be down, got %v", health)
+	}
+
+	if tracker.attach() {
+		t.Fatal("Expected the database to still be unreachable")
+	}
+	if tracker.spooled != 3 {
+		t.Fatalf("Expected the spool to be kept, got %d", tracker.spooled)
+	}
+
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if !tracker.attach() {
+		t.Fatal("Expected the database to be reachable")
+	}
+	if tracker.spooled != 0 {
+		t.Fatalf("Expected the spool to be backfilled, got %d left", tracker.spooled)
+	}
+	if health := tracker.HealthCheck(context.Background()); health[UsageDBPrimary] != nil {
+		t.Fatalf("Expected the primary database to be up, got %v", health)
+	}
+
+	// Usage goes straight to the database from now on
+	tracker.backend.(*SQLiteUsageTracker).now = tracker.now
+	now = now.Add(5 * time.Minute)
+	if err := tracker.RecordUsage([]string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := tracker.ViewUsage(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] != 10*time.Minute || usage["2"] != 10*time.Minute {
+		t.Fatalf("Expected spooled and live usage, got %v", usage)
+	}
+}
+
+func TestSpoolingUsageTrackerFull(t *testing.T) {
+	_, err := metrics.Init("usage_startup_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	tracker := newSpoolingUsageTracker(zaptest.NewLogger(t), UsageTrackerOptions{}, errors.New("down"))
+	defer tracker.Close()
+	tracker.spooled = maxSpooledUsage - 1
+
+	err = tracker.RecordUsage([]string{"1", "2"})
+	if !errors.Is(err, ErrUsageBackendUnavailable) {
+		t.Fatalf("Expected usage to be dropped, got %v", err)
+	}
+	if tracker.spooled != maxSpooledUsage {
+		t.Fatalf("Expected the spool to be full, got %d", tracker.spooled)
+	}
+}
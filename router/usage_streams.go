@@ -0,0 +1,64 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// streamHeartbeat is how often the usage of open streams is recorded: once per
+// bucket, or at the default precision for unbucketed usage models.
+func (pr *ProxyRouter) streamHeartbeat() time.Duration {
+	if buckets, ok := pr.ut.(usageBuckets); ok {
+		return buckets.bucketPrecision()
+	}
+	return defaultUsagePrecision
+}
+
+// recordStreamUsage records the usage of a stream every heartbeat until ctx, the
+// context of its request, is done. The usage at connection time is recorded by the caller.
+func (pr *ProxyRouter) recordStreamUsage(ctx context.Context, authInfo authInfo, kind string, indices []string) {
+	if pr.m != nil {
+		open := pr.m.Gauge("usage_open_streams")
+		open.Inc()
+		defer open.Dec()
+	}
+
+	ticker := time.NewTicker(pr.streamHeartbeat())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pr.recordUsage(authInfo, kind, indices)
+		}
+	}
+}
+
+// nodeValidators returns the validators attributed to node within maxAge.
+func (pr *ProxyRouter) nodeValidators(node common.Address, maxAge time.Duration) ([]string, error) {
+	if pr.attr == nil {
+		return nil, errors.New("usage attribution is disabled")
+	}
+
+	attributions, err := pr.attr.Validators(node)
+	if err != nil {
+		return nil, err
+	}
+
+	since := pr.attr.clock().Add(-maxAge)
+	out := make([]string, 0, len(attributions))
+	for _, attribution := range attributions {
+		if attribution.LastSeen.Before(since) {
+			continue
+		}
+		out = append(out, attribution.Validator)
+	}
+	return out, nil
+}
@@ -0,0 +1,94 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestRecordStreamUsage(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	node := common.HexToAddress("0x0000000000000000000000000000000000000002")
+
+	synctest.Run(func() {
+		start := time.Now()
+		ctx, cancel := context.WithCancel(context.Background())
+		go pr.recordStreamUsage(ctx, authInfo{nodeAddr: node}, "events", []string{"1"})
+
+		// Heartbeats at 00:05 and 00:10
+		time.Sleep(11 * time.Minute)
+		cancel()
+		synctest.Wait()
+
+		// Nothing is recorded once the stream is closed
+		time.Sleep(time.Hour)
+		synctest.Wait()
+
+		usage, err := tracker.ViewUsage(start, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage["1"] != 10*time.Minute {
+			t.Fatalf("Expected 2 buckets, got %v", usage)
+		}
+	})
+}
+
+func TestNodeValidators(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	node := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	if _, err := pr.nodeValidators(node, time.Hour); err == nil {
+		t.Fatal("Expected an error without attribution")
+	}
+
+	attr, err := NewAttributionStore(pr.Logger, tracker.(*SQLiteUsageTracker).primaryDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	attr.now = func() time.Time { return now }
+	pr.attr = attr
+
+	if err := attr.Attribute(node, []string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Hour)
+	if err := attr.Attribute(node, []string{"2", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := attr.Attribute(common.HexToAddress("0x0000000000000000000000000000000000000003"), []string{"4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	validators, err := pr.nodeValidators(node, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(validators) != 2 || validators[0] != "2" || validators[1] != "3" {
+		t.Fatalf("Unexpected validators %v", validators)
+	}
+}
@@ -0,0 +1,228 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+// ErrTenantRequired is returned for writes without a tenant in multi-tenant mode.
+var ErrTenantRequired = errors.New("usage must be recorded for a tenant in multi-tenant mode")
+
+// maxUntenantedNodes is how many nodes outside every organization are remembered
+// without a memory budget, see untenantedNodes.
+const maxUntenantedNodes = 10_000
+
+// tenantUsageStore is implemented by trackers which keep the tenant of each record, so
+// tenants' usage can be written and read without crossing into another's.
+type tenantUsageStore interface {
+	// RecordTenantUsage records usage of tenant in the current bucket.
+	RecordTenantUsage(tenant string, indexes []string) error
+	// ViewTenantUsage is ViewUsage restricted to the records of tenant.
+	ViewTenantUsage(tenant string, from time.Time, to time.Time) (map[string]time.Duration, error)
+}
+
+// migrateUsageTenant adds the tenant column to usage tables created before it existed.
+// Existing records belong to no tenant.
+func migrateUsageTenant(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('validator_usage')")
+	if err != nil {
+		return fmt.Errorf("failed to read the usage schema: %w", err)
+	}
+	defer rows.Close()
+
+	migrated := false
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return err
+		}
+		if column == "tenant" {
+			migrated = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if migrated {
+		return nil
+	}
+	if _, err := db.Exec("ALTER TABLE validator_usage ADD COLUMN tenant TEXT NOT NULL DEFAULT ''"); err != nil {
+		return fmt.Errorf("failed to add the tenant column: %w", err)
+	}
+	return nil
+}
+
+// migrateUsageTenantKey rebuilds usage tables whose primary key doesn't include the
+// tenant, which kept a single tenant's record of each validator per bucket. SQLite can't
+// alter a primary key, so the records are copied to a new table, keeping their rowids
+// for incremental exports. It runs after the columns were added by the other usage
+// migrations, and leaves the indexes to be created again.
+func migrateUsageTenantKey(db *sql.DB) error {
+	var keyed bool
+	err := db.QueryRow("SELECT pk > 0 FROM pragma_table_info('validator_usage') WHERE name = 'tenant'").Scan(&keyed)
+	if err != nil {
+		return fmt.Errorf("failed to read the usage schema: %w", err)
+	}
+	if keyed {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []string{`
+	CREATE TABLE validator_usage_rekeyed (
+		timestamp DATETIME NOT NULL,
+		validator_index TEXT NOT NULL,
+		tenant TEXT NOT NULL DEFAULT '',
+		first_offset_ms INTEGER,
+		last_offset_ms INTEGER,
+		PRIMARY KEY (timestamp, validator_index, tenant)
+	)`, `
+	INSERT INTO validator_usage_rekeyed (rowid, timestamp, validator_index, tenant, first_offset_ms, last_offset_ms)
+	SELECT rowid, timestamp, validator_index, tenant, first_offset_ms, last_offset_ms FROM validator_usage`,
+		"DROP TABLE validator_usage",
+		"ALTER TABLE validator_usage_rekeyed RENAME TO validator_usage",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to add the tenant to the usage primary key: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// RecordTenantUsage records usage of tenant. Tenants recording the same validator in
+// the same bucket each keep their record.
+func (tracker *SQLiteUsageTracker) RecordTenantUsage(tenant string, indexes []string) error {
+	if tenant == "" {
+		return ErrTenantRequired
+	}
+	return tracker.recordLiveUsage(tenant, indexes)
+}
+
+func (tracker *SQLiteUsageTracker) ViewTenantUsage(tenant string, from time.Time, to time.Time) (map[string]time.Duration, error) {
+	if err := ValidatePrecision(tracker.Precision); err != nil {
+		return nil, err
+	}
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+	if err := tracker.Faults.read(); err != nil {
+		return nil, err
+	}
+	if tracker.closed.Load() {
+		return nil, ErrTrackerClosed
+	}
+
+	fromUnix := from.Truncate(tracker.Precision).Unix()
+	toUnix := to.Truncate(tracker.Precision).Unix()
+	if tracker.Occupancy {
+		return tracker.viewTenantOccupancy(tenant, fromUnix, toUnix)
+	}
+
+	rows, err := tracker.readDB().Query(`
+	SELECT validator_index, COUNT(*)
+	FROM validator_usage
+	WHERE tenant = ? AND timestamp >= datetime(?, 'unixepoch') AND timestamp <= datetime(?, 'unixepoch')
+	GROUP BY validator_index
+	`, tenant, fromUnix, toUnix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tenant usage: %w", err)
+	}
+	defer rows.Close()
+
+	out := make(map[string]time.Duration)
+	for rows.Next() {
+		var validator string
+		var count int64
+		if err := rows.Scan(&validator, &count); err != nil {
+			return nil, err
+		}
+		out[validator] = time.Duration(count) * tracker.Precision
+	}
+
+	return out, rows.Err()
+}
+
+// initMultiTenant checks the usage backend can keep tenants apart.
+func (pr *ProxyRouter) initMultiTenant() {
+	if err := requireCapability(pr.usage(), "multi-tenant mode", UsageCapabilityTenants); err != nil {
+		pr.Logger.Fatal("Failed to enable multi-tenant mode", zap.Error(err))
+	}
+	if pr.orgs == nil {
+		pr.Logger.Fatal("Multi-tenant mode requires a SQL usage tracker")
+	}
+	pr.untenanted.limit.max = pr.MemoryBudget.Entries(MemoryCacheUntenanted)
+}
+
+// untenantedNodes remembers the nodes outside every organization whose usage wasn't
+// recorded, so each is only logged once while remembered. The least recently seen are
+// forgotten first once the limit is reached.
+type untenantedNodes struct {
+	mu sync.Mutex
+	// When each node was last seen, by address
+	seen  map[string]time.Time
+	limit cacheLimit
+}
+
+// see marks node as seen at now, and returns whether it was already remembered.
+func (u *untenantedNodes) see(node common.Address, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.seen == nil {
+		u.seen = make(map[string]time.Time)
+	}
+
+	key := node.Hex()
+	_, ok := u.seen[key]
+	if !ok && u.limit.full(len(u.seen)) {
+		u.limit.evict(u.seen, time.Time{})
+	}
+	u.seen[key] = now
+	return ok
+}
+
+func (u *untenantedNodes) cacheEntries() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return len(u.seen)
+}
+
+func (u *untenantedNodes) cacheEvictions() uint64 {
+	return u.limit.evictions.Load()
+}
+
+// recordTenantUsage records usage for the organization of node. Usage of nodes outside
+// every organization belongs to no tenant and isn't recorded, so it returns false.
+func (pr *ProxyRouter) recordTenantUsage(node common.Address, indices []string) (bool, error) {
+	tenant, err := pr.orgs.OrganizationOf(node)
+	if errors.Is(err, ErrNotMember) {
+		pr.m.Counter("usage_without_tenant").Inc()
+		// Nodes outside every organization keep making requests, so they're only
+		// logged the first time
+		if logged := pr.untenanted.see(node, time.Now()); !logged {
+			pr.Logger.Warn("Not recording usage of a node outside every organization",
+				zap.String("node", node.Hex()),
+				zap.Int("validators", len(indices)))
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, pr.usage().(tenantUsageStore).RecordTenantUsage(tenant, indices)
+}
@@ -0,0 +1,296 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestUsageTenantMigration(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:tenant_migration.db?mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	// Schema and records from before tenants
+	_, err = db.Exec(`
+	CREATE TABLE validator_usage (
+		timestamp DATETIME NOT NULL,
+		validator_index TEXT NOT NULL,
+		PRIMARY KEY (timestamp, validator_index)
+	);
+	INSERT INTO validator_usage (timestamp, validator_index) VALUES (datetime(0, 'unixepoch'), '1');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := &SQLiteUsageTracker{Database: db, Logger: zaptest.NewLogger(t), Precision: 5 * time.Minute}
+	defer tracker.Close()
+	// Migrating twice is a no-op
+	for i := 0; i < 2; i++ {
+		if err := tracker.initSchema(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tenant string
+	if err := db.QueryRow("SELECT tenant FROM validator_usage WHERE validator_index = '1'").Scan(&tenant); err != nil {
+		t.Fatal(err)
+	}
+	if tenant != "" {
+		t.Fatalf("Expected existing records to belong to no tenant, got %q", tenant)
+	}
+	if err := tracker.RecordTenantUsage("acme", []string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tenant is part of the primary key, and rowids are kept for exports
+	var keyed bool
+	if err := db.QueryRow("SELECT pk > 0 FROM pragma_table_info('validator_usage') WHERE name = 'tenant'").Scan(&keyed); err != nil || !keyed {
+		t.Fatalf("Expected the tenant in the primary key, got %v: %v", keyed, err)
+	}
+	export, err := tracker.ExportSince(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Records) != 2 || export.Records[0].Cursor != 1 || export.Records[0].Validator != "1" {
+		t.Fatalf("Unexpected records after the migration %+v", export.Records)
+	}
+}
+
+func TestMultiTenantWrites(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+	sqlite.MultiTenant = true
+
+	if err := sqlite.RecordUsage([]string{"1"}); !errors.Is(err, ErrTenantRequired) {
+		t.Fatal("Expected ErrTenantRequired without a tenant, got", err)
+	}
+	if err := sqlite.RecordUsageAt(time.Now(), []string{"1"}); !errors.Is(err, ErrTenantRequired) {
+		t.Fatal("Expected ErrTenantRequired for a backfill, got", err)
+	}
+	if err := sqlite.RecordTenantUsage("", []string{"1"}); !errors.Is(err, ErrTenantRequired) {
+		t.Fatal("Expected ErrTenantRequired for an empty tenant, got", err)
+	}
+
+	if err := sqlite.RecordTenantUsage("a", []string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sqlite.RecordTenantUsage("b", []string{"3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	usage, err := sqlite.ViewTenantUsage("a", now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || usage["1"] != 5*time.Minute || usage["2"] != 5*time.Minute {
+		t.Fatalf("Unexpected usage of tenant a %v", usage)
+	}
+	if usage, err := sqlite.ViewTenantUsage("c", now, now); err != nil || len(usage) != 0 {
+		t.Fatalf("Expected no usage for tenant c, got %v: %v", usage, err)
+	}
+
+	// A validator recorded by two tenants in a bucket is kept for both, and only counts
+	// once overall
+	if err := sqlite.RecordTenantUsage("b", []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err := sqlite.ViewTenantUsage("b", now, now); err != nil || usage["1"] != 5*time.Minute {
+		t.Fatalf("Expected tenant b to keep its usage of validator 1, got %v: %v", usage, err)
+	}
+	if usage, err := sqlite.ViewTenantUsage("a", now, now); err != nil || usage["1"] != 5*time.Minute {
+		t.Fatalf("Expected tenant a to keep its usage of validator 1, got %v: %v", usage, err)
+	}
+	if usage, err := sqlite.ViewUsage(now, now); err != nil || usage["1"] != 5*time.Minute {
+		t.Fatalf("Expected validator 1 to be counted once, got %v: %v", usage, err)
+	}
+	export, err := sqlite.ExportSince(0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Records) != 3 {
+		t.Fatalf("Expected each bucket to be exported once, got %+v", export.Records)
+	}
+}
+
+func TestTenantUsageOccupancy(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:tenant_occupancy.db?mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	tracker := &SQLiteUsageTracker{
+		Database:    db,
+		Logger:      zaptest.NewLogger(t),
+		Precision:   5 * time.Minute,
+		Occupancy:   true,
+		MultiTenant: true,
+		wallClock:   wallClock{now: func() time.Time { return now }},
+	}
+	if err := tracker.initSchema(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tracker.closeStatements)
+	record := func(tenant string, offset time.Duration) {
+		now = start.Add(offset)
+		if err := tracker.RecordTenantUsage(tenant, []string{"1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	record("a", 0)
+	record("a", time.Minute)
+	record("b", 4*time.Minute)
+
+	// Each tenant is credited with its own activity only
+	for tenant, expected := range map[string]time.Duration{
+		"a": time.Minute + occupancyMinimum,
+		"b": occupancyMinimum,
+	} {
+		usage, err := tracker.ViewTenantUsage(tenant, start, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage["1"] != expected {
+			t.Fatalf("Expected %v of usage for tenant %s, got %v", expected, tenant, usage)
+		}
+	}
+	if usage, err := tracker.ViewUsage(start, start); err != nil || usage["1"] != 4*time.Minute+occupancyMinimum {
+		t.Fatalf("Expected the activity of both tenants overall, got %v: %v", usage, err)
+	}
+}
+
+// TestTenantIsolation requests every route of the tenant API with the key of one tenant
+// and checks no response mentions the validators or node addresses of another.
+func TestTenantIsolation(t *testing.T) {
+	metrics.Init("x_test_" + t.Name())
+	t.Cleanup(metrics.Deinit)
+
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+	sqlite.MultiTenant = true
+	db := sqlite.primaryDatabase()
+	logger := zaptest.NewLogger(t)
+
+	pr := &ProxyRouter{
+		Logger:              logger,
+		ut:                  tracker,
+		m:                   metrics.NewMetricsRegistry("http_proxy"),
+		UsageTrackerOptions: UsageTrackerOptions{MultiTenant: true},
+	}
+	if pr.orgs, err = NewOrganizationStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+	if pr.attr, err = NewAttributionStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+	if pr.tenantKeys, err = NewTenantKeyStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+	if pr.operatorDaily, err = NewOperatorDailyStore(logger, db); err != nil {
+		t.Fatal(err)
+	}
+
+	nodeA := common.HexToAddress("0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	nodeB := common.HexToAddress("0xbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb")
+	outsider := common.HexToAddress("0xcccccccccccccccccccccccccccccccccccccccc")
+	for org, node := range map[string]common.Address{"a": nodeA, "b": nodeB} {
+		if err := pr.orgs.Put(&Organization{ID: org, Name: org}); err != nil {
+			t.Fatal(err)
+		}
+		if err := pr.orgs.AddMember(org, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keyA, err := pr.tenantKeys.Create("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Validator 222222 is used by both tenants, and recorded for each
+	pr.recordUsage(authInfo{nodeAddr: nodeB}, "test", []string{"111111", "222222"})
+	pr.recordUsage(authInfo{nodeAddr: nodeA}, "test", []string{"333333", "222222"})
+	pr.recordUsage(authInfo{nodeAddr: outsider}, "test", []string{"444444"})
+	var records int
+	if err := db.QueryRow("SELECT COUNT(*) FROM validator_usage WHERE tenant = ''").Scan(&records); err != nil || records != 0 {
+		t.Fatalf("Expected no usage without a tenant, got %d: %v", records, err)
+	}
+
+	job := &OperatorDailyJob{
+		Tracker:     sqlite,
+		Attribution: pr.attr,
+		Store:       pr.operatorDaily,
+		Interval:    time.Hour,
+		Logger:      logger,
+		wallClock:   wallClock{now: func() time.Time { return time.Now().Add(24 * time.Hour) }},
+	}
+	if _, err := job.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	forbidden := []string{"111111", "444444", nodeB.Hex(), strings.ToLower(nodeB.Hex()), outsider.Hex(), `"b"`}
+	query := "?from=" + time.Now().Add(-time.Hour).UTC().Format(time.RFC3339) + "&to=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	handler := pr.TenantHandler()
+	routes := 0
+	err = handler.(*mux.Router).Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		routes++
+
+		r := httptest.NewRequest(http.MethodGet, path+query, nil)
+		r.Header.Set("Authorization", "Bearer "+keyA.Key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected %d for %s, got %d: %s", http.StatusOK, path, rec.Code, rec.Body.String())
+		}
+		body, err := io.ReadAll(rec.Body)
+		if err != nil {
+			return err
+		}
+		if path == "/usage" && (!strings.Contains(string(body), "333333") || !strings.Contains(string(body), "222222")) {
+			t.Fatalf("Expected the usage of tenant a, got %s", body)
+		}
+		for _, s := range forbidden {
+			if strings.Contains(string(body), s) {
+				t.Fatalf("%s leaked %s to tenant a: %s", path, s, body)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes == 0 {
+		t.Fatal("Expected tenant routes")
+	}
+}
@@ -3,16 +3,21 @@
 package router
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
 	"github.com/Rocket-Rescue-Node/rescue-proxy/test"
 	"math/rand"
+	"path/filepath"
 	"testing"
 	"testing/synctest"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/rocket-pool/rocketpool-go/types"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
 )
 
@@ -152,6 +157,447 @@ func TestSQLiteUsageTrackerEmptyRange(t *testing.T) {
 	t.Log("Test passed: empty range returns empty result")
 }
 
+func TestSQLiteUsageTrackerRangeBoundaries(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal("Failed to set up test database:", err)
+	}
+	defer cleanup()
+
+	validators := []string{"1"}
+
+	synctest.Run(func() {
+		// The bubble's clock starts at midnight, so buckets begin at 00:00, 00:05 and 00:10
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			if err := tracker.RecordUsage(validators); err != nil {
+				t.Fatal("Failed to record usage:", err)
+			}
+			time.Sleep(5 * time.Minute)
+		}
+
+		tests := []struct {
+			name     string
+			from     time.Duration
+			to       time.Duration
+			expected time.Duration
+		}{
+			{"all buckets", 0, 10 * time.Minute, 15 * time.Minute},
+			{"straddling both edges", 2 * time.Minute, 7 * time.Minute, 10 * time.Minute},
+			{"single instant on a boundary", 5 * time.Minute, 5 * time.Minute, 5 * time.Minute},
+			{"single instant inside a bucket", 7 * time.Minute, 7 * time.Minute, 5 * time.Minute},
+			{"ends just after a boundary", 5*time.Minute - time.Millisecond, 5 * time.Minute, 10 * time.Minute},
+			{"starts just after a boundary", 10*time.Minute + time.Millisecond, time.Hour, 5 * time.Minute},
+			{"after all buckets", 15 * time.Minute, time.Hour, 0},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				result, err := tracker.ViewUsage(start.Add(tc.from), start.Add(tc.to))
+				if err != nil {
+					t.Fatal("Failed to view usage:", err)
+				}
+				if result[validators[0]] != tc.expected {
+					t.Fatalf("Expected %v of usage, got %v", tc.expected, result[validators[0]])
+				}
+			})
+		}
+	})
+}
+
+func TestSQLiteUsageTrackerInvalidRange(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal("Failed to set up test database:", err)
+	}
+	defer cleanup()
+
+	now := time.Now()
+	tests := []struct {
+		name     string
+		from     time.Time
+		to       time.Time
+		expected error
+	}{
+		{"zero from", time.Time{}, now, ErrZeroTime},
+		{"zero to", now, time.Time{}, ErrZeroTime},
+		{"both zero", time.Time{}, time.Time{}, ErrZeroTime},
+		{"inverted", now, now.Add(-time.Nanosecond), ErrInvertedRange},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tracker.ViewUsage(tc.from, tc.to)
+			if !errors.Is(err, tc.expected) {
+				t.Fatalf("Expected %v, got %v", tc.expected, err)
+			}
+
+			var rangeErr *RangeError
+			if !errors.As(err, &rangeErr) {
+				t.Fatalf("Expected a *RangeError, got %T", err)
+			}
+			if !rangeErr.From.Equal(tc.from) || !rangeErr.To.Equal(tc.to) {
+				t.Fatalf("RangeError doesn't carry the requested range: %v", rangeErr)
+			}
+		})
+	}
+}
+
+func TestValidatePrecision(t *testing.T) {
+	tests := []struct {
+		precision time.Duration
+		valid     bool
+	}{
+		{-time.Minute, false},
+		{0, false},
+		{time.Millisecond, false},
+		{MinUsagePrecision, true},
+		{5 * time.Minute, true},
+		{MaxUsagePrecision, true},
+		{MaxUsagePrecision + time.Nanosecond, false},
+	}
+
+	for _, tc := range tests {
+		err := ValidatePrecision(tc.precision)
+		if tc.valid && err != nil {
+			t.Errorf("Expected %v to be valid, got %v", tc.precision, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidPrecision) {
+			t.Errorf("Expected %v to be rejected, got %v", tc.precision, err)
+		}
+	}
+}
+
+func TestSQLiteUsageTrackerZeroPrecision(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 0)
+	if err != nil {
+		t.Fatal("Failed to set up test database:", err)
+	}
+	defer cleanup()
+
+	if err := tracker.RecordUsage([]string{"1"}); !errors.Is(err, ErrInvalidPrecision) {
+		t.Fatal("Expected RecordUsage to reject a zero precision, got", err)
+	}
+
+	now := time.Now()
+	if _, err := tracker.ViewUsage(now.Add(-time.Hour), now); !errors.Is(err, ErrInvalidPrecision) {
+		t.Fatal("Expected ViewUsage to reject a zero precision, got", err)
+	}
+}
+
+func TestSQLiteUsageTrackerClockSkew(t *testing.T) {
+	base := time.Date(2025, 1, 1, 0, 12, 0, 0, time.UTC)
+
+	tests := []struct {
+		policy   ClockSkewPolicy
+		err      error
+		expected time.Duration
+	}{
+		// The skewed call lands in the 00:10 bucket, which already exists
+		{ClockSkewClamp, nil, 5 * time.Minute},
+		// The skewed call creates a new bucket at 00:00
+		{ClockSkewWarn, nil, 10 * time.Minute},
+		{ClockSkewDrop, ErrClockSkew, 5 * time.Minute},
+	}
+
+	for _, tc := range tests {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			ut, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+			if err != nil {
+				t.Fatal("Failed to set up test database:", err)
+			}
+			defer cleanup()
+
+			tracker := ut.(*SQLiteUsageTracker)
+			tracker.SkewPolicy = tc.policy
+			now := base
+			tracker.now = func() time.Time { return now }
+
+			validators := []string{"1"}
+			if err := tracker.RecordUsage(validators); err != nil {
+				t.Fatal("Failed to record usage:", err)
+			}
+
+			// Small steps back are tolerated and recorded as-is
+			now = base.Add(-500 * time.Millisecond)
+			if err := tracker.RecordUsage(validators); err != nil {
+				t.Fatal("Failed to record usage:", err)
+			}
+			if tracker.skewed.Load() {
+				t.Fatal("Expected sub-second reordering not to be treated as skew")
+			}
+
+			// NTP steps the clock back by 8 minutes
+			now = base.Add(-8 * time.Minute)
+			err = tracker.RecordUsage(validators)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("Expected error %v, got %v", tc.err, err)
+			}
+
+			result, err := tracker.ViewUsage(base.Add(-time.Hour), base.Add(time.Hour))
+			if err != nil {
+				t.Fatal("Failed to view usage:", err)
+			}
+			if result[validators[0]] != tc.expected {
+				t.Fatalf("Expected %v of usage, got %v", tc.expected, result[validators[0]])
+			}
+
+			// Once the clock catches up, recording proceeds normally
+			now = base.Add(5 * time.Minute)
+			if err := tracker.RecordUsage(validators); err != nil {
+				t.Fatal("Failed to record usage:", err)
+			}
+			if tracker.skewed.Load() {
+				t.Fatal("Expected the skewed state to clear")
+			}
+		})
+	}
+}
+
+func TestSQLiteUsageTrackerBoundaryGrace(t *testing.T) {
+	ut, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal("Failed to set up test database:", err)
+	}
+	defer cleanup()
+
+	tracker := ut.(*SQLiteUsageTracker)
+	tracker.BoundaryGrace = 2 * time.Second
+	boundary := time.Date(2025, 1, 1, 0, 5, 0, 0, time.UTC)
+	var now time.Time
+	tracker.now = func() time.Time { return now }
+
+	record := func(at time.Time, validators ...string) {
+		t.Helper()
+		now = at
+		if err := tracker.RecordUsage(validators); err != nil {
+			t.Fatal("Failed to record usage:", err)
+		}
+	}
+
+	// Validator 3 was active long before the boundary
+	record(boundary.Add(-time.Minute), "3")
+	// Validator 1 has a short burst straddling the boundary
+	record(boundary.Add(-time.Second), "1")
+	record(boundary.Add(time.Second), "1", "3")
+	// Validator 2 only starts after the boundary, and must still be recorded
+	record(boundary.Add(time.Second), "2")
+
+	result, err := tracker.ViewUsage(boundary.Add(-time.Hour), boundary.Add(time.Hour))
+	if err != nil {
+		t.Fatal("Failed to view usage:", err)
+	}
+
+	expected := map[string]time.Duration{
+		"1": 5 * time.Minute,
+		"2": 5 * time.Minute,
+		"3": 10 * time.Minute,
+	}
+	for validator, duration := range expected {
+		if result[validator] != duration {
+			t.Errorf("Expected validator %s to have %v of usage, got %v", validator, duration, result[validator])
+		}
+	}
+
+	// Continued activity past the grace is recorded in the new bucket
+	record(boundary.Add(time.Minute), "1")
+	result, err = tracker.ViewUsage(boundary.Add(-time.Hour), boundary.Add(time.Hour))
+	if err != nil {
+		t.Fatal("Failed to view usage:", err)
+	}
+	if result["1"] != 10*time.Minute {
+		t.Fatalf("Expected continued usage to be recorded, got %v", result["1"])
+	}
+}
+
+func TestSQLiteUsageTrackerReadReplica(t *testing.T) {
+	_, err := metrics.Init("usage_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	path := filepath.Join(t.TempDir(), "usage.db")
+	tracker := NewSQLiteUsageTracker(zaptest.NewLogger(t), UsageTrackerOptions{
+		DSN:          "file:" + path,
+		ReadDSN:      "file:" + path + "?mode=ro",
+		MaxOpenConns: 2,
+	}).(*SQLiteUsageTracker)
+	defer tracker.Close()
+
+	if open := tracker.ReadDatabase.Stats().MaxOpenConnections; open != 2 {
+		t.Fatalf("Expected the pool options to apply to the replica, got %d max connections", open)
+	}
+
+	health := tracker.HealthCheck(context.Background())
+	if len(health) != 2 {
+		t.Fatalf("Expected health for 2 roles, got %d", len(health))
+	}
+	for role, err := range health {
+		if err != nil {
+			t.Fatalf("Expected %s to be healthy, got %v", role, err)
+		}
+	}
+
+	validators := []string{"1", "2"}
+	if err := tracker.RecordUsage(validators); err != nil {
+		t.Fatal("Failed to record usage:", err)
+	}
+
+	// Writes must not be accepted by the replica connection
+	if _, err := tracker.ReadDatabase.Exec("DELETE FROM validator_usage"); err == nil {
+		t.Fatal("Expected the read-only replica to reject writes")
+	}
+
+	now := time.Now()
+	result, err := tracker.ViewUsage(now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal("Failed to view usage:", err)
+	}
+
+	if len(result) != len(validators) {
+		t.Fatalf("Expected %d validators read from the replica, got %d", len(validators), len(result))
+	}
+}
+
+func TestSQLiteUsageTrackerBusyRetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.db")
+
+	// Disable the driver's busy handler so lock contention surfaces immediately
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=0&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	tracker := &SQLiteUsageTracker{
+		Database:     db,
+		Logger:       zaptest.NewLogger(t),
+		Precision:    5 * time.Minute,
+		WriteRetries: 10,
+		TxLock:       "immediate",
+	}
+	if err := tracker.initSchema(); err != nil {
+		t.Fatal(err)
+	}
+	defer tracker.Close()
+
+	// A second instance holds the write lock for a while
+	other, err := sql.Open("sqlite3", "file:"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	lock, err := other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lock.Exec("INSERT INTO validator_usage (timestamp, validator_index) VALUES (datetime(0, 'unixepoch'), 'other')"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = lock.Commit()
+	}()
+
+	if err := tracker.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal("Expected the write to succeed after retrying, got", err)
+	}
+
+	// Without retries the same contention is reported to the caller
+	tracker.WriteRetries = 0
+	lock, err = other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = lock.Rollback()
+	}()
+	if _, err := lock.Exec("INSERT INTO validator_usage (timestamp, validator_index) VALUES (datetime(1, 'unixepoch'), 'other')"); err != nil {
+		t.Fatal(err)
+	}
+	err = tracker.RecordUsage([]string{"2"})
+	if !isRetryableWriteError(err) {
+		t.Fatal("Expected a busy error, got", err)
+	}
+}
+
+func BenchmarkSQLiteUsageTrackerRecordUsage(b *testing.B) {
+	// A typical prepare_beacon_proposer call only carries a handful of validators,
+	// so per-call overhead dominates.
+	validators := []string{"1", "2", "3", "4"}
+
+	b.Run("cached", func(b *testing.B) {
+		tracker := setupSQLiteBenchmarkDatabase(b)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := tracker.RecordUsage(validators); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// Repeated calls within a bucket, which don't reach the database
+	b.Run("coalesced", func(b *testing.B) {
+		tracker := setupSQLiteBenchmarkDatabase(b)
+		tracker.Coalesce = true
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := tracker.RecordUsage(validators); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// Baseline: the insert statement prepared inside every transaction
+	b.Run("reprepared", func(b *testing.B) {
+		tracker := setupSQLiteBenchmarkDatabase(b)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			tx, err := tracker.Database.Begin()
+			if err != nil {
+				b.Fatal(err)
+			}
+			stmt, err := tx.Prepare(insertUsageQuery)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := tracker.insertUsage(stmt, time.Now().Truncate(tracker.Precision).Unix(), "", validators); err != nil {
+				b.Fatal(err)
+			}
+			_ = stmt.Close()
+			if err := tx.Commit(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func setupSQLiteBenchmarkDatabase(b testing.TB) *SQLiteUsageTracker {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(b.TempDir(), "bench.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	tracker := &SQLiteUsageTracker{
+		Database:  db,
+		Logger:    zap.NewNop(),
+		Precision: 5 * time.Minute,
+	}
+	if err := tracker.initSchema(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(tracker.Close)
+
+	return tracker
+}
+
 func setupSQLiteTestDatabase(t *testing.T, precision time.Duration) (UsageTracker, func(), error) {
 	logger := zaptest.NewLogger(t)
 
@@ -177,3 +623,58 @@ func setupSQLiteTestDatabase(t *testing.T, precision time.Duration) (UsageTracke
 
 	return tracker, cleanup, nil
 }
+
+func TestSQLiteUsageTrackerConflictPolicy(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:conflicts.db?mode=memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	newTracker := func(occupancy bool, policy UsageConflictPolicy) *SQLiteUsageTracker {
+		tracker := &SQLiteUsageTracker{
+			Database:       db,
+			Logger:         zaptest.NewLogger(t),
+			Precision:      5 * time.Minute,
+			Occupancy:      occupancy,
+			ConflictPolicy: policy,
+			wallClock:      wallClock{now: func() time.Time { return start.Add(time.Minute) }},
+		}
+		if err := tracker.initSchema(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(tracker.closeStatements)
+		return tracker
+	}
+
+	// Another instance recorded a moment of activity in the bucket
+	occupancy := newTracker(true, "")
+	if err := occupancy.RecordUsage([]string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newTracker(false, UsageConflictIgnore).RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := newTracker(false, UsageConflictReplace).RecordUsage([]string{"2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := occupancy.ViewUsage(start, start.Add(5*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replacing the bucket drops its activity, so it's credited in full
+	if usage["1"] != occupancyMinimum || usage["2"] != 5*time.Minute {
+		t.Fatalf("Expected the ignored bucket kept and the other replaced, got %v", usage)
+	}
+	var buckets int
+	if err := db.QueryRow("SELECT COUNT(*) FROM validator_usage").Scan(&buckets); err != nil {
+		t.Fatal(err)
+	}
+	if buckets != 2 {
+		t.Fatalf("Expected conflicting writes to keep one bucket per validator, got %d", buckets)
+	}
+}
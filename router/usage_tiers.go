@@ -0,0 +1,146 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/credentials"
+	"go.uber.org/zap"
+)
+
+// credentialTier is the tier of a credential's operator type, e.g. rocketpool or solo.
+func credentialTier(operatorType credentials.OperatorType) string {
+	return strings.ToLower(strings.TrimPrefix(operatorType.String(), "OT_"))
+}
+
+// TierUsageTotal is the usage recorded with credentials of one tier.
+type TierUsageTotal struct {
+	Validators int     `json:"validators"`
+	Seconds    float64 `json:"seconds"`
+}
+
+// TierUsage breaks the usage of a range down by credential tier.
+type TierUsage struct {
+	From  time.Time                 `json:"from"`
+	To    time.Time                 `json:"to"`
+	Tiers map[string]TierUsageTotal `json:"tiers"`
+}
+
+// TierStore records the tier of the credential usage was recorded with, per bucket.
+// Operators can move between tiers, so reports reflect the tier at the time of usage
+// rather than the current one.
+type TierStore struct {
+	Database  *sql.DB
+	Logger    *zap.Logger
+	Precision time.Duration
+
+	wallClock
+}
+
+// NewTierStore creates the tier table in db if needed. Tiers are recorded in buckets
+// of the given precision, which should match the usage tracker's.
+func NewTierStore(logger *zap.Logger, db *sql.DB, precision time.Duration) (*TierStore, error) {
+	store := &TierStore{
+		Database:  db,
+		Logger:    logger,
+		Precision: precision,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *TierStore) initSchema() error {
+	// bucket is a unix timestamp
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS usage_tier (
+		bucket INTEGER NOT NULL,
+		validator_index TEXT NOT NULL,
+		tier TEXT NOT NULL,
+		PRIMARY KEY (bucket, validator_index, tier)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_usage_tier_validator ON usage_tier(validator_index);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Record records that the given validators were used with a credential of tier just now.
+func (store *TierStore) Record(tier string, indexes []string) error {
+	bucket := store.clock().Truncate(store.Precision).Unix()
+
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT OR IGNORE INTO usage_tier (bucket, validator_index, tier) VALUES (?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare tier statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, index := range indexes {
+		if _, err := stmt.Exec(bucket, index, tier); err != nil {
+			return fmt.Errorf("failed to record tier of validator %s: %w", index, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Breakdown returns the usage in every bucket overlapping [from, to] per tier, with the
+// same edge semantics as UsageTracker.ViewUsage. A validator used with credentials of
+// several tiers in a bucket counts towards each of them.
+func (store *TierStore) Breakdown(from time.Time, to time.Time) (*TierUsage, error) {
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+
+	rows, err := store.Database.Query(`
+	SELECT tier, COUNT(DISTINCT validator_index), COUNT(*)
+	FROM usage_tier
+	WHERE bucket >= ? AND bucket <= ?
+	GROUP BY tier
+	`, from.Truncate(store.Precision).Unix(), to.Truncate(store.Precision).Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tiers: %w", err)
+	}
+	defer rows.Close()
+
+	out := &TierUsage{
+		From:  from,
+		To:    to,
+		Tiers: map[string]TierUsageTotal{},
+	}
+	for rows.Next() {
+		var tier string
+		var validators, buckets int
+		if err := rows.Scan(&tier, &validators, &buckets); err != nil {
+			return nil, err
+		}
+		out.Tiers[tier] = TierUsageTotal{
+			Validators: validators,
+			Seconds:    (time.Duration(buckets) * store.Precision).Seconds(),
+		}
+	}
+
+	return out, rows.Err()
+}
+
+func (store *TierStore) pruneUsage(cutoff time.Time, exempt map[string]time.Time) (int64, error) {
+	return pruneRows(store.Database, "usage_tier", "bucket < ?",
+		func(t time.Time) any { return t.Add(-store.Precision).Unix() }, cutoff, exempt)
+}
@@ -0,0 +1,137 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/credentials/pb"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestCredentialTier(t *testing.T) {
+	if tier := credentialTier(pb.OperatorType_OT_ROCKETPOOL); tier != "rocketpool" {
+		t.Fatalf("Unexpected tier %q", tier)
+	}
+	if tier := credentialTier(pb.OperatorType_OT_SOLO); tier != "solo" {
+		t.Fatalf("Unexpected tier %q", tier)
+	}
+}
+
+func TestTierStore(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	store, err := NewTierStore(zaptest.NewLogger(t), tracker.(*SQLiteUsageTracker).Database, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	store.now = func() time.Time { return now }
+
+	record := func(tier string, indexes ...string) {
+		t.Helper()
+		if err := store.Record(tier, indexes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record("solo", "1", "2")
+	// Repeated usage in a bucket counts once
+	now = now.Add(time.Minute)
+	record("solo", "1")
+	// The operator of 1 moves to another tier
+	now = now.Add(10 * time.Minute)
+	record("rocketpool", "1")
+
+	breakdown, err := store.Breakdown(start, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]TierUsageTotal{
+		"solo":       {Validators: 2, Seconds: 600},
+		"rocketpool": {Validators: 1, Seconds: 300},
+	}
+	if !reflect.DeepEqual(breakdown.Tiers, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, breakdown.Tiers)
+	}
+
+	// Usage before the move keeps its tier
+	breakdown, err = store.Breakdown(start, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := breakdown.Tiers["rocketpool"]; ok || breakdown.Tiers["solo"].Validators != 2 {
+		t.Fatalf("Unexpected breakdown %+v", breakdown.Tiers)
+	}
+
+	// Buckets ending before the cutoff are pruned
+	pruned, err := store.pruneUsage(start.Add(6*time.Minute), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 {
+		t.Fatalf("Expected 2 pruned rows, got %d", pruned)
+	}
+}
+
+func TestAdminUsageTiers(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	handler := pr.AdminHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/tiers?from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected 501 without a tier store, got %d", rec.Code)
+	}
+
+	pr.tiers, err = NewTierStore(pr.Logger, sqlite.Database, sqlite.Precision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC)
+	sqlite.now = func() time.Time { return now }
+	pr.tiers.now = sqlite.now
+
+	node := common.HexToAddress("0x0000000000000000000000000000000000000002")
+	pr.recordUsage(authInfo{nodeAddr: node, operatorType: pb.OperatorType_OT_SOLO}, prepareBeaconProposerKind, []string{"1"})
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/tiers?from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var report TierUsage
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Tiers) != 1 || report.Tiers["solo"].Seconds != 300 {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/usage/tiers?from=2025-01-01T01:00:00Z&to=2025-01-01T00:00:00Z", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an inverted range, got %d", rec.Code)
+	}
+}
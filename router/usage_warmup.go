@@ -0,0 +1,155 @@
+//go:build ns
+
+package router
+
+import (
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Validators looked up on the consensus layer per request while warming up
+const warmUpBatch = 500
+
+// UsageWarmUp summarizes what was restored from recent usage on startup.
+type UsageWarmUp struct {
+	Validators int
+	// Validators whose info was loaded into the consensus layer cache
+	ValidatorInfo int
+	// Validators marked active for load shedding
+	Active int
+	// Validators remembered as recorded in the current bucket
+	Coalesced int
+}
+
+// usageWarmer is implemented by trackers whose in-memory state can be restored from
+// recorded usage after a restart.
+type usageWarmer interface {
+	// warmUp restores state from records, ordered by bucket, and returns how many
+	// validators it restored.
+	warmUp(records []UsageRecord) int
+}
+
+func (tracker *SQLiteUsageTracker) warmUp(records []UsageRecord) int {
+	// Records don't carry their tenant, which the coalescer remembers in multi-tenant mode
+	if !tracker.Coalesce || tracker.MultiTenant {
+		return 0
+	}
+
+	bucket := tracker.clock().Truncate(tracker.Precision)
+	validators := make([]string, 0)
+	for _, record := range records {
+		if record.Bucket.Equal(bucket) {
+			validators = append(validators, record.Validator.String())
+		}
+	}
+	tracker.coalescer.warm(bucket.Unix(), validators)
+	return len(validators)
+}
+
+func (tracker *HybridUsageTracker) warmUp(records []UsageRecord) int {
+	return tracker.Buckets.warmUp(records)
+}
+
+// warm remembers that indexes were recorded in bucket, unless a later bucket was
+// already recorded in.
+func (c *usageCoalescer) warm(bucket int64, indexes []string) {
+	c.pending(bucket, "", nil)
+	c.done(bucket, "", indexes)
+}
+
+// warm marks validators as active since the given times, unless they were seen since.
+func (m *LoadMonitor) warm(seen map[string]time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seen == nil {
+		m.seen = make(map[string]time.Time, len(seen))
+	}
+	for index, t := range seen {
+		if t.After(m.seen[index]) {
+			m.add(index, t)
+		}
+	}
+}
+
+// warmUp restores the in-memory state lost on restart from the usage recorded in the
+// last window: the consensus layer's validator info cache, the active validators of
+// the load monitor, and the coalescer's current bucket. It runs before traffic is
+// accepted, and failures only leave caches cold.
+func (pr *ProxyRouter) warmUp(window time.Duration) *UsageWarmUp {
+	out := &UsageWarmUp{}
+	if err := requireCapability(pr.ut, "warming up", UsageCapabilityBuckets); err != nil {
+		pr.Logger.Warn("Not warming up", zap.Error(err))
+		return out
+	}
+	tracker := pr.ut.(usageBuckets)
+
+	start := time.Now()
+	precision := tracker.bucketPrecision()
+	now := start
+	switch t := pr.ut.(type) {
+	case *SQLiteUsageTracker:
+		now = t.clock()
+	case *HybridUsageTracker:
+		now = t.Buckets.clock()
+	}
+	records, err := tracker.usageRecords(now.Add(-window).Truncate(precision), now.Truncate(precision).Add(precision))
+	if err != nil {
+		pr.Logger.Warn("Failed to load recent usage, caches stay cold", zap.Error(err))
+		return out
+	}
+
+	// Latest bucket each validator was active in
+	latest := make(map[string]time.Time)
+	for _, record := range records {
+		latest[record.Validator.String()] = record.Bucket
+	}
+	validators := make([]string, 0, len(latest))
+	for validator := range latest {
+		validators = append(validators, validator)
+	}
+	sort.Strings(validators)
+	out.Validators = len(validators)
+
+	// Pseudonyms can't be looked up on the beacon chain
+	if pr.DataMinimization == nil && pr.CL != nil {
+		for batch := validators; len(batch) > 0; {
+			n := min(len(batch), warmUpBatch)
+			infos, err := pr.CL.GetValidatorInfo(batch[:n])
+			if err != nil {
+				pr.Logger.Warn("Failed to warm up validator info", zap.Error(err))
+				break
+			}
+			out.ValidatorInfo += len(infos)
+			batch = batch[n:]
+		}
+	}
+
+	if pr.load != nil {
+		// Activity is only known to the bucket, so validators count as active from its
+		// start, which may end their window early but never extends it
+		cutoff := pr.load.clock().Add(-pr.load.window())
+		active := make(map[string]time.Time)
+		for validator, bucket := range latest {
+			if !bucket.Before(cutoff) {
+				active[validator] = bucket
+			}
+		}
+		pr.load.warm(active)
+		out.Active = len(active)
+	}
+
+	if warmer, ok := pr.ut.(usageWarmer); ok {
+		out.Coalesced = warmer.warmUp(records)
+	}
+
+	pr.Logger.Info("Warmed up caches from recent usage",
+		zap.Duration("window", window),
+		zap.Int("validators", out.Validators),
+		zap.Int("validator_info", out.ValidatorInfo),
+		zap.Int("active", out.Active),
+		zap.Int("coalesced", out.Coalesced),
+		zap.Duration("took", time.Since(start)))
+	return out
+}
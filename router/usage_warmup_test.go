@@ -0,0 +1,105 @@
+//go:build ns
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/consensuslayer"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/test"
+	"go.uber.org/zap/zaptest"
+)
+
+// countingConsensusLayer counts the validators whose info is requested.
+type countingConsensusLayer struct {
+	*test.MockConsensusLayer
+	lookups int
+}
+
+func (c *countingConsensusLayer) GetValidatorInfo(indices []string) (map[string]*consensuslayer.ValidatorInfo, error) {
+	c.lookups += len(indices)
+	return c.MockConsensusLayer.GetValidatorInfo(indices)
+}
+
+func TestWarmUp(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+	now := time.Date(2024, 12, 31, 23, 40, 0, 0, time.UTC)
+	sqlite.now = func() time.Time { return now }
+
+	for _, usage := range []struct {
+		at         time.Time
+		validators []string
+	}{
+		{time.Date(2024, 12, 31, 22, 0, 0, 0, time.UTC), []string{"103"}},
+		{time.Date(2024, 12, 31, 23, 40, 0, 0, time.UTC), []string{"102"}},
+		{time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), []string{"101"}},
+		{time.Date(2025, 1, 1, 0, 10, 0, 0, time.UTC), []string{"100"}},
+	} {
+		now = usage.at
+		if err := tracker.RecordUsage(usage.validators); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Restart with empty caches
+	now = time.Date(2025, 1, 1, 0, 11, 0, 0, time.UTC)
+	sqlite.Coalesce = true
+	sqlite.coalescer = usageCoalescer{}
+	cl := &countingConsensusLayer{MockConsensusLayer: test.NewMockConsensusLayer(4, "warmup")}
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		CL:     cl,
+		ut:     tracker,
+		load: &LoadMonitor{
+			Logger:    zaptest.NewLogger(t),
+			wallClock: wallClock{now: sqlite.now},
+		},
+	}
+
+	summary := pr.warmUp(time.Hour)
+	expected := UsageWarmUp{Validators: 3, ValidatorInfo: 3, Active: 2, Coalesced: 1}
+	if *summary != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, *summary)
+	}
+	if cl.lookups != 3 {
+		t.Fatalf("Expected 3 validators looked up, got %d", cl.lookups)
+	}
+	if active := pr.load.ActiveValidators(); active != 2 {
+		t.Fatalf("Expected 2 active validators, got %d", active)
+	}
+
+	bucket := now.Truncate(sqlite.Precision).Unix()
+	if pending := sqlite.coalescer.pending(bucket, "", []string{"100", "101"}); len(pending) != 1 || pending[0] != "101" {
+		t.Fatalf("Expected only 101 to be pending in the current bucket, got %v", pending)
+	}
+}
+
+func TestWarmUpMinimized(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if err := tracker.RecordUsage([]string{"pseudonym"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cl := &countingConsensusLayer{MockConsensusLayer: test.NewMockConsensusLayer(0, "warmup")}
+	pr := &ProxyRouter{
+		Logger:           zaptest.NewLogger(t),
+		CL:               cl,
+		DataMinimization: &DataMinimization{},
+		ut:               tracker,
+	}
+
+	summary := pr.warmUp(time.Hour)
+	if summary.Validators != 1 || cl.lookups != 0 {
+		t.Fatalf("Expected pseudonyms not to be looked up, got %+v after %d lookups", summary, cl.lookups)
+	}
+}
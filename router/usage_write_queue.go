@@ -0,0 +1,294 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	// How often the write queue writes its spool when it isn't busy
+	usageWriteQueueFlushInterval = time.Second
+	// Queued usage older than this is refused rather than written late. The queue
+	// normally lags by seconds, older usage means the writer was stuck or the clock
+	// jumped.
+	usageWriteQueueMaxAge = 24 * time.Hour
+)
+
+// usageWriteQueueCaller is who writes late queued usage in the backdating audit
+var usageWriteQueueCaller = BackfillCaller{Identity: "system:usage-write-queue"}
+
+var (
+	// ErrUsageQueueFull is returned when both the write queue and its spool are full,
+	// and the usage was dropped.
+	ErrUsageQueueFull = errors.New("the usage write queue and its spool are full")
+	// ErrUsageQueueClosed is returned for usage recorded after the queue was closed.
+	ErrUsageQueueClosed = errors.New("the usage write queue is closed")
+)
+
+type queuedUsage struct {
+	at      time.Time
+	indexes []string
+}
+
+// UsageWriteQueue takes usage writes off the request path, for deployments where
+// proxy latency matters more than writes being synchronous. RecordUsage never touches
+// the database: usage is enqueued with the time it was recorded at, and written by a
+// single background writer.
+//
+// When the queue is full, usage is spooled in memory per bucket, like
+// SpoolingUsageTracker does, and written once the queue has drained. It's only dropped
+// when the spool is full as well. Usage written after its bucket ended is backfilled
+// into it if the tracker supports it, and recorded in the current bucket otherwise.
+// Backfilled usage is guarded and audited like any backfill, as usageWriteQueueCaller,
+// and keeps the boundary grace and occupancy it would have had if written on time.
+//
+// Queue depth, spool size, writer lag and write outcomes are exported as metrics of
+// the usage_write_queue subsystem.
+type UsageWriteQueue struct {
+	Logger  *zap.Logger
+	Tracker UsageTracker
+	// Writes usage after its bucket ended, nil if Tracker can't backfill
+	backfill *GuardedBackfiller
+	// Optional, called with the outcome of every write
+	OnWrite func(error)
+	// Optional, called with the outcome of every write and how long after it was queued
+	// it was written. Spooled usage is measured from the start of its bucket.
+	observe func(err error, latency time.Duration)
+	// Optional, called when usage starts being spooled
+	onSpool func()
+
+	precision time.Duration
+	queue     chan queuedUsage
+	// Held for reading while usage is enqueued or spooled, and for writing by Close, so
+	// usage is either refused or queued before the writer drains
+	closing sync.RWMutex
+	closed  bool
+	stop    chan struct{}
+	done    chan struct{}
+
+	mu sync.Mutex
+	// Validators per bucket, in unix seconds
+	spool   map[int64]map[string]struct{}
+	spooled int
+	// Bounds spooled, see MemoryBudget
+	limit cacheLimit
+
+	wallClock
+
+	m *metrics.MetricsRegistry
+}
+
+// NewUsageWriteQueue starts writing usage to tracker, whose buckets are precision
+// wide, through a queue of size entries.
+func NewUsageWriteQueue(logger *zap.Logger, tracker UsageTracker, precision time.Duration, size int) *UsageWriteQueue {
+	q := newUsageWriteQueue(logger, tracker, precision, size)
+	go q.run()
+	return q
+}
+
+func newUsageWriteQueue(logger *zap.Logger, tracker UsageTracker, precision time.Duration, size int) *UsageWriteQueue {
+	if precision == 0 {
+		precision = defaultUsagePrecision
+	}
+	q := &UsageWriteQueue{
+		Logger:    logger,
+		Tracker:   tracker,
+		precision: precision,
+		queue:     make(chan queuedUsage, size),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		spool:     make(map[int64]map[string]struct{}),
+		limit:     cacheLimit{max: maxSpooledUsage},
+		m:         metrics.NewMetricsRegistry("usage_write_queue"),
+	}
+	if backfiller, ok := tracker.(UsageBackfiller); ok {
+		guard, err := newGuardedBackfiller(logger, backfiller, usageWriteQueueCaller, usageWriteQueueMaxAge)
+		if err != nil {
+			logger.Warn("Late queued usage will be recorded in the current bucket", zap.Error(err))
+		} else {
+			guard.Audit.now = q.clock
+			q.backfill = guard
+		}
+	}
+	q.m.GaugeFunc("depth", func() float64 {
+		return float64(len(q.queue))
+	})
+	q.m.GaugeFunc("capacity", func() float64 {
+		return float64(cap(q.queue))
+	})
+	q.m.GaugeFunc("spooled", func() float64 {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		return float64(q.spooled)
+	})
+	return q
+}
+
+// RecordUsage enqueues the usage of indexes, spooling it if the queue is full.
+// It returns an error only if the usage was dropped.
+func (q *UsageWriteQueue) RecordUsage(indexes []string) error {
+	q.closing.RLock()
+	defer q.closing.RUnlock()
+	if q.closed {
+		return ErrUsageQueueClosed
+	}
+	at := q.clock()
+	select {
+	case q.queue <- queuedUsage{at: at, indexes: indexes}:
+		return nil
+	default:
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.spooled == 0 && q.onSpool != nil {
+		q.onSpool()
+	}
+	bucket := at.Truncate(q.precision).Unix()
+	validators, ok := q.spool[bucket]
+	if !ok {
+		validators = make(map[string]struct{})
+		q.spool[bucket] = validators
+	}
+	dropped := 0
+	for _, index := range indexes {
+		if _, ok := validators[index]; ok {
+			continue
+		}
+		if q.limit.full(q.spooled) {
+			dropped++
+			continue
+		}
+		validators[index] = struct{}{}
+		q.spooled++
+	}
+	q.m.Counter("overflowed").Inc()
+	q.limit.evictions.Add(uint64(dropped))
+	if dropped > 0 {
+		q.m.Counter("dropped").Add(float64(dropped))
+		return fmt.Errorf("%w, %d validators dropped", ErrUsageQueueFull, dropped)
+	}
+	return nil
+}
+
+// write records usage recorded at, backfilling it if its bucket has ended.
+func (q *UsageWriteQueue) write(at time.Time, indexes []string) {
+	now := q.clock()
+	q.m.Gauge("lag_seconds").Set(now.Sub(at).Seconds())
+
+	var err error
+	switch {
+	case at.Truncate(q.precision).Equal(now.Truncate(q.precision)):
+		err = q.Tracker.RecordUsage(indexes)
+	case q.backfill != nil:
+		err = q.backfill.recordLate(at, indexes)
+	default:
+		q.m.Counter("late").Inc()
+		err = q.Tracker.RecordUsage(indexes)
+	}
+
+	if err != nil {
+		q.m.Counter("write_errors").Inc()
+		q.Logger.Error("Error while writing queued validator usage", zap.Time("recorded_at", at), zap.Error(err))
+	}
+	if q.OnWrite != nil {
+		q.OnWrite(err)
+	}
+	if q.observe != nil {
+		q.observe(err, q.clock().Sub(at))
+	}
+}
+
+// flushSpool writes the spooled usage, oldest bucket first.
+func (q *UsageWriteQueue) flushSpool() {
+	q.mu.Lock()
+	spool := q.spool
+	q.spool = make(map[int64]map[string]struct{})
+	q.spooled = 0
+	q.mu.Unlock()
+
+	for len(spool) > 0 {
+		oldest := int64(0)
+		for bucket := range spool {
+			if oldest == 0 || bucket < oldest {
+				oldest = bucket
+			}
+		}
+		indexes := make([]string, 0, len(spool[oldest]))
+		for index := range spool[oldest] {
+			indexes = append(indexes, index)
+		}
+		delete(spool, oldest)
+		q.write(time.Unix(oldest, 0), indexes)
+	}
+}
+
+// run writes queued usage, then the spool whenever the queue is empty, until the queue
+// is closed.
+func (q *UsageWriteQueue) run() {
+	defer close(q.done)
+
+	ticker := time.NewTicker(usageWriteQueueFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case item := <-q.queue:
+			q.write(item.at, item.indexes)
+			if len(q.queue) > 0 {
+				continue
+			}
+		case <-ticker.C:
+		case <-q.stop:
+			q.drain()
+			return
+		}
+		q.flushSpool()
+	}
+}
+
+// drain writes everything queued and spooled.
+func (q *UsageWriteQueue) drain() {
+	for {
+		select {
+		case item := <-q.queue:
+			q.write(item.at, item.indexes)
+		default:
+			q.flushSpool()
+			return
+		}
+	}
+}
+
+// Close stops accepting usage and returns once what was queued is written, also when
+// called concurrently. The tracker isn't closed.
+func (q *UsageWriteQueue) Close() {
+	q.closing.Lock()
+	closed := q.closed
+	q.closed = true
+	q.closing.Unlock()
+	if closed {
+		<-q.done
+		return
+	}
+
+	close(q.stop)
+	<-q.done
+	q.m.UnregisterAll()
+}
+
+func (q *UsageWriteQueue) cacheEntries() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.spooled
+}
+
+func (q *UsageWriteQueue) cacheEvictions() uint64 {
+	return q.limit.evictions.Load()
+}
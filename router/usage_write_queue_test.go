@@ -0,0 +1,170 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestUsageWriteQueue(t *testing.T) {
+	_, err := metrics.Init("usage_write_queue_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	tracker.(*SQLiteUsageTracker).now = func() time.Time { return now }
+
+	q := newUsageWriteQueue(zaptest.NewLogger(t), tracker, 5*time.Minute, 2)
+	q.now = func() time.Time { return now }
+	defer q.m.UnregisterAll()
+	var writeErrs []error
+	q.OnWrite = func(err error) { writeErrs = append(writeErrs, err) }
+
+	// Nothing is written until the writer runs
+	for _, index := range []string{"1", "2", "3", "4"} {
+		if err := q.RecordUsage([]string{index}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(q.queue) != 2 || q.spooled != 2 {
+		t.Fatalf("Expected 2 queued and 2 spooled, got %d and %d", len(q.queue), q.spooled)
+	}
+	usage, err := tracker.ViewUsage(start, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 0 {
+		t.Fatalf("Expected nothing to be written yet, got %v", usage)
+	}
+
+	// Usage written after its bucket ended is backfilled into it
+	now = start.Add(7 * time.Minute)
+	q.drain()
+	if len(writeErrs) != 3 {
+		t.Fatalf("Expected 2 queued writes and a spool write, got %v", writeErrs)
+	}
+	usage, err = tracker.ViewUsage(start, start.Add(10*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range []string{"1", "2", "3", "4"} {
+		if usage[index] != 5*time.Minute {
+			t.Fatalf("Expected a bucket of usage for validator %s, got %v", index, usage)
+		}
+	}
+	if usage, _ := tracker.ViewUsage(start.Add(5*time.Minute), start.Add(10*time.Minute)); len(usage) != 0 {
+		t.Fatalf("Expected nothing in the current bucket, got %v", usage)
+	}
+
+	// Late writes are audited as the queue, and refused past its maximum age
+	audits, err := q.backfill.Audit.List(start, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(audits) != 3 || audits[0].Caller != usageWriteQueueCaller || !audits[0].Bucket.Equal(start) {
+		t.Fatalf("Expected 3 audited late writes, got %+v", audits)
+	}
+	q.write(now.Add(-usageWriteQueueMaxAge-time.Hour), []string{"9"})
+	if err := writeErrs[len(writeErrs)-1]; !errors.Is(err, ErrBackdatingTooOld) {
+		t.Fatalf("Expected a backdating error, got %v", err)
+	}
+
+	// The spool is bounded
+	q.queue <- queuedUsage{}
+	q.queue <- queuedUsage{}
+	q.spooled = maxSpooledUsage
+	if err := q.RecordUsage([]string{"5"}); !errors.Is(err, ErrUsageQueueFull) {
+		t.Fatalf("Expected a full queue, got %v", err)
+	}
+}
+
+func TestUsageWriteQueueClose(t *testing.T) {
+	_, err := metrics.Init("usage_write_queue_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	q := NewUsageWriteQueue(zaptest.NewLogger(t), tracker, 5*time.Minute, 16)
+	if err := q.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	// Closing writes what's queued
+	q.Close()
+	if err := q.RecordUsage([]string{"2"}); !errors.Is(err, ErrUsageQueueClosed) {
+		t.Fatalf("Expected a closed queue, got %v", err)
+	}
+
+	now := time.Now()
+	usage, err := tracker.ViewUsage(now.Add(-time.Minute), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] == 0 || usage["2"] != 0 {
+		t.Fatalf("Expected only the usage recorded before closing, got %v", usage)
+	}
+}
+
+func TestUsageWriteQueueCloseRace(t *testing.T) {
+	_, err := metrics.Init("usage_write_queue_test_" + t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(metrics.Deinit)
+
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	// Close while usage is being enqueued: the queue may not drain before it's queued
+	q := newUsageWriteQueue(zaptest.NewLogger(t), tracker, 5*time.Minute, 16)
+	var once sync.Once
+	q.now = func() time.Time {
+		once.Do(func() {
+			go q.Close()
+			select {
+			case <-q.done:
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+		return time.Now()
+	}
+	go q.run()
+
+	if err := q.RecordUsage([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	now := time.Now()
+	usage, err := tracker.ViewUsage(now.Add(-time.Minute), now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] == 0 {
+		t.Fatalf("Expected the usage recorded while closing, got %v", usage)
+	}
+}
@@ -0,0 +1,97 @@
+//go:build ns
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/router"
+)
+
+// errDifferent makes diff exit with an error status when the databases differ.
+var errDifferent = errors.New("the usage databases differ")
+
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	a := addTrackerFlags(fs, "a-", "compared from, eg, the primary")
+	b := addTrackerFlags(fs, "b-", "compared to, eg, a restored backup")
+	from := fs.String("from", "24h", "Start of the range, an RFC3339 time or a duration before now")
+	to := fs.String("to", "", "End of the range, an RFC3339 time or a duration before now. Now if empty.")
+	format := fs.String("format", "table", "Output format, table or json")
+	_ = fs.Parse(args)
+
+	now := time.Now()
+	fromTime, err := parseTime(*from, now)
+	if err != nil {
+		return fmt.Errorf("invalid -from: %w", err)
+	}
+	toTime, err := parseTime(*to, now)
+	if err != nil {
+		return fmt.Errorf("invalid -to: %w", err)
+	}
+
+	logger, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = logger.Sync()
+	}()
+	trackerA := a.open(logger)
+	defer trackerA.Close()
+	trackerB := b.open(logger)
+	defer trackerB.Close()
+
+	diff, err := router.DiffUsage(trackerA, trackerB, fromTime, toTime)
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "table":
+		err = writeDiffTable(os.Stdout, diff)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(diff)
+	default:
+		return fmt.Errorf("invalid -format %q, must be table or json", *format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !diff.Equal() {
+		return errDifferent
+	}
+	return nil
+}
+
+func writeDiffTable(w io.Writer, diff *router.UsageDiff) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VALIDATOR\tMISSING\tEXTRA\tFIRST DIFFERENCE")
+	for _, d := range diff.Validators {
+		buckets := append(d.Missing, d.Extra...)
+		first := buckets[0]
+		for _, bucket := range buckets {
+			if bucket.Before(first) {
+				first = bucket
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", d.Validator, len(d.Missing), len(d.Extra), first.UTC().Format(time.RFC3339))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%s\n%d records, %d matching, %d validators differ\n",
+		strings.Repeat("-", 40), diff.Records, diff.Matching, len(diff.Validators))
+	return err
+}
@@ -0,0 +1,77 @@
+//go:build ns
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/router"
+)
+
+func runEstimate(args []string) error {
+	fs := flag.NewFlagSet("estimate", flag.ExitOnError)
+	validators := fs.Int("validators", 0, "Number of validators using the proxy")
+	active := fs.Float64("active-fraction", 1, "Fraction of the validators active at any time, in (0, 1]")
+	interval := fs.Duration("request-interval", 12*time.Second, "Average time between the requests of an active validator")
+	model := fs.String("usage-model", "buckets", "Usage model, buckets, sessions or hybrid")
+	precision := fs.Duration("usage-precision", 5*time.Minute, "Width of the usage buckets")
+	idle := fs.Duration("usage-session-idle-timeout", 15*time.Minute, "Idle timeout of the sessions")
+	retention := fs.Duration("usage-retention", 0, "How long usage is kept, 0 if it's never pruned")
+	coalesce := fs.Bool("usage-coalesce", false, "Whether writes are coalesced")
+	occupancy := fs.Bool("usage-occupancy", false, "Whether buckets record their occupancy")
+	multiTenant := fs.Bool("usage-multi-tenant", false, "Whether usage is recorded for tenants")
+	format := fs.String("format", "table", "Output format, table or json")
+	_ = fs.Parse(args)
+
+	estimates, err := router.EstimateUsageStorage(router.UsageEstimateInput{
+		Validators:         *validators,
+		ActiveFraction:     *active,
+		RequestInterval:    *interval,
+		Model:              router.UsageModel(*model),
+		Precision:          *precision,
+		SessionIdleTimeout: *idle,
+		Retention:          *retention,
+		Coalesce:           *coalesce,
+		Occupancy:          *occupancy,
+		MultiTenant:        *multiTenant,
+	})
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "table":
+		steady := "AFTER A YEAR"
+		if *retention > 0 {
+			steady = "AT RETENTION"
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "TABLE\tROWS/DAY\tGROWTH/DAY\t%s\tWRITES/S\n", steady)
+		for _, e := range estimates {
+			fmt.Fprintf(tw, "%s\t%.0f\t%s\t%s\t%.1f\n", e.Table, e.RowsPerDay, formatBytes(e.BytesPerDay), formatBytes(e.SteadyStateBytes), e.WritesPerSecond)
+		}
+		return tw.Flush()
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(estimates)
+	default:
+		return fmt.Errorf("invalid -format %q, must be table or json", *format)
+	}
+}
+
+// formatBytes formats n bytes with a binary unit.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
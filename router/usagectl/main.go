@@ -0,0 +1,284 @@
+//go:build ns
+
+// Command usagectl inspects usage databases.
+//
+// query queries the validator usage of a database, either from flags or with an
+// interactive console which guides operators through the query. diff compares the
+// records of two databases. estimate projects the storage of a deployment.
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/metrics"
+	"github.com/Rocket-Rescue-Node/rescue-proxy/router"
+	"go.uber.org/zap"
+)
+
+// Output formats of the results
+var formats = []string{"table", "json", "csv"}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "query":
+		err = runQuery(os.Args[2:])
+	case "diff":
+		err = runDiff(os.Args[2:])
+	case "estimate":
+		err = runEstimate(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: usagectl <command> [flags]
+
+Commands:
+  query     Query the usage of a usage database
+  diff      Compare the records of two usage databases
+  estimate  Project the storage growth and write rate of a deployment
+
+Run usagectl <command> -h for the flags of a command.
+`)
+	os.Exit(2)
+}
+
+// trackerFlags are the flags opening a usage database.
+type trackerFlags struct {
+	// Names the tracker's metrics, which must differ between the trackers opened
+	name      string
+	dsn       *string
+	model     *string
+	precision *time.Duration
+}
+
+func addTrackerFlags(fs *flag.FlagSet, prefix string, what string) trackerFlags {
+	return trackerFlags{
+		name:      strings.TrimSuffix(prefix, "-"),
+		dsn:       fs.String(prefix+"usage-db", "file:nodeset-usage.db?cache=shared", "DSN of the database "+what),
+		model:     fs.String(prefix+"usage-model", "buckets", "Usage model of the database "+what+", buckets, sessions or hybrid"),
+		precision: fs.Duration(prefix+"usage-precision", 5*time.Minute, "Width of the buckets of the database "+what),
+	}
+}
+
+func (f trackerFlags) open(logger *zap.Logger) router.UsageTracker {
+	return router.NewUsageTracker(logger, router.UsageTrackerOptions{
+		Name:      f.name,
+		DSN:       *f.dsn,
+		Model:     router.UsageModel(*f.model),
+		Precision: *f.precision,
+	})
+}
+
+func newLogger() (*zap.Logger, error) {
+	logger, err := zap.NewProduction(zap.IncreaseLevel(zap.WarnLevel))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := metrics.Init("rescue_proxy_usagectl"); err != nil {
+		return nil, err
+	}
+	return logger, nil
+}
+
+func runQuery(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	db := addTrackerFlags(fs, "", "usage is read from")
+	from := fs.String("from", "24h", "Start of the range, an RFC3339 time or a duration before now")
+	to := fs.String("to", "", "End of the range, an RFC3339 time or a duration before now. Now if empty.")
+	validator := fs.String("validator", "", "Optional validator index or pubkey to filter on")
+	format := fs.String("format", "table", "Output format, "+strings.Join(formats, ", "))
+	interactive := fs.Bool("interactive", false, "Prompt for the range, filters and format instead, and run queries until the input ends")
+	_ = fs.Parse(args)
+
+	logger, err := newLogger()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = logger.Sync()
+	}()
+	tracker := db.open(logger)
+	defer tracker.Close()
+
+	q := query{From: *from, To: *to, Validator: *validator, Format: *format}
+	if *interactive {
+		c := &console{in: bufio.NewScanner(os.Stdin), out: os.Stdout, tracker: tracker}
+		return c.run(q)
+	}
+	return q.run(tracker, os.Stdout, time.Now())
+}
+
+// query is a usage query as entered, parsed when it's run.
+type query struct {
+	From      string
+	To        string
+	Validator string
+	Format    string
+}
+
+// parseTime parses an RFC3339 time, or a duration before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return now, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func (q query) run(tracker router.UsageTracker, w io.Writer, now time.Time) error {
+	from, err := parseTime(q.From, now)
+	if err != nil {
+		return fmt.Errorf("invalid from: %w", err)
+	}
+	to, err := parseTime(q.To, now)
+	if err != nil {
+		return fmt.Errorf("invalid to: %w", err)
+	}
+	var validator router.ValidatorID
+	if q.Validator != "" {
+		if validator, err = router.ParseValidatorID(q.Validator); err != nil {
+			return err
+		}
+	}
+
+	summary, err := router.SummarizeUsage(tracker, from, to)
+	if err != nil {
+		return err
+	}
+	validators := summary.ValidatorIDs()
+	if validator != "" {
+		validators = []router.ValidatorID{validator}
+	}
+
+	switch q.Format {
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VALIDATOR\tUSAGE")
+		for _, v := range validators {
+			fmt.Fprintf(tw, "%s\t%s\n", v, summary.Usage(v))
+		}
+		fmt.Fprintf(tw, "TOTAL (%d)\t%s\n", len(validators), total(summary, validators))
+		return tw.Flush()
+	case "json":
+		type row struct {
+			Validator router.ValidatorID `json:"validator"`
+			Seconds   float64            `json:"seconds"`
+		}
+		rows := make([]row, 0, len(validators))
+		for _, v := range validators {
+			rows = append(rows, row{Validator: v, Seconds: summary.Usage(v).Seconds()})
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(map[string]any{"from": from, "to": to, "validators": rows})
+	case "csv":
+		cw := csv.NewWriter(w)
+		_ = cw.Write([]string{"validator", "seconds"})
+		for _, v := range validators {
+			_ = cw.Write([]string{v.String(), strconv.FormatFloat(summary.Usage(v).Seconds(), 'f', -1, 64)})
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("invalid format %q, must be one of %s", q.Format, strings.Join(formats, ", "))
+	}
+}
+
+func total(summary *router.UsageSummary, validators []router.ValidatorID) time.Duration {
+	var out time.Duration
+	for _, v := range validators {
+		out += summary.Usage(v)
+	}
+	return out
+}
+
+// errQuit is returned by prompts when the input ends.
+var errQuit = errors.New("quit")
+
+// console prompts for queries and runs them, defaulting each answer to that of the
+// previous query.
+type console struct {
+	in      *bufio.Scanner
+	out     io.Writer
+	tracker router.UsageTracker
+}
+
+// prompt asks question and returns the answer, or def if it's empty.
+func (c *console) prompt(question string, def string) (string, error) {
+	fmt.Fprintf(c.out, "%s [%s]: ", question, def)
+	if !c.in.Scan() {
+		if err := c.in.Err(); err != nil {
+			return "", err
+		}
+		return "", errQuit
+	}
+	if answer := strings.TrimSpace(c.in.Text()); answer != "" {
+		return answer, nil
+	}
+	return def, nil
+}
+
+func (c *console) run(q query) error {
+	fmt.Fprintln(c.out, "Usage query console. Enter keeps the value in brackets, end the input to quit.")
+	for {
+		var err error
+		for _, p := range []struct {
+			question string
+			answer   *string
+			// Shown for, and entered as, an empty value
+			blank string
+		}{
+			{"From, an RFC3339 time or a duration before now, eg, 24h", &q.From, ""},
+			{"To, an RFC3339 time or a duration before now", &q.To, "now"},
+			{"Validator index or pubkey", &q.Validator, "all"},
+			{"Format, " + strings.Join(formats, ", "), &q.Format, ""},
+		} {
+			def := *p.answer
+			if def == "" {
+				def = p.blank
+			}
+			if *p.answer, err = c.prompt(p.question, def); err != nil {
+				break
+			}
+			if *p.answer == p.blank {
+				*p.answer = ""
+			}
+		}
+		if errors.Is(err, errQuit) {
+			fmt.Fprintln(c.out)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := q.run(c.tracker, c.out, time.Now()); err != nil {
+			// Mistakes are corrected in the next query
+			fmt.Fprintf(c.out, "Error: %v\n", err)
+		}
+		fmt.Fprintln(c.out)
+	}
+}
@@ -0,0 +1,84 @@
+//go:build ns
+
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryTracker returns the same usage for every range, and keeps the ranges viewed.
+type memoryTracker struct {
+	usage  map[string]time.Duration
+	ranges [][2]time.Time
+}
+
+func (t *memoryTracker) RecordUsage(indices []string) error {
+	return nil
+}
+
+func (t *memoryTracker) ViewUsage(from time.Time, to time.Time) (map[string]time.Duration, error) {
+	t.ranges = append(t.ranges, [2]time.Time{from, to})
+	return t.usage, nil
+}
+
+func (t *memoryTracker) Close() {}
+
+func TestConsole(t *testing.T) {
+	tracker := &memoryTracker{usage: map[string]time.Duration{"1": time.Hour, "2": 30 * time.Minute}}
+	// One query per four answers of from, to, validator and format. Empty answers keep
+	// the previous query's.
+	input := strings.Join([]string{
+		"2h", "", "", "",
+		"", "1h", "1", "json",
+		"", "now", "all", "csv",
+		"", "", "", "yaml",
+		"", "", "", "table",
+	}, "\n") + "\n"
+	var out strings.Builder
+	c := &console{in: bufio.NewScanner(strings.NewReader(input)), out: &out, tracker: tracker}
+	if err := c.run(query{From: "24h", Format: "table"}); err != nil {
+		t.Fatal(err)
+	}
+	output := out.String()
+
+	// The mistake is printed without ending the console
+	if len(tracker.ranges) != 5 {
+		t.Fatalf("Expected 5 queries to run, got %d:\n%s", len(tracker.ranges), output)
+	}
+	for i, expected := range []time.Duration{2 * time.Hour, time.Hour, 2 * time.Hour, 2 * time.Hour, 2 * time.Hour} {
+		if d := tracker.ranges[i][1].Sub(tracker.ranges[i][0]); d != expected {
+			t.Fatalf("Expected query %d to span %s, got %s", i, expected, d)
+		}
+	}
+
+	for _, expected := range []string{
+		// Answers carry over, blank ones are shown as now and all
+		"From, an RFC3339 time or a duration before now, eg, 24h [24h]: ",
+		"To, an RFC3339 time or a duration before now [now]: ",
+		"Validator index or pubkey [all]: ",
+		"From, an RFC3339 time or a duration before now, eg, 24h [2h]: ",
+		"To, an RFC3339 time or a duration before now [1h]: ",
+		"Validator index or pubkey [1]: ",
+		"Format, table, json, csv [json]: ",
+		"Format, table, json, csv [yaml]: ",
+		// Every format
+		"TOTAL (2)  1h30m0s\n",
+		`"validator": "1",` + "\n" + `      "seconds": 3600`,
+		"validator,seconds\n1,3600\n2,1800\n",
+		`Error: invalid format "yaml"`,
+	} {
+		if !strings.Contains(output, expected) {
+			t.Fatalf("Expected %q in the output:\n%s", expected, output)
+		}
+	}
+	// The validator filter was cleared by all
+	if strings.Count(output, "TOTAL (2)") != 2 {
+		t.Fatalf("Expected both tables to list every validator:\n%s", output)
+	}
+	if strings.Contains(output, `"validator": "2"`) {
+		t.Fatalf("Expected the JSON query to be filtered on validator 1:\n%s", output)
+	}
+}
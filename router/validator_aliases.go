@@ -0,0 +1,176 @@
+//go:build ns
+
+package router
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNoAlias is returned when an identifier isn't an alias.
+	ErrNoAlias = errors.New("no such validator alias")
+	// ErrInvalidAlias is returned for empty aliases and aliases of themselves.
+	ErrInvalidAlias = errors.New("invalid validator alias")
+	// ErrAliasChain is returned when an alias would point at another alias, or
+	// an aliased identifier would become an alias itself.
+	ErrAliasChain = errors.New("validator aliases can't be chained")
+)
+
+// ValidatorAlias links the usage recorded under Alias to Validator, for validators
+// whose identity changed, e.g. keys which were re-registered under a new index.
+type ValidatorAlias struct {
+	Alias     string    `json:"alias"`
+	Validator string    `json:"validator"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AliasStore maps the identities usage was recorded under to canonical validators.
+// Usage itself is never rewritten, aliases are resolved when reporting.
+type AliasStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewAliasStore creates the alias table in db if needed.
+func NewAliasStore(logger *zap.Logger, db *sql.DB) (*AliasStore, error) {
+	store := &AliasStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *AliasStore) initSchema() error {
+	// created_at is unix milliseconds
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS validator_aliases (
+		alias TEXT PRIMARY KEY,
+		validator_index TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_aliases_validator ON validator_aliases(validator_index);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// Put makes alias an alias of validator, replacing its previous target if any.
+func (store *AliasStore) Put(alias string, validator string) (*ValidatorAlias, error) {
+	if alias == "" || validator == "" || alias == validator {
+		return nil, fmt.Errorf("%w %q of validator %q", ErrInvalidAlias, alias, validator)
+	}
+
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Aliases resolve in a single step, so validator can't be an alias and alias can't be aliased
+	var chained int
+	err = tx.QueryRow(`
+	SELECT COUNT(*) FROM validator_aliases WHERE alias = ?1 OR validator_index = ?2
+	`, validator, alias).Scan(&chained)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query validator aliases: %w", err)
+	}
+	if chained > 0 {
+		return nil, ErrAliasChain
+	}
+
+	out := &ValidatorAlias{
+		Alias:     alias,
+		Validator: validator,
+		CreatedAt: time.UnixMilli(store.clock().UnixMilli()).UTC(),
+	}
+	_, err = tx.Exec(`
+	INSERT INTO validator_aliases (alias, validator_index, created_at) VALUES (?, ?, ?)
+	ON CONFLICT (alias) DO UPDATE SET
+		validator_index = excluded.validator_index,
+		created_at = excluded.created_at
+	`, out.Alias, out.Validator, out.CreatedAt.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to store validator alias: %w", err)
+	}
+
+	return out, tx.Commit()
+}
+
+// Delete removes an alias.
+func (store *AliasStore) Delete(alias string) error {
+	res, err := store.Database.Exec("DELETE FROM validator_aliases WHERE alias = ?", alias)
+	if err != nil {
+		return fmt.Errorf("failed to delete validator alias: %w", err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNoAlias
+	}
+
+	return nil
+}
+
+// List returns every alias, ordered by alias.
+func (store *AliasStore) List() ([]ValidatorAlias, error) {
+	rows, err := store.Database.Query(`
+	SELECT alias, validator_index, created_at FROM validator_aliases ORDER BY alias
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query validator aliases: %w", err)
+	}
+	defer rows.Close()
+
+	out := []ValidatorAlias{}
+	for rows.Next() {
+		var a ValidatorAlias
+		var createdAt int64
+		if err := rows.Scan(&a.Alias, &a.Validator, &createdAt); err != nil {
+			return nil, err
+		}
+		a.CreatedAt = time.UnixMilli(createdAt).UTC()
+		out = append(out, a)
+	}
+
+	return out, rows.Err()
+}
+
+// LinkUsage merges the usage of aliases into their validators.
+func (store *AliasStore) LinkUsage(usage map[string]time.Duration) (map[string]time.Duration, error) {
+	aliases, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	canonical := make(map[string]string, len(aliases))
+	for _, a := range aliases {
+		canonical[a.Alias] = a.Validator
+	}
+
+	out := make(map[string]time.Duration, len(usage))
+	for validator, d := range usage {
+		if c, ok := canonical[validator]; ok {
+			validator = c
+		}
+		out[validator] += d
+	}
+
+	return out, nil
+}
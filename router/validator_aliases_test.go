@@ -0,0 +1,113 @@
+//go:build ns
+
+package router
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func setupAliasTestDatabase(t *testing.T) *AliasStore {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanup)
+
+	store, err := NewAliasStore(zaptest.NewLogger(t), tracker.(*SQLiteUsageTracker).primaryDatabase())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.now = func() time.Time { return time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC) }
+	return store
+}
+
+func TestAliasPutList(t *testing.T) {
+	store := setupAliasTestDatabase(t)
+
+	if _, err := store.Put("100", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// Replaces the earlier target
+	alias, err := store.Put("100", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alias.Validator != "2" || !alias.CreatedAt.Equal(store.now()) {
+		t.Fatalf("Unexpected alias %+v", alias)
+	}
+	if _, err := store.Put("200", "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	aliases, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aliases) != 2 || aliases[0] != *alias || aliases[1].Alias != "200" {
+		t.Fatalf("Unexpected aliases %+v", aliases)
+	}
+}
+
+func TestAliasInvalid(t *testing.T) {
+	store := setupAliasTestDatabase(t)
+
+	for _, tt := range [][2]string{{"", "1"}, {"1", ""}, {"1", "1"}} {
+		if _, err := store.Put(tt[0], tt[1]); !errors.Is(err, ErrInvalidAlias) {
+			t.Fatalf("Expected ErrInvalidAlias for %v, got %v", tt, err)
+		}
+	}
+}
+
+func TestAliasChain(t *testing.T) {
+	store := setupAliasTestDatabase(t)
+
+	if _, err := store.Put("100", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// 1 is aliased, so it can't become an alias
+	if _, err := store.Put("1", "2"); !errors.Is(err, ErrAliasChain) {
+		t.Fatalf("Expected ErrAliasChain, got %v", err)
+	}
+	// 100 is an alias, so nothing can be aliased to it
+	if _, err := store.Put("200", "100"); !errors.Is(err, ErrAliasChain) {
+		t.Fatalf("Expected ErrAliasChain, got %v", err)
+	}
+}
+
+func TestAliasDelete(t *testing.T) {
+	store := setupAliasTestDatabase(t)
+
+	if _, err := store.Put("100", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("100"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("100"); !errors.Is(err, ErrNoAlias) {
+		t.Fatalf("Expected ErrNoAlias, got %v", err)
+	}
+}
+
+func TestAliasLinkUsage(t *testing.T) {
+	store := setupAliasTestDatabase(t)
+
+	if _, err := store.Put("100", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	linked, err := store.LinkUsage(map[string]time.Duration{
+		"1":   time.Hour,
+		"100": 30 * time.Minute,
+		"2":   time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(linked) != 2 || linked["1"] != 90*time.Minute || linked["2"] != time.Minute {
+		t.Fatalf("Unexpected linked usage %v", linked)
+	}
+}
@@ -0,0 +1,351 @@
+//go:build ns
+
+package router
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"go.uber.org/zap"
+)
+
+const (
+	// How long cached metadata is used before it's refreshed. Activation doesn't change,
+	// but status, exit and withdrawal credentials do.
+	validatorMetadataMaxAge = 24 * time.Hour
+	// Validators looked up on the beacon node per request
+	validatorMetadataBatch = 500
+	// Epoch the beacon chain uses for events which aren't scheduled
+	farFutureEpoch = ^uint64(0)
+)
+
+// ValidatorMetadata is the cached beacon chain state of a validator.
+type ValidatorMetadata struct {
+	Validator             string `json:"validator"`
+	Pubkey                string `json:"pubkey"`
+	WithdrawalCredentials string `json:"withdrawal_credentials"`
+	Status                string `json:"status"`
+	// Unset until scheduled
+	ActivationEpoch *uint64   `json:"activation_epoch,omitempty"`
+	ExitEpoch       *uint64   `json:"exit_epoch,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// ValidatorUsage is the usage of a validator, with its metadata if cached.
+type ValidatorUsage struct {
+	Validator string             `json:"validator"`
+	Usage     time.Duration      `json:"usage"`
+	Metadata  *ValidatorMetadata `json:"metadata,omitempty"`
+}
+
+// ValidatorMetadataStore caches the beacon chain state of validators which used the
+// rescue node, so reports don't query the beacon node. Rows are keyed by the
+// validator_index of validator_usage and can be joined with it.
+type ValidatorMetadataStore struct {
+	Database *sql.DB
+	Logger   *zap.Logger
+
+	wallClock
+}
+
+// NewValidatorMetadataStore creates the validator metadata table in db if needed.
+func NewValidatorMetadataStore(logger *zap.Logger, db *sql.DB) (*ValidatorMetadataStore, error) {
+	store := &ValidatorMetadataStore{
+		Database: db,
+		Logger:   logger,
+	}
+
+	if err := store.initSchema(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *ValidatorMetadataStore) initSchema() error {
+	// Epochs are NULL until scheduled, updated_at is a unix timestamp
+	createTableSQL := `
+	CREATE TABLE IF NOT EXISTS validator_metadata (
+		validator_index TEXT PRIMARY KEY,
+		pubkey TEXT NOT NULL,
+		withdrawal_credentials TEXT NOT NULL,
+		status TEXT NOT NULL,
+		activation_epoch INTEGER,
+		exit_epoch INTEGER,
+		updated_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_validator_metadata_updated_at ON validator_metadata(updated_at);
+	`
+
+	_, err := store.Database.Exec(createTableSQL)
+	return err
+}
+
+// epochParam stores epochs which aren't scheduled as NULL, since they overflow INTEGER.
+func epochParam(epoch uint64) sql.NullInt64 {
+	if epoch == farFutureEpoch {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(epoch), Valid: true}
+}
+
+// Update stores the state of validators, keyed by index.
+func (store *ValidatorMetadataStore) Update(validators map[string]*apiv1.Validator) error {
+	now := store.clock().Unix()
+
+	tx, err := store.Database.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+	INSERT INTO validator_metadata
+		(validator_index, pubkey, withdrawal_credentials, status, activation_epoch, exit_epoch, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (validator_index) DO UPDATE SET
+		pubkey = excluded.pubkey,
+		withdrawal_credentials = excluded.withdrawal_credentials,
+		status = excluded.status,
+		activation_epoch = excluded.activation_epoch,
+		exit_epoch = excluded.exit_epoch,
+		updated_at = excluded.updated_at
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare validator metadata statement: %w", err)
+	}
+	defer stmt.Close()
+
+	for index, validator := range validators {
+		if validator == nil || validator.Validator == nil {
+			continue
+		}
+		_, err := stmt.Exec(index,
+			"0x"+hex.EncodeToString(validator.Validator.PublicKey[:]),
+			"0x"+hex.EncodeToString(validator.Validator.WithdrawalCredentials),
+			validator.Status.String(),
+			epochParam(uint64(validator.Validator.ActivationEpoch)),
+			epochParam(uint64(validator.Validator.ExitEpoch)),
+			now)
+		if err != nil {
+			return fmt.Errorf("failed to store the metadata of validator %s: %w", index, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Get returns the cached metadata of the given validators. Validators which aren't
+// cached are omitted.
+func (store *ValidatorMetadataStore) Get(validators []string) (map[string]*ValidatorMetadata, error) {
+	out := make(map[string]*ValidatorMetadata, len(validators))
+	if len(validators) == 0 {
+		return out, nil
+	}
+
+	params := make([]string, 0, len(validators))
+	args := make([]any, 0, len(validators))
+	for _, validator := range validators {
+		params = append(params, "?")
+		args = append(args, validator)
+	}
+	rows, err := store.Database.Query(fmt.Sprintf(`
+	SELECT validator_index, pubkey, withdrawal_credentials, status, activation_epoch, exit_epoch, updated_at
+	FROM validator_metadata WHERE validator_index IN (%s)
+	`, strings.Join(params, ",")), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query validator metadata: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m ValidatorMetadata
+		var activation, exit sql.NullInt64
+		var updatedAt int64
+		if err := rows.Scan(&m.Validator, &m.Pubkey, &m.WithdrawalCredentials, &m.Status, &activation, &exit, &updatedAt); err != nil {
+			return nil, err
+		}
+		if activation.Valid {
+			epoch := uint64(activation.Int64)
+			m.ActivationEpoch = &epoch
+		}
+		if exit.Valid {
+			epoch := uint64(exit.Int64)
+			m.ExitEpoch = &epoch
+		}
+		m.UpdatedAt = time.Unix(updatedAt, 0).UTC()
+		out[m.Validator] = &m
+	}
+
+	return out, rows.Err()
+}
+
+// Stale returns the validators whose metadata isn't cached or was updated before cutoff.
+func (store *ValidatorMetadataStore) Stale(validators []string, cutoff time.Time) ([]string, error) {
+	cached, err := store.Get(validators)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0)
+	for _, validator := range validators {
+		if m, ok := cached[validator]; !ok || m.UpdatedAt.Before(cutoff) {
+			out = append(out, validator)
+		}
+	}
+	return out, nil
+}
+
+// Report returns the usage of every validator in the buckets overlapping [from, to]
+// with its cached metadata, most used first.
+func (store *ValidatorMetadataStore) Report(tracker usageBuckets, from time.Time, to time.Time) ([]ValidatorUsage, error) {
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+
+	precision := tracker.bucketPrecision()
+	records, err := tracker.usageRecords(from.Truncate(precision), to.Truncate(precision).Add(precision))
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]time.Duration)
+	for _, record := range records {
+		usage[record.Validator.String()] += precision
+	}
+	validators := make([]string, 0, len(usage))
+	for validator := range usage {
+		validators = append(validators, validator)
+	}
+	metadata, err := store.Get(validators)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]ValidatorUsage, 0, len(usage))
+	for _, validator := range validators {
+		out = append(out, ValidatorUsage{
+			Validator: validator,
+			Usage:     usage[validator],
+			Metadata:  metadata[validator],
+		})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Usage != out[j].Usage {
+			return out[i].Usage > out[j].Usage
+		}
+		return out[i].Validator < out[j].Validator
+	})
+
+	return out, nil
+}
+
+// validatorStater is implemented by consensus layers which can look up the state of
+// validators.
+type validatorStater interface {
+	GetValidatorStates(validatorIndices []string) (map[string]*apiv1.Validator, error)
+}
+
+// ValidatorMetadataJob periodically refreshes the metadata of the validators which used
+// the rescue node since the previous refresh, when it's missing or stale.
+type ValidatorMetadataJob struct {
+	CL       validatorStater
+	Tracker  UsageTracker
+	Store    *ValidatorMetadataStore
+	Interval time.Duration
+	Logger   *zap.Logger
+}
+
+// Refresh looks up the validators used in the last interval whose metadata is missing
+// or stale, and returns how many were updated.
+func (job *ValidatorMetadataJob) Refresh() (int, error) {
+	now := job.Store.clock()
+	usage, err := job.Tracker.ViewUsage(now.Add(-job.Interval), now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to view usage: %w", err)
+	}
+
+	validators := make([]string, 0, len(usage))
+	for validator := range usage {
+		validators = append(validators, validator)
+	}
+	sort.Strings(validators)
+	stale, err := job.Store.Stale(validators, now.Add(-validatorMetadataMaxAge))
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for len(stale) > 0 {
+		batch := stale[:min(len(stale), validatorMetadataBatch)]
+		stale = stale[len(batch):]
+
+		states, err := job.CL.GetValidatorStates(batch)
+		if err != nil {
+			return updated, fmt.Errorf("failed to get validator states: %w", err)
+		}
+		if err := job.Store.Update(states); err != nil {
+			return updated, err
+		}
+		updated += len(states)
+	}
+
+	return updated, nil
+}
+
+// Run refreshes metadata every Interval until ctx is done.
+func (job *ValidatorMetadataJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := job.Refresh(); err != nil {
+			job.Logger.Warn("Failed to refresh validator metadata", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// serveValidatorUsage returns the usage of every validator in the buckets overlapping
+// [from, to], with its cached metadata.
+func (pr *ProxyRouter) serveValidatorUsage(w http.ResponseWriter, r *http.Request) {
+	tracker, ok := pr.ut.(usageBuckets)
+	if pr.metadata == nil || !ok {
+		http.Error(w, "validator metadata requires -usage-validator-metadata-interval", http.StatusNotImplemented)
+		return
+	}
+
+	from, to, err := parseUsageRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := pr.metadata.Report(tracker, from, to)
+	if err != nil {
+		var rangeErr *RangeError
+		if errors.As(err, &rangeErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pr.Logger.Error("Failed to report validator usage", zap.Error(err))
+		http.Error(w, "failed to report validator usage", http.StatusInternalServerError)
+		return
+	}
+
+	pr.writeUsageJSON(w, r, report)
+}
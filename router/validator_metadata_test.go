@@ -0,0 +1,201 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Rocket-Rescue-Node/rescue-proxy/test"
+	apiv1 "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"go.uber.org/zap/zaptest"
+)
+
+// countingStater counts the validators looked up on the consensus layer.
+type countingStater struct {
+	*test.MockConsensusLayer
+	lookups int
+}
+
+func (c *countingStater) GetValidatorStates(indices []string) (map[string]*apiv1.Validator, error) {
+	c.lookups += len(indices)
+	return c.MockConsensusLayer.GetValidatorStates(indices)
+}
+
+func TestValidatorMetadataRefresh(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+
+	store, err := NewValidatorMetadataStore(zaptest.NewLogger(t), sqlite.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	sqlite.now = func() time.Time { return now }
+	store.now = sqlite.now
+
+	cl := &countingStater{MockConsensusLayer: test.NewMockConsensusLayer(2, "metadata")}
+	job := &ValidatorMetadataJob{
+		CL:       cl,
+		Tracker:  tracker,
+		Store:    store,
+		Interval: time.Hour,
+		Logger:   zaptest.NewLogger(t),
+	}
+
+	// 999 isn't known to the consensus layer
+	if err := tracker.RecordUsage([]string{"100", "101", "999"}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := job.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated != 2 || cl.lookups != 3 {
+		t.Fatalf("Expected 2 of 3 validators updated, got %d of %d", updated, cl.lookups)
+	}
+
+	// Fresh metadata isn't looked up again, unknown validators are
+	now = now.Add(time.Hour)
+	if err := tracker.RecordUsage([]string{"100", "999"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := job.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if cl.lookups != 4 {
+		t.Fatalf("Expected only the unknown validator to be looked up again, got %d lookups", cl.lookups)
+	}
+
+	// Stale metadata is refreshed
+	now = now.Add(validatorMetadataMaxAge)
+	if err := tracker.RecordUsage([]string{"100"}); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := job.Refresh(); err != nil || updated != 1 {
+		t.Fatalf("Expected stale metadata to be refreshed, got %d: %v", updated, err)
+	}
+
+	metadata, err := store.Get([]string{"100", "101", "999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metadata) != 2 || metadata["999"] != nil {
+		t.Fatalf("Unexpected metadata %+v", metadata)
+	}
+	if !metadata["100"].UpdatedAt.Equal(now) || metadata["101"].UpdatedAt.Equal(now) {
+		t.Fatalf("Expected only validator 100 to be refreshed, got %+v and %+v", metadata["100"], metadata["101"])
+	}
+}
+
+func TestValidatorMetadataEpochs(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	store, err := NewValidatorMetadataStore(zaptest.NewLogger(t), tracker.(*SQLiteUsageTracker).Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Update(map[string]*apiv1.Validator{
+		"1": {
+			Index:  1,
+			Status: apiv1.ValidatorStatePendingQueued,
+			Validator: &phase0.Validator{
+				WithdrawalCredentials: []byte{0x01, 0x02},
+				ActivationEpoch:       phase0.Epoch(farFutureEpoch),
+				ExitEpoch:             phase0.Epoch(farFutureEpoch),
+			},
+		},
+		"2": {
+			Index:  2,
+			Status: apiv1.ValidatorStateActiveExiting,
+			Validator: &phase0.Validator{
+				ActivationEpoch: 10,
+				ExitEpoch:       20,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := store.Get([]string{"1", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := metadata["1"]
+	if pending.ActivationEpoch != nil || pending.ExitEpoch != nil || pending.Status != "pending_queued" || pending.WithdrawalCredentials != "0x0102" {
+		t.Fatalf("Unexpected metadata %+v", pending)
+	}
+	exiting := metadata["2"]
+	if exiting.ActivationEpoch == nil || *exiting.ActivationEpoch != 10 || exiting.ExitEpoch == nil || *exiting.ExitEpoch != 20 {
+		t.Fatalf("Unexpected metadata %+v", exiting)
+	}
+}
+
+func TestAdminValidatorUsage(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sqlite := tracker.(*SQLiteUsageTracker)
+	sqlite.now = func() time.Time { return time.Date(2025, 1, 1, 0, 1, 0, 0, time.UTC) }
+
+	pr := &ProxyRouter{
+		Logger: zaptest.NewLogger(t),
+		ut:     tracker,
+	}
+	handler := pr.AdminHandler()
+	path := "/usage/validators?from=2025-01-01T00:00:00Z&to=2025-01-01T01:00:00Z"
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("Expected %d without metadata, got %d", http.StatusNotImplemented, rec.Code)
+	}
+
+	store, err := NewValidatorMetadataStore(zaptest.NewLogger(t), sqlite.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr.metadata = store
+	states, err := test.NewMockConsensusLayer(1, "metadata").GetValidatorStates([]string{"100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Update(states); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracker.RecordUsage([]string{"100", "999"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+	var report []ValidatorUsage
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 2 || report[0].Validator != "100" || report[1].Validator != "999" {
+		t.Fatalf("Unexpected report %+v", report)
+	}
+	if report[0].Usage != 5*time.Minute || report[0].Metadata == nil || report[1].Metadata != nil {
+		t.Fatalf("Expected metadata for validator 100 only, got %+v", report)
+	}
+}
@@ -0,0 +1,135 @@
+//go:build ns
+
+package router
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SharedValidator is a validator attributed to more than one operator in a range, either
+// because credentials of several nodes recorded its usage, or because it changed owners.
+// Either can corrupt billing, so they're worth investigating.
+type SharedValidator struct {
+	Validator string `json:"validator"`
+	// Nodes whose credentials recorded usage for the validator, when there were several
+	Attributions []ValidatorAttribution `json:"attributions,omitempty"`
+	// Owners of the validator per ownership snapshots, when there were several
+	Owners []OwnershipPeriod `json:"owners,omitempty"`
+}
+
+// SharedValidatorsReport lists the validators shared across operators in [From, To].
+type SharedValidatorsReport struct {
+	From       time.Time         `json:"from"`
+	To         time.Time         `json:"to"`
+	Validators []SharedValidator `json:"validators"`
+}
+
+// SharedValidators reports the validators attributed to more than one node, or owned
+// by more than one operator, in [from, to]. Either store may be nil.
+func SharedValidators(attr *AttributionStore, owners *OwnershipStore, from time.Time, to time.Time) (*SharedValidatorsReport, error) {
+	if err := validateRange(from, to); err != nil {
+		return nil, err
+	}
+
+	shared := make(map[string]*SharedValidator)
+	get := func(validator string) *SharedValidator {
+		if v, ok := shared[validator]; ok {
+			return v
+		}
+		v := &SharedValidator{Validator: validator}
+		shared[validator] = v
+		return v
+	}
+
+	if attr != nil {
+		attributions, err := attr.shared(from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range attributions {
+			v := get(a.Validator)
+			v.Attributions = append(v.Attributions, a)
+		}
+	}
+	if owners != nil {
+		periods, err := owners.shared(from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range periods {
+			v := get(p.Validator)
+			v.Owners = append(v.Owners, p)
+		}
+	}
+
+	out := &SharedValidatorsReport{
+		From:       from,
+		To:         to,
+		Validators: make([]SharedValidator, 0, len(shared)),
+	}
+	for _, v := range shared {
+		out.Validators = append(out.Validators, *v)
+	}
+	sort.Slice(out.Validators, func(i, j int) bool {
+		return out.Validators[i].Validator < out.Validators[j].Validator
+	})
+	return out, nil
+}
+
+// shared returns the attributions overlapping [from, to] of the validators attributed to
+// more than one node in that range, ordered by validator and first seen.
+func (store *AttributionStore) shared(from time.Time, to time.Time) ([]ValidatorAttribution, error) {
+	rows, err := store.Database.Query(`
+	SELECT node_address, validator_index, first_seen, last_seen FROM validator_attribution
+	WHERE last_seen >= ?1 AND first_seen <= ?2 AND validator_index IN (
+		SELECT validator_index FROM validator_attribution
+		WHERE last_seen >= ?1 AND first_seen <= ?2
+		GROUP BY validator_index HAVING COUNT(DISTINCT node_address) > 1
+	)
+	ORDER BY validator_index, first_seen
+	`, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query shared attributions: %w", err)
+	}
+	defer rows.Close()
+
+	var out []ValidatorAttribution
+	for rows.Next() {
+		var a ValidatorAttribution
+		var node string
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&node, &a.Validator, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		a.NodeAddress = common.HexToAddress(node)
+		a.FirstSeen = time.UnixMilli(firstSeen).UTC()
+		a.LastSeen = time.UnixMilli(lastSeen).UTC()
+		out = append(out, a)
+	}
+
+	return out, rows.Err()
+}
+
+// shared returns the ownership periods overlapping [from, to] of the validators owned by
+// more than one operator in that range, ordered by validator and first seen.
+func (store *OwnershipStore) shared(from time.Time, to time.Time) ([]OwnershipPeriod, error) {
+	rows, err := store.Database.Query(`
+	SELECT validator_index, owner, first_seen, last_seen FROM validator_ownership
+	WHERE last_seen >= ?1 AND first_seen <= ?2 AND validator_index IN (
+		SELECT validator_index FROM validator_ownership
+		WHERE last_seen >= ?1 AND first_seen <= ?2
+		GROUP BY validator_index HAVING COUNT(DISTINCT owner) > 1
+	)
+	ORDER BY validator_index, first_seen
+	`, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query shared ownership: %w", err)
+	}
+	defer rows.Close()
+
+	return scanOwnershipPeriods(rows)
+}
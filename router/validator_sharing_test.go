@@ -0,0 +1,98 @@
+//go:build ns
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap/zaptest"
+)
+
+func TestSharedValidators(t *testing.T) {
+	tracker, cleanup, err := setupSQLiteTestDatabase(t, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	db := tracker.(*SQLiteUsageTracker).Database
+
+	logger := zaptest.NewLogger(t)
+	attr, err := NewAttributionStore(logger, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners, err := NewOwnershipStore(logger, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := &ProxyRouter{Logger: logger, ut: tracker, attr: attr, owners: owners}
+	handler := pr.AdminHandler()
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	attr.now = func() time.Time { return now }
+	owners.now = attr.now
+
+	a := common.HexToAddress("0x000000000000000000000000000000000000000a")
+	b := common.HexToAddress("0x000000000000000000000000000000000000000b")
+
+	// 1 is used with credentials of two nodes, 2 with one
+	if err := attr.Attribute(a, []string{"1", "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := owners.Snapshot(map[string]common.Address{"1": a, "3": a}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	if err := attr.Attribute(b, []string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	// 3 is transferred
+	if _, err := owners.Snapshot(map[string]common.Address{"1": a, "3": b}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(query string) SharedValidatorsReport {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/validators/shared?"+query, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var report SharedValidatorsReport
+		if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return report
+	}
+
+	report := get("from=2025-01-01T00:00:00Z&to=2025-01-01T02:00:00Z")
+	if len(report.Validators) != 2 {
+		t.Fatalf("Expected 2 shared validators, got %+v", report.Validators)
+	}
+	if v := report.Validators[0]; v.Validator != "1" || len(v.Attributions) != 2 || len(v.Owners) != 0 ||
+		v.Attributions[0].NodeAddress != a || v.Attributions[1].NodeAddress != b {
+		t.Fatalf("Unexpected shared validator %+v", v)
+	}
+	if v := report.Validators[1]; v.Validator != "3" || len(v.Attributions) != 0 || len(v.Owners) != 2 ||
+		v.Owners[0].Owner != a || v.Owners[1].Owner != b {
+		t.Fatalf("Unexpected shared validator %+v", v)
+	}
+
+	// Nothing is shared within the first half hour
+	report = get("from=2025-01-01T00:00:00Z&to=2025-01-01T00:30:00Z")
+	if len(report.Validators) != 0 {
+		t.Fatalf("Expected no shared validators, got %+v", report.Validators)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/validators/shared?from=2025-01-01T01:00:00Z", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 without to, got %d", rec.Code)
+	}
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
 	"errors"
 	"fmt"
 	"net"
@@ -16,6 +17,7 @@ import (
 	"github.com/Rocket-Rescue-Node/rescue-proxy/consensuslayer"
 	"github.com/Rocket-Rescue-Node/rescue-proxy/executionlayer"
 	"github.com/Rocket-Rescue-Node/rescue-proxy/router"
+	"github.com/ethereum/go-ethereum/crypto"
 	"go.uber.org/zap"
 )
 
@@ -36,6 +38,9 @@ type Service struct {
 	cl    consensuslayer.ConsensusLayer
 	r     *router.ProxyRouter
 	a     *api.API
+	// Serves the usage of operators who opted in, when enabled
+	public *http.Server
+	tenant *http.Server
 
 	// error reporting channel
 	errs chan error
@@ -88,6 +93,50 @@ func (s *Service) run(ctx context.Context, errs chan error) {
 		}()
 	}
 
+	// Load the export signing key before anything slow, so a bad key fails fast
+	var reportSigningKey *ecdsa.PrivateKey
+	if s.Config.ReportSigningKey != "" {
+		key, err := crypto.LoadECDSA(s.Config.ReportSigningKey)
+		if err != nil {
+			s.errs <- fmt.Errorf("unable to load report signing key: %v", err)
+			return
+		}
+		reportSigningKey = key
+	}
+
+	faults, err := router.ParseFaultInjector(s.Config.UsageFaults)
+	if err != nil {
+		s.errs <- fmt.Errorf("invalid -usage-faults: %v", err)
+		return
+	}
+	if faults != nil {
+		s.Logger.Warn("Injecting faults into usage tracking", zap.String("faults", s.Config.UsageFaults))
+	}
+
+	memoryBudget, err := router.ParseMemoryBudget(s.Config.MemoryBudget, s.Config.MemoryBudgetCaches)
+	if err != nil {
+		s.errs <- fmt.Errorf("invalid memory budget: %v", err)
+		return
+	}
+
+	var recordingRules *router.RecordingRules
+	if s.Config.UsageRecordingRules != "" {
+		recordingRules, err = router.LoadRecordingRules(s.Config.UsageRecordingRules)
+		if err != nil {
+			s.errs <- fmt.Errorf("unable to load usage recording rules: %v", err)
+			return
+		}
+	}
+
+	var rollout *router.Rollout
+	if s.Config.UsageRollout != "" {
+		rollout, err = router.LoadRollout(s.Config.UsageRollout)
+		if err != nil {
+			s.errs <- fmt.Errorf("unable to load the usage rollout: %v", err)
+			return
+		}
+	}
+
 	// Connect to and initialize the execution layer
 	el := &executionlayer.CachingExecutionLayer{
 		ECURL:                s.Config.ExecutionURL,
@@ -113,6 +162,7 @@ func (s *Service) run(ctx context.Context, errs chan error) {
 
 	// Connect to and initialize the consensus layer
 	cl := consensuslayer.NewCachingConsensusLayer(s.Config.BeaconURL, s.Logger, s.Config.ForceBNJSON)
+	cl.ValidatorCacheSize = memoryBudget.MiB(router.MemoryCacheValidators)
 	s.cl = cl
 	s.Logger.Info("Starting CL monitor")
 	// Consensus Layer is non-blocking/synchronous only.
@@ -128,21 +178,142 @@ func (s *Service) run(ctx context.Context, errs chan error) {
 		return
 	}
 
+	var dataMinimization *router.DataMinimization
+	if s.Config.UsageMinimize {
+		dataMinimization = &router.DataMinimization{
+			PseudonymKey: s.Config.UsagePseudonymKey,
+		}
+	}
+
 	s.r = &router.ProxyRouter{
-		Addr:                 s.Config.ListenAddr,
-		BeaconURL:            s.Config.BeaconURL,
-		GRPCAddr:             s.Config.GRPCListenAddr,
-		GRPCBeaconURL:        s.Config.GRPCBeaconAddr,
-		TLSCertFile:          s.Config.GRPCTLSCertFile,
-		TLSKeyFile:           s.Config.GRPCTLSKeyFile,
-		Logger:               s.Logger,
-		EL:                   s.el,
-		CL:                   s.cl,
-		EnableSoloValidators: s.Config.EnableSoloValidators,
-		CredentialSecrets:    s.Config.CredentialSecrets,
-		ExpectedFeeRecipient: s.Config.FeeRecipient,
+		Addr:                      s.Config.ListenAddr,
+		BeaconURL:                 s.Config.BeaconURL,
+		GRPCAddr:                  s.Config.GRPCListenAddr,
+		GRPCBeaconURL:             s.Config.GRPCBeaconAddr,
+		TLSCertFile:               s.Config.GRPCTLSCertFile,
+		TLSKeyFile:                s.Config.GRPCTLSKeyFile,
+		Logger:                    s.Logger,
+		EL:                        s.el,
+		CL:                        s.cl,
+		EnableSoloValidators:      s.Config.EnableSoloValidators,
+		CredentialSecrets:         s.Config.CredentialSecrets,
+		ExpectedFeeRecipient:      s.Config.FeeRecipient,
+		UsageCommitmentPeriod:     s.Config.UsageCommitPeriod,
+		UsageCommitmentWebhook:    s.Config.UsageCommitWebhook,
+		ReportSigningKey:          reportSigningKey,
+		UsageRetention:            s.Config.UsageRetention,
+		DataMinimization:          dataMinimization,
+		DutyCoverage:              s.Config.UsageDutyCoverage,
+		MissedProposalWebhook:     s.Config.UsageMissedWebhook,
+		OwnershipSnapshotInterval: s.Config.UsageOwnershipPeriod,
+		OwnershipRefreshInterval:  s.Config.UsageOwnershipRefresh,
+		OwnershipWebhook:          s.Config.UsageOwnershipWebhook,
+		AdminUndoWindow:           s.Config.AdminUndoWindow,
+		ReportTimeZone:            s.Config.UsageReportTimeZone,
+		ValidatorMetadataInterval: s.Config.UsageMetadataPeriod,
+		WarmUpWindow:              s.Config.UsageWarmUpWindow,
+		OperatorDailyInterval:     s.Config.UsageOperatorDaily,
+		AdminQueryCostLimit:       s.Config.AdminQueryCostLimit,
+		AdminIdempotencyWindow:    s.Config.AdminIdempotency,
+		DeepTrackingRate:          s.Config.UsageDeepTracking,
+		UsageWriteQueue:           s.Config.UsageWriteQueue,
+		MemoryBudget:              memoryBudget,
+		AdminReadBreaker: router.ReadBreakerOptions{
+			Failures: s.Config.AdminBreakerFailures,
+			Cooldown: s.Config.AdminBreakerCooldown,
+			SlowRead: s.Config.AdminBreakerSlowRead,
+		},
+		Policy: router.PolicyWebhookOptions{
+			URL:        s.Config.PolicyWebhook,
+			Format:     router.PolicyFormat(s.Config.PolicyWebhookFormat),
+			Timeout:    s.Config.PolicyWebhookTimeout,
+			TTL:        s.Config.PolicyWebhookTTL,
+			FailClosed: s.Config.PolicyFailClosed,
+		},
+		LoadThresholds: router.LoadThresholds{
+			ElevatedValidators:   s.Config.LoadElevatedVals,
+			OverloadedValidators: s.Config.LoadOverloadVals,
+			ElevatedLatency:      s.Config.LoadElevatedLatency,
+			OverloadedLatency:    s.Config.LoadOverloadLatency,
+		},
+		UsageEventLog: router.UsageEventLogOptions{
+			Path:       s.Config.UsageEventLog,
+			MaxSize:    s.Config.UsageEventLogSize,
+			MaxAge:     s.Config.UsageEventLogAge,
+			MaxBackups: s.Config.UsageEventLogBackups,
+			Instance:   s.Config.UsageEventInstance,
+		},
+		UsageInflux: router.InfluxOptions{
+			URL:           s.Config.UsageInfluxURL,
+			Org:           s.Config.UsageInfluxOrg,
+			Bucket:        s.Config.UsageInfluxBucket,
+			Token:         s.Config.UsageInfluxToken,
+			FlushInterval: s.Config.UsageInfluxFlush,
+		},
+		RecordingRules: recordingRules,
+		UsageShadow: router.UsageShadowOptions{
+			DSN:       s.Config.UsageShadowDSN,
+			Model:     router.UsageModel(s.Config.UsageShadowModel),
+			Tolerance: s.Config.UsageShadowTolerance,
+		},
+		Rollout: rollout,
+		UsageSLO: router.SLOObjectives{
+			WriteSuccess:       s.Config.UsageSLOWriteSuccess,
+			WriteLatency:       s.Config.UsageSLOWriteLatency,
+			WriteLatencyTarget: s.Config.UsageSLOLatencyTarget,
+			SpoolFree:          s.Config.UsageSLOSpoolFree,
+		},
+		UsageTrackerOptions: router.UsageTrackerOptions{
+			DSN:                s.Config.UsageDSN,
+			ReadDSN:            s.Config.UsageReadDSN,
+			Model:              router.UsageModel(s.Config.UsageModel),
+			SessionIdleTimeout: s.Config.UsageSessionIdle,
+			Precision:          s.Config.UsagePrecision,
+			BoundaryGrace:      s.Config.UsageBoundaryGrace,
+			Coalesce:           s.Config.UsageCoalesce,
+			Occupancy:          s.Config.UsageOccupancy,
+			MultiTenant:        s.Config.UsageMultiTenant,
+			MaxOpenConns:       s.Config.UsageMaxOpenConns,
+			MaxIdleConns:       s.Config.UsageMaxIdleConns,
+			ConnMaxLifetime:    s.Config.UsageConnMaxLifetime,
+			ConnMaxIdleTime:    s.Config.UsageConnMaxIdleTime,
+			TxLock:             s.Config.UsageTxLock,
+			ConflictPolicy:     router.UsageConflictPolicy(s.Config.UsageConflictPolicy),
+			WriteRetries:       s.Config.UsageWriteRetries,
+			SkewPolicy:         router.ClockSkewPolicy(s.Config.UsageClockSkew),
+			Faults:             faults,
+			StartupPolicy:      router.UsageStartupPolicy(s.Config.UsageStartupPolicy),
+			StartupRetryFor:    s.Config.UsageStartupRetry,
+		},
 	}
 	s.r.Init()
+	s.admin.Mount("/", s.r.AdminHandler())
+	if s.Config.PublicListenAddr != "" {
+		s.public = &http.Server{
+			Addr:              s.Config.PublicListenAddr,
+			Handler:           s.r.PublicHandler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			s.Logger.Info("Starting public usage endpoint", zap.String("addr", s.Config.PublicListenAddr))
+			if err := s.public.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.errs <- err
+			}
+		}()
+	}
+	if s.Config.TenantListenAddr != "" {
+		s.tenant = &http.Server{
+			Addr:              s.Config.TenantListenAddr,
+			Handler:           s.r.TenantHandler(),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			s.Logger.Info("Starting tenant API", zap.String("addr", s.Config.TenantListenAddr))
+			if err := s.tenant.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.errs <- err
+			}
+		}()
+	}
 	// Spin up the rest of the servers on different goroutines, since they block.
 	go func() {
 		s.Logger.Info("Starting http server", zap.String("url", s.Config.ListenAddr))
@@ -180,9 +351,19 @@ func (s *Service) run(ctx context.Context, errs chan error) {
 	s.a.Deinit()
 	s.Logger.Info("Stopped API")
 
-	// Stop the proxy
-	s.r.Stop(ctx)
-	s.Logger.Info("Stopped router")
+	if s.public != nil {
+		if err := s.public.Shutdown(ctx); err != nil {
+			s.Logger.Info("Error stopping public usage endpoint", zap.Error(err))
+		}
+		s.Logger.Info("Stopped public usage endpoint")
+	}
+
+	if s.tenant != nil {
+		if err := s.tenant.Shutdown(ctx); err != nil {
+			s.Logger.Info("Error stopping tenant API", zap.Error(err))
+		}
+		s.Logger.Info("Stopped tenant API")
+	}
 
 	// Shut down metrics server
 	if err := s.admin.Shutdown(ctx); err != nil {
@@ -190,6 +371,11 @@ func (s *Service) run(ctx context.Context, errs chan error) {
 	}
 	s.Logger.Info("Stopped internal API")
 
+	// Stop the proxy after every server using its handlers, since it closes the usage
+	// database
+	s.r.Stop(ctx)
+	s.Logger.Info("Stopped router")
+
 	// Disconnect from the execution client as soon as feasible after shutting down http
 	// handlers so that we can serialize the cache
 	el.Stop()
@@ -134,3 +134,25 @@ func (m *MockConsensusLayer) GetValidators() ([]*apiv1.Validator, error) {
 
 	return out, nil
 }
+
+func (m *MockConsensusLayer) GetValidatorIndices(pubkeys []rptypes.ValidatorPubkey) (map[rptypes.ValidatorPubkey]string, error) {
+	out := make(map[rptypes.ValidatorPubkey]string)
+	for _, pubkey := range pubkeys {
+		if index, ok := m.Indices[pubkey]; ok {
+			out[pubkey] = index
+		}
+	}
+
+	return out, nil
+}
+
+func (m *MockConsensusLayer) GetValidatorStates(idx []string) (map[string]*apiv1.Validator, error) {
+	out := make(map[string]*apiv1.Validator)
+	for _, k := range idx {
+		if v, ok := m.validators[k]; ok {
+			out[k] = v
+		}
+	}
+
+	return out, nil
+}
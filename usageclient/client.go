@@ -0,0 +1,600 @@
+// Package usageclient is a typed client for the usage endpoints of the rescue
+// proxy's admin API, for services which consume usage data.
+//
+// The client is stable: it only breaks with a major version of the module. Methods
+// whose doc starts with "Experimental:" call endpoints which may still change, and
+// are exempt until they graduate.
+package usageclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// APIError is returned for responses with an error status.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("usage api returned %d: %s", e.StatusCode, e.Message)
+}
+
+// IsNotFound returns whether err is a 404 from the API.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// IsUnsupported returns whether err is a 501 from the API, returned for features the
+// proxy's usage backend doesn't support. See Client.Capabilities.
+func IsUnsupported(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotImplemented
+}
+
+// Capabilities are the usage model and optional features of the proxy's usage backend.
+type Capabilities struct {
+	Model        string   `json:"model"`
+	Capabilities []string `json:"capabilities"`
+}
+
+// Has returns whether the backend supports capability, e.g. "buckets" or "export".
+func (c *Capabilities) Has(capability string) bool {
+	return slices.Contains(c.Capabilities, capability)
+}
+
+// ValidatorAlias links the usage recorded under Alias to Validator.
+type ValidatorAlias struct {
+	Alias     string    `json:"alias"`
+	Validator string    `json:"validator"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Organization groups the node addresses of an operator running many nodes.
+type Organization struct {
+	ID            string           `json:"id"`
+	Name          string           `json:"name"`
+	RetentionDays int              `json:"retention_days,omitempty"`
+	Members       []common.Address `json:"members"`
+	CreatedAt     time.Time        `json:"created_at"`
+}
+
+// NodeUsage is the usage of the validators attributed to a node address.
+type NodeUsage struct {
+	NodeAddress common.Address `json:"node_address"`
+	Validators  int            `json:"validators"`
+	Seconds     float64        `json:"seconds"`
+}
+
+// OrganizationUsage is the usage of an organization's members in a range.
+type OrganizationUsage struct {
+	Organization string      `json:"organization"`
+	From         time.Time   `json:"from"`
+	To           time.Time   `json:"to"`
+	Seconds      float64     `json:"seconds"`
+	Nodes        []NodeUsage `json:"nodes"`
+}
+
+// DutyCoverageCount counts expected and covered duties.
+type DutyCoverageCount struct {
+	Expected int `json:"expected"`
+	Covered  int `json:"covered"`
+}
+
+// ValidatorDutyCoverage is the coverage of one validator's duties.
+type ValidatorDutyCoverage struct {
+	Validator string            `json:"validator"`
+	Attester  DutyCoverageCount `json:"attester"`
+	Proposer  DutyCoverageCount `json:"proposer"`
+}
+
+// DutyCoverageReport summarizes the coverage of the duties due in [From, To).
+type DutyCoverageReport struct {
+	From       time.Time               `json:"from"`
+	To         time.Time               `json:"to"`
+	Attester   DutyCoverageCount       `json:"attester"`
+	Proposer   DutyCoverageCount       `json:"proposer"`
+	Validators []ValidatorDutyCoverage `json:"validators"`
+}
+
+// UsageExportRecord is a bucket a validator was recorded in, with the cursor of its
+// ingestion.
+type UsageExportRecord struct {
+	Cursor    int64     `json:"cursor"`
+	Bucket    time.Time `json:"bucket"`
+	Validator string    `json:"validator"`
+}
+
+// UsageExport is a page of the records ingested after a cursor, in ingestion order.
+type UsageExport struct {
+	Records []UsageExportRecord `json:"records"`
+	// Cursor to export the next page from
+	Cursor   int64               `json:"cursor"`
+	More     bool                `json:"more"`
+	Manifest UsageExportManifest `json:"manifest"`
+}
+
+// UsageExportManifest describes a page of an export.
+type UsageExportManifest struct {
+	SchemaVersion int           `json:"schema_version"`
+	Since         int64         `json:"since"`
+	Rows          int           `json:"rows"`
+	SHA256        hexutil.Bytes `json:"sha256"`
+}
+
+// Version of the export record format this client understands
+const usageExportSchemaVersion = 1
+
+// ErrIncompleteExport is returned when a page of an export doesn't match its manifest.
+var ErrIncompleteExport = errors.New("export page doesn't match its manifest")
+
+// Verify checks that the records of the page match its manifest, e.g. after reading
+// back a page a pipeline stored.
+func (e *UsageExport) Verify() error {
+	if e.Manifest.SchemaVersion != usageExportSchemaVersion {
+		return fmt.Errorf("%w: unsupported schema version %d", ErrIncompleteExport, e.Manifest.SchemaVersion)
+	}
+	if len(e.Records) != e.Manifest.Rows {
+		return fmt.Errorf("%w: %d records instead of %d", ErrIncompleteExport, len(e.Records), e.Manifest.Rows)
+	}
+	content, err := json.Marshal(e.Records)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	if !bytes.Equal(sum[:], e.Manifest.SHA256) {
+		return fmt.Errorf("%w: records don't match their hash", ErrIncompleteExport)
+	}
+	return nil
+}
+
+// AttestedValidatorUsage is the usage of one validator in an attestation, with the
+// period it was attributed to the node.
+type AttestedValidatorUsage struct {
+	Validator string    `json:"validator"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Seconds   float64   `json:"seconds"`
+}
+
+// UsageAttestation summarizes the usage of an operator over a period.
+type UsageAttestation struct {
+	Version     int                      `json:"version"`
+	NodeAddress common.Address           `json:"node_address"`
+	From        time.Time                `json:"from"`
+	To          time.Time                `json:"to"`
+	GeneratedAt time.Time                `json:"generated_at"`
+	Seconds     float64                  `json:"seconds"`
+	Validators  []AttestedValidatorUsage `json:"validators"`
+}
+
+// SignedUsageAttestation is an attestation with an EIP-191 signature over its compact
+// JSON encoding.
+type SignedUsageAttestation struct {
+	Attestation json.RawMessage `json:"attestation"`
+	Signer      common.Address  `json:"signer"`
+	Signature   hexutil.Bytes   `json:"signature"`
+}
+
+// Version of the attestation format this client understands
+const usageAttestationVersion = 1
+
+// ErrInvalidAttestation is returned when an attestation's signature doesn't match its
+// signer.
+var ErrInvalidAttestation = errors.New("invalid usage attestation")
+
+// Verify checks that the attestation was signed by its claimed signer and returns it,
+// without contacting the proxy. Callers should then check the signer is one they trust.
+func (a *SignedUsageAttestation) Verify() (*UsageAttestation, error) {
+	if len(a.Signature) != crypto.SignatureLength {
+		return nil, fmt.Errorf("%w: signature is %d bytes", ErrInvalidAttestation, len(a.Signature))
+	}
+	var content bytes.Buffer
+	if err := json.Compact(&content, a.Attestation); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	pubkey, err := crypto.SigToPub(accounts.TextHash(content.Bytes()), a.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	if crypto.PubkeyToAddress(*pubkey) != a.Signer {
+		return nil, fmt.Errorf("%w: not signed by %s", ErrInvalidAttestation, a.Signer.Hex())
+	}
+
+	var out UsageAttestation
+	if err := json.Unmarshal(content.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAttestation, err)
+	}
+	if out.Version != usageAttestationVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidAttestation, out.Version)
+	}
+	return &out, nil
+}
+
+// Client calls the admin API at BaseURL.
+type Client struct {
+	BaseURL *url.URL
+	// Sent as a bearer token when set, for admin APIs behind an authenticating proxy
+	Token string
+	// Defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// How many times failed requests are retried, defaults to 3. Negative disables retries.
+	Retries int
+	// Delay before the first retry, doubled for every following one. Defaults to 500ms.
+	Backoff time.Duration
+}
+
+// NewClient creates a Client for the admin API at baseURL, e.g. http://localhost:8000.
+func NewClient(baseURL string) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid usage api url %s", baseURL)
+	}
+
+	return &Client{BaseURL: u}, nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *Client) retries() int {
+	switch {
+	case c.Retries < 0:
+		return 0
+	case c.Retries == 0:
+		return 3
+	}
+	return c.Retries
+}
+
+func (c *Client) backoff() time.Duration {
+	if c.Backoff == 0 {
+		return 500 * time.Millisecond
+	}
+	return c.Backoff
+}
+
+// retryable returns whether a request may succeed if sent again.
+// Every endpoint is idempotent, so only the failure matters.
+func retryable(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return true
+	}
+	return apiErr.StatusCode >= 500 && apiErr.StatusCode != http.StatusNotImplemented
+}
+
+// do sends a request and decodes the JSON response into out, if not nil.
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body any, out any) error {
+	u := c.BaseURL.JoinPath(path)
+	u.RawQuery = query.Encode()
+
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	delay := c.backoff()
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, method, u.String(), payload, out)
+		if err == nil || attempt >= c.retries() || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method string, u string, payload []byte, out any) error {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &APIError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func rangeQuery(from time.Time, to time.Time) url.Values {
+	return url.Values{
+		"from": {from.UTC().Format(time.RFC3339)},
+		"to":   {to.UTC().Format(time.RFC3339)},
+	}
+}
+
+// Usage returns the usage of every validator in the buckets overlapping [from, to],
+// with the usage of aliases merged into their validators.
+func (c *Client) Usage(ctx context.Context, from time.Time, to time.Time) (map[string]time.Duration, error) {
+	return c.usage(ctx, rangeQuery(from, to))
+}
+
+// UnlinkedUsage is Usage without merging aliases into their validators.
+func (c *Client) UnlinkedUsage(ctx context.Context, from time.Time, to time.Time) (map[string]time.Duration, error) {
+	query := rangeQuery(from, to)
+	query.Set("aliases", "false")
+	return c.usage(ctx, query)
+}
+
+func (c *Client) usage(ctx context.Context, query url.Values) (map[string]time.Duration, error) {
+	var seconds map[string]float64
+	if err := c.do(ctx, http.MethodGet, "/usage", query, nil, &seconds); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]time.Duration, len(seconds))
+	for validator, s := range seconds {
+		out[validator] = time.Duration(s * float64(time.Second))
+	}
+	return out, nil
+}
+
+// UsageWindows calls fn with the usage of every window of length step in [from, to),
+// oldest first, so long ranges are fetched a window at a time.
+// step must be a multiple of the tracker's precision and from aligned to it, or
+// buckets straddling windows are counted in both.
+func (c *Client) UsageWindows(ctx context.Context, from time.Time, to time.Time, step time.Duration, fn func(start time.Time, usage map[string]time.Duration) error) error {
+	if step < time.Second {
+		return fmt.Errorf("invalid step %s", step)
+	}
+
+	for start := from; start.Before(to); start = start.Add(step) {
+		end := start.Add(step)
+		if end.After(to) {
+			end = to
+		}
+		// The range is inclusive and has second precision
+		usage, err := c.Usage(ctx, start, end.Add(-time.Second))
+		if err != nil {
+			return err
+		}
+		if err := fn(start, usage); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// TimeRange is a range usage is viewed over, the buckets overlapping [From, To].
+type TimeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// RangeUsage is the usage of every validator over a range.
+type RangeUsage struct {
+	TimeRange
+	Usage map[string]time.Duration
+}
+
+// UsageRanges returns the usage of every validator over each of ranges, in order, with
+// the usage of aliases merged into their validators. It's a single request, where Usage
+// would need one per range.
+func (c *Client) UsageRanges(ctx context.Context, ranges []TimeRange) ([]RangeUsage, error) {
+	query := url.Values{}
+	for _, r := range ranges {
+		query.Add("range", r.From.UTC().Format(time.RFC3339)+"/"+r.To.UTC().Format(time.RFC3339))
+	}
+	var usages []struct {
+		TimeRange
+		Usage map[string]float64 `json:"usage"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/usage/ranges", query, nil, &usages); err != nil {
+		return nil, err
+	}
+
+	out := make([]RangeUsage, 0, len(usages))
+	for _, usage := range usages {
+		durations := make(map[string]time.Duration, len(usage.Usage))
+		for validator, s := range usage.Usage {
+			durations[validator] = time.Duration(s * float64(time.Second))
+		}
+		out = append(out, RangeUsage{TimeRange: usage.TimeRange, Usage: durations})
+	}
+	return out, nil
+}
+
+// DutyCoverage summarizes the coverage of the duties due in [from, to).
+func (c *Client) DutyCoverage(ctx context.Context, from time.Time, to time.Time) (*DutyCoverageReport, error) {
+	out := &DutyCoverageReport{}
+	if err := c.do(ctx, http.MethodGet, "/usage/duties", rangeQuery(from, to), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ExportSince returns up to limit usage records ingested after cursor, 0 for all.
+// A limit of 0 leaves the page size to the server.
+func (c *Client) ExportSince(ctx context.Context, cursor int64, limit int) (*UsageExport, error) {
+	query := url.Values{"since": {strconv.FormatInt(cursor, 10)}}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	out := &UsageExport{}
+	if err := c.do(ctx, http.MethodGet, "/usage/export", query, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ExportAll calls fn with every page of records ingested after cursor until none are
+// left, and returns the cursor to resume from next time. Pages are only fetched once fn
+// returns, so a pipeline can persist the cursor of each page it has stored.
+func (c *Client) ExportAll(ctx context.Context, cursor int64, fn func(page *UsageExport) error) (int64, error) {
+	for {
+		page, err := c.ExportSince(ctx, cursor, 0)
+		if err != nil {
+			return cursor, err
+		}
+		if len(page.Records) > 0 {
+			if err := fn(page); err != nil {
+				return cursor, err
+			}
+		}
+		cursor = page.Cursor
+		if !page.More {
+			return cursor, nil
+		}
+	}
+}
+
+// Aliases returns every validator alias.
+func (c *Client) Aliases(ctx context.Context) ([]ValidatorAlias, error) {
+	var out []ValidatorAlias
+	if err := c.do(ctx, http.MethodGet, "/validators/aliases", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PutAlias makes alias an alias of validator.
+func (c *Client) PutAlias(ctx context.Context, alias string, validator string) (*ValidatorAlias, error) {
+	body := struct {
+		Validator string `json:"validator"`
+	}{validator}
+
+	out := &ValidatorAlias{}
+	if err := c.do(ctx, http.MethodPut, "/validators/"+url.PathEscape(alias)+"/alias", nil, body, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteAlias removes an alias.
+func (c *Client) DeleteAlias(ctx context.Context, alias string) error {
+	return c.do(ctx, http.MethodDelete, "/validators/"+url.PathEscape(alias)+"/alias", nil, nil, nil)
+}
+
+// Organizations returns every organization, without members.
+func (c *Client) Organizations(ctx context.Context) ([]*Organization, error) {
+	var out []*Organization
+	if err := c.do(ctx, http.MethodGet, "/organizations", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Organization returns an organization with its members.
+func (c *Client) Organization(ctx context.Context, id string) (*Organization, error) {
+	out := &Organization{}
+	if err := c.do(ctx, http.MethodGet, "/organizations/"+url.PathEscape(id), nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PutOrganization creates or updates the name and retention of an organization.
+func (c *Client) PutOrganization(ctx context.Context, org *Organization) (*Organization, error) {
+	body := struct {
+		Name          string `json:"name"`
+		RetentionDays int    `json:"retention_days"`
+	}{org.Name, org.RetentionDays}
+
+	out := &Organization{}
+	if err := c.do(ctx, http.MethodPut, "/organizations/"+url.PathEscape(org.ID), nil, body, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteOrganization removes an organization and its memberships.
+func (c *Client) DeleteOrganization(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/organizations/"+url.PathEscape(id), nil, nil, nil)
+}
+
+// AddMember adds a node address to an organization, moving it out of its previous one.
+func (c *Client) AddMember(ctx context.Context, id string, node common.Address) error {
+	return c.do(ctx, http.MethodPut, "/organizations/"+url.PathEscape(id)+"/members/"+node.Hex(), nil, nil, nil)
+}
+
+// RemoveMember removes a node address from an organization.
+func (c *Client) RemoveMember(ctx context.Context, id string, node common.Address) error {
+	return c.do(ctx, http.MethodDelete, "/organizations/"+url.PathEscape(id)+"/members/"+node.Hex(), nil, nil, nil)
+}
+
+// OrganizationUsage returns the usage of an organization's members in the buckets
+// overlapping [from, to].
+func (c *Client) OrganizationUsage(ctx context.Context, id string, from time.Time, to time.Time) (*OrganizationUsage, error) {
+	out := &OrganizationUsage{}
+	if err := c.do(ctx, http.MethodGet, "/organizations/"+url.PathEscape(id)+"/usage", rangeQuery(from, to), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Attestation returns a signed attestation of the usage of node in the buckets
+// overlapping [from, to], see SignedUsageAttestation.Verify.
+func (c *Client) Attestation(ctx context.Context, node common.Address, from time.Time, to time.Time) (*SignedUsageAttestation, error) {
+	out := &SignedUsageAttestation{}
+	if err := c.do(ctx, http.MethodGet, "/operators/"+node.Hex()+"/attestation", rangeQuery(from, to), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Capabilities returns the optional features of the proxy's usage backend, so
+// unsupported features can be skipped instead of failing.
+func (c *Client) Capabilities(ctx context.Context) (*Capabilities, error) {
+	out := &Capabilities{}
+	if err := c.do(ctx, http.MethodGet, "/usage/capabilities", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,315 @@
+package usageclient
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func setup(t *testing.T, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	c, err := NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func TestNewClient(t *testing.T) {
+	if _, err := NewClient("localhost:8000"); err == nil {
+		t.Fatal("Expected an error for a url without scheme")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	c := setup(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/usage" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("Unexpected authorization %q", r.Header.Get("Authorization"))
+		}
+		query := r.URL.Query()
+		if query.Get("from") != "2025-01-01T00:00:00Z" || query.Get("to") != "2025-01-01T01:00:00Z" {
+			t.Errorf("Unexpected range %s", r.URL.RawQuery)
+		}
+		if query.Get("aliases") != "" {
+			t.Errorf("Unexpected aliases %s", query.Get("aliases"))
+		}
+		_, _ = w.Write([]byte(`{"1": 300, "2": 0.5}`))
+	})
+	c.Token = "secret"
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	usage, err := c.Usage(context.Background(), start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage["1"] != 5*time.Minute || usage["2"] != 500*time.Millisecond {
+		t.Fatalf("Unexpected usage %v", usage)
+	}
+}
+
+func TestUsageRanges(t *testing.T) {
+	c := setup(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/usage/ranges" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		if ranges := r.URL.Query()["range"]; len(ranges) != 2 || ranges[1] != "2025-02-01T00:00:00Z/2025-02-28T23:59:59Z" {
+			t.Errorf("Unexpected ranges %v", ranges)
+		}
+		_, _ = w.Write([]byte(`[
+			{"from": "2025-01-01T00:00:00Z", "to": "2025-01-31T23:59:59Z", "usage": {"1": 300}},
+			{"from": "2025-02-01T00:00:00Z", "to": "2025-02-28T23:59:59Z", "usage": {}}
+		]`))
+	})
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ranges := []TimeRange{
+		{From: start, To: start.AddDate(0, 1, 0).Add(-time.Second)},
+		{From: start.AddDate(0, 1, 0), To: start.AddDate(0, 2, 0).Add(-time.Second)},
+	}
+	usages, err := c.UsageRanges(context.Background(), ranges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 2 || !usages[1].From.Equal(ranges[1].From) || usages[0].Usage["1"] != 5*time.Minute || len(usages[1].Usage) != 0 {
+		t.Fatalf("Unexpected usage %v", usages)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var calls atomic.Int32
+	c := setup(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`[]`))
+	})
+
+	if _, err := c.Aliases(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 3 {
+		t.Fatalf("Expected 3 calls, got %d", calls.Load())
+	}
+
+	calls.Store(0)
+	c.Retries = -1
+	if _, err := c.Aliases(context.Background()); err == nil {
+		t.Fatal("Expected an error without retries")
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("Expected a single call, got %d", calls.Load())
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	var calls atomic.Int32
+	c := setup(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.URL.Path != "/organizations/acme" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		http.Error(w, "no such organization", http.StatusNotFound)
+	})
+
+	_, err := c.Organization(context.Background(), "acme")
+	if !IsNotFound(err) {
+		t.Fatalf("Expected a 404, got %v", err)
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("Expected 404s not to be retried, got %d calls", calls.Load())
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	c := setup(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/usage/capabilities":
+			json.NewEncoder(w).Encode(Capabilities{Model: "sessions", Capabilities: []string{"health_check", "sql"}})
+		default:
+			http.Error(w, "daily usage is unsupported by the usage tracker", http.StatusNotImplemented)
+		}
+	})
+
+	caps, err := c.Capabilities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Model != "sessions" || !caps.Has("sql") || caps.Has("export") {
+		t.Fatalf("Unexpected capabilities %+v", caps)
+	}
+
+	_, err = c.ExportSince(context.Background(), 0, 0)
+	if !IsUnsupported(err) {
+		t.Fatalf("Expected a 501, got %v", err)
+	}
+}
+
+func TestPutOrganization(t *testing.T) {
+	node := common.HexToAddress("0x1234567890123456789012345678901234567890")
+	c := setup(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.URL.Path != "/organizations/acme" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if body["name"] != "ACME" || body["retention_days"] != float64(30) {
+			t.Errorf("Unexpected body %v", body)
+		}
+		_ = json.NewEncoder(w).Encode(Organization{ID: "acme", Name: "ACME", RetentionDays: 30, Members: []common.Address{node}})
+	})
+
+	org, err := c.PutOrganization(context.Background(), &Organization{ID: "acme", Name: "ACME", RetentionDays: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if org.RetentionDays != 30 || len(org.Members) != 1 || org.Members[0] != node {
+		t.Fatalf("Unexpected organization %+v", org)
+	}
+}
+
+func TestUsageWindows(t *testing.T) {
+	var ranges []string
+	c := setup(t, func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.URL.Query().Get("from")+"/"+r.URL.Query().Get("to"))
+		_, _ = w.Write([]byte(`{"1": 60}`))
+	})
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var total time.Duration
+	err := c.UsageWindows(context.Background(), start, start.Add(90*time.Minute), time.Hour, func(_ time.Time, usage map[string]time.Duration) error {
+		total += usage["1"]
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"2025-01-01T00:00:00Z/2025-01-01T00:59:59Z",
+		"2025-01-01T01:00:00Z/2025-01-01T01:29:59Z",
+	}
+	if len(ranges) != len(expected) || ranges[0] != expected[0] || ranges[1] != expected[1] {
+		t.Fatalf("Unexpected windows %v", ranges)
+	}
+	if total != 2*time.Minute {
+		t.Fatalf("Unexpected total %v", total)
+	}
+}
+
+func TestExportAll(t *testing.T) {
+	pages := map[string]string{
+		"0": `{"records": [{"cursor": 1, "bucket": "2025-01-01T00:00:00Z", "validator": "1"}, {"cursor": 2, "bucket": "2025-01-01T00:00:00Z", "validator": "2"}], "cursor": 2, "more": true}`,
+		"2": `{"records": [{"cursor": 5, "bucket": "2024-12-31T23:55:00Z", "validator": "3"}], "cursor": 5, "more": false}`,
+	}
+	c := setup(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/usage/export" {
+			t.Errorf("Unexpected path %s", r.URL.Path)
+		}
+		page, ok := pages[r.URL.Query().Get("since")]
+		if !ok {
+			t.Errorf("Unexpected cursor %s", r.URL.RawQuery)
+		}
+		_, _ = w.Write([]byte(page))
+	})
+
+	var validators []string
+	cursor, err := c.ExportAll(context.Background(), 0, func(page *UsageExport) error {
+		for _, record := range page.Records {
+			validators = append(validators, record.Validator)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != 5 || len(validators) != 3 || validators[2] != "3" {
+		t.Fatalf("Unexpected export of %v up to %d", validators, cursor)
+	}
+}
+
+func TestUsageExportVerify(t *testing.T) {
+	page := &UsageExport{
+		Records: []UsageExportRecord{
+			{Cursor: 1, Bucket: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), Validator: "1"},
+			{Cursor: 2, Bucket: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), Validator: "2"},
+		},
+		Cursor: 2,
+	}
+	records, err := json.Marshal(page.Records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(records)
+	page.Manifest = UsageExportManifest{SchemaVersion: 1, Rows: 2, SHA256: sum[:]}
+	if err := page.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	page.Records[1].Validator = "3"
+	if err := page.Verify(); !errors.Is(err, ErrIncompleteExport) {
+		t.Fatal("Expected ErrIncompleteExport for a modified record, got", err)
+	}
+	page.Records = page.Records[:1]
+	if err := page.Verify(); !errors.Is(err, ErrIncompleteExport) {
+		t.Fatal("Expected ErrIncompleteExport for a missing record, got", err)
+	}
+}
+
+func TestAttestationVerify(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte(`{"version":1,"node_address":"0x0100000000000000000000000000000000000000","from":"2025-01-01T00:00:00Z","to":"2025-02-01T00:00:00Z","generated_at":"2025-02-01T00:00:00Z","seconds":300,"validators":[{"validator":"1","first_seen":"2025-01-01T00:00:00Z","last_seen":"2025-01-02T00:00:00Z","seconds":300}]}`)
+	signature, err := crypto.Sign(accounts.TextHash(content), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := common.Address{1}
+	c := setup(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/operators/"+node.Hex()+"/attestation" || r.URL.Query().Get("from") != "2025-01-01T00:00:00Z" {
+			t.Errorf("Unexpected request %s", r.URL)
+		}
+		_ = json.NewEncoder(w).Encode(SignedUsageAttestation{
+			Attestation: content,
+			Signer:      crypto.PubkeyToAddress(key.PublicKey),
+			Signature:   signature,
+		})
+	})
+
+	signed, err := c.Attestation(context.Background(), node, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attestation, err := signed.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attestation.NodeAddress != node || attestation.Seconds != 300 || len(attestation.Validators) != 1 {
+		t.Fatalf("Unexpected attestation %+v", attestation)
+	}
+
+	signed.Signer = common.Address{2}
+	if _, err := signed.Verify(); !errors.Is(err, ErrInvalidAttestation) {
+		t.Fatal("Expected ErrInvalidAttestation for another signer, got", err)
+	}
+}
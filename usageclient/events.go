@@ -0,0 +1,116 @@
+package usageclient
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// UsageEvent is a line of the proxy's -usage-event-log.
+//
+// Events are delivered at least once: a validator produces an event for every
+// request in a bucket, log shippers may resend lines, and several proxy instances
+// may record the same validator. Consumers should deduplicate events by their Key,
+// (bucket, validator, instance), and count usage by distinct (bucket, validator),
+// which is how the proxy's own tracker counts it. Events of the sessions usage model
+// have no bucket and are keyed by their time instead.
+type UsageEvent struct {
+	Time      time.Time       `json:"time"`
+	Bucket    *time.Time      `json:"bucket,omitempty"`
+	Validator string          `json:"validator"`
+	Node      *common.Address `json:"node,omitempty"`
+	Instance  string          `json:"instance,omitempty"`
+	Kind      string          `json:"kind,omitempty"`
+	Tier      string          `json:"tier,omitempty"`
+}
+
+// EventKey identifies the deliveries of the same usage.
+type EventKey struct {
+	Bucket    time.Time
+	Validator string
+	Instance  string
+}
+
+// Key returns the key events are deduplicated by.
+func (e *UsageEvent) Key() EventKey {
+	bucket := e.Time
+	if e.Bucket != nil {
+		bucket = *e.Bucket
+	}
+	return EventKey{Bucket: bucket.UTC(), Validator: e.Validator, Instance: e.Instance}
+}
+
+// Deduplicator drops redelivered events.
+// It remembers keys for Horizon past the newest bucket it has seen, so its memory
+// is bounded by the number of validators active within Horizon.
+// Events older than that can't be told apart from duplicates and are dropped,
+// so Horizon must exceed the longest redelivery delay.
+type Deduplicator struct {
+	Horizon time.Duration
+
+	seen   map[EventKey]struct{}
+	newest time.Time
+	late   int
+}
+
+// NewDeduplicator creates a Deduplicator remembering keys for horizon.
+func NewDeduplicator(horizon time.Duration) *Deduplicator {
+	return &Deduplicator{
+		Horizon: horizon,
+		seen:    make(map[EventKey]struct{}),
+	}
+}
+
+// Add returns whether e is the first delivery of its key.
+func (d *Deduplicator) Add(e UsageEvent) bool {
+	key := e.Key()
+	if key.Bucket.Before(d.newest.Add(-d.Horizon)) {
+		d.late++
+		return false
+	}
+	if _, ok := d.seen[key]; ok {
+		return false
+	}
+	d.seen[key] = struct{}{}
+
+	if key.Bucket.After(d.newest) {
+		d.newest = key.Bucket
+		cutoff := d.newest.Add(-d.Horizon)
+		for k := range d.seen {
+			if k.Bucket.Before(cutoff) {
+				delete(d.seen, k)
+			}
+		}
+	}
+
+	return true
+}
+
+// Late returns how many events were dropped for being older than the horizon.
+func (d *Deduplicator) Late() int {
+	return d.late
+}
+
+// UsageFromEvents returns the usage of every validator in events of a bucketed
+// usage model with the given precision. A bucket counts once per validator, however
+// many instances recorded it. Events without a bucket are ignored.
+func UsageFromEvents(events []UsageEvent, precision time.Duration) map[string]time.Duration {
+	type bucketKey struct {
+		bucket    int64
+		validator string
+	}
+	seen := make(map[bucketKey]struct{})
+	out := make(map[string]time.Duration)
+	for _, e := range events {
+		if e.Bucket == nil {
+			continue
+		}
+		key := bucketKey{bucket: e.Bucket.Unix(), validator: e.Validator}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		out[e.Validator] += precision
+	}
+	return out
+}
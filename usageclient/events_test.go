@@ -0,0 +1,71 @@
+package usageclient
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func bucketEvent(bucket time.Time, validator string, instance string) UsageEvent {
+	return UsageEvent{Time: bucket.Add(time.Minute), Bucket: &bucket, Validator: validator, Instance: instance}
+}
+
+func TestUsageEventJSON(t *testing.T) {
+	line := `{"time":"2025-01-01T00:01:00Z","bucket":"2025-01-01T00:00:00Z","validator":"1","node":"0x1234567890123456789012345678901234567890","instance":"proxy-a"}`
+	var e UsageEvent
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	expected := EventKey{Bucket: start, Validator: "1", Instance: "proxy-a"}
+	if e.Key() != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, e.Key())
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := NewDeduplicator(time.Hour)
+
+	for _, c := range []struct {
+		event    UsageEvent
+		expected bool
+	}{
+		{bucketEvent(start, "1", "a"), true},
+		{bucketEvent(start, "1", "a"), false},
+		// Another instance or validator is another key
+		{bucketEvent(start, "1", "b"), true},
+		{bucketEvent(start, "2", "a"), true},
+		{bucketEvent(start.Add(2*time.Hour), "1", "a"), true},
+		// Older than the horizon
+		{bucketEvent(start.Add(30*time.Minute), "1", "a"), false},
+		{bucketEvent(start.Add(90*time.Minute), "1", "a"), true},
+	} {
+		if d.Add(c.event) != c.expected {
+			t.Fatalf("Expected Add(%+v) to be %v", c.event.Key(), c.expected)
+		}
+	}
+
+	if d.Late() != 1 {
+		t.Fatalf("Expected 1 late event, got %d", d.Late())
+	}
+	if len(d.seen) != 2 {
+		t.Fatalf("Expected keys older than the horizon to be evicted, got %v", d.seen)
+	}
+}
+
+func TestUsageFromEvents(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	usage := UsageFromEvents([]UsageEvent{
+		bucketEvent(start, "1", "a"),
+		bucketEvent(start, "1", "b"),
+		bucketEvent(start.Add(5*time.Minute), "1", "a"),
+		bucketEvent(start, "2", "a"),
+		{Time: start, Validator: "3"},
+	}, 5*time.Minute)
+
+	if len(usage) != 2 || usage["1"] != 10*time.Minute || usage["2"] != 5*time.Minute {
+		t.Fatalf("Unexpected usage %v", usage)
+	}
+}